@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apiutil"
+)
+
+// benchArgs is intended as args for func bench.
+type benchArgs struct {
+	// URL is the full url of the "/cmd/knn" endpoint of a running api server,
+	// e.g "http://localhost:8080/cmd/knn".
+	URL string
+	// Dim is the dimension of the random query vecs, which should match
+	// the dimension of the vecs in KNNArgs.Namespace.
+	Dim int
+	// N is the number of queries to issue.
+	N int
+	// QPS is the target rate of queries per second. 0 means no pacing, i.e
+	// as fast as Concurrency allows.
+	QPS float64
+	// Concurrency is the max number of concurrent queries.
+	Concurrency int
+	// Recall true will issue an exhaustive query (extent 1, no accept or
+	// reject thresholds) for each query, which is used as ground truth for
+	// computing recall. These are not included in the latency stats.
+	Recall bool
+	// KNNArgs is used for all queries.
+	KNNArgs apiutil.KNNArgsPartial
+	// Client is used for the requests. Uses http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Ok returns true if all the minimum requirements are met, specifically:
+// - args.URL != ""
+// - args.Dim > 0
+// - args.N > 0
+// - args.QPS >= 0
+// - args.Concurrency > 0
+// - args.KNNArgs.K > 0
+func (args *benchArgs) Ok() bool {
+	ok := true
+	ok = ok && args.URL != ""
+	ok = ok && args.Dim > 0
+	ok = ok && args.N > 0
+	ok = ok && args.QPS >= 0
+	ok = ok && args.Concurrency > 0
+	ok = ok && args.KNNArgs.K > 0
+	return ok
+}
+
+// benchResult is the result of func bench.
+type benchResult struct {
+	// Queries is the number of queries that were issued.
+	Queries int
+	// Failed is the number of queries with a failed request (e.g network
+	// errors or a non-200 status such as when the cluster rejects queries
+	// due to TTL).
+	Failed int
+	// Empty is the number of successful queries without any results.
+	Empty int
+	// Latencies are the (sorted) round-trip latencies of successful queries.
+	Latencies []time.Duration
+	// Recall is the average recall of the queries with ground truth, i.e the
+	// fraction of exhaustive-search results also found by the query. Only set
+	// with benchArgs.Recall.
+	Recall float64
+	// RecallN is the number of queries used for Recall.
+	RecallN int
+	// Duration is the wall time of the entire benchmark.
+	Duration time.Duration
+}
+
+// Percentile returns the latency at the given percentile p, in range [0, 100].
+// Returns 0 if there are no latencies.
+func (r *benchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(r.Latencies)-1))
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// Mean returns the mean latency, 0 if there are no latencies.
+func (r *benchResult) Mean() time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, l := range r.Latencies {
+		sum += l
+	}
+	return sum / time.Duration(len(r.Latencies))
+}
+
+// QPS returns the achieved rate of successful queries per second.
+func (r *benchResult) QPS() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(len(r.Latencies)) / r.Duration.Seconds()
+}
+
+// String returns a human-readable summary of the benchmark.
+func (r *benchResult) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "queries: %d (failed %d, empty %d) in %v (%.1f qps)\n",
+		r.Queries, r.Failed, r.Empty, r.Duration, r.QPS())
+	fmt.Fprintf(&sb, "latency: mean %v, p50 %v, p90 %v, p99 %v, max %v",
+		r.Mean(), r.Percentile(50), r.Percentile(90), r.Percentile(99),
+		r.Percentile(100))
+	if r.RecallN > 0 {
+		fmt.Fprintf(&sb, "\nrecall: %.3f (%d queries)", r.Recall, r.RecallN)
+	}
+	return sb.String()
+}
+
+// queryResult is the result of a single query.
+type queryResult struct {
+	ok      bool
+	latency time.Duration
+	vecs    [][]float64
+}
+
+// query does a single KNN query against the "/cmd/knn" endpoint at 'url'.
+func query(client *http.Client, url string, args apiutil.KNNArgs) queryResult {
+	start := time.Now()
+	resps, err := apiutil.Post[[]apiutil.KNNResp](client, url, args)
+	latency := time.Since(start)
+	if err != nil || len(resps) != 1 {
+		return queryResult{}
+	}
+
+	vecs := make([][]float64, 0, len(resps[0].Results))
+	for _, result := range resps[0].Results {
+		vecs = append(vecs, result.Payload.Vec)
+	}
+	return queryResult{ok: true, latency: latency, vecs: vecs}
+}
+
+// recall returns the fraction of 'truth' that is also in 'found'.
+// Returns false if 'truth' is empty.
+func recall(found, truth [][]float64) (float64, bool) {
+	if len(truth) == 0 {
+		return 0, false
+	}
+	key := func(v []float64) string { return fmt.Sprint(v) }
+	set := make(map[string]bool, len(found))
+	for _, v := range found {
+		set[key(v)] = true
+	}
+
+	n := 0
+	for _, v := range truth {
+		if set[key(v)] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(truth)), true
+}
+
+// bench issues args.N random KNN queries (see benchArgs for details) and
+// collects latency and (optionally) recall stats. Returns an error only if
+// args.Ok() == false.
+func bench(args benchArgs) (benchResult, error) {
+	if !args.Ok() {
+		return benchResult{}, errors.New("invalid bench args")
+	}
+	client := args.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// Ground truth args; exhaustive search.
+	truthArgs := args.KNNArgs
+	truthArgs.Extent = 1
+	truthArgs.Accept = math.MaxFloat64
+	truthArgs.Reject = -math.MaxFloat64
+	if truthArgs.Ascending {
+		truthArgs.Accept, truthArgs.Reject = truthArgs.Reject, truthArgs.Accept
+	}
+
+	start := time.Now()
+	result := benchResult{}
+	mx := sync.Mutex{}
+
+	jobs := make(chan []float64)
+	wg := sync.WaitGroup{}
+	wg.Add(args.Concurrency)
+	for i := 0; i < args.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for vec := range jobs {
+				vecs := [][]float64{vec}
+				r := query(client, args.URL, apiutil.KNNArgs{
+					QueryVecs: vecs,
+					Args:      args.KNNArgs,
+				})
+
+				var truth queryResult
+				if r.ok && args.Recall {
+					truth = query(client, args.URL, apiutil.KNNArgs{
+						QueryVecs: vecs,
+						Args:      truthArgs,
+					})
+				}
+
+				mx.Lock()
+				result.Queries++
+				switch {
+				case !r.ok:
+					result.Failed++
+				case len(r.vecs) == 0:
+					result.Empty++
+					fallthrough
+				default:
+					result.Latencies = append(result.Latencies, r.latency)
+				}
+				if rec, ok := recall(r.vecs, truth.vecs); ok && truth.ok {
+					// Running mean.
+					result.RecallN++
+					result.Recall += (rec - result.Recall) / float64(result.RecallN)
+				}
+				mx.Unlock()
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if args.QPS > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / args.QPS))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := 0; i < args.N; i++ {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+		vec := make([]float64, args.Dim)
+		for j := range vec {
+			vec[j] = rand.Float64()
+		}
+		jobs <- vec
+	}
+	close(jobs)
+	wg.Wait()
+
+	result.Duration = time.Since(start)
+	sort.Slice(result.Latencies, func(i, j int) bool {
+		return result.Latencies[i] < result.Latencies[j]
+	})
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apitest"
+	"github.com/crunchypi/ddrop/cmd/internal/apiutil"
+	rman "github.com/crunchypi/ddrop/service/requestman"
+)
+
+// fill adds 'n' random vecs with dimension 'dim' into namespace 'ns'.
+func fill(t *testing.T, addr, ns string, n, dim int) {
+	items := make([]apiutil.AddDataArgs, n)
+	for i := range items {
+		vec := make([]float64, dim)
+		for j := range vec {
+			vec[j] = rand.Float64()
+		}
+		items[i] = apiutil.AddDataArgs{Namespace: ns, Vec: vec}
+	}
+
+	url := fmt.Sprintf("http://%s/cmd/add", addr)
+	_, err := apiutil.Post[apiutil.AddDataResp](nil, url, items)
+	if err != nil {
+		t.Fatal("could not add data:", err)
+	}
+	if l := apitest.TotalLen(t, addr, ns); l != n {
+		t.Fatal("unexpected len after fill:", l)
+	}
+}
+
+func TestBench(t *testing.T) {
+	apitest.WithCluster(t, func(addr string) {
+		ns, dim := "test", 5
+		fill(t, addr, ns, 500, dim)
+
+		n := 20
+		result, err := bench(benchArgs{
+			URL:         fmt.Sprintf("http://%s/cmd/knn", addr),
+			Dim:         dim,
+			N:           n,
+			QPS:         200,
+			Concurrency: 2,
+			Recall:      true,
+			KNNArgs: apiutil.KNNArgsPartial{
+				Namespace: ns,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         3,
+				Extent:    1,
+				Accept:    0,
+				Reject:    1e9,
+				TTL:       time.Second * 10,
+			},
+		})
+
+		if err != nil {
+			t.Fatal("unexpected err:", err)
+		}
+		if result.Queries != n || result.Failed != 0 || result.Empty != 0 {
+			t.Fatal("unexpected result:", result.String())
+		}
+		if len(result.Latencies) != n || result.Percentile(50) <= 0 {
+			t.Fatal("unexpected latencies:", result.String())
+		}
+		// Extent 1 without thresholds is exhaustive, same as the ground truth.
+		if result.RecallN != n || result.Recall != 1 {
+			t.Fatal("unexpected recall:", result.String())
+		}
+		// 20 queries at 200 qps should take at least ~95ms.
+		if result.Duration < time.Millisecond*90 {
+			t.Fatal("qps target not respected:", result.Duration)
+		}
+	})
+
+	args := benchArgs{URL: "x", Dim: 1, N: 1, Concurrency: 1}
+	if _, err := bench(args); err == nil {
+		t.Fatal("expected err with K=0")
+	}
+}
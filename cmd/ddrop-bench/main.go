@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apiutil"
+	rman "github.com/crunchypi/ddrop/service/requestman"
+)
+
+func main() {
+	flag.Usage = func() {
+		s := "---------------------------------------------------\n"
+		s += "ddrop\n"
+		s += "For benchmarking distributed recommendation systems.\n"
+		s += "See https://github.com/crunchypi/ddrop\n"
+		s += "\n"
+		s += "This build is for benchmarking KNN queries against a\n"
+		s += "running cluster, through the /cmd/knn endpoint of the\n"
+		s += "http server. Random query vectors are used, and a \n"
+		s += "summary of latency percentiles (and optionally recall)\n"
+		s += "is printed when done.\n"
+		s += "\n"
+		s += "Args:\n"
+		fmt.Fprintf(os.Stderr, s)
+		flag.PrintDefaults()
+	}
+
+	addr := flag.String("addr", "localhost:8080",
+		"Specify the http server address",
+	)
+	ns := flag.String("ns", "default",
+		"Specify the namespace to query",
+	)
+	dim := flag.Int("dim", 0,
+		"Specify the dimension of the vectors in the namespace",
+	)
+	n := flag.Int("n", 1000,
+		"Specify the number of queries",
+	)
+	qps := flag.Float64("qps", 0,
+		"Specify the target queries per second, 0 for no limit",
+	)
+	concurrency := flag.Int("concurrency", 4,
+		"Specify the number of concurrent queries",
+	)
+	recall := flag.Bool("recall", false,
+		"Compute recall against an exhaustive query (extra query each)",
+	)
+	cosine := flag.Bool("cosine", false,
+		"Use cosine similarity instead of Euclidean distance",
+	)
+	k := flag.Int("k", 10, "Specify the k in KNN")
+	extent := flag.Float64("extent", 1, "Specify the search extent, (0, 1]")
+	accept := flag.Float64("accept", 0,
+		"Specify the accept threshold (default 0, or 1 with -cosine)",
+	)
+	reject := flag.Float64("reject", 1e9,
+		"Specify the reject threshold (default 1e9, or -1 with -cosine)",
+	)
+	ttl := flag.Duration("ttl", time.Second, "Specify the query TTL")
+	priority := flag.Int("priority", 1, "Specify the query priority")
+
+	flag.Parse()
+
+	// Keeps track of explicitly set flags, for defaults that depend on -cosine.
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	knnArgs := apiutil.KNNArgsPartial{
+		Namespace: *ns,
+		Priority:  *priority,
+		KNNMethod: rman.KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         *k,
+		Extent:    *extent,
+		Accept:    *accept,
+		Reject:    *reject,
+		TTL:       *ttl,
+	}
+	if *cosine {
+		knnArgs.KNNMethod = rman.KNNMethodCosineSimilarity
+		knnArgs.Ascending = false
+		if !set["accept"] {
+			knnArgs.Accept = 1
+		}
+		if !set["reject"] {
+			knnArgs.Reject = -1
+		}
+	}
+
+	result, err := bench(benchArgs{
+		URL:         fmt.Sprintf("http://%s/cmd/knn", *addr),
+		Dim:         *dim,
+		N:           *n,
+		QPS:         *qps,
+		Concurrency: *concurrency,
+		Recall:      *recall,
+		KNNArgs:     knnArgs,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err, "(see -h)")
+		os.Exit(1)
+	}
+
+	fmt.Println(result.String())
+}
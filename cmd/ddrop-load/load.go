@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apiutil"
+)
+
+// loadArgs is intended as args for func load.
+type loadArgs struct {
+	// URL is the full url of the "/cmd/add" endpoint of a running api server,
+	// e.g "http://localhost:8080/cmd/add".
+	URL string
+	// Namespace is used for all vecs, unless a line specifies its own.
+	Namespace string
+	// BatchSize is the max number of vecs sent with each request.
+	BatchSize int
+	// Concurrency is the number of concurrent requests.
+	Concurrency int
+	// Client is used for the requests. Uses http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Ok returns true if all the minimum requirements are met, specifically:
+// - args.URL != ""
+// - args.Namespace != ""
+// - args.BatchSize > 0
+// - args.Concurrency > 0
+func (args *loadArgs) Ok() bool {
+	ok := true
+	ok = ok && args.URL != ""
+	ok = ok && args.Namespace != ""
+	ok = ok && args.BatchSize > 0
+	ok = ok && args.Concurrency > 0
+	return ok
+}
+
+// loadResult is the result of func load.
+type loadResult struct {
+	// Read is the number of vecs read from the input.
+	Read int64
+	// Added is the number of vecs that were confirmed added by the cluster.
+	Added int64
+	// Failed is the number of vecs that were sent but not added, either
+	// because of a rejection or a failed request.
+	Failed int64
+	// Duration is the wall time of the entire load.
+	Duration time.Duration
+}
+
+// Throughput returns the number of added vecs per second.
+func (r loadResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Added) / r.Duration.Seconds()
+}
+
+// String returns a human-readable summary of the load.
+func (r loadResult) String() string {
+	s := "read %d vecs, added %d, failed %d in %v (%.1f vecs/s)"
+	return fmt.Sprintf(s, r.Read, r.Added, r.Failed, r.Duration, r.Throughput())
+}
+
+// parseLine parses a single NDJSON line, which is either a json array of
+// numbers (a vec) or an object in the format used with the "/cmd/add"
+// endpoint (the namespace field is optional, defaults to 'ns').
+func parseLine(line []byte, ns string) (apiutil.AddDataArgs, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return apiutil.AddDataArgs{}, errors.New("empty line")
+	}
+
+	item := apiutil.AddDataArgs{Namespace: ns}
+	var err error
+	if line[0] == '[' {
+		err = json.Unmarshal(line, &item.Vec)
+	} else {
+		err = json.Unmarshal(line, &item)
+	}
+	if item.Namespace == "" {
+		item.Namespace = ns
+	}
+	return item, err
+}
+
+// load reads NDJSON vecs (see parseLine) from 'r' and sends them in batches to
+// the "/cmd/add" endpoint specified with args.URL. Empty lines are skipped.
+// Returns an error if args.Ok() == false or if 'r' contains a line that can't
+// be parsed, in which case the load stops early (but the result is still valid
+// for what was sent). Failed requests are counted in loadResult.Failed.
+func load(args loadArgs, r io.Reader) (loadResult, error) {
+	if !args.Ok() {
+		return loadResult{}, errors.New("invalid load args")
+	}
+	client := args.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	result := loadResult{}
+
+	batches := make(chan []apiutil.AddDataArgs, args.Concurrency)
+	wg := sync.WaitGroup{}
+	wg.Add(args.Concurrency)
+	for i := 0; i < args.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				added := postBatch(client, args.URL, batch)
+				atomic.AddInt64(&result.Added, int64(added))
+				atomic.AddInt64(&result.Failed, int64(len(batch)-added))
+			}
+		}()
+	}
+
+	var err error
+	batch := make([]apiutil.AddDataArgs, 0, args.BatchSize)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for lineN := 1; scanner.Scan(); lineN++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		item, parseErr := parseLine(scanner.Bytes(), args.Namespace)
+		if parseErr != nil {
+			err = fmt.Errorf("line %d: %w", lineN, parseErr)
+			break
+		}
+
+		result.Read++
+		batch = append(batch, item)
+		if len(batch) == args.BatchSize {
+			batches <- batch
+			batch = make([]apiutil.AddDataArgs, 0, args.BatchSize)
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if len(batch) > 0 {
+		batches <- batch
+	}
+
+	close(batches)
+	wg.Wait()
+
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// postBatch sends a batch to the "/cmd/add" endpoint at 'url' and returns the
+// number of vecs that were added. Any failure counts as 0 added.
+func postBatch(client *http.Client, url string, batch []apiutil.AddDataArgs) int {
+	resp, err := apiutil.Post[apiutil.AddDataResp](client, url, batch)
+	if err != nil {
+		return 0
+	}
+	return resp.Succeeded
+}
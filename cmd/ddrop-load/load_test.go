@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apitest"
+)
+
+func TestLoad(t *testing.T) {
+	apitest.WithCluster(t, func(addr string) {
+		n := 250
+		sb := strings.Builder{}
+		for i := 0; i < n; i++ {
+			// Mix the two supported line formats, with some empty lines.
+			if i%2 == 0 {
+				fmt.Fprintf(&sb, "[%d, 1, 2]\n", i)
+			} else {
+				fmt.Fprintf(&sb, "{\"vec\": [%d, 1, 2]}\n\n", i)
+			}
+		}
+
+		ns := "test"
+		result, err := load(loadArgs{
+			URL:         fmt.Sprintf("http://%s/cmd/add", addr),
+			Namespace:   ns,
+			BatchSize:   40,
+			Concurrency: 4,
+		}, strings.NewReader(sb.String()))
+
+		if err != nil {
+			t.Fatal("unexpected err:", err)
+		}
+		if result.Read != int64(n) || result.Added != int64(n) || result.Failed != 0 {
+			t.Fatal("unexpected result:", result)
+		}
+		if result.Throughput() <= 0 {
+			t.Fatal("unexpected throughput:", result.Throughput())
+		}
+
+		// Check that the vecs actually landed.
+		total := apitest.TotalLen(t, addr, ns)
+		if total != n {
+			t.Fatalf("unexpected number of vecs in cluster. want %v, have %v", n, total)
+		}
+	})
+}
+
+func TestLoadInvalidLine(t *testing.T) {
+	apitest.WithCluster(t, func(addr string) {
+		input := "[1, 2, 3]\nnot json\n[4, 5, 6]\n"
+		result, err := load(loadArgs{
+			URL:         fmt.Sprintf("http://%s/cmd/add", addr),
+			Namespace:   "test",
+			BatchSize:   10,
+			Concurrency: 1,
+		}, strings.NewReader(input))
+
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Fatal("expected err for line 2, got:", err)
+		}
+		// The first line is still sent.
+		if result.Read != 1 || result.Added != 1 {
+			t.Fatal("unexpected result:", result)
+		}
+	})
+}
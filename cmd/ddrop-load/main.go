@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	flag.Usage = func() {
+		s := "---------------------------------------------------\n"
+		s += "ddrop\n"
+		s += "For benchmarking distributed recommendation systems.\n"
+		s += "See https://github.com/crunchypi/ddrop\n"
+		s += "\n"
+		s += "This build is for loading vectors into a running \n"
+		s += "cluster, through the /cmd/add endpoint of the http \n"
+		s += "server. The input is NDJSON, where each line is \n"
+		s += "either a vector such as [1,2,3] or an object such \n"
+		s += "as {\"vec\":[1,2,3]} (same fmt as with /cmd/add).\n"
+		s += "\n"
+		s += "Args:\n"
+		fmt.Fprintf(os.Stderr, s)
+		flag.PrintDefaults()
+	}
+
+	addr := flag.String("addr", "localhost:8080",
+		"Specify the http server address",
+	)
+	file := flag.String("file", "-",
+		"Specify the NDJSON file to load, '-' for stdin",
+	)
+	ns := flag.String("ns", "default",
+		"Specify the namespace used for the vectors",
+	)
+	batch := flag.Int("batch", 100,
+		"Specify the number of vectors sent per request",
+	)
+	concurrency := flag.Int("concurrency", 4,
+		"Specify the number of concurrent requests",
+	)
+
+	flag.Parse()
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not open file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := load(loadArgs{
+		URL:         fmt.Sprintf("http://%s/cmd/add", *addr),
+		Namespace:   *ns,
+		BatchSize:   *batch,
+		Concurrency: *concurrency,
+	}, r)
+
+	fmt.Println(result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load stopped:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+apitest contains test utilities for the command line tools in /cmd, such as
+setting up an in-process cluster (http server of the /service/api pkg with an
+rpc server of the /service/ops pkg).
+*/
+package apitest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apiutil"
+	"github.com/crunchypi/ddrop/service/api"
+)
+
+// FreeAddr returns a free local addr in the format "localhost:x".
+func FreeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("could not get a free port:", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// WithCluster starts an api server and an rpc server (through the api), then
+// calls rcv with the api addr. Everything is stopped after rcv returns. The
+// rpc server is configured with room for 10k vecs.
+func WithCluster(t *testing.T, rcv func(addr string)) {
+	addrAPI := FreeAddr(t)
+	addrRPC := FreeAddr(t)
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+	go api.StartServer(api.StartServerArgs{
+		Addr:                   addrAPI,
+		Ctx:                    ctx,
+		ReadTimeout:            time.Minute,
+		WriteTimeout:           time.Minute,
+		UpdateFrequencyAddrSet: time.Minute,
+	})
+
+	// Wait until the routes are up.
+	url := fmt.Sprintf("http://%s", addrAPI)
+	for i := 0; ; i++ {
+		if _, err := apiutil.Post[bool](nil, url+"/ping", struct{}{}); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("api server did not start")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	latencyTrackerArgs := map[string]any{
+		"maxChainLinkN":    10,
+		"minChainLinkSize": time.Second,
+		"standardPeriod":   time.Second,
+	}
+	cfg := map[string]any{
+		"rpcAddr": addrRPC,
+		"cfg": map[string]any{
+			"newSearchSpacesArgs": map[string]any{
+				"searchSpacesMaxCap":      10_000,
+				"searchSpacesMaxN":        100,
+				"maintenanceTaskInterval": time.Second,
+			},
+			"newLatencyTrackerArgs": latencyTrackerArgs,
+			"knnQueueBuf":           100,
+			"knnQueueMaxConcurrent": 100,
+			"newKNNMonitorArgs":     latencyTrackerArgs,
+		},
+	}
+	_, err := apiutil.Post[map[string]any](nil, url+"/ops/rpc/server/start", cfg)
+	if err != nil {
+		t.Fatal("could not start rpc server:", err)
+	}
+
+	rcv(addrAPI)
+}
+
+// TotalLen returns the total number of vecs in the namespace 'ns' for all rpc
+// nodes known to the api server at 'addr', using the "/info/len" endpoint.
+func TotalLen(t *testing.T, addr, ns string) int {
+	type T = apiutil.ClientResult[struct {
+		NVecs int `json:"nVecs"`
+	}]
+	url := fmt.Sprintf("http://%s/info/len", addr)
+	lens, err := apiutil.Post[[]T](nil, url, ns)
+	if err != nil {
+		t.Fatal("could not get len:", err)
+	}
+
+	total := 0
+	for _, l := range lens {
+		total += l.Payload.NVecs
+	}
+	return total
+}
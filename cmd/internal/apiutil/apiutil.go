@@ -0,0 +1,123 @@
+/*
+apiutil contains helpers for the command line tools in /cmd which work on top
+of the http server of the /service/api pkg. The types here mirror the (mostly
+unexported) json args and responses of that pkg's endpoints, with only the
+fields that are used by the tools.
+*/
+package apiutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	rman "github.com/crunchypi/ddrop/service/requestman"
+)
+
+// AddDataArgs mirrors the json args of the "/cmd/add" endpoint.
+type AddDataArgs struct {
+	Namespace string    `json:"namespace"`
+	Vec       []float64 `json:"vec"`
+	Data      []byte    `json:"data,omitempty"`
+	Expires   time.Time `json:"expires"`
+}
+
+// AddDataResp mirrors the json response of the "/cmd/add" endpoint.
+type AddDataResp struct {
+	Statuses  []string `json:"statuses"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	NetErr    string   `json:"netErr,omitempty"`
+}
+
+// ClientResult mirrors the json of api.clientResult.
+type ClientResult[T any] struct {
+	RemoteAddr     string        `json:"remoteAddr"`
+	NetErr         string        `json:"netErr,omitempty"`
+	Payload        T             `json:"payload"`
+	NetworkLatency time.Duration `json:"networkLatency"`
+}
+
+// KNNArgsPartial mirrors the json of the "args" field of the "/cmd/knn"
+// endpoint, which is requestman.KNNArgs without the QueryVec field.
+type KNNArgsPartial struct {
+	Namespace string         `json:"namespace"`
+	Priority  int            `json:"priority"`
+	KNNMethod rman.KNNMethod `json:"KNNMethod"`
+	Ascending bool           `json:"ascending"`
+	K         int            `json:"k"`
+	Extent    float64        `json:"extent"`
+	Accept    float64        `json:"accept"`
+	Reject    float64        `json:"reject"`
+	TTL       time.Duration  `json:"ttl"`
+	Monitor   bool           `json:"monitor"`
+}
+
+// KNNArgs mirrors the json args of the "/cmd/knn" endpoint.
+type KNNArgs struct {
+	QueryVecs [][]float64    `json:"queryVecs"`
+	Args      KNNArgsPartial `json:"args"`
+}
+
+// KNNRespItem mirrors the json of a single KNN result of the "/cmd/knn" endpoint.
+type KNNRespItem struct {
+	Vec   []float64 `json:"vec"`
+	Score float64   `json:"score"`
+}
+
+// KNNResp mirrors the json response items of the "/cmd/knn" endpoint.
+type KNNResp struct {
+	QueryVec      []float64                   `json:"queryVec"`
+	QueryVecIndex int                         `json:"queryVecIndex"`
+	Results       []ClientResult[KNNRespItem] `json:"results"`
+}
+
+// Envelope mirrors the json envelope which wraps all responses of the api.
+type Envelope[T any] struct {
+	Data  T      `json:"data"`
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// Post is a convenience func on top of http.Client.Post, which encodes 'data'
+// into a json, posts it to 'url' and decodes the data of the json response
+// envelope (see Envelope) into a T. Uses http.DefaultClient if 'client' is nil.
+// The error is not nil if:
+// - 'data' cannot be encoded into a json.
+// - http.Client.Post(...) returns an error.
+// - the response cannot be decoded into an Envelope[T].
+// - the response status is not http.StatusOK (the error contains the error
+//   msg of the envelope, if any).
+func Post[T any](client *http.Client, url string, data any) (T, error) {
+	var r T
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return r, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return r, err
+	}
+	var env Envelope[T]
+	if err := json.Unmarshal(b, &env); err != nil {
+		return r, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		s := "unexpected status: %v (%s)"
+		return env.Data, fmt.Errorf(s, resp.StatusCode, env.Error)
+	}
+	return env.Data, nil
+}
@@ -2,16 +2,97 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/crunchypi/ddrop/service/api"
+	"github.com/crunchypi/ddrop/service/ops"
 )
 
+// options are the command line options of this build.
+type options struct {
+	addr      string
+	ioTimeout int
+	config    string
+	peers     string
+	// addrFailThreshold is api.StartServerArgs.AddrSetFailThreshold.
+	addrFailThreshold int
+	// failureCooldown is api.StartServerArgs.ClientFailureCooldown.
+	failureCooldown time.Duration
+	// breakerThreshold and breakerTimeout are
+	// api.StartServerArgs.ClientCircuitBreaker.
+	breakerThreshold int
+	breakerTimeout   time.Duration
+	// shutdownGrace is api.StartServerArgs.ShutdownGrace.
+	shutdownGrace time.Duration
+	// handlerTimeout is api.StartServerArgs.HandlerTimeout.
+	handlerTimeout time.Duration
+	// idleTimeout is api.StartServerArgs.IdleTimeout.
+	idleTimeout time.Duration
+	// maxConns is api.StartServerArgs.MaxConns.
+	maxConns int
+	// maxKNNRespBytes is api.StartServerArgs.MaxKNNRespBytes.
+	maxKNNRespBytes int
+}
+
+// run starts the http server with the given options and blocks until ctx is
+// done. If opts.config is set, then that file is read and used to start an rpc
+// server along with the http server (see api.StartServerArgs.RPCServerStart).
+// onStart is called after the http server starts listening, accepts nil.
+func run(ctx context.Context, opts options, onStart func()) error {
+	var rpcServerStart []byte
+	if opts.config != "" {
+		b, err := os.ReadFile(opts.config)
+		if err != nil {
+			return fmt.Errorf("could not read config file: %w", err)
+		}
+		rpcServerStart = b
+	}
+
+	ok, err := api.StartServer(api.StartServerArgs{
+		Addr:                   opts.addr,
+		Ctx:                    ctx,
+		ReadTimeout:            time.Second * time.Duration(opts.ioTimeout),
+		WriteTimeout:           time.Second * time.Duration(opts.ioTimeout),
+		HandlerTimeout:         opts.handlerTimeout,
+		IdleTimeout:            opts.idleTimeout,
+		MaxConns:               opts.maxConns,
+		MaxKNNRespBytes:        opts.maxKNNRespBytes,
+		UpdateFrequencyAddrSet: time.Second * 10,
+		OnStart:                onStart,
+		RPCServerStart:         rpcServerStart,
+		Peers:                  splitPeers(opts.peers),
+		AddrSetFailThreshold:   opts.addrFailThreshold,
+		ClientFailureCooldown:  opts.failureCooldown,
+		ClientCircuitBreaker: ops.NewCircuitBreakerArgs{
+			FailThreshold: opts.breakerThreshold,
+			OpenTimeout:   opts.breakerTimeout,
+		},
+		ShutdownGrace: opts.shutdownGrace,
+	})
+	if !ok && err == nil {
+		return errors.New("invalid server args")
+	}
+	return err
+}
+
+// splitPeers splits a comma-separated list of addrs, ignoring empty items.
+func splitPeers(s string) []string {
+	peers := make([]string, 0)
+	for _, peer := range strings.Split(s, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
 func main() {
 	flag.Usage = func() {
 		s := "---------------------------------------------------\n"
@@ -28,31 +109,81 @@ func main() {
 		flag.PrintDefaults()
 	}
 
-	addr := *flag.String("addr", "localhost:8080",
+	opts := options{}
+	flag.StringVar(&opts.addr, "addr", "localhost:8080",
 		"Specify the http server address",
 	)
-	ioTimeout := *flag.Int("io-timeout", 10,
+	flag.IntVar(&opts.ioTimeout, "io-timeout", 10,
 		"Specify in seconds the http server's read/write timeout",
 	)
+	flag.DurationVar(&opts.handlerTimeout, "handler-timeout", 0,
+		"Specify the max total time for handling a single request, e.g 5s.\n"+
+			"Slower requests get a 503 response. Disabled with 0",
+	)
+	flag.DurationVar(&opts.idleTimeout, "idle-timeout", 0,
+		"Specify how long keep-alive connections can be idle, e.g 30s.\n"+
+			"0 defaults to -io-timeout",
+	)
+	flag.IntVar(&opts.maxConns, "max-conns", 0,
+		"Specify the max amount of simultaneous connections, additional\n"+
+			"ones are queued. Disabled with 0",
+	)
+	flag.IntVar(&opts.maxKNNRespBytes, "max-knn-resp-bytes", 0,
+		"Specify the max size of /cmd/knn responses (as json), the worst\n"+
+			"results are dropped to fit. Disabled with 0",
+	)
+	flag.StringVar(&opts.config, "config", "",
+		"Specify a json file for starting an rpc server on startup. The fmt\n"+
+			"is the same as used with the /ops/rpc/server/start endpoint",
+	)
+	flag.IntVar(&opts.addrFailThreshold, "addr-fail-threshold", 1,
+		"Specify the number of failed pings in a row (one every 10s) before\n"+
+			"an rpc addr is evicted",
+	)
+	flag.DurationVar(&opts.failureCooldown, "failure-cooldown", 0,
+		"Specify how long rpc addrs that fail are skipped in KNN and info\n"+
+			"calls, e.g 5s. Disabled with 0",
+	)
+	flag.IntVar(&opts.breakerThreshold, "breaker-threshold", 0,
+		"Specify the number of failed calls in a row before calls to an rpc\n"+
+			"addr fail fast. Requires -breaker-timeout, disabled with 0",
+	)
+	flag.DurationVar(&opts.breakerTimeout, "breaker-timeout", 0,
+		"Specify how long calls to an rpc addr fail fast before a probe\n"+
+			"call is let through, e.g 10s",
+	)
+	flag.DurationVar(&opts.shutdownGrace, "shutdown-grace", time.Second*10,
+		"Specify how long in-flight requests can take to finish on shutdown\n"+
+			"(SIGTERM/SIGINT), e.g 10s. Peers are asked to remove the rpc addr\n"+
+			"of this node in the meantime. Stops right away with 0",
+	)
+	flag.StringVar(&opts.peers, "peers", "",
+		"Specify a comma-separated list of http server addrs of other nodes,\n"+
+			"which rpc addrs are periodically exchanged with (every 10s)",
+	)
 
 	flag.Parse()
 
-	ctx, _ := signal.NotifyContext(
+	ctx, ctxStop := signal.NotifyContext(
 		context.Background(),
 		syscall.SIGKILL,
 		syscall.SIGTERM,
 		syscall.SIGINT,
 	)
-	api.StartServer(api.StartServerArgs{
-		Addr:                   addr,
-		Ctx:                    ctx,
-		ReadTimeout:            time.Second * time.Duration(ioTimeout),
-		WriteTimeout:           time.Second * time.Duration(ioTimeout),
-		UpdateFrequencyAddrSet: time.Second * 10,
-		OnStart: func() {
-			fmt.Printf("started listening on addr '%s'\n", addr)
-		},
+	// Restore default signal handling once draining starts (see -shutdown-grace),
+	// such that a second signal stops right away.
+	go func() {
+		<-ctx.Done()
+		ctxStop()
+		fmt.Println("\nstopping, signal again to stop right away")
+	}()
+	err := run(ctx, opts, func() {
+		fmt.Printf("started listening on addr '%s'\n", opts.addr)
 	})
+	if err != nil {
+		fmt.Println("\nstopped:", err)
+		os.Exit(1)
+	}
 
 	fmt.Println("\nstopped")
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/cmd/internal/apitest"
+	"github.com/crunchypi/ddrop/cmd/internal/apiutil"
+)
+
+func TestRunWithConfig(t *testing.T) {
+	addrAPI := apitest.FreeAddr(t)
+	addrRPC := apitest.FreeAddr(t)
+	// Reported by the /info/cap endpoint.
+	searchSpacesMaxN := 123
+
+	cfg := `{
+		"rpcAddr": "%s",
+		"cfg": {
+			"newSearchSpacesArgs": {
+				"searchSpacesMaxCap": 1000,
+				"searchSpacesMaxN": %d,
+				"maintenanceTaskInterval": 1000000000
+			},
+			"newLatencyTrackerArgs": {
+				"maxChainLinkN": 10,
+				"minChainLinkSize": 1000000000,
+				"standardPeriod": 1000000000
+			},
+			"knnQueueBuf": 10,
+			"knnQueueMaxConcurrent": 10,
+			"newKNNMonitorArgs": {
+				"maxChainLinkN": 10,
+				"minChainLinkSize": 1000000000
+			}
+		}
+	}`
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(cfg, addrRPC, searchSpacesMaxN)), 0600)
+	if err != nil {
+		t.Fatal("could not write config file:", err)
+	}
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	chErr := make(chan error)
+	go func() {
+		chErr <- run(ctx, options{addr: addrAPI, ioTimeout: 10, config: path}, nil)
+	}()
+
+	// Wait until the routes are up.
+	url := fmt.Sprintf("http://%s", addrAPI)
+	for i := 0; ; i++ {
+		if _, err := apiutil.Post[bool](nil, url+"/ping", struct{}{}); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// The rpc server should be up without calling /ops/rpc/server/start.
+	pings, err := apiutil.Post[[]apiutil.ClientResult[bool]](nil, url+"/cmd/ping", struct{}{})
+	if err != nil || len(pings) != 1 || !pings[0].Payload {
+		t.Fatal("rpc server not running:", pings, err)
+	}
+
+	// Check the caps from the config.
+	ns := "test"
+	add := []apiutil.AddDataArgs{{Namespace: ns, Vec: []float64{1, 2}}}
+	_, err = apiutil.Post[apiutil.AddDataResp](nil, url+"/cmd/add", add)
+	if err != nil {
+		t.Fatal("could not add data:", err)
+	}
+	type T = apiutil.ClientResult[struct {
+		Cap int `json:"cap"`
+	}]
+	caps, err := apiutil.Post[[]T](nil, url+"/info/cap", ns)
+	if err != nil || len(caps) != 1 {
+		t.Fatal("could not get cap:", caps, err)
+	}
+	if caps[0].Payload.Cap != searchSpacesMaxN {
+		t.Fatalf("unexpected cap. want %v, have %v", searchSpacesMaxN, caps[0].Payload.Cap)
+	}
+
+	ctxCancel()
+	if err := <-chErr; err != nil {
+		t.Fatal("unexpected err on stop:", err)
+	}
+}
+
+func TestRunWithInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal("could not write config file:", err)
+	}
+
+	opts := options{addr: apitest.FreeAddr(t), ioTimeout: 10, config: path}
+	if err := run(context.Background(), opts, nil); err == nil {
+		t.Fatal("expected err with invalid config")
+	}
+}
+
+func TestSplitPeers(t *testing.T) {
+	peers := splitPeers(" a:1,,b:2 , ")
+	if len(peers) != 2 || peers[0] != "a:1" || peers[1] != "b:2" {
+		t.Fatal("unexpected peers:", peers)
+	}
+	if peers := splitPeers(""); len(peers) != 0 {
+		t.Fatal("unexpected peers:", peers)
+	}
+}
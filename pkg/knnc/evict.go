@@ -0,0 +1,52 @@
+package knnc
+
+/*
+File contains eviction notifications, i.e a way of reacting to data leaving
+SearchSpaces, see NewSearchSpacesArgs.OnEvict.
+*/
+
+// EvictReason tells why a DistancerContainer was removed from SearchSpaces.
+type EvictReason int
+
+const (
+	// EvictExpired means that the DistancerContainer returned a nil Distancer
+	// and was removed with SearchSpaces.Clean or the maintenance loop.
+	EvictExpired EvictReason = iota
+	// EvictRemoved means that the DistancerContainer was removed explicitly,
+	// with SearchSpaces.Remove.
+	EvictRemoved
+)
+
+// String implements fmt.Stringer.
+func (r EvictReason) String() string {
+	switch r {
+	case EvictExpired:
+		return "expired"
+	case EvictRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// containerID returns the ID of a DistancerContainer, if it has an 'ID() string'
+// method. Returns an empty string otherwise.
+func containerID(dc DistancerContainer) string {
+	if ider, ok := dc.(interface{ ID() string }); ok {
+		return ider.ID()
+	}
+	return ""
+}
+
+// evict calls SearchSpaces.onEvict (if set) for each of the given containers,
+// in a new goroutine. Does nothing if there are no containers.
+func (ss *SearchSpaces) evict(dcs []DistancerContainer, reason EvictReason) {
+	if ss.onEvict == nil || len(dcs) == 0 {
+		return
+	}
+	go func() {
+		for _, dc := range dcs {
+			ss.onEvict(containerID(dc), reason)
+		}
+	}()
+}
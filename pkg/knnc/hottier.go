@@ -0,0 +1,143 @@
+package knnc
+
+import "sync"
+
+/*
+File contains the 'hot tier' used by SearchSpaces (plural) when it is set up
+with NewSearchSpacesArgs.HotTierSize > 0. The hot tier is a small set of data
+which is accessed often (see SearchSpaces.Touch), and which is always scanned
+fully, regardless of the scan extent.
+*/
+
+// hotTier keeps track of access counts and the most accessed DistancerContainer
+// instances (at most hotTier.size). Note that it uses Distancer instances as map
+// keys, so they must be comparable (e.g pointers, like *mathx.SafeVec).
+type hotTier struct {
+	size int
+	// index maps all data in SearchSpaces to their containers, such that
+	// the containers can be found by the Distancer given to touch.
+	index map[Distancer]DistancerContainer
+	// hits are access counts, bounded by hotTierMaxHitsFactor * size.
+	hits map[Distancer]int
+	// hot are the promoted containers, len <= size.
+	hot map[Distancer]DistancerContainer
+	mx  sync.Mutex
+}
+
+// hotTierMaxHitsFactor * hotTier.size is the max number of access counts kept.
+// Counts are halved (decayed) when this is exceeded.
+const hotTierMaxHitsFactor = 8
+
+// newHotTier is a factory func for hotTier. Returns nil if size < 1.
+func newHotTier(size int) *hotTier {
+	if size < 1 {
+		return nil
+	}
+	return &hotTier{
+		size:  size,
+		index: make(map[Distancer]DistancerContainer),
+		hits:  make(map[Distancer]int),
+		hot:   make(map[Distancer]DistancerContainer, size),
+	}
+}
+
+// add adds the container to the index, unless 'from' (the SearchSpace which
+// holds it) is retired. This is checked while holding the lock, so an add can't
+// complete after a retire followed by hotTier.reset (see SearchSpaces.Clear).
+func (h *hotTier) add(d Distancer, dc DistancerContainer, from *SearchSpace) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if !from.isRetired() {
+		h.index[d] = dc
+	}
+}
+
+// touch counts an access of each given Distancer, and promotes them if their
+// count is higher than the least accessed promoted one. Distancer instances
+// that are unknown (see hotTier.add) or expired are ignored.
+func (h *hotTier) touch(ds ...Distancer) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for _, d := range ds {
+		dc, ok := h.index[d]
+		if !ok || dc.Distancer() == nil {
+			continue
+		}
+
+		h.hits[d]++
+		if _, ok := h.hot[d]; ok {
+			continue
+		}
+		if len(h.hot) < h.size {
+			h.hot[d] = dc
+			continue
+		}
+
+		// Replace the least accessed, if it is accessed less than this one.
+		var coldest Distancer
+		for other := range h.hot {
+			if coldest == nil || h.hits[other] < h.hits[coldest] {
+				coldest = other
+			}
+		}
+		if h.hits[d] > h.hits[coldest] {
+			delete(h.hot, coldest)
+			h.hot[d] = dc
+		}
+	}
+
+	// Decay, such that old accesses matter less and memory is bounded.
+	if len(h.hits) > h.size*hotTierMaxHitsFactor {
+		for d, n := range h.hits {
+			if n /= 2; n == 0 {
+				delete(h.hits, d)
+				continue
+			}
+			h.hits[d] = n
+		}
+	}
+}
+
+// clean removes expired containers, i.e ones that return a nil Distancer.
+func (h *hotTier) clean() {
+	h.removeWhere(func(dc DistancerContainer) bool { return dc.Distancer() == nil })
+}
+
+// removeWhere removes all containers where f returns true.
+func (h *hotTier) removeWhere(f func(DistancerContainer) bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for d, dc := range h.index {
+		if !f(dc) {
+			continue
+		}
+		delete(h.index, d)
+		delete(h.hits, d)
+		delete(h.hot, d)
+	}
+}
+
+// reset removes everything, including the index.
+func (h *hotTier) reset() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.index = make(map[Distancer]DistancerContainer)
+	h.hits = make(map[Distancer]int)
+	h.hot = make(map[Distancer]DistancerContainer, h.size)
+}
+
+// snapshot returns a copy of the promoted containers, which is safe to read
+// without locking.
+func (h *hotTier) snapshot() map[Distancer]DistancerContainer {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	hot := make(map[Distancer]DistancerContainer, len(h.hot))
+	for d, dc := range h.hot {
+		hot[d] = dc
+	}
+	return hot
+}
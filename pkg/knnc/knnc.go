@@ -5,7 +5,11 @@ concurrency.
 */
 package knnc
 
-import "github.com/crunchypi/ddrop/pkg/mathx"
+import (
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
 
 // Distancer is an alias for mathx.Distancer.
 type Distancer = mathx.Distancer
@@ -37,6 +41,16 @@ type ScoreItem struct {
 	Score float64
 	// Set is false if this instance is in a default unset state.
 	Set bool
+	// ID is the ID of the DistancerContainer that Distancer came from, see
+	// ScanItem.ID. It is set by MapStage.
+	ID string
+	// Added is the insertion time of the DistancerContainer that Distancer
+	// came from, see ScanItem.Added. It is set by MapStage.
+	Added time.Time
+	// Source is an optional provenance tag, e.g the namespace or backend that
+	// this item came from, such that merged results can report where each of
+	// them came from. It is not used by this pkg.
+	Source string
 }
 
 // ScoreItems is <[]ScoreItem>, used for method attachment.
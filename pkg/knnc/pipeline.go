@@ -5,6 +5,79 @@ This file contains a convenience type Pipeline which orchestrates some of the
 concurrent KNN processes in this pkg.
 */
 
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PipelineStageStats contains counters for a single stage in a Pipeline.
+type PipelineStageStats struct {
+	// In is the number of items that entered the stage.
+	In int64
+	// Out is the number of items that left the stage. For the merge stage,
+	// this is the number of ScoreItems (plural) instances.
+	Out int64
+	// BlockedSend is the total time spent blocked while sending the output of
+	// this stage into the next one, i.e backpressure from the next stage. This
+	// is measured by the Pipeline between stages, so it is always 0 for the
+	// merge stage (output is consumed with Pipeline.ConsumeIter).
+	BlockedSend time.Duration
+}
+
+// PipelineStats contains counters for each stage in a Pipeline, which is useful
+// for finding out which stage is the bottleneck. Scan is the ScanChan instances
+// fed into the Pipeline with Pipeline.AddScanner (so Scan.In is always 0).
+type PipelineStats struct {
+	Scan   PipelineStageStats
+	Map    PipelineStageStats
+	Filter PipelineStageStats
+	Merge  PipelineStageStats
+}
+
+// pipelineStageCounters is the concurrency-safe equivalent of PipelineStageStats.
+type pipelineStageCounters struct {
+	out         int64
+	blockedSend int64 // time.Duration.
+}
+
+// send sends the item into the chan, while counting it and the time blocked.
+// Returns false if the send was aborted by either of the given signals.
+func send[T any](
+	c *pipelineStageCounters,
+	out chan<- T,
+	item T,
+	cancel *CancelSignal,
+	deadline *CancelSignal,
+) bool {
+	select {
+	case out <- item:
+		atomic.AddInt64(&c.out, 1)
+		return true
+	default:
+	}
+
+	start := time.Now()
+	defer func() { atomic.AddInt64(&c.blockedSend, int64(time.Since(start))) }()
+	select {
+	case out <- item:
+		atomic.AddInt64(&c.out, 1)
+		return true
+	case <-cancel.c:
+		return false
+	case <-deadline.c:
+		return false
+	}
+}
+
+// stats converts to PipelineStageStats, using 'in' as PipelineStageStats.In.
+func (c *pipelineStageCounters) stats(in int64) PipelineStageStats {
+	return PipelineStageStats{
+		In:          in,
+		Out:         atomic.LoadInt64(&c.out),
+		BlockedSend: time.Duration(atomic.LoadInt64(&c.blockedSend)),
+	}
+}
+
 // Pipeline is a convenience type for connecting concurrent stages and
 // feeding them ScanChan instances. This can be used with the SearchSpace(s)
 // types of this pkg (both singular and plural) and the different pre-defined
@@ -16,6 +89,12 @@ type Pipeline struct {
 	inputChanClosedSignal *CancelSignal          // Signal for stopping faucet.
 	outputChan            <-chan ScoreItems      // Sink.
 	scanTick              ActiveGoroutinesTicker // Current n chans fed into faucet.
+
+	// Stage counters, nil if NewPipelineArgs.Stats is false.
+	scanStats   *pipelineStageCounters
+	mapStats    *pipelineStageCounters
+	filterStats *pipelineStageCounters
+	mergeStats  *pipelineStageCounters
 }
 
 // NewPipelineArgs is intended as args for the NewPipeline func.
@@ -41,6 +120,10 @@ type NewPipelineArgs struct {
 	// of ScoreItems (plural). Note that the MergeStage func of this pkg can be
 	// used here (with closure conversion).
 	MergeStage func(<-chan ScoreItem) (<-chan ScoreItems, bool)
+	// Stats enables counters for each stage, accessible with Pipeline.Stats.
+	// Note that this adds a relay goroutine between the map and filter stages,
+	// and between the filter and merge stages (where counting is done).
+	Stats bool
 }
 
 // Ok validates NewPipelineArgs. Returns true iff:
@@ -67,30 +150,78 @@ func NewPipeline(args NewPipelineArgs) (*Pipeline, bool) {
 		return nil, false
 	}
 
+	pipeline := Pipeline{
+		inputChanClosedSignal: NewCancelSignal(),
+		baseWorkerArgs:        args.BaseWorkerArgs,
+	}
+	if args.Stats {
+		pipeline.scanStats = &pipelineStageCounters{}
+		pipeline.mapStats = &pipelineStageCounters{}
+		pipeline.filterStats = &pipelineStageCounters{}
+		pipeline.mergeStats = &pipelineStageCounters{}
+	}
+
 	chScan := make(chan ScanItem, args.Buf)
 	chMap, ok := args.MapStage(chScan)
 	if !ok || chScan == nil {
 		return nil, false
 	}
-	chFilter, ok := args.FilterStage(chMap)
+	chFilter, ok := args.FilterStage(relay(&pipeline, pipeline.mapStats, chMap))
 	if !ok || chFilter == nil {
 		return nil, false
 	}
 
-	chFinal, ok := args.MergeStage(chFilter)
+	chFinal, ok := args.MergeStage(relay(&pipeline, pipeline.filterStats, chFilter))
 	if !ok {
 		return nil, false
 	}
 
-	pipeline := Pipeline{
-		inputChan:             chScan,
-		inputChanClosedSignal: NewCancelSignal(),
-		outputChan:            chFinal,
-		baseWorkerArgs:        args.BaseWorkerArgs,
-	}
+	pipeline.inputChan = chScan
+	pipeline.outputChan = chFinal
 	return &pipeline, true
 }
 
+// relay returns 'in' as-is if 'c' is nil. Otherwise, it returns a new chan
+// which everything in 'in' is relayed to, while counting with 'c'. Note that
+// 'in' is drained even if sending is aborted, such that the stage before does
+// not block.
+func relay[T any](p *Pipeline, c *pipelineStageCounters, in <-chan T) <-chan T {
+	if c == nil {
+		return in
+	}
+
+	out := make(chan T, p.baseWorkerArgs.Buf)
+	go func() {
+		defer close(out)
+		deadlineSignal, deadlineSignalCancel := p.baseWorkerArgs.DeadlineSignal()
+		defer deadlineSignalCancel.Cancel()
+
+		aborted := false
+		for item := range in {
+			if aborted {
+				continue
+			}
+			aborted = !send(c, out, item, p.baseWorkerArgs.Cancel, deadlineSignal)
+		}
+	}()
+
+	return out
+}
+
+// Stats returns counters for each stage of the Pipeline, see PipelineStats.
+// Returns false if NewPipelineArgs.Stats was false when setting up.
+func (p *Pipeline) Stats() (PipelineStats, bool) {
+	if p.scanStats == nil {
+		return PipelineStats{}, false
+	}
+
+	scan := p.scanStats.stats(0)
+	mapStage := p.mapStats.stats(scan.Out)
+	filter := p.filterStats.stats(mapStage.Out)
+	merge := p.mergeStats.stats(filter.Out)
+	return PipelineStats{Scan: scan, Map: mapStage, Filter: filter, Merge: merge}, true
+}
+
 // AddScanner connects a specified ScanChan to the internal ScanChan that is fed
 // through the pipeline. Closing the internal chan is done with Pipeline.WaitThenClose.
 // Will return false if a Pipeline.WaitThenClose is called previously or if s is nil.
@@ -108,6 +239,13 @@ func (p *Pipeline) AddScanner(s ScanChan) bool {
 	go func() {
 		defer done()
 		for distancer := range s {
+			if p.scanStats != nil {
+				cancel := p.baseWorkerArgs.Cancel
+				if !send(p.scanStats, p.inputChan, distancer, cancel, deadlineSignal) {
+					return
+				}
+				continue
+			}
 			select {
 			case p.inputChan <- distancer:
 			case <-p.baseWorkerArgs.Cancel.c:
@@ -147,6 +285,9 @@ func (p *Pipeline) ConsumeIter(rcv func(ScoreItems) bool) bool {
 		if p.baseWorkerArgs.Cancel.Cancelled() {
 			return true
 		}
+		if p.mergeStats != nil {
+			atomic.AddInt64(&p.mergeStats.out, 1)
+		}
 		if !rcv(scoreItems) {
 			return true
 		}
@@ -205,7 +205,9 @@ func TestPipelinePrefabbed(t *testing.T) {
 	go func() {
 		for scanChan := range scanChans {
 			if !pipeline.AddScanner(scanChan) {
-				t.Fatal("could not add scanChan to pipeline")
+				// t.Fatal must not be called from a non-test goroutine.
+				t.Error("could not add scanChan to pipeline")
+				break
 			}
 		}
 
@@ -230,3 +232,107 @@ func TestPipelinePrefabbed(t *testing.T) {
 		t.Fatal("Pipeline ended with an unexpected best neighbour:", result[0])
 	}
 }
+
+// Using Pipeline T with the stage-prefabs and NewPipelineArgs.Stats enabled.
+func TestPipelineStats(t *testing.T) {
+	query := newTVec(0)
+	n := 1000 // Amount of scanned vecs.
+
+	uniformBaseStageArgs := BaseStageArgs{
+		NWorkers: 4,
+		BaseWorkerArgs: BaseWorkerArgs{
+			Buf:    10,
+			Cancel: NewCancelSignal(),
+			TTL:    time.Second * 10,
+		},
+	}
+
+	pipelineArgs := NewPipelineArgs{
+		BaseWorkerArgs: uniformBaseStageArgs.BaseWorkerArgs,
+		MapStage: func(in ScanChan) (<-chan ScoreItem, bool) {
+			return MapStage(MapStageArgs{
+				In: in,
+				MapStagePartialArgs: MapStagePartialArgs{
+					MapFunc: func(other mathx.Distancer) (ScoreItem, bool) {
+						score, ok := other.EuclideanDistance(query)
+						return ScoreItem{Score: score}, ok
+					},
+					BaseStageArgs: uniformBaseStageArgs,
+				},
+			})
+		},
+		// Vecs are [0, n), so this drops the lower half.
+		FilterStage: func(in <-chan ScoreItem) (<-chan ScoreItem, bool) {
+			return FilterStage(FilterStageArgs{
+				In: in,
+				FilterStagePartialArgs: FilterStagePartialArgs{
+					FilterFunc: func(scoreItem ScoreItem) bool {
+						return scoreItem.Score >= float64(n/2)
+					},
+					BaseStageArgs: uniformBaseStageArgs,
+				},
+			})
+		},
+		MergeStage: func(in <-chan ScoreItem) (<-chan ScoreItems, bool) {
+			return MergeStage(MergeStageArgs{
+				In: in,
+				MergeStagePartialArgs: MergeStagePartialArgs{
+					K:             1,
+					Ascending:     true,
+					SendInterval:  1,
+					BaseStageArgs: uniformBaseStageArgs,
+				},
+			})
+		},
+		Stats: true,
+	}
+	pipeline, ok := NewPipeline(pipelineArgs)
+	if !ok {
+		t.Fatal("pipeline setup not ok")
+	}
+
+	scanChan := make(chan ScanItem)
+	go func() {
+		defer close(scanChan)
+		for i := 0; i < n; i++ {
+			scanChan <- ScanItem{Distancer: newTVec(float64(i))}
+		}
+	}()
+	go func() {
+		pipeline.AddScanner(scanChan)
+		pipeline.WaitThenClose()
+	}()
+	pipeline.ConsumeIter(func(ScoreItems) bool { return true })
+
+	stats, ok := pipeline.Stats()
+	if !ok {
+		t.Fatal("unexpected not-ok stats")
+	}
+	for _, tc := range []struct {
+		name    string
+		stats   PipelineStageStats
+		in, out int64
+	}{
+		{name: "scan", stats: stats.Scan, in: 0, out: int64(n)},
+		{name: "map", stats: stats.Map, in: int64(n), out: int64(n)},
+		{name: "filter", stats: stats.Filter, in: int64(n), out: int64(n / 2)},
+		// SendInterval=1, so one ScoreItems per ScoreItem.
+		{name: "merge", stats: stats.Merge, in: int64(n / 2), out: int64(n / 2)},
+	} {
+		if tc.stats.In != tc.in || tc.stats.Out != tc.out {
+			s := "unexpected %v stage stats; want in=%v out=%v, have %+v"
+			t.Fatalf(s, tc.name, tc.in, tc.out, tc.stats)
+		}
+	}
+	if stats.Merge.BlockedSend != 0 {
+		t.Fatal("unexpected blocked time for the merge stage")
+	}
+
+	// Not enabled.
+	pipelineArgs.Stats = false
+	pipeline, _ = NewPipeline(pipelineArgs)
+	defer uniformBaseStageArgs.Cancel.Cancel()
+	if _, ok := pipeline.Stats(); ok {
+		t.Fatal("unexpected ok stats when not enabled")
+	}
+}
@@ -0,0 +1,529 @@
+package knnc
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+File contains a product quantization (PQ) index, which is a memory saving (and
+lossy) alternative to scanning the raw vecs of a SearchSpaces instance. Vecs are
+split into M sub-vecs, and each sub-vec is replaced with the index of its closest
+centroid in a small per-subspace codebook (trained with k-means on a sample),
+i.e a vec is kept as M bytes. Queries use asymmetric distance computation (ADC):
+the distances from the (raw) query sub-vecs to all centroids are computed once
+per query (see PQCodebook.DistanceTable), after which the approximate distance
+to any stored vec is M table lookups. Only Euclidean distance is supported.
+*/
+
+// pqDefaultKSub is the default of TrainPQArgs.KSub.
+const pqDefaultKSub = 256
+
+// pqDefaultIterations is the default of TrainPQArgs.Iterations.
+const pqDefaultIterations = 10
+
+// TrainPQArgs is intended for TrainPQ.
+type TrainPQArgs struct {
+	// M is the number of subspaces, i.e the number of bytes per encoded vec.
+	// The vec dimension must be divisible by M.
+	M int
+	// KSub is the number of centroids per subspace, must be <= 256 such that
+	// a centroid index fits in a byte. It is capped to the sample size.
+	// Optional, 0 defaults to 256.
+	KSub int
+	// Iterations is the number of k-means iterations per subspace.
+	// Optional, 0 defaults to 10.
+	Iterations int
+	// Seed is used for the (random) initial centroids, such that training on
+	// the same sample with the same Seed gives the same codebook.
+	Seed int64
+}
+
+// Ok validates TrainPQArgs. Returns true iff:
+//	(1) M > 0
+//	(2) KSub >= 0 and <= 256
+//	(3) Iterations >= 0
+func (args *TrainPQArgs) Ok() bool {
+	return boolsOk([]bool{
+		args.M > 0,
+		args.KSub >= 0 && args.KSub <= pqDefaultKSub,
+		args.Iterations >= 0,
+	})
+}
+
+// PQCodebook keeps the trained centroids of a product quantizer, see TrainPQ.
+// Note; read-only after creation, so it is thread safe.
+type PQCodebook struct {
+	dim    int
+	subDim int
+	// centroids are indexed by [subspace][centroid], each with len subDim.
+	centroids [][][]float64
+}
+
+// TrainPQ trains a PQCodebook on the given sample, see TrainPQArgs for details.
+// Returns (nil, false) if args.Ok() == false, if the sample is empty, if the
+// vecs in it have different dimensions or if the dimension is not divisible by
+// args.M. Nil or expired (see DistancerContainer) Distancer instances are not
+// allowed in the sample.
+func TrainPQ(sample []Distancer, args TrainPQArgs) (*PQCodebook, bool) {
+	if !args.Ok() || len(sample) == 0 {
+		return nil, false
+	}
+	if args.KSub == 0 {
+		args.KSub = pqDefaultKSub
+	}
+	if args.Iterations == 0 {
+		args.Iterations = pqDefaultIterations
+	}
+	if args.KSub > len(sample) {
+		args.KSub = len(sample)
+	}
+
+	vecs := make([][]float64, len(sample))
+	for i, d := range sample {
+		if d == nil || reflect.ValueOf(d).IsNil() {
+			return nil, false
+		}
+		if vecs[i] = pqPeekAll(d); len(vecs[i]) != len(vecs[0]) {
+			return nil, false
+		}
+	}
+	dim := len(vecs[0])
+	if dim == 0 || dim%args.M != 0 {
+		return nil, false
+	}
+
+	cb := PQCodebook{
+		dim:       dim,
+		subDim:    dim / args.M,
+		centroids: make([][][]float64, args.M),
+	}
+	rng := rand.New(rand.NewSource(args.Seed))
+	sub := make([][]float64, len(vecs))
+	for m := 0; m < args.M; m++ {
+		for i, vec := range vecs {
+			sub[i] = vec[m*cb.subDim : (m+1)*cb.subDim]
+		}
+		cb.centroids[m] = pqKMeans(sub, args.KSub, args.Iterations, rng)
+	}
+	return &cb, true
+}
+
+// pqPeekAll copies the elements of a Distancer into a new slice.
+func pqPeekAll(d Distancer) []float64 {
+	r := make([]float64, d.Dim())
+	for i := range r {
+		r[i], _ = d.Peek(i)
+	}
+	return r
+}
+
+// pqSquaredDist is the squared Euclidean distance between a and b (same len).
+func pqSquaredDist(a, b []float64) float64 {
+	r := 0.
+	for i := range a {
+		x := a[i] - b[i]
+		r += x * x
+	}
+	return r
+}
+
+// pqNearest returns the index of the centroid that is closest to vec.
+func pqNearest(centroids [][]float64, vec []float64) int {
+	best, bestDist := 0, math.Inf(1)
+	for i, c := range centroids {
+		if dist := pqSquaredDist(c, vec); dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+// pqKMeans clusters the vecs into k centroids with Lloyd's algorithm, using
+// k distinct (random) vecs as the initial centroids. Clusters that become empty
+// keep their previous centroid.
+func pqKMeans(vecs [][]float64, k, iterations int, rng *rand.Rand) [][]float64 {
+	centroids := make([][]float64, k)
+	for i, j := range rng.Perm(len(vecs))[:k] {
+		centroids[i] = append([]float64(nil), vecs[j]...)
+	}
+
+	sums := make([][]float64, k)
+	for i := range sums {
+		sums[i] = make([]float64, len(vecs[0]))
+	}
+	counts := make([]int, k)
+	for it := 0; it < iterations; it++ {
+		for i := range sums {
+			for j := range sums[i] {
+				sums[i][j] = 0
+			}
+			counts[i] = 0
+		}
+		for _, vec := range vecs {
+			c := pqNearest(centroids, vec)
+			counts[c]++
+			for j, elm := range vec {
+				sums[c][j] += elm
+			}
+		}
+		for i := range centroids {
+			if counts[i] == 0 {
+				continue
+			}
+			for j := range centroids[i] {
+				centroids[i][j] = sums[i][j] / float64(counts[i])
+			}
+		}
+	}
+	return centroids
+}
+
+// Dim returns the vec dimension of the codebook.
+func (cb *PQCodebook) Dim() int {
+	return cb.dim
+}
+
+// M returns the number of subspaces, i.e the len of each code (see Encode).
+func (cb *PQCodebook) M() int {
+	return len(cb.centroids)
+}
+
+// Encode quantizes a Distancer into a code, which is the index of the closest
+// centroid for each subspace. Returns false if d is nil or if the dimension of
+// d does not match the codebook.
+func (cb *PQCodebook) Encode(d Distancer) ([]uint8, bool) {
+	if d == nil || reflect.ValueOf(d).IsNil() || d.Dim() != cb.dim {
+		return nil, false
+	}
+
+	vec := pqPeekAll(d)
+	code := make([]uint8, len(cb.centroids))
+	for m, centroids := range cb.centroids {
+		code[m] = uint8(pqNearest(centroids, vec[m*cb.subDim:(m+1)*cb.subDim]))
+	}
+	return code, true
+}
+
+// PQDistanceTable is a per-query lookup table of (squared) distances from the
+// query sub-vecs to all centroids, see PQCodebook.DistanceTable.
+type PQDistanceTable struct {
+	// t is indexed by [subspace][centroid].
+	t [][]float64
+}
+
+// DistanceTable creates a PQDistanceTable for the query, which is used to find
+// the approximate Euclidean distance between the query and any code made with
+// this codebook (see PQDistanceTable.Distance). Returns false if the query is
+// nil or if its dimension does not match the codebook.
+func (cb *PQCodebook) DistanceTable(query Distancer) (*PQDistanceTable, bool) {
+	if query == nil || reflect.ValueOf(query).IsNil() || query.Dim() != cb.dim {
+		return nil, false
+	}
+
+	vec := pqPeekAll(query)
+	table := PQDistanceTable{t: make([][]float64, len(cb.centroids))}
+	for m, centroids := range cb.centroids {
+		table.t[m] = make([]float64, len(centroids))
+		for i, c := range centroids {
+			table.t[m][i] = pqSquaredDist(c, vec[m*cb.subDim:(m+1)*cb.subDim])
+		}
+	}
+	return &table, true
+}
+
+// Distance returns the approximate Euclidean distance between the query of the
+// table and the given PQVec. Returns false if the PQVec is nil or if it was
+// encoded with a codebook with another number of subspaces.
+func (t *PQDistanceTable) Distance(v *PQVec) (float64, bool) {
+	if v == nil || len(v.code) != len(t.t) {
+		return 0, false
+	}
+
+	r := 0.
+	for m, c := range v.code {
+		r += t.t[m][c]
+	}
+	return math.Sqrt(r), true
+}
+
+// PQVec is a PQ encoded vec, along with the DistancerContainer it was encoded
+// from (see PQVec.Original). It is the Distancer of the ScanItem instances sent
+// by PQIndex.Scan, and implements mathx.Distancer with the decoded (i.e lossy)
+// vec, though PQDistanceTable.Distance is the intended way of scoring it.
+// Note; read-only after creation, so it is thread safe.
+type PQVec struct {
+	cb   *PQCodebook
+	code []uint8
+	dc   DistancerContainer
+}
+
+// Symbolic.
+var _ Distancer = &PQVec{}
+
+// Original returns the Distancer of the container that this PQVec was encoded
+// from, which is nil if the container is expired.
+func (v *PQVec) Original() Distancer {
+	return v.dc.Distancer()
+}
+
+// Peek returns the decoded element at the given index, i.e the element of the
+// centroid that the element was quantized to. False return means out-of-bounds.
+func (v *PQVec) Peek(index int) (float64, bool) {
+	if index < 0 || index >= v.cb.dim {
+		return 0, false
+	}
+	m := index / v.cb.subDim
+	return v.cb.centroids[m][v.code[m]][index%v.cb.subDim], true
+}
+
+// Dim returns the dimension of the decoded vec.
+func (v *PQVec) Dim() int {
+	return v.cb.dim
+}
+
+// Norm returns the norm of the decoded vec.
+func (v *PQVec) Norm() float64 {
+	r := 0.
+	for m, c := range v.code {
+		for _, elm := range v.cb.centroids[m][c] {
+			r += elm * elm
+		}
+	}
+	return math.Sqrt(r)
+}
+
+// EuclideanDistance computes the Euclidean distance between the decoded vec and
+// another vec that implements the Distancer interface (mathx pkg).
+// False condition if:
+//	neq dimension for the two vecs.
+func (v *PQVec) EuclideanDistance(other Distancer) (float64, bool) {
+	if other == nil || v.cb.dim != other.Dim() {
+		return 0, false
+	}
+
+	r := 0.
+	for i := 0; i < v.cb.dim; i++ {
+		a, _ := v.Peek(i)
+		b, _ := other.Peek(i)
+		r += (a - b) * (a - b)
+	}
+	return math.Sqrt(r), true
+}
+
+// CosineSimilarity finds the cosine similarity between the decoded vec and the
+// other. Returns false on two conditions, if;
+//	(A): neq dimensions.
+//	(B): one of the vectors is a zero vector.
+func (v *PQVec) CosineSimilarity(other Distancer) (float64, bool) {
+	if other == nil || v.cb.dim != other.Dim() {
+		return 0, false
+	}
+
+	dot := 0.
+	for i := 0; i < v.cb.dim; i++ {
+		a, _ := v.Peek(i)
+		b, _ := other.Peek(i)
+		dot += a * b
+	}
+
+	norms := v.Norm() * other.Norm()
+	if norms == 0 {
+		return 0, false
+	}
+	return dot / norms, true
+}
+
+// PQIndex keeps PQ encoded DistancerContainer instances (see PQCodebook), such
+// that they can be scanned with less memory traffic than the raw vecs. It does
+// not own the containers: expired containers (DistancerContainer.Distancer
+// returns nil) are skipped when scanning and dropped when the index grows.
+type PQIndex struct {
+	cb    *PQCodebook
+	items []*PQVec
+	mx    sync.RWMutex
+}
+
+// NewPQIndex creates a new empty PQIndex which encodes with the given codebook.
+// Returns (nil, false) if the codebook is nil.
+func NewPQIndex(cb *PQCodebook) (*PQIndex, bool) {
+	if cb == nil {
+		return nil, false
+	}
+	return &PQIndex{cb: cb}, true
+}
+
+// Codebook returns the codebook used by the index.
+func (ix *PQIndex) Codebook() *PQCodebook {
+	return ix.cb
+}
+
+// Add encodes and adds a DistancerContainer to the index. Returns false if the
+// container is nil, expired or has another dimension than the codebook. Expired
+// containers are removed before the underlying slice grows, such that they do
+// not accumulate.
+func (ix *PQIndex) Add(dc DistancerContainer) bool {
+	if dc == nil || reflect.ValueOf(dc).IsNil() {
+		return false
+	}
+	code, ok := ix.cb.Encode(dc.Distancer())
+	if !ok {
+		return false
+	}
+
+	ix.mx.Lock()
+	defer ix.mx.Unlock()
+	if len(ix.items) == cap(ix.items) {
+		ix.remove(func(dc DistancerContainer) bool { return dc.Distancer() == nil })
+	}
+	ix.items = append(ix.items, &PQVec{cb: ix.cb, code: code, dc: dc})
+	return true
+}
+
+// Remove removes all containers where 'pred' returns true, and returns how many
+// were removed. Note that 'pred' is called while holding a lock.
+func (ix *PQIndex) Remove(pred func(DistancerContainer) bool) int {
+	ix.mx.Lock()
+	defer ix.mx.Unlock()
+	return ix.remove(pred)
+}
+
+// remove is the impl of PQIndex.Remove, the caller must hold the lock.
+func (ix *PQIndex) remove(pred func(DistancerContainer) bool) int {
+	kept := ix.items[:0]
+	for _, item := range ix.items {
+		if !pred(item.dc) {
+			kept = append(kept, item)
+		}
+	}
+	n := len(ix.items) - len(kept)
+	// Clear the tail such that removed items can be garbage collected.
+	for i := len(kept); i < len(ix.items); i++ {
+		ix.items[i] = nil
+	}
+	ix.items = kept
+	return n
+}
+
+// Len returns the number of containers in the index, including expired ones.
+func (ix *PQIndex) Len() int {
+	ix.mx.RLock()
+	defer ix.mx.RUnlock()
+	return len(ix.items)
+}
+
+// MemoryBytes returns the number of bytes used for the codes of the index (one
+// byte per subspace per container), which can be compared with the 8 bytes per
+// element needed for raw float64 vecs. The centroids and per-item overhead are
+// not included, as they do not scale with the dimension.
+func (ix *PQIndex) MemoryBytes() int {
+	ix.mx.RLock()
+	defer ix.mx.RUnlock()
+	return len(ix.items) * ix.cb.M()
+}
+
+// Scan is the PQIndex equivalent of SearchSpaces.Scan, where the ScanItem
+// instances are *PQVec (see PQDistanceTable.Distance and PQVec.Original).
+// The index is split into (at most) args.NWorkers parts, each scanned by its
+// own worker, and args.Extent is applied to each part. args.Status,
+// args.Seed, args.BlockDeadline (with args.OnBlockDeadline) and args.Unscanned
+// are used in the same way as for SearchSpaces.Scan (each part is seeded as a
+// SearchSpace). Return is (nil, false) if args.Ok() == false.
+func (ix *PQIndex) Scan(args SearchSpacesScanArgs) (<-chan ScanChan, bool) {
+	if !args.Ok() {
+		return nil, false
+	}
+
+	// Copy, such that the lock is not held while scanning.
+	ix.mx.RLock()
+	items := append([]*PQVec(nil), ix.items...)
+	ix.mx.RUnlock()
+
+	nParts := args.NWorkers
+	if nParts > len(items) {
+		nParts = len(items)
+	}
+	out := make(chan ScanChan, nParts)
+	aborted := int32(ScanCompleted)
+	wg := sync.WaitGroup{}
+	seeds := seedSource(args.Seed)
+	for i := 0; i < nParts; i++ {
+		part := items[i*len(items)/nParts : (i+1)*len(items)/nParts]
+		wg.Add(1)
+		out <- ix.scanPart(part, args, seeds(), &aborted, wg.Done)
+	}
+	close(out)
+
+	if args.Status != nil {
+		go func() {
+			wg.Wait()
+			args.Status <- ScanStatus(atomic.LoadInt32(&aborted))
+		}()
+	}
+	return out, true
+}
+
+// scanPart starts a worker which sends the non-expired items of 'part' (with
+// extent args.Extent, starting at an offset derived from 'seed', see
+// seededOffset), see PQIndex.Scan. 'aborted' is set in the same way as for
+// SearchSpace.scan, and 'done' is called when the worker returns.
+func (ix *PQIndex) scanPart(
+	part []*PQVec,
+	args SearchSpacesScanArgs,
+	seed int64,
+	aborted *int32,
+	done func(),
+) ScanChan {
+	ch := make(chan ScanItem, args.Buf)
+	go func() {
+		defer close(ch)
+		defer done()
+		if args.UnsafeDoneCallback != nil {
+			defer args.UnsafeDoneCallback()
+		}
+
+		sender := newScanSender(ch, args.inherited(), aborted, args.Unscanned)
+		defer sender.stopTimers()
+
+		step := int(math.Max(1, math.Round(1/args.Extent)))
+		for i := seededOffset(seed, step); i < len(part); i += step {
+			if part[i].Original() == nil {
+				continue
+			}
+			item := ScanItem{
+				Distancer: part[i],
+				ID:        containerID(part[i].dc),
+				Added:     containerAdded(part[i].dc),
+				Container: part[i].dc,
+			}
+			if !sender.send(item) {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// UnwrapPQ replaces *PQVec Distancer instances of the items with their original
+// Distancer (see PQVec.Original), in place. Items where the original is expired
+// are removed, while the order of the rest is kept, i.e the slice is still
+// sorted if it was before. The removed items are replaced with unset items
+// at the end, such that the len is the same.
+func (items ScoreItems) UnwrapPQ() {
+	n := 0
+	for _, item := range items {
+		if v, ok := item.Distancer.(*PQVec); ok && item.Set {
+			if item.Distancer = v.Original(); item.Distancer == nil {
+				continue
+			}
+		}
+		items[n] = item
+		n++
+	}
+	for i := n; i < len(items); i++ {
+		items[i] = ScoreItem{}
+	}
+}
@@ -0,0 +1,189 @@
+package knnc
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+// pqTestData returns n vecs of the given dim, clustered around nClusters random
+// centers (such that there is structure for the codebook to learn).
+func pqTestData(rng *rand.Rand, n, dim, nClusters int) []*data {
+	centers := make([][]float64, nClusters)
+	for i := range centers {
+		centers[i] = make([]float64, dim)
+		for j := range centers[i] {
+			centers[i][j] = rng.Float64()*2 - 1
+		}
+	}
+
+	r := make([]*data, n)
+	for i := range r {
+		vec := make([]float64, dim)
+		for j, elm := range centers[rng.Intn(nClusters)] {
+			vec[j] = elm + rng.NormFloat64()*0.1
+		}
+		r[i] = &data{v: newTVec(vec...)}
+	}
+	return r
+}
+
+// pqTestIndex trains a codebook on (all of) 'ds' and adds them to a new index.
+func pqTestIndex(t *testing.T, ds []*data, args TrainPQArgs) *PQIndex {
+	sample := make([]Distancer, len(ds))
+	for i, d := range ds {
+		sample[i] = d.v
+	}
+	cb, ok := TrainPQ(sample, args)
+	if !ok {
+		t.Fatal("could not train codebook")
+	}
+	ix, _ := NewPQIndex(cb)
+	for _, d := range ds {
+		if !ix.Add(d) {
+			t.Fatal("could not add to index")
+		}
+	}
+	return ix
+}
+
+// pqTestKNN does an exhaustive KNN of 'query' with PQIndex.Scan, where the
+// scores are the approximate distances.
+func pqTestKNN(ix *PQIndex, query Distancer, k int) ScoreItems {
+	table, _ := ix.Codebook().DistanceTable(query)
+	scanChans, _ := ix.Scan(SearchSpacesScanArgs{
+		Extent: 1,
+		BaseStageArgs: BaseStageArgs{
+			NWorkers:       4,
+			BaseWorkerArgs: BaseWorkerArgs{Buf: 10, Cancel: NewCancelSignal(), TTL: time.Second},
+		},
+	})
+
+	r := make(ScoreItems, k)
+	for scanChan := range scanChans {
+		for scanItem := range scanChan {
+			score, _ := table.Distance(scanItem.Distancer.(*PQVec))
+			r.BubbleInsert(ScoreItem{Distancer: scanItem.Distancer, Score: score, Set: true}, true)
+		}
+	}
+	r.UnwrapPQ()
+	return r
+}
+
+// exactTestKNN does an exhaustive and exact KNN of 'query' in 'ds'.
+func exactTestKNN(ds []*data, query Distancer, k int) ScoreItems {
+	r := make(ScoreItems, k)
+	for _, d := range ds {
+		score, _ := query.EuclideanDistance(d.v)
+		r.BubbleInsert(ScoreItem{Distancer: d.v, Score: score, Set: true}, true)
+	}
+	return r
+}
+
+func TestTrainPQ(t *testing.T) {
+	sample := []Distancer{newTVec(1, 2, 3, 4), newTVec(4, 3, 2, 1)}
+
+	if _, ok := TrainPQ(sample, TrainPQArgs{M: 3}); ok {
+		t.Fatal("trained a codebook where the dim is not divisible by M")
+	}
+	if _, ok := TrainPQ(sample, TrainPQArgs{M: 2, KSub: 257}); ok {
+		t.Fatal("trained a codebook with KSub > 256")
+	}
+	if _, ok := TrainPQ(nil, TrainPQArgs{M: 2}); ok {
+		t.Fatal("trained a codebook with an empty sample")
+	}
+	if _, ok := TrainPQ(append(sample, newTVec(1, 2)), TrainPQArgs{M: 2}); ok {
+		t.Fatal("trained a codebook with mixed dims")
+	}
+
+	cb, ok := TrainPQ(sample, TrainPQArgs{M: 2})
+	if !ok {
+		t.Fatal("could not train a codebook with valid args")
+	}
+	if cb.Dim() != 4 || cb.M() != 2 {
+		t.Fatalf("unexpected codebook dim/m: %v/%v", cb.Dim(), cb.M())
+	}
+
+	// KSub is capped to the sample size, so the sample is encoded exactly.
+	for _, d := range sample {
+		code, _ := cb.Encode(d)
+		table, _ := cb.DistanceTable(d)
+		dist, _ := table.Distance(&PQVec{cb: cb, code: code})
+		if dist != 0 {
+			t.Fatalf("sample vec %v was not encoded exactly, dist: %v", d, dist)
+		}
+	}
+	if _, ok := cb.Encode(newTVec(1, 2)); ok {
+		t.Fatal("encoded a vec with a dim that does not match the codebook")
+	}
+}
+
+func TestPQIndexRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ds := pqTestData(rng, 2000, 32, 200)
+	ix := pqTestIndex(t, ds, TrainPQArgs{M: 8, KSub: 64, Seed: 1})
+
+	k := 10
+	nQueries := 20
+	hits := 0
+	for i := 0; i < nQueries; i++ {
+		query := ds[rng.Intn(len(ds))].v
+		want := map[Distancer]bool{}
+		for _, item := range exactTestKNN(ds, query, k) {
+			want[item.Distancer] = true
+		}
+		for _, item := range pqTestKNN(ix, query, k) {
+			if want[item.Distancer] {
+				hits++
+			}
+		}
+	}
+
+	recall := float64(hits) / float64(k*nQueries)
+	t.Logf("recall@%v: %.3f", k, recall)
+	if recall < 0.5 {
+		t.Fatalf("unexpectedly low recall@%v: %v", k, recall)
+	}
+}
+
+func TestPQIndexMemory(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dim := 64
+	ds := pqTestData(rng, 500, dim, 10)
+	ix := pqTestIndex(t, ds, TrainPQArgs{M: 8, Seed: 1})
+
+	raw := len(ds) * dim * 8 // float64.
+	codes := ix.MemoryBytes()
+	t.Logf("raw: %vB, codes: %vB (%.1fx smaller)", raw, codes, float64(raw)/float64(codes))
+	if codes != len(ds)*8 {
+		t.Fatalf("unexpected code size: %v", codes)
+	}
+	if codes*64 != raw {
+		t.Fatalf("unexpected ratio between raw and code size: %v/%v", raw, codes)
+	}
+}
+
+func TestPQIndexExpiredAndRemove(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ds := pqTestData(rng, 10, 4, 2)
+	ix := pqTestIndex(t, ds, TrainPQArgs{M: 2, Seed: 1})
+
+	ds[0].Expires = time.Now().Add(-time.Second)
+	for _, item := range pqTestKNN(ix, ds[1].v, len(ds)) {
+		if item.Distancer == mathx.Distancer(ds[0].v) {
+			t.Fatal("expired data was included in the result")
+		}
+	}
+
+	n := ix.Remove(func(dc DistancerContainer) bool { return dc == ds[1] || dc == ds[2] })
+	if n != 2 || ix.Len() != len(ds)-2 {
+		t.Fatalf("unexpected remove result: n=%v, len=%v", n, ix.Len())
+	}
+
+	items := pqTestKNN(ix, ds[3].v, len(ds))
+	if !items[len(items)-4].Set || items[len(items)-3].Set {
+		t.Fatalf("unexpected number of results: %v", items.Trim())
+	}
+}
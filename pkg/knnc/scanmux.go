@@ -0,0 +1,105 @@
+package knnc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/crunchypi/ddrop/pkg/syncx"
+)
+
+/*
+File contains a multiplexer for scans (see SearchSpaces.Scan), such that a
+single scan can feed multiple consumers (e.g one Pipeline per query vec in a
+batch of KNN requests on the same data), i.e the scan cost is amortized.
+*/
+
+// scanMuxConsumer is a single consumer of MultiplexScan.
+type scanMuxConsumer struct {
+	// ctx is done on BaseWorkerArgs.Cancel or BaseWorkerArgs.TTL.
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    chan ScanChan
+}
+
+// newScanMuxConsumer sets up a scanMuxConsumer with the given args. This starts
+// a goroutine which stops when scanMuxConsumer.cancel is called.
+func newScanMuxConsumer(args BaseWorkerArgs) *scanMuxConsumer {
+	ctx, cancel := context.WithTimeout(context.Background(), args.TTL)
+	go func() {
+		select {
+		case <-args.Cancel.c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return &scanMuxConsumer{ctx: ctx, cancel: cancel, out: make(chan ScanChan, args.Buf)}
+}
+
+// MultiplexScan fans out a scan, i.e the return of SearchSpaces.Scan, to one
+// output per BaseWorkerArgs in 'outs'. Each output gets its own ScanChan for
+// each ScanChan in 'in', and every ScanItem is sent to all of them (with
+// syncx.TeeWithArgs). As such, each output can be consumed as if it were
+// returned from SearchSpaces.Scan, e.g with Pipeline.AddScanner.
+//
+// The BaseWorkerArgs of an output is used as follows: Buf is the buffer for
+// its chans, while Cancel and TTL stop sending to (and close) that output
+// only. Other outputs are not affected, and 'in' is always drained such that
+// the scanners do not block. Note that cancelling all outputs does not stop
+// the scan itself, that must be done with the args of SearchSpaces.Scan.
+//
+// Sends are done to one output at a time, so a slow consumer will also slow
+// down the others (as they share the scan). A larger Buf can mitigate that.
+//
+// Returns (nil, false) if 'in' is nil, 'outs' is empty or any of 'outs' is
+// not ok (BaseWorkerArgs.Ok).
+func MultiplexScan(in <-chan ScanChan, outs []BaseWorkerArgs) ([]<-chan ScanChan, bool) {
+	if in == nil || len(outs) == 0 {
+		return nil, false
+	}
+	for i := range outs {
+		if !outs[i].Ok() {
+			return nil, false
+		}
+	}
+
+	consumers := make([]*scanMuxConsumer, len(outs))
+	teeOutputs := make([]syncx.TeeOutput, len(outs))
+	res := make([]<-chan ScanChan, len(outs))
+	for i := range outs {
+		consumers[i] = newScanMuxConsumer(outs[i])
+		teeOutputs[i] = syncx.TeeOutput{Ctx: consumers[i].ctx, Buf: outs[i].Buf}
+		res[i] = consumers[i].out
+	}
+
+	go func() {
+		wg := sync.WaitGroup{}
+		defer func() {
+			for _, c := range consumers {
+				close(c.out)
+			}
+			// Contexts are still used by the tees.
+			wg.Wait()
+			for _, c := range consumers {
+				c.cancel()
+			}
+		}()
+
+		for scanChan := range in {
+			wg.Add(1)
+			tees, _ := syncx.TeeWithArgs(syncx.TeeArgs[ScanItem]{
+				In:           scanChan,
+				Outputs:      teeOutputs,
+				DoneCallback: wg.Done,
+			})
+			for i, c := range consumers {
+				select {
+				case c.out <- tees[i]:
+				case <-c.ctx.Done():
+					// Tee closes the chan without sending, as ctx is done.
+				}
+			}
+		}
+	}()
+
+	return res, true
+}
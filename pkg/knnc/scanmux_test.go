@@ -0,0 +1,148 @@
+package knnc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestScanMuxSearchSpaces creates SearchSpaces with 'n' SearchSpace instances
+// of 'l' vecs each, where the vecs have a single unique element.
+func newTestScanMuxSearchSpaces(n, l int) *SearchSpaces {
+	ss := SearchSpaces{
+		searchSpaces:            make([]*SearchSpace, 0, n),
+		searchSpacesMaxCap:      l,
+		uniformVecDim:           1,
+		maintenanceTaskInterval: 1,     // Does not matter.
+		maintenanceActive:       false, // Does not matter.
+	}
+	for i := 0; i < n; i++ {
+		items := make([]DistancerContainer, l)
+		for j := range items {
+			items[j] = &data{v: newTVec(float64(i*l + j))}
+		}
+		ss.searchSpaces = append(ss.searchSpaces, &SearchSpace{items: items})
+	}
+	return &ss
+}
+
+func TestMultiplexScan(t *testing.T) {
+	ss := newTestScanMuxSearchSpaces(10, 100)
+
+	// Counts scanners, i.e SearchSpace instances scanned.
+	var scanned int64
+	scanChans, _ := ss.Scan(SearchSpacesScanArgs{
+		Extent: 1.,
+		BaseStageArgs: BaseStageArgs{
+			NWorkers: 2,
+			BaseWorkerArgs: BaseWorkerArgs{
+				Cancel:             NewCancelSignal(),
+				TTL:                time.Second * 10,
+				UnsafeDoneCallback: func() { atomic.AddInt64(&scanned, 1) },
+			},
+		},
+	})
+
+	n := 3
+	outs := make([]BaseWorkerArgs, n)
+	for i := range outs {
+		outs[i] = BaseWorkerArgs{Buf: i, Cancel: NewCancelSignal(), TTL: time.Second * 10}
+	}
+	muxed, ok := MultiplexScan(scanChans, outs)
+	if !ok || len(muxed) != n {
+		t.Fatal("unexpected not-ok multiplex")
+	}
+
+	// Consumers must be concurrent, as they share the scan.
+	results := make([]map[float64]bool, n)
+	wg := sync.WaitGroup{}
+	for i := range muxed {
+		results[i] = make(map[float64]bool)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for scanChan := range muxed[i] {
+				for scanItem := range scanChan {
+					element, _ := scanItem.Distancer.Peek(0)
+					results[i][element] = true
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if scanned != 10 {
+		t.Fatalf("want 10 SearchSpace instances scanned once, have %v", scanned)
+	}
+	for i, result := range results {
+		if len(result) != 1000 {
+			t.Fatalf("output %v got %v unique items, want 1000", i, len(result))
+		}
+	}
+}
+
+func TestMultiplexScanCancel(t *testing.T) {
+	ss := newTestScanMuxSearchSpaces(10, 100)
+
+	scanChans, _ := ss.Scan(SearchSpacesScanArgs{
+		Extent: 1.,
+		BaseStageArgs: BaseStageArgs{
+			NWorkers: 2,
+			BaseWorkerArgs: BaseWorkerArgs{
+				Cancel: NewCancelSignal(),
+				TTL:    time.Second * 10,
+			},
+		},
+	})
+
+	cancelled := BaseWorkerArgs{Cancel: NewCancelSignal(), TTL: time.Second * 10}
+	other := BaseWorkerArgs{Cancel: NewCancelSignal(), TTL: time.Second * 10}
+	muxed, _ := MultiplexScan(scanChans, []BaseWorkerArgs{cancelled, other})
+
+	// First output is cancelled after a single item and then abandoned, which
+	// must neither block nor corrupt the other output.
+	go func() {
+		for scanChan := range muxed[0] {
+			for range scanChan {
+				cancelled.Cancel.Cancel()
+				return
+			}
+		}
+	}()
+
+	n := 0
+	seen := make(map[float64]bool)
+	for scanChan := range muxed[1] {
+		for scanItem := range scanChan {
+			element, _ := scanItem.Distancer.Peek(0)
+			seen[element] = true
+			n++
+		}
+	}
+	if n != 1000 || len(seen) != 1000 {
+		t.Fatalf("want 1000 unique items in uncancelled output, have %v (%v unique)", n, len(seen))
+	}
+}
+
+func TestMultiplexScanArgs(t *testing.T) {
+	in := make(chan ScanChan)
+	close(in)
+
+	ok := BaseWorkerArgs{Cancel: NewCancelSignal(), TTL: time.Second}
+	for _, tc := range []struct {
+		name string
+		in   <-chan ScanChan
+		outs []BaseWorkerArgs
+		want bool
+	}{
+		{name: "ok", in: in, outs: []BaseWorkerArgs{ok}, want: true},
+		{name: "nil in", in: nil, outs: []BaseWorkerArgs{ok}, want: false},
+		{name: "no outs", in: in, outs: nil, want: false},
+		{name: "bad out", in: in, outs: []BaseWorkerArgs{ok, {Cancel: NewCancelSignal()}}, want: false},
+	} {
+		if _, have := MultiplexScan(tc.in, tc.outs); have != tc.want {
+			t.Fatalf("%v: want %v, have %v", tc.name, tc.want, have)
+		}
+	}
+}
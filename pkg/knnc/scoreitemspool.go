@@ -0,0 +1,116 @@
+package knnc
+
+import "sync"
+
+/*
+File contains a pool of ScoreItems slices, which reduces allocations in the
+merge path of KNN requests (see MergeStage), where many short-lived slices are
+created per request.
+*/
+
+// scoreItemsHolder owns a pooled ScoreItems slice. Pointers to holders are
+// pooled instead of the slices themselves, as putting a slice into a sync.Pool
+// allocates a copy of the slice header.
+type scoreItemsHolder struct {
+	items ScoreItems
+}
+
+// scoreItemsPool keeps *scoreItemsHolder with slices for reuse, all items in
+// those slices are unset. scoreItemsHolders keeps the empty ones, such that
+// neither GetScoreItems nor PutScoreItems allocate a holder once warmed up.
+var (
+	scoreItemsPool    = sync.Pool{}
+	scoreItemsHolders = sync.Pool{}
+)
+
+// pooler is the part of sync.Pool used here, such that the logic of
+// GetScoreItems and PutScoreItems can be tested with a pool which does not
+// drop items (sync.Pool can, e.g on GC or randomly with the race detector).
+type pooler interface {
+	Get() any
+	Put(any)
+}
+
+// getScoreItemsTries is the max number of pooled slices that GetScoreItems
+// tries before it allocates a new one. Slices which are too small are put back,
+// so trying more than one avoids being stuck with a small one.
+const getScoreItemsTries = 2
+
+// GetScoreItems returns ScoreItems with the length n, where all items are unset
+// (zero values). The slice might be reused from an earlier PutScoreItems call,
+// in which case nothing else has a ref to it. Returns nil if n < 0.
+func GetScoreItems(n int) ScoreItems {
+	return getScoreItems(&scoreItemsPool, &scoreItemsHolders, n)
+}
+
+// getScoreItems is the impl of GetScoreItems, with 'pool' and 'holders' in
+// place of scoreItemsPool and scoreItemsHolders.
+func getScoreItems(pool, holders pooler, n int) ScoreItems {
+	if n < 0 {
+		return nil
+	}
+
+	var items ScoreItems
+	var tooSmall [getScoreItemsTries]*scoreItemsHolder
+	for i := range tooSmall {
+		h, ok := pool.Get().(*scoreItemsHolder)
+		if !ok {
+			break
+		}
+		if cap(h.items) < n {
+			tooSmall[i] = h
+			continue
+		}
+		items = h.items[:n]
+		h.items = nil
+		holders.Put(h)
+		break
+	}
+	// Too small for this call, but might do for others.
+	for _, h := range tooSmall {
+		if h != nil {
+			pool.Put(h)
+		}
+	}
+
+	if items == nil {
+		items = make(ScoreItems, n)
+	}
+	return items
+}
+
+// PutScoreItems gives ScoreItems back for reuse by GetScoreItems. This is
+// optional, but the caller must not use the slice afterwards (or any other
+// slice with the same backing array), as it will be reset and reused. Slices
+// from any source can be given back, not only those from GetScoreItems.
+//
+// Note that the ScoreItems sent from MergeStage (and so, Pipeline) are owned
+// by the receiver, so they can be given back when they are consumed.
+func PutScoreItems(items ScoreItems) {
+	putScoreItems(&scoreItemsPool, &scoreItemsHolders, items)
+}
+
+// putScoreItems is the impl of PutScoreItems, with 'pool' and 'holders' in
+// place of scoreItemsPool and scoreItemsHolders.
+func putScoreItems(pool, holders pooler, items ScoreItems) {
+	if cap(items) == 0 {
+		return
+	}
+	// Reset, which also drops the refs to Distancer instances.
+	items = items[:cap(items)]
+	items.reset()
+
+	h, ok := holders.Get().(*scoreItemsHolder)
+	if !ok {
+		h = &scoreItemsHolder{}
+	}
+	h.items = items
+	pool.Put(h)
+}
+
+// reset sets all items to their zero value (unset).
+func (items ScoreItems) reset() {
+	for i := range items {
+		items[i] = ScoreItem{}
+	}
+}
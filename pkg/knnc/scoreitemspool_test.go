@@ -0,0 +1,100 @@
+package knnc
+
+import (
+	"testing"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestGetPutScoreItems(t *testing.T) {
+	if GetScoreItems(-1) != nil {
+		t.Fatal("want nil with a negative len")
+	}
+
+	for i := 0; i < 100; i++ {
+		n := i % 10
+		items := GetScoreItems(n)
+		if len(items) != n {
+			t.Fatalf("want len %v, have %v", n, len(items))
+		}
+		for j, item := range items {
+			if item.Set || item.Distancer != nil || item.Score != 0 {
+				t.Fatalf("iter %v: item %v is not reset: %+v", i, j, item)
+			}
+		}
+		// Dirty items before giving them back, which should not leak into
+		// later calls.
+		for j := range items {
+			items[j] = ScoreItem{Distancer: mathx.NewSafeVec(1), Score: 1, Set: true}
+		}
+		PutScoreItems(items)
+	}
+
+	// Should not panic.
+	PutScoreItems(nil)
+}
+
+// testPool is a pooler which does not drop items, unlike sync.Pool. Get
+// returns the last item given to Put, or nil if it is empty.
+type testPool struct {
+	items []any
+}
+
+func (p *testPool) Get() any {
+	if len(p.items) == 0 {
+		return nil
+	}
+	item := p.items[len(p.items)-1]
+	p.items = p.items[:len(p.items)-1]
+	return item
+}
+
+func (p *testPool) Put(item any) {
+	p.items = append(p.items, item)
+}
+
+func TestGetScoreItemsTooSmall(t *testing.T) {
+	pool, holders := &testPool{}, &testPool{}
+	small := make(ScoreItems, 10)
+	putScoreItems(pool, holders, small)
+
+	// Too small, so a new one, while the small one is kept for later calls.
+	if items := getScoreItems(pool, holders, 20); len(items) != 20 || cap(items) == 10 {
+		t.Fatal("got a slice which is too small")
+	}
+	if len(pool.items) != 1 {
+		t.Fatal("a pooled slice was dropped because it was too small once")
+	}
+	if items := getScoreItems(pool, holders, 5); len(items) != 5 || &items[0] != &small[0] {
+		t.Fatal("a pooled slice was not reused")
+	}
+	if len(pool.items) != 0 || len(holders.items) != 1 {
+		t.Fatalf("want the holder back, have %v, %v", len(pool.items), len(holders.items))
+	}
+}
+
+func TestGetScoreItemsTooSmallTries(t *testing.T) {
+	pool, holders := &testPool{}, &testPool{}
+	big := make(ScoreItems, 20)
+	putScoreItems(pool, holders, big)
+	putScoreItems(pool, holders, make(ScoreItems, 10))
+
+	// The small one is tried first, but the big one is found anyway.
+	if items := getScoreItems(pool, holders, 20); &items[0] != &big[0] {
+		t.Fatal("want the pooled slice which is big enough")
+	}
+	if len(pool.items) != 1 {
+		t.Fatal("want the small slice back in the pool")
+	}
+}
+
+func TestGetPutScoreItemsAllocs(t *testing.T) {
+	PutScoreItems(make(ScoreItems, 10))
+	allocs := testing.AllocsPerRun(100, func() {
+		PutScoreItems(GetScoreItems(10))
+	})
+	// Not necessarily 0, as a sync.Pool can drop items (e.g on GC).
+	if allocs >= 1 {
+		t.Fatalf("want no allocs per get/put, have %v", allocs)
+	}
+}
@@ -2,8 +2,11 @@ package knnc
 
 import (
 	"math"
+	"math/rand"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/crunchypi/ddrop/pkg/mathx"
 )
@@ -21,7 +24,10 @@ type SearchSpace struct {
 	items  []DistancerContainer
 	vecDim int // Only uniform vectors (mathx.Distancer).
 	mx     sync.RWMutex
-	// TODO: Add locker bool?
+	// retired is set (to 1, with sync/atomic) when this instance is removed
+	// from a SearchSpaces, after which nothing can be added. See
+	// SearchSpace.retireIfEmpty and SearchSpace.retire.
+	retired int32
 }
 
 // NewSearchSpace is a factory func for the SearchSpace T. Only requirement
@@ -59,18 +65,43 @@ func (ss *SearchSpace) Dim() int {
 }
 
 // AddSearchable is the only way of adding data to this search space (do look
-// at the clean() and clear() methods, those are the only way to delete data).
+// at the Clean() and Clear() methods, those are the only way to delete data,
+// other than SearchSpaces.Remove).
 // There are a few rules for adding data here:
 //	-	All of vectors must be of equal length. To be specific, all integers
 //		from dc.Distancer().Dim() must be the same.
 //	-	The rule above does not apply if the SearchSpace.Len() == 0.
 //	-	SearchSpace.Len() will never be greater than SearchSpace.Cap(). So if
 //		SearchSpace.Len() >= SearchSpace.Cap(), then theis will abort.
+//	-	The instance must not be retired, i.e removed from a SearchSpaces.
 func (ss *SearchSpace) AddSearchable(dc DistancerContainer) bool {
+	return ss.addSearchableThen(dc, nil)
+}
+
+// addSearchableThen is the same as SearchSpace.AddSearchable, except that
+// 'then' (if not nil) is called with this instance after dc is added, while
+// the lock is still held. This orders it before any later removal of dc.
+func (ss *SearchSpace) addSearchableThen(dc DistancerContainer, then func(*SearchSpace)) bool {
 	ss.mx.Lock()
 	defer ss.mx.Unlock()
+	return ss.addSearchable(dc, then)
+}
 
-	if dc == nil {
+// tryAddSearchable is the same as SearchSpace.addSearchableThen, except that
+// it does not wait for the lock, e.g while the instance is scanned. The second
+// bool is false if the lock could not be acquired (nothing is added then).
+func (ss *SearchSpace) tryAddSearchable(dc DistancerContainer, then func(*SearchSpace)) (bool, bool) {
+	if !ss.mx.TryLock() {
+		return false, false
+	}
+	defer ss.mx.Unlock()
+	return ss.addSearchable(dc, then), true
+}
+
+// addSearchable is the impl of SearchSpace.addSearchableThen, the caller must
+// hold the (write) lock.
+func (ss *SearchSpace) addSearchable(dc DistancerContainer, then func(*SearchSpace)) bool {
+	if dc == nil || ss.isRetired() {
 		return false
 	}
 
@@ -97,6 +128,9 @@ func (ss *SearchSpace) AddSearchable(dc DistancerContainer) bool {
 	}
 
 	ss.items = append(ss.items, dc)
+	if then != nil {
+		then(ss)
+	}
 	return true
 }
 
@@ -105,22 +139,80 @@ func (ss *SearchSpace) AddSearchable(dc DistancerContainer) bool {
 // mathx.Distancer or a nil -- the latter is interpreted as a mark for
 // deletion and will be removed when calling this Clean() method.
 func (ss *SearchSpace) Clean() {
-	ss.mx.Lock()
-	defer ss.mx.Unlock()
-	i := 0
-	for i < len(ss.items) {
+	ss.clean()
+}
+
+// clean is the impl of SearchSpace.Clean, it returns the removed containers.
+func (ss *SearchSpace) clean() []DistancerContainer {
+	return ss.removeWhere(func(dc DistancerContainer) bool {
 		// NOTE: Checking nil with 'ss.items[i].Distancer() == nil'
 		// will not work if it's actually nil, due to some odd
 		// internatl (Go) behaviour. Do not change without running
 		// the unit test for this func.
-		d := ss.items[i].Distancer()
-		if d == nil || reflect.ValueOf(d).IsNil() {
+		d := dc.Distancer()
+		return d == nil || reflect.ValueOf(d).IsNil()
+	})
+}
+
+// removeWhere removes all containers where f returns true, and returns them
+// (nil if none were removed).
+func (ss *SearchSpace) removeWhere(f func(DistancerContainer) bool) []DistancerContainer {
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+
+	var removed []DistancerContainer
+	i := 0
+	for i < len(ss.items) {
+		if f(ss.items[i]) {
+			removed = append(removed, ss.items[i])
 			// _Should_ be re-sliced with O(1) going by Go docs/code.
 			ss.items = append(ss.items[:i], ss.items[i+1:]...)
 			continue
 		}
 		i++
 	}
+
+	// Any dim is accepted when empty, so this is just for consistency.
+	if len(ss.items) == 0 {
+		ss.vecDim = 0
+	}
+	return removed
+}
+
+// retireIfEmpty retires the instance if it is empty, such that nothing can be
+// added to it after it is removed from a SearchSpaces (which is done without
+// holding the lock of the instance). Returns true if the instance is retired.
+func (ss *SearchSpace) retireIfEmpty() bool {
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+	if len(ss.items) == 0 {
+		ss.retire()
+	}
+	return ss.isRetired()
+}
+
+// retire retires the instance regardless of its data, without waiting for the
+// lock, i.e adds that already hold it might still complete.
+func (ss *SearchSpace) retire() {
+	atomic.StoreInt32(&ss.retired, 1)
+}
+
+// isRetired returns true if the instance is retired, see retireIfEmpty.
+func (ss *SearchSpace) isRetired() bool {
+	return atomic.LoadInt32(&ss.retired) == 1
+}
+
+// Snapshot returns a point-in-time copy of the DistancerContainer references
+// in this search space. The lock is only held while copying, so the snapshot
+// can be iterated at any pace without blocking writers. Note that only the
+// references are copied; containers can still expire (i.e return a nil
+// mathx.Distancer) after the snapshot is taken.
+func (ss *SearchSpace) Snapshot() []DistancerContainer {
+	ss.mx.RLock()
+	defer ss.mx.RUnlock()
+	snapshot := make([]DistancerContainer, len(ss.items))
+	copy(snapshot, ss.items)
+	return snapshot
 }
 
 // Clear will reset the inner data slice and return the old slice.
@@ -135,42 +227,251 @@ func (ss *SearchSpace) Clear() []DistancerContainer {
 // ScanItem is a single/atomic item output from a SearchSpace.Scan.
 type ScanItem struct {
 	Distancer mathx.Distancer
+	// ID is the result of an 'ID() string' method on the DistancerContainer
+	// that Distancer came from, empty if it has none.
+	ID string
+	// Added is the result of an 'AddedTime() time.Time' method on the
+	// DistancerContainer that Distancer came from, zero if it has none.
+	Added time.Time
+	// Container is the DistancerContainer that Distancer came from, e.g for
+	// filtering on other data of the container, see
+	// MapStagePartialArgs.Predicate. It is not copied, so it must not be
+	// modified.
+	Container DistancerContainer
+}
+
+// containerAdded returns the insertion time of a DistancerContainer, if it has
+// an 'AddedTime() time.Time' method. Returns the zero time otherwise.
+func containerAdded(dc DistancerContainer) time.Time {
+	if adder, ok := dc.(interface{ AddedTime() time.Time }); ok {
+		return adder.AddedTime()
+	}
+	return time.Time{}
+}
+
+// seededOffset returns a pseudo-random offset in [0, step), derived from the
+// given seed (see SearchSpaceScanArgs.Seed). Returns 0 if seed is 0.
+func seededOffset(seed int64, step int) int {
+	if seed == 0 || step <= 1 {
+		return 0
+	}
+	return rand.New(rand.NewSource(seed)).Intn(step)
+}
+
+// seedSource returns a func which derives seeds from 'seed', i.e a new one on
+// each call, in a deterministic order. This is used for giving each scanner its
+// own SearchSpaceScanArgs.Seed. The func always returns 0 if 'seed' is 0.
+func seedSource(seed int64) func() int64 {
+	if seed == 0 {
+		return func() int64 { return 0 }
+	}
+	rng := rand.New(rand.NewSource(seed))
+	// Never 0, as that disables seeding.
+	return func() int64 { return rng.Int63() | 1 }
 }
 
 // ScanChan is the return of SearchSpace.Scan. It is a chan of ScanItem.
 type ScanChan <-chan ScanItem
 
+// BlockDeadlinePolicy specifies what a scanner does when sending a ScanItem
+// blocks for longer than SearchSpaceScanArgs.BlockDeadline, i.e when the
+// consumer of the scan is too slow.
+type BlockDeadlinePolicy int
+
+const (
+	// BlockDeadlineAbort aborts the scan, in the same way as when the TTL is
+	// exceeded, i.e the scan gets ScanTruncated. This is the default.
+	BlockDeadlineAbort BlockDeadlinePolicy = iota
+	// BlockDeadlineSkip skips the item that could not be sent and continues
+	// with the next one, i.e the scan gets ScanDegraded (unless it is aborted
+	// otherwise).
+	BlockDeadlineSkip
+)
+
+// Ok returns true if the BlockDeadlinePolicy is one of the defined constants.
+func (p BlockDeadlinePolicy) Ok() bool {
+	return p == BlockDeadlineAbort || p == BlockDeadlineSkip
+}
+
 // SearchSpaceScanArgs is intended for SearchSpace.Scan().
 type SearchSpaceScanArgs struct {
 	// Extend refers to the search extent. 1=scan whole searchspace, 0.5=half.
 	// Must be >= 0.0 and <= 1.0.
 	Extent float64
+	// Seed is optional. If not 0, then the items which are scanned (with an
+	// Extent < 1) start at a pseudo-random offset derived from Seed, instead
+	// of at the first item, see seededOffset. The same Seed gives the same
+	// items (for the same data), while different seeds give different samples.
+	Seed int64
+	// BlockDeadline is optional. If > 0, then it is the max time that sending
+	// a single ScanItem can block (as opposed to the TTL, which is for the
+	// whole scan), after which OnBlockDeadline applies. Must be >= 0.
+	BlockDeadline time.Duration
+	// OnBlockDeadline specifies what happens when BlockDeadline is hit. The
+	// default is BlockDeadlineAbort. Must be Ok().
+	OnBlockDeadline BlockDeadlinePolicy
 	BaseWorkerArgs
 }
 
 // Ok validates SearchSpaceScanArgs. Returns true iff:
 //	(1) args.Extent > 0.0 and <= 1.0.
-//	(2) Embedded BaseWorkerArgs.Ok() is true.
+//	(2) args.BlockDeadline >= 0.
+//	(3) args.OnBlockDeadline.Ok() is true.
+//	(4) Embedded BaseWorkerArgs.Ok() is true.
 func (args *SearchSpaceScanArgs) Ok() bool {
 	return boolsOk([]bool{
 		// Not strinctly needed but is an indicator of logic flaw.
 		args.Extent > 0.0 && args.Extent <= 1.0,
+		args.BlockDeadline >= 0,
+		args.OnBlockDeadline.Ok(),
 		args.BaseWorkerArgs.Ok(),
 	})
 }
 
+// scanSender sends the ScanItem instances of a single scanner (see
+// SearchSpace.scan and PQIndex.scanPart), while applying the cancel signal,
+// TTL and block deadline of its args. Items which are not sent because of a
+// deadline are counted as unscanned. Set it up with newScanSender and call
+// scanSender.stopTimers when done.
+type scanSender struct {
+	out    chan<- ScanItem
+	cancel *CancelSignal
+	// deadline is for the TTL. A timer (as opposed to
+	// BaseWorkerArgs.DeadlineSignal) is used such that the deadline does not
+	// cost an additional goroutine per scanner.
+	deadline *time.Timer
+	// block is for the block deadline, nil if it is not used.
+	block         *time.Timer
+	blockDeadline time.Duration
+	policy        BlockDeadlinePolicy
+	// aborted is set (with sync/atomic) to a ScanStatus if the scan is not
+	// completed, may be nil.
+	aborted *int32
+	// unscanned counts (with sync/atomic) items which were not sent due to a
+	// deadline, may be nil.
+	unscanned *int64
+	// stopped is true once the scan is aborted due to a deadline, after which
+	// items are only counted.
+	stopped bool
+}
+
+// newScanSender is a factory func for scanSender, where 'aborted' and
+// 'unscanned' may be nil (see the fields with the same names).
+func newScanSender(
+	out chan<- ScanItem,
+	args SearchSpaceScanArgs,
+	aborted *int32,
+	unscanned *int64,
+) *scanSender {
+	s := scanSender{
+		out:           out,
+		cancel:        args.Cancel,
+		deadline:      time.NewTimer(args.TTL),
+		blockDeadline: args.BlockDeadline,
+		policy:        args.OnBlockDeadline,
+		aborted:       aborted,
+		unscanned:     unscanned,
+	}
+	if args.BlockDeadline > 0 {
+		s.block = time.NewTimer(args.BlockDeadline)
+	}
+	return &s
+}
+
+// stopTimers stops the internal timers.
+func (s *scanSender) stopTimers() {
+	s.deadline.Stop()
+	if s.block != nil {
+		s.block.Stop()
+	}
+}
+
+// send sends 'item', or counts it as unscanned if the scan was aborted due to
+// a deadline (or if the block deadline is hit with BlockDeadlineSkip). Returns
+// false if the scanner should return, i.e if the scan was cancelled, or if it
+// was aborted while unscanned items are not counted.
+func (s *scanSender) send(item ScanItem) bool {
+	if s.stopped {
+		s.count()
+		return s.unscanned != nil
+	}
+
+	// Nil chan (never ready) without a block deadline.
+	var block <-chan time.Time
+	if s.block != nil {
+		if !s.block.Stop() {
+			// Drain, in case it fired without being received.
+			select {
+			case <-s.block.C:
+			default:
+			}
+		}
+		s.block.Reset(s.blockDeadline)
+		block = s.block.C
+	}
+
+	select {
+	case s.out <- item:
+		return true
+	case <-s.cancel.c:
+		if s.aborted != nil {
+			atomic.StoreInt32(s.aborted, int32(ScanCancelled))
+		}
+		return false
+	case <-s.deadline.C:
+	case <-block:
+		if s.policy == BlockDeadlineSkip {
+			if s.aborted != nil {
+				atomic.CompareAndSwapInt32(s.aborted, int32(ScanCompleted), int32(ScanDegraded))
+			}
+			s.count()
+			return true
+		}
+	}
+
+	// Deadline, abort.
+	s.stopped = true
+	if s.aborted != nil {
+		atomic.StoreInt32(s.aborted, int32(ScanTruncated))
+	}
+	s.count()
+	return s.unscanned != nil
+}
+
+// count increments s.unscanned, if set.
+func (s *scanSender) count() {
+	if s.unscanned != nil {
+		atomic.AddInt64(s.unscanned, 1)
+	}
+}
+
 // Scan starts a scanner worker which scans the SearchSpace (i.e not blocking).
 // Returns is (ScanChan, true) if args.Ok() == true, else return is (nil, false).
 // See SearchSpaceScanArgs and BaseWorkerArgs (embedded in ScanArgs) for details.
 // Note, scanner uses 'read mutex', so will not block multiple concurrent scans.
 func (ss *SearchSpace) Scan(args SearchSpaceScanArgs) (ScanChan, bool) {
+	return ss.scan(args, nil, nil, nil)
+}
+
+// scan is the impl of SearchSpace.Scan. If 'aborted' is not nil, then it is set
+// (with sync/atomic) to either ScanTruncated or ScanCancelled if the scan is
+// aborted due to a deadline (args.TTL or args.BlockDeadline) or args.Cancel,
+// respectively, or to ScanDegraded if items were skipped (see
+// BlockDeadlineSkip). If 'unscanned' is not nil, then the number of items
+// which were not sent due to a deadline is added to it (with sync/atomic).
+// Distancer instances in 'skip' are not sent (it is read-only here and may be
+// nil).
+func (ss *SearchSpace) scan(
+	args SearchSpaceScanArgs,
+	aborted *int32,
+	unscanned *int64,
+	skip map[Distancer]DistancerContainer,
+) (ScanChan, bool) {
 	if !args.Ok() {
 		return nil, false
 	}
 
 	out := make(chan ScanItem, args.Buf)
-	deadlineSignal, deadlineSignalCancel := args.DeadlineSignal()
-	defer deadlineSignalCancel.Cancel()
 
 	go func() {
 		defer close(out)
@@ -180,6 +481,9 @@ func (ss *SearchSpace) Scan(args SearchSpaceScanArgs) (ScanChan, bool) {
 			defer args.UnsafeDoneCallback()
 		}
 
+		sender := newScanSender(out, args, aborted, unscanned)
+		defer sender.stopTimers()
+
 		// Adjusted loop iteration to accommodate the specified search extent.
 		l := len(ss.items)
 		if l == 0 {
@@ -189,16 +493,23 @@ func (ss *SearchSpace) Scan(args SearchSpaceScanArgs) (ScanChan, bool) {
 		iterStep := l / int(math.Ceil(checkN))
 		remainder := l % int(math.Ceil(checkN))
 
-		i := 0
+		i := seededOffset(args.Seed, iterStep)
 		for i < l {
 			distancer := ss.items[i].Distancer()
 			// != nil does not work as expected.
-			if !(distancer == nil || reflect.ValueOf(distancer).IsNil()) {
-				select {
-				case out <- ScanItem{Distancer: distancer}:
-				case <-args.Cancel.c:
-					return
-				case <-deadlineSignal.c:
+			send := !(distancer == nil || reflect.ValueOf(distancer).IsNil())
+			if send && skip != nil {
+				_, skipped := skip[distancer]
+				send = !skipped
+			}
+			if send {
+				item := ScanItem{
+					Distancer: distancer,
+					ID:        containerID(ss.items[i]),
+					Added:     containerAdded(ss.items[i]),
+					Container: ss.items[i],
+				}
+				if !sender.send(item) {
 					return
 				}
 			}
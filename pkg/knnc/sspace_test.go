@@ -1,6 +1,7 @@
 package knnc
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -150,6 +151,51 @@ func TestSearchSpaceScanPartial(t *testing.T) {
 	}
 }
 
+// Validate that a seeded partial scan is reproducible, and that different seeds
+// sample different items.
+func TestSearchSpaceScanSeed(t *testing.T) {
+	ss := SearchSpace{}
+	for i := 0; i < 100; i++ {
+		ss.items = append(ss.items, &data{v: newTVec(float64(i))})
+	}
+
+	scan := func(seed int64) string {
+		ch, ok := ss.Scan(SearchSpaceScanArgs{
+			Extent: 0.1,
+			Seed:   seed,
+			BaseWorkerArgs: BaseWorkerArgs{
+				Buf:    1,
+				Cancel: NewCancelSignal(),
+				TTL:    time.Second,
+			},
+		})
+		if !ok {
+			t.Fatal("scan setup failed; invalid args")
+		}
+		var scanned []float64
+		for scanItem := range ch {
+			v, _ := scanItem.Distancer.(*tVec).Peek(0)
+			scanned = append(scanned, v)
+		}
+		if len(scanned) != 10 {
+			t.Fatalf("unexpected amt of scanned items with seed %v: %v", seed, len(scanned))
+		}
+		return fmt.Sprint(scanned)
+	}
+
+	samples := make(map[string]bool)
+	for seed := int64(1); seed <= 10; seed++ {
+		sample := scan(seed)
+		if scan(seed) != sample {
+			t.Fatalf("different items with the same seed: %v", seed)
+		}
+		samples[sample] = true
+	}
+	if len(samples) < 2 {
+		t.Fatal("all seeds gave the same items")
+	}
+}
+
 // Validate that the scanner stops after sending the stop signal.
 func TestSearchSpaceScanStopped(t *testing.T) {
 	ss := SearchSpace{
@@ -202,6 +248,8 @@ func TestSearchSpaceScanConcurrent(t *testing.T) {
 			TTL:    time.Second,
 		},
 	}
+	// Scanners are not drained, so they would otherwise linger until the TTL.
+	defer args.Cancel.Cancel()
 
 	ch1, ok := ss.Scan(args)
 	if !ok {
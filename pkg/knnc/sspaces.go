@@ -1,8 +1,10 @@
 package knnc
 
 import (
+	"math"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,6 +12,16 @@ import (
 File contains code for a 'SearchSpaces' (plural) type, which represents a
 collection of SearchSpace (singular) instances. The intended responsebility of
 SearchSpaces T is to manage data, for instance cleaning and scanning.
+
+Locking is two-level: SearchSpaces.mx only guards the membership (i.e the slice
+of SearchSpace instances) and a few fields, while the data is guarded by the
+lock of each SearchSpace. The slice is never changed in place; it is appended
+to (which readers with an earlier len do not see) or replaced with a filtered
+copy (see SearchSpaces.dropRetired). So the slice can be read without holding
+SearchSpaces.mx once it is copied (see SearchSpaces.spaces), which is how scans
+and writes work, such that they only contend on the SearchSpace they touch.
+A SearchSpace is retired (see SearchSpace.retireIfEmpty) before it is removed,
+such that data is not added to it by writers that still see it.
 */
 
 // SearchSpaces is intended for managing a collection of SearchSpace (singular)
@@ -23,6 +35,14 @@ type SearchSpaces struct {
 	maintenanceTaskInterval time.Duration
 	maintenanceActive       bool // If task loop started. Not for each step.
 
+	// keepEmpty is NewSearchSpacesArgs.KeepEmptySearchSpaces.
+	keepEmpty bool
+	// hot is nil unless NewSearchSpacesArgs.HotTierSize > 0.
+	hot *hotTier
+	// onEvict is NewSearchSpacesArgs.OnEvict.
+	onEvict func(id string, reason EvictReason)
+
+	// mx guards the membership, see the doc at the top of this file.
 	mx sync.RWMutex
 }
 
@@ -37,17 +57,41 @@ type NewSearchSpacesArgs struct {
 	// MaintenanceTaskInterval is a _suggestion_ of how often the internal task
 	// loop is ran. See SearchSpaces.StartMaintenance method for more info.
 	MaintenanceTaskInterval time.Duration
+	// KeepEmptySearchSpaces will keep SearchSpace instances that are emptied by
+	// cleaning (see SearchSpaces.Clean and SearchSpaces.StartMaintenance), such
+	// that they can be re-used for new data, instead of being deleted. This is
+	// useful for write-heavy workloads where SearchSpace instances are emptied
+	// and refilled repeatedly, as it avoids repeated allocation.
+	KeepEmptySearchSpaces bool
+	// HotTierSize enables a two-tier scan if > 0 (must be >= 0). The hot tier
+	// contains at most this many of the most accessed Distancer instances (see
+	// SearchSpaces.Touch), and is always scanned fully by SearchSpaces.Scan,
+	// while the rest (the cold tier) is scanned with the given extent. This
+	// improves recall for popular neighbours cheaply. Note that it requires
+	// all Distancer instances to be comparable (e.g pointers), as they are
+	// used as map keys, and that it keeps an index of all data.
+	HotTierSize int
+	// OnEvict is optional. If set, it is called for each DistancerContainer
+	// that is removed, either due to expiration (SearchSpaces.Clean and the
+	// maintenance loop) or with SearchSpaces.Remove. The id is the result of
+	// an 'ID() string' method on the DistancerContainer, empty if it has none.
+	// Calls are done asynchronously (one goroutine per batch of removals), so
+	// that the maintenance is not blocked, which also means that the calls
+	// are not ordered across batches. Not called for SearchSpaces.Clear.
+	OnEvict func(id string, reason EvictReason)
 }
 
 // Ok validates NewSearchSpaceArgs. Returns true iff:
 //	(1) args.SearchSpacesMaxCap > 0
 //	(2) args.SearchSpacesMaxN > 0
 //	(3)	args.MaintenanceTaskInterval > 0
+//	(4) args.HotTierSize >= 0
 func (args *NewSearchSpacesArgs) Ok() bool {
 	return boolsOk([]bool{
 		args.SearchSpacesMaxCap > 0,
 		args.SearchSpacesMaxN > 0,
 		args.MaintenanceTaskInterval > 0,
+		args.HotTierSize >= 0,
 	})
 }
 
@@ -62,6 +106,9 @@ func NewSearchSpaces(args NewSearchSpacesArgs) (*SearchSpaces, bool) {
 		searchSpaces:            make([]*SearchSpace, 0, args.SearchSpacesMaxN),
 		searchSpacesMaxCap:      args.SearchSpacesMaxCap,
 		maintenanceTaskInterval: args.MaintenanceTaskInterval,
+		keepEmpty:               args.KeepEmptySearchSpaces,
+		hot:                     newHotTier(args.HotTierSize),
+		onEvict:                 args.OnEvict,
 	}
 	return &ss, true
 }
@@ -69,15 +116,60 @@ func NewSearchSpaces(args NewSearchSpacesArgs) (*SearchSpaces, bool) {
 // Len returns a tuple where [0] = number of internal SearchSpace instances,
 // and [1] = sum of all their Len method returns (i.e num of all data).
 func (ss *SearchSpaces) Len() (int, int) {
+	searchSpaces := ss.spaces()
+
+	distancersN := 0
+	for _, searchSpace := range searchSpaces {
+		distancersN += searchSpace.Len()
+	}
+
+	return len(searchSpaces), distancersN
+}
+
+// spaces returns the current SearchSpace instances. The slice must not be
+// modified, but it can be used without holding ss.mx, see the doc at the top
+// of this file.
+func (ss *SearchSpaces) spaces() []*SearchSpace {
 	ss.mx.RLock()
 	defer ss.mx.RUnlock()
+	return ss.searchSpaces
+}
 
-	distancersN := 0
+// dropRetired replaces the SearchSpace slice with a copy without the retired
+// instances (see SearchSpace.retireIfEmpty). The caller must hold the (write)
+// lock of ss.mx.
+func (ss *SearchSpaces) dropRetired() {
+	kept := make([]*SearchSpace, 0, cap(ss.searchSpaces))
 	for _, searchSpace := range ss.searchSpaces {
-		distancersN += searchSpace.Len()
+		if !searchSpace.isRetired() {
+			kept = append(kept, searchSpace)
+		}
 	}
+	ss.searchSpaces = kept
+}
 
-	return len(ss.searchSpaces), distancersN
+// addToAny adds dc to the first SearchSpace in 'searchSpaces' that accepts it,
+// and calls 'then' (if not nil) with that one while it is still locked, see
+// SearchSpace.addSearchableThen. Instances that are locked (e.g scanned) are
+// skipped at first, and only tried (with blocking) if none of the others
+// accepted it.
+func addToAny(searchSpaces []*SearchSpace, dc DistancerContainer, then func(*SearchSpace)) bool {
+	var busy []*SearchSpace
+	for _, searchSpace := range searchSpaces {
+		added, locked := searchSpace.tryAddSearchable(dc, then)
+		if added {
+			return true
+		}
+		if !locked {
+			busy = append(busy, searchSpace)
+		}
+	}
+	for _, searchSpace := range busy {
+		if searchSpace.addSearchableThen(dc, then) {
+			return true
+		}
+	}
+	return false
 }
 
 // Cap returns the capacity of the internal slice of SearchSpace instances.
@@ -104,14 +196,28 @@ func (ss *SearchSpaces) Dim() int {
 // -	dc must not be nil.
 // -	dc.Distancer() must not be nil.
 // -	All distancer dimensions must be equal (dc.Distancer().Dim()); this rule
-//  	does not apply if SearchSpaces.Len() == 0 and a new one is created.
+//  	does not apply if SearchSpaces.Len() == 0 and a new one is created, or
+//  	if all kept SearchSpace instances are empty (NewSearchSpacesArgs.
+//  	KeepEmptySearchSpaces).
 // -	None internal SearchSpace (singular) could add, due to their capacities,
 // -	Same as above _and_ if a new SearchSpace instance can't be created due
 //		to the capacity limit of this SearchSpaces instance.
+//
+// Data is added to existing SearchSpace instances without holding the lock of
+// this instance (other than briefly, for copying the membership), preferring
+// ones that are not locked by scans, so adds and scans of different SearchSpace
+// instances do not block each other. The lock is only held while creating a
+// new SearchSpace, or when adding the first data (which sets the dim). The
+// latter is always the case with NewSearchSpacesArgs.KeepEmptySearchSpaces, as
+// the dim can change whenever all kept SearchSpace instances are empty. With
+// a hot tier (NewSearchSpacesArgs.HotTierSize), data is added to it while the
+// SearchSpace it was added to is still locked, such that a concurrent
+// SearchSpaces.Remove can't leave it in the hot tier.
+//
+// An add which is concurrent with SearchSpaces.Clear might complete in one of
+// the old SearchSpace instances, i.e it happened before the Clear, in which
+// case the data is in the return of the Clear (and not in the hot tier).
 func (ss *SearchSpaces) AddSearchable(dc DistancerContainer) bool {
-	ss.mx.RLock()
-	defer ss.mx.RUnlock()
-
 	if dc == nil {
 		return false
 	}
@@ -122,17 +228,41 @@ func (ss *SearchSpaces) AddSearchable(dc DistancerContainer) bool {
 		return false
 	}
 
+	// Fast path, see the doc of this method. A mismatched dim is checked in
+	// the slow path, as the data might have been removed meanwhile.
+	addHot := ss.hotAdder(d, dc)
+	if !ss.keepEmpty {
+		ss.mx.RLock()
+		searchSpaces, dim := ss.searchSpaces, ss.uniformVecDim
+		ss.mx.RUnlock()
+		if len(searchSpaces) != 0 && d.Dim() == dim && addToAny(searchSpaces, dc, addHot) {
+			return true
+		}
+	}
+
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+
 	// All vecs in this ss must have an equal dimension. This is naturally not
-	// enforced if ss.searchSpaces is empty.
-	if d.Dim() != ss.uniformVecDim && len(ss.searchSpaces) != 0 {
+	// enforced if ss.searchSpaces is empty, or if all of them are empty.
+	hasData := len(ss.searchSpaces) != 0
+	if hasData && ss.keepEmpty {
+		hasData = false
+		for _, searchSpace := range ss.searchSpaces {
+			hasData = hasData || searchSpace.Len() != 0
+		}
+	}
+	if d.Dim() != ss.uniformVecDim && hasData {
 		return false
 	}
 
-	// Try adding to any.
-	for _, searchSpace := range ss.searchSpaces {
-		if ok := searchSpace.AddSearchable(dc); ok {
-			return true
+	// Try adding to any, e.g ones created since the fast path.
+	if addToAny(ss.searchSpaces, dc, addHot) {
+		// Allow new uniform vec dim if this is the only data.
+		if !hasData {
+			ss.uniformVecDim = d.Dim()
 		}
+		return true
 	}
 
 	// Tried to add in any (block above), but none could (no capacity, or some
@@ -148,51 +278,178 @@ func (ss *SearchSpaces) AddSearchable(dc DistancerContainer) bool {
 	if !ok {
 		return false
 	}
-	if ok := newSearchSpace.AddSearchable(dc); !ok {
+	if ok := newSearchSpace.addSearchableThen(dc, addHot); !ok {
 		return false
 
 	}
 	ss.searchSpaces = append(ss.searchSpaces, newSearchSpace)
 
-	// Allow new uniform vec dim if the new searchSpace is the only one.
-	if len(ss.searchSpaces) == 1 {
+	// Allow new uniform vec dim if the new searchSpace has the only data.
+	if !hasData {
 		ss.uniformVecDim = d.Dim()
 	}
 
 	return true
 }
 
+// hotAdder returns a func which adds dc to the hot tier, to be called by the
+// SearchSpace which dc is added to (see addToAny). Returns nil if the hot tier
+// is not enabled.
+func (ss *SearchSpaces) hotAdder(d Distancer, dc DistancerContainer) func(*SearchSpace) {
+	if ss.hot == nil {
+		return nil
+	}
+	return func(searchSpace *SearchSpace) {
+		ss.hot.add(d, dc, searchSpace)
+	}
+}
+
 // Clean is a controlled way of deleting data in this instance. It calls the
 // method with the same name on all internal SearchSpace (singular) instances
-// and deletes the ones which get completely emptied (len of 0).
+// and deletes the ones which get completely emptied (len of 0), unless
+// NewSearchSpacesArgs.KeepEmptySearchSpaces was set.
 func (ss *SearchSpaces) Clean() {
-	ss.mx.Lock()
-	defer ss.mx.Unlock()
+	var removed []DistancerContainer
+	retired := false
+	for _, searchSpace := range ss.spaces() {
+		removed = append(removed, searchSpace.clean()...)
+		// NOTE: It may be better to leave them empty because creating and
+		// deleting them (allocation) is constly, though that comes with its
+		// own disadvantages (keeping track of vectpr dimensions and unused
+		// memory. This can be done with NewSearchSpacesArgs.KeepEmptySearchSpaces.
+		if !ss.keepEmpty && searchSpace.retireIfEmpty() {
+			retired = true
+		}
+	}
+	if retired {
+		ss.mx.Lock()
+		ss.dropRetired()
+		ss.mx.Unlock()
+	}
+	if ss.hot != nil {
+		ss.hot.clean()
+	}
+	ss.evict(removed, EvictExpired)
+}
 
-	i := 0
-	for i < len(ss.searchSpaces) {
-		ss.searchSpaces[i].Clean()
-		if ss.searchSpaces[i].Len() == 0 {
-			// NOTE: It may be better to leave them empty because creating and
-			// deleting them (allocation) is constly, though that comes with its
-			// own disadvantages (keeping track of vectpr dimensions and unused
-			// memory. Leaving this as a Note.
-			ss.searchSpaces = append(ss.searchSpaces[:i], ss.searchSpaces[i+1:]...)
-			continue
+// Remove deletes all DistancerContainer instances where f returns true, and
+// returns how many were deleted. SearchSpace (singular) instances which get
+// completely emptied are deleted, same as with SearchSpaces.Clean. Note that f
+// is called while holding the lock of a SearchSpace (singular), so it must not
+// use this SearchSpaces.
+func (ss *SearchSpaces) Remove(f func(DistancerContainer) bool) int {
+	var removed []DistancerContainer
+	retired := false
+	for _, searchSpace := range ss.spaces() {
+		removed = append(removed, searchSpace.removeWhere(f)...)
+		if !ss.keepEmpty && searchSpace.retireIfEmpty() {
+			retired = true
 		}
-		i++
 	}
+	if retired {
+		ss.mx.Lock()
+		ss.dropRetired()
+		ss.mx.Unlock()
+	}
+	if ss.hot != nil {
+		ss.hot.removeWhere(f)
+	}
+	ss.evict(removed, EvictRemoved)
+	return len(removed)
 }
 
-// Clear will reset the internal SearchSpace slice and return the old one.
+// Clear will reset the internal SearchSpace slice and return the old one. This
+// is a swap of the slice, where the lock is only held for the swap itself, so
+// it does not wait for scans (or other readers, see SearchSpaces.spaces). Scans
+// that started before the swap see all of the old data, while later ones see
+// the new (empty) data. The old SearchSpace instances are retired along with
+// the swap, such that adds that are concurrent with it either complete in them
+// (i.e they happened before the Clear) or go to the new data.
 func (ss *SearchSpaces) Clear() []*SearchSpace {
 	ss.mx.Lock()
 	defer ss.mx.Unlock()
+
 	old := ss.searchSpaces
-	ss.searchSpaces = make([]*SearchSpace, 0, cap(ss.searchSpaces))
+	ss.searchSpaces = make([]*SearchSpace, 0, cap(old))
+	for _, searchSpace := range old {
+		searchSpace.retire()
+	}
+	if ss.hot != nil {
+		ss.hot.reset()
+	}
 	return old
 }
 
+// Snapshot returns a point-in-time copy of the DistancerContainer references
+// in all internal SearchSpace (singular) instances, see SearchSpace.Snapshot.
+// This is intended for long iterations (e.g analytics), as locks are only held
+// while copying references, such that concurrent writes (e.g AddSearchable) are
+// not blocked during the iteration. Writes after the call are not reflected in
+// the snapshot, though containers in it can still expire (i.e return a nil
+// mathx.Distancer), so that should be checked while iterating.
+func (ss *SearchSpaces) Snapshot() []DistancerContainer {
+	searchSpaces := ss.spaces()
+
+	n := 0
+	snapshots := make([][]DistancerContainer, len(searchSpaces))
+	for i, searchSpace := range searchSpaces {
+		snapshots[i] = searchSpace.Snapshot()
+		n += len(snapshots[i])
+	}
+
+	snapshot := make([]DistancerContainer, 0, n)
+	for _, s := range snapshots {
+		snapshot = append(snapshot, s...)
+	}
+	return snapshot
+}
+
+// Touch registers an access of the given Distancer instances, typically the
+// results of a KNN query, such that the most accessed ones are promoted to the
+// hot tier (see NewSearchSpacesArgs.HotTierSize). Does nothing if the hot tier
+// is not enabled. Distancer instances not in this SearchSpaces are ignored.
+func (ss *SearchSpaces) Touch(ds ...Distancer) {
+	if ss.hot != nil {
+		ss.hot.touch(ds...)
+	}
+}
+
+// ScanStatus tells whether a scan (see SearchSpaces.Scan) completed or not.
+type ScanStatus int
+
+const (
+	// ScanCompleted means that all SearchSpace instances were scanned fully
+	// (as specified by SearchSpacesScanArgs.Extent).
+	ScanCompleted ScanStatus = iota
+	// ScanTruncated means that the scan was aborted due to the TTL (or the
+	// block deadline, see BlockDeadlineAbort), i.e the scanned data is only
+	// partial.
+	ScanTruncated
+	// ScanCancelled means that the scan was aborted with the cancel signal
+	// (BaseWorkerArgs.Cancel), i.e the scanned data is only partial.
+	ScanCancelled
+	// ScanDegraded means that the scan completed, except for items that were
+	// skipped because sending them hit the block deadline (see
+	// BlockDeadlineSkip), i.e the scanned data is only partial.
+	ScanDegraded
+)
+
+// String returns a human-readable name of the ScanStatus.
+func (s ScanStatus) String() string {
+	switch s {
+	case ScanCompleted:
+		return "completed"
+	case ScanTruncated:
+		return "truncated"
+	case ScanCancelled:
+		return "cancelled"
+	case ScanDegraded:
+		return "degraded"
+	default:
+		return "unknown"
+	}
+}
+
 // SearchSpacesScanArgs is intended for SearchSpaces.Scan(). Note that some of
 // these fields will get passed to each internal SearchSpace (singular) when
 // their 'Scan()' method is called. Those shared and 'inherited' fields are
@@ -206,23 +463,73 @@ type SearchSpacesScanArgs struct {
 	// SeachSpace instance counts as a worker, and will as such 'inherit' from
 	// BaseStageArgs.BaseWorkerArgs.
 	BaseStageArgs
+	// Status is optional (may be nil). If set, a single ScanStatus is sent into
+	// it once all scanners are done, after which it is closed. This can be used
+	// to tell whether the scanned data is partial. The send is blocking and is
+	// only aborted with BaseWorkerArgs.Cancel, so the chan should have a buffer
+	// of at least 1, or be consumed.
+	Status chan<- ScanStatus
+	// Seed is optional, see SearchSpaceScanArgs.Seed. Each internal SearchSpace
+	// gets its own seed, derived from this one (in order), such that the scan
+	// is reproducible for the same Seed and data.
+	Seed int64
+	// Subset is optional. If not nil, then only these containers are scanned,
+	// instead of the data of the SearchSpaces, e.g candidates found with a
+	// secondary index. They are split into SearchSpace instances with the
+	// same max cap as the others (see NewSearchSpacesArgs.SearchSpacesMaxCap),
+	// and the hot tier is not used. The slice is not copied, so it must not be
+	// modified during the scan.
+	Subset []DistancerContainer
+	// BlockDeadline and OnBlockDeadline are optional, they are passed to each
+	// internal SearchSpace, see SearchSpaceScanArgs for details.
+	BlockDeadline   time.Duration
+	OnBlockDeadline BlockDeadlinePolicy
+	// Unscanned is optional (may be nil). If set, the number of items which
+	// were not scanned because a deadline was hit (the TTL, or BlockDeadline)
+	// is added to it (with sync/atomic), which tells how much data is missing
+	// when the scan is not completed (see ScanStatus). Items of SearchSpace
+	// instances which were not scanned at all are counted with Extent, i.e
+	// including expired items. Use it after a status is received from Status,
+	// as it is updated until then.
+	Unscanned *int64
 }
 
 // Ok validates SearchSpacesScanArgs. Returns true iff:
 //	(1) args.Extent >= 0.0 and <= 1.0.
-//	(2) args.BaseStageArgs.Ok() is true.
+//	(2) args.BlockDeadline >= 0.
+//	(3) args.OnBlockDeadline.Ok() is true.
+//	(4) args.BaseStageArgs.Ok() is true.
 func (args *SearchSpacesScanArgs) Ok() bool {
 	return boolsOk([]bool{
 		args.Extent >= 0.0 && args.Extent <= 1.0,
+		args.BlockDeadline >= 0,
+		args.OnBlockDeadline.Ok(),
 		args.BaseStageArgs.Ok(),
 	})
 }
 
+// inherited gives the SearchSpaceScanArgs that are passed to each internal
+// SearchSpace (singular), see SearchSpacesScanArgs.
+func (args *SearchSpacesScanArgs) inherited() SearchSpaceScanArgs {
+	return SearchSpaceScanArgs{
+		Extent:          args.Extent,
+		BlockDeadline:   args.BlockDeadline,
+		OnBlockDeadline: args.OnBlockDeadline,
+		BaseWorkerArgs:  args.BaseWorkerArgs,
+	}
+}
+
 // Scan calls the method with the same name on internal SearchSpace instances
 // and pushes their ScanChan returns to the chan returned here (i.e chan of chans).
 // The process is done in a controlle way such that number of active scanners does
-// not exceed args.BaseStageArgs.NWorkers. See documentation for SearchSpacesScanArgs
-// for more details.
+// not exceed args.BaseStageArgs.NWorkers. If the hot tier is enabled (see
+// NewSearchSpacesArgs.HotTierSize), then its data is sent first and scanned
+// fully, while it is skipped in the rest of the scan. Scanning stops when args.TTL is exceeded,
+// in which case the data is partial; this is reported through args.Status (if set), while
+// args.Unscanned (if set) tells how much is missing. The same goes for args.BlockDeadline.
+// The scan covers the SearchSpace instances that exist when it starts, and each of
+// them is read-locked only while it is scanned (see SearchSpace.Scan).
+// See documentation for SearchSpacesScanArgs for more details.
 func (ss *SearchSpaces) Scan(args SearchSpacesScanArgs) (<-chan ScanChan, bool) {
 	if !args.Ok() {
 		return nil, false
@@ -230,10 +537,7 @@ func (ss *SearchSpaces) Scan(args SearchSpacesScanArgs) (<-chan ScanChan, bool)
 
 	// No point in proceeding if this is not ok (should be, but doing for more
 	// robustness)- and no point in re-creating this on each loop iter below.
-	inheritedArgs := SearchSpaceScanArgs{
-		Extent:         args.Extent,
-		BaseWorkerArgs: args.BaseWorkerArgs,
-	}
+	inheritedArgs := args.inherited()
 	if ok := inheritedArgs.Ok(); !ok {
 		return nil, false
 	}
@@ -243,27 +547,69 @@ func (ss *SearchSpaces) Scan(args SearchSpacesScanArgs) (<-chan ScanChan, bool)
 	ticker := ActiveGoroutinesTicker{}
 	decrement := ticker.AddAwait()
 	decrement() // ticker back to 0.
+	// Used to wait for all scanners, only when args.Status is set.
+	wg := sync.WaitGroup{}
 	inheritedArgs.UnsafeDoneCallback = func() {
 		decrement()
+		if args.Status != nil {
+			wg.Done()
+		}
 		if oldCallback != nil {
 			oldCallback()
 		}
 	}
 
 	out := make(chan ScanChan, args.Buf)
-	deadlineSignal, deadlineSignalCancel := args.DeadlineSignal()
-	defer deadlineSignalCancel.Cancel()
+	// Set by any aborted scanner (to a ScanStatus), see SearchSpace.scan.
+	aborted := int32(ScanCompleted)
 
-	go func() {
+	// Sends the ScanChan of all SearchSpace instances to 'out', returns when
+	// done or aborted.
+	scanAll := func() ScanStatus {
 		defer close(out)
-		ss.mx.RLock()
-		defer ss.mx.RUnlock()
 
+		// See SearchSpace.scan for why a timer is used.
+		deadline := time.NewTimer(args.TTL)
+		defer deadline.Stop()
+
+		// The hot tier is scanned first, as a SearchSpace with extent=1.
+		searchSpaces := ss.spaces()
+		var skip map[Distancer]DistancerContainer
+		if args.Subset != nil {
+			searchSpaces = splitSearchSpaces(args.Subset, ss.searchSpacesMaxCap)
+		} else if ss.hot != nil {
+			skip = ss.hot.snapshot()
+		}
+		if len(skip) != 0 {
+			hotSpace := SearchSpace{items: make([]DistancerContainer, 0, len(skip))}
+			for _, dc := range skip {
+				hotSpace.items = append(hotSpace.items, dc)
+			}
+			searchSpaces = append([]*SearchSpace{&hotSpace}, searchSpaces...)
+		}
+
+		seeds := seedSource(args.Seed)
 		// Used for constraining the max amount of goroutines running at a time.
-		for _, searchSpace := range ss.searchSpaces {
+		for i, searchSpace := range searchSpaces {
 			ticker.BlockUntilBelowN(args.NWorkers + 1)
-			ch, ok := searchSpace.Scan(inheritedArgs)
+			if args.Status != nil {
+				wg.Add(1)
+			}
+			var ch ScanChan
+			var ok bool
+			if len(skip) != 0 && i == 0 {
+				hotArgs := inheritedArgs
+				hotArgs.Extent = 1
+				ch, ok = searchSpace.scan(hotArgs, &aborted, args.Unscanned, nil)
+			} else {
+				spaceArgs := inheritedArgs
+				spaceArgs.Seed = seeds()
+				ch, ok = searchSpace.scan(spaceArgs, &aborted, args.Unscanned, skip)
+			}
 			if !ok {
+				if args.Status != nil {
+					wg.Done()
+				}
 				continue
 			}
 			// Increment ticker and ignore the returned decrement callback, as
@@ -274,15 +620,77 @@ func (ss *SearchSpaces) Scan(args SearchSpacesScanArgs) (<-chan ScanChan, bool)
 			select {
 			case out <- ch:
 			case <-args.Cancel.c:
-				return
-			case <-deadlineSignal.c:
-				return
+				return ScanCancelled
+			case <-deadline.C:
+				// Scanner would otherwise block until its own deadline. Its
+				// items are not scanned by the consumer either, so they are
+				// counted (before args.Status is sent).
+				if args.Status != nil {
+					wg.Add(1)
+				}
+				go func() {
+					for range ch {
+						if args.Unscanned != nil {
+							atomic.AddInt64(args.Unscanned, 1)
+						}
+					}
+					if args.Status != nil {
+						wg.Done()
+					}
+				}()
+				if args.Unscanned != nil {
+					for _, rest := range searchSpaces[i+1:] {
+						n := math.Ceil(float64(rest.Len()) * args.Extent)
+						atomic.AddInt64(args.Unscanned, int64(n))
+					}
+				}
+				return ScanTruncated
 			}
 		}
+		return ScanCompleted
+	}
+
+	go func() {
+		status := scanAll()
+		if args.Status == nil {
+			return
+		}
+		defer close(args.Status)
+
+		wg.Wait()
+		if status == ScanCompleted {
+			status = ScanStatus(atomic.LoadInt32(&aborted))
+		}
+
+		// Try without blocking first, as args.Cancel might be closed already.
+		select {
+		case args.Status <- status:
+			return
+		default:
+		}
+		select {
+		case args.Status <- status:
+		case <-args.Cancel.c:
+		}
 	}()
 	return out, true
 }
 
+// splitSearchSpaces splits 'items' into SearchSpace instances with at most
+// 'maxCap' items each, which share the underlying array of 'items'. They are
+// only intended for scanning, see SearchSpacesScanArgs.Subset.
+func splitSearchSpaces(items []DistancerContainer, maxCap int) []*SearchSpace {
+	r := make([]*SearchSpace, 0, len(items)/maxCap+1)
+	for start := 0; start < len(items); start += maxCap {
+		end := start + maxCap
+		if end > len(items) {
+			end = len(items)
+		}
+		r = append(r, &SearchSpace{items: items[start:end:end]})
+	}
+	return r
+}
+
 // StartMaintenance starts a task loop where internal data is cleaned and stale
 // data is removed. Specifically, each step will run at approximately the interval
 // specified when creating this instance (NewSearchSpacesArgs.MaintenanceTaskInterval).
@@ -312,29 +720,32 @@ func (ss *SearchSpaces) StartMaintenance() {
 		// The return is for exiting the outer func, i.e StartMaintenance.
 		cursor := 0
 		stepf := func() bool {
-			ss.mx.Lock()
-			defer ss.mx.Unlock()
-
 			// No maintenance if empty.
-			if len(ss.searchSpaces) == 0 {
-				return ss.maintenanceActive
+			searchSpaces := ss.spaces()
+			if len(searchSpaces) == 0 {
+				return ss.CheckMaintenance()
 			}
 
-			// Wraparound.
-			if cursor >= len(ss.searchSpaces) {
+			// Wraparound. The hot tier is cleaned once per cycle, as it
+			// is not known which SearchSpace its data is in.
+			if cursor >= len(searchSpaces) {
 				cursor = 0
+				if ss.hot != nil {
+					ss.hot.clean()
+				}
 			}
 
-			ss.searchSpaces[cursor].Clean()
+			ss.evict(searchSpaces[cursor].clean(), EvictExpired)
 			// Delete empty.
-			if ss.searchSpaces[cursor].Len() == 0 {
-				slice := ss.searchSpaces // Alias for shorter line length.
-				ss.searchSpaces = append(slice[:cursor], slice[cursor+1:]...)
-				return ss.maintenanceActive // Slice changed, so no cursor++ here.
+			if !ss.keepEmpty && searchSpaces[cursor].retireIfEmpty() {
+				ss.mx.Lock()
+				ss.dropRetired()
+				ss.mx.Unlock()
+				return ss.CheckMaintenance() // Slice changed, so no cursor++ here.
 			}
 
 			cursor++
-			return ss.maintenanceActive
+			return ss.CheckMaintenance()
 		}
 
 		for {
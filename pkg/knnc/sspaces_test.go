@@ -1,8 +1,10 @@
 package knnc
 
 import (
+	"fmt"
 	"reflect"
 	"runtime"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -89,6 +91,309 @@ func TestSearchSpacesClean(t *testing.T) {
 	}
 }
 
+func TestSearchSpacesCleanKeepEmpty(t *testing.T) {
+	ttl := time.Millisecond * 10
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      2,
+		SearchSpacesMaxN:        10,
+		MaintenanceTaskInterval: time.Second,
+		KeepEmptySearchSpaces:   true,
+	})
+
+	// Fills 2 SearchSpace instances.
+	for i := 0; i < 4; i++ {
+		d := &data{v: newTVec(float64(i)), Expires: time.Now().Add(ttl)}
+		if !ss.AddSearchable(d) {
+			t.Fatal("could not add data")
+		}
+	}
+	old := append([]*SearchSpace{}, ss.searchSpaces...)
+
+	time.Sleep(ttl)
+	ss.Clean()
+	if n, l := ss.Len(); n != len(old) || l != 0 {
+		t.Fatalf("unexpected len after full expiry: (%v, %v)", n, l)
+	}
+
+	// Any dim is allowed as everything is empty, and existing slots are used.
+	if !ss.AddSearchable(&data{v: newTVec(1, 2)}) {
+		t.Fatal("could not add data with a new dim after full expiry")
+	}
+	if n, l := ss.Len(); n != len(old) || l != 1 {
+		t.Fatalf("unexpected len after re-adding: (%v, %v)", n, l)
+	}
+	if ss.searchSpaces[0] != old[0] || ss.searchSpaces[0].Len() != 1 {
+		t.Fatal("an existing SearchSpace was not re-used")
+	}
+	if ss.Dim() != 2 {
+		t.Fatal("unexpected dim after re-adding:", ss.Dim())
+	}
+	if ss.AddSearchable(&data{v: newTVec(1)}) {
+		t.Fatal("added data with a mismatched dim")
+	}
+}
+
+// Adds of two dims race against kept SearchSpace instances which are all empty,
+// i.e where the dim can change. Only one of the dims should end up stored. Note
+// that this is probability based, the race window is small.
+func TestSearchSpacesKeepEmptyConcurrentDims(t *testing.T) {
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      10,
+		SearchSpacesMaxN:        4,
+		MaintenanceTaskInterval: time.Second,
+		KeepEmptySearchSpaces:   true,
+	})
+	for i := 0; i < 40; i++ {
+		ss.AddSearchable(&data{v: newTVec(float64(i))})
+	}
+
+	for round := 0; round < 1000; round++ {
+		// All empty, while the dim of the removed data (1) is still set.
+		ss.Remove(func(DistancerContainer) bool { return true })
+
+		start := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for _, dim := range []int{1, 2} {
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func(dim int) {
+					defer wg.Done()
+					<-start
+					for i := 0; i < 5; i++ {
+						ss.AddSearchable(&data{v: newTVecRand(dim)})
+					}
+				}(dim)
+			}
+		}
+		close(start)
+		wg.Wait()
+
+		for _, dc := range ss.Snapshot() {
+			if dim := dc.Distancer().Dim(); dim != ss.Dim() {
+				t.Fatalf("round %v: mixed dims, have %v with a dim of %v", round, dim, ss.Dim())
+			}
+		}
+		// Resets the dim for the next round.
+		ss.Remove(func(DistancerContainer) bool { return true })
+		ss.AddSearchable(&data{v: newTVec(1)})
+	}
+}
+
+func TestSearchSpacesOnEvict(t *testing.T) {
+	type eviction struct {
+		id     string
+		reason EvictReason
+	}
+	evictions := make(chan eviction, 10)
+
+	ttl := time.Millisecond * 10
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      2,
+		SearchSpacesMaxN:        10,
+		MaintenanceTaskInterval: time.Second,
+		HotTierSize:             2,
+		OnEvict: func(id string, reason EvictReason) {
+			evictions <- eviction{id: id, reason: reason}
+		},
+	})
+
+	dataSlice := []*data{
+		{v: newTVec(1), id: "a", Expires: time.Now().Add(ttl)},
+		{v: newTVec(2), id: "b"},
+		{v: newTVec(3), id: "c", Expires: time.Now().Add(ttl)},
+		{v: newTVec(4), id: "d"},
+		{v: newTVec(5), id: "e"},
+	}
+	for _, d := range dataSlice {
+		if !ss.AddSearchable(d) {
+			t.Fatal("could not add data")
+		}
+	}
+
+	// Collects n evictions, sorted by id.
+	collect := func(n int) []eviction {
+		r := make([]eviction, 0, n)
+		for i := 0; i < n; i++ {
+			select {
+			case e := <-evictions:
+				r = append(r, e)
+			case <-time.After(time.Second):
+				t.Fatalf("want %v evictions, have %v", n, len(r))
+			}
+		}
+		sort.Slice(r, func(i, j int) bool { return r[i].id < r[j].id })
+		return r
+	}
+
+	time.Sleep(ttl)
+	ss.Clean()
+	want := []eviction{{"a", EvictExpired}, {"c", EvictExpired}}
+	if have := collect(2); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("want evictions %v, have %v", want, have)
+	}
+
+	n := ss.Remove(func(dc DistancerContainer) bool {
+		id := dc.(*data).id
+		return id == "b" || id == "e"
+	})
+	if n != 2 {
+		t.Fatal("unexpected remove count:", n)
+	}
+	want = []eviction{{"b", EvictRemoved}, {"e", EvictRemoved}}
+	if have := collect(2); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("want evictions %v, have %v", want, have)
+	}
+
+	// Only 'd' is left, also in the hot tier index.
+	if _, l := ss.Len(); l != 1 || len(ss.hot.index) != 1 {
+		t.Fatalf("unexpected len after removal: %v, %v", l, len(ss.hot.index))
+	}
+	if ss.Remove(func(DistancerContainer) bool { return false }) != 0 {
+		t.Fatal("unexpected removal")
+	}
+	select {
+	case e := <-evictions:
+		t.Fatal("unexpected eviction:", e)
+	case <-time.After(ttl):
+	}
+}
+
+func TestSearchSpacesSnapshot(t *testing.T) {
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      2,
+		SearchSpacesMaxN:        10,
+		MaintenanceTaskInterval: time.Second,
+	})
+
+	n := 5
+	for i := 0; i < n; i++ {
+		if !ss.AddSearchable(&data{v: newTVec(float64(i))}) {
+			t.Fatal("could not add data")
+		}
+	}
+
+	snapshot := ss.Snapshot()
+	if len(snapshot) != n {
+		t.Fatal("unexpected snapshot len:", len(snapshot))
+	}
+
+	for i, dc := range snapshot {
+		// Writes should not block during iteration.
+		done := make(chan bool)
+		go func() { done <- ss.AddSearchable(&data{v: newTVec(float64(n + i))}) }()
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Fatal("could not add data during iteration")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("write blocked during snapshot iteration")
+		}
+
+		if x, _ := dc.Distancer().(*tVec).Peek(0); x != float64(i) {
+			t.Fatal("unexpected snapshot item:", x)
+		}
+	}
+
+	// Point-in-time.
+	if len(snapshot) != n {
+		t.Fatal("snapshot changed after writes:", len(snapshot))
+	}
+	if _, l := ss.Len(); l != n*2 {
+		t.Fatal("unexpected len after writes:", l)
+	}
+}
+
+func TestSearchSpacesScanHotTier(t *testing.T) {
+	n := 1000
+	ttl := time.Millisecond * 50
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      100,
+		SearchSpacesMaxN:        100,
+		MaintenanceTaskInterval: time.Second,
+		HotTierSize:             2,
+	})
+
+	dataSlice := make([]*data, n)
+	for i := range dataSlice {
+		dataSlice[i] = &data{v: newTVec(float64(i))}
+		if i == 333 {
+			dataSlice[i].Expires = time.Now().Add(ttl)
+		}
+		ss.AddSearchable(dataSlice[i])
+	}
+
+	// Scans with a low extent, returns how many times each vec was scanned.
+	scan := func() map[float64]int {
+		scanChans, ok := ss.Scan(SearchSpacesScanArgs{
+			Extent: 0.01,
+			BaseStageArgs: BaseStageArgs{
+				NWorkers: 10,
+				BaseWorkerArgs: BaseWorkerArgs{
+					Buf:    10,
+					Cancel: NewCancelSignal(),
+					TTL:    time.Second * 10,
+				},
+			},
+		})
+		if !ok {
+			t.Fatal("unexpected not-ok scan")
+		}
+		counts := make(map[float64]int)
+		for scanChan := range scanChans {
+			for scanItem := range scanChan {
+				element, _ := scanItem.Distancer.Peek(0)
+				counts[element]++
+			}
+		}
+		return counts
+	}
+
+	// 777 and 333 are not scanned with this extent unless they are hot.
+	hot := []float64{777, 333}
+	for _, v := range hot {
+		if scan()[v] != 0 {
+			t.Fatalf("%v was scanned before being promoted", v)
+		}
+	}
+
+	// Unknown vecs are ignored.
+	ss.Touch(dataSlice[777].v, dataSlice[333].v, newTVec(1))
+	for i := 0; i < 5; i++ {
+		counts := scan()
+		for _, v := range hot {
+			if counts[v] != 1 {
+				t.Fatalf("hot vec %v was scanned %v times", v, counts[v])
+			}
+		}
+		for v, count := range counts {
+			if count != 1 {
+				t.Fatalf("vec %v was scanned %v times", v, count)
+			}
+		}
+	}
+
+	// Replaces 777 or 333, as they are accessed less.
+	ss.Touch(dataSlice[555].v, dataSlice[555].v)
+	if counts := scan(); counts[555] != 1 || counts[777]+counts[333] != 1 {
+		t.Fatal("the most accessed vec was not promoted")
+	}
+
+	// Expired data is removed from the hot tier when cleaning.
+	ss.Touch(dataSlice[333].v, dataSlice[333].v, dataSlice[333].v)
+	if scan()[333] != 1 {
+		t.Fatal("vec 333 was not promoted")
+	}
+	time.Sleep(ttl)
+	ss.Clean()
+	if len(ss.hot.index) != n-1 || len(ss.hot.snapshot()) != 1 {
+		t.Fatal("expired data was not removed from the hot tier")
+	}
+	if scan()[333] != 0 {
+		t.Fatal("expired vec was scanned")
+	}
+}
+
 // Test verifies that output of SearchSpaces.Scan is ok in SearchSpaces.Scan.
 // Does not cover the controlled-scan behaviour (goroutine suppression)
 // NOTE: the correctness here is dependant on SearchSpace T.
@@ -142,6 +447,168 @@ func TestSearchSpacesScanOutputCorrectness(t *testing.T) {
 	}
 }
 
+// Test verifies that SearchSpacesScanArgs.Status reports whether a scan was
+// completed, truncated due to TTL, or cancelled.
+func TestSearchSpacesScanStatus(t *testing.T) {
+	ss := SearchSpaces{
+		searchSpaces:            make([]*SearchSpace, 0, 10),
+		searchSpacesMaxCap:      100,
+		uniformVecDim:           1,
+		maintenanceTaskInterval: 1,     // Does not matter.
+		maintenanceActive:       false, // Does not matter.
+	}
+	for i := 0; i < 10; i++ {
+		items := make([]DistancerContainer, 100)
+		for j := range items {
+			items[j] = &data{v: newTVec(float64(j))}
+		}
+		ss.searchSpaces = append(ss.searchSpaces, &SearchSpace{items: items})
+	}
+
+	for _, tc := range []struct {
+		name string
+		ttl  time.Duration
+		// Applied for each ScanItem, false stops consuming.
+		consume func(cancel *CancelSignal) bool
+		want    ScanStatus
+	}{
+		{
+			name:    "completed",
+			ttl:     time.Second * 10,
+			consume: func(*CancelSignal) bool { return true },
+			want:    ScanCompleted,
+		},
+		{
+			// Scanning takes at least 1000ms, which is more than the TTL.
+			name: "truncated",
+			ttl:  time.Millisecond * 50,
+			consume: func(*CancelSignal) bool {
+				time.Sleep(time.Millisecond)
+				return true
+			},
+			want: ScanTruncated,
+		},
+		{
+			name: "cancelled",
+			ttl:  time.Second * 10,
+			consume: func(cancel *CancelSignal) bool {
+				cancel.Cancel()
+				return false
+			},
+			want: ScanCancelled,
+		},
+	} {
+		status := make(chan ScanStatus, 1)
+		cancel := NewCancelSignal()
+		scanChans, ok := ss.Scan(SearchSpacesScanArgs{
+			Extent: 1.,
+			BaseStageArgs: BaseStageArgs{
+				NWorkers: 2,
+				BaseWorkerArgs: BaseWorkerArgs{
+					Cancel: cancel,
+					TTL:    tc.ttl,
+				},
+			},
+			Status: status,
+		})
+		if !ok {
+			t.Fatal("unexpected not-ok scan")
+		}
+
+		n := 0
+		consuming := true
+		for scanChan := range scanChans {
+			for range scanChan {
+				n++
+				consuming = consuming && tc.consume(cancel)
+				if !consuming {
+					break
+				}
+			}
+		}
+
+		if have := <-status; have != tc.want {
+			t.Fatalf("%v: unexpected status %v after %v items", tc.name, have, n)
+		}
+		if tc.want == ScanCompleted && n != 1000 {
+			t.Fatalf("%v: unexpected item count: %v", tc.name, n)
+		}
+		if tc.want == ScanTruncated && n >= 1000 {
+			t.Fatalf("%v: unexpected item count: %v", tc.name, n)
+		}
+		if _, ok := <-status; ok {
+			t.Fatalf("%v: status chan was not closed", tc.name)
+		}
+	}
+}
+
+// Test verifies that hitting SearchSpacesScanArgs.BlockDeadline with a slow
+// consumer is reported through Status and Unscanned, for both policies.
+func TestSearchSpacesScanBlockDeadline(t *testing.T) {
+	ss := SearchSpaces{
+		searchSpaces:            make([]*SearchSpace, 0, 3),
+		searchSpacesMaxCap:      10,
+		uniformVecDim:           1,
+		maintenanceTaskInterval: 1,     // Does not matter.
+		maintenanceActive:       false, // Does not matter.
+	}
+	for i := 0; i < 3; i++ {
+		items := make([]DistancerContainer, 10)
+		for j := range items {
+			items[j] = &data{v: newTVec(float64(j))}
+		}
+		ss.searchSpaces = append(ss.searchSpaces, &SearchSpace{items: items})
+	}
+
+	for _, tc := range []struct {
+		policy BlockDeadlinePolicy
+		want   ScanStatus
+	}{
+		{policy: BlockDeadlineAbort, want: ScanTruncated},
+		{policy: BlockDeadlineSkip, want: ScanDegraded},
+	} {
+		status := make(chan ScanStatus, 1)
+		unscanned := int64(0)
+		scanChans, ok := ss.Scan(SearchSpacesScanArgs{
+			Extent: 1.,
+			BaseStageArgs: BaseStageArgs{
+				NWorkers: 1,
+				BaseWorkerArgs: BaseWorkerArgs{
+					// Unbuffered, such that sends block on the consumer.
+					Buf:    0,
+					Cancel: NewCancelSignal(),
+					TTL:    time.Second * 10,
+				},
+			},
+			Status:          status,
+			BlockDeadline:   time.Millisecond * 5,
+			OnBlockDeadline: tc.policy,
+			Unscanned:       &unscanned,
+		})
+		if !ok {
+			t.Fatal("unexpected not-ok scan")
+		}
+
+		// Only the first item is consumed slowly.
+		n := 0
+		for scanChan := range scanChans {
+			for range scanChan {
+				if n == 0 {
+					time.Sleep(time.Millisecond * 50)
+				}
+				n++
+			}
+		}
+
+		if have := <-status; have != tc.want {
+			t.Fatalf("%v: unexpected status %v after %v items", tc.want, have, n)
+		}
+		if unscanned == 0 || n+int(unscanned) != 30 {
+			t.Fatalf("%v: unexpected count, %v scanned and %v unscanned", tc.want, n, unscanned)
+		}
+	}
+}
+
 // Test verifies the controlled-scan behaviour (goroutine suppression) in SearchSpaces.Scan.
 // Does not cover the output correctness itself.
 func TestSearchSpacesScanInternalBehaviourCorrectness(t *testing.T) {
@@ -186,7 +653,9 @@ func TestSearchSpacesScanInternalBehaviourCorrectness(t *testing.T) {
 			BaseWorkerArgs: BaseWorkerArgs{
 				Buf:    10,
 				Cancel: NewCancelSignal(),
-				TTL:    time.Second,
+				// The scan must not be truncated, as it is the goroutine
+				// count of a full scan that is checked.
+				TTL: time.Minute * 10,
 			},
 		},
 	}
@@ -329,3 +798,302 @@ func TestSearchSpacesMaintenanceStates(t *testing.T) {
 		t.Fatal("test start & end have neq amount of active goroutines")
 	}
 }
+
+// Test verifies that adds are not blocked by a scan of another SearchSpace, and
+// that concurrent adds, scans and removals keep the data consistent. Intended
+// to be run with -race as well.
+func TestSearchSpacesConcurrentAddScan(t *testing.T) {
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      10,
+		SearchSpacesMaxN:        1000,
+		MaintenanceTaskInterval: time.Second,
+	})
+	// One full SearchSpace and one with room.
+	for i := 0; i < 11; i++ {
+		ss.AddSearchable(&data{v: newTVec(float64(i))})
+	}
+
+	// Stall a scan of the full SearchSpace, by not consuming it. The buf lets
+	// the scan of the other one complete.
+	cancel := NewCancelSignal()
+	scanChans, _ := ss.Scan(SearchSpacesScanArgs{
+		Extent: 1,
+		BaseStageArgs: BaseStageArgs{
+			NWorkers:       2,
+			BaseWorkerArgs: BaseWorkerArgs{Buf: 1, Cancel: cancel, TTL: time.Second * 10},
+		},
+	})
+	<-scanChans
+	time.Sleep(time.Millisecond * 10)
+
+	done := make(chan bool)
+	go func() { done <- ss.AddSearchable(&data{v: newTVec(11)}) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("could not add data while another SearchSpace was scanned")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add was blocked by a scan of another SearchSpace")
+	}
+	cancel.Cancel()
+
+	// Mixed workload, where items with odd values are removed concurrently.
+	nWriters, nPerWriter := 4, 500
+	wg := sync.WaitGroup{}
+	stop := make(chan struct{})
+	added := make([]int, nWriters)
+	for w := 0; w < nWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nPerWriter; i++ {
+				if ss.AddSearchable(&data{v: newTVec(float64(i))}) {
+					added[w]++
+				}
+			}
+		}(w)
+	}
+	scanned := make(chan int, 4)
+	for s := 0; s < cap(scanned); s++ {
+		go func() {
+			n := 0
+			for {
+				select {
+				case <-stop:
+					scanned <- n
+					return
+				default:
+				}
+				scanChans, _ := ss.Scan(SearchSpacesScanArgs{
+					Extent: 1,
+					BaseStageArgs: BaseStageArgs{
+						NWorkers:       2,
+						BaseWorkerArgs: BaseWorkerArgs{Buf: 10, Cancel: NewCancelSignal(), TTL: time.Second},
+					},
+				})
+				for scanChan := range scanChans {
+					for range scanChan {
+						n++
+					}
+				}
+			}
+		}()
+	}
+	isOdd := func(dc DistancerContainer) bool {
+		elm, _ := dc.Distancer().Peek(0)
+		return int(elm)%2 == 1
+	}
+	removed := 0
+	removerDone := make(chan struct{})
+	go func() {
+		defer close(removerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			removed += ss.Remove(isOdd)
+			ss.Clean()
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-removerDone
+	removed += ss.Remove(isOdd)
+	nScanned := 0
+	for s := 0; s < cap(scanned); s++ {
+		nScanned += <-scanned
+	}
+
+	nAdded := 12
+	for _, n := range added {
+		nAdded += n
+	}
+	if _, n := ss.Len(); n != nAdded-removed {
+		t.Fatalf("unexpected len: %v, added %v, removed %v", n, nAdded, removed)
+	}
+	if nAdded != 12+nWriters*nPerWriter {
+		t.Fatalf("not all adds succeeded: %v", nAdded)
+	}
+	t.Logf("scanned %v items concurrently with %v adds", nScanned, nAdded)
+}
+
+// Test verifies that scans which are concurrent with SearchSpaces.Clear see
+// either all of the old data or none of it. Intended to be run with -race.
+func TestSearchSpacesClearConcurrentScan(t *testing.T) {
+	nSpaces, nPerSpace := 10, 100
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      nPerSpace,
+		SearchSpacesMaxN:        nSpaces,
+		MaintenanceTaskInterval: time.Second,
+	})
+	// The last SearchSpace has room for one more.
+	nItems := nSpaces*nPerSpace - 1
+	for i := 0; i < nItems; i++ {
+		ss.AddSearchable(&data{v: newTVec(float64(i))})
+	}
+
+	nScanners := 8
+	counts := make(chan int, 1000)
+	wg := sync.WaitGroup{}
+	for s := 0; s < nScanners; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Scans until one sees the new (empty) data.
+			for {
+				scanChans, _ := ss.Scan(SearchSpacesScanArgs{
+					Extent: 1,
+					BaseStageArgs: BaseStageArgs{
+						NWorkers:       2,
+						BaseWorkerArgs: BaseWorkerArgs{Buf: 10, Cancel: NewCancelSignal(), TTL: time.Second * 5},
+					},
+				})
+				n := 0
+				for scanChan := range scanChans {
+					for range scanChan {
+						n++
+					}
+				}
+				counts <- n
+				if n == 0 {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	old := ss.Clear()
+	wg.Wait()
+	close(counts)
+
+	nFull := 0
+	for n := range counts {
+		if n != 0 && n != nItems {
+			t.Fatalf("scan saw a mix of old and new data: %v items", n)
+		}
+		if n != 0 {
+			nFull++
+		}
+	}
+	if nFull == 0 {
+		t.Fatal("no scan saw the old data, the test is not concurrent")
+	}
+	if len(old) != nSpaces {
+		t.Fatalf("unexpected number of old SearchSpace instances: %v", len(old))
+	}
+	if n, l := ss.Len(); n != 0 || l != 0 {
+		t.Fatalf("unexpected len after clear: (%v, %v)", n, l)
+	}
+
+	// Adds go to the new data, the old SearchSpace instances are retired.
+	if !ss.AddSearchable(&data{v: newTVec(1)}) {
+		t.Fatal("could not add data after clear")
+	}
+	if old[len(old)-1].Len() != nPerSpace-1 {
+		t.Fatal("data was added to an old SearchSpace after clear")
+	}
+	if n, l := ss.Len(); n != 1 || l != 1 {
+		t.Fatalf("unexpected len after adding: (%v, %v)", n, l)
+	}
+}
+
+// Clears race with adds while the hot tier is enabled. Containers that were
+// cleared should not remain in the hot tier index (see SearchSpaces.Touch).
+// Note that this is probability based, the race window is small.
+func TestSearchSpacesClearConcurrentAddHotTier(t *testing.T) {
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      10,
+		SearchSpacesMaxN:        100,
+		MaintenanceTaskInterval: time.Second,
+		HotTierSize:             2,
+	})
+	ss.AddSearchable(&data{v: newTVec(0)})
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					ss.AddSearchable(&data{v: newTVec(float64(i))})
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		ss.Clear()
+		ss.AddSearchable(&data{v: newTVec(0)})
+	}
+	close(stop)
+	wg.Wait()
+
+	current := make(map[Distancer]bool)
+	for _, dc := range ss.Snapshot() {
+		current[dc.Distancer()] = true
+	}
+	ss.hot.mx.Lock()
+	defer ss.hot.mx.Unlock()
+	for d := range ss.hot.index {
+		if !current[d] {
+			t.Fatal("a cleared container is in the hot tier index")
+		}
+	}
+}
+
+// Removes race with adds while the hot tier is enabled. Containers that were
+// removed should not remain in the hot tier index (see SearchSpaces.Touch).
+// Note that this is probability based, the race window is small.
+func TestSearchSpacesRemoveConcurrentAddHotTier(t *testing.T) {
+	ss, _ := NewSearchSpaces(NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      10,
+		SearchSpacesMaxN:        100,
+		MaintenanceTaskInterval: time.Second,
+		HotTierSize:             2,
+	})
+	ss.AddSearchable(&data{v: newTVec(0)})
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					ss.AddSearchable(&data{v: newTVec(float64(i))})
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		ss.Remove(func(DistancerContainer) bool { return true })
+		ss.AddSearchable(&data{v: newTVec(0)})
+	}
+	close(stop)
+	wg.Wait()
+
+	current := make(map[Distancer]bool)
+	for _, dc := range ss.Snapshot() {
+		current[dc.Distancer()] = true
+	}
+	ss.hot.mx.Lock()
+	defer ss.hot.mx.Unlock()
+	for d := range ss.hot.index {
+		if !current[d] {
+			t.Fatal("a removed container is in the hot tier index")
+		}
+	}
+}
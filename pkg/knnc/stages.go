@@ -99,12 +99,54 @@ MapStage func and argument types (along with validation methods).
 --------------------------------------------------------------------------------
 */
 
+// MapStageFailures contains the number of ScanItem instances a MapStage worker
+// has dropped (i.e not passed along), grouped by reason.
+type MapStageFailures struct {
+	// Received is the total number of ScanItem instances received, including
+	// the ones that were dropped.
+	Received int
+	// NilDistancer is the number of ScanItem instances dropped because their
+	// Distancer was nil (it might have become nil while in the queue).
+	NilDistancer int
+	// MapFunc is the number of ScanItem instances dropped because MapFunc (of
+	// MapStagePartialArgs) returned false, e.g because of a failed distance
+	// calculation (vectors with different dimensions).
+	MapFunc int
+	// Predicate is the number of ScanItem instances dropped because Predicate
+	// (of MapStagePartialArgs) returned false, i.e without calling MapFunc.
+	Predicate int
+}
+
+// Dropped returns the total number of dropped ScanItem instances.
+func (f *MapStageFailures) Dropped() int {
+	return f.NilDistancer + f.MapFunc + f.Predicate
+}
+
+// Merge adds all the counts of 'other' into this instance.
+func (f *MapStageFailures) Merge(other MapStageFailures) {
+	f.Received += other.Received
+	f.NilDistancer += other.NilDistancer
+	f.MapFunc += other.MapFunc
+	f.Predicate += other.Predicate
+}
+
 // MapStagePartialArgs is intended as partial args for MapStageArgs.
 // Extracted as a separate struct for additional flexibility.
 type MapStagePartialArgs struct {
 	// Each worker will read from the 'In' field of this struct (<-chan ScanItem),
 	// then use this func to transform the ScanItem. Note; false will drop ScanItem.
 	MapFunc func(Distancer) (ScoreItem, bool)
+	// Predicate is optional (may be nil). If set, each ScanItem for which it
+	// returns false is dropped before MapFunc is called, i.e it is not scored.
+	// This is cheaper than dropping with a FilterStage, e.g for filtering on
+	// data of ScanItem.Container.
+	Predicate func(ScanItem) bool
+	// Failures is optional (may be nil). If set, each worker will send a
+	// MapStageFailures into it once the worker exits, and it will be closed
+	// when all workers are done. Sends are blocking and are only aborted with
+	// BaseWorkerArgs.Cancel, so the chan should have a buffer of at least
+	// BaseStageArgs.NWorkers, or be consumed.
+	Failures chan<- MapStageFailures
 	BaseStageArgs
 }
 
@@ -140,6 +182,9 @@ func (args *MapStageArgs) Ok() bool {
 // args.MapFunc, and passed along to the channel returned from this func. See
 // documentation for MapStageArgs and the nested structs to get more details
 // about the different parameters (such as MapStageArgs.BaseStageArgs.NWorkers).
+// Dropped ScanItem instances are reported through args.Failures, if it is set.
+// The Distancer, ID and Added fields of each ScanItem are kept in the ScoreItem
+// from MapFunc.
 // Note; return here will be (nil, false) if args.Ok() == false.
 func MapStage(args MapStageArgs) (<-chan ScoreItem, bool) {
 	if !args.Ok() {
@@ -160,19 +205,39 @@ func MapStage(args MapStageArgs) (<-chan ScoreItem, bool) {
 				defer args.UnsafeDoneCallback()
 			}
 
+			failures := MapStageFailures{}
+			if args.Failures != nil {
+				defer func() {
+					select {
+					case args.Failures <- failures:
+					case <-args.Cancel.c:
+					}
+				}()
+			}
+
 			for scanItem := range args.In {
+				failures.Received++
 				d := scanItem.Distancer
 				// Distancer might have become nil while in the queue.
 				// == nil check does not work as expected.
 				if d == nil || reflect.ValueOf(d).IsNil() {
+					failures.NilDistancer++
+					continue
+				}
+
+				if args.Predicate != nil && !args.Predicate(scanItem) {
+					failures.Predicate++
 					continue
 				}
 
 				scoreItem, ok := args.MapFunc(d)
 				if !ok {
+					failures.MapFunc++
 					continue
 				}
 				scoreItem.Distancer = d
+				scoreItem.ID = scanItem.ID
+				scoreItem.Added = scanItem.Added
 				scoreItem.Set = true
 
 				select {
@@ -186,7 +251,13 @@ func MapStage(args MapStageArgs) (<-chan ScoreItem, bool) {
 		}()
 	}
 
-	go func() { wg.Wait(); close(out) }()
+	go func() {
+		wg.Wait()
+		if args.Failures != nil {
+			close(args.Failures)
+		}
+		close(out)
+	}()
 
 	return out, true
 }
@@ -303,8 +374,8 @@ type MergeStagePartialArgs struct {
 	//	1 = send on each recv and merge.
 	//	2 = send every second recv and merge.
 	//	3 = etc.
-	// Note that when a ScoreItems instance is sent, a new one will be created in
-	// its place in a worker, so duplicate data will not be sent.
+	// Note that when a ScoreItems instance is sent, the one in the worker is
+	// reset, so duplicate data will not be sent.
 	SendInterval int
 	BaseStageArgs
 }
@@ -345,9 +416,11 @@ func (args *MergeStageArgs) Ok() bool {
 // using the ScoreItems.BubbleInsert method (ascending arg = args.Ascending).
 // Copies of these ordered ScoreItems are then pushed into the returned chan at
 // the interval specified in args.SendInterval. As such, this is a particularly
-// costly function and should be treated as such. For more information, see
-// documentation for MergeStageArgs and the nested structs. Also note that
-// the only condition for a false return is if args.Ok() == false.
+// costly function and should be treated as such. The copies are owned by the
+// receiver, which can give them back with PutScoreItems once they are consumed
+// (this reduces allocations, as the copies come from GetScoreItems). For more
+// information, see documentation for MergeStageArgs and the nested structs.
+// Also note that the only condition for a false return is args.Ok() == false.
 func MergeStage(args MergeStageArgs) (<-chan ScoreItems, bool) {
 	if !args.Ok() {
 		return nil, false
@@ -360,25 +433,35 @@ func MergeStage(args MergeStageArgs) (<-chan ScoreItems, bool) {
 	deadlineSignal, deadlineSignalCancel := args.DeadlineSignal()
 	defer deadlineSignalCancel.Cancel()
 
-	// Reduces code duplication. False means abort.
+	// Reduces code duplication. False means abort. Sends a trimmed copy (from
+	// GetScoreItems), which is owned by the receiver.
 	trySend := func(scoreItems ScoreItems) bool {
-		// No point in sending empty. Check before costly .Trim() call.
-		if len(scoreItems) == 0 {
+		n := 0
+		for _, scoreItem := range scoreItems {
+			if scoreItem.Set {
+				n++
+			}
+		}
+		// No point in sending empty.
+		if n == 0 {
 			return true
 		}
-		scoreItems = scoreItems.Trim()
 
-		// Check again, might not be empty after trim.
-		if len(scoreItems) == 0 {
-			return true
+		trimmed := GetScoreItems(n)[:0]
+		for _, scoreItem := range scoreItems {
+			if scoreItem.Set {
+				trimmed = append(trimmed, scoreItem)
+			}
 		}
 
 		select {
-		case out <- scoreItems:
+		case out <- trimmed:
 			return true
 		case <-args.Cancel.c:
+			PutScoreItems(trimmed)
 			return false
 		case <-deadlineSignal.c:
+			PutScoreItems(trimmed)
 			return true
 		}
 	}
@@ -392,7 +475,9 @@ func MergeStage(args MergeStageArgs) (<-chan ScoreItems, bool) {
 				defer args.UnsafeDoneCallback()
 			}
 
-			scoreItems := make(ScoreItems, args.K)
+			scoreItems := GetScoreItems(args.K)
+			defer func() { PutScoreItems(scoreItems) }()
+
 			i := 1 // So it won't send on the first iter.
 			for scoreItem := range args.In {
 				scoreItems.BubbleInsert(scoreItem, args.Ascending)
@@ -401,17 +486,16 @@ func MergeStage(args MergeStageArgs) (<-chan ScoreItems, bool) {
 					if !trySend(scoreItems) {
 						return
 					}
-					// A new copy _must_ be created; not doing so can lead to
-					// the same ScoreItem instance to be sent multiple times.
+					// Must be reset (a copy was sent); not doing so can lead
+					// to the same ScoreItem instance to be sent multiple times.
 					// That is a problem because the caller of this func can't
 					// know whether or not the ScoreItems are duplicates or not,
 					// and can't assume either case.
-					scoreItems = make(ScoreItems, args.K)
+					scoreItems.reset()
 				}
 				i++
 			}
 
-			// No need in creating a duplicate as above (since this is last).
 			trySend(scoreItems)
 		}()
 	}
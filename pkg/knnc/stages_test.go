@@ -92,6 +92,57 @@ func TestMapStage(t *testing.T) {
 	}
 }
 
+func TestMapStageFailures(t *testing.T) {
+	queryVec := newTVec(0)
+	chFaucet := commonTestingCodeRawScanItemFaucet([]*tVec{
+		newTVec(1),
+		newTVec(1, 2), // Mismatched dimension.
+		newTVec(2),
+		newTVec(1, 2, 3), // Mismatched dimension.
+		nil,
+	})
+
+	baseStageArgs := commonTestingCodeBaseStageArgs()
+	failures := make(chan MapStageFailures, baseStageArgs.NWorkers)
+	chOut, ok := MapStage(MapStageArgs{
+		In: chFaucet,
+		MapStagePartialArgs: MapStagePartialArgs{
+			MapFunc: func(d Distancer) (ScoreItem, bool) {
+				score, ok := d.EuclideanDistance(queryVec)
+				return ScoreItem{Score: score}, ok
+			},
+			Failures:      failures,
+			BaseStageArgs: baseStageArgs,
+		},
+	})
+
+	if !ok {
+		t.Fatal("args validation check failed; test impl error")
+	}
+
+	n := 0
+	for range chOut {
+		n++
+	}
+	if n != 2 {
+		t.Fatal("unexpected number of mapped items:", n)
+	}
+
+	// Chan is closed by the stage, so this doesn't block forever.
+	total := MapStageFailures{}
+	for f := range failures {
+		total.Merge(f)
+	}
+
+	want := MapStageFailures{Received: 5, NilDistancer: 1, MapFunc: 2}
+	if total != want {
+		t.Fatalf("unexpected failures. want %+v, have %+v", want, total)
+	}
+	if total.Dropped() != 3 {
+		t.Fatal("unexpected number of dropped items:", total.Dropped())
+	}
+}
+
 func TestFilterStage(t *testing.T) {
 	// Input data.
 	scores := []ScoreItem{
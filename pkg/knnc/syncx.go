@@ -1,6 +1,9 @@
 package knnc
 
-import "sync"
+import (
+	"runtime"
+	"sync"
+)
 
 /*
 File for things that could have been an extension of std/sync.
@@ -43,6 +46,12 @@ func (cs *CancelSignal) Cancelled() bool {
 	return cs.closed
 }
 
+// Done returns a chan which is closed when the Cancel method is called, such that
+// the signal can be awaited in a select statement.
+func (cs *CancelSignal) Done() <-chan struct{} {
+	return cs.c
+}
+
 // Ok returns true if the instance was created correctly (with NewCancelSignal()).
 func (cs *CancelSignal) Ok() bool { return cs.c != nil }
 
@@ -77,8 +86,10 @@ func (a *ActiveGoroutinesTicker) CurrentN() int {
 }
 
 // BlockUntilBelowN is a convenience method; it blocks until the internal ticker
-// is below the specified 'n'.
+// is below the specified 'n'. It yields (runtime.Gosched) while waiting, such
+// that the goroutines being waited on are not starved when cpus are scarce.
 func (a *ActiveGoroutinesTicker) BlockUntilBelowN(n int) {
 	for a.CurrentN() >= n {
+		runtime.Gosched()
 	}
 }
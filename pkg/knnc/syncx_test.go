@@ -31,6 +31,23 @@ func TestCancelSignalBasic(t *testing.T) {
 	}
 }
 
+func TestCancelSignalDone(t *testing.T) {
+	cs := NewCancelSignal()
+
+	select {
+	case <-cs.Done():
+		t.Fatal("false positive (cancelled) from 'Done' method chan")
+	default:
+	}
+
+	cs.Cancel()
+	select {
+	case <-cs.Done():
+	case <-time.After(time.Second):
+		t.Fatal("'Done' method chan not closed after cancel")
+	}
+}
+
 func TestCancelSignalConcurrent(t *testing.T) {
 	cs := NewCancelSignal()
 
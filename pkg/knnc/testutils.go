@@ -21,6 +21,7 @@ var _ DistancerContainer = new(data) // Hint.
 type data struct {
 	v       *tVec
 	Expires time.Time
+	id      string
 }
 
 func (d *data) Distancer() mathx.Distancer {
@@ -30,4 +31,4 @@ func (d *data) Distancer() mathx.Distancer {
 	return d.v
 }
 
-func (d *data) ID() string { return "" } // Not used for tests here.
+func (d *data) ID() string { return d.id }
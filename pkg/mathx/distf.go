@@ -47,3 +47,56 @@ func CosineSimilarity(v1, v2 []float64) (float64, bool) {
 	}
 	return dot / norm1 / norm2, true
 }
+
+// ZeroVecMode specifies how cosine similarity is handled when one (or both) of
+// the vectors is a zero vector, since the similarity is undefined in that case.
+type ZeroVecMode int
+
+const (
+	// ZeroVecModeSkip gives a false return, which is the default behavior of
+	// the cosine similarity funcs in this pkg. In a KNN context, this will
+	// typically drop the candidate.
+	ZeroVecModeSkip ZeroVecMode = iota
+	// ZeroVecModeZero treats the similarity as 0, i.e as if the vectors were
+	// orthogonal.
+	ZeroVecModeZero
+	// ZeroVecModeNegOne treats the similarity as -1, i.e as if the vectors
+	// were pointing in opposite directions (least similar).
+	ZeroVecModeNegOne
+)
+
+// Ok returns true if the ZeroVecMode is defined in this pkg.
+func (m *ZeroVecMode) Ok() bool {
+	ok := false
+	ok = ok || (*m) == ZeroVecModeSkip
+	ok = ok || (*m) == ZeroVecModeZero
+	ok = ok || (*m) == ZeroVecModeNegOne
+	return ok
+}
+
+// score gives the similarity defined by the mode. False for ZeroVecModeSkip
+// and undefined modes.
+func (m ZeroVecMode) score() (float64, bool) {
+	switch m {
+	case ZeroVecModeZero:
+		return 0, true
+	case ZeroVecModeNegOne:
+		return -1, true
+	default:
+		return 0, false
+	}
+}
+
+// CosineSimilarityZeroVec is equivalent to CosineSimilarity (this pkg), except
+// that zero vectors are handled as specified with 'mode'. Returns false if:
+//	(A): len(v1) != len(v2)
+//	(B): One of the vectors is a zero vector and mode is ZeroVecModeSkip.
+func CosineSimilarityZeroVec(v1, v2 []float64, mode ZeroVecMode) (float64, bool) {
+	if len(v1) != len(v2) {
+		return 0, false
+	}
+	if norm(v1) == 0 || norm(v2) == 0 {
+		return mode.score()
+	}
+	return CosineSimilarity(v1, v2)
+}
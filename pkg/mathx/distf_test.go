@@ -50,3 +50,38 @@ func TestCosineSimilarity(t *testing.T) {
 		}
 	}
 }
+
+func TestCosineSimilarityZeroVec(t *testing.T) {
+	type tcase struct {
+		vec1   []float64
+		vec2   []float64
+		mode   ZeroVecMode
+		answer float64
+		ok     bool
+	}
+
+	cases := []tcase{
+		// Zero query.
+		{vec1: []float64{0, 0}, vec2: []float64{1, 2}, mode: ZeroVecModeSkip, ok: false},
+		{vec1: []float64{0, 0}, vec2: []float64{1, 2}, mode: ZeroVecModeZero, answer: 0, ok: true},
+		{vec1: []float64{0, 0}, vec2: []float64{1, 2}, mode: ZeroVecModeNegOne, answer: -1, ok: true},
+		// Zero candidate.
+		{vec1: []float64{1, 2}, vec2: []float64{0, 0}, mode: ZeroVecModeSkip, ok: false},
+		{vec1: []float64{1, 2}, vec2: []float64{0, 0}, mode: ZeroVecModeZero, answer: 0, ok: true},
+		{vec1: []float64{1, 2}, vec2: []float64{0, 0}, mode: ZeroVecModeNegOne, answer: -1, ok: true},
+		// Non-zero vecs are unaffected by the mode.
+		{vec1: []float64{1, 1}, vec2: []float64{2, 2}, mode: ZeroVecModeNegOne, answer: 1, ok: true},
+		// Dimension mismatch is never ok.
+		{vec1: []float64{0}, vec2: []float64{0, 0}, mode: ZeroVecModeZero, ok: false},
+	}
+
+	for i, c := range cases {
+		res, ok := CosineSimilarityZeroVec(c.vec1, c.vec2, c.mode)
+		if ok != c.ok {
+			t.Fatalf("failed case %v. want ok=%v, got %v", i, c.ok, ok)
+		}
+		if ok && RoundF64(res, 3) != c.answer {
+			t.Fatalf("failed case %v. want %v, got %v", i, c.answer, res)
+		}
+	}
+}
@@ -1,6 +1,21 @@
 package mathx
 
-import "math"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Errors returned by ValidVec and ValidDistancer. They are wrapped with the
+// index of the offending element for ErrVecNaN and ErrVecInf, so use errors.Is
+// for comparisons.
+var (
+	ErrVecNil   = errors.New("mathx: vec is nil")
+	ErrVecEmpty = errors.New("mathx: vec is empty")
+	ErrVecNaN   = errors.New("mathx: vec contains NaN")
+	ErrVecInf   = errors.New("mathx: vec contains Inf")
+)
 
 // RoundF64 rounds a float64 to the specified amount of decimals.
 // Rounds to the closest num, so no ceil or floor.
@@ -16,3 +31,57 @@ func RoundF64(f float64, decimals int) float64 {
 	}
 	return math.Round(f*round) / round
 }
+
+// ValidVec checks whether a vec is usable for distance calculations. A single
+// NaN or Inf element makes all distances involving the vec NaN/Inf as well, so
+// such vecs should be rejected early. Returns a non-nil err if:
+//	(A): v == nil (ErrVecNil).
+//	(B): len(v) == 0 (ErrVecEmpty).
+//	(C): any element of v is NaN (ErrVecNaN).
+//	(D): any element of v is +Inf or -Inf (ErrVecInf).
+func ValidVec(v []float64) error {
+	if v == nil {
+		return ErrVecNil
+	}
+	if len(v) == 0 {
+		return ErrVecEmpty
+	}
+	for i, f := range v {
+		if err := validElement(f, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidDistancer is the same as ValidVec, but checks the elements of 'd' in
+// place with Distancer.Peek, i.e without copying them into a slice first. A nil
+// pointer in a non-nil Distancer (e.g a (*SafeVec)(nil)) gives ErrVecNil too.
+func ValidDistancer(d Distancer) error {
+	// == nil does not work as expected.
+	if d == nil || reflect.ValueOf(d).IsNil() {
+		return ErrVecNil
+	}
+	if d.Dim() == 0 {
+		return ErrVecEmpty
+	}
+	for i := 0; i < d.Dim(); i++ {
+		f, _ := d.Peek(i)
+		if err := validElement(f, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validElement returns ErrVecNaN or ErrVecInf (wrapped with 'i', the index of
+// the element) if 'f' is NaN or Inf, see ValidVec.
+func validElement(f float64, i int) error {
+	if math.IsNaN(f) {
+		return fmt.Errorf("%w (index %d)", ErrVecNaN, i)
+	}
+	if math.IsInf(f, 0) {
+		return fmt.Errorf("%w (index %d)", ErrVecInf, i)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package mathx
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestValidVec(t *testing.T) {
+	type tcase struct {
+		vec []float64
+		err error
+	}
+
+	cases := []tcase{
+		{vec: nil, err: ErrVecNil},
+		{vec: []float64{}, err: ErrVecEmpty},
+		{vec: []float64{1, math.NaN(), 2}, err: ErrVecNaN},
+		{vec: []float64{math.Inf(1)}, err: ErrVecInf},
+		{vec: []float64{0, math.Inf(-1)}, err: ErrVecInf},
+		{vec: []float64{0, 1, -2.5}, err: nil},
+	}
+
+	for i, c := range cases {
+		err := ValidVec(c.vec)
+		if c.err == nil && err != nil {
+			t.Fatalf("failed case %v. unexpected err: %v", i, err)
+		}
+		if !errors.Is(err, c.err) {
+			t.Fatalf("failed case %v. want %v, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestValidDistancer(t *testing.T) {
+	type tcase struct {
+		d   Distancer
+		err error
+	}
+
+	cases := []tcase{
+		{d: nil, err: ErrVecNil},
+		{d: (*SafeVec)(nil), err: ErrVecNil},
+		{d: NewSafeVec(), err: ErrVecEmpty},
+		{d: NewSafeVec(1, math.NaN(), 2), err: ErrVecNaN},
+		{d: NewFloatVec([]float64{0, math.Inf(-1)}), err: ErrVecInf},
+		{d: NewSafeVec(0, 1, -2.5), err: nil},
+	}
+
+	for i, c := range cases {
+		err := ValidDistancer(c.d)
+		if c.err == nil && err != nil {
+			t.Fatalf("failed case %v. unexpected err: %v", i, err)
+		}
+		if !errors.Is(err, c.err) {
+			t.Fatalf("failed case %v. want %v, got %v", i, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package mathx
+
+/*
+File contains FloatVec, a zero-copy alternative to SafeVec.
+*/
+
+import "math"
+
+// FloatVec is a lightweight alternative to SafeVec, which implements Distancer
+// directly over a caller-owned []float64, i.e the slice is not copied. This
+// saves an allocation and a copy per vec, which adds up in hot paths such as
+// bulk ingest. The norm is computed once, when the FloatVec is created.
+//
+// Note; the caller must NOT change the slice after it is given to NewFloatVec,
+// as FloatVec is only thread safe (and correct) for as long as it is not
+// changed. Use SafeVec if that can not be guaranteed.
+type FloatVec struct {
+	vec  []float64
+	norm float64
+	// id is optional, see NewFloatVecWithID.
+	id string
+}
+
+// Symbolic.
+var _ Distancer = &FloatVec{}
+
+// NewFloatVec wraps the given slice without copying it, see doc of FloatVec.
+func NewFloatVec(vec []float64) *FloatVec {
+	return &FloatVec{vec: vec, norm: norm(vec)}
+}
+
+// NewFloatVecWithID is the same as NewFloatVec, except that the FloatVec also
+// keeps the given ID (see FloatVec.ID). The ID is not used for any of the
+// calculations, it is only a way of recognising the vec elsewhere.
+func NewFloatVecWithID(vec []float64, id string) *FloatVec {
+	return &FloatVec{vec: vec, norm: norm(vec), id: id}
+}
+
+// ID returns the ID given with NewFloatVecWithID, empty if none was given.
+func (v *FloatVec) ID() string {
+	return v.id
+}
+
+// Dim exposes the dimension of the underlying vector.
+func (v *FloatVec) Dim() int {
+	return len(v.vec)
+}
+
+// Peek returns the element of the underlying []float64 at a given index.
+// Will return false if the index is out-of-bounds.
+func (v *FloatVec) Peek(index int) (float64, bool) {
+	if index >= len(v.vec) || index < 0 {
+		return 0, false
+	}
+	return v.vec[index], true
+}
+
+// Norm is the norm of the internal vector.
+func (v *FloatVec) Norm() float64 {
+	return v.norm
+}
+
+// EuclideanDistance computes the Euclidean distance to another vec that
+// implements the Distancer interface (this pkg).
+// False condition if:
+//	neq dimension for the two vecs.
+func (v *FloatVec) EuclideanDistance(other Distancer) (float64, bool) {
+	if other == nil || len(v.vec) != other.Dim() {
+		return 0, false
+	}
+
+	r := 0.
+	for i, vi := range v.vec {
+		wi, ok := other.Peek(i)
+		// Vecs are not of equal length afterall.
+		if !ok {
+			return 0, false
+		}
+		r += (vi - wi) * (vi - wi)
+	}
+
+	return math.Sqrt(r), true
+}
+
+// CosineSimilarity finds the cosine similarity between this vector and the
+// other. Returns false on two conditions, if;
+//	(A): neq dimensions.
+//	(B): one of the vectors is a zero vector.
+func (v *FloatVec) CosineSimilarity(other Distancer) (float64, bool) {
+	if other == nil || len(v.vec) != other.Dim() {
+		return 0, false
+	}
+
+	vNorm, otherNorm := v.norm, other.Norm()
+	if vNorm == 0 || otherNorm == 0 {
+		return 0, false
+	}
+
+	dot := 0.
+	for i, vi := range v.vec {
+		otherElm, ok := other.Peek(i)
+		// Vecs are not of equal length afterall.
+		if !ok {
+			return 0, false
+		}
+		dot += vi * otherElm
+	}
+	return dot / vNorm / otherNorm, true
+}
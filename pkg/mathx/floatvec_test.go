@@ -0,0 +1,97 @@
+package mathx
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestFloatVecDistancesMatchSafeVec(t *testing.T) {
+	dim := 16
+	for i := 0; i < 100; i++ {
+		a, b := make([]float64, dim), make([]float64, dim)
+		for j := range a {
+			a[j], b[j] = rand.Float64()*2-1, rand.Float64()*2-1
+		}
+		fa, fb := NewFloatVec(a), NewFloatVec(b)
+		sa, sb := NewSafeVec(a...), NewSafeVec(b...)
+
+		// Both ways, and mixed with SafeVec.
+		for _, pair := range [][2]Distancer{{fa, fb}, {fa, sb}, {sa, fb}} {
+			want, _ := sa.EuclideanDistance(sb)
+			have, ok := pair[0].EuclideanDistance(pair[1])
+			if !ok || math.Abs(want-have) > 1e-12 {
+				t.Fatalf("euclidean: want %v, have %v (ok=%v)", want, have, ok)
+			}
+
+			want, _ = sa.CosineSimilarity(sb)
+			have, ok = pair[0].CosineSimilarity(pair[1])
+			if !ok || math.Abs(want-have) > 1e-12 {
+				t.Fatalf("cosine: want %v, have %v (ok=%v)", want, have, ok)
+			}
+		}
+		if math.Abs(fa.Norm()-sa.Norm()) > 1e-12 {
+			t.Fatalf("norm: want %v, have %v", sa.Norm(), fa.Norm())
+		}
+	}
+}
+
+func TestFloatVecNoCopy(t *testing.T) {
+	s := []float64{1, 2, 3}
+	v := NewFloatVec(s)
+	if &v.vec[0] != &s[0] {
+		t.Fatal("slice was copied")
+	}
+	if elm, ok := v.Peek(2); !ok || elm != 3 || v.Dim() != 3 {
+		t.Fatalf("unexpected peek/dim: %v/%v", elm, v.Dim())
+	}
+	if _, ok := v.Peek(3); ok {
+		t.Fatal("unexpected ok peek out of bounds")
+	}
+	if v.ID() != "" || NewFloatVecWithID(s, "x").ID() != "x" {
+		t.Fatal("unexpected ids")
+	}
+}
+
+func TestFloatVecFalse(t *testing.T) {
+	v := NewFloatVec([]float64{1, 2})
+	if _, ok := v.EuclideanDistance(NewFloatVec([]float64{1})); ok {
+		t.Fatal("unexpected ok euclidean with a dimension mismatch")
+	}
+	if _, ok := v.CosineSimilarity(NewFloatVec([]float64{0, 0})); ok {
+		t.Fatal("unexpected ok cosine with a zero vector")
+	}
+	if _, ok := v.CosineSimilarity(nil); ok {
+		t.Fatal("unexpected ok cosine with nil")
+	}
+}
+
+// benchmarkIngest simulates bulk ingest, where vecs are (typically) decoded
+// from a request and then wrapped as a Distancer before they are stored.
+func benchmarkIngest(b *testing.B, wrap func([]float64) Distancer) {
+	dim := 128
+	vecs := make([][]float64, 1000)
+	for i := range vecs {
+		vecs[i] = make([]float64, dim)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.Float64()
+		}
+	}
+	stored := make([]Distancer, len(vecs))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, vec := range vecs {
+			stored[j] = wrap(vec)
+		}
+	}
+}
+
+func BenchmarkIngestSafeVec(b *testing.B) {
+	benchmarkIngest(b, func(vec []float64) Distancer { return NewSafeVec(vec...) })
+}
+
+func BenchmarkIngestFloatVec(b *testing.B) {
+	benchmarkIngest(b, func(vec []float64) Distancer { return NewFloatVec(vec) })
+}
@@ -0,0 +1,160 @@
+package mathx
+
+/*
+File contains Int8Vec, a scalar quantized (lossy) alternative to SafeVec.
+*/
+
+import "math"
+
+// Int8Vec is a memory saving alternative to SafeVec and FloatVec, which keeps
+// each element as an int8 along with a single float64 scale per vec, such that
+// element i is approximately vec[i] * scale. This is ~8x smaller than a slice
+// of float64 (and ~4x smaller than float32) for large dimensions, which matters
+// for very large indexes.
+//
+// Accuracy trade-off: the scale is max(abs(element)) / 127, so each element is
+// rounded to one of 255 evenly spaced values in [-max, max], i.e the error per
+// element is at most scale/2. Distances are computed by dequantizing elements
+// in the distance loop, so they are approximate: the relative error is usually
+// well below 1% for dense vecs, but vecs with a few very large elements lose
+// precision in the small ones. Rankings are therefore only reliable for
+// neighbours that are not (nearly) equally close, i.e when the data is well
+// separated compared to the quantization error.
+//
+// Note; read-only after creation, so it is thread safe.
+type Int8Vec struct {
+	vec   []int8
+	scale float64
+	norm  float64
+	// id is optional, see NewInt8VecWithID.
+	id string
+}
+
+// Symbolic.
+var _ Distancer = &Int8Vec{}
+
+// NewInt8Vec quantizes the given slice into a new Int8Vec, see doc of Int8Vec.
+// The slice is not kept, so it can be changed afterwards.
+func NewInt8Vec(vec []float64) *Int8Vec {
+	maxAbs := 0.
+	for _, elm := range vec {
+		maxAbs = math.Max(maxAbs, math.Abs(elm))
+	}
+
+	v := Int8Vec{vec: make([]int8, len(vec))}
+	if maxAbs == 0 {
+		return &v
+	}
+
+	v.scale = maxAbs / math.MaxInt8
+	for i, elm := range vec {
+		v.vec[i] = int8(math.Round(elm / v.scale))
+	}
+	// The norm is of the quantized elements, such that it is consistent with
+	// the other calculations.
+	x := 0.
+	for _, elm := range v.vec {
+		x += float64(elm) * float64(elm)
+	}
+	v.norm = math.Sqrt(x) * v.scale
+	return &v
+}
+
+// NewInt8VecWithID is the same as NewInt8Vec, except that the Int8Vec also
+// keeps the given ID (see Int8Vec.ID). The ID is not used for any of the
+// calculations, it is only a way of recognising the vec elsewhere.
+func NewInt8VecWithID(vec []float64, id string) *Int8Vec {
+	v := NewInt8Vec(vec)
+	v.id = id
+	return v
+}
+
+// ID returns the ID given with NewInt8VecWithID, empty if none was given.
+func (v *Int8Vec) ID() string {
+	return v.id
+}
+
+// Dim exposes the dimension of the underlying vector.
+func (v *Int8Vec) Dim() int {
+	return len(v.vec)
+}
+
+// Peek returns the (dequantized) element of the underlying vector at a given
+// index. Will return false if the index is out-of-bounds.
+func (v *Int8Vec) Peek(index int) (float64, bool) {
+	if index >= len(v.vec) || index < 0 {
+		return 0, false
+	}
+	return float64(v.vec[index]) * v.scale, true
+}
+
+// Norm is the norm of the internal (dequantized) vector.
+func (v *Int8Vec) Norm() float64 {
+	return v.norm
+}
+
+// EuclideanDistance computes the (approximate) Euclidean distance to another vec
+// that implements the Distancer interface (this pkg).
+// False condition if:
+//	neq dimension for the two vecs.
+func (v *Int8Vec) EuclideanDistance(other Distancer) (float64, bool) {
+	if other == nil || len(v.vec) != other.Dim() {
+		return 0, false
+	}
+
+	r := 0.
+	// Fast path, avoids Peek calls.
+	if w, ok := other.(*Int8Vec); ok {
+		for i, vi := range v.vec {
+			d := float64(vi)*v.scale - float64(w.vec[i])*w.scale
+			r += d * d
+		}
+		return math.Sqrt(r), true
+	}
+
+	for i, vi := range v.vec {
+		wi, ok := other.Peek(i)
+		// Vecs are not of equal length afterall.
+		if !ok {
+			return 0, false
+		}
+		d := float64(vi)*v.scale - wi
+		r += d * d
+	}
+	return math.Sqrt(r), true
+}
+
+// CosineSimilarity finds the (approximate) cosine similarity between this vector
+// and the other. Returns false on two conditions, if;
+//	(A): neq dimensions.
+//	(B): one of the vectors is a zero vector.
+func (v *Int8Vec) CosineSimilarity(other Distancer) (float64, bool) {
+	if other == nil || len(v.vec) != other.Dim() {
+		return 0, false
+	}
+
+	vNorm, otherNorm := v.norm, other.Norm()
+	if vNorm == 0 || otherNorm == 0 {
+		return 0, false
+	}
+
+	// Fast path, the scales cancel out with the norms.
+	if w, ok := other.(*Int8Vec); ok {
+		dot := 0
+		for i, vi := range v.vec {
+			dot += int(vi) * int(w.vec[i])
+		}
+		return float64(dot) * v.scale * w.scale / vNorm / otherNorm, true
+	}
+
+	dot := 0.
+	for i, vi := range v.vec {
+		otherElm, ok := other.Peek(i)
+		// Vecs are not of equal length afterall.
+		if !ok {
+			return 0, false
+		}
+		dot += float64(vi) * otherElm
+	}
+	return dot * v.scale / vNorm / otherNorm, true
+}
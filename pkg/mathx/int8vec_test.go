@@ -0,0 +1,107 @@
+package mathx
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestInt8VecDistancesApproximateSafeVec(t *testing.T) {
+	dim := 64
+	for i := 0; i < 100; i++ {
+		a, b := make([]float64, dim), make([]float64, dim)
+		for j := range a {
+			a[j], b[j] = rand.Float64()*2-1, rand.Float64()*2-1
+		}
+		qa, qb := NewInt8Vec(a), NewInt8Vec(b)
+		sa, sb := NewSafeVec(a...), NewSafeVec(b...)
+
+		// Both ways, and mixed with SafeVec.
+		for _, pair := range [][2]Distancer{{qa, qb}, {qa, sb}, {sa, qb}} {
+			want, _ := sa.EuclideanDistance(sb)
+			have, ok := pair[0].EuclideanDistance(pair[1])
+			if !ok || math.Abs(want-have)/want > 0.01 {
+				t.Fatalf("euclidean: want ~%v, have %v (ok=%v)", want, have, ok)
+			}
+
+			want, _ = sa.CosineSimilarity(sb)
+			have, ok = pair[0].CosineSimilarity(pair[1])
+			if !ok || math.Abs(want-have) > 0.01 {
+				t.Fatalf("cosine: want ~%v, have %v (ok=%v)", want, have, ok)
+			}
+		}
+		if math.Abs(qa.Norm()-sa.Norm())/sa.Norm() > 0.01 {
+			t.Fatalf("norm: want ~%v, have %v", sa.Norm(), qa.Norm())
+		}
+	}
+}
+
+func TestInt8VecTopK(t *testing.T) {
+	// Well separated data: clusters around distinct centers, with little noise.
+	dim, nClusters, perCluster, k := 32, 20, 10, 10
+	var raw [][]float64
+	for c := 0; c < nClusters; c++ {
+		center := make([]float64, dim)
+		for j := range center {
+			center[j] = rand.Float64()*20 - 10
+		}
+		for i := 0; i < perCluster; i++ {
+			v := make([]float64, dim)
+			for j := range v {
+				v[j] = center[j] + rand.Float64()*0.5
+			}
+			raw = append(raw, v)
+		}
+	}
+
+	// Indexes of the k nearest neighbours of query, in the vecs made by f.
+	topK := func(query []float64, f func([]float64) Distancer) []int {
+		q := f(query)
+		dists := make([]float64, len(raw))
+		indexes := make([]int, len(raw))
+		for i, v := range raw {
+			dists[i], _ = q.EuclideanDistance(f(v))
+			indexes[i] = i
+		}
+		sort.Slice(indexes, func(i, j int) bool { return dists[indexes[i]] < dists[indexes[j]] })
+		r := indexes[:k]
+		sort.Ints(r)
+		return r
+	}
+
+	safeVec := func(v []float64) Distancer { return NewSafeVec(v...) }
+	int8Vec := func(v []float64) Distancer { return NewInt8Vec(v) }
+	for c := 0; c < nClusters; c++ {
+		query := raw[c*perCluster]
+		want, have := topK(query, safeVec), topK(query, int8Vec)
+		for i := range want {
+			if want[i] != have[i] {
+				t.Fatalf("query %v: want top-k %v, have %v", c, want, have)
+			}
+		}
+	}
+}
+
+func TestInt8VecFalse(t *testing.T) {
+	v := NewInt8Vec([]float64{1, 2})
+	if _, ok := v.EuclideanDistance(NewInt8Vec([]float64{1})); ok {
+		t.Fatal("unexpected ok euclidean with a dimension mismatch")
+	}
+	if _, ok := v.CosineSimilarity(NewInt8Vec([]float64{0, 0})); ok {
+		t.Fatal("unexpected ok cosine with a zero vector")
+	}
+	if _, ok := v.CosineSimilarity(nil); ok {
+		t.Fatal("unexpected ok cosine with nil")
+	}
+	if _, ok := v.Peek(2); ok {
+		t.Fatal("unexpected ok peek out of bounds")
+	}
+	if v.ID() != "" || NewInt8VecWithID([]float64{1}, "x").ID() != "x" {
+		t.Fatal("unexpected ids")
+	}
+}
+
+func BenchmarkIngestInt8Vec(b *testing.B) {
+	benchmarkIngest(b, func(vec []float64) Distancer { return NewInt8Vec(vec) })
+}
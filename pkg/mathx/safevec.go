@@ -117,6 +117,71 @@ func (v *SafeVec) In(others []*SafeVec) bool {
 	return false
 }
 
+// zipWith returns a new SafeVec where each element is f applied to the elements
+// with the same index in this and the other SafeVec. Returns (nil, false) if
+// the other SafeVec is nil or has a different dimension.
+func (v *SafeVec) zipWith(other *SafeVec, f func(a, b float64) float64) (*SafeVec, bool) {
+	if other == nil || len(v.vec) != len(other.vec) {
+		return nil, false
+	}
+
+	vec := make([]float64, len(v.vec))
+	for i := range vec {
+		vec[i] = f(v.vec[i], other.vec[i])
+	}
+	return &SafeVec{vec: vec}, true
+}
+
+// Add returns a new SafeVec which is the element-wise sum of this and the other
+// SafeVec, neither of which are changed. Returns (nil, false) if the other
+// SafeVec is nil or has a different dimension.
+func (v *SafeVec) Add(other *SafeVec) (*SafeVec, bool) {
+	return v.zipWith(other, func(a, b float64) float64 { return a + b })
+}
+
+// Sub returns a new SafeVec which is the element-wise difference of this and
+// the other SafeVec (i.e this - other), neither of which are changed. Returns
+// (nil, false) if the other SafeVec is nil or has a different dimension.
+func (v *SafeVec) Sub(other *SafeVec) (*SafeVec, bool) {
+	return v.zipWith(other, func(a, b float64) float64 { return a - b })
+}
+
+// Scale returns a new SafeVec where each element of this SafeVec is multiplied
+// by the given factor. This SafeVec is not changed.
+func (v *SafeVec) Scale(factor float64) *SafeVec {
+	vec := make([]float64, len(v.vec))
+	for i, elm := range v.vec {
+		vec[i] = elm * factor
+	}
+	return &SafeVec{vec: vec}
+}
+
+// Mean returns a new SafeVec which is the element-wise mean of the given vecs,
+// e.g the centroid of a group of vecs. None of the given vecs are changed, so
+// a single vec gives a copy. Returns (nil, false) if len(vecs) == 0, or if any
+// of the vecs are nil or have a dimension different to the others.
+func Mean(vecs []*SafeVec) (*SafeVec, bool) {
+	if len(vecs) == 0 || vecs[0] == nil {
+		return nil, false
+	}
+
+	vec := make([]float64, vecs[0].Dim())
+	for _, v := range vecs {
+		if v == nil || len(v.vec) != len(vec) {
+			return nil, false
+		}
+		for i, elm := range v.vec {
+			vec[i] += elm
+		}
+	}
+
+	n := float64(len(vecs))
+	for i := range vec {
+		vec[i] /= n
+	}
+	return &SafeVec{vec: vec}, true
+}
+
 // Peek returns the element of the underlying []float64 at a given index.
 // Will return false if the index is out-of-bounds.
 func (v *SafeVec) Peek(index int) (float64, bool) {
@@ -191,3 +256,18 @@ func (v *SafeVec) CosineSimilarity(other Distancer) (float64, bool) {
 	}
 	return dot / vNorm / otherNorm, true
 }
+
+// CosineSimilarityZeroVecDist is equivalent to d1.CosineSimilarity(d2), except
+// that zero vectors are handled as specified with 'mode'. Returns false if;
+//	(A): either Distancer is nil.
+//	(B): neq dimensions.
+//	(C): one of the vectors is a zero vector and mode is ZeroVecModeSkip.
+func CosineSimilarityZeroVecDist(d1, d2 Distancer, mode ZeroVecMode) (float64, bool) {
+	if d1 == nil || d2 == nil || d1.Dim() != d2.Dim() {
+		return 0, false
+	}
+	if d1.Norm() == 0 || d2.Norm() == 0 {
+		return mode.score()
+	}
+	return d1.CosineSimilarity(d2)
+}
@@ -49,6 +49,102 @@ func TestSafeVecIn(t *testing.T) {
 	}
 }
 
+func TestSafeVecAdd(t *testing.T) {
+	v := NewSafeVec(1, 2, 3)
+	w := NewSafeVec(0.5, -2, 10)
+
+	r, ok := v.Add(w)
+	if !ok {
+		t.Fatal("unexpected not-ok")
+	}
+	if !r.Eq(NewSafeVec(1.5, 0, 13)) {
+		t.Fatalf("unexpected result: %v", r.vec)
+	}
+	// Read-only.
+	if !v.Eq(NewSafeVec(1, 2, 3)) || !w.Eq(NewSafeVec(0.5, -2, 10)) {
+		t.Fatal("operands were changed")
+	}
+
+	if _, ok := v.Add(NewSafeVec(1, 2)); ok {
+		t.Fatal("unexpected ok with a dimension mismatch")
+	}
+	if _, ok := v.Add(nil); ok {
+		t.Fatal("unexpected ok with nil")
+	}
+}
+
+func TestSafeVecSub(t *testing.T) {
+	v := NewSafeVec(1, 2, 3)
+	w := NewSafeVec(0.5, -2, 10)
+
+	r, ok := v.Sub(w)
+	if !ok {
+		t.Fatal("unexpected not-ok")
+	}
+	if !r.Eq(NewSafeVec(0.5, 4, -7)) {
+		t.Fatalf("unexpected result: %v", r.vec)
+	}
+	// Read-only.
+	if !v.Eq(NewSafeVec(1, 2, 3)) || !w.Eq(NewSafeVec(0.5, -2, 10)) {
+		t.Fatal("operands were changed")
+	}
+
+	if _, ok := v.Sub(NewSafeVec(1, 2, 3, 4)); ok {
+		t.Fatal("unexpected ok with a dimension mismatch")
+	}
+}
+
+func TestSafeVecScale(t *testing.T) {
+	v := NewSafeVec(1, -2, 3)
+
+	if r := v.Scale(2); !r.Eq(NewSafeVec(2, -4, 6)) {
+		t.Fatalf("unexpected result: %v", r.vec)
+	}
+	if r := v.Scale(0); !r.Eq(NewSafeVec(0, 0, 0)) {
+		t.Fatalf("unexpected result: %v", r.vec)
+	}
+	// Read-only, including the precomputed norm.
+	norm := v.Norm()
+	v.Scale(10)
+	if !v.Eq(NewSafeVec(1, -2, 3)) || v.Norm() != norm {
+		t.Fatal("scaled vec was changed")
+	}
+}
+
+func TestMean(t *testing.T) {
+	vecs := []*SafeVec{
+		NewSafeVec(1, 2, 3),
+		NewSafeVec(3, 4, 5),
+		NewSafeVec(-1, 0, 10),
+	}
+	r, ok := Mean(vecs)
+	if !ok {
+		t.Fatal("unexpected not-ok")
+	}
+	if !r.Eq(NewSafeVec(1, 2, 6)) {
+		t.Fatalf("unexpected mean: %v", r.vec)
+	}
+
+	// Single vec gives a copy.
+	r, ok = Mean(vecs[:1])
+	if !ok || !r.Eq(vecs[0]) || &r.vec[0] == &vecs[0].vec[0] {
+		t.Fatal("want a copy of the single vec")
+	}
+
+	for _, tc := range []struct {
+		name string
+		vecs []*SafeVec
+	}{
+		{name: "empty", vecs: nil},
+		{name: "dimension mismatch", vecs: []*SafeVec{NewSafeVec(1, 2), NewSafeVec(1, 2, 3)}},
+		{name: "nil vec", vecs: []*SafeVec{NewSafeVec(1, 2), nil}},
+	} {
+		if _, ok := Mean(tc.vecs); ok {
+			t.Fatalf("%v: unexpected ok", tc.name)
+		}
+	}
+}
+
 func TestSafeVecPeek(t *testing.T) {
 	v := []float64{1, 2, 3, 0, 4}
 	w := NewSafeVec(v...)
@@ -113,3 +209,35 @@ func TestSafeVecCosDist(t *testing.T) {
 		}
 	}
 }
+
+func TestSafeVecCosDistZeroVec(t *testing.T) {
+	type tcase struct {
+		vec1   Distancer
+		vec2   Distancer
+		mode   ZeroVecMode
+		answer float64
+		ok     bool
+	}
+
+	zero := NewSafeVec(0, 0, 0)
+	nonZero := NewSafeVec(1, 2, 3)
+	cases := []tcase{
+		{vec1: zero, vec2: nonZero, mode: ZeroVecModeSkip, ok: false},
+		{vec1: zero, vec2: nonZero, mode: ZeroVecModeZero, answer: 0, ok: true},
+		{vec1: zero, vec2: nonZero, mode: ZeroVecModeNegOne, answer: -1, ok: true},
+		{vec1: nonZero, vec2: zero, mode: ZeroVecModeSkip, ok: false},
+		{vec1: nonZero, vec2: zero, mode: ZeroVecModeZero, answer: 0, ok: true},
+		{vec1: nonZero, vec2: zero, mode: ZeroVecModeNegOne, answer: -1, ok: true},
+		{vec1: nonZero, vec2: nonZero, mode: ZeroVecModeNegOne, answer: 1, ok: true},
+	}
+
+	for i, c := range cases {
+		res, ok := CosineSimilarityZeroVecDist(c.vec1, c.vec2, c.mode)
+		if ok != c.ok {
+			t.Fatalf("failed case %v. want ok=%v, got %v", i, c.ok, ok)
+		}
+		if ok && RoundF64(res, 3) != c.answer {
+			t.Fatalf("failed case %v. want %v, got %v", i, c.answer, res)
+		}
+	}
+}
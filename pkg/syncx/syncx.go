@@ -0,0 +1,6 @@
+/*
+syncx is an addition to the std sync pkg. It contains generic helpers for
+concurrency patterns on chans, such as broadcasting a chan to multiple
+consumers (Tee).
+*/
+package syncx
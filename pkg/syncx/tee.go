@@ -0,0 +1,129 @@
+package syncx
+
+/*
+File contains a tee for chans, i.e a way of broadcasting every element of a
+single chan to multiple consumers.
+*/
+
+import "context"
+
+// TeeOutput configures a single output of TeeWithArgs.
+type TeeOutput struct {
+	// Ctx stops sending to (and closes) this output when done, without
+	// affecting the other outputs. Nil means that it is never stopped.
+	Ctx context.Context
+	// Buf is the buffer of this output chan, see doc of TeeWithArgs. Must
+	// be >= 0.
+	Buf int
+}
+
+// TeeArgs is intended as args for TeeWithArgs.
+type TeeArgs[T any] struct {
+	// In is the chan which is duplicated. Must not be nil.
+	In <-chan T
+	// Outputs configures each output chan, see TeeOutput. Must not be empty.
+	Outputs []TeeOutput
+	// DoneCallback is called once In is closed and drained, and all outputs
+	// are closed. It is called in a goroutine. May be nil.
+	DoneCallback func()
+}
+
+// Ok validates TeeArgs. Returns true iff:
+//  (1) args.In != nil,
+//  (2) len(args.Outputs) > 0,
+//  (3) args.Outputs[i].Buf >= 0 for all i.
+func (args *TeeArgs[T]) Ok() bool {
+	if args.In == nil || len(args.Outputs) == 0 {
+		return false
+	}
+	for _, out := range args.Outputs {
+		if out.Buf < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Tee duplicates every element of 'in' to 'n' unbuffered output chans, which
+// are all closed when 'in' is closed, or when ctx is done. See TeeWithArgs for
+// details about backpressure, and for outputs which can be cancelled (and
+// buffered) independently. Returns nil if n < 1 or 'in' is nil.
+func Tee[T any](ctx context.Context, in <-chan T, n int) []<-chan T {
+	if n < 1 {
+		return nil
+	}
+	outs := make([]TeeOutput, n)
+	for i := range outs {
+		outs[i].Ctx = ctx
+	}
+	res, _ := TeeWithArgs(TeeArgs[T]{In: in, Outputs: outs})
+	return res
+}
+
+// TeeWithArgs duplicates every element of args.In to one output chan per
+// TeeOutput in args.Outputs (in the same order). Each output is closed when
+// args.In is closed, or when the Ctx of its TeeOutput is done, in which case
+// elements are no longer sent to it. The latter is only noticed while sending,
+// i.e a stopped output is closed at the latest when the next element is
+// received. Note that args.In is drained regardless, such that the sender does
+// not block even if all outputs are stopped.
+//
+// Elements are sent to one output at a time, in order, so a slow consumer will
+// block the others (backpressure). This can be mitigated with TeeOutput.Buf,
+// e.g a buffer which is as large as the lag to be tolerated between consumers.
+//
+// Returns (nil, false) if args.Ok() == false.
+func TeeWithArgs[T any](args TeeArgs[T]) ([]<-chan T, bool) {
+	if !args.Ok() {
+		return nil, false
+	}
+
+	chans := make([]chan T, len(args.Outputs))
+	dones := make([]<-chan struct{}, len(args.Outputs))
+	res := make([]<-chan T, len(args.Outputs))
+	for i, out := range args.Outputs {
+		chans[i] = make(chan T, out.Buf)
+		if out.Ctx != nil {
+			dones[i] = out.Ctx.Done() // Nil chan (never done) for Background.
+		}
+		res[i] = chans[i]
+	}
+
+	go func() {
+		if args.DoneCallback != nil {
+			defer args.DoneCallback()
+		}
+		defer func() {
+			for _, ch := range chans {
+				if ch != nil {
+					close(ch)
+				}
+			}
+		}()
+
+		for item := range args.In {
+			for i, ch := range chans {
+				if ch == nil {
+					continue
+				}
+				// Checked first, as the select below picks randomly.
+				select {
+				case <-dones[i]:
+					close(ch)
+					chans[i] = nil
+					continue
+				default:
+				}
+				select {
+				case ch <- item:
+					continue
+				case <-dones[i]:
+				}
+				close(ch)
+				chans[i] = nil
+			}
+		}
+	}()
+
+	return res, true
+}
@@ -0,0 +1,136 @@
+package syncx
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTeeSource sends 0 to n-1 into the returned chan, then closes it.
+func testTeeSource(n int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			ch <- i
+		}
+	}()
+	return ch
+}
+
+// testTeeCollect consumes all outputs concurrently, returns what each got.
+func testTeeCollect(outs []<-chan int) [][]int {
+	res := make([][]int, len(outs))
+	wg := sync.WaitGroup{}
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for item := range outs[i] {
+				res[i] = append(res[i], item)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
+
+func TestTee(t *testing.T) {
+	n := 1000
+	outs := Tee(context.Background(), testTeeSource(n), 3)
+	if len(outs) != 3 {
+		t.Fatalf("want 3 outputs, have %v", len(outs))
+	}
+
+	for i, items := range testTeeCollect(outs) {
+		if len(items) != n {
+			t.Fatalf("output %v got %v items, want %v", i, len(items), n)
+		}
+		for j, item := range items {
+			if item != j {
+				t.Fatalf("output %v got item %v at index %v", i, item, j)
+			}
+		}
+	}
+}
+
+func TestTeeCancelOne(t *testing.T) {
+	n := 1000
+	ctx, cancel := context.WithCancel(context.Background())
+	outs, ok := TeeWithArgs(TeeArgs[int]{
+		In:      testTeeSource(n),
+		Outputs: []TeeOutput{{Ctx: ctx}, {}, {Buf: 10}},
+	})
+	if !ok {
+		t.Fatal("unexpected not-ok tee")
+	}
+
+	// First output is cancelled after a single item and then abandoned, which
+	// must neither block nor corrupt the others.
+	<-outs[0]
+	cancel()
+
+	for i, items := range testTeeCollect(outs[1:]) {
+		if len(items) != n {
+			t.Fatalf("output %v got %v items, want %v", i+1, len(items), n)
+		}
+		for j, item := range items {
+			if item != j {
+				t.Fatalf("output %v got item %v at index %v", i+1, item, j)
+			}
+		}
+	}
+
+	// Closed at the latest when the source is closed.
+	for range outs[0] {
+	}
+}
+
+func TestTeeCancelAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Source must be drained even though no one consumes.
+	done := make(chan struct{})
+	outs, _ := TeeWithArgs(TeeArgs[int]{
+		In:           testTeeSource(1000),
+		Outputs:      []TeeOutput{{Ctx: ctx}, {Ctx: ctx}},
+		DoneCallback: func() { close(done) },
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("source was not drained")
+	}
+	for i, items := range testTeeCollect(outs) {
+		if len(items) != 0 {
+			t.Fatalf("cancelled output %v got %v items", i, len(items))
+		}
+	}
+}
+
+func TestTeeArgs(t *testing.T) {
+	in := make(chan int)
+	close(in)
+
+	for _, tc := range []struct {
+		name string
+		args TeeArgs[int]
+		want bool
+	}{
+		{name: "ok", args: TeeArgs[int]{In: in, Outputs: []TeeOutput{{}}}, want: true},
+		{name: "nil in", args: TeeArgs[int]{Outputs: []TeeOutput{{}}}, want: false},
+		{name: "no outputs", args: TeeArgs[int]{In: in}, want: false},
+		{name: "bad buf", args: TeeArgs[int]{In: in, Outputs: []TeeOutput{{Buf: -1}}}, want: false},
+	} {
+		if _, have := TeeWithArgs(tc.args); have != tc.want {
+			t.Fatalf("%v: want %v, have %v", tc.name, tc.want, have)
+		}
+	}
+
+	if outs := Tee(context.Background(), in, 0); outs != nil {
+		t.Fatal("want nil outputs for n=0")
+	}
+}
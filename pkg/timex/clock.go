@@ -0,0 +1,69 @@
+package timex
+
+/*
+File contains the Clock interface, which is how the trackers in this pkg (and
+users of them) tell time. The default is the real time (RealClock), while
+ManualClock only moves when told to, such that tests can control time
+deterministically instead of sleeping.
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time, see NewLatencyTrackerArgs.Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is a Clock which uses time.Now, it is the default where a Clock is
+// optional.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock which only changes with ManualClock.Advance and
+// ManualClock.Set, intended for tests. Note, thread safe, and must be set up
+// with NewManualClock(...).
+type ManualClock struct {
+	mx  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock which starts at 'now'.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by 'd'.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the current time of the clock to 't'.
+func (c *ManualClock) Set(t time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = t
+}
+
+// clockOrReal returns 'c', or RealClock if it is nil.
+func clockOrReal(c Clock) Clock {
+	if c == nil {
+		return RealClock{}
+	}
+	return c
+}
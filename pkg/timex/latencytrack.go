@@ -8,6 +8,7 @@ store data about cumulative latency and amount of additions (for average calc).
 */
 
 import (
+	"math"
 	"sync"
 	"time"
 )
@@ -40,13 +41,20 @@ type NewLatencyTrackerArgs struct {
 	MaxChainLinkN int
 	// MinChainLinkSize represents the min time delta between any link.
 	// A latency tracker tracks latency during a time frame, so link
-	// sizes are measured as a time.Duration.
+	// sizes are measured as a time.Duration. Links start at multiples of
+	// this duration (since the zero time, see time.Time.Truncate), rather
+	// than at the time of the first registered latency, such that the
+	// boundaries are given by the clock alone.
 	MinChainLinkSize time.Duration
 	// StandardPeriod is meant for consistency. The method LatencyTracker.Average
 	// accepts a time.Duration, but there are cases where this arg shouldn't
 	// change. As such, LatencyTracker.AverageSTD can be called, which uses
 	// this field val instead.
 	StandardPeriod time.Duration
+	// Clock is optional, it is used for all timekeeping of the tracker, e.g
+	// for when new links are added, and for LatencyTracker.RegisterCallback.
+	// Use a ManualClock for deterministic tests. Nil defaults to RealClock.
+	Clock Clock
 }
 
 // Ok returns true if the instance was set up correctly. Specifically:
@@ -76,18 +84,27 @@ func (lt *LatencyTracker) Config() NewLatencyTrackerArgs {
 	return lt.cfg
 }
 
+// now returns the current time of the configured clock, see
+// NewLatencyTrackerArgs.Clock.
+func (lt *LatencyTracker) now() time.Time {
+	return clockOrReal(lt.cfg.Clock).Now()
+}
+
 // Try add new head and trim tail.
 // NOTE: no locking, that must be done from the caller.
 func (lt *LatencyTracker) maintain() {
+	// Start of the link which covers the current time, deterministic for
+	// a given clock, see NewLatencyTrackerArgs.MinChainLinkSize.
+	start := lt.now().Truncate(lt.cfg.MinChainLinkSize)
 	// Handle unset.
 	if lt.head == nil {
-		lt.head = &latencyTrackerItem{created: time.Now()}
+		lt.head = &latencyTrackerItem{created: start}
 	}
 
-	// New head if enough time has passed.
+	// New head if the current time is past the link of the head.
 	// Layout: further from head = further back in time.
-	if time.Now().Sub(lt.head.created) >= lt.cfg.MinChainLinkSize {
-		lt.head = &latencyTrackerItem{created: time.Now(), next: lt.head}
+	if start.After(lt.head.created) {
+		lt.head = &latencyTrackerItem{created: start, next: lt.head}
 	}
 
 	// Trim tail.
@@ -104,7 +121,8 @@ func (lt *LatencyTracker) maintain() {
 }
 
 // Register registers some latency. Specifically, it adds the delta to a node
-// that is closest to time.Now(), which might be a node that is created here.
+// that is closest to the current time (see NewLatencyTrackerArgs.Clock), which
+// might be a node that is created here.
 // Additionally, it trims off the old tail(s).
 func (lt *LatencyTracker) Register(delta time.Duration) {
 	lt.Lock()
@@ -124,9 +142,9 @@ func (lt *LatencyTracker) Register(delta time.Duration) {
 // For instance, calling "defer lt.RegisterCallback()" at the start of a func f,
 // will register the whole execution time of f.
 func (lt *LatencyTracker) RegisterCallback() func() {
-	then := time.Now()
+	then := lt.now()
 	return func() {
-		lt.Register(time.Now().Sub(then))
+		lt.Register(lt.now().Sub(then))
 	}
 }
 
@@ -137,7 +155,7 @@ func (lt *LatencyTracker) RegisterCallback() func() {
 // (min link size) * (max amount of links), as specified with the argument
 // given when creating this instance with NewLatencyTrackerArgs.
 func (lt *LatencyTracker) Average(period time.Duration) (time.Duration, bool) {
-	stamp := time.Now()
+	stamp := lt.now()
 	lt.RLock()
 	defer lt.RUnlock()
 
@@ -172,3 +190,42 @@ func (lt *LatencyTracker) Average(period time.Duration) (time.Duration, bool) {
 func (lt *LatencyTracker) AverageSTD() (time.Duration, bool) {
 	return lt.Average(lt.cfg.StandardPeriod)
 }
+
+// AverageDecayed gives the average latency of all retained links, where each
+// link is weighted with exponential decay based on its age. In other words, a
+// link that is 'halfLife' old weighs half as much as a link created now, which
+// makes the average more responsive to recent latency than Average.
+//
+// Will return (0, false) if halfLife <= 0.
+func (lt *LatencyTracker) AverageDecayed(halfLife time.Duration) (time.Duration, bool) {
+	if halfLife <= 0 {
+		return 0, false
+	}
+
+	stamp := lt.now()
+	lt.Lock()
+	defer lt.Unlock()
+
+	lt.maintain()
+
+	var weightedWait float64
+	var weightedWaiters float64
+
+	// Traverse and add.
+	current := lt.head
+	for current != nil {
+		age := stamp.Sub(current.created)
+		weight := math.Pow(0.5, float64(age)/float64(halfLife))
+		weightedWait += weight * float64(current.cumulativeLatency)
+		weightedWaiters += weight * float64(current.nWaiters)
+
+		current = current.next
+	}
+
+	// Guard zero div.
+	if weightedWaiters == 0 {
+		return 0, true
+	}
+
+	return time.Duration(weightedWait / weightedWaiters), true
+}
@@ -32,17 +32,19 @@ func TestLatencyTrackerDenseWindow(t *testing.T) {
 	maxChainLinkN := 10
 	minChainLinkSize := time.Millisecond * 5
 
+	clock := NewManualClock(time.Now())
 	lt := LatencyTracker{
 		cfg: NewLatencyTrackerArgs{
 			MaxChainLinkN:    maxChainLinkN,
 			MinChainLinkSize: minChainLinkSize,
+			Clock:            clock,
 		},
 	}
 
 	for i := 0; i < n; i++ {
 		done := lt.RegisterCallback()
 		// NOTE: half.
-		time.Sleep(minChainLinkSize / 2)
+		clock.Advance(minChainLinkSize / 2)
 		done()
 
 		nLinks := latencyTrackerLen(&lt)
@@ -61,17 +63,19 @@ func TestLatencyTrackerSparseWindow(t *testing.T) {
 	maxChainLinkN := 10
 	minChainLinkSize := time.Millisecond * 5
 
+	clock := NewManualClock(time.Now())
 	lt := LatencyTracker{
 		cfg: NewLatencyTrackerArgs{
 			MaxChainLinkN:    maxChainLinkN,
 			MinChainLinkSize: minChainLinkSize,
+			Clock:            clock,
 		},
 	}
 
 	for i := 0; i < n; i++ {
 		done := lt.RegisterCallback()
 		// NOTE: double.
-		time.Sleep(minChainLinkSize * 2)
+		clock.Advance(minChainLinkSize * 2)
 		done()
 
 		nLinks := latencyTrackerLen(&lt)
@@ -123,8 +127,8 @@ func TestLatencyTrackerFuzzedWindow(t *testing.T) {
 
 			done()
 
-			wgFinishline.Done()
 			goroutineFinished <- true
+			wgFinishline.Done()
 		}(i)
 	}
 
@@ -145,15 +149,14 @@ func TestLatencyTrackerFuzzedWindow(t *testing.T) {
 func TestLatencyTrackerAverageCorrectness(t *testing.T) {
 	maxChainLinkN := 100
 	minChainLinkSize := time.Millisecond * 5
+	clock := NewManualClock(time.Now())
 	lt := LatencyTracker{
 		cfg: NewLatencyTrackerArgs{
 			MaxChainLinkN:    maxChainLinkN,
 			MinChainLinkSize: minChainLinkSize,
+			Clock:            clock,
 		},
 	}
-	// Should be fairly high, unless the two variables above are higher (and
-	// test is longer), since there is a lot of measurement overhead.
-	errMargin := minChainLinkSize / 10
 
 	var actualWait time.Duration
 
@@ -167,41 +170,34 @@ func TestLatencyTrackerAverageCorrectness(t *testing.T) {
 		actualWait += waitTime
 
 		done := lt.RegisterCallback()
-		time.Sleep(waitTime)
+		clock.Advance(waitTime)
 		done()
 	}
 
+	// No measurement overhead with the manual clock, i.e the average is exact.
 	actualAverage := actualWait / time.Duration(maxChainLinkN)
 	estimatedAverage, _ := lt.Average(time.Duration(maxChainLinkN) * minChainLinkSize)
-	diff := actualAverage - estimatedAverage
-	// Absolute.
-	if diff < 0 {
-		diff = diff * -1
-	}
-
-	withinMargin := diff < errMargin
-	if !withinMargin {
+	if actualAverage != estimatedAverage {
 		t.Fatalf("fail. actual: %v, estimate: %v", actualAverage, estimatedAverage)
 	}
 }
 
 // Basically same as the TestLatencyTrackerAverageCorrectness test, just in a
-// concurrent environment.
+// concurrent environment, where the clock is advanced while registering.
 func TestLatencyTrackerAverageCorrectnessFuzzed(t *testing.T) {
 	maxChainLinkN := 10
 	minChainLinkSize := time.Millisecond * 5
+	clock := NewManualClock(time.Now())
 	lt := LatencyTracker{
 		cfg: NewLatencyTrackerArgs{
 			MaxChainLinkN:    maxChainLinkN,
 			MinChainLinkSize: minChainLinkSize,
+			Clock:            clock,
 		},
 	}
 
-	errMargin := minChainLinkSize / 20
-
 	// Used for preventing goroutines from doing anything before all of
-	// them have started, for the purpose of factoring out the the startup
-	// overhead time.
+	// them have started.
 	nGoroutines := 1000
 	wgStartline := sync.WaitGroup{}
 	wgStartline.Add(nGoroutines)
@@ -220,25 +216,21 @@ func TestLatencyTrackerAverageCorrectnessFuzzed(t *testing.T) {
 
 			defer wgFinishline.Done()
 
-			// Spread goroutines over half the linked list capacity.
-			if i > 0 { // Guard div by zero.
-				max := time.Duration(maxChainLinkN) * minChainLinkSize / 2
-				step := max / time.Duration(nGoroutines)
-				time.Sleep(step * time.Duration(i))
-			}
-
 			// Wait on average half a link size.
 			waitTime := time.Duration(rand.Int63n(int64(minChainLinkSize)))
-			//waitTime := minChainLinkSize
 			actualWaitChan <- waitTime
-
-			done := lt.RegisterCallback()
-			time.Sleep(waitTime)
-			done()
+			lt.Register(waitTime)
 		}(i)
 	}
 
-	go func() { wgFinishline.Wait(); close(actualWaitChan) }()
+	// Spread registrations over (at most) half the linked list capacity.
+	done := make(chan struct{})
+	go func() { wgFinishline.Wait(); close(actualWaitChan); close(done) }()
+	max := time.Duration(maxChainLinkN) * minChainLinkSize / 2
+	for elapsed := time.Duration(0); elapsed < max; elapsed += time.Millisecond {
+		clock.Advance(time.Millisecond)
+	}
+	<-done
 
 	// Collect.
 	var actualWait time.Duration
@@ -249,14 +241,140 @@ func TestLatencyTrackerAverageCorrectnessFuzzed(t *testing.T) {
 	// Check diff.
 	actualAverage := actualWait / time.Duration(nGoroutines)
 	estimatedAverage, _ := lt.Average(time.Duration(maxChainLinkN) * minChainLinkSize)
-	diff := actualAverage - estimatedAverage
-	// Absolute.
-	if diff < 0 {
-		diff = diff * -1
+	if actualAverage != estimatedAverage {
+		t.Fatalf("fail. actual: %v, estimate: %v", actualAverage, estimatedAverage)
 	}
+}
 
-	withinMargin := diff < errMargin
-	if !withinMargin {
-		t.Fatalf("fail. actual: %v, estimate: %v", actualAverage, estimatedAverage)
+// Tests bucket (link) rollover and averages over periods with a manual clock,
+// i.e without any sleeping.
+func TestLatencyTrackerManualClock(t *testing.T) {
+	// Starts at a link boundary, see NewLatencyTrackerArgs.MinChainLinkSize.
+	clock := NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	lt, ok := NewLatencyTracker(NewLatencyTrackerArgs{
+		MaxChainLinkN:    3,
+		MinChainLinkSize: time.Second,
+		Clock:            clock,
+	})
+	if !ok {
+		t.Fatal("unexpected not-ok setup")
+	}
+
+	// Layout after this: [now: 30ms]-[now-1s: 10ms, 20ms].
+	lt.Register(time.Millisecond * 10)
+	clock.Advance(time.Millisecond * 500)
+	lt.Register(time.Millisecond * 20)
+	if n := latencyTrackerLen(lt); n != 1 {
+		t.Fatalf("unexpected rollover before the link size: %v links", n)
+	}
+	clock.Advance(time.Millisecond * 500)
+	done := lt.RegisterCallback()
+	clock.Advance(time.Millisecond * 30)
+	done()
+	if n := latencyTrackerLen(lt); n != 2 {
+		t.Fatalf("unexpected number of links after rollover: %v", n)
+	}
+
+	if avg, _ := lt.Average(time.Millisecond * 100); avg != time.Millisecond*30 {
+		t.Fatalf("unexpected average of the last link: %v", avg)
+	}
+	if avg, ok := lt.Average(time.Second * 2); avg != time.Millisecond*20 || !ok {
+		t.Fatalf("unexpected average of all links: %v, %v", avg, ok)
+	}
+
+	// Old links are trimmed, while the period exceeds the tracked window.
+	clock.Advance(time.Second * 10)
+	lt.Register(time.Millisecond)
+	if n := latencyTrackerLen(lt); n != 3 {
+		t.Fatalf("unexpected number of links after trimming: %v", n)
+	}
+	if avg, ok := lt.Average(time.Second * 5); avg != time.Millisecond || ok {
+		t.Fatalf("unexpected average after trimming: %v, %v", avg, ok)
+	}
+}
+
+// Tests that links start at multiples of the link size rather than when the
+// first latency is registered, such that a fixed sequence of registrations
+// under a manual clock always ends up in the same links.
+func TestLatencyTrackerBucketBoundaries(t *testing.T) {
+	size := time.Millisecond * 100
+	epoch := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(epoch)
+	lt, ok := NewLatencyTracker(NewLatencyTrackerArgs{
+		MaxChainLinkN:    10,
+		MinChainLinkSize: size,
+		Clock:            clock,
+	})
+	if !ok {
+		t.Fatal("unexpected not-ok setup")
+	}
+
+	// Offsets (in ms) from epoch of each registration.
+	for _, offset := range []int{50, 99, 100, 150, 199, 420, 430} {
+		clock.Set(epoch.Add(time.Millisecond * time.Duration(offset)))
+		lt.Register(time.Millisecond)
+	}
+
+	// Oldest first.
+	wantCreated := []time.Time{epoch, epoch.Add(size), epoch.Add(size * 4)}
+	wantCounts := []int{2, 3, 2}
+	haveCreated := make([]time.Time, 0)
+	haveCounts := make([]int, 0)
+	for current := lt.head; current != nil; current = current.next {
+		haveCreated = append([]time.Time{current.created}, haveCreated...)
+		haveCounts = append([]int{current.nWaiters}, haveCounts...)
+	}
+
+	if len(haveCounts) != len(wantCounts) {
+		t.Fatalf("unexpected links; want counts %v, have %v", wantCounts, haveCounts)
+	}
+	for i := range wantCounts {
+		if !haveCreated[i].Equal(wantCreated[i]) || haveCounts[i] != wantCounts[i] {
+			s := "link %v: want created %v with count %v, have %v with count %v"
+			t.Fatalf(s, i, wantCreated[i], wantCounts[i], haveCreated[i], haveCounts[i])
+		}
+	}
+}
+
+// Tests that a recent latency spike is reflected more in the decayed average
+// than in the plain average.
+func TestLatencyTrackerAverageDecayed(t *testing.T) {
+	now := time.Now()
+	lt := LatencyTracker{
+		cfg: NewLatencyTrackerArgs{
+			MaxChainLinkN:    10,
+			MinChainLinkSize: time.Hour, // No new links during the test.
+		},
+	}
+
+	// Layout: [now: 1x100ms]-[now-1s: 9x1ms].
+	lt.head = &latencyTrackerItem{
+		created:           now,
+		cumulativeLatency: time.Millisecond * 100,
+		nWaiters:          1,
+		next: &latencyTrackerItem{
+			created:           now.Add(-time.Second),
+			cumulativeLatency: time.Millisecond * 9,
+			nWaiters:          9,
+		},
+	}
+
+	plain, _ := lt.Average(time.Second * 2)
+	decayed, ok := lt.AverageDecayed(time.Millisecond * 100)
+	if !ok {
+		t.Fatal("unexpected not-ok")
+	}
+
+	// Plain: (100+9)/10 = 10.9ms. Decayed: the old link has a weight of about
+	// 0.5^10, so the average should be close to the spike.
+	if decayed <= plain {
+		t.Fatalf("decayed average (%v) not above plain average (%v)", decayed, plain)
+	}
+	if decayed < time.Millisecond*90 {
+		t.Fatalf("decayed average does not reflect the spike: %v", decayed)
+	}
+
+	if _, ok := lt.AverageDecayed(0); ok {
+		t.Fatal("unexpected ok with a halfLife of 0")
 	}
 }
@@ -2,9 +2,14 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/crunchypi/ddrop/service/ops"
 )
 
 // StartServerArgs is intended as args for func StartServer. Check if it's set
@@ -19,6 +24,31 @@ type StartServerArgs struct {
 	ReadTimeout time.Duration
 	// WriteTimeout is the write timeout for this http server.
 	WriteTimeout time.Duration
+	// HandlerTimeout is optional (disabled with 0). It bounds the total time
+	// spent handling a single request (e.g a KNN fan-out to rpc addrs), as
+	// opposed to ReadTimeout/WriteTimeout which only bound socket IO. Requests
+	// that exceed it get a 503 (Service Unavailable) response, and the context
+	// of the request is cancelled. This is unrelated to the TTL of KNN queries.
+	HandlerTimeout time.Duration
+	// IdleTimeout is optional, it is the max time to wait for the next request
+	// on a keep-alive connection. 0 defaults to ReadTimeout, as with the field
+	// of the same name in http.Server.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes is optional, it is the max size of request headers. 0
+	// defaults to http.DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxConns is optional (disabled with 0). If set, it is the max amount of
+	// simultaneous connections. Additional connections are queued, i.e they
+	// are not accepted until another one is closed. Note that idle keep-alive
+	// connections count as well, until they time out (see IdleTimeout).
+	MaxConns int
+	// MaxKNNRespBytes is optional (disabled with 0). If set, it caps the size of
+	// the payload of "/cmd/knn" responses, as encoded with json (excluding the
+	// envelope). Results that do not fit are dropped, worst first (see
+	// truncateKNNResps), and the results of the affected query vecs are
+	// flagged as truncated. This protects clients from huge responses, e.g
+	// with a large "k" and high-dimensional vecs.
+	MaxKNNRespBytes int
 
 	// OnStart is called in a new goroutine right after the server starts
 	// listening successfully. This is intended to work with a sync.WaitGroup.
@@ -36,40 +66,97 @@ type StartServerArgs struct {
 	// calling /service/ops/Client.Ping and is as such costly network calls.
 	// Note that adding these addrs is done with endpoint ip:port/ops/addrs/put.
 	UpdateFrequencyAddrSet time.Duration
+	// AddrSetFailThreshold is the number of consecutive failed pings (one per
+	// UpdateFrequencyAddrSet) before an rpc addr is evicted from the set of
+	// rpc addrs. Defaults to 1 if < 1, i.e evict on first failure.
+	AddrSetFailThreshold int
+	// ClientFailureCooldown is optional (disabled with 0). If set, rpc addrs
+	// that fail are skipped for this long in KNN and info calls, instead of
+	// waiting for them to time out again. See ops.FailureTracker.
+	ClientFailureCooldown time.Duration
+	// ClientCircuitBreaker is optional (disabled with the zero value). If set,
+	// calls to rpc addrs fail fast after the configured amount of consecutive
+	// failures, see ops.CircuitBreaker.
+	ClientCircuitBreaker ops.NewCircuitBreakerArgs
+
+	// RPCServerStart is an optional json cfg for an rpc server which will be
+	// started along with this http server, such that a node comes up fully
+	// operational. The format is the same as used with the endpoint
+	// ip:port/ops/rpc/server/start. Ignored if empty.
+	RPCServerStart []byte
+	// Peers is an optional seed list of addrs of other http servers (of this
+	// pkg). The set of rpc addrs is periodically exchanged with them (at the
+	// UpdateFrequencyAddrSet interval), such that a cluster forms itself
+	// without manual calls to the endpoint ip:port/ops/rpc/addrs/put.
+	Peers []string
+	// ShutdownGrace is optional (disabled with 0). If set, the server drains
+	// when Ctx is done, instead of stopping abruptly: it stops accepting new
+	// requests, asks the Peers to remove the rpc addr of this node (with
+	// the endpoint ip:port/ops/rpc/addrs/remove), and waits up to this long
+	// for in-flight requests to finish. The rpc server is kept running until
+	// then, such that in-flight requests to it can finish as well.
+	ShutdownGrace time.Duration
 }
 
 // Ok returns true if all the minimum requirements are met, specifically:
 // - args.Ctx != nil
 // - args.ReadTimeout > 0
 // - args.WriteTimeout > 0
+// - args.HandlerTimeout >= 0
+// - args.IdleTimeout >= 0
+// - args.MaxHeaderBytes >= 0
+// - args.MaxConns >= 0
+// - args.MaxKNNRespBytes >= 0
 // - args.UpdateFrequencyAddrSet > 0
+// - args.ShutdownGrace >= 0
 func (args *StartServerArgs) Ok() bool {
 	ok := true
 	ok = ok && args.Ctx != nil
 	ok = ok && args.ReadTimeout > 0
 	ok = ok && args.WriteTimeout > 0
+	ok = ok && args.HandlerTimeout >= 0
+	ok = ok && args.IdleTimeout >= 0
+	ok = ok && args.MaxHeaderBytes >= 0
+	ok = ok && args.MaxConns >= 0
+	ok = ok && args.MaxKNNRespBytes >= 0
 	ok = ok && args.UpdateFrequencyAddrSet > 0
+	ok = ok && args.ShutdownGrace >= 0
 	return ok
 }
 
 // StartServer starts the http server in this pkg, see docs of StartServerArgs
 // for details about configuration. This has a few fail cases:
 // - (false, nil) if args.Ok() == false.
+// - (false, err) if args.RPCServerStart is set but can't be decoded.
 // - (false, err) if net.Listen(...) fails. This might be caused by for example
 //   an args.Addr that is formatted madly or is simply in use (i.e port).
+// - (true, err) if args.RPCServerStart is set but the rpc server could not be
+//   started. The http server is shut down in this case.
 // - (true, err) if http.Server.Serve(...) returns false after start.
 // - (true,  ? ) if args.Ctx is done. The unknown/potential err will be from
-//   Server.Shutdown(...).
+//   Server.Shutdown(...), which is context.DeadlineExceeded if in-flight
+//   requests did not finish within args.ShutdownGrace.
 func StartServer(args StartServerArgs) (bool, error) {
 	if !args.Ok() {
 		return false, nil
 	}
 
+	// Decode rpc server cfg early, no need to start anything if it's invalid.
+	var rpcCfg *rpcServerStartArgs
+	if len(args.RPCServerStart) > 0 {
+		if err := json.Unmarshal(args.RPCServerStart, &rpcCfg); err != nil {
+			return false, fmt.Errorf("could not decode rpc server cfg: %w", err)
+		}
+	}
+
 	// Start listener.
 	l, err := net.Listen("tcp", args.Addr)
 	if err != nil {
 		return false, err
 	}
+	if args.MaxConns > 0 {
+		l = newLimitListener(l, args.MaxConns)
+	}
 
 	// Signal started.
 	if args.OnStart != nil {
@@ -79,10 +166,12 @@ func StartServer(args StartServerArgs) (bool, error) {
 	// Setup server.
 	mux := http.NewServeMux()
 	srv := &http.Server{
-		Addr:         args.Addr,
-		Handler:      mux,
-		ReadTimeout:  args.ReadTimeout,
-		WriteTimeout: args.WriteTimeout,
+		Addr:           args.Addr,
+		Handler:        withHandlerTimeout(mux, args.HandlerTimeout),
+		ReadTimeout:    args.ReadTimeout,
+		WriteTimeout:   args.WriteTimeout,
+		IdleTimeout:    args.IdleTimeout,
+		MaxHeaderBytes: args.MaxHeaderBytes,
 	}
 
 	chErr := make(chan error)
@@ -91,16 +180,39 @@ func StartServer(args StartServerArgs) (bool, error) {
 		close(chErr)
 	}()
 
+	// The handle (and the rpc server it starts) outlives args.Ctx while the
+	// server drains, see StartServerArgs.ShutdownGrace.
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
 	// Setup handle and routes.
 	h := handle{
-		ctx: args.Ctx,
+		ctx: ctx,
 		addrSet: addrSet{
 			_addrs:          make(map[string]bool),
+			_fails:          make(map[string]int),
 			updateFrequency: args.UpdateFrequencyAddrSet,
+			failThreshold:   args.AddrSetFailThreshold,
 		},
+		peers:           args.Peers,
+		maxKNNRespBytes: args.MaxKNNRespBytes,
 	}
+	h.failures, _ = ops.NewFailureTracker(args.ClientFailureCooldown)
+	h.breaker, _ = ops.NewCircuitBreaker(args.ClientCircuitBreaker)
 	h.registerRoutes(mux)
 
+	if rpcCfg != nil {
+		if _, err := h.rpcServerStart(*rpcCfg); err != nil {
+			srv.Shutdown(context.Background())
+			return true, fmt.Errorf("could not start rpc server: %w", err)
+		}
+	}
+	gossipDone := make(chan struct{})
+	go func() {
+		defer close(gossipDone)
+		h.gossipLoop(args.Ctx.Done())
+	}()
+
 	// Give handle to testing.
 	if args.onRunning != nil {
 		go args.onRunning(&h)
@@ -111,6 +223,80 @@ func StartServer(args StartServerArgs) (bool, error) {
 	case err := <-chErr:
 		return true, err
 	case <-args.Ctx.Done():
+	}
+
+	if args.ShutdownGrace == 0 {
+		ctxCancel()
 		return true, srv.Shutdown(context.Background())
 	}
+
+	// Drain. Shutdown stops accepting new requests right away, while peers are
+	// notified. Gossip must be stopped first, or it might add the addr back.
+	shutdownCtx, shutdownCancel := context.WithTimeout(
+		context.Background(),
+		args.ShutdownGrace,
+	)
+	defer shutdownCancel()
+
+	chShutdown := make(chan error, 1)
+	go func() { chShutdown <- srv.Shutdown(shutdownCtx) }()
+	<-gossipDone
+	h.deregister()
+	return true, <-chShutdown
+}
+
+// limitListener is a net.Listener which accepts at most cap(sem) simultaneous
+// connections, see StartServerArgs.MaxConns. Accept blocks while the limit is
+// reached, until a connection is closed (or the listener is).
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newLimitListener wraps 'l' with a limitListener, where 'n' is the limit.
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for a free slot, then for the next connection.
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+// Close closes the underlying listener and unblocks waiting Accept calls.
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitListenerConn releases its slot in a limitListener once it is closed.
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+// Close closes the connection and releases its slot.
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
 }
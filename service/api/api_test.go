@@ -1,7 +1,19 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -111,6 +123,50 @@ func TestRPCAddrsGet(t *testing.T) {
 	}
 }
 
+func TestRPCAddrsRemove(t *testing.T) {
+	tNode := newTestNode(t)
+	defer tNode.stopF()
+	url := "http://localhost" + tNode.addrAPI + "/ops/rpc/addrs/remove"
+
+	tNode.handle.addrSet.addrsMaintanedLocked("a", "b")
+	r, err := post[[]string](url, []string{"a", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0] != "b" {
+		t.Fatal("got unexpected addr result:", r)
+	}
+}
+
+func TestAddrSetFailThreshold(t *testing.T) {
+	tNode := newTestNode(t)
+	defer tNode.stopF()
+	if err := tNode.startRPC(); err != nil {
+		t.Fatal(err)
+	}
+
+	threshold := 3
+	freq := time.Millisecond * 10
+	tNode.handle.addrSet.mx.Lock()
+	tNode.handle.addrSet.failThreshold = threshold
+	tNode.handle.addrSet.updateFrequency = freq
+	tNode.handle.addrSet.mx.Unlock()
+
+	// Stop the rpc server, pings will fail from here.
+	tNode.handle.rpcServerWrap.inner.serverStopF()
+
+	for cycle := 1; cycle <= threshold; cycle++ {
+		time.Sleep(freq * 2)
+		addrs := tNode.handle.addrSet.addrsMaintanedLocked()
+		if cycle < threshold && len(addrs) != 1 {
+			t.Fatalf("addr evicted after %v failures, want %v", cycle, threshold)
+		}
+		if cycle == threshold && len(addrs) != 0 {
+			t.Fatalf("addr not evicted after %v failures: %v", cycle, addrs)
+		}
+	}
+}
+
 func TestRPCServerStop(t *testing.T) {
 	addrAPI := freeLocalNoFail(t)
 	addrRPC := freeLocalNoFail(t)
@@ -240,6 +296,276 @@ func TestRPCServerStart(t *testing.T) {
 	}
 }
 
+func TestPeersGossip(t *testing.T) {
+	// Each node has the other as a seed.
+	nodes := newGossipNodes(t, [][]int{{1}, {0}})
+	defer nodes.stop()
+
+	for _, n := range nodes.nodes {
+		if !nodes.waitForAddrs(n, len(nodes.nodes)) {
+			t.Fatal("node got unexpected addrs:", n.handle.addrSet.addrsMaintanedLocked())
+		}
+	}
+}
+
+func TestPeersGossipTransitive(t *testing.T) {
+	// Chain: A knows B, B knows C, C knows nobody.
+	nodes := newGossipNodes(t, [][]int{{1}, {2}, {}})
+	defer nodes.stop()
+
+	a, c := nodes.nodes[0], nodes.nodes[2]
+	if !nodes.waitForAddrs(a, 3) {
+		t.Fatal("A got unexpected addrs:", a.handle.addrSet.addrsMaintanedLocked())
+	}
+	// C learns about the rest through pushes.
+	if !nodes.waitForAddrs(c, 3) {
+		t.Fatal("C got unexpected addrs:", c.handle.addrSet.addrsMaintanedLocked())
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	// B is a plain node, which A (draining) has as a peer.
+	b := newTestNode(t)
+	defer b.stopF()
+	if err := b.startRPC(); err != nil {
+		t.Fatal("could not start rpc server:", err)
+	}
+
+	a := testNode{addrAPI: freeLocalNoFail(t), addrRPC: freeLocalNoFail(t)}
+	rpcCfg, err := json.Marshal(rpcServerStartArgs{
+		Addr: a.addrRPC,
+		Cfg:  newTestRequestManagerHandleArgs(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	chStopped := make(chan error, 1)
+	go func() {
+		_, err := StartServer(StartServerArgs{
+			Addr:         a.addrAPI,
+			Ctx:          ctx,
+			ReadTimeout:  time.Minute,
+			WriteTimeout: time.Minute,
+			// Long, such that gossip and pings are only done on startup.
+			UpdateFrequencyAddrSet: time.Minute,
+			RPCServerStart:         rpcCfg,
+			Peers:                  []string{"localhost" + b.addrAPI},
+			ShutdownGrace:          time.Second * 5,
+			onRunning:              func(h *handle) { a.handle = h; wg.Done() },
+		})
+		chStopped <- err
+	}()
+	wg.Wait()
+
+	// hasAddr checks if the addrSet of B has the rpc addr of A.
+	hasAddr := func() bool {
+		for _, addr := range b.handle.addrSet.addrsMaintanedLocked() {
+			if addr == a.addrRPC {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; !hasAddr(); i++ {
+		if i == 100 {
+			t.Fatal("B did not learn the rpc addr of A")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// A slow rpc addr, which makes a /cmd/ping request to A stay in-flight
+	// until the conn is closed.
+	delay := time.Millisecond * 500
+	l, err := net.Listen("tcp", freeLocalNoFail(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- struct{}{}
+		time.Sleep(delay)
+		conn.Close()
+	}()
+	a.handle.addrSet.addrsMaintanedLocked(l.Addr().String())
+
+	type T = []clientResult[bool]
+	chResp := make(chan envelope[T], 1)
+	go func() {
+		env, err := postEnvelope[T]("http://localhost"+a.addrAPI+"/cmd/ping", struct{}{})
+		if err != nil {
+			env.Error = err.Error()
+		}
+		chResp <- env
+	}()
+
+	// Signal shutdown while the request is in-flight.
+	<-accepted
+	ctxCancel()
+
+	// Peer is notified while draining.
+	for i := 0; hasAddr(); i++ {
+		if i == 100 {
+			t.Fatal("A was not removed from the addrSet of B")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	env := <-chResp
+	if env.Code != http.StatusOK || len(env.Data) != 3 {
+		t.Fatalf("in-flight request did not complete: %+v", env)
+	}
+	select {
+	case err := <-chStopped:
+		if err != nil {
+			t.Fatal("unexpected err on shutdown:", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server did not stop within the grace period")
+	}
+
+	// Not accepting new requests.
+	if _, err := post[bool]("http://localhost"+a.addrAPI+"/ping", struct{}{}); err == nil {
+		t.Fatal("unexpected ok request after shutdown")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	addr := freeLocalNoFail(t)
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	timeout := time.Millisecond * 200
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var h *handle
+	go StartServer(StartServerArgs{
+		Addr:                   addr,
+		Ctx:                    ctx,
+		ReadTimeout:            time.Minute,
+		WriteTimeout:           time.Minute,
+		HandlerTimeout:         timeout,
+		UpdateFrequencyAddrSet: time.Minute,
+		onRunning:              func(_h *handle) { h = _h; wg.Done() },
+	})
+	wg.Wait()
+
+	// A slow rpc addr, which makes the /cmd/ping handler slow.
+	l, err := net.Listen("tcp", freeLocalNoFail(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Second * 2)
+		conn.Close()
+	}()
+	h.addrSet.addrsMaintanedLocked(l.Addr().String())
+
+	start := time.Now()
+	resp, err := http.Post("http://localhost"+addr+"/cmd/ping", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	elapsed := time.Since(start)
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status code:", resp.StatusCode)
+	}
+	if elapsed < timeout || elapsed > time.Second {
+		t.Fatalf("handler was not cut off at %v, took %v", timeout, elapsed)
+	}
+	env := envelope[any]{}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal("could not decode timeout response:", err)
+	}
+	if env.Code != http.StatusServiceUnavailable || env.Error == "" {
+		t.Fatalf("unexpected timeout response: %+v", env)
+	}
+
+	// Fast handlers are not affected.
+	if _, err := post[bool]("http://localhost"+addr+"/ping", struct{}{}); err != nil {
+		t.Fatal("unexpected err for a fast handler:", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := freeLocalNoFail(t)
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go StartServer(StartServerArgs{
+		Addr:                   addr,
+		Ctx:                    ctx,
+		ReadTimeout:            time.Minute,
+		WriteTimeout:           time.Minute,
+		IdleTimeout:            time.Minute,
+		MaxHeaderBytes:         1 << 16,
+		MaxConns:               1,
+		UpdateFrequencyAddrSet: time.Minute,
+		onRunning:              func(_ *handle) { wg.Done() },
+	})
+	wg.Wait()
+
+	// No keep-alive, such that requests do not hold on to the only slot.
+	client := http.Client{
+		Timeout:   time.Millisecond * 300,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	ping := func() error {
+		resp, err := client.Post("http://localhost"+addr+"/ping", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if err := ping(); err != nil {
+		t.Fatal("unexpected err below the limit:", err)
+	}
+
+	// Idle connection which takes the only slot.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(); err == nil {
+		t.Fatal("request was not queued at the limit")
+	}
+
+	conn.Close()
+	if err := ping(); err != nil {
+		t.Fatal("unexpected err after a slot was freed:", err)
+	}
+
+	args := StartServerArgs{
+		Ctx:                    ctx,
+		ReadTimeout:            time.Minute,
+		WriteTimeout:           time.Minute,
+		UpdateFrequencyAddrSet: time.Minute,
+		MaxConns:               -1,
+	}
+	if args.Ok() {
+		t.Fatal("args with negative MaxConns are ok")
+	}
+}
+
 func TestRPCPing(t *testing.T) {
 	nNodes := 3
 	url := func(addr string) string {
@@ -262,6 +588,28 @@ func TestRPCPing(t *testing.T) {
 	})
 }
 
+func TestRPCPingNetErr(t *testing.T) {
+	tNode := newTestNode(t)
+	defer tNode.stopF()
+	url := "http://localhost" + tNode.addrAPI + "/cmd/ping"
+
+	// Nothing listens on the rpc addr, as the rpc server is not started.
+	tNode.handle.addrSet.addrsMaintanedLocked(tNode.addrRPC)
+
+	// Checked as raw json too, errors would otherwise be marshalled as {}.
+	r, err := post[[]map[string]any](url, struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 {
+		t.Fatal("unexpected resp len:", len(r))
+	}
+	netErr, ok := r[0]["netErr"].(string)
+	if !ok || netErr == "" {
+		t.Fatalf("want a readable netErr string, have %#v", r[0]["netErr"])
+	}
+}
+
 func TestRPCAddData(t *testing.T) {
 	nNodes := 3
 	url := func(addr string) string {
@@ -274,31 +622,143 @@ func TestRPCAddData(t *testing.T) {
 			{Namespace: "", Vec: []float64{1}, Data: []byte{}},
 		}
 
-		r, err := post[[]clientResult[[]bool]](url, opts)
+		r, err := post[addDataResp](url, opts)
 		if err != nil {
 			t.Fatal("issue sending/receiving:", err)
 		}
 
-		if r == nil || len(r) == 0 {
-			t.Fatal("empty response")
-		}
 		// opts.Clients.AddData adds all data to a single node.
-		if r[0].Payload == nil {
-			t.Fatal("empty payload")
+		if r.RemoteAddr == "" || r.NetErr != "" {
+			t.Fatalf("unexpected node in response: %+v", r)
 		}
-		if len(r[0].Payload) != 1 {
-			t.Fatal("unexpected amt. for responses:", len(r[0].Payload))
+		if len(r.Statuses) != 1 {
+			t.Fatal("unexpected amt. for statuses:", len(r.Statuses))
 		}
-		for _, cliResp := range r {
-			for _, okBool := range cliResp.Payload {
-				if !okBool {
-					t.Fatal("unexpected not-ok")
+		if r.Statuses[0] != addDataStatusSuccess || r.Succeeded != 1 || r.Failed != 0 {
+			t.Fatalf("unexpected not-ok: %+v", r)
+		}
+	})
+}
+
+func TestRPCDeleteOlderThan(t *testing.T) {
+	nNodes := 3
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/cmd/delete"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+		ns := "test"
+		tn.fill(ns, 4, 3)
+		time.Sleep(time.Millisecond * 100)
+
+		opts := deleteOlderThanArgs{Namespace: ns, OlderThan: time.Millisecond * 50}
+		for _, want := range []int{4, 0} {
+			r, err := post[[]clientResult[int]](url, opts)
+			if err != nil {
+				t.Fatal("issue sending/receiving:", err)
+			}
+			if len(r) != nNodes {
+				t.Fatal("unexpected amt. of results:", len(r))
+			}
+			for _, result := range r {
+				if result.NetErr != "" || result.Payload != want {
+					t.Fatalf("want %v deleted, have %+v", want, result)
 				}
 			}
 		}
 	})
 }
 
+func TestRPCGetVector(t *testing.T) {
+	nNodes := 2
+	url := func(addr string, path string) string {
+		return "http://localhost" + addr + path
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		addr := tn.nodes[0].addrAPI
+		vec := []float64{1, 2, 3}
+		add := []addDataArgs{{Namespace: "test", Vec: vec, Data: []byte("payload"), ID: "a"}}
+		if r, err := post[addDataResp](url(addr, "/cmd/add"), add); err != nil || r.Succeeded != 1 {
+			t.Fatalf("could not add data: %+v, %v", r, err)
+		}
+
+		r, err := post[[]clientResult[getVectorResp]](url(addr, "/data/get"), getVectorArgs{"test", "a"})
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if len(r) != nNodes {
+			t.Fatal("unexpected amt. of results:", len(r))
+		}
+		// Data is added to a single node.
+		nFound := 0
+		for _, result := range r {
+			if !result.Payload.Found {
+				continue
+			}
+			nFound++
+			payload := result.Payload
+			if !reflect.DeepEqual(payload.Vec, vec) || string(payload.Data) != "payload" {
+				t.Fatalf("unexpected vec: %+v", payload)
+			}
+			if payload.ID != "a" || payload.Added == nil || payload.Expires != nil {
+				t.Fatalf("unexpected metadata: %+v", payload)
+			}
+		}
+		if nFound != 1 {
+			t.Fatalf("vec was found on %v nodes", nFound)
+		}
+
+		env, err := postEnvelope[[]clientResult[getVectorResp]](url(addr, "/data/get"), getVectorArgs{"test", "b"})
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if env.Code != http.StatusNotFound || len(env.Data) != nNodes {
+			t.Fatalf("unexpected response for a missing vec: %+v", env)
+		}
+	})
+}
+
+func TestRPCAddDataStatuses(t *testing.T) {
+	nNodes := 3
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/cmd/add"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		// All items go to the same node, where the first sets the dim.
+		opts := []addDataArgs{
+			{Namespace: "test", Vec: []float64{1, 1, 1}},
+			{Namespace: "test", Vec: []float64{1, 1}},
+			{Namespace: "test", Vec: []float64{2, 2, 2}},
+			{Namespace: "test", Vec: []float64{}},
+		}
+
+		r, err := post[addDataResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+
+		want := []addDataStatus{
+			addDataStatusSuccess,
+			addDataStatusDimMismatch,
+			addDataStatusSuccess,
+			addDataStatusInvalidVec,
+		}
+		if len(r.Statuses) != len(want) {
+			t.Fatalf("want %v statuses, have %v", len(want), len(r.Statuses))
+		}
+		for i := range want {
+			if r.Statuses[i] != want[i] {
+				t.Fatalf("want status %v for item %v, have %v", want[i], i, r.Statuses[i])
+			}
+		}
+		if r.Succeeded != 2 || r.Failed != 2 {
+			t.Fatalf("unexpected summary: %v succeeded, %v failed", r.Succeeded, r.Failed)
+		}
+	})
+}
+
 func TestRPCKNN(t *testing.T) {
 	nNodes := 3
 	url := func(addr string) string {
@@ -356,84 +816,535 @@ func TestRPCKNN(t *testing.T) {
 	})
 }
 
-func TestSSpaceNamespaces(t *testing.T) {
-	nNodes := 2
+func TestRPCKNNFurthest(t *testing.T) {
 	url := func(addr string) string {
-		return "http://localhost" + addr + "/info/namespaces"
+		return "http://localhost" + addr + "/cmd/knn"
 	}
-	withNetwork(t, nNodes, func(tn *testNetwork) {
+	withNetwork(t, 1, func(tn *testNetwork) {
 		url := url(tn.nodes[0].addrAPI)
 
 		namespace := "test"
-		tn.fill(namespace, 1, 1)
+		dim := 3
+		n := 20
+		k := 3
+		tn.fill(namespace, n, dim)
+		v, _ := randFloat64Slice(dim)
+
+		// Scores of a query, sorted from nearest to furthest.
+		query := func(method rman.KNNMethod, furthest bool, k int) []float64 {
+			// Never accept early and never reject, regardless of ordering.
+			accept, reject := 1e9, -1e9
+			if method.Ascending(furthest) {
+				accept, reject = reject, accept
+			}
+			opts := knnArgs{
+				QueryVecs: [][]float64{v},
+				Args: knnArgsPartial{
+					Namespace: namespace,
+					Priority:  1,
+					KNNMethod: method,
+					// Ignored with furthest=true, set for a KNN query.
+					Ascending: method.Ascending(false),
+					K:         k,
+					Extent:    1,
+					Accept:    accept,
+					Reject:    reject,
+					TTL:       time.Hour,
+					Furthest:  furthest,
+				},
+			}
+			r, err := post[[]knnResp](url, opts)
+			if err != nil {
+				t.Fatal("issue sending/receiving:", err)
+			}
+			if len(r) != 1 || len(r[0].Results) != k {
+				t.Fatal("unexpected amt of results")
+			}
 
-		r, err := post[[]clientResult[[]string]](url, struct{}{})
-		if err != nil {
-			t.Fatal("issue sending/receiving:", err)
+			scores := make([]float64, 0, k)
+			for _, rItem := range r[0].Results {
+				scores = append(scores, rItem.Payload.Score)
+			}
+			sort.Slice(scores, func(i, j int) bool {
+				if method.Ascending(false) {
+					return scores[i] < scores[j]
+				}
+				return scores[i] > scores[j]
+			})
+			return scores
 		}
 
-		for _, rItem := range r {
-			if rItem.Payload == nil || len(rItem.Payload) == 0 {
-				t.Fatal("empty result")
-			}
-			if rItem.Payload[0] != namespace {
-				t.Fatal("unexpected result:", rItem.Payload[0])
+		for _, method := range []rman.KNNMethod{
+			rman.KNNMethodCosineSimilarity,
+			rman.KNNMethodEuclideanDistance,
+		} {
+			all := query(method, false, n)
+			furthest := query(method, true, k)
+			for i, score := range furthest {
+				if want := all[n-k+i]; score != want {
+					s := "method %v: unexpected furthest score no. %v: want %v, have %v"
+					t.Fatalf(s, method, i, want, score)
+				}
 			}
 		}
 	})
 }
 
-func TestSSpaceNamespace(t *testing.T) {
-	nNodes := 2
+func TestRPCKNNNormalize(t *testing.T) {
 	url := func(addr string) string {
-		return "http://localhost" + addr + "/info/namespace"
+		return "http://localhost" + addr + "/cmd/knn"
 	}
-	withNetwork(t, nNodes, func(tn *testNetwork) {
+	withNetwork(t, 2, func(tn *testNetwork) {
 		url := url(tn.nodes[0].addrAPI)
 
 		namespace := "test"
-		tn.fill(namespace, 1, 1)
+		dim := 3
+		k := 5
+		tn.fill(namespace, 100, dim)
+		v, _ := randFloat64Slice(dim)
+
+		for _, method := range []rman.KNNMethod{
+			rman.KNNMethodCosineSimilarity,
+			rman.KNNMethodEuclideanDistance,
+		} {
+			// Never accept early and never reject, regardless of ordering.
+			accept, reject := 1e9, -1e9
+			if method.Ascending(false) {
+				accept, reject = reject, accept
+			}
+			opts := knnArgs{
+				QueryVecs: [][]float64{v},
+				Args: knnArgsPartial{
+					Namespace: namespace,
+					Priority:  1,
+					KNNMethod: method,
+					Ascending: method.Ascending(false),
+					K:         k,
+					Extent:    1,
+					Accept:    accept,
+					Reject:    reject,
+					TTL:       time.Hour,
+					Normalize: true,
+				},
+			}
+			r, err := post[[]knnResp](url, opts)
+			if err != nil {
+				t.Fatal("issue sending/receiving:", err)
+			}
+			if len(r) != 1 || len(r[0].Results) != k {
+				t.Fatal("unexpected amt of results")
+			}
 
-		r, err := post[[]clientResult[bool]](url, namespace)
+			results := r[0].Results
+			for i, result := range results {
+				if result.Payload.Rank == nil || *result.Payload.Rank != i {
+					t.Fatalf("method %v: unexpected rank at index %v", method, i)
+				}
+				normScore := result.Payload.NormScore
+				if normScore == nil || *normScore < 0 || *normScore > 1 {
+					t.Fatalf("method %v: unexpected norm score at index %v", method, i)
+				}
+				if i > 0 && *normScore > *results[i-1].Payload.NormScore {
+					t.Fatalf("method %v: norm scores are not ordered at index %v", method, i)
+				}
+			}
+			if *results[0].Payload.NormScore != 1 || *results[k-1].Payload.NormScore != 0 {
+				t.Fatalf("method %v: unexpected norm scores of the best and worst", method)
+			}
+		}
+
+		// Omitted without the option.
+		opts := knnArgs{
+			QueryVecs: [][]float64{v},
+			Args: knnArgsPartial{
+				Namespace: namespace,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodCosineSimilarity,
+				K:         k,
+				Extent:    1,
+				Accept:    1e9,
+				Reject:    -1e9,
+				TTL:       time.Hour,
+			},
+		}
+		r, err := post[[]knnResp](url, opts)
 		if err != nil {
 			t.Fatal("issue sending/receiving:", err)
 		}
-
-		for _, rItem := range r {
-			if !rItem.Payload {
-				t.Fatal("unexpected false response")
-			}
+		if len(r) != 1 || len(r[0].Results) == 0 || r[0].Results[0].Payload.Rank != nil {
+			t.Fatal("unexpected rank without normalize")
 		}
 	})
 }
 
-func TestSSpaceDim(t *testing.T) {
-	nNodes := 2
+func TestRPCKNNSecondarySort(t *testing.T) {
 	url := func(addr string) string {
-		return "http://localhost" + addr + "/info/dim"
+		return "http://localhost" + addr + "/cmd/knn"
 	}
-	withNetwork(t, nNodes, func(tn *testNetwork) {
+	withNetwork(t, 2, func(tn *testNetwork) {
 		url := url(tn.nodes[0].addrAPI)
 
 		namespace := "test"
 		dim := 3
-		tn.fill(namespace, 1, dim)
+		k := 10
+		tn.fill(namespace, 100, dim)
+		v, _ := randFloat64Slice(dim)
+
+		query := func(secondarySort string) []knnRespItem {
+			opts := knnArgs{
+				QueryVecs: [][]float64{v},
+				Args: knnArgsPartial{
+					Namespace:     namespace,
+					Priority:      1,
+					KNNMethod:     rman.KNNMethodCosineSimilarity,
+					K:             k,
+					Extent:        1,
+					Accept:        1e9,
+					Reject:        -1e9,
+					TTL:           time.Hour,
+					Normalize:     true,
+					SecondarySort: secondarySort,
+				},
+			}
+			r, err := post[[]knnResp](url, opts)
+			if err != nil {
+				t.Fatal("issue sending/receiving:", err)
+			}
+			if len(r) != 1 || len(r[0].Results) != k {
+				t.Fatal("unexpected amt of results")
+			}
+			items := make([]knnRespItem, 0, k)
+			for _, result := range r[0].Results {
+				items = append(items, result.Payload)
+			}
+			return items
+		}
 
-		r, err := post[[]clientResult[sSpaceDimResp]](url, namespace)
+		// Same set as without a secondary sort, keyed by the rank (by score).
+		byScore := query("")
+		for _, secondarySort := range []string{"added", "-added"} {
+			items := query(secondarySort)
+			for i, item := range items {
+				if item.Added.IsZero() {
+					t.Fatalf("%v: item %v has no insertion time", secondarySort, i)
+				}
+				want := byScore[*item.Rank]
+				if item.Score != want.Score || !item.Added.Equal(want.Added) {
+					t.Fatalf("%v: item %v is not in the result without sorting", secondarySort, i)
+				}
+				if i == 0 {
+					continue
+				}
+				prev := items[i-1].Added
+				ok := !item.Added.Before(prev)
+				if secondarySort == "-added" {
+					ok = !item.Added.After(prev)
+				}
+				if !ok {
+					t.Fatalf("%v: unexpected order at index %v", secondarySort, i)
+				}
+			}
+		}
+
+		opts := knnArgs{
+			QueryVecs: [][]float64{v},
+			Args:      knnArgsPartial{SecondarySort: "unknown"},
+		}
+		env, err := postEnvelope[[]knnResp](url, opts)
 		if err != nil {
 			t.Fatal("issue sending/receiving:", err)
 		}
-
-		for _, rItem := range r {
-			if rItem.Payload.Dim != dim {
-				t.Fatal("unexpected dim response:", rItem.Payload.Dim)
-			}
+		if env.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status with an unknown secondary sort: %v", env.Code)
 		}
 	})
 }
 
-func TestSSpaceLen(t *testing.T) {
-	nNodes := 2
+func TestRPCKNNRetryAfter(t *testing.T) {
+	node := newTestNode(t)
+	defer node.stopF()
+
+	// Any latency estimate > 0 will exceed the TTL with this admission factor.
+	args := newTestRequestManagerHandleArgs()
+	args.AdmissionFactor = 1e-12
+	if err := node.startRPCWithArgs(args); err != nil {
+		t.Fatal("could not start rpc server:", err)
+	}
+
+	namespace := "test"
+	dim := 3
+	tn := testNetwork{nodes: []testNode{node}}
+	tn.fill(namespace, 100, dim)
+	// The first query is admitted as there are no latency estimates yet.
+	tn.knnFuzz(namespace, 1, dim, 0)
+
+	v, _ := randFloat64Slice(dim)
+	opts := knnArgs{
+		QueryVecs: [][]float64{v},
+		Args: knnArgsPartial{
+			Namespace: namespace,
+			Priority:  1,
+			KNNMethod: rman.KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         1,
+			Extent:    1,
+			Reject:    1,
+			TTL:       time.Minute,
+		},
+	}
+	b, _ := json.Marshal(opts)
+	url := "http://localhost" + node.addrAPI + "/cmd/knn"
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal("issue sending/receiving:", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status code:", resp.StatusCode)
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		t.Fatal("invalid Retry-After header:", err)
+	}
+	// Latency is tiny, so this should be rounded up to the minimum.
+	if secs != 1 {
+		t.Fatal("unexpected Retry-After:", secs)
+	}
+
+	var env envelope[[]knnResp]
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal("could not decode envelope:", err)
+	}
+	if env.Code != http.StatusServiceUnavailable || env.Error == "" {
+		t.Fatalf("unexpected envelope code/error: %v/%q", env.Code, env.Error)
+	}
+	if len(env.Data) != 1 {
+		t.Fatal("unexpected data len:", len(env.Data))
+	}
+}
+
+func TestRPCNoNodes(t *testing.T) {
+	tNode := newTestNode(t)
+	defer tNode.stopF()
+	url := func(path string) string {
+		return "http://localhost" + tNode.addrAPI + path
+	}
+
+	// Add data.
+	envAdd, err := postEnvelope[addDataResp](url("/cmd/add"), []addDataArgs{{Vec: []float64{1}}})
+	if err != nil {
+		t.Fatal("issue sending/receiving:", err)
+	}
+	if envAdd.Code != http.StatusServiceUnavailable || envAdd.Error != msgNoRPCNodes {
+		t.Fatalf("unexpected add envelope code/error: %v/%q", envAdd.Code, envAdd.Error)
+	}
+	r := envAdd.Data
+	if len(r.Statuses) != 1 || r.Statuses[0] != addDataStatusNodeUnreachable || r.Failed != 1 {
+		t.Fatalf("unexpected add resp without rpc nodes: %+v", r)
+	}
+
+	// KNN.
+	opts := knnArgs{
+		QueryVecs: [][]float64{{1}},
+		Args: knnArgsPartial{
+			Namespace: "test",
+			Priority:  1,
+			KNNMethod: rman.KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         1,
+			Extent:    1,
+			TTL:       time.Second,
+		},
+	}
+	envKNN, err := postEnvelope[[]knnResp](url("/cmd/knn"), opts)
+	if err != nil {
+		t.Fatal("issue sending/receiving:", err)
+	}
+	if envKNN.Code != http.StatusServiceUnavailable || envKNN.Error != msgNoRPCNodes {
+		t.Fatalf("unexpected knn envelope code/error: %v/%q", envKNN.Code, envKNN.Error)
+	}
+	if len(envKNN.Data) != 0 {
+		t.Fatal("unexpected knn data len:", len(envKNN.Data))
+	}
+
+	// Consistency check.
+	envCons, err := postEnvelope[consistencyResp](url("/admin/consistency"), nil)
+	if err != nil {
+		t.Fatal("issue sending/receiving:", err)
+	}
+	if envCons.Code != http.StatusServiceUnavailable || envCons.Error != msgNoRPCNodes {
+		t.Fatalf("unexpected consistency envelope code/error: %v/%q", envCons.Code, envCons.Error)
+	}
+}
+
+func TestRPCServerStartFail(t *testing.T) {
+	addrAPI := freeLocalNoFail(t)
+	addrRPC := freeLocalNoFail(t)
+	url := "http://localhost" + addrAPI + "/ops/rpc/server/start"
+
+	ctx, ctxStop := context.WithCancel(context.Background())
+	ok, err := StartServer(StartServerArgs{
+		Addr:                   addrAPI,
+		Ctx:                    ctx,
+		ReadTimeout:            time.Minute,
+		WriteTimeout:           time.Minute,
+		UpdateFrequencyAddrSet: time.Second,
+		onRunning: func(h *handle) {
+			defer ctxStop()
+
+			// Invalid (zero value) cfg.
+			r, err := postEnvelope[status](url, rpcServerStartArgs{Addr: addrRPC})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Code != http.StatusBadRequest {
+				t.Fatal("unexpected code:", r.Code)
+			}
+			if !strings.Contains(r.Error, "invalid rpc server cfg") {
+				t.Fatalf("unexpected error msg: %q", r.Error)
+			}
+
+			// Already running.
+			h.rpcServerWrap.mx.Lock()
+			h.rpcServerWrap.state = rpcServerStateStarted
+			h.rpcServerWrap.mx.Unlock()
+
+			args := newRequestManagerHandleArgs{
+				NewSearchSpacesArgs: newSearchSpacesArgs{
+					SearchSpacesMaxCap:      100,
+					SearchSpacesMaxN:        100,
+					MaintenanceTaskInterval: time.Second,
+				},
+				NewLatencyTrackerArgs: newLatencyTrackerArgs{
+					MaxChainLinkN:    10,
+					MinChainLinkSize: time.Second,
+					StandardPeriod:   time.Second,
+				},
+				KNNQueueBuf:           100,
+				KNNQueueMaxConcurrent: 100,
+				NewKNNMonitorArgs: newLatencyTrackerArgs{
+					MaxChainLinkN:    10,
+					MinChainLinkSize: time.Second,
+					StandardPeriod:   time.Second,
+				},
+			}
+			r, err = postEnvelope[status](url, rpcServerStartArgs{addrRPC, args})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Code != http.StatusConflict {
+				t.Fatal("unexpected code:", r.Code)
+			}
+			if !strings.Contains(r.Error, "started") {
+				t.Fatalf("unexpected error msg: %q", r.Error)
+			}
+			if r.Data.Code != int(rpcServerStateStarted) {
+				t.Fatal("got unexpected state:", r.Data.Msg)
+			}
+
+			// Not decodable.
+			resp, err := http.Post(url, "application/json", strings.NewReader("{"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var env envelope[*status]
+			if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+				t.Fatal("could not decode envelope:", err)
+			}
+			if resp.StatusCode != http.StatusBadRequest || env.Code != resp.StatusCode {
+				t.Fatalf("unexpected codes: %v/%v", resp.StatusCode, env.Code)
+			}
+			if env.Error == "" || env.Data != nil {
+				t.Fatalf("unexpected envelope: %+v", env)
+			}
+		},
+	})
+
+	if !ok || err != nil {
+		t.Fatalf("issue with server, returned bool=%v, err=%v", ok, err)
+	}
+}
+
+func TestSSpaceNamespaces(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/info/namespaces"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		tn.fill(namespace, 1, 1)
+
+		r, err := post[[]clientResult[[]string]](url, struct{}{})
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+
+		for _, rItem := range r {
+			if rItem.Payload == nil || len(rItem.Payload) == 0 {
+				t.Fatal("empty result")
+			}
+			if rItem.Payload[0] != namespace {
+				t.Fatal("unexpected result:", rItem.Payload[0])
+			}
+		}
+	})
+}
+
+func TestSSpaceNamespace(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/info/namespace"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		tn.fill(namespace, 1, 1)
+
+		r, err := post[[]clientResult[bool]](url, namespace)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+
+		for _, rItem := range r {
+			if !rItem.Payload {
+				t.Fatal("unexpected false response")
+			}
+		}
+	})
+}
+
+func TestSSpaceDim(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/info/dim"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		dim := 3
+		tn.fill(namespace, 1, dim)
+
+		r, err := post[[]clientResult[sSpaceDimResp]](url, namespace)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+
+		for _, rItem := range r {
+			if rItem.Payload.Dim != dim {
+				t.Fatal("unexpected dim response:", rItem.Payload.Dim)
+			}
+		}
+	})
+}
+
+func TestSSpaceLen(t *testing.T) {
+	nNodes := 2
 	url := func(addr string) string {
 		return "http://localhost" + addr + "/info/len"
 	}
@@ -483,6 +1394,131 @@ func TestSSpaceCap(t *testing.T) {
 	})
 }
 
+func TestSSpaceBatch(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/info/batch"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		tn.fill("a", 10, 3)
+		tn.fill("b", 20, 5)
+		namespaces := []string{"a", "missing", "b"}
+
+		r, err := post[[]sSpaceBatchResp](url, namespaces)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if len(r) != len(namespaces) {
+			t.Fatal("unexpected resp len:", len(r))
+		}
+
+		for i, tc := range []struct {
+			found bool
+			dim   int
+			nVecs int
+		}{
+			{found: true, dim: 3, nVecs: 10},
+			{found: false},
+			{found: true, dim: 5, nVecs: 20},
+		} {
+			rItem := r[i]
+			if rItem.Namespace != namespaces[i] || rItem.Found != tc.found {
+				t.Fatalf("unexpected namespace/found: %v/%v", rItem.Namespace, rItem.Found)
+			}
+			if len(rItem.Dim) != nNodes || len(rItem.Len) != nNodes || len(rItem.Cap) != nNodes {
+				t.Fatal("unexpected amt of client results for ns", rItem.Namespace)
+			}
+			for j := 0; j < nNodes; j++ {
+				if rItem.Dim[j].Payload.LookupOk != tc.found {
+					t.Fatal("unexpected lookup for ns", rItem.Namespace)
+				}
+				if rItem.Dim[j].Payload.Dim != tc.dim {
+					t.Fatal("unexpected dim:", rItem.Dim[j].Payload.Dim)
+				}
+				if rItem.Len[j].Payload.NVecs != tc.nVecs {
+					t.Fatal("unexpected len:", rItem.Len[j].Payload.NVecs)
+				}
+				if tc.found && rItem.Cap[j].Payload.Cap == 0 {
+					t.Fatal("unexpected cap:", rItem.Cap[j].Payload.Cap)
+				}
+			}
+		}
+	})
+}
+
+func TestAdminConsistency(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/admin/consistency"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		// addData adds a vec with the given dim to a single node.
+		addData := func(node testNode, ns string, dim int) {
+			v, _ := randFloat64Slice(dim)
+			r := ops.NewClient(node.addrRPC).AddData([]ops.AddDataArgs{{Namespace: ns, Vec: v}})
+			if r.NetErr != nil || r.Payload[0] != ops.AddDataOk {
+				t.Fatal("could not add data:", r)
+			}
+		}
+
+		// "a" is consistent, "b" has a dim mismatch across the nodes, while
+		// "c" is pinned (but empty) on one node and has data on the other.
+		tn.fill("a", 1, 3)
+		addData(tn.nodes[0], "b", 3)
+		addData(tn.nodes[1], "b", 5)
+		pin := ops.NewClient(tn.nodes[0].addrRPC).CreateNamespace(
+			ops.CreateNamespaceArgs{Namespace: "c", Dim: 4},
+		)
+		if pin.NetErr != nil || pin.Payload != ops.CreateNamespaceOk {
+			t.Fatal("could not create namespace:", pin)
+		}
+		addData(tn.nodes[1], "c", 4)
+
+		r, err := post[consistencyResp](url, nil)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if r.Consistent || len(r.Unreachable) != 0 {
+			t.Fatalf("unexpected consistent/unreachable: %v/%v", r.Consistent, r.Unreachable)
+		}
+		if len(r.Namespaces) != 3 {
+			t.Fatal("unexpected amt of namespaces:", len(r.Namespaces))
+		}
+		for i, tc := range []struct {
+			ns         string
+			consistent bool
+		}{
+			{ns: "a", consistent: true},
+			{ns: "b", consistent: false},
+			{ns: "c", consistent: true},
+		} {
+			nsc := r.Namespaces[i]
+			if nsc.Namespace != tc.ns || nsc.Consistent != tc.consistent {
+				t.Fatalf("unexpected namespace/consistent: %v/%v", nsc.Namespace, nsc.Consistent)
+			}
+			if len(nsc.Dims) != nNodes {
+				t.Fatalf("ns %v: unexpected dims: %v", nsc.Namespace, nsc.Dims)
+			}
+		}
+		if r.Namespaces[1].Dims[tn.nodes[1].addrRPC] != 5 {
+			t.Fatal("unexpected dims for mismatched ns:", r.Namespaces[1].Dims)
+		}
+
+		// Only the given namespaces are checked.
+		r, err = post[consistencyResp](url, []string{"a", "missing"})
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if !r.Consistent || len(r.Namespaces) != 2 || len(r.Namespaces[1].Dims) != 0 {
+			t.Fatalf("unexpected resp: %+v", r)
+		}
+	})
+}
+
 func TestKNNLatency(t *testing.T) {
 	nNodes := 2
 	url := func(addr string) string {
@@ -516,6 +1552,47 @@ func TestKNNLatency(t *testing.T) {
 	})
 }
 
+func TestNormHistogram(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/info/norms"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		nVecs := 10
+		dim := 10
+		tn.fill(namespace, nVecs, dim)
+
+		opts := normHistogramArgs{
+			Key:     namespace,
+			Buckets: 4,
+		}
+		r, err := post[[]clientResult[normHistogramResp]](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if len(r) != nNodes {
+			t.Fatal("unexpected amt of results:", len(r))
+		}
+		for _, rItem := range r {
+			if !rItem.Payload.LookupOk || rItem.Payload.N != nVecs || len(rItem.Payload.Counts) != 4 {
+				t.Fatalf("unexpected resp: %+v", rItem.Payload)
+			}
+		}
+
+		opts.Buckets = 0
+		env, err := postEnvelope[[]clientResult[normHistogramResp]](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if env.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status with 0 buckets: %v", env.Code)
+		}
+	})
+}
+
 func TestKNNMonitor(t *testing.T) {
 	nNodes := 2
 	url := func(addr string) string {
@@ -548,3 +1625,536 @@ func TestKNNMonitor(t *testing.T) {
 		}
 	})
 }
+
+func TestClientResultJSONOmitNetErr(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		netErr error
+		want   bool
+	}{
+		{name: "ok", netErr: nil, want: false},
+		{name: "err", netErr: errors.New("some net error"), want: true},
+	} {
+		r := ops.ClientResult[bool]{RemoteAddr: ":1", NetErr: tc.netErr}
+		b, err := json.Marshal(newClientResult(r, func(b bool) bool { return b }))
+		if err != nil {
+			t.Fatalf("%v: unexpected marshal err: %v", tc.name, err)
+		}
+		m := make(map[string]any)
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%v: unexpected unmarshal err: %v", tc.name, err)
+		}
+		if _, have := m["netErr"]; have != tc.want {
+			t.Fatalf("%v: want netErr field %v, have %v (%s)", tc.name, tc.want, have, b)
+		}
+	}
+}
+
+func TestMetricsJSON(t *testing.T) {
+	nNodes := 2
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/metrics/json"
+	}
+	withNetwork(t, nNodes, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		nVecs := 10
+		dim := 10
+		tn.fill(namespace, nVecs, dim)
+		tn.knnFuzz(namespace, 3, dim, time.Millisecond*50)
+
+		opts := knnMonArgs{
+			Namespace: namespace,
+			Start:     time.Now(),
+			End:       time.Now().Add(-time.Minute),
+		}
+
+		r, err := post[[]metricsJSONSeries](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+
+		// Key: metric, val: number of series.
+		metrics := make(map[string]int)
+		for _, s := range r {
+			metric := s.Target[strings.Index(s.Target, "/")+1:]
+			metrics[metric]++
+			for _, point := range s.Datapoints {
+				if point[1] < float64(opts.End.UnixMilli()) {
+					t.Fatalf("unexpected timestamp of %v: %v", s.Target, point[1])
+				}
+			}
+		}
+		for _, metric := range []string{"knn.n", "latency.queueMs", "namespace.nVecs"} {
+			if metrics[metric] != nNodes {
+				t.Fatalf("want %v series of %v, have %v", nNodes, metric, metrics[metric])
+			}
+		}
+		for _, s := range r {
+			if strings.HasSuffix(s.Target, "/knn.n") && s.Datapoints[0][0] == 0 {
+				t.Fatalf("unexpected knn.n value of zero: %+v", s)
+			}
+		}
+	})
+}
+
+func TestBenchmarkSweep(t *testing.T) {
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/benchmark/sweep"
+	}
+	withNetwork(t, 2, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		dim := 10
+		tn.fill(namespace, 2000, dim)
+
+		opts := sweepArgs{
+			Args: knnArgsPartial{
+				Namespace: namespace,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         10,
+				Accept:    -math.MaxFloat64,
+				Reject:    math.MaxFloat64,
+				TTL:       time.Hour,
+			},
+			Extents: []float64{0.05, 0.2, 0.5, 1},
+		}
+		for i := 0; i < 10; i++ {
+			v, _ := randFloat64Slice(dim)
+			opts.QueryVecs = append(opts.QueryVecs, v)
+		}
+
+		r, err := post[sweepResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if len(r.Results) != len(opts.Extents) {
+			t.Fatalf("want %v results, have %v", len(opts.Extents), len(r.Results))
+		}
+		last := r.Results[len(r.Results)-1]
+		if last.Extent != 1 || last.Recall != 1 || last.Failed != 0 {
+			t.Fatalf("unexpected result of the exhaustive configuration: %+v", last)
+		}
+		if r.Results[0].Recall >= 1 {
+			t.Fatalf("unexpected recall of the smallest extent: %+v", r.Results[0])
+		}
+
+		// Higher recall must cost latency along the frontier.
+		if len(r.Frontier) == 0 || r.Frontier[len(r.Frontier)-1].Recall != 1 {
+			t.Fatalf("unexpected frontier: %+v", r.Frontier)
+		}
+		for i := 1; i < len(r.Frontier); i++ {
+			prev, curr := r.Frontier[i-1], r.Frontier[i]
+			if curr.Recall <= prev.Recall || curr.Latency < prev.Latency {
+				t.Fatalf("frontier is not ordered at index %v: %+v", i, r.Frontier)
+			}
+		}
+
+		env, _ := postEnvelope[sweepResp](url, sweepArgs{Args: opts.Args})
+		if env.Code != http.StatusBadRequest {
+			t.Fatalf("want status %v without query vecs, have %v", http.StatusBadRequest, env.Code)
+		}
+	})
+}
+
+func TestBenchmarkGroundTruth(t *testing.T) {
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/benchmark/groundtruth"
+	}
+	withNetwork(t, 2, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+		cache := &tn.nodes[0].handle.groundTruthCache
+
+		namespace := "test"
+		dim := 5
+		k := 10
+		tn.fill(namespace, 200, dim)
+
+		opts := groundTruthArgs{
+			Args: knnArgsPartial{
+				Namespace: namespace,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         k,
+				TTL:       time.Hour,
+			},
+		}
+		for i := 0; i < 5; i++ {
+			v, _ := randFloat64Slice(dim)
+			opts.QueryVecs = append(opts.QueryVecs, v)
+		}
+
+		query := func() groundTruthResp {
+			r, err := post[groundTruthResp](url, opts)
+			if err != nil {
+				t.Fatal("issue sending/receiving:", err)
+			}
+			if len(r.Results) != len(opts.QueryVecs) {
+				t.Fatalf("want %v results, have %v", len(opts.QueryVecs), len(r.Results))
+			}
+			for _, result := range r.Results {
+				if len(result) != k {
+					t.Fatalf("want %v neighbors, have %v", k, len(result))
+				}
+			}
+			return r
+		}
+
+		first := query()
+		second := query()
+		if first.Cached || !second.Cached {
+			t.Fatalf("unexpected cache use: first %v, second %v", first.Cached, second.Cached)
+		}
+		if !reflect.DeepEqual(first.Results, second.Results) {
+			t.Fatal("unexpected results from the cache")
+		}
+		cache.mx.Lock()
+		hits, misses := cache.hits, cache.misses
+		cache.mx.Unlock()
+		if hits != 1 || misses != 1 {
+			t.Fatalf("unexpected cache hits/misses: %v/%v", hits, misses)
+		}
+
+		// Mutations of the namespace invalidate.
+		tn.fill(namespace, 1, dim)
+		if query().Cached {
+			t.Fatal("results were cached after a mutation")
+		}
+		if !query().Cached {
+			t.Fatal("results were not cached after recomputing")
+		}
+	})
+}
+
+func TestBenchmarkStability(t *testing.T) {
+	url := func(addr string, path string) string {
+		return "http://localhost" + addr + path
+	}
+	withNetwork(t, 2, func(tn *testNetwork) {
+		addr := tn.nodes[0].addrAPI
+		namespace := "test"
+		dim := 5
+
+		add := func(vec []float64, id string) {
+			opts := []addDataArgs{{Namespace: namespace, Vec: vec, ID: id}}
+			if r, err := post[addDataResp](url(addr, "/cmd/add"), opts); err != nil || r.Succeeded != 1 {
+				t.Fatalf("could not add data: %+v, %v", r, err)
+			}
+		}
+		for i := 0; i < 200; i++ {
+			v, _ := randFloat64Slice(dim)
+			add(v, fmt.Sprint("id", i))
+		}
+
+		opts := stabilityArgs{
+			Args: knnArgsPartial{
+				Namespace: namespace,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         10,
+				TTL:       time.Hour,
+			},
+			Seed:     1,
+			NQueries: 20,
+		}
+		digest := func() stabilityResp {
+			r, err := post[stabilityResp](url(addr, "/benchmark/stability"), opts)
+			if err != nil {
+				t.Fatal("issue sending/receiving:", err)
+			}
+			if r.Digest == "" || len(r.QueryDigests) != opts.NQueries {
+				t.Fatalf("unexpected response: %+v", r)
+			}
+			if r.Failed != 0 || r.MissingIDs != 0 {
+				t.Fatalf("unexpected failures: %+v", r)
+			}
+			return r
+		}
+
+		first := digest()
+		for i := 0; i < 3; i++ {
+			if r := digest(); r.Digest != first.Digest {
+				t.Fatalf("digest changed without changes of the data, run %v", i)
+			}
+		}
+
+		// The new vec is the best result of the first query.
+		add(stabilityQueryVecs(opts.Seed, 1, dim)[0], "new")
+		changed := digest()
+		if changed.Digest == first.Digest {
+			t.Fatal("digest did not change after the data changed")
+		}
+		if changed.QueryDigests[0] == first.QueryDigests[0] {
+			t.Fatal("digest of the first query did not change")
+		}
+	})
+}
+
+func TestStabilityDigestTies(t *testing.T) {
+	a := []knnRespItem{{ID: "a", Score: 1}, {ID: "b", Score: 1}, {ID: "c", Score: 2}}
+	b := []knnRespItem{{ID: "b", Score: 1}, {ID: "a", Score: 1}, {ID: "c", Score: 2}}
+	c := []knnRespItem{{ID: "c", Score: 1}, {ID: "a", Score: 1}, {ID: "b", Score: 2}}
+
+	digestA, _ := stabilityDigest([][]knnRespItem{a})
+	digestB, _ := stabilityDigest([][]knnRespItem{b})
+	digestC, _ := stabilityDigest([][]knnRespItem{c})
+	if digestA != digestB {
+		t.Fatal("order of ties changed the digest")
+	}
+	if digestA == digestC {
+		t.Fatal("different rankings gave the same digest")
+	}
+	if a[0].ID != "a" || b[0].ID != "b" {
+		t.Fatal("results were modified")
+	}
+}
+
+func TestRPCKNNBulk(t *testing.T) {
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/cmd/knn/bulk"
+	}
+	withNetwork(t, 2, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		// addData adds the vecs with IDs to the rpc server of node 'i'.
+		addData := func(i int, ns string, vecs map[string][]float64) {
+			addDataArgs := make([]ops.AddDataArgs, 0, len(vecs))
+			for id, vec := range vecs {
+				addDataArgs = append(addDataArgs, ops.AddDataArgs{Namespace: ns, Vec: vec, ID: id})
+			}
+			sArgs := ops.SArgs[[]ops.AddDataArgs]{Payload: addDataArgs}
+			sResp := ops.SResp[[]ops.AddDataStatus]{}
+			node := tn.nodes[i]
+			node.handle.rpcServerWrap.mx.Lock()
+			defer node.handle.rpcServerWrap.mx.Unlock()
+			if err := node.handle.rpcServerWrap.inner.server.AddData(sArgs, &sResp); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Targets are spread over both nodes, item i is at [i, 0].
+		for i := 0; i < 2; i++ {
+			vecs := make(map[string][]float64)
+			for j := i; j < 10; j += 2 {
+				vecs[fmt.Sprint("item", j)] = []float64{float64(j), 0}
+			}
+			addData(i, "items", vecs)
+		}
+		// Query q<i> is closest to item 3i, then item 3i+1. Query q0 is
+		// replicated, it should only be used once.
+		queries := map[string][]float64{
+			"q0": {0.1, 0},
+			"q1": {3.1, 0},
+			"q2": {6.1, 0},
+		}
+		addData(0, "queries", queries)
+		addData(1, "queries", map[string][]float64{"q0": queries["q0"]})
+
+		opts := knnBulkArgs{
+			QueryNamespace: "queries",
+			Args: knnArgsPartial{
+				Namespace: "items",
+				Priority:  1,
+				KNNMethod: rman.KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         2,
+				Extent:    1,
+				Accept:    0,
+				Reject:    100,
+				TTL:       time.Second * 5,
+			},
+		}
+		r, err := post[[]knnBulkResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if len(r) != len(queries) {
+			t.Fatalf("unexpected amt of result groups: %v", len(r))
+		}
+		for i, resp := range r {
+			if resp.QueryID != fmt.Sprint("q", i) {
+				t.Fatalf("unexpected query ID at index %v: %q", i, resp.QueryID)
+			}
+			if len(resp.Results) != 2 {
+				t.Fatalf("unexpected amt of results for %v: %v", resp.QueryID, len(resp.Results))
+			}
+			for j, result := range resp.Results {
+				if want := fmt.Sprint("item", i*3+j); result.Payload.ID != want {
+					t.Fatalf("unexpected neighbor %v of %v: %q", j, resp.QueryID, result.Payload.ID)
+				}
+			}
+		}
+
+		opts.Args.SecondarySort = "unknown"
+		env, err := postEnvelope[[]knnBulkResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving:", err)
+		}
+		if env.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status with an unknown secondary sort: %v", env.Code)
+		}
+	})
+}
+
+func TestMarshalMsgpack(t *testing.T) {
+	type s struct {
+		A int     `json:"a"`
+		B string  `json:"b,omitempty"`
+		C []byte  `json:"-"`
+		D *string `json:"d"`
+	}
+	cases := []struct {
+		v    any
+		want []byte
+	}{
+		{v: -1, want: []byte{0xff}},
+		{v: 200, want: []byte{0xcc, 200}},
+		{v: -200, want: []byte{0xd1, 0xff, 0x38}},
+		{v: 1.5, want: []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{v: []int{1, 2}, want: []byte{0x92, 1, 2}},
+		{v: []byte{1, 2}, want: []byte{0xc4, 2, 1, 2}},
+		{v: map[int]bool{2: true, 1: false}, want: []byte{0x82, 0xa1, '1', 0xc2, 0xa1, '2', 0xc3}},
+		{v: s{A: 1, C: []byte{1}}, want: []byte{0x82, 0xa1, 'a', 1, 0xa1, 'd', 0xc0}},
+		{v: time.Duration(70000), want: []byte{0xce, 0, 1, 0x11, 0x70}},
+	}
+	for _, c := range cases {
+		b, err := marshalMsgpack(c.v)
+		if err != nil {
+			t.Fatalf("could not encode %v: %v", c.v, err)
+		}
+		if !bytes.Equal(b, c.want) {
+			t.Fatalf("unexpected encoding of %v: % x, want % x", c.v, b, c.want)
+		}
+	}
+}
+
+func TestRPCKNNMsgpack(t *testing.T) {
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/cmd/knn"
+	}
+	withNetwork(t, 2, func(tn *testNetwork) {
+		url := url(tn.nodes[0].addrAPI)
+
+		namespace := "test"
+		dim := 3
+		k := 5
+		tn.fill(namespace, 100, dim)
+		v, _ := randFloat64Slice(dim)
+
+		opts := knnArgs{
+			QueryVecs: [][]float64{v},
+			Args: knnArgsPartial{
+				Namespace: namespace,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodCosineSimilarity,
+				K:         k,
+				Extent:    1,
+				Accept:    1e9,
+				Reject:    -1e9,
+				TTL:       time.Hour,
+				Normalize: true,
+			},
+		}
+		want, err := postEnvelope[[]knnResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving json:", err)
+		}
+		have, err := postMsgpack[[]knnResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving msgpack:", err)
+		}
+		if have.Code != http.StatusOK || len(have.Data) != 1 || len(have.Data[0].Results) != k {
+			t.Fatalf("unexpected msgpack response: %+v", have)
+		}
+		if !reflect.DeepEqual(have.Data[0].QueryVec, v) {
+			t.Fatalf("unexpected query vec: %v", have.Data[0].QueryVec)
+		}
+		// Same results as with json, network latencies differ.
+		for i, result := range have.Data[0].Results {
+			wantResult := want.Data[0].Results[i]
+			if result.RemoteAddr != wantResult.RemoteAddr {
+				t.Fatalf("unexpected addr of result %v: %v", i, result.RemoteAddr)
+			}
+			if !reflect.DeepEqual(result.Payload, wantResult.Payload) {
+				t.Fatalf("unexpected result %v:\nhave: %+v\nwant: %+v", i, result.Payload, wantResult.Payload)
+			}
+		}
+
+		// Errors are msgpack as well.
+		opts.Args.SecondarySort = "unknown"
+		have, err = postMsgpack[[]knnResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving msgpack:", err)
+		}
+		if have.Code != http.StatusBadRequest || have.Error == "" {
+			t.Fatalf("unexpected msgpack error response: %+v", have)
+		}
+	})
+}
+
+func TestRPCKNNMaxRespBytes(t *testing.T) {
+	url := func(addr string) string {
+		return "http://localhost" + addr + "/cmd/knn"
+	}
+	withNetwork(t, 1, func(tn *testNetwork) {
+		node := tn.nodes[0]
+		url := url(node.addrAPI)
+
+		namespace := "test"
+		dim := 256
+		k := 200
+		tn.fill(namespace, 300, dim)
+		v, _ := randFloat64Slice(dim)
+
+		opts := knnArgs{
+			QueryVecs: [][]float64{v},
+			Args: knnArgsPartial{
+				Namespace: namespace,
+				Priority:  1,
+				KNNMethod: rman.KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         k,
+				Extent:    1,
+				Accept:    -1,
+				Reject:    1e9,
+				TTL:       time.Hour,
+			},
+		}
+		want, err := post[[]knnResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving json:", err)
+		}
+		if len(want) != 1 || len(want[0].Results) != k || want[0].Truncated {
+			t.Fatalf("unexpected response without a max size: %+v", want)
+		}
+
+		maxBytes := 50_000
+		node.handle.maxKNNRespBytes = maxBytes
+		have, err := post[[]knnResp](url, opts)
+		if err != nil {
+			t.Fatal("issue sending/receiving json:", err)
+		}
+		if len(have) != 1 || !have[0].Truncated {
+			t.Fatalf("response was not truncated: %+v", have)
+		}
+		results := have[0].Results
+		if len(results) == 0 || len(results) >= k {
+			t.Fatalf("unexpected amt of results after truncation: %v", len(results))
+		}
+		if b, _ := json.Marshal(have); len(b) > maxBytes {
+			t.Fatalf("response of %v bytes exceeds the max of %v", len(b), maxBytes)
+		}
+		// The best results are kept.
+		for i, result := range results {
+			if result.Payload.Score != want[0].Results[i].Payload.Score {
+				t.Fatalf("unexpected score of result %v: %v", i, result.Payload.Score)
+			}
+		}
+	})
+}
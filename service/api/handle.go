@@ -1,8 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,11 +22,16 @@ import (
 type addrSet struct {
 	mx     sync.Mutex
 	_addrs map[string]bool
+	// _fails keeps the number of consecutive failed pings per addr.
+	_fails map[string]int
 
 	// updateFrequency is how often the "maintain" method actually maintains
 	// the addrs in the "addrs" set.
 	updateFrequency time.Duration
 	updateTimeStamp time.Time
+	// failThreshold is the number of consecutive failed pings (i.e maintain
+	// cycles) before an addr is evicted. Values < 1 are treated as 1.
+	failThreshold int
 }
 
 // addrs adds the slice of newAddrs into the internal set, then returns all the
@@ -40,8 +52,9 @@ func (s *addrSet) addrs(newAddrs ...string) []string {
 
 // maintain tries to maintain the internal set of addrs by pinging them with
 // ops.Clients(addrSet.addrs()).Ping() -- those nodes that yield a negative
-// resppnse are removed from the internal set of addrs. This action does not
-// occur more often than addrSet.updateFrequency.
+// response addrSet.failThreshold times in a row are removed from the internal
+// set of addrs. This action does not occur more often than
+// addrSet.updateFrequency.
 // Note that this method is not mutex protected.
 func (s *addrSet) maintain() {
 	if time.Now().Sub(s.updateTimeStamp) < s.updateFrequency {
@@ -49,15 +62,42 @@ func (s *addrSet) maintain() {
 	}
 	s.updateTimeStamp = time.Now()
 
+	if s._fails == nil {
+		s._fails = make(map[string]int)
+	}
+
 	for clientResp := range ops.NewClients(s.addrs()).Ping() {
+		addr := clientResp.RemoteAddr
 		if !clientResp.Payload {
-			delete(s._addrs, clientResp.RemoteAddr)
+			s._fails[addr]++
+			if s._fails[addr] >= s.failThreshold {
+				s.remove(addr)
+			}
 			continue
 		}
-		s._addrs[clientResp.RemoteAddr] = true
+		s._addrs[addr] = true
+		delete(s._fails, addr)
 	}
 }
 
+// remove removes the given addrs from the internal set (along with their fail
+// count), then returns all the addrs currently in the set.
+// Note that this is not mutex protected.
+func (s *addrSet) remove(addrs ...string) []string {
+	for _, addr := range addrs {
+		delete(s._addrs, addr)
+		delete(s._fails, addr)
+	}
+	return s.addrs()
+}
+
+// removeLocked does addrSet.remove(addrs...) in a mutex protected way.
+func (s *addrSet) removeLocked(addrs ...string) []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.remove(addrs...)
+}
+
 // addrsMaintanedLocked does addrSet.addrs(newAddrs...) and addrSet.maintain()
 // in a mutex protected way.
 func (s *addrSet) addrsMaintanedLocked(newAddrs ...string) []string {
@@ -133,30 +173,329 @@ type handle struct {
 	addrSet addrSet
 	// rpcServerWrap holds an ops.Server.
 	rpcServerWrap rpcServerWrap
+	// peers are addrs of other http servers (of this pkg) which are used to
+	// exchange rpc addrs with, see handle.gossip.
+	peers []string
+	// failures is shared by all ops.Clients, see handle.clients. Can be nil.
+	failures *ops.FailureTracker
+	// breaker is shared by all ops.Clients, see handle.clients. Can be nil.
+	breaker *ops.CircuitBreaker
+	// groundTruthCache keeps results of handle.groundTruth.
+	groundTruthCache groundTruthCache
+	// maxKNNRespBytes caps the size of "/cmd/knn" responses, 0 disables it.
+	// See StartServerArgs.MaxKNNRespBytes.
+	maxKNNRespBytes int
+}
+
+// clients returns ops.NewClientsWithBreaker(addrs, handle.breaker), with
+// ops.Clients.Failures set to handle.failures.
+func (h *handle) clients(addrs []string) *ops.Clients {
+	cs := ops.NewClientsWithBreaker(addrs, h.breaker)
+	cs.Failures = h.failures
+	return cs
 }
 
 // registerRoutes registers all endpoints for this server handle.
 func (h *handle) registerRoutes(mux *http.ServeMux) {
 	// Key: endpoint url, Val: rcv method.
 	routes := map[string]func(http.ResponseWriter, *http.Request){
-		"/ping":                 h.Ping,
-		"/ops/rpc/addrs/put":    h.RPCAddrsPut,
-		"/ops/rpc/addrs/get":    h.RPCAddrsGet,
-		"/ops/rpc/server/stop":  h.RPCServerStop,
-		"/ops/rpc/server/start": h.RPCServerStart,
-		"/cmd/ping":             h.RPCPing,
-		"/cmd/add":              h.RPCAddData,
-		"/cmd/knn":              h.RPCKNNEager,
-		"/info/namespaces":      h.RPCSSpaceNamespaces,
-		"/info/namespace":       h.RPCSSpaceNamespace,
-		"/info/dim":             h.RPCSSpaceDim,
-		"/info/len":             h.RPCSSpaceLen,
-		"/info/cap":             h.RPCSSpaceCap,
-		"/info/knnLatency":      h.RPCKNNLatency,
-		"/info/knnMonitor":      h.RPCKNNMonitor,
+		"/ping":                  h.Ping,
+		"/ops/rpc/addrs/put":     h.RPCAddrsPut,
+		"/ops/rpc/addrs/get":     h.RPCAddrsGet,
+		"/ops/rpc/addrs/remove":  h.RPCAddrsRemove,
+		"/ops/rpc/server/stop":   h.RPCServerStop,
+		"/ops/rpc/server/start":  h.RPCServerStart,
+		"/cmd/ping":              h.RPCPing,
+		"/cmd/add":               h.RPCAddData,
+		"/cmd/knn":               h.RPCKNNEager,
+		"/cmd/knn/bulk":          h.RPCKNNBulk,
+		"/cmd/delete":            h.RPCDeleteOlderThan,
+		"/data/get":              h.RPCGetVector,
+		"/info/namespaces":       h.RPCSSpaceNamespaces,
+		"/info/namespace":        h.RPCSSpaceNamespace,
+		"/info/dim":              h.RPCSSpaceDim,
+		"/info/len":              h.RPCSSpaceLen,
+		"/info/cap":              h.RPCSSpaceCap,
+		"/info/batch":            h.RPCSSpaceBatch,
+		"/info/knnLatency":       h.RPCKNNLatency,
+		"/info/knnMonitor":       h.RPCKNNMonitor,
+		"/info/norms":            h.RPCNormHistogram,
+		"/metrics/json":          h.MetricsJSON,
+		"/admin/consistency":     h.AdminConsistency,
+		"/benchmark/sweep":       h.BenchmarkSweep,
+		"/benchmark/groundtruth": h.BenchmarkGroundTruth,
+		"/benchmark/stability":   h.BenchmarkStability,
 	}
 
 	for k, v := range routes {
 		mux.Handle(k, http.HandlerFunc(v))
 	}
 }
+
+// groundTruthCacheMaxN is the max number of entries in groundTruthCache.
+const groundTruthCacheMaxN = 100
+
+// groundTruthCache keeps ground truth (exact KNN results) of query sets, see
+// handle.groundTruth. Each entry is kept along with the version of the data it
+// was computed from, and is only used while that version is unchanged.
+type groundTruthCache struct {
+	mx      sync.Mutex
+	entries map[string]groundTruthCacheEntry
+	// hits and misses count lookups with groundTruthCache.get.
+	hits   int
+	misses int
+}
+
+// groundTruthCacheEntry is a value of groundTruthCache.entries.
+type groundTruthCacheEntry struct {
+	version string
+	results [][]knnRespItem
+}
+
+// get returns the results of the entry with the given key, and true if it
+// exists and has the given version.
+func (c *groundTruthCache) get(key string, version string) ([][]knnRespItem, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.version != version {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.results, true
+}
+
+// put sets the entry with the given key, replacing any previous version. An
+// arbitrary entry is evicted if the cache is full (see groundTruthCacheMaxN).
+func (c *groundTruthCache) put(key string, version string, results [][]knnRespItem) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]groundTruthCacheEntry)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= groundTruthCacheMaxN {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = groundTruthCacheEntry{version: version, results: results}
+}
+
+// groundTruth returns the exact KNN results of each vec in 'vecs', with an
+// exhaustive query (see exhaustiveKNNArgs) using 'args'. Results are cached in
+// handle.groundTruthCache, keyed by a hash of 'vecs' and 'args', along with the
+// versions of the namespace on all rpc nodes (see ops.CSInfo.SSpaceVersion).
+// Cached results are returned (with a true bool) while the versions are
+// unchanged, i.e they are invalidated when the namespace is mutated on any rpc
+// node. Results are not cached if a query has no results (e.g due to TTL), or
+// if the version of any rpc node could not be fetched.
+func (h *handle) groundTruth(
+	cs *ops.Clients,
+	vecs [][]float64,
+	args knnArgsPartial,
+) ([][]knnRespItem, bool) {
+	args = exhaustiveKNNArgs(args)
+
+	b, _ := json.Marshal(groundTruthArgs{QueryVecs: vecs, Args: args})
+	key := fmt.Sprintf("%x", sha256.Sum256(b))
+	// Fetched before the queries, such that concurrent mutations invalidate.
+	version, versionOk := groundTruthVersion(cs, args.Namespace)
+	if versionOk {
+		if results, ok := h.groundTruthCache.get(key, version); ok {
+			return results, true
+		}
+	}
+
+	results, _ := sweepQuery(cs, vecs, args)
+	for _, result := range results {
+		if len(result) == 0 {
+			return results, false
+		}
+	}
+	if versionOk {
+		h.groundTruthCache.put(key, version, results)
+	}
+	return results, false
+}
+
+// groundTruthVersion returns the versions of the namespace on all rpc nodes of
+// 'cs' as a single string, see handle.groundTruth. Returns false if the version
+// of any rpc node could not be fetched.
+func groundTruthVersion(cs *ops.Clients, ns string) (string, bool) {
+	versions := make([]string, 0, len(cs.RemoteAddrs))
+	for r := range cs.Info().SSpaceVersion(ns) {
+		if r.NetErr != nil {
+			return "", false
+		}
+		versions = append(versions, fmt.Sprint(r.RemoteAddr, "/", r.Payload.Version))
+	}
+	if len(versions) != len(cs.RemoteAddrs) {
+		return "", false
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ","), true
+}
+
+// rpcServerStart tries to init a new internal rpc server, using the given args.
+// Returns a status and a nil error on success. Otherwise, the err is an
+// *apiError with a descriptive message and one of the following codes:
+// - http.StatusBadRequest if the requestman cfg is invalid.
+// - http.StatusInternalServerError if the rpc server could not be set up or
+//   could not start listening.
+// - http.StatusConflict if an rpc server is already running (or starting).
+func (h *handle) rpcServerStart(opts rpcServerStartArgs) (status, error) {
+	// Validate.
+	conv := opts.Cfg.export(h.ctx)
+	if !conv.Ok() {
+		msg := "invalid rpc server cfg (requestman args not ok)"
+		return status{}, newAPIError(http.StatusBadRequest, msg)
+	}
+
+	// Set up new potential server. Doing this here to reduce mutex
+	// locking (and unlocking) complexity further down.
+	newServer, ok := ops.NewServer(opts.Addr, conv)
+	if !ok {
+		msg := "could not set up rpc server on addr '%s'"
+		return status{}, newAPIError(http.StatusInternalServerError, msg, opts.Addr)
+	}
+
+	newServerStopF, err := newServer.StartListen()
+	if err != nil {
+		msg := "could not listen on addr '%s': %v"
+		return status{}, newAPIError(http.StatusInternalServerError, msg, opts.Addr, err)
+	}
+
+	// Add the new addr.
+	h.addrSet.addrsMaintanedLocked(opts.Addr)
+
+	// Try starting below.
+	// Not deferring unlock because of double locking mechanism.
+	h.rpcServerWrap.mx.Lock()
+
+	// Only valid state for stopping is "...Default/Stopped".
+	ok = false
+	ok = ok || h.rpcServerWrap.state == rpcServerStateDefault
+	ok = ok || h.rpcServerWrap.state == rpcServerStateStopped
+	if !ok {
+		state := h.rpcServerWrap.state
+		h.rpcServerWrap.mx.Unlock()
+		newServerStopF() // Don't need it anymore.
+		msg := "rpc server can not be started (%s)"
+		return state.toStatus(), newAPIError(http.StatusConflict, msg, state.toStatus().Msg)
+	}
+
+	// Outer update and unlock.
+	h.rpcServerWrap.state = rpcServerStateStarting
+	h.rpcServerWrap.mx.Unlock()
+
+	// Inner handling. Again, intentionally not deferring unlock.
+	h.rpcServerWrap.inner.mx.Lock()
+	h.rpcServerWrap.inner.server = newServer
+	h.rpcServerWrap.inner.serverStopF = newServerStopF
+	h.rpcServerWrap.inner.mx.Unlock()
+
+	// Outer update since now the state should be "...Started".
+	h.rpcServerWrap.mx.Lock()
+	defer h.rpcServerWrap.mx.Unlock()
+	h.rpcServerWrap.state = rpcServerStateStarted
+	return h.rpcServerWrap.state.toStatus(), nil
+}
+
+// peerAddrs posts 'addrs' (json) to the given endpoint of a peer (http server
+// of this pkg), and returns the rpc addrs in the response. This is intended for
+// the "/ops/rpc/addrs/get" and "/ops/rpc/addrs/put" endpoints, which both
+// respond with the full set of rpc addrs known to the peer.
+func peerAddrs(client *http.Client, peer, endpoint string, addrs []string) ([]string, error) {
+	b, err := json.Marshal(addrs)
+	if err != nil {
+		return nil, err
+	}
+	url := "http://" + peer + endpoint
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var r envelope[[]string]
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		s := "unexpected status from peer: %v (%s)"
+		return nil, fmt.Errorf(s, resp.StatusCode, r.Error)
+	}
+	return r.Data, nil
+}
+
+// gossip exchanges rpc addrs with all handle.peers in two phases. First, the
+// rpc addrs of all peers are pulled (with their "/ops/rpc/addrs/get" endpoint)
+// and merged into the local set. Then, the merged local set is pushed to all
+// peers (with their "/ops/rpc/addrs/put" endpoint), such that peers without a
+// seed list of their own learn about the rest of the cluster as well. Since
+// peers do the same with their peers, rpc addrs spread transitively; a node
+// which knows one peer eventually learns the rpc addrs of the whole cluster.
+// Peers that fail are simply skipped, as gossip is done periodically (see
+// handle.gossipLoop). Merges are deduplicated since the addrSet is a set.
+func (h *handle) gossip() {
+	client := &http.Client{Timeout: h.addrSet.updateFrequency}
+	for _, peer := range h.peers {
+		addrs, err := peerAddrs(client, peer, "/ops/rpc/addrs/get", nil)
+		if err == nil {
+			h.addrSet.addrsMaintanedLocked(addrs...)
+		}
+	}
+
+	addrs := h.addrSet.addrsMaintanedLocked()
+	for _, peer := range h.peers {
+		peerAddrs(client, peer, "/ops/rpc/addrs/put", addrs)
+	}
+}
+
+// gossipLoop calls handle.gossip right away and then with an interval of
+// handle.addrSet.updateFrequency, until 'done' is closed. It returns right
+// away if there are no handle.peers.
+func (h *handle) gossipLoop(done <-chan struct{}) {
+	if len(h.peers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.addrSet.updateFrequency)
+	defer ticker.Stop()
+	for {
+		h.gossip()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// deregister asks all handle.peers to remove the rpc addr of the running rpc
+// server (if any) from their addr sets, with their "/ops/rpc/addrs/remove"
+// endpoint. This is intended for shutdown, see StartServerArgs.ShutdownGrace.
+// Note that other nodes which know the addr (e.g through gossip with peers)
+// only remove it once it fails (see addrSet.maintain). Peers that fail are
+// simply skipped.
+func (h *handle) deregister() {
+	h.rpcServerWrap.inner.mx.Lock()
+	server := h.rpcServerWrap.inner.server
+	h.rpcServerWrap.inner.mx.Unlock()
+	if server == nil {
+		return
+	}
+
+	client := &http.Client{Timeout: h.addrSet.updateFrequency}
+	for _, peer := range h.peers {
+		peerAddrs(client, peer, "/ops/rpc/addrs/remove", []string{server.LocalAddr})
+	}
+}
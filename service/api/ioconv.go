@@ -2,40 +2,84 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/crunchypi/ddrop/pkg/knnc"
+	"github.com/crunchypi/ddrop/pkg/mathx"
 	"github.com/crunchypi/ddrop/pkg/timex"
 	"github.com/crunchypi/ddrop/service/ops"
 	rman "github.com/crunchypi/ddrop/service/requestman"
 )
 
+// apiError is an error with an http status code, which handlers can return
+// from the rcv func of withNetIO to signal a failure. Its message and code are
+// put into the response envelope, see envelope.
+type apiError struct {
+	code int
+	msg  string
+}
+
+// newAPIError is a factory func for apiError, the message is formatted with
+// fmt.Sprintf.
+func newAPIError(code int, format string, args ...any) *apiError {
+	return &apiError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// Error implements the error interface.
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// envelope is the standard response format of all endpoints. Data is the
+// payload (can be partial or empty on failure), Error is a description of
+// the failure (omitted on success) and Code is the http status code.
+type envelope[U any] struct {
+	Data  U      `json:"data"`
+	Error string `json:"error,omitempty"`
+	Code  int    `json:"code"`
+}
+
 // withNetIO is a convenience func for unpacking json requests (T) and packing
 // json responses [U]. Note that T and U can be anything as long as it can be
 // packed/unpacked as json. Also note that an empty struct for T signals that
 // nothing is expected for input. It works with the following syntax:
 //
 //  // This will expect to recieve a string json and send back a bool resp.
-//  withNetIO(w, r, func(opts string) bool {
+//  withNetIO(w, r, func(opts string) (bool, error) {
 //      fmt.Println("got:", opts)
 //      // Simply return to pack- and send the response.
-//      return true
+//      return true, nil
 //  })
 //
+// Responses are json, unless the Accept header of the request asks for msgpack,
+// see responseContentType and marshalMsgpack.
+//
+// Responses are always wrapped in an envelope, i.e {data, error, code}. If the
+// rcv func returns an error, then its message is put in the envelope, and the
+// status code is the one of the error if it is an *apiError, or else a
+// http.StatusInternalServerError. The data is sent along regardless.
+//
 // If T is not an empty struct (stuct{}) and cannot be decoded, then the
-// rcv func will not run, this func will simply do w.WriteHeader with a
-// http.StatusBadRequest, then return.
+// rcv func will not run, this func will simply respond with an envelope with
+// a http.StatusBadRequest, then return.
 // Similarly, if U cannot be encoded, then this func will simply do a
 // w.WriteHeader with http.StatusInternalServerError, then return.
 func withNetIO[T, U any](
 	w http.ResponseWriter,
 	r *http.Request,
-	rcv func(in T) (out U),
+	rcv func(in T) (out U, err error),
 ) {
 	var in T
+	contentType := responseContentType(r)
 
 	// Only try to unpack request data if T is not empty struct.
 	_, ok := any(in).(struct{})
@@ -43,34 +87,85 @@ func withNetIO[T, U any](
 		// Read.
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			msg := "could not read request: %v"
+			writeEnvelope(w, contentType, envelope[*U]{}, newAPIError(http.StatusBadRequest, msg, err))
 			return
 		}
 
 		// T extract.
 		if err := json.Unmarshal(body, &in); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			msg := "could not decode request: %v"
+			writeEnvelope(w, contentType, envelope[*U]{}, newAPIError(http.StatusBadRequest, msg, err))
 			return
 		}
 	}
 
-	out := rcv(in)
+	out, err := rcv(in)
+	writeEnvelope(w, contentType, envelope[U]{Data: out}, err)
+}
+
+// writeEnvelope sets the error and code of the envelope (see withNetIO for how
+// that is done), then encodes it with the given content type (see
+// responseContentType) and writes it (along with the status code).
+func writeEnvelope[U any](
+	w http.ResponseWriter,
+	contentType string,
+	env envelope[U],
+	err error,
+) {
+	env.Code = http.StatusOK
+	if err != nil {
+		env.Code = http.StatusInternalServerError
+		env.Error = err.Error()
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		env.Code = apiErr.code
+	}
 
 	// Try send back.
-	b, err := json.Marshal(out)
+	marshal := json.Marshal
+	if contentType == contentTypeMsgpack {
+		marshal = marshalMsgpack
+	}
+	b, err := marshal(env)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(env.Code)
 	w.Write(b)
 }
 
+// withHandlerTimeout wraps 'next' with http.TimeoutHandler, such that requests
+// which take longer than 'timeout' get a 503 response with an envelope (see
+// writeEnvelope). Returns 'next' as-is if timeout <= 0.
+func withHandlerTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+
+	code := http.StatusServiceUnavailable
+	msg := fmt.Sprintf("handler timeout (%v)", timeout)
+	b, _ := json.Marshal(envelope[any]{Error: msg, Code: code})
+	timeoutHandler := http.TimeoutHandler(next, timeout, string(b))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Used by the timeout response, responses from 'next' set their own.
+		w.Header().Set("Content-Type", "application/json")
+		timeoutHandler.ServeHTTP(w, r)
+	})
+}
+
 // newSearchSpacesArgs mirrors knnc.NewSearchSpacesArgs, see docs for that
 // struct for more info. This is defined seperately for struct tags.
 type newSearchSpacesArgs struct {
 	SearchSpacesMaxCap      int           `json:"searchSpacesMaxCap"`
 	SearchSpacesMaxN        int           `json:"searchSpacesMaxN"`
 	MaintenanceTaskInterval time.Duration `json:"maintenanceTaskInterval"`
+	KeepEmptySearchSpaces   bool          `json:"keepEmptySearchSpaces"`
+	HotTierSize             int           `json:"hotTierSize"`
 }
 
 // export converts this instance into its exported equivalent in the knnc pkg.
@@ -79,6 +174,8 @@ func (args *newSearchSpacesArgs) export() knnc.NewSearchSpacesArgs {
 		SearchSpacesMaxCap:      args.SearchSpacesMaxCap,
 		SearchSpacesMaxN:        args.SearchSpacesMaxN,
 		MaintenanceTaskInterval: args.MaintenanceTaskInterval,
+		KeepEmptySearchSpaces:   args.KeepEmptySearchSpaces,
+		HotTierSize:             args.HotTierSize,
 	}
 }
 
@@ -99,6 +196,39 @@ func (args *newLatencyTrackerArgs) export() timex.NewLatencyTrackerArgs {
 	}
 }
 
+// nearDupArgs mirrors requestman.NearDupArgs, see docs for that struct for more
+// info. This is defined seperately for struct tags. The method is the same as
+// with knnArgsPartial.
+type nearDupArgs struct {
+	Enabled   bool           `json:"enabled"`
+	KNNMethod rman.KNNMethod `json:"KNNMethod"`
+	Threshold float64        `json:"threshold"`
+}
+
+// export converts this instance into its exported equivalent in the requestman pkg.
+func (args *nearDupArgs) export() rman.NearDupArgs {
+	return rman.NearDupArgs{
+		Enabled:   args.Enabled,
+		KNNMethod: args.KNNMethod,
+		Threshold: args.Threshold,
+	}
+}
+
+// knnBudget mirrors requestman.KNNBudget, see docs for that struct for more
+// info. This is defined seperately for struct tags.
+type knnBudget struct {
+	Queue float64 `json:"queue"`
+	Scan  float64 `json:"scan"`
+}
+
+// export converts this instance into its exported equivalent in the requestman pkg.
+func (args *knnBudget) export() rman.KNNBudget {
+	return rman.KNNBudget{
+		Queue: args.Queue,
+		Scan:  args.Scan,
+	}
+}
+
 // newRequestManagerHandleArgs mirrors (almost) requestmanager.NewHandleArgs,
 // see docs for that struct for more info. This is redefined for struct tags.
 // Note: The only difference is that the Ctx field is excluded (naturally).
@@ -108,6 +238,12 @@ type newRequestManagerHandleArgs struct {
 	KNNQueueBuf           int                   `json:"knnQueueBuf"`
 	KNNQueueMaxConcurrent int                   `json:"knnQueueMaxConcurrent"`
 	NewKNNMonitorArgs     newLatencyTrackerArgs `json:"newKNNMonitorArgs"`
+	LatencyHalfLife       time.Duration         `json:"latencyHalfLife"`
+	AdmissionFactor       float64               `json:"admissionFactor"`
+	ScanMaxWorkers        int                   `json:"scanMaxWorkers"`
+	NearDup               nearDupArgs           `json:"nearDup"`
+	MonitorSampleRate     float64               `json:"monitorSampleRate"`
+	KNNBudget             knnBudget             `json:"knnBudget"`
 }
 
 // export converts this instance into its exported equivalent in the requestmanager pkg.
@@ -119,6 +255,12 @@ func (args *newRequestManagerHandleArgs) export(ctx context.Context) rman.NewHan
 		KNNQueueMaxConcurrent: args.KNNQueueMaxConcurrent,
 		Ctx:                   ctx,
 		NewKNNMonitorArgs:     args.NewKNNMonitorArgs.export(),
+		LatencyHalfLife:       args.LatencyHalfLife,
+		AdmissionFactor:       args.AdmissionFactor,
+		ScanMaxWorkers:        args.ScanMaxWorkers,
+		NearDup:               args.NearDup.export(),
+		MonitorSampleRate:     args.MonitorSampleRate,
+		KNNBudget:             args.KNNBudget.export(),
 	}
 }
 
@@ -132,9 +274,11 @@ type rpcServerStartArgs struct {
 
 // clientResult mirrors the _exported_ T of the same in pkg ops, see docs for
 // that struct for more info. This is defined seperately for struct tags.
+// NetErr is the message of ops.ClientResult.NetErr, as errors are marshalled
+// as empty json objects. It is omitted from the json when empty, i.e on success.
 type clientResult[T any] struct {
 	RemoteAddr     string        `json:"remoteAddr"`
-	NetErr         error         `json:"netErr"`
+	NetErr         string        `json:"netErr,omitempty"`
 	Payload        T             `json:"payload"`
 	NetworkLatency time.Duration `json:"networkLatency"`
 }
@@ -147,12 +291,15 @@ func newClientResult[T, U any](
 	r ops.ClientResult[T],
 	conv func(T) U,
 ) clientResult[U] {
-	return clientResult[U]{
+	res := clientResult[U]{
 		RemoteAddr:     r.RemoteAddr,
-		NetErr:         r.NetErr,
 		Payload:        conv(r.Payload),
 		NetworkLatency: r.NetworkLatency,
 	}
+	if r.NetErr != nil {
+		res.NetErr = r.NetErr.Error()
+	}
+	return res
 }
 
 // newClientResults is similar to newClientResult but works with
@@ -175,6 +322,9 @@ type addDataArgs struct {
 	Vec       []float64 `json:"vec"`
 	Data      []byte    `json:"data"`
 	Expires   time.Time `json:"expires"`
+	ID        string    `json:"id"`
+
+	Metadata map[string]string `json:"metadata"`
 }
 
 // export converts this instance into its exported equivalent in the ops pkg.
@@ -184,18 +334,169 @@ func (args *addDataArgs) export() ops.AddDataArgs {
 		Vec:       args.Vec,
 		Data:      args.Data,
 		Expires:   args.Expires,
+		ID:        args.ID,
+		Metadata:  args.Metadata,
+	}
+}
+
+// addDataStatus is the status of a single item of the "/cmd/add" endpoint.
+type addDataStatus string
+
+// Statuses of addDataResp.Statuses.
+const (
+	addDataStatusSuccess         addDataStatus = "success"
+	addDataStatusRejected        addDataStatus = "rejected"
+	addDataStatusInvalidVec      addDataStatus = "rejected-invalid-vec"
+	addDataStatusDimMismatch     addDataStatus = "rejected-dimension"
+	addDataStatusNearDuplicate   addDataStatus = "rejected-near-duplicate"
+	addDataStatusNodeUnreachable addDataStatus = "node-unreachable"
+)
+
+// addDataStatusFromExported converts an ops.AddDataStatus into addDataStatus.
+func addDataStatusFromExported(s ops.AddDataStatus) addDataStatus {
+	switch s {
+	case ops.AddDataOk:
+		return addDataStatusSuccess
+	case ops.AddDataInvalidVec:
+		return addDataStatusInvalidVec
+	case ops.AddDataDimMismatch:
+		return addDataStatusDimMismatch
+	case ops.AddDataNearDuplicate:
+		return addDataStatusNearDuplicate
+	default:
+		return addDataStatusRejected
+	}
+}
+
+// addDataResp is the response of the "/cmd/add" endpoint. Statuses has one
+// status per item in the request (same order), which are summarized with the
+// Succeeded and Failed counts. All data is sent to a single rpc node (see
+// ops.Clients.AddData), which is RemoteAddr. If that node could not be reached,
+// then NetErr is set and all statuses are addDataStatusNodeUnreachable.
+type addDataResp struct {
+	Statuses       []addDataStatus `json:"statuses"`
+	Succeeded      int             `json:"succeeded"`
+	Failed         int             `json:"failed"`
+	RemoteAddr     string          `json:"remoteAddr,omitempty"`
+	NetErr         string          `json:"netErr,omitempty"`
+	NetworkLatency time.Duration   `json:"networkLatency,omitempty"`
+}
+
+// newAddDataResp creates an addDataResp for 'n' items from the results of
+// ops.Clients.AddData. Items without a result (e.g if 'r' is empty, or a
+// node could not be reached) get addDataStatusNodeUnreachable.
+func newAddDataResp(n int, r []clientResult[[]ops.AddDataStatus]) addDataResp {
+	resp := addDataResp{Statuses: make([]addDataStatus, n)}
+	for i := range resp.Statuses {
+		resp.Statuses[i] = addDataStatusNodeUnreachable
+	}
+
+	for _, result := range r {
+		resp.RemoteAddr = result.RemoteAddr
+		resp.NetErr = result.NetErr
+		resp.NetworkLatency = result.NetworkLatency
+		if result.NetErr != "" {
+			continue
+		}
+		for i := 0; i < n && i < len(result.Payload); i++ {
+			resp.Statuses[i] = addDataStatusFromExported(result.Payload[i])
+		}
+	}
+
+	for _, status := range resp.Statuses {
+		if status == addDataStatusSuccess {
+			resp.Succeeded++
+			continue
+		}
+		resp.Failed++
+	}
+	return resp
+}
+
+// deleteOlderThanArgs mirrors the _exported_ T of the same in pkg ops, see docs
+// for that struct for more info. This is defined seperately for struct tags.
+type deleteOlderThanArgs struct {
+	Namespace string        `json:"namespace"`
+	OlderThan time.Duration `json:"olderThan"`
+}
+
+// export converts this instance into its exported equivalent in the ops pkg.
+func (args *deleteOlderThanArgs) export() ops.DeleteOlderThanArgs {
+	return ops.DeleteOlderThanArgs{
+		Namespace: args.Namespace,
+		OlderThan: args.OlderThan,
 	}
 }
 
+// getVectorArgs mirrors the _exported_ T of the same in pkg ops, see docs for
+// that struct for more info. This is defined seperately for struct tags.
+type getVectorArgs struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+}
+
+// export converts this instance into its exported equivalent in the ops pkg.
+func (args *getVectorArgs) export() ops.GetVectorArgs {
+	return ops.GetVectorArgs{
+		Namespace: args.Namespace,
+		ID:        args.ID,
+	}
+}
+
+// getVectorResp mirrors ops.GetVectorResp, where the fields of the vec
+// (requestman.StoredVec) are flattened. The vec fields are omitted if !Found.
+type getVectorResp struct {
+	Found   bool       `json:"found"`
+	ID      string     `json:"id,omitempty"`
+	Vec     []float64  `json:"vec,omitempty"`
+	Data    []byte     `json:"data,omitempty"`
+	Added   *time.Time `json:"added,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// getVectorRespFromExported converts an ops.GetVectorResp into getVectorResp.
+func getVectorRespFromExported(r ops.GetVectorResp) getVectorResp {
+	if !r.Found {
+		return getVectorResp{}
+	}
+	resp := getVectorResp{
+		Found: true,
+		ID:    r.Vec.ID,
+		Vec:   r.Vec.Vec,
+		Data:  r.Vec.Data,
+		Added: &r.Vec.Added,
+	}
+	if !r.Vec.Expires.IsZero() {
+		resp.Expires = &r.Vec.Expires
+	}
+	return resp
+}
+
 // knnArgsPartial is exactly the same as requestmanager.KNNArgs except for the
 // missing QueryVec field. It is re-defined here for two reasons:
 // 1) Struct tags for json.
 // 2) Decoupling the QueryVec field allows for using these KNN args with multiple
 //    different query vecs, making API calls more efficient.
+//
+// There is one addition; Furthest=true requests the K furthest neighbours
+// (e.g the least similar items, for outlier detection). In that case, the
+// Ascending field is ignored, it is instead set for the given KNNMethod (see
+// requestman.KNNMethod.Ascending, or requestman.MetricAscending if the Metric
+// field is set). Note that the meaning of the Accept and Reject fields flip
+// accordingly, as they work on the ordering.
+//
+// Normalize=true sets the Rank and NormScore fields of each knnRespItem, see
+// normalizeKNNResults.
+//
+// SecondarySort re-orders the results of each query vec by another key, see
+// knnSecondarySort. Note that this only changes the order in which results are
+// returned, not which results are selected (that is still by score), e.g the
+// K most similar items can be returned with the most recent first.
 type knnArgsPartial struct {
 	Namespace string         `json:"namespace"`
 	Priority  int            `json:"priority"`
 	KNNMethod rman.KNNMethod `json:"KNNMethod"`
+	Metric    string         `json:"metric"`
 	Ascending bool           `json:"ascending"`
 	K         int            `json:"k"`
 	Extent    float64        `json:"extent"`
@@ -203,6 +504,28 @@ type knnArgsPartial struct {
 	Reject    float64        `json:"reject"`
 	TTL       time.Duration  `json:"ttl"`
 	Monitor   bool           `json:"monitor"`
+
+	ZeroVecMode        mathx.ZeroVecMode `json:"zeroVecMode"`
+	ScoreRoundDecimals int               `json:"scoreRoundDecimals"`
+	MergeSendInterval  int               `json:"mergeSendInterval"`
+	OverFetch          int               `json:"overFetch"`
+	Stats              bool              `json:"stats"`
+
+	DimMismatchFallback bool    `json:"dimMismatchFallback"`
+	DimMismatchScore    float64 `json:"dimMismatchScore"`
+
+	Filter map[string]string `json:"filter"`
+
+	BlockDeadline   time.Duration            `json:"blockDeadline"`
+	OnBlockDeadline knnc.BlockDeadlinePolicy `json:"onBlockDeadline"`
+
+	Furthest   bool    `json:"furthest"`
+	RangeQuery bool    `json:"rangeQuery"`
+	Radius     float64 `json:"radius"`
+	Normalize  bool    `json:"normalize"`
+
+	SecondarySort string `json:"secondarySort"`
+	RandomSeed    int64  `json:"randomSeed"`
 }
 
 // knnArgs is intended as json args/options for the "/cmd/knn" endpoint (method
@@ -216,6 +539,15 @@ type knnArgs struct {
 // export converts this instance into multiple requestmanager.KNNArgs. The fmt
 // is: one KNNArgs per knnArgs.QueryVecs.
 func (args *knnArgs) export() []rman.KNNArgs {
+	ascending := args.Args.Ascending
+	if args.Args.Furthest {
+		ascending = args.Args.KNNMethod.Ascending(true)
+		if args.Args.Metric != "" {
+			// Unregistered metrics are rejected later (KNNArgs.Ok).
+			ascending, _ = rman.MetricAscending(args.Args.Metric, true)
+		}
+	}
+
 	r := make([]rman.KNNArgs, len(args.QueryVecs))
 	for i, vec := range args.QueryVecs {
 		r[i] = rman.KNNArgs{
@@ -223,38 +555,304 @@ func (args *knnArgs) export() []rman.KNNArgs {
 			Priority:  args.Args.Priority,
 			QueryVec:  vec,
 			KNNMethod: args.Args.KNNMethod,
-			Ascending: args.Args.Ascending,
+			Metric:    args.Args.Metric,
+			Ascending: ascending,
 			K:         args.Args.K,
 			Extent:    args.Args.Extent,
 			Accept:    args.Args.Accept,
 			Reject:    args.Args.Reject,
 			TTL:       args.Args.TTL,
 			Monitor:   args.Args.Monitor,
+
+			ZeroVecMode:        args.Args.ZeroVecMode,
+			ScoreRoundDecimals: args.Args.ScoreRoundDecimals,
+			MergeSendInterval:  args.Args.MergeSendInterval,
+			OverFetch:          args.Args.OverFetch,
+			Stats:              args.Args.Stats,
+
+			DimMismatchFallback: args.Args.DimMismatchFallback,
+			DimMismatchScore:    args.Args.DimMismatchScore,
+
+			Filter: args.Args.Filter,
+
+			BlockDeadline:   args.Args.BlockDeadline,
+			OnBlockDeadline: args.Args.OnBlockDeadline,
+
+			RangeQuery: args.Args.RangeQuery,
+			Radius:     args.Args.Radius,
+			RandomSeed: args.Args.RandomSeed,
 		}
 	}
 	return r
 }
 
+// knnBulkArgs is intended as json args/options for the "/cmd/knn/bulk" endpoint
+// (method handle.RPCKNNBulk). All vecs in the QueryNamespace are used as query
+// vecs, with Args (as with knnArgs), where Args.Namespace is the namespace that
+// is queried. Note that Args.TTL is the budget of all queries together.
+type knnBulkArgs struct {
+	QueryNamespace string         `json:"queryNamespace"`
+	Args           knnArgsPartial `json:"args"`
+}
+
 // knnRespItem mirrors the ops.KNNRespItem. It is re-defined for struct tags.
+// The Rank and NormScore fields are only set (else omitted) if the "normalize"
+// field of knnArgsPartial is true, see normalizeKNNResults.
 type knnRespItem struct {
-	Vec   []float64 `json:"vec"`
-	Score float64   `json:"score"`
+	ID        string    `json:"id,omitempty"`
+	Vec       []float64 `json:"vec"`
+	Score     float64   `json:"score"`
+	Added     time.Time `json:"added"`
+	Rank      *int      `json:"rank,omitempty"`
+	NormScore *float64  `json:"normScore,omitempty"`
+}
+
+// knnSecondarySort returns a less func for sorting knnRespItem by the key given
+// as knnArgsPartial.SecondarySort, which is one of the following:
+// - "added": Oldest first, by knnRespItem.Added.
+// - "-added": Most recent first, by knnRespItem.Added.
+// The func is nil if the key is empty (no sorting), the bool is false if the
+// key is unknown.
+func knnSecondarySort(key string) (func(a, b knnRespItem) bool, bool) {
+	switch key {
+	case "":
+		return nil, true
+	case "added":
+		return func(a, b knnRespItem) bool { return a.Added.Before(b.Added) }, true
+	case "-added":
+		return func(a, b knnRespItem) bool { return a.Added.After(b.Added) }, true
+	default:
+		return nil, false
+	}
+}
+
+// normalizeKNNResults sets the Rank and NormScore fields of the payloads in
+// 'results', which are merged KNN results ordered from best to worst (see
+// ops.Clients.KNNEagerx). The rank is the index, i.e the best item has rank 0.
+// The normalized score is the score min-max scaled across 'results' into the
+// range [0, 1], where 1 is the best, regardless of whether the scores are
+// ascending (e.g distances) or not (e.g similarities). All items get 1 if the
+// scores are equal. Note that this is relative to the returned set only, i.e
+// normalized scores are not comparable across queries.
+func normalizeKNNResults(results []clientResult[knnRespItem], ascending bool) {
+	if len(results) == 0 {
+		return
+	}
+
+	min, max := results[0].Payload.Score, results[0].Payload.Score
+	for _, result := range results {
+		min = math.Min(min, result.Payload.Score)
+		max = math.Max(max, result.Payload.Score)
+	}
+
+	for i := range results {
+		rank := i
+		normScore := 1.
+		if max > min {
+			normScore = (results[i].Payload.Score - min) / (max - min)
+			if ascending {
+				normScore = 1 - normScore
+			}
+		}
+		results[i].Payload.Rank = &rank
+		results[i].Payload.NormScore = &normScore
+	}
+}
+
+// newKNNResults converts merged KNN results (see ops.Clients.KNNEagerx) into
+// clientResult[knnRespItem]. They are normalized (see normalizeKNNResults) if
+// 'normalize' is true, then sorted with 'less' (see knnSecondarySort) if it is
+// not nil, such that ranks are by score.
+func newKNNResults(
+	cliResults []*ops.ClientResult[ops.KNNRespItem],
+	ascending bool,
+	normalize bool,
+	less func(a, b knnRespItem) bool,
+) []clientResult[knnRespItem] {
+	r := make([]clientResult[knnRespItem], 0, len(cliResults))
+	for _, cliResult := range cliResults {
+		r = append(r, newClientResult(
+			*cliResult,
+			func(payload ops.KNNRespItem) knnRespItem {
+				return knnRespItem{
+					ID:    payload.ID,
+					Vec:   payload.Vec,
+					Score: payload.Score,
+					Added: payload.Added,
+				}
+			}))
+	}
+	if normalize {
+		normalizeKNNResults(r, ascending)
+	}
+	if less != nil {
+		sort.SliceStable(r, func(i, j int) bool {
+			return less(r[i].Payload, r[j].Payload)
+		})
+	}
+	return r
+}
+
+// knnStats mirrors requestman.KNNStats. It is re-defined for struct tags.
+// The counters of exceptional cases (and Truncated) are omitted when zero.
+type knnStats struct {
+	Candidates   int           `json:"candidates"`
+	Expired      int           `json:"expired,omitempty"`
+	Failed       int           `json:"failed,omitempty"`
+	DimMismatch  int           `json:"dimMismatch,omitempty"`
+	Unmatched    int           `json:"unmatched,omitempty"`
+	Filtered     int           `json:"filtered"`
+	MergeInserts int           `json:"mergeInserts"`
+	WallTime     time.Duration `json:"wallTime"`
+	Truncated    bool          `json:"truncated,omitempty"`
+	Unscanned    int           `json:"unscanned,omitempty"`
+	Exhausted    rman.KNNPhase `json:"exhausted,omitempty"`
+}
+
+// knnStatsFromExported converts a requestman.KNNStats into knnStats.
+func knnStatsFromExported(s rman.KNNStats) knnStats {
+	return knnStats{
+		Candidates:   s.Candidates,
+		Expired:      s.Expired,
+		Failed:       s.Failed,
+		DimMismatch:  s.DimMismatch,
+		Unmatched:    s.Unmatched,
+		Filtered:     s.Filtered,
+		MergeInserts: s.MergeInserts,
+		WallTime:     s.WallTime,
+		Truncated:    s.Truncated,
+		Unscanned:    s.Unscanned,
+		Exhausted:    s.Exhausted,
+	}
 }
 
 // knnResp is similar to ops.KNNResp but modified/expanden for the purposes
 // of this pkg. Specifically, it also contains query vec (from QueryVecs field
-// of T knnArgs _and_ its index for client convenience.
+// of T knnArgs _and_ its index for client convenience. The Stats field has
+// one item per server that processed the query, and is only set if the
+// "stats" field of knnArgsPartial is true.
 type knnResp struct {
 	QueryVec      []float64                   `json:"queryVec"`
 	QueryVecIndex int                         `json:"queryVecIndex"`
 	Results       []clientResult[knnRespItem] `json:"results"`
+	Stats         []clientResult[knnStats]    `json:"stats,omitempty"`
+	// Truncated is true if some of the results were dropped because the
+	// response was too large, see truncateKNNResps.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// retryAfter is the smallest ops.KNNResp.RetryAfter of all rpc servers
+	// that rejected the query, zero if none did.
+	retryAfter time.Duration
+}
+
+// knnBulkResp is the result of a single query vec of the "/cmd/knn/bulk"
+// endpoint (method handle.RPCKNNBulk), i.e the result of one vec in the query
+// namespace, which is identified by QueryID.
+type knnBulkResp struct {
+	QueryID  string                      `json:"queryId"`
+	QueryVec []float64                   `json:"queryVec"`
+	Results  []clientResult[knnRespItem] `json:"results"`
+}
+
+// knnRespsRetryAfter returns the largest knnResp.retryAfter of all resps, and
+// true if there are no results at all while at least one query was rejected.
+func knnRespsRetryAfter(resps []knnResp) (time.Duration, bool) {
+	var retryAfter time.Duration
+	for _, resp := range resps {
+		if len(resp.Results) != 0 {
+			return 0, false
+		}
+		if resp.retryAfter > retryAfter {
+			retryAfter = resp.retryAfter
+		}
+	}
+
+	return retryAfter, retryAfter > 0
+}
+
+// truncateKNNResps drops results from 'resps' (in-place) such that the json
+// encoding of all of them is at most maxBytes, and sets knnResp.Truncated where
+// results were dropped. The best results (by score, regardless of the order of
+// knnResp.Results, see knnSecondarySort) are kept, where the n-th best result
+// of every knnResp is kept before the (n+1)-th best of any, such that no query
+// vec is starved. Note that the size is estimated per result, i.e it is not
+// exact to the byte.
+func truncateKNNResps(resps []knnResp, ascending bool, maxBytes int) {
+	// Size without any results, i.e the fixed cost.
+	budget := maxBytes
+	for _, resp := range resps {
+		resp.Results = []clientResult[knnRespItem]{}
+		b, _ := json.Marshal(resp)
+		budget -= len(b) + 1 // Separator.
+	}
+
+	// Indexes of results per resp, best first.
+	order := make([][]int, len(resps))
+	for i, resp := range resps {
+		order[i] = make([]int, len(resp.Results))
+		for j := range order[i] {
+			order[i][j] = j
+		}
+		results := resp.Results
+		sort.SliceStable(order[i], func(a, b int) bool {
+			if ascending {
+				return results[order[i][a]].Payload.Score < results[order[i][b]].Payload.Score
+			}
+			return results[order[i][a]].Payload.Score > results[order[i][b]].Payload.Score
+		})
+	}
+
+	// Keep the best results of all resps (round-robin) until the budget is spent.
+	keep := make([]map[int]bool, len(resps))
+	for i := range keep {
+		keep[i] = make(map[int]bool)
+	}
+	for rank, full := 0, false; !full; rank++ {
+		full = true
+		for i, resp := range resps {
+			if rank >= len(order[i]) {
+				continue
+			}
+			b, _ := json.Marshal(resp.Results[order[i][rank]])
+			if budget -= len(b) + 1; budget < 0 {
+				full = true
+				break
+			}
+			keep[i][order[i][rank]] = true
+			full = false
+		}
+	}
+
+	for i := range resps {
+		if len(keep[i]) == len(resps[i].Results) {
+			continue
+		}
+		kept := make([]clientResult[knnRespItem], 0, len(keep[i]))
+		for j, result := range resps[i].Results {
+			if keep[i][j] {
+				kept = append(kept, result)
+			}
+		}
+		resps[i].Results = kept
+		resps[i].Truncated = true
+	}
 }
 
 // sSpaceDimResp mirrors the _exported_ T of the same in pkg ops, see docs for
 // that struct for more info. This is defined seperately for struct tags.
 type sSpaceDimResp struct {
-	LookupOk bool `json:"lookupOk"`
-	Dim      int  `json:"dim"`
+	LookupOk  bool `json:"lookupOk"`
+	Dim       int  `json:"dim"`
+	PinnedDim int  `json:"pinnedDim"`
+}
+
+// sSpaceDimRespFromExported converts an ops.SSpaceDimResp into sSpaceDimResp.
+func sSpaceDimRespFromExported(r ops.SSpaceDimResp) sSpaceDimResp {
+	return sSpaceDimResp{
+		LookupOk:  r.LookupOk,
+		Dim:       r.Dim,
+		PinnedDim: r.PinnedDim,
+	}
 }
 
 // sSpaceLenResp mirrors the _exported_ T of the same in pkg ops, see docs for
@@ -265,6 +863,15 @@ type sSpaceLenResp struct {
 	NVecs    int  `json:"nVecs"`
 }
 
+// sSpaceLenRespFromExported converts an ops.SSpaceLenResp into sSpaceLenResp.
+func sSpaceLenRespFromExported(r ops.SSpaceLenResp) sSpaceLenResp {
+	return sSpaceLenResp{
+		LookupOk: r.LookupOk,
+		NSSpaces: r.NSSpaces,
+		NVecs:    r.NVecs,
+	}
+}
+
 // sSpaceCapResp mirrors the _exported_ T of the same in pkg ops, see docs for
 // that struct for more info. This is defined seperately for struct tags.
 type sSpaceCapResp struct {
@@ -272,6 +879,48 @@ type sSpaceCapResp struct {
 	Cap      int  `json:"cap"`
 }
 
+// sSpaceCapRespFromExported converts an ops.SSpaceCapResp into sSpaceCapResp.
+func sSpaceCapRespFromExported(r ops.SSpaceCapResp) sSpaceCapResp {
+	return sSpaceCapResp{
+		LookupOk: r.LookupOk,
+		Cap:      r.Cap,
+	}
+}
+
+// sSpaceBatchResp is the response of the "/info/batch" endpoint for a single
+// namespace. It contains the results of the "/info/dim", "/info/len" and
+// "/info/cap" endpoints. Found is a marker for whether or not the namespace
+// exists on at least one rpc node (i.e any LookupOk is true).
+type sSpaceBatchResp struct {
+	Namespace string                        `json:"namespace"`
+	Found     bool                          `json:"found"`
+	Dim       []clientResult[sSpaceDimResp] `json:"dim"`
+	Len       []clientResult[sSpaceLenResp] `json:"len"`
+	Cap       []clientResult[sSpaceCapResp] `json:"cap"`
+}
+
+// namespaceConsistency is the dimension agreement of a single namespace across
+// rpc nodes, see handle.AdminConsistency.
+type namespaceConsistency struct {
+	Namespace string `json:"namespace"`
+	// Dims is the dimension of the namespace per rpc addr (the pinned one if
+	// set, see ops.SSpaceDimResp). Nodes without the namespace, or where it
+	// is empty and not pinned, are left out as they accept any dimension.
+	Dims map[string]int `json:"dims"`
+	// Consistent is true if all values in Dims are equal.
+	Consistent bool `json:"consistent"`
+}
+
+// consistencyResp is the response of handle.AdminConsistency.
+type consistencyResp struct {
+	// Consistent is true if all namespaces are consistent.
+	Consistent bool                   `json:"consistent"`
+	Namespaces []namespaceConsistency `json:"namespaces"`
+	// Unreachable are the rpc addrs which could not be reached, so they are
+	// not included in the check.
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
 // knnLatencyArgs mirrors ops.KNNLatencyArgs; see docs for that struct for more
 // info. This is redefined seperately for struct tags.
 type knnLatencyArgs struct {
@@ -288,23 +937,293 @@ type knnLatencyResp struct {
 	BoundsOk bool          `json:"boundsOk"`
 }
 
+// normHistogramArgs mirrors ops.NormHistogramArgs; see docs for that struct
+// for more info. This is redefined seperately for struct tags.
+type normHistogramArgs struct {
+	Key     string `json:"key"`
+	Buckets int    `json:"buckets"`
+}
+
+// normHistogramResp mirrors ops.NormHistogramResp, where the fields of
+// requestman.NormHistogram are flattened; see docs for those structs for more
+// info. This is redefined seperately for struct tags.
+type normHistogramResp struct {
+	LookupOk bool    `json:"lookupOk"`
+	N        int     `json:"n"`
+	Zero     int     `json:"zero"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Width    float64 `json:"width"`
+	Counts   []int   `json:"counts"`
+}
+
+// normHistogramRespFromExported converts an ops.NormHistogramResp into
+// normHistogramResp.
+func normHistogramRespFromExported(r ops.NormHistogramResp) normHistogramResp {
+	return normHistogramResp{
+		LookupOk: r.LookupOk,
+		N:        r.Histogram.N,
+		Zero:     r.Histogram.Zero,
+		Min:      r.Histogram.Min,
+		Max:      r.Histogram.Max,
+		Width:    r.Histogram.Width,
+		Counts:   r.Histogram.Counts,
+	}
+}
+
 // knnMonArgs mirrors ops.KNNMonArgs; see docs for that struct for more info.
 // This is redefined seperately for struct tags.
 type knnMonArgs struct {
-	Start time.Time `json:"start"`
-	End   time.Time `json:"end"`
+	Namespace string    `json:"namespace"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
 }
 
 // knnMonItemAvg mirrors _almost requestman.KNNMonItemAvg; see docs for that
 // struct for more info. This is redefined seperately for struct tags.
 // Note, the only difference is that this struct excludes private fields.
 type knnMonItemAvg struct {
-	Created         time.Time     `json:"created"`
-	Span            time.Duration `json:"span"`
-	N               int           `json:"n"`
-	NFailed         int           `json:"nFailed"`
-	AvgLatency      time.Duration `json:"avgLatency"`
-	AvgScore        float64       `json:"avgScore"`
-	AvgScoreNoFails float64       `json:"avgScoreNoFails"`
-	AvgSatisfaction float64       `json:"avgSatisfaction"`
+	Created          time.Time     `json:"created"`
+	Span             time.Duration `json:"span"`
+	N                int           `json:"n"`
+	NFailed          int           `json:"nFailed"`
+	AvgLatency       time.Duration `json:"avgLatency"`
+	AvgScore         float64       `json:"avgScore"`
+	AvgScoreNoFails  float64       `json:"avgScoreNoFails"`
+	AvgSatisfaction  float64       `json:"avgSatisfaction"`
+	SatisfactionHist [5]int        `json:"satisfactionHist"`
+	BoundsOk         bool          `json:"boundsOk"`
+}
+
+// metricsJSONSeries is a single time series in the format of the Grafana JSON
+// (SimpleJSON) datasource. Each datapoint is [value, unix timestamp in ms].
+type metricsJSONSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// metricsJSONPoint makes a datapoint for metricsJSONSeries.
+func metricsJSONPoint(v float64, t time.Time) [2]float64 {
+	return [2]float64{v, float64(t.UnixMilli())}
+}
+
+// sweepMaxConfigs is the max number of configurations in a single sweep, see
+// sweepArgs.configs.
+const sweepMaxConfigs = 1000
+
+// sweepArgs is intended as json args for the "/benchmark/sweep" endpoint (method
+// handle.BenchmarkSweep). Each query vec is queried once per configuration in
+// the grid of Extents x Accepts x Rejects, using Args for everything else. An
+// empty grid dimension means that the corresponding value of Args is used.
+type sweepArgs struct {
+	QueryVecs [][]float64    `json:"queryVecs"`
+	Args      knnArgsPartial `json:"args"`
+	Extents   []float64      `json:"extents"`
+	Accepts   []float64      `json:"accepts"`
+	Rejects   []float64      `json:"rejects"`
+}
+
+// configs returns the grid of sweepArgs as knnArgsPartial, in order of Extents,
+// then Accepts, then Rejects.
+func (args *sweepArgs) configs() []knnArgsPartial {
+	extents, accepts, rejects := args.Extents, args.Accepts, args.Rejects
+	if len(extents) == 0 {
+		extents = []float64{args.Args.Extent}
+	}
+	if len(accepts) == 0 {
+		accepts = []float64{args.Args.Accept}
+	}
+	if len(rejects) == 0 {
+		rejects = []float64{args.Args.Reject}
+	}
+
+	r := make([]knnArgsPartial, 0, len(extents)*len(accepts)*len(rejects))
+	for _, extent := range extents {
+		for _, accept := range accepts {
+			for _, reject := range rejects {
+				config := args.Args
+				config.Extent = extent
+				config.Accept = accept
+				config.Reject = reject
+				r = append(r, config)
+			}
+		}
+	}
+	return r
+}
+
+// sweepResult is the result of a single configuration of a sweep, see sweepArgs.
+type sweepResult struct {
+	Extent float64 `json:"extent"`
+	Accept float64 `json:"accept"`
+	Reject float64 `json:"reject"`
+	// Latency is the mean round-trip latency of the (successful) queries.
+	Latency time.Duration `json:"latency"`
+	// Recall is the mean fraction of the exhaustive-search results that were
+	// also found by the queries.
+	Recall float64 `json:"recall"`
+	// Failed is the number of queries without any results, e.g due to TTL.
+	Failed int `json:"failed"`
+}
+
+// sweepResp is the response of handle.BenchmarkSweep.
+type sweepResp struct {
+	// Results has one item per configuration, in the order of sweepArgs.configs.
+	Results []sweepResult `json:"results"`
+	// Frontier are the Pareto optimal configurations, i.e the ones where no
+	// other configuration is both faster and has a higher (or equal) recall.
+	// It is ordered by latency, so recall increases along it.
+	Frontier []sweepResult `json:"frontier"`
+}
+
+// sweepFrontier returns the speed/accuracy Pareto frontier of 'results', see
+// sweepResp.Frontier. 'results' is not modified.
+func sweepFrontier(results []sweepResult) []sweepResult {
+	sorted := append([]sweepResult(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Latency == sorted[j].Latency {
+			return sorted[i].Recall > sorted[j].Recall
+		}
+		return sorted[i].Latency < sorted[j].Latency
+	})
+
+	r := make([]sweepResult, 0, len(sorted))
+	for _, result := range sorted {
+		if len(r) == 0 || result.Recall > r[len(r)-1].Recall {
+			r = append(r, result)
+		}
+	}
+	return r
+}
+
+// exhaustiveKNNArgs returns 'args' for an exhaustive query, i.e with Extent 1
+// and without Accept and Reject thresholds. This is used for ground truth, see
+// handle.groundTruth.
+func exhaustiveKNNArgs(args knnArgsPartial) knnArgsPartial {
+	args.Extent = 1
+	args.Accept = math.MaxFloat64
+	args.Reject = -math.MaxFloat64
+	// The effective ordering, see knnArgsPartial.Furthest.
+	exported := (&knnArgs{QueryVecs: [][]float64{nil}, Args: args}).export()
+	if exported[0].Ascending {
+		args.Accept, args.Reject = args.Reject, args.Accept
+	}
+	return args
+}
+
+// groundTruthArgs is intended as json args for the "/benchmark/groundtruth"
+// endpoint (method handle.BenchmarkGroundTruth). Each query vec is queried
+// exhaustively with Args, i.e the Extent, Accept and Reject fields of Args are
+// ignored (see exhaustiveKNNArgs).
+type groundTruthArgs struct {
+	QueryVecs [][]float64    `json:"queryVecs"`
+	Args      knnArgsPartial `json:"args"`
+}
+
+// groundTruthResp is the response of handle.BenchmarkGroundTruth.
+type groundTruthResp struct {
+	// Results are the exhaustive KNN results, one slice per query vec (in the
+	// same order as groundTruthArgs.QueryVecs).
+	Results [][]knnRespItem `json:"results"`
+	// Cached is true if the results were served from the cache.
+	Cached bool `json:"cached"`
+}
+
+// sweepRecall returns the fraction of 'truth' that is also in 'found', where
+// vecs are compared by value. Returns false if 'truth' is empty.
+func sweepRecall(found, truth []knnRespItem) (float64, bool) {
+	if len(truth) == 0 {
+		return 0, false
+	}
+	key := func(v []float64) string { return fmt.Sprint(v) }
+	set := make(map[string]bool, len(found))
+	for _, item := range found {
+		set[key(item.Vec)] = true
+	}
+
+	n := 0
+	for _, item := range truth {
+		if set[key(item.Vec)] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(truth)), true
+}
+
+// stabilityDefaultNQueries is used if stabilityArgs.NQueries is 0, and
+// stabilityMaxNQueries is the max of that field.
+const (
+	stabilityDefaultNQueries = 100
+	stabilityMaxNQueries     = 10_000
+)
+
+// stabilityArgs is intended as json args for the "/benchmark/stability" endpoint
+// (method handle.BenchmarkStability). The query vecs are generated from Seed,
+// such that the same args give the same queries. They are done exhaustively
+// with Args (see exhaustiveKNNArgs), such that the results only depend on the
+// data (and the code), not on timing.
+type stabilityArgs struct {
+	Args knnArgsPartial `json:"args"`
+	// Seed for generating the query vecs, see stabilityQueryVecs.
+	Seed int64 `json:"seed"`
+	// NQueries is optional, 0 defaults to stabilityDefaultNQueries.
+	NQueries int `json:"nQueries"`
+	// Dim is optional, 0 defaults to the dim of the namespace.
+	Dim int `json:"dim"`
+}
+
+// stabilityResp is the response of handle.BenchmarkStability.
+type stabilityResp struct {
+	// Digest is a hash of the ordered result IDs of all queries, see
+	// stabilityDigest. It changes if any ranking changes.
+	Digest string `json:"digest"`
+	// QueryDigests has one digest per query, for finding which queries changed.
+	QueryDigests []string `json:"queryDigests"`
+	// Failed is the number of queries without any results (e.g due to TTL),
+	// in which case the digest is not meaningful.
+	Failed int `json:"failed"`
+	// MissingIDs is the number of results without an ID, which are only told
+	// apart by their position (i.e they are equal in the digest).
+	MissingIDs int `json:"missingIds"`
+}
+
+// stabilityQueryVecs returns 'n' query vecs with dimension 'dim' (and elements
+// in [0, 1)), which are the same for the same seed.
+func stabilityQueryVecs(seed int64, n, dim int) [][]float64 {
+	rng := rand.New(rand.NewSource(seed))
+	vecs := make([][]float64, n)
+	for i := range vecs {
+		vecs[i] = make([]float64, dim)
+		for j := range vecs[i] {
+			vecs[i][j] = rng.Float64()
+		}
+	}
+	return vecs
+}
+
+// stabilityDigest returns the digest of 'results' (one slice per query, best
+// first) along with one digest per query, as hex encoded sha256 hashes of the
+// result IDs. Results with an equal score are ordered by ID, such that ties do
+// not depend on which rpc node answered first. 'results' is not modified.
+func stabilityDigest(results [][]knnRespItem) (string, []string) {
+	all := sha256.New()
+	digests := make([]string, len(results))
+	for i, items := range results {
+		items = append([]knnRespItem(nil), items...)
+		// Sort each run of equal scores by ID.
+		for start, end := 0, 0; start < len(items); start = end {
+			for end = start + 1; end < len(items) && items[end].Score == items[start].Score; end++ {
+			}
+			run := items[start:end]
+			sort.Slice(run, func(a, b int) bool { return run[a].ID < run[b].ID })
+		}
+
+		h := sha256.New()
+		for _, item := range items {
+			fmt.Fprintf(h, "%q\n", item.ID)
+		}
+		digests[i] = fmt.Sprintf("%x", h.Sum(nil))
+		fmt.Fprintln(all, digests[i])
+	}
+	return fmt.Sprintf("%x", all.Sum(nil)), digests
 }
@@ -0,0 +1,321 @@
+package api
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types of responses, see responseContentType.
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// responseContentType returns the content type of the response to 'r', based
+// on its Accept header. It is contentTypeMsgpack if the header lists that type
+// (or the unofficial "application/x-msgpack"), and contentTypeJSON otherwise.
+func responseContentType(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == contentTypeMsgpack || mediaType == "application/x-msgpack" {
+			return contentTypeMsgpack
+		}
+	}
+	return contentTypeJSON
+}
+
+// marshalMsgpack encodes 'v' as msgpack (https://msgpack.org), with the same
+// structure as encoding/json would give, such that clients can decode either
+// format into the same types. Specifically:
+// - Structs are maps, keyed by the field names of json struct tags (including
+//   the "-" and "omitempty" options). Embedded structs are not flattened.
+// - Types which implement encoding.TextMarshaler (e.g time.Time) are strings.
+// - Nil pointers, slices, maps and interfaces are nil.
+// - []byte is bin (instead of a base64 string, as with json).
+// - Map keys are strings, where integer keys are formatted as decimals.
+// Other types (e.g channels and funcs) give an error.
+func marshalMsgpack(v any) ([]byte, error) {
+	e := msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+// msgpackEncoder is used by marshalMsgpack, it appends to b.
+type msgpackEncoder struct {
+	b []byte
+}
+
+// textMarshalerType is used for checking if values implement the interface.
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// encode appends the msgpack encoding of 'v', see marshalMsgpack.
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.b = append(e.b, 0xc0)
+		return nil
+	}
+	if v.Type().Implements(textMarshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			e.b = append(e.b, 0xc0)
+			return nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.encodeString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.b = append(e.b, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.b = append(e.b, 0xc3)
+		} else {
+			e.b = append(e.b, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.b = append(e.b, 0xca)
+		e.appendUint32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.b = append(e.b, 0xcb)
+		e.appendUint64(math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.b = append(e.b, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			e.encodeBin(v.Bytes())
+			return nil
+		}
+		e.encodeHeader(v.Len(), 0x90, 15, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type: %v", v.Type())
+	}
+	return nil
+}
+
+// encodeHeader appends the header of a str, array or map with len 'n', where
+// 'fix' is the fix format (for n <= fixMax) and 'b16' and 'b32' are the 16 and
+// 32 bit formats.
+func (e *msgpackEncoder) encodeHeader(n int, fix byte, fixMax int, b16, b32 byte) {
+	switch {
+	case n <= fixMax:
+		e.b = append(e.b, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.b = append(e.b, b16)
+		e.appendUint16(uint16(n))
+	default:
+		e.b = append(e.b, b32)
+		e.appendUint32(uint32(n))
+	}
+}
+
+// appendUint16 appends 'n' as big-endian.
+func (e *msgpackEncoder) appendUint16(n uint16) {
+	e.b = append(e.b, byte(n>>8), byte(n))
+}
+
+// appendUint32 appends 'n' as big-endian.
+func (e *msgpackEncoder) appendUint32(n uint32) {
+	e.b = append(e.b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// appendUint64 appends 'n' as big-endian.
+func (e *msgpackEncoder) appendUint64(n uint64) {
+	e.appendUint32(uint32(n >> 32))
+	e.appendUint32(uint32(n))
+}
+
+// encodeInt appends 'n' with the smallest int format.
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.b = append(e.b, byte(n))
+	case n >= math.MinInt8:
+		e.b = append(e.b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.b = append(e.b, 0xd1)
+		e.appendUint16(uint16(n))
+	case n >= math.MinInt32:
+		e.b = append(e.b, 0xd2)
+		e.appendUint32(uint32(n))
+	default:
+		e.b = append(e.b, 0xd3)
+		e.appendUint64(uint64(n))
+	}
+}
+
+// encodeUint appends 'n' with the smallest uint format.
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= math.MaxInt8:
+		e.b = append(e.b, byte(n))
+	case n <= math.MaxUint8:
+		e.b = append(e.b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.b = append(e.b, 0xcd)
+		e.appendUint16(uint16(n))
+	case n <= math.MaxUint32:
+		e.b = append(e.b, 0xce)
+		e.appendUint32(uint32(n))
+	default:
+		e.b = append(e.b, 0xcf)
+		e.appendUint64(n)
+	}
+}
+
+// encodeString appends 's' with the smallest str format.
+func (e *msgpackEncoder) encodeString(s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		e.b = append(e.b, 0xd9, byte(len(s)))
+	} else {
+		e.encodeHeader(len(s), 0xa0, 31, 0xda, 0xdb)
+	}
+	e.b = append(e.b, s...)
+}
+
+// encodeBin appends 'b' with the smallest bin format.
+func (e *msgpackEncoder) encodeBin(b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		e.b = append(e.b, 0xc4, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		e.b = append(e.b, 0xc5)
+		e.appendUint16(uint16(len(b)))
+	default:
+		e.b = append(e.b, 0xc6)
+		e.appendUint32(uint32(len(b)))
+	}
+	e.b = append(e.b, b...)
+}
+
+// encodeMap appends the map 'v', with keys as strings in sorted order (as with
+// encoding/json).
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	if v.IsNil() {
+		e.b = append(e.b, 0xc0)
+		return nil
+	}
+
+	type kv struct {
+		k string
+		v reflect.Value
+	}
+	kvs := make([]kv, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k := iter.Key()
+		switch k.Kind() {
+		case reflect.String:
+			kvs = append(kvs, kv{k.String(), iter.Value()})
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			kvs = append(kvs, kv{strconv.FormatInt(k.Int(), 10), iter.Value()})
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			kvs = append(kvs, kv{strconv.FormatUint(k.Uint(), 10), iter.Value()})
+		default:
+			return fmt.Errorf("msgpack: unsupported map key type: %v", k.Type())
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].k < kvs[j].k })
+
+	e.encodeHeader(len(kvs), 0x80, 15, 0xde, 0xdf)
+	for _, kv := range kvs {
+		e.encodeString(kv.k)
+		if err := e.encode(kv.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeStruct appends the struct 'v' as a map, see marshalMsgpack.
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	type kv struct {
+		k string
+		v reflect.Value
+	}
+	kvs := make([]kv, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && msgpackIsEmpty(v.Field(i)) {
+			continue
+		}
+		kvs = append(kvs, kv{name, v.Field(i)})
+	}
+
+	e.encodeHeader(len(kvs), 0x80, 15, 0xde, 0xdf)
+	for _, kv := range kvs {
+		e.encodeString(kv.k)
+		if err := e.encode(kv.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackIsEmpty returns true if 'v' is empty as defined by the "omitempty"
+// option of encoding/json.
+func msgpackIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
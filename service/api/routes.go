@@ -1,8 +1,12 @@
 package api
 
 import (
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/crunchypi/ddrop/service/ops"
 	rman "github.com/crunchypi/ddrop/service/requestman"
@@ -12,8 +16,8 @@ import (
 //
 // URL: /ping
 func (h *handle) Ping(w http.ResponseWriter, r *http.Request) {
-	withNetIO(w, r, func(_ struct{}) bool {
-		return true
+	withNetIO(w, r, func(_ struct{}) (bool, error) {
+		return true, nil
 	})
 }
 
@@ -22,8 +26,8 @@ func (h *handle) Ping(w http.ResponseWriter, r *http.Request) {
 //
 // URL: /ops/rpc/addrs/put
 func (h *handle) RPCAddrsPut(w http.ResponseWriter, r *http.Request) {
-	withNetIO(w, r, func(addrs []string) []string {
-		return h.addrSet.addrsMaintanedLocked(addrs...)
+	withNetIO(w, r, func(addrs []string) ([]string, error) {
+		return h.addrSet.addrsMaintanedLocked(addrs...), nil
 	})
 }
 
@@ -32,17 +36,30 @@ func (h *handle) RPCAddrsPut(w http.ResponseWriter, r *http.Request) {
 //
 // URL: /ops/rpc/addrs/get
 func (h *handle) RPCAddrsGet(w http.ResponseWriter, r *http.Request) {
-	withNetIO(w, r, func(_ struct{}) []string {
-		return h.addrSet.addrsMaintanedLocked()
+	withNetIO(w, r, func(_ struct{}) ([]string, error) {
+		return h.addrSet.addrsMaintanedLocked(), nil
+	})
+}
+
+// RPCAddrsRemove removes addresses from the set of rpc addrs (as defined in
+// the /service/ops pkg). Returns a list of all remaining rpc addrs. Note that
+// removed addrs can be added again through gossip with peers, if they still
+// know about them (see StartServerArgs.Peers).
+//
+// URL: /ops/rpc/addrs/remove
+func (h *handle) RPCAddrsRemove(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(addrs []string) ([]string, error) {
+		return h.addrSet.removeLocked(addrs...), nil
 	})
 }
 
 // RPCServerStop tries to stop the internal rpc server (and all embedded knn
-// vector pool / search space data). Will return a status code and msg.
+// vector pool / search space data). Will return a status code and msg. The
+// http status is 409 (with an error in the envelope) if no rpc server runs.
 //
 // URL: /ops/rpc/server/stop
 func (h *handle) RPCServerStop(w http.ResponseWriter, r *http.Request) {
-	withNetIO(w, r, func(_ struct{}) status {
+	withNetIO(w, r, func(_ struct{}) (status, error) {
 		h.rpcServerWrap.mx.Lock()
 		// Not deferring unlock because of double locking mechanism.
 
@@ -50,8 +67,8 @@ func (h *handle) RPCServerStop(w http.ResponseWriter, r *http.Request) {
 		if h.rpcServerWrap.state != rpcServerStateStarted {
 			state := h.rpcServerWrap.state
 			h.rpcServerWrap.mx.Unlock()
-			w.WriteHeader(http.StatusConflict)
-			return state.toStatus()
+			msg := "rpc server can not be stopped (%s)"
+			return state.toStatus(), newAPIError(http.StatusConflict, msg, state.toStatus().Msg)
 		}
 
 		// Outer update and unlock.
@@ -69,73 +86,18 @@ func (h *handle) RPCServerStop(w http.ResponseWriter, r *http.Request) {
 		h.rpcServerWrap.mx.Lock()
 		defer h.rpcServerWrap.mx.Unlock()
 		h.rpcServerWrap.state = rpcServerStateStopped
-		return h.rpcServerWrap.state.toStatus()
+		return h.rpcServerWrap.state.toStatus(), nil
 	})
 }
 
 // RPCServerStop tries to init a new internal rpc server, using rpcServerStartArgs.
-// Will return a status code and msg.
+// Will return a status code and msg. On failure, the envelope contains an error
+// which describes why, see handle.rpcServerStart for the http status codes.
 //
 // URL: /ops/rpc/server/start
 func (h *handle) RPCServerStart(w http.ResponseWriter, r *http.Request) {
-	withNetIO(w, r, func(opts rpcServerStartArgs) status {
-
-		// Validate.
-		conv := opts.Cfg.export(h.ctx)
-		if !conv.Ok() {
-			w.WriteHeader(http.StatusBadRequest)
-			return status{}
-		}
-
-		// Set up new potential server. Doing this here to reduce mutex
-		// locking (and unlocking) complexity further down.
-		newServer, ok := ops.NewServer(opts.Addr, conv)
-		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			return status{}
-		}
-
-		newServerStopF, err := newServer.StartListen()
-		if err != nil {
-			//w.Write([]byte(err.Error()))
-			w.WriteHeader(http.StatusInternalServerError)
-			return status{}
-		}
-
-		// Add the new addr.
-		h.addrSet.addrsMaintanedLocked(opts.Addr)
-
-		// Try starting below.
-		// Not deferring unlock because of double locking mechanism.
-		h.rpcServerWrap.mx.Lock()
-
-		// Only valid state for stopping is "...Default/Stopped".
-		ok = false
-		ok = ok || h.rpcServerWrap.state == rpcServerStateDefault
-		ok = ok || h.rpcServerWrap.state == rpcServerStateStopped
-		if !ok {
-			state := h.rpcServerWrap.state
-			h.rpcServerWrap.mx.Unlock()
-			newServerStopF() // Don't need it anymore.
-			w.WriteHeader(http.StatusConflict)
-			return state.toStatus()
-		}
-
-		// Outer update and unlock.
-		h.rpcServerWrap.state = rpcServerStateStarting
-		h.rpcServerWrap.mx.Unlock()
-
-		// Inner handling. Again, intentionally not deferring unlock.
-		h.rpcServerWrap.inner.mx.Lock()
-		h.rpcServerWrap.inner.server = newServer
-		h.rpcServerWrap.inner.serverStopF = newServerStopF
-		h.rpcServerWrap.inner.mx.Unlock()
-
-		// Outer update since now the state should be "...Started".
-		h.rpcServerWrap.mx.Lock()
-		defer h.rpcServerWrap.mx.Unlock()
-		h.rpcServerWrap.state = rpcServerStateStarted
-		return h.rpcServerWrap.state.toStatus()
+	withNetIO(w, r, func(opts rpcServerStartArgs) (status, error) {
+		return h.rpcServerStart(opts)
 	})
 }
 
@@ -149,31 +111,36 @@ func (h *handle) RPCServerStart(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCPing(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
 	type T = bool
-	withNetIO(w, r, func(opts struct{}) []clientResult[T] {
+	withNetIO(w, r, func(opts struct{}) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
-		ch := ops.NewClients(addrs).Ping()
-		return newClientResults(ch, func(payload T) T { return payload })
+		ch := h.clients(addrs).Ping()
+		return newClientResults(ch, func(payload T) T { return payload }), nil
 	})
 }
 
+// msgNoRPCNodes is the error msg of endpoints which forward to rpc nodes, used
+// when the internal addr set is empty.
+const msgNoRPCNodes = "no rpc nodes registered"
+
 // RPCAddData is an endpoint on top of ops.Clients.AddData().
 // See docs for that method for details.
 //
 // URL: /cmd/add.
 // Addrs: Pulled from internal addr set.
 // Accepts: []addDataArgs.
-// Sends back: []clientResult[[]bool]
+// Sends back: addDataResp, with a status per item and a summary. The status is
+// 503 if the internal addr set is empty, in which case all items are marked as
+// node-unreachable.
 func (h *handle) RPCAddData(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
-	type T = []bool
-	withNetIO(w, r, func(opts []addDataArgs) []clientResult[T] {
+	type T = []ops.AddDataStatus
+	withNetIO(w, r, func(opts []addDataArgs) (addDataResp, error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
 		// ops.Clients.AddData, which is used further down, tries to pick a
 		// random address using rand.Intn, which will panic if len=0.
 		if len(addrs) == 0 {
-			return []clientResult[T]{
-				{Payload: make([]bool, len(opts))},
-			}
+			resp := newAddDataResp(len(opts), nil)
+			return resp, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
 		}
 
 		optsExported := make([]ops.AddDataArgs, 0, len(opts))
@@ -181,8 +148,57 @@ func (h *handle) RPCAddData(w http.ResponseWriter, r *http.Request) {
 			optsExported = append(optsExported, opt.export())
 		}
 
-		ch := ops.NewClients(addrs).AddData(optsExported)
-		return newClientResults(ch, func(payload T) T { return payload })
+		ch := h.clients(addrs).AddData(optsExported)
+		results := newClientResults(ch, func(payload T) T { return payload })
+		return newAddDataResp(len(opts), results), nil
+	})
+}
+
+// RPCGetVector is an endpoint on top of ops.Clients.GetVector().
+// See docs for that method for details.
+//
+// URL: /data/get.
+// Addrs: Pulled from internal addr set.
+// Accepts: getVectorArgs.
+// Sends back: []clientResult[getVectorResp], i.e the vec per rpc addr, where
+// the "found" field is false on the rpc addrs which do not have it. The status
+// is 503 if the internal addr set is empty, and 404 if no rpc addr has the vec.
+func (h *handle) RPCGetVector(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts getVectorArgs) ([]clientResult[getVectorResp], error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return nil, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		ch := h.clients(addrs).GetVector(opts.export())
+		results := newClientResults(ch, getVectorRespFromExported)
+		for _, result := range results {
+			if result.Payload.Found {
+				return results, nil
+			}
+		}
+		msg := "vec %q not found in namespace %q"
+		return results, newAPIError(http.StatusNotFound, msg, opts.ID, opts.Namespace)
+	})
+}
+
+// RPCDeleteOlderThan is an endpoint on top of ops.Clients.DeleteOlderThan().
+// See docs for that method for details.
+//
+// URL: /cmd/delete.
+// Addrs: Pulled from internal addr set.
+// Accepts: deleteOlderThanArgs.
+// Sends back: []clientResult[int], i.e the number of deleted vecs per rpc addr.
+// The status is 503 if the internal addr set is empty.
+func (h *handle) RPCDeleteOlderThan(w http.ResponseWriter, r *http.Request) {
+	// Payload type of return from deferred rpc call clientResult.
+	type T = int
+	withNetIO(w, r, func(opts deleteOlderThanArgs) ([]clientResult[T], error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return nil, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		ch := h.clients(addrs).DeleteOlderThan(opts.export())
+		return newClientResults(ch, func(payload T) T { return payload }), nil
 	})
 }
 
@@ -196,39 +212,64 @@ func (h *handle) RPCAddData(w http.ResponseWriter, r *http.Request) {
 // URL: /cmd/knn.
 // Addrs: Pulled from internal addr set.
 // Accepts: knnArgs.
-// Sends back: []knnResp.
+// Sends back: []knnResp. The status is 503 if the internal addr set is empty,
+// or (with a Retry-After header, in seconds) if no query got results and at
+// least one rpc server rejected a query because its estimated latency exceeded
+// the TTL. The status is 400 if the "secondarySort" field of knnArgsPartial is
+// unknown, see knnSecondarySort. Results are truncated (worst first) if the
+// response would exceed StartServerArgs.MaxKNNRespBytes, see truncateKNNResps.
 func (h *handle) RPCKNNEager(w http.ResponseWriter, r *http.Request) {
-	withNetIO(w, r, func(opts knnArgs) []knnResp {
+	withNetIO(w, r, func(opts knnArgs) ([]knnResp, error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return nil, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		less, ok := knnSecondarySort(opts.Args.SecondarySort)
+		if !ok {
+			msg := "unknown secondary sort: %q"
+			return nil, newAPIError(http.StatusBadRequest, msg, opts.Args.SecondarySort)
+		}
 
 		ch := make(chan knnResp)
 		wg := sync.WaitGroup{}
 		wg.Add(len(opts.QueryVecs))
 
-		for i, knnArgs := range opts.export() {
+		exported := opts.export()
+		for i, knnArgs := range exported {
 			// Per query vec.
 			go func(i int, knnArgs rman.KNNArgs) {
 				defer wg.Done()
 
 				// Gather results from remote rpc servers.
-				knnResults := make([]clientResult[knnRespItem], 0, knnArgs.K)
-				for _, cliResult := range ops.NewClients(addrs).KNNEagerx(knnArgs) {
-					knnResult := newClientResult(
-						*cliResult,
-						func(payload ops.KNNRespItem) knnRespItem {
-							return knnRespItem{
-								Vec:   payload.Vec,
-								Score: payload.Score,
-							}
-						})
-
-					knnResults = append(knnResults, knnResult)
+				cliResults, cliResps := h.clients(addrs).KNNEagerxWithResps(knnArgs)
+				knnResults := newKNNResults(cliResults, knnArgs.Ascending, opts.Args.Normalize, less)
+
+				// Stats are nil (omitted) if they were not requested.
+				var stats []clientResult[knnStats]
+				var retryAfter time.Duration
+				for _, cliResp := range cliResps {
+					payload := cliResp.Payload
+					if payload.Stats != nil {
+						stats = append(stats, newClientResult(
+							*cliResp,
+							func(payload ops.KNNResp) knnStats {
+								return knnStatsFromExported(*payload.Stats)
+							}))
+					}
+					// Smallest hint, as one node is enough for a result.
+					ok := payload.RetryAfter > 0
+					ok = ok && (retryAfter == 0 || payload.RetryAfter < retryAfter)
+					if ok {
+						retryAfter = payload.RetryAfter
+					}
 				}
 
 				ch <- knnResp{
 					QueryVec:      knnArgs.QueryVec,
 					QueryVecIndex: i,
 					Results:       knnResults,
+					Stats:         stats,
+					retryAfter:    retryAfter,
 				}
 			}(i, knnArgs)
 		}
@@ -239,7 +280,79 @@ func (h *handle) RPCKNNEager(w http.ResponseWriter, r *http.Request) {
 		for iKNNResp := range ch {
 			resps = append(resps, iKNNResp)
 		}
-		return resps
+		if h.maxKNNRespBytes > 0 && len(exported) != 0 {
+			truncateKNNResps(resps, exported[0].Ascending, h.maxKNNRespBytes)
+		}
+
+		// All queries were rejected due to load; hint when to retry.
+		if retryAfter, ok := knnRespsRetryAfter(resps); ok {
+			secs := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			msg := "all queries were rejected due to load, retry after %vs"
+			return resps, newAPIError(http.StatusServiceUnavailable, msg, secs)
+		}
+		return resps, nil
+	})
+}
+
+// knnBulkTimeoutMargin is added to the TTL of "/cmd/knn/bulk" requests, for
+// the timeout of the rpc calls (see ops.Clients.KNNBulkx).
+const knnBulkTimeoutMargin = time.Second
+
+// RPCKNNBulk is an endpoint on top of ops.Clients.KNNBulkx(...), see docs for
+// that method for more details. All vecs in the query namespace (gathered from
+// all rpc servers with ops.Clients.NamespaceVecs) are used as query vecs, e.g
+// for precomputing recommendations. Vecs without an ID are skipped, and vecs
+// with the same ID (e.g replicated ones) are only used once. Each rpc server
+// does the queries in batches, which share scans of the data.
+//
+// URL: /cmd/knn/bulk.
+// Addrs: Pulled from internal addr set.
+// Accepts: knnBulkArgs.
+// Sends back: []knnBulkResp, ordered by query ID. The status is 503 if the
+// internal addr set is empty, and 400 if the "secondarySort" field of
+// knnArgsPartial is unknown (see knnSecondarySort).
+func (h *handle) RPCKNNBulk(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts knnBulkArgs) ([]knnBulkResp, error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return nil, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		less, ok := knnSecondarySort(opts.Args.SecondarySort)
+		if !ok {
+			msg := "unknown secondary sort: %q"
+			return nil, newAPIError(http.StatusBadRequest, msg, opts.Args.SecondarySort)
+		}
+
+		// Gather query vecs, unique by ID.
+		queries := make([]rman.NamespaceVec, 0)
+		seen := make(map[string]bool)
+		for cliResult := range h.clients(addrs).NamespaceVecs(opts.QueryNamespace) {
+			for _, vec := range cliResult.Payload {
+				if vec.ID == "" || seen[vec.ID] {
+					continue
+				}
+				seen[vec.ID] = true
+				queries = append(queries, vec)
+			}
+		}
+		sort.Slice(queries, func(i, j int) bool { return queries[i].ID < queries[j].ID })
+
+		// Args are the same for all queries, the query vec is set per query.
+		knnArgs := (&knnArgs{QueryVecs: [][]float64{nil}, Args: opts.Args}).export()[0]
+		clients := h.clients(addrs)
+		clients.Timeout = knnArgs.TTL + knnBulkTimeoutMargin
+		cliResults := clients.KNNBulkx(ops.KNNBulkArgs{Queries: queries, Args: knnArgs})
+
+		resps := make([]knnBulkResp, len(queries))
+		for i, query := range queries {
+			resps[i] = knnBulkResp{
+				QueryID:  query.ID,
+				QueryVec: query.Vec,
+				Results:  newKNNResults(cliResults[i], knnArgs.Ascending, opts.Args.Normalize, less),
+			}
+		}
+		return resps, nil
 	})
 }
 
@@ -252,10 +365,10 @@ func (h *handle) RPCKNNEager(w http.ResponseWriter, r *http.Request) {
 // Sends back: []clientResult[[]string]
 func (h *handle) RPCSSpaceNamespaces(w http.ResponseWriter, r *http.Request) {
 	type T = []string
-	withNetIO(w, r, func(_ struct{}) []clientResult[T] {
+	withNetIO(w, r, func(_ struct{}) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
-		ch := ops.NewClients(addrs).Info().SSpaceNamespaces()
-		return newClientResults(ch, func(payload T) T { return payload })
+		ch := h.clients(addrs).Info().SSpaceNamespaces()
+		return newClientResults(ch, func(payload T) T { return payload }), nil
 	})
 
 }
@@ -270,10 +383,10 @@ func (h *handle) RPCSSpaceNamespaces(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCSSpaceNamespace(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
 	type T = bool
-	withNetIO(w, r, func(opts string) []clientResult[T] {
+	withNetIO(w, r, func(opts string) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
-		ch := ops.NewClients(addrs).Info().SSpaceNamespace(opts)
-		return newClientResults(ch, func(payload T) T { return payload })
+		ch := h.clients(addrs).Info().SSpaceNamespace(opts)
+		return newClientResults(ch, func(payload T) T { return payload }), nil
 	})
 }
 
@@ -287,15 +400,10 @@ func (h *handle) RPCSSpaceNamespace(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCSSpaceDim(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call.
 	type T = sSpaceDimResp
-	withNetIO(w, r, func(opts string) []clientResult[T] {
+	withNetIO(w, r, func(opts string) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
-		ch := ops.NewClients(addrs).Info().SSpaceDim(opts)
-		return newClientResults(ch, func(payload ops.SSpaceDimResp) T {
-			return T{
-				LookupOk: payload.LookupOk,
-				Dim:      payload.Dim,
-			}
-		})
+		ch := h.clients(addrs).Info().SSpaceDim(opts)
+		return newClientResults(ch, sSpaceDimRespFromExported), nil
 	})
 }
 
@@ -309,17 +417,10 @@ func (h *handle) RPCSSpaceDim(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCSSpaceLen(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
 	type T = sSpaceLenResp
-	withNetIO(w, r, func(opts string) []clientResult[T] {
+	withNetIO(w, r, func(opts string) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
-		ch := ops.NewClients(addrs).Info().SSpaceLen(opts)
-
-		return newClientResults(ch, func(payload ops.SSpaceLenResp) T {
-			return T{
-				LookupOk: payload.LookupOk,
-				NSSpaces: payload.NSSpaces,
-				NVecs:    payload.NVecs,
-			}
-		})
+		ch := h.clients(addrs).Info().SSpaceLen(opts)
+		return newClientResults(ch, sSpaceLenRespFromExported), nil
 	})
 }
 
@@ -333,16 +434,40 @@ func (h *handle) RPCSSpaceLen(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCSSpaceCap(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
 	type T = sSpaceCapResp
-	withNetIO(w, r, func(opts string) []clientResult[T] {
+	withNetIO(w, r, func(opts string) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
-		ch := ops.NewClients(addrs).Info().SSpaceCap(opts)
+		ch := h.clients(addrs).Info().SSpaceCap(opts)
+		return newClientResults(ch, sSpaceCapRespFromExported), nil
+	})
+}
 
-		return newClientResults(ch, func(payload ops.SSpaceCapResp) T {
-			return T{
-				LookupOk: payload.LookupOk,
-				Cap:      payload.Cap,
+// RPCSSpaceBatch is an endpoint on top of the SSpaceDim, SSpaceLen and SSpaceCap
+// methods of ops.Clients.Info(), for multiple namespaces in one call. See docs
+// for those methods for details.
+//
+// URL: /info/batch.
+// Addrs: Pulled from internal addr set.
+// Accepts: []string (namespaces).
+// Sends back: []sSpaceBatchResp, one per namespace (in the same order).
+func (h *handle) RPCSSpaceBatch(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts []string) ([]sSpaceBatchResp, error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		info := h.clients(addrs).Info()
+
+		resps := make([]sSpaceBatchResp, 0, len(opts))
+		for _, ns := range opts {
+			resp := sSpaceBatchResp{
+				Namespace: ns,
+				Dim:       newClientResults(info.SSpaceDim(ns), sSpaceDimRespFromExported),
+				Len:       newClientResults(info.SSpaceLen(ns), sSpaceLenRespFromExported),
+				Cap:       newClientResults(info.SSpaceCap(ns), sSpaceCapRespFromExported),
+			}
+			for _, r := range resp.Dim {
+				resp.Found = resp.Found || r.Payload.LookupOk
 			}
-		})
+			resps = append(resps, resp)
+		}
+		return resps, nil
 	})
 }
 
@@ -356,14 +481,14 @@ func (h *handle) RPCSSpaceCap(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCKNNLatency(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
 	type T = knnLatencyResp
-	withNetIO(w, r, func(opts knnLatencyArgs) []clientResult[T] {
+	withNetIO(w, r, func(opts knnLatencyArgs) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
 
 		conv := ops.KNNLatencyArgs{
 			Key:    opts.Key,
 			Period: opts.Period,
 		}
-		ch := ops.NewClients(addrs).Info().KNNLatency(conv)
+		ch := h.clients(addrs).Info().KNNLatency(conv)
 
 		return newClientResults(ch, func(payload ops.KNNLatencyResp) T {
 			return T{
@@ -372,7 +497,34 @@ func (h *handle) RPCKNNLatency(w http.ResponseWriter, r *http.Request) {
 				Query:    payload.Query,
 				BoundsOk: payload.BoundsOk,
 			}
-		})
+		}), nil
+	})
+}
+
+// RPCNormHistogram is an endpoint on top of
+// ops.Clients.Info().NormHistogram(...). See docs for that method for details.
+// The status is 400 if normHistogramArgs.Buckets < 1.
+//
+// URL: /info/norms.
+// Addrs: Pulled from internal addr set.
+// Accepts: normHistogramArgs.
+// Sends back: []clientResult[normHistogramResp].
+func (h *handle) RPCNormHistogram(w http.ResponseWriter, r *http.Request) {
+	// Payload type of return from deferred rpc call clientResult.
+	type T = normHistogramResp
+	withNetIO(w, r, func(opts normHistogramArgs) ([]clientResult[T], error) {
+		if opts.Buckets < 1 {
+			msg := "buckets must be at least 1, got %v"
+			return nil, newAPIError(http.StatusBadRequest, msg, opts.Buckets)
+		}
+		addrs := h.addrSet.addrsMaintanedLocked()
+
+		conv := ops.NormHistogramArgs{
+			Key:     opts.Key,
+			Buckets: opts.Buckets,
+		}
+		ch := h.clients(addrs).Info().NormHistogram(conv)
+		return newClientResults(ch, normHistogramRespFromExported), nil
 	})
 }
 
@@ -386,26 +538,371 @@ func (h *handle) RPCKNNLatency(w http.ResponseWriter, r *http.Request) {
 func (h *handle) RPCKNNMonitor(w http.ResponseWriter, r *http.Request) {
 	// Payload type of return from deferred rpc call clientResult.
 	type T = knnMonItemAvg
-	withNetIO(w, r, func(opts knnMonArgs) []clientResult[T] {
+	withNetIO(w, r, func(opts knnMonArgs) ([]clientResult[T], error) {
 		addrs := h.addrSet.addrsMaintanedLocked()
 
 		conv := ops.KNNMonArgs{
-			Start: opts.Start,
-			End:   opts.End,
+			Namespace: opts.Namespace,
+			Start:     opts.Start,
+			End:       opts.End,
 		}
-		ch := ops.NewClients(addrs).Info().KNNMonitor(conv)
+		ch := h.clients(addrs).Info().KNNMonitor(conv)
 
 		return newClientResults(ch, func(payload rman.KNNMonItemAvg) T {
 			return T{
-				Created:         payload.Created,
-				Span:            payload.Span,
-				N:               payload.N,
-				NFailed:         payload.NFailed,
-				AvgLatency:      payload.AvgLatency,
-				AvgScore:        payload.AvgScore,
-				AvgScoreNoFails: payload.AvgScoreNoFails,
-				AvgSatisfaction: payload.AvgSatisfaction,
+				Created:          payload.Created,
+				Span:             payload.Span,
+				N:                payload.N,
+				NFailed:          payload.NFailed,
+				AvgLatency:       payload.AvgLatency,
+				AvgScore:         payload.AvgScore,
+				AvgScoreNoFails:  payload.AvgScoreNoFails,
+				AvgSatisfaction:  payload.AvgSatisfaction,
+				SatisfactionHist: payload.SatisfactionHist,
+				BoundsOk:         payload.BoundsOk,
+			}
+		}), nil
+	})
+}
+
+// MetricsJSON exports monitoring data of all rpc nodes as time series, in the
+// format of the Grafana JSON (SimpleJSON) datasource. It is done on top of the
+// KNNMonitorSeries, KNNLatency, SSpaceLen and SSpaceCap methods of
+// ops.Clients.Info(), see docs of those for details. Each series is named
+// "<rpc addr>/<metric>", with the following metrics:
+// - knn.n, knn.nFailed, knn.avgLatencyMs, knn.avgScore, knn.avgSatisfaction:
+//   one datapoint per monitor time bucket with KNN requests.
+// - latency.queueMs, latency.queryMs: average latency over the whole period,
+//   as a single datapoint at knnMonArgs.Start.
+// - namespace.nVecs, namespace.cap: a single datapoint at knnMonArgs.Start.
+// Metrics which are specific to a namespace (latency.queryMs, namespace.*) are
+// left out if knnMonArgs.Namespace is empty or unknown to an rpc node.
+//
+// URL: /metrics/json.
+// Addrs: Pulled from internal addr set.
+// Accepts: knnMonArgs.
+// Sends back: []metricsJSONSeries, sorted by target.
+func (h *handle) MetricsJSON(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts knnMonArgs) ([]metricsJSONSeries, error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		info := h.clients(addrs).Info()
+
+		// Key: target, val: series.
+		series := make(map[string]*metricsJSONSeries)
+		add := func(addr, metric string, point [2]float64) {
+			target := addr + "/" + metric
+			s, ok := series[target]
+			if !ok {
+				s = &metricsJSONSeries{Target: target, Datapoints: [][2]float64{}}
+				series[target] = s
+			}
+			s.Datapoints = append(s.Datapoints, point)
+		}
+
+		conv := ops.KNNMonArgs{
+			Namespace: opts.Namespace,
+			Start:     opts.Start,
+			End:       opts.End,
+		}
+		for cliResult := range info.KNNMonitorSeries(conv) {
+			if cliResult.NetErr != nil {
+				continue
+			}
+			addr := cliResult.RemoteAddr
+			for _, item := range cliResult.Payload {
+				ms := float64(item.AvgLatency) / float64(time.Millisecond)
+				add(addr, "knn.n", metricsJSONPoint(float64(item.N), item.Created))
+				add(addr, "knn.nFailed", metricsJSONPoint(float64(item.NFailed), item.Created))
+				add(addr, "knn.avgLatencyMs", metricsJSONPoint(ms, item.Created))
+				add(addr, "knn.avgScore", metricsJSONPoint(item.AvgScore, item.Created))
+				add(addr, "knn.avgSatisfaction", metricsJSONPoint(item.AvgSatisfaction, item.Created))
+			}
+		}
+
+		latencyArgs := ops.KNNLatencyArgs{Key: opts.Namespace, Period: opts.Start.Sub(opts.End)}
+		for cliResult := range info.KNNLatency(latencyArgs) {
+			if cliResult.NetErr != nil {
+				continue
+			}
+			addr := cliResult.RemoteAddr
+			queue := float64(cliResult.Payload.Queue) / float64(time.Millisecond)
+			add(addr, "latency.queueMs", metricsJSONPoint(queue, opts.Start))
+			if cliResult.Payload.LookupOk {
+				query := float64(cliResult.Payload.Query) / float64(time.Millisecond)
+				add(addr, "latency.queryMs", metricsJSONPoint(query, opts.Start))
+			}
+		}
+
+		if opts.Namespace != "" {
+			for cliResult := range info.SSpaceLen(opts.Namespace) {
+				if cliResult.NetErr != nil || !cliResult.Payload.LookupOk {
+					continue
+				}
+				v := float64(cliResult.Payload.NVecs)
+				add(cliResult.RemoteAddr, "namespace.nVecs", metricsJSONPoint(v, opts.Start))
+			}
+			for cliResult := range info.SSpaceCap(opts.Namespace) {
+				if cliResult.NetErr != nil || !cliResult.Payload.LookupOk {
+					continue
+				}
+				v := float64(cliResult.Payload.Cap)
+				add(cliResult.RemoteAddr, "namespace.cap", metricsJSONPoint(v, opts.Start))
 			}
-		})
+		}
+
+		resp := make([]metricsJSONSeries, 0, len(series))
+		for _, s := range series {
+			resp = append(resp, *s)
+		}
+		sort.Slice(resp, func(i, j int) bool { return resp[i].Target < resp[j].Target })
+		return resp, nil
 	})
 }
+
+// AdminConsistency checks that the vec dimension of namespaces agree across all
+// rpc nodes, such that operators can detect drift (e.g namespaces that were
+// created implicitly with different dimensions on different nodes, which
+// silently breaks KNN across nodes). This is done on top of the SSpaceNamespaces
+// and SSpaceDim methods of ops.Clients.Info(), see docs of those for details.
+// The http status is 503 if no rpc nodes are known.
+//
+// URL: /admin/consistency.
+// Addrs: Pulled from internal addr set.
+// Accepts: []string (namespaces), all namespaces on any rpc node if empty.
+// Sends back: consistencyResp.
+func (h *handle) AdminConsistency(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts []string) (consistencyResp, error) {
+		resp := consistencyResp{Consistent: true, Namespaces: []namespaceConsistency{}}
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return resp, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		info := h.clients(addrs).Info()
+		unreachable := make(map[string]bool)
+
+		namespaces := opts
+		if len(namespaces) == 0 {
+			seen := make(map[string]bool)
+			for clientResult := range info.SSpaceNamespaces() {
+				if clientResult.NetErr != nil {
+					unreachable[clientResult.RemoteAddr] = true
+					continue
+				}
+				for _, ns := range clientResult.Payload {
+					if !seen[ns] {
+						seen[ns] = true
+						namespaces = append(namespaces, ns)
+					}
+				}
+			}
+			sort.Strings(namespaces)
+		}
+
+		for _, ns := range namespaces {
+			nsc := namespaceConsistency{
+				Namespace:  ns,
+				Dims:       make(map[string]int),
+				Consistent: true,
+			}
+			dim := 0
+			for clientResult := range info.SSpaceDim(ns) {
+				if clientResult.NetErr != nil {
+					unreachable[clientResult.RemoteAddr] = true
+					continue
+				}
+				d := clientResult.Payload.Dim
+				if clientResult.Payload.PinnedDim != 0 {
+					d = clientResult.Payload.PinnedDim
+				}
+				if !clientResult.Payload.LookupOk || d == 0 {
+					continue
+				}
+
+				nsc.Dims[clientResult.RemoteAddr] = d
+				nsc.Consistent = nsc.Consistent && (dim == 0 || dim == d)
+				dim = d
+			}
+			resp.Consistent = resp.Consistent && nsc.Consistent
+			resp.Namespaces = append(resp.Namespaces, nsc)
+		}
+
+		for addr := range unreachable {
+			resp.Unreachable = append(resp.Unreachable, addr)
+		}
+		sort.Strings(resp.Unreachable)
+		return resp, nil
+	})
+}
+
+// BenchmarkSweep runs the given query vecs with each configuration in a grid of
+// Extent/Accept/Reject values (see sweepArgs), and reports the mean latency and
+// recall per configuration, along with the speed/accuracy Pareto frontier. The
+// recall is relative to an exhaustive query (Extent 1, without Accept and
+// Reject thresholds) of each query vec, which is cached (see
+// handle.groundTruth). Queries are done one at a time, such that they do not
+// compete with each other, so a sweep can take a while. This
+// is done on top of ops.Clients.KNNEagerx. The http status is 503 if no rpc
+// nodes are known, and 400 if there are no query vecs or more than 1000
+// configurations.
+//
+// URL: /benchmark/sweep.
+// Addrs: Pulled from internal addr set.
+// Accepts: sweepArgs.
+// Sends back: sweepResp.
+func (h *handle) BenchmarkSweep(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts sweepArgs) (sweepResp, error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return sweepResp{}, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		configs := opts.configs()
+		if len(opts.QueryVecs) == 0 || len(configs) > sweepMaxConfigs {
+			msg := "a sweep needs at least one query vec and at most %v configurations"
+			return sweepResp{}, newAPIError(http.StatusBadRequest, msg, sweepMaxConfigs)
+		}
+		cs := h.clients(addrs)
+		truth, _ := h.groundTruth(cs, opts.QueryVecs, opts.Args)
+
+		resp := sweepResp{Results: make([]sweepResult, len(configs))}
+		for i, config := range configs {
+			result := sweepResult{
+				Extent: config.Extent,
+				Accept: config.Accept,
+				Reject: config.Reject,
+			}
+			found, latencies := sweepQuery(cs, opts.QueryVecs, config)
+			nRecall, nLatency := 0, 0
+			for j := range found {
+				if len(found[j]) == 0 {
+					result.Failed++
+					continue
+				}
+				// Running means.
+				nLatency++
+				result.Latency += (latencies[j] - result.Latency) / time.Duration(nLatency)
+				if recall, ok := sweepRecall(found[j], truth[j]); ok {
+					nRecall++
+					result.Recall += (recall - result.Recall) / float64(nRecall)
+				}
+			}
+			resp.Results[i] = result
+		}
+
+		resp.Frontier = sweepFrontier(resp.Results)
+		return resp, nil
+	})
+}
+
+// BenchmarkGroundTruth computes the exact (exhaustive) KNN results of the given
+// query vecs, e.g for evaluating the recall of other queries. The results are
+// cached, such that repeated requests with the same query vecs and args are not
+// recomputed while the namespace is unchanged, see handle.groundTruth. Queries
+// are done one at a time, on top of ops.Clients.KNNEagerx. The http status is
+// 503 if no rpc nodes are known, and 400 if there are no query vecs.
+//
+// URL: /benchmark/groundtruth.
+// Addrs: Pulled from internal addr set.
+// Accepts: groundTruthArgs.
+// Sends back: groundTruthResp.
+func (h *handle) BenchmarkGroundTruth(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts groundTruthArgs) (groundTruthResp, error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return groundTruthResp{}, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		if len(opts.QueryVecs) == 0 {
+			msg := "ground truth needs at least one query vec"
+			return groundTruthResp{}, newAPIError(http.StatusBadRequest, msg)
+		}
+
+		results, cached := h.groundTruth(h.clients(addrs), opts.QueryVecs, opts.Args)
+		return groundTruthResp{Results: results, Cached: cached}, nil
+	})
+}
+
+// BenchmarkStability runs a fixed set of query vecs, generated from a seed (see
+// stabilityArgs), and returns a digest of the ordered result IDs. The digest is
+// the same across runs while the data is unchanged, so it can be compared
+// before and after a code change to detect changes of rankings (e.g in CI).
+// Queries are done one at a time and exhaustively, on top of
+// ops.Clients.KNNEagerx. The http status is 503 if no rpc nodes are known, and
+// 400 if stabilityArgs.NQueries is out of range (see stabilityMaxNQueries) or
+// if the dim of the query vecs is unknown, i.e stabilityArgs.Dim is not set
+// and the namespace does not exist.
+//
+// URL: /benchmark/stability.
+// Addrs: Pulled from internal addr set.
+// Accepts: stabilityArgs.
+// Sends back: stabilityResp.
+func (h *handle) BenchmarkStability(w http.ResponseWriter, r *http.Request) {
+	withNetIO(w, r, func(opts stabilityArgs) (stabilityResp, error) {
+		addrs := h.addrSet.addrsMaintanedLocked()
+		if len(addrs) == 0 {
+			return stabilityResp{}, newAPIError(http.StatusServiceUnavailable, msgNoRPCNodes)
+		}
+		if opts.NQueries == 0 {
+			opts.NQueries = stabilityDefaultNQueries
+		}
+		if opts.NQueries < 0 || opts.NQueries > stabilityMaxNQueries {
+			msg := "the number of queries must be between 1 and %v"
+			return stabilityResp{}, newAPIError(http.StatusBadRequest, msg, stabilityMaxNQueries)
+		}
+
+		cs := h.clients(addrs)
+		if opts.Dim == 0 {
+			for r := range cs.Info().SSpaceDim(opts.Args.Namespace) {
+				if r.NetErr == nil && r.Payload.LookupOk && r.Payload.Dim > 0 {
+					opts.Dim = r.Payload.Dim
+				}
+			}
+		}
+		if opts.Dim <= 0 {
+			msg := "unknown dim of namespace %q"
+			return stabilityResp{}, newAPIError(http.StatusBadRequest, msg, opts.Args.Namespace)
+		}
+
+		vecs := stabilityQueryVecs(opts.Seed, opts.NQueries, opts.Dim)
+		results, _ := sweepQuery(cs, vecs, exhaustiveKNNArgs(opts.Args))
+		resp := stabilityResp{}
+		resp.Digest, resp.QueryDigests = stabilityDigest(results)
+		for _, items := range results {
+			if len(items) == 0 {
+				resp.Failed++
+			}
+			for _, item := range items {
+				if item.ID == "" {
+					resp.MissingIDs++
+				}
+			}
+		}
+		return resp, nil
+	})
+}
+
+// sweepQuery does a KNN query (ops.Clients.KNNEagerx) per vec in 'vecs' using
+// 'args', one at a time. Returns the results and round-trip latency per vec,
+// where the results are empty if a query failed.
+func sweepQuery(
+	cs *ops.Clients,
+	vecs [][]float64,
+	args knnArgsPartial,
+) (
+	[][]knnRespItem,
+	[]time.Duration,
+) {
+	found := make([][]knnRespItem, len(vecs))
+	latencies := make([]time.Duration, len(vecs))
+	for i, knnArgs := range (&knnArgs{QueryVecs: vecs, Args: args}).export() {
+		start := time.Now()
+		cliResults := cs.KNNEagerx(knnArgs)
+		latencies[i] = time.Since(start)
+		for _, cliResult := range cliResults {
+			found[i] = append(found[i], knnRespItem{
+				ID:    cliResult.Payload.ID,
+				Vec:   cliResult.Payload.Vec,
+				Score: cliResult.Payload.Score,
+			})
+		}
+	}
+	return found, latencies
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -50,13 +51,21 @@ func freeLocalNoFail(t *testing.T) string {
 
 // post is a convenience func on top of http.Post, which provides simple-to-use
 // generic syntax. It simply tries to encode "data" into a json, post it to the
-// url, then attempts to unpack the response from a json into an instance of T
-// which is to be returned. The error is not nil on these conditions:
+// url, then attempts to unpack the data of the response envelope (see envelope)
+// from a json into an instance of T which is to be returned. The error is not
+// nil on these conditions:
 // - "data" cannot be encoded into a json.
 // - http.Post(...) returns an error.
 // - T cannot be decoded from a json.
 func post[T any](url string, data any) (T, error) {
-	var r T
+	r, err := postEnvelope[T](url, data)
+	return r.Data, err
+}
+
+// postEnvelope is the same as post, except that it returns the whole response
+// envelope, i.e the data along with the error msg and status code.
+func postEnvelope[T any](url string, data any) (envelope[T], error) {
+	var r envelope[T]
 
 	// Encode send data.
 	b, err := json.Marshal(data)
@@ -78,6 +87,185 @@ func post[T any](url string, data any) (T, error) {
 	return r, json.Unmarshal(b, &r)
 }
 
+// postMsgpack is the same as postEnvelope, except that it asks for a msgpack
+// response (with the Accept header) and decodes it with unmarshalMsgpack. The
+// msgpack is decoded into T through json, i.e T should have json struct tags.
+// Errors if the Content-Type of the response is not msgpack.
+func postMsgpack[T any](url string, data any) (envelope[T], error) {
+	var r envelope[T]
+
+	// Encode send data.
+	b, err := json.Marshal(data)
+	if err != nil {
+		return r, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(b))
+	if err != nil {
+		return r, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", contentTypeMsgpack)
+
+	// Post and get reply.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != contentTypeMsgpack {
+		return r, fmt.Errorf("unexpected content type: %q", contentType)
+	}
+
+	// Decode end return data.
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return r, err
+	}
+	v, err := unmarshalMsgpack(b)
+	if err != nil {
+		return r, err
+	}
+	if b, err = json.Marshal(v); err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(b, &r)
+}
+
+// unmarshalMsgpack decodes a msgpack value (e.g from marshalMsgpack) into
+// generic Go values, i.e nil, bool, int64, uint64, float64, string, []byte,
+// []any and map[string]any. Errors if 'b' is not a single valid value.
+func unmarshalMsgpack(b []byte) (any, error) {
+	d := msgpackDecoder{b: b}
+	v, err := d.decode()
+	if err == nil && d.i != len(b) {
+		err = errors.New("msgpack: trailing data")
+	}
+	return v, err
+}
+
+// msgpackDecoder is used by unmarshalMsgpack, it reads b from index i.
+type msgpackDecoder struct {
+	b []byte
+	i int
+}
+
+// next reads the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.i+n > len(d.b) {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	d.i += n
+	return d.b[d.i-n : d.i], nil
+}
+
+// uint reads an n byte big-endian uint.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	var r uint64
+	for _, x := range b {
+		r = r<<8 | uint64(x)
+	}
+	return r, err
+}
+
+// decode reads the next value, see unmarshalMsgpack.
+func (d *msgpackDecoder) decode() (any, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+
+	// Lengths of str, bin, array and map.
+	var n uint64
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		b, err := d.next(int(t & 0x1f))
+		return string(b), err
+	case t&0xf0 == 0x90:
+		return d.decodeArray(int(t & 0x0f))
+	case t&0xf0 == 0x80:
+		return d.decodeMap(int(t & 0x0f))
+	case t == 0xc0:
+		return nil, nil
+	case t == 0xc2 || t == 0xc3:
+		return t == 0xc3, nil
+	case t >= 0xcc && t <= 0xcf:
+		return d.uint(1 << (t - 0xcc))
+	case t >= 0xd0 && t <= 0xd3:
+		size := 1 << (t - 0xd0)
+		u, err := d.uint(size)
+		// Sign extend.
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, err
+	case t == 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case t == 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case t >= 0xd9 && t <= 0xdb:
+		if n, err = d.uint(1 << (t - 0xd9)); err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		return string(b), err
+	case t >= 0xc4 && t <= 0xc6:
+		if n, err = d.uint(1 << (t - 0xc4)); err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		return append([]byte{}, b...), err
+	case t == 0xdc || t == 0xdd:
+		if n, err = d.uint(2 << (t - 0xdc)); err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case t == 0xde || t == 0xdf:
+		if n, err = d.uint(2 << (t - 0xde)); err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format: %#x", t)
+}
+
+// decodeArray reads n values.
+func (d *msgpackDecoder) decodeArray(n int) ([]any, error) {
+	r := make([]any, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, v)
+	}
+	return r, nil
+}
+
+// decodeMap reads n key-value pairs, where keys must be strings.
+func (d *msgpackDecoder) decodeMap(n int) (map[string]any, error) {
+	r := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: unsupported map key: %v", k)
+		}
+		if r[key], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
 // randFloat64Slice returns a random float slice with the given dimension.
 // Will return (nil, false) if the dimension is not a positive integer.
 func randFloat64Slice(dim int) ([]float64, bool) {
@@ -158,12 +346,13 @@ func newTestNode(t *testing.T) testNode {
 // - newKNNMonitor.MinChainLinkSize         : 1s,
 //
 func (tn *testNode) startRPC() error {
-	if tn.handle == nil {
-		return errors.New("internal handle not set")
-	}
+	return tn.startRPCWithArgs(newTestRequestManagerHandleArgs())
+}
 
-	// Try setup and start new rpc server.
-	args := newRequestManagerHandleArgs{
+// newTestRequestManagerHandleArgs returns the args used in testNode.startRPC,
+// see docs for that method for the field values.
+func newTestRequestManagerHandleArgs() newRequestManagerHandleArgs {
+	return newRequestManagerHandleArgs{
 		NewSearchSpacesArgs: newSearchSpacesArgs{
 			SearchSpacesMaxCap:      10_000,
 			SearchSpacesMaxN:        100,
@@ -182,6 +371,16 @@ func (tn *testNode) startRPC() error {
 			StandardPeriod:   time.Second,
 		},
 	}
+}
+
+// startRPCWithArgs is the same as testNode.startRPC, except that the given args
+// are used for the requestman.Handle of the new ops.Server.
+func (tn *testNode) startRPCWithArgs(args newRequestManagerHandleArgs) error {
+	if tn.handle == nil {
+		return errors.New("internal handle not set")
+	}
+
+	// Try setup and start new rpc server.
 	s, ok := ops.NewServer(tn.addrRPC, args.export(tn.handle.ctx))
 	if !ok {
 		return errors.New("could not set up a new ops.Server")
@@ -250,7 +449,7 @@ func (tn *testNetwork) startRPC() error {
 // - n <= 0.
 // - The AddData method, as described above, returns nil.
 // - The ops.SResp (used as response args ptr of the AddData method) contains any
-//   bools indicating that data could not be added.
+//   statuses indicating that data could not be added.
 func (tn *testNetwork) fill(ns string, n, dim int) {
 	for _, node := range tn.nodes {
 		node.handle.rpcServerWrap.mx.Lock()
@@ -270,15 +469,15 @@ func (tn *testNetwork) fill(ns string, n, dim int) {
 		}
 
 		sArgs := ops.SArgs[[]ops.AddDataArgs]{Payload: addDataArgs}
-		sResp := ops.SResp[[]bool]{Payload: make([]bool, 0, 1)}
+		sResp := ops.SResp[[]ops.AddDataStatus]{}
 
 		err := node.handle.rpcServerWrap.inner.server.AddData(sArgs, &sResp)
 		if err != nil {
 			panic(err)
 		}
-		for _, b := range sResp.Payload {
-			if !b {
-				panic("got false bool resp from ops.Server.AddData")
+		for _, status := range sResp.Payload {
+			if status != ops.AddDataOk {
+				panic("got not-ok status from ops.Server.AddData: " + status.String())
 			}
 		}
 	}
@@ -336,3 +535,72 @@ func withNetwork(t *testing.T, numNodes int, rcv func(tn *testNetwork)) {
 	}
 	rcv(&tNetwork)
 }
+
+// gossipNodes is a set of testNode instances which are set up with seed lists
+// (StartServerArgs.Peers) and rpc servers. Set up with newGossipNodes(...).
+type gossipNodes struct {
+	nodes []*testNode
+	stop  func()
+}
+
+// newGossipNodes sets up len(peers) testNode instances, each with an rpc server
+// (started with StartServerArgs.RPCServerStart and newTestRequestManagerHandleArgs)
+// and an addrSet update frequency of 50ms. 'peers' specifies the seed list of
+// each node, as indexes of other nodes. Note, rpc addrs are not put manually
+// into the addrSets, so that is only done through gossip.
+func newGossipNodes(t *testing.T, peers [][]int) gossipNodes {
+	nodes := make([]*testNode, len(peers))
+	for i := range nodes {
+		nodes[i] = &testNode{
+			addrAPI: "localhost" + freeLocalNoFail(t),
+			addrRPC: freeLocalNoFail(t),
+		}
+	}
+
+	ctx, ctxStop := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(len(nodes))
+	for i, n := range nodes {
+		rpcCfg, err := json.Marshal(rpcServerStartArgs{
+			Addr: n.addrRPC,
+			Cfg:  newTestRequestManagerHandleArgs(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seeds := make([]string, 0, len(peers[i]))
+		for _, j := range peers[i] {
+			seeds = append(seeds, nodes[j].addrAPI)
+		}
+
+		n.stopF = ctxStop
+		go func(n *testNode) {
+			StartServer(StartServerArgs{
+				Addr:                   n.addrAPI,
+				Ctx:                    ctx,
+				ReadTimeout:            time.Minute,
+				WriteTimeout:           time.Minute,
+				UpdateFrequencyAddrSet: time.Millisecond * 50,
+				RPCServerStart:         rpcCfg,
+				Peers:                  seeds,
+				onRunning:              func(h *handle) { n.handle = h; wg.Done() },
+			})
+		}(n)
+	}
+	wg.Wait()
+
+	return gossipNodes{nodes: nodes, stop: ctxStop}
+}
+
+// waitForAddrs waits (up to ~1s) until the addrSet of the given node has 'n'
+// addrs. Returns false on timeout.
+func (gn *gossipNodes) waitForAddrs(node *testNode, n int) bool {
+	for i := 0; i < 100; i++ {
+		if len(node.handle.addrSet.addrsMaintanedLocked()) == n {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
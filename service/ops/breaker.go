@@ -0,0 +1,159 @@
+package ops
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is used as ClientResult.NetErr when a call was not attempted
+// because the circuit of the remote addr is open, see CircuitBreaker.
+var ErrCircuitOpen = errors.New("ops: circuit open for remote addr")
+
+// CircuitState is the state of a circuit (per remote addr) in CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state where calls are attempted.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen is the state where calls fail fast without dialing.
+	CircuitOpen
+	// CircuitHalfOpen is the state where a single probe call is attempted,
+	// which decides whether the circuit closes again or re-opens.
+	CircuitHalfOpen
+)
+
+// String returns a human-readable name of the CircuitState.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// NewCircuitBreakerArgs is intended as args for NewCircuitBreaker.
+type NewCircuitBreakerArgs struct {
+	// FailThreshold is the number of consecutive failures before a circuit
+	// goes from closed to open. Must be > 0.
+	FailThreshold int
+	// OpenTimeout is how long a circuit stays open before it goes half-open,
+	// i.e allows a single probe call. Must be > 0.
+	OpenTimeout time.Duration
+}
+
+// Ok returns true if:
+//  args.FailThreshold > 0
+//  args.OpenTimeout > 0
+func (args *NewCircuitBreakerArgs) Ok() bool {
+	ok := true
+	ok = ok && args.FailThreshold > 0
+	ok = ok && args.OpenTimeout > 0
+	return ok
+}
+
+// circuit is the state of a single remote addr in CircuitBreaker.
+type circuit struct {
+	state    CircuitState
+	fails    int
+	openedAt time.Time
+}
+
+// CircuitBreaker keeps a circuit per remote addr, which prevents cascading
+// latency when remote nodes are down. Circuits are closed by default (normal),
+// open after NewCircuitBreakerArgs.FailThreshold consecutive failures (calls
+// fail fast with ErrCircuitOpen, without dialing), then go half-open after
+// NewCircuitBreakerArgs.OpenTimeout. While half-open, a single probe call is
+// allowed; a success closes the circuit while a failure re-opens it. It is
+// intended to be shared between Clients instances (see Clients.Breaker).
+type CircuitBreaker struct {
+	mx       sync.Mutex
+	circuits map[string]*circuit
+	args     NewCircuitBreakerArgs
+}
+
+// NewCircuitBreaker is a factory func for CircuitBreaker.
+// Returns false if args.Ok() == false.
+func NewCircuitBreaker(args NewCircuitBreakerArgs) (*CircuitBreaker, bool) {
+	if !args.Ok() {
+		return nil, false
+	}
+	cb := CircuitBreaker{
+		circuits: make(map[string]*circuit),
+		args:     args,
+	}
+	return &cb, true
+}
+
+// State returns the current CircuitState of the given addr. Note that an open
+// circuit is reported as half-open once NewCircuitBreakerArgs.OpenTimeout has
+// passed, even before a probe is attempted.
+func (cb *CircuitBreaker) State(addr string) CircuitState {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+
+	c, ok := cb.circuits[addr]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= cb.args.OpenTimeout {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// allow returns true if a call to the given addr should be attempted. An open
+// circuit goes half-open here if the timeout has passed, in which case true is
+// returned for the caller (the probe) only.
+func (cb *CircuitBreaker) allow(addr string) bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+
+	c, ok := cb.circuits[addr]
+	if !ok {
+		return true
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < cb.args.OpenTimeout {
+			return false
+		}
+		c.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// A probe is already in flight.
+		return false
+	default:
+		return true
+	}
+}
+
+// register registers the outcome of a call to the given addr, which was allowed
+// with CircuitBreaker.allow. A nil 'err' is a success.
+func (cb *CircuitBreaker) register(addr string, err error) {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+
+	if err == nil {
+		delete(cb.circuits, addr)
+		return
+	}
+
+	c, ok := cb.circuits[addr]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[addr] = c
+	}
+
+	c.fails++
+	if c.state == CircuitHalfOpen || c.fails >= cb.args.FailThreshold {
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+	}
+}
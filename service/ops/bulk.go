@@ -0,0 +1,270 @@
+package ops
+
+import (
+	"time"
+
+	rman "github.com/crunchypi/ddrop/service/requestman"
+)
+
+/*
+File contains bulk KNN, i.e KNN for many query vecs with a single call, e.g for
+precomputing the neighbors of all vecs in a namespace (see Clients.KNNBulkx and
+Clients.NamespaceVecs). Queries are done in batches with requestman.Handle.KNNBatch,
+such that each batch shares a single scan of the data.
+*/
+
+// knnBulkBatchSize is the max amount of queries in each
+// requestman.Handle.KNNBatch call done by Server.KNNBulk.
+const knnBulkBatchSize = 64
+
+// KNNBulkArgs is intended as args for Client.KNNBulk.
+type KNNBulkArgs struct {
+	// Queries are the query vecs, their IDs are kept in the results.
+	Queries []rman.NamespaceVec
+	// Args are used for all queries, except that Args.QueryVec is ignored. Note
+	// that Args.TTL is the budget of all queries together, not of each query.
+	Args rman.KNNArgs
+}
+
+// KNNBulkItem is the result of a single query done with Client.KNNBulk.
+type KNNBulkItem struct {
+	// ID is the ID of the query vec, see KNNBulkArgs.Queries.
+	ID  string
+	KNN []KNNRespItem
+	// Ok is false if the query was not done, e.g if the TTL ran out or if the
+	// batch of the query was rejected (see requestman.Handle.KNNBatch).
+	Ok bool
+}
+
+// KNNBulk does KNN with all args.Payload.Queries, using the internal
+// requestman.Handle.KNNBatch method for batches of queries. The response
+// contains one KNNBulkItem per query, in the same order as the queries.
+func (s *Server) KNNBulk(args SArgs[KNNBulkArgs], resp *SResp[[]KNNBulkItem]) error {
+	resp.RecvTime = time.Now()
+
+	// Factor network latency into TTL.
+	deadline := resp.RecvTime.Add(args.Payload.Args.TTL - resp.RecvTime.Sub(args.SendTime))
+
+	queries := args.Payload.Queries
+	resp.Payload = make([]KNNBulkItem, len(queries))
+	for i, query := range queries {
+		resp.Payload[i].ID = query.ID
+	}
+
+	for start := 0; start < len(queries); start += knnBulkBatchSize {
+		ttl := time.Until(deadline)
+		if ttl <= 0 {
+			return nil
+		}
+
+		end := start + knnBulkBatchSize
+		if end > len(queries) {
+			end = len(queries)
+		}
+		batch := make([]rman.KNNArgs, end-start)
+		for i := range batch {
+			batch[i] = args.Payload.Args
+			batch[i].QueryVec = queries[start+i].Vec
+			batch[i].TTL = ttl
+		}
+
+		enqueueResults, ok := s.rManHandle.KNNBatch(batch)
+		if !ok {
+			continue
+		}
+		s.awaitKNNBulk(enqueueResults, resp.Payload[start:end], deadline)
+	}
+
+	return nil
+}
+
+// awaitKNNBulk awaits the results of a batch of queries (as returned by
+// requestman.Handle.KNNBatch) until the deadline, and puts them into 'items',
+// which is expected to have the same len. Queries which are not done at the
+// deadline are cancelled.
+func (s *Server) awaitKNNBulk(
+	enqueueResults []rman.KNNEnqueueResult,
+	items []KNNBulkItem,
+	deadline time.Time,
+) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for i, enqueueResult := range enqueueResults {
+		select {
+		case result, open := <-enqueueResult.Pipe:
+			if !open {
+				continue
+			}
+			items[i].KNN = KNNRespItemsFromScoreItems(result)
+			items[i].Ok = true
+		case <-timer.C:
+			for _, enqueueResult := range enqueueResults[i:] {
+				enqueueResult.Cancel.Cancel()
+			}
+			return
+		}
+	}
+}
+
+// NamespaceVecs gets all vecs of a namespace with the internal
+// requestman.Handle.Info().SSpaceVecs(ns) method, where args.Payload is ns.
+func (s *Server) NamespaceVecs(args SArgs[string], resp *SResp[[]rman.NamespaceVec]) error {
+	resp.RecvTime = time.Now()
+	resp.Payload, _ = s.rManHandle.Info().SSpaceVecs(args.Payload)
+	return nil
+}
+
+// KNNBulk does KNN on the remote server with all args.Queries, where each query
+// uses args.Args (except for the QueryVec field). The payload of the result has
+// one KNNBulkItem per query, in the same order as args.Queries. Note that the
+// args.Args.TTL is the budget of all queries together, so the timeout of the
+// Client should be larger. Queries are done in batches with
+// requestman.Handle.KNNBatch, see the docs of that method for more details.
+func (c *Client) KNNBulk(args KNNBulkArgs) *ClientResult[[]KNNBulkItem] {
+	// Nested return type.
+	type T = []KNNBulkItem
+
+	// Request.
+	send := NewSArgs(args)
+	resp := SResp[T]{}
+	nErr := c.call(callArgs{"Server.KNNBulk", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     c.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
+// NamespaceVecs gets a copy of all vecs in namespace 'ns' on the remote server.
+// The payload is nil if the namespace does not exist. The remote server uses
+// requestman.Handle.Info().SSpaceVecs(ns).
+func (c *Client) NamespaceVecs(ns string) *ClientResult[[]rman.NamespaceVec] {
+	// Nested return type.
+	type T = []rman.NamespaceVec
+
+	// Request.
+	send := NewSArgs(ns)
+	resp := SResp[T]{}
+	nErr := c.call(callArgs{"Server.NamespaceVecs", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     c.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
+// KNNBulk does a composite call to Client.KNNBulk(), using all internal addrs.
+// See docs for that method for more details. Also see Clients.KNNBulkx for
+// merging and ordering the results.
+func (cs *Clients) KNNBulk(args KNNBulkArgs) ClientResults[[]KNNBulkItem] {
+	// Nested return type.
+	type T = []KNNBulkItem
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.KNNBulk(args)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       cs.RemoteAddrs,
+		ttl:         cs.Timeout,
+		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
+		skipFailed:  true,
+	})
+}
+
+// KNNBulkx is a convenience on top of Clients.KNNBulk. It calls the latter
+// method, then merges and orders the KNN results of each query in the same way
+// as Clients.KNNEagerx. The return has one slice per query, in the same order
+// as args.Queries, where lower indexes are better KNN. Clients.DedupByID is
+// used as with Clients.KNNEagerx. Note that args.Args.TTL is the budget of all
+// queries together, so Clients.Timeout should be larger.
+func (cs *Clients) KNNBulkx(args KNNBulkArgs) [][]*ClientResult[KNNRespItem] {
+	// Used as the 'data' field in a sortItem.
+	type U = *ClientResult[KNNRespItem]
+
+	// Used with Clients.DedupByID.
+	key := func(u U) string { return u.Payload.ID }
+
+	sortItems := make([][]sortItem[U], len(args.Queries))
+	for i := range sortItems {
+		sortItems[i] = make([]sortItem[U], args.Args.MaxK())
+	}
+	// Requests -> bubble insert client results into the sortItems var above.
+	for clientResult := range cs.KNNBulk(args) {
+		// Validate / check skip.
+		ok := true
+		ok = ok && clientResult.NetErr == nil
+		ok = ok && len(clientResult.Payload) == len(args.Queries)
+		if !ok {
+			continue
+		}
+
+		// Insert.
+		for i, item := range clientResult.Payload {
+			if !item.Ok {
+				continue
+			}
+			for _, knnItem := range item.KNN {
+				newSortItem := sortItem[U]{
+					score: knnItem.Score,
+					set:   true,
+					data: &ClientResult[KNNRespItem]{
+						RemoteAddr:     clientResult.RemoteAddr,
+						NetErr:         nil,
+						Payload:        knnItem,
+						NetworkLatency: clientResult.NetworkLatency,
+					},
+				}
+				if cs.DedupByID {
+					bubbleInsertUnique(sortItems[i], newSortItem, args.Args.Ascending, key)
+					continue
+				}
+				bubbleInsert(sortItems[i], newSortItem, args.Args.Ascending)
+			}
+		}
+	}
+
+	// Extract from ordered slices.
+	r := make([][]*ClientResult[KNNRespItem], len(args.Queries))
+	for i := range sortItems {
+		r[i] = make([]*ClientResult[KNNRespItem], 0, args.Args.MaxK())
+		for _, sortItem := range sortItems[i] {
+			if sortItem.set {
+				r[i] = append(r[i], sortItem.data)
+			}
+		}
+	}
+
+	return r
+}
+
+// NamespaceVecs does a composite call to Client.NamespaceVecs(), using all
+// internal addrs. See docs for that method for more details.
+func (cs *Clients) NamespaceVecs(ns string) ClientResults[[]rman.NamespaceVec] {
+	// Nested return type.
+	type T = []rman.NamespaceVec
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.NamespaceVecs(ns)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       cs.RemoteAddrs,
+		ttl:         cs.Timeout,
+		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
+		skipFailed:  true,
+	})
+}
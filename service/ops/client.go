@@ -1,10 +1,11 @@
 package ops
 
 import (
+	"errors"
 	"net"
-	"net/rpc"
 	"time"
 
+	"github.com/crunchypi/ddrop/pkg/mathx"
 	rman "github.com/crunchypi/ddrop/service/requestman"
 )
 
@@ -14,6 +15,9 @@ type Client struct {
 	RemoteAddr string
 	// Timeout specifies connection timeout.
 	Timeout time.Duration
+	// Codec is the encoding of rpc calls, it must match the one used by the
+	// Server (see NewServerWithCodec). The zero value is CodecGob.
+	Codec Codec
 }
 
 // NewClient sets up a new client. If a timeout isn't specified, or has a
@@ -25,6 +29,14 @@ func NewClient(remoteAddr string, timeout ...time.Duration) *Client {
 	return &Client{RemoteAddr: remoteAddr, Timeout: timeout[0]}
 }
 
+// NewClientWithCodec is the same as NewClient, except that the client uses the
+// given Codec, which must match the one of the Server (see NewServerWithCodec).
+func NewClientWithCodec(remoteAddr string, codec Codec, timeout ...time.Duration) *Client {
+	c := NewClient(remoteAddr, timeout...)
+	c.Codec = codec
+	return c
+}
+
 // ClientResult is a wrapper around any result returned from a client -> server
 // call. It contains additional meta info, specifically the address used, err,
 // as well as network latency.
@@ -44,7 +56,7 @@ type callArgs struct {
 }
 
 // call is a convenience remote-call method. It handles rpc.Client setup,
-// timeout, and resource release.
+// timeout, resource release, and protocol versions (see protocolVersionErr).
 func (c *Client) call(args callArgs) error {
 	conn, err := net.DialTimeout("tcp", c.RemoteAddr, c.Timeout)
 	if err != nil {
@@ -53,9 +65,10 @@ func (c *Client) call(args callArgs) error {
 
 	defer conn.Close()
 
-	client := rpc.NewClient(conn)
+	client := c.Codec.newClient(conn)
 	defer client.Close()
-	return client.Call(args.rpcServiceMethod, args.rpcArgs, args.rpcResp)
+	err = client.Call(args.rpcServiceMethod, args.rpcArgs, args.rpcResp)
+	return protocolVersionErr(err, args.rpcResp)
 }
 
 // Ping pings the remote server. The returned ClientResult.Payload will be true
@@ -83,14 +96,94 @@ type AddDataArgs struct {
 	Vec       []float64
 	Data      []byte
 	Expires   time.Time
+	// ID is optional. If set, it is returned with KNN results for this vec (see
+	// KNNRespItem.ID), e.g for recognising a vec that is replicated on multiple
+	// nodes (see Clients.DedupByID). IDs are not required to be unique.
+	ID string
+	// Tenant is optional, see requestman.DistancerContainer.Tenant.
+	Tenant string
+	// Metadata is optional, see requestman.DistancerContainer.Metadata.
+	Metadata map[string]string
+}
+
+// AddDataStatus is the outcome of adding a single AddDataArgs with
+// Client.AddData. Note that the zero value is AddDataRejected.
+type AddDataStatus int
+
+const (
+	// AddDataRejected means that the data was rejected for reasons other than
+	// the ones below, e.g the capacity of the namespace (see
+	// requestman.ErrDataRejected).
+	AddDataRejected AddDataStatus = iota
+	// AddDataOk means that the data was added.
+	AddDataOk
+	// AddDataInvalidVec means that the vec was nil, empty or had NaN/Inf
+	// elements (see mathx.ValidVec).
+	AddDataInvalidVec
+	// AddDataDimMismatch means that the dimension of the vec did not match
+	// the namespace (see requestman.ErrDimMismatch).
+	AddDataDimMismatch
+	// AddDataQuotaExceeded means that AddDataArgs.Tenant is at its quota
+	// (see requestman.ErrQuotaExceeded).
+	AddDataQuotaExceeded
+	// AddDataNearDuplicate means that the namespace has a near-duplicate of
+	// the vec (see requestman.ErrNearDuplicate).
+	AddDataNearDuplicate
+	// AddDataReadOnly means that the server is a replica, which does not
+	// accept writes (see NewReplicaServer).
+	AddDataReadOnly
+)
+
+// String returns a human-readable name of the AddDataStatus.
+func (s AddDataStatus) String() string {
+	switch s {
+	case AddDataRejected:
+		return "rejected"
+	case AddDataOk:
+		return "ok"
+	case AddDataInvalidVec:
+		return "invalid vec"
+	case AddDataDimMismatch:
+		return "dim mismatch"
+	case AddDataQuotaExceeded:
+		return "quota exceeded"
+	case AddDataNearDuplicate:
+		return "near duplicate"
+	case AddDataReadOnly:
+		return "read only"
+	default:
+		return "unknown"
+	}
+}
+
+// addDataStatusFromErr converts an error from requestman.Handle.AddDataErr.
+func addDataStatusFromErr(err error) AddDataStatus {
+	switch {
+	case err == nil:
+		return AddDataOk
+	case errors.Is(err, rman.ErrDimMismatch):
+		return AddDataDimMismatch
+	case errors.Is(err, rman.ErrQuotaExceeded):
+		return AddDataQuotaExceeded
+	case errors.Is(err, rman.ErrNearDuplicate):
+		return AddDataNearDuplicate
+	case errors.Is(err, mathx.ErrVecNil),
+		errors.Is(err, mathx.ErrVecEmpty),
+		errors.Is(err, mathx.ErrVecNaN),
+		errors.Is(err, mathx.ErrVecInf):
+		return AddDataInvalidVec
+	default:
+		return AddDataRejected
+	}
 }
 
 // AddData tries to add data to the remote server.
-// The remote server uses requestmanager.Handle.AddData(...), see
-// the docs for more details about args, returns, etc.
-func (c *Client) AddData(args []AddDataArgs) *ClientResult[[]bool] {
+// The remote server uses requestmanager.Handle.AddDataErr(...), see
+// the docs for more details about args, returns, etc. The payload of the
+// result has an AddDataStatus per item in args (same order).
+func (c *Client) AddData(args []AddDataArgs) *ClientResult[[]AddDataStatus] {
 	// Nested return type.
-	type T = []bool
+	type T = []AddDataStatus
 
 	// Request.
 	send := NewSArgs[[]AddDataArgs](args)
@@ -105,10 +198,150 @@ func (c *Client) AddData(args []AddDataArgs) *ClientResult[[]bool] {
 	}
 }
 
+// CreateNamespaceArgs is intended as args for Client.CreateNamespace.
+type CreateNamespaceArgs struct {
+	Namespace string
+	// Dim is the vec dimension which the namespace is pinned to.
+	Dim int
+	// DefaultKNNMethod is optional, see the field of the same name in
+	// requestman.CreateNamespaceArgs.
+	DefaultKNNMethod rman.KNNMethod
+}
+
+// CreateNamespaceStatus is the outcome of Client.CreateNamespace. Note that the
+// zero value is CreateNamespaceRejected.
+type CreateNamespaceStatus int
+
+const (
+	// CreateNamespaceRejected means that the namespace could not be created,
+	// e.g because the dim was not positive (see requestman.ErrInvalidDim) or
+	// the default KNNMethod was invalid (see requestman.ErrInvalidKNNMethod).
+	CreateNamespaceRejected CreateNamespaceStatus = iota
+	// CreateNamespaceOk means that the namespace was created (or already
+	// existed) with the given dim.
+	CreateNamespaceOk
+	// CreateNamespaceDimMismatch means that the namespace already exists with
+	// another dim (see requestman.ErrDimMismatch).
+	CreateNamespaceDimMismatch
+)
+
+// String returns a human-readable name of the CreateNamespaceStatus.
+func (s CreateNamespaceStatus) String() string {
+	switch s {
+	case CreateNamespaceRejected:
+		return "rejected"
+	case CreateNamespaceOk:
+		return "ok"
+	case CreateNamespaceDimMismatch:
+		return "dim mismatch"
+	default:
+		return "unknown"
+	}
+}
+
+// createNamespaceStatusFromErr converts an error from
+// requestman.Handle.CreateNamespace.
+func createNamespaceStatusFromErr(err error) CreateNamespaceStatus {
+	switch {
+	case err == nil:
+		return CreateNamespaceOk
+	case errors.Is(err, rman.ErrDimMismatch):
+		return CreateNamespaceDimMismatch
+	default:
+		return CreateNamespaceRejected
+	}
+}
+
+// CreateNamespace tries to create a namespace with a pinned vec dimension on
+// the remote server, such that it rejects data with any other dimension (with
+// AddDataDimMismatch). The remote server uses
+// requestmanager.Handle.CreateNamespace(...), see the docs for more details.
+func (c *Client) CreateNamespace(args CreateNamespaceArgs) *ClientResult[CreateNamespaceStatus] {
+	// Nested return type.
+	type T = CreateNamespaceStatus
+
+	// Request.
+	send := NewSArgs(args)
+	resp := SResp[T]{}
+	nErr := c.call(callArgs{"Server.CreateNamespace", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     c.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
+// DeleteOlderThanArgs is intended as args for Client.DeleteOlderThan.
+type DeleteOlderThanArgs struct {
+	Namespace string
+	// OlderThan is the min age of the data that is deleted, i.e data added
+	// before now-OlderThan (according to the clock of the remote server) is
+	// deleted. Nothing is deleted if this is <= 0.
+	OlderThan time.Duration
+}
+
+// DeleteOlderThan deletes data in a namespace on the remote server, which was
+// added longer ago than args.OlderThan. The remote server uses
+// requestmanager.Handle.DeleteWhere(...), see the docs for more details. The
+// payload of the result is the number of deleted vecs.
+func (c *Client) DeleteOlderThan(args DeleteOlderThanArgs) *ClientResult[int] {
+	// Request.
+	send := NewSArgs(args)
+	resp := SResp[int]{}
+	nErr := c.call(callArgs{"Server.DeleteOlderThan", send, &resp})
+
+	return &ClientResult[int]{
+		RemoteAddr:     c.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
+// GetVectorArgs is intended as args for Client.GetVector.
+type GetVectorArgs struct {
+	Namespace string
+	// ID is the AddDataArgs.ID of the vec.
+	ID string
+}
+
+// GetVectorResp is the payload of Client.GetVector.
+type GetVectorResp struct {
+	// Found is false if either the namespace or the vec does not exist, or if
+	// the vec expired.
+	Found bool
+	Vec   rman.StoredVec
+}
+
+// GetVector gets a copy of the vec with args.ID in a namespace on the remote
+// server, along with its payload (AddDataArgs.Data) and Added/Expires times.
+// The remote server uses requestmanager.Handle.Info().SSpaceVecByID(...), see
+// the docs for more details.
+func (c *Client) GetVector(args GetVectorArgs) *ClientResult[GetVectorResp] {
+	// Request.
+	send := NewSArgs(args)
+	resp := SResp[GetVectorResp]{}
+	nErr := c.call(callArgs{"Server.GetVector", send, &resp})
+
+	return &ClientResult[GetVectorResp]{
+		RemoteAddr:     c.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
 // KNNRespItem is intended as a single item in KNNResp.
 type KNNRespItem struct {
 	Vec   []float64
 	Score float64
+	// ID is the AddDataArgs.ID of the vec, empty if it was not set.
+	ID string
+	// Added is when the vec was added to the remote server, according to its
+	// clock (see requestman.DistancerContainer.Added).
+	Added time.Time
 }
 
 // KNNResp is intended as the response of Client.KNNEager.
@@ -118,6 +351,13 @@ type KNNResp struct {
 	// requestman.Handle.KNN. But it is also false if the
 	// requestman.KNNArgs.TTL is less than network latency.
 	Ok bool
+	// Stats is only set if requestman.KNNArgs.Stats is true and
+	// the request was successful, see requestman.KNNStats.
+	Stats *rman.KNNStats
+	// RetryAfter is only set if Ok is false because the remote server
+	// estimated that the request would not finish within its TTL. It is
+	// that estimate, see requestman.KNNEnqueueResult.RetryAfter.
+	RetryAfter time.Duration
 }
 
 // KNNEager tries to (eagerly) do a KNN lookup on a remote server.
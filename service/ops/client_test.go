@@ -1,8 +1,11 @@
 package ops
 
 import (
+	"math"
 	"testing"
 	"time"
+
+	rman "github.com/crunchypi/ddrop/service/requestman"
 )
 
 /*
@@ -52,8 +55,8 @@ func TestSingleAddData(t *testing.T) {
 		if len(r.Payload) != 1 {
 			t.Fatal("unexpected len of", len(r.Payload))
 		}
-		if !r.Payload[0] {
-			t.Fatal("got unexpected not-ok")
+		if r.Payload[0] != AddDataOk {
+			t.Fatal("got unexpected status:", r.Payload[0])
 		}
 		_, l, _ := rm.Info().SSpaceLen(namespace)
 		if l != 1 {
@@ -66,6 +69,122 @@ func TestSingleAddData(t *testing.T) {
 	}
 }
 
+func TestSingleGetVector(t *testing.T) {
+	addr := freeLocalNoFail(t)
+
+	err := withTestNode(addr, func(testNode *testNode) {
+		// Abbreviations for convenience.
+		namespace := testNode.rManMeta.namespace
+		dim := testNode.rManMeta.poolVecDim
+
+		vec, _ := randFloat64Slice(dim)
+		payload := []AddDataArgs{
+			{Namespace: namespace, Vec: vec, Data: []byte("payload"), ID: "a"},
+		}
+		client := NewClient(addr)
+		if r := client.AddData(payload); r.NetErr != nil || r.Payload[0] != AddDataOk {
+			t.Fatal("could not add data:", r)
+		}
+
+		r := client.GetVector(GetVectorArgs{Namespace: namespace, ID: "a"})
+		if r.NetErr != nil {
+			t.Fatal(r)
+		}
+		if !r.Payload.Found || string(r.Payload.Vec.Data) != "payload" {
+			t.Fatalf("unexpected payload: %+v", r.Payload)
+		}
+		for i := range vec {
+			if r.Payload.Vec.Vec[i] != vec[i] {
+				t.Fatalf("unexpected elements: %v", r.Payload.Vec.Vec)
+			}
+		}
+
+		r = client.GetVector(GetVectorArgs{Namespace: namespace, ID: "b"})
+		if r.NetErr != nil || r.Payload.Found {
+			t.Fatalf("unexpected result for a missing vec: %+v", r)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSingleAddDataInvalidVec(t *testing.T) {
+	addr := freeLocalNoFail(t)
+
+	err := withTestNode(addr, func(testNode *testNode) {
+		namespace := testNode.rManMeta.namespace
+		dim := testNode.rManMeta.poolVecDim
+		rm := testNode.server.rManHandle
+
+		vec, _ := randFloat64Slice(dim)
+		vecNaN, _ := randFloat64Slice(dim)
+		vecNaN[0] = math.NaN()
+		payload := []AddDataArgs{
+			{Namespace: namespace, Vec: vecNaN, Data: []byte{}},
+			{Namespace: namespace, Vec: vec, Data: []byte{}},
+			{Namespace: namespace, Vec: nil, Data: []byte{}},
+			{Namespace: namespace, Vec: append(vec, 1), Data: []byte{}},
+		}
+
+		r := NewClient(addr).AddData(payload)
+		if r.NetErr != nil {
+			t.Fatal(r)
+		}
+		if len(r.Payload) != 4 {
+			t.Fatal("unexpected len of", len(r.Payload))
+		}
+		want := []AddDataStatus{
+			AddDataInvalidVec,
+			AddDataOk,
+			AddDataInvalidVec,
+			AddDataDimMismatch,
+		}
+		for i := range want {
+			if r.Payload[i] != want[i] {
+				t.Fatal("unexpected add results:", r.Payload)
+			}
+		}
+		_, l, _ := rm.Info().SSpaceLen(namespace)
+		if l != 1 {
+			t.Fatal("unexpected search space len after add:", l)
+		}
+
+		// The rejected NaN vec should not affect subsequent queries.
+		testNode.fill(100)
+		for _, method := range []rman.KNNMethod{
+			rman.KNNMethodEuclideanDistance,
+			rman.KNNMethodCosineSimilarity,
+		} {
+			args := testNode.rManMeta.randKNNArgs()
+			args.KNNMethod = method
+			args.Extent = 1
+			args.TTL = time.Hour
+			// Descending for both, so nothing is rejected. A random reject
+			// can otherwise drop all cosine similarities.
+			args.Reject = -1
+
+			r := NewClient(addr).KNNEager(args)
+			if r.NetErr != nil {
+				t.Fatal(r.NetErr)
+			}
+			if !r.Payload.Ok || len(r.Payload.KNN) == 0 {
+				t.Fatal("unexpected not-ok or empty result")
+			}
+			for _, item := range r.Payload.KNN {
+				if math.IsNaN(item.Score) || math.IsInf(item.Score, 0) {
+					t.Fatal("got corrupt score:", item.Score)
+				}
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSingleKNNEager(t *testing.T) {
 	addr := freeLocalNoFail(t)
 
@@ -64,6 +64,9 @@ func (ci *CInfo) SSpaceNamespace(key string) *ClientResult[bool] {
 type SSpaceDimResp struct {
 	LookupOk bool // LookupOk indicates if the namespace/key was valid.
 	Dim      int  // Uniform vector dimension.
+	// PinnedDim is the dimension pinned with Client.CreateNamespace, 0 if the
+	// namespace is not pinned.
+	PinnedDim int
 }
 
 // SSpaceDim tries to get the uniform dimension for vectors on the search space
@@ -119,6 +122,35 @@ func (ci *CInfo) SSpaceLen(key string) *ClientResult[SSpaceLenResp] {
 	}
 }
 
+// SSpaceVersionResp is intended as a response from CInfo.SSpaceVersion.
+type SSpaceVersionResp struct {
+	LookupOk bool   // LookupOk indicates if the namespace/key was valid.
+	Version  uint64 // Version changes whenever the namespace is mutated.
+}
+
+// SSpaceVersion tries to get the version of a given key/namespace from the
+// remote server, which changes whenever the namespace is mutated.
+//
+// The remote server forwards the call to the method with the same name on top
+// of its internal requestmanager.Handle.Info(). See the docs for that path
+// for more details about args, returns, etc.
+func (ci *CInfo) SSpaceVersion(key string) *ClientResult[SSpaceVersionResp] {
+	// Nested return type.
+	type T = SSpaceVersionResp
+
+	// Request.
+	send := NewSArgs(key)
+	resp := SResp[T]{}
+	nErr := ci.client().call(callArgs{"SInfo.SSpaceVersion", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     ci.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
 // SSpaceCapresp is intended as a response from CInfo.SSpaceCap.
 type SSpaceCapResp struct {
 	LookupOk bool // LookupOk indicates if the namespace/key was valid.
@@ -192,7 +224,12 @@ func (ci *CInfo) KNNLatency(args KNNLatencyArgs) *ClientResult[KNNLatencyResp] {
 // "start" represents the offset. So to get records for the last minute:
 // - Start: time.Now()
 // - End  : time.Now().Add(-time.Minute)
+//
+// Namespace selects which namespace to get monitoring data for, where the
+// zero value (requestman.KNNMonitorAllNamespaces) gives the aggregate for all.
 type KNNMonArgs struct {
+	// Namespace of monitored requests, all if empty.
+	Namespace string
 	// Start of record.
 	Start time.Time
 	// End of record, how far to go back in time relative to "Start".
@@ -221,3 +258,63 @@ func (ci *CInfo) KNNMonitor(args KNNMonArgs) *ClientResult[rman.KNNMonItemAvg] {
 		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
 	}
 }
+
+// KNNMonitorSeries is the same as CInfo.KNNMonitor, except that the monitoring
+// data is returned as a time series, i.e one item per time bucket.
+//
+// The remote server forwards the call to the method with the same name on top
+// of its internal requestmanager.Handle.Info(). See the docs for that path
+// for more details about args, returns, etc.
+func (ci *CInfo) KNNMonitorSeries(args KNNMonArgs) *ClientResult[[]rman.KNNMonItemAvg] {
+	// Nested return type.
+	type T = []rman.KNNMonItemAvg
+
+	// Request.
+	send := NewSArgs(args)
+	resp := SResp[T]{}
+	nErr := ci.client().call(callArgs{"SInfo.KNNMonitorSeries", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     ci.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
+
+// NormHistogramArgs is intended as args for CInfo.NormHistogram.
+type NormHistogramArgs struct {
+	Key     string // Key/namespace of the vecs.
+	Buckets int    // Number of buckets in the histogram.
+}
+
+// NormHistogramResp is intended as a response from CInfo.NormHistogram.
+type NormHistogramResp struct {
+	// LookupOk indicates if the namespace/key was valid, and if
+	// NormHistogramArgs.Buckets was at least 1.
+	LookupOk  bool
+	Histogram rman.NormHistogram
+}
+
+// NormHistogram tries to get the distribution of the norms of the vecs on the
+// search space with the given key/namespace from the remote server.
+//
+// The remote server forwards the call to the method with the same name on top
+// of its internal requestmanager.Handle.Info(). See the docs for that path
+// for more details about args, returns, etc.
+func (ci *CInfo) NormHistogram(args NormHistogramArgs) *ClientResult[NormHistogramResp] {
+	// Nested return type.
+	type T = NormHistogramResp
+
+	// Request.
+	send := NewSArgs(args)
+	resp := SResp[T]{}
+	nErr := ci.client().call(callArgs{"SInfo.NormHistogram", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     ci.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
@@ -124,6 +124,33 @@ func TestSingleInfoSSpaceLen(t *testing.T) {
 	}
 }
 
+func TestSingleInfoSSpaceVersion(t *testing.T) {
+	addr := freeLocalNoFail(t)
+
+	err := withTestNode(addr, func(testNode *testNode) {
+		ns := testNode.rManMeta.namespace
+
+		testNode.fill(9)
+		version, _ := testNode.server.rManHandle.Info().SSpaceVersion(ns)
+
+		r := NewClient(addr).Info().SSpaceVersion(ns)
+		if r.NetErr != nil {
+			t.Fatal(r.NetErr)
+		}
+		if !r.Payload.LookupOk {
+			t.Fatal("unexpected namespace not-found")
+		}
+		if r.Payload.Version != version {
+			s := "unexpected neq version. want %v, got %v"
+			t.Fatalf(s, version, r.Payload.Version)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSingleInfoSSpaceCap(t *testing.T) {
 	addr := freeLocalNoFail(t)
 
@@ -213,3 +240,58 @@ func TestSingleInfoKNNMonitor(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSingleInfoKNNMonitorSeries(t *testing.T) {
+	addr := freeLocalNoFail(t)
+
+	err := withTestNode(addr, func(testNode *testNode) {
+
+		testNode.fill(10_000)
+		testNode.makeLatency(100, time.Millisecond*10)
+
+		r := NewClient(addr).Info().KNNMonitorSeries(KNNMonArgs{
+			Start: time.Now(),
+			End:   time.Now().Add(-time.Minute),
+		})
+		if r.NetErr != nil {
+			t.Fatal(r.NetErr)
+		}
+		n := 0
+		for _, item := range r.Payload {
+			n += item.N
+		}
+		if len(r.Payload) == 0 || n == 0 {
+			t.Fatal("unexpected 0 entries monitored")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSingleInfoNormHistogram(t *testing.T) {
+	addr := freeLocalNoFail(t)
+
+	err := withTestNode(addr, func(testNode *testNode) {
+		ns := testNode.rManMeta.namespace
+
+		n := 10
+		testNode.fill(n)
+
+		r := NewClient(addr).Info().NormHistogram(NormHistogramArgs{Key: ns, Buckets: 3})
+		if r.NetErr != nil {
+			t.Fatal(r.NetErr)
+		}
+		if !r.Payload.LookupOk {
+			t.Fatal("unexpected namespace not-found")
+		}
+		if hist := r.Payload.Histogram; hist.N != n || len(hist.Counts) != 3 {
+			t.Fatalf("unexpected histogram: %+v", hist)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -17,10 +17,24 @@ func init() {
 type Clients struct {
 	RemoteAddrs []string
 	Timeout     time.Duration // This is passed to each individual Client.
+	// Failures is optional. If set, network errors (and successes) of all
+	// calls are registered, and read operations (KNN and info calls) skip
+	// addrs that are cooling down after a recent failure. See FailureTracker.
+	Failures *FailureTracker
+	// Breaker is optional. If set, calls to addrs with an open circuit fail
+	// fast with ErrCircuitOpen (as ClientResult.NetErr), without dialing.
+	// See CircuitBreaker.
+	Breaker *CircuitBreaker
+	// DedupByID is optional. If true, Clients.KNNEagerx keeps only the best
+	// scoring item of those with the same KNNRespItem.ID (items without an ID
+	// are kept as-is). This is useful when vecs are replicated on multiple
+	// nodes, as they would otherwise show up as multiple neighbors.
+	DedupByID bool
 }
 
 // NewClients sets up a new composite client. If a timeout isn't specified, or has
 // time.Duration <= 0, then the timeout will be set to 3 seconds as default.
+// See NewClientsWithBreaker for setting up a circuit breaker as well.
 func NewClients(remoteAddrs []string, timeout ...time.Duration) *Clients {
 	if len(timeout) == 0 || timeout[0] <= time.Duration(0) {
 		return &Clients{RemoteAddrs: remoteAddrs, Timeout: time.Second * 3}
@@ -28,6 +42,19 @@ func NewClients(remoteAddrs []string, timeout ...time.Duration) *Clients {
 	return &Clients{RemoteAddrs: remoteAddrs, Timeout: timeout[0]}
 }
 
+// NewClientsWithBreaker is the same as NewClients, except that Clients.Breaker
+// is set to the given CircuitBreaker (can be nil). The CircuitBreaker should be
+// shared between Clients instances, as that is where the state is kept.
+func NewClientsWithBreaker(
+	remoteAddrs []string,
+	breaker *CircuitBreaker,
+	timeout ...time.Duration,
+) *Clients {
+	cs := NewClients(remoteAddrs, timeout...)
+	cs.Breaker = breaker
+	return cs
+}
+
 // ClientResults is the general return from T Clients methods.
 type ClientResults[T any] <-chan *ClientResult[T]
 
@@ -54,12 +81,40 @@ type fanInRequestsArgs[T any] struct {
 	ttl time.Duration
 	// requestFunc lends a *Client, which must be used to do requests.
 	requestFunc func(c *Client) *ClientResult[T]
+	// failures is optional, it is used to register the outcome of each request
+	// (with ClientResult.NetErr). If skipFailed is true, then addrs that are
+	// cooling down will be skipped (see FailureTracker).
+	failures   *FailureTracker
+	skipFailed bool
+	// breaker is optional, requests to addrs with an open circuit are not done
+	// (see CircuitBreaker). The outcome of other requests is registered.
+	breaker *CircuitBreaker
 }
 
 // fanInRequests is a shorthand for fan-out-requests-fan-in-responses.
 // It is used to do multiple Client->Server calls concurrently. See
 // docs for fanInRequestArgs for more details.
 func fanInRequests[T any](args fanInRequestsArgs[T]) ClientResults[T] {
+	if args.failures != nil && args.skipFailed {
+		args.addrs = args.failures.filter(args.addrs)
+	}
+
+	// Wraps requestFunc such that results are registered, and such that
+	// requests fail fast if the circuit of the addr is open.
+	requestFunc := func(c *Client) *ClientResult[T] {
+		if args.breaker != nil && !args.breaker.allow(c.RemoteAddr) {
+			return &ClientResult[T]{RemoteAddr: c.RemoteAddr, NetErr: ErrCircuitOpen}
+		}
+		r := args.requestFunc(c)
+		if args.breaker != nil {
+			args.breaker.register(c.RemoteAddr, r.NetErr)
+		}
+		if args.failures != nil {
+			args.failures.register(c.RemoteAddr, r.NetErr)
+		}
+		return r
+	}
+
 	ch := make(chan *ClientResult[T], len(args.addrs))
 	wg := sync.WaitGroup{}
 	wg.Add(len(args.addrs))
@@ -75,7 +130,7 @@ func fanInRequests[T any](args fanInRequestsArgs[T]) ClientResults[T] {
 				defer wg.Done()
 				select {
 				case <-ctx.Done():
-				case ch <- args.requestFunc(NewClient(addr, args.ttl)):
+				case ch <- requestFunc(NewClient(addr, args.ttl)):
 				}
 			}(addr)
 		}
@@ -104,6 +159,8 @@ func (cs *Clients) Ping() ClientResults[bool] {
 		addrs:       cs.RemoteAddrs,
 		ttl:         cs.Timeout,
 		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
 	})
 }
 
@@ -111,9 +168,9 @@ func (cs *Clients) Ping() ClientResults[bool] {
 // Do note that the data to add (i.e "args") is added to a single remote node,
 // picked at random, as a way of avoiding data duplication.
 // See docs for that method for more details.
-func (cs *Clients) AddData(args []AddDataArgs) ClientResults[[]bool] {
+func (cs *Clients) AddData(args []AddDataArgs) ClientResults[[]AddDataStatus] {
 	// Nested return type.
-	type T = []bool
+	type T = []AddDataStatus
 
 	// Request/task func per client/address.
 	rf := func(c *Client) *ClientResult[T] {
@@ -129,6 +186,76 @@ func (cs *Clients) AddData(args []AddDataArgs) ClientResults[[]bool] {
 		addrs:       []string{rAddr},
 		ttl:         cs.Timeout,
 		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
+	})
+}
+
+// CreateNamespace does a composite call to Client.CreateNamespace(), using all
+// internal addrs, such that all nodes agree on the vec dimension of the
+// namespace. This matters because Clients.AddData adds to a random node, where
+// namespaces are otherwise created implicitly with the dim of the first data.
+// Nodes which are unreachable (see ClientResult.NetErr) do not get the dim
+// pinned, so the call should be repeated for those (it is idempotent).
+// See docs for Client.CreateNamespace for more details.
+func (cs *Clients) CreateNamespace(args CreateNamespaceArgs) ClientResults[CreateNamespaceStatus] {
+	// Nested return type.
+	type T = CreateNamespaceStatus
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.CreateNamespace(args)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       cs.RemoteAddrs,
+		ttl:         cs.Timeout,
+		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
+	})
+}
+
+// DeleteOlderThan does a composite call to Client.DeleteOlderThan(), using all
+// internal addrs, since data is spread across all nodes (see Clients.AddData).
+// See docs for Client.DeleteOlderThan for more details.
+func (cs *Clients) DeleteOlderThan(args DeleteOlderThanArgs) ClientResults[int] {
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[int] {
+		return c.DeleteOlderThan(args)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[int]{
+		addrs:       cs.RemoteAddrs,
+		ttl:         cs.Timeout,
+		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
+	})
+}
+
+// GetVector does a composite call to Client.GetVector(), using all internal
+// addrs, since data is spread across all nodes (see Clients.AddData). Note that
+// the vec may be found on multiple nodes, e.g if it was added multiple times.
+// See docs for Client.GetVector for more details.
+func (cs *Clients) GetVector(args GetVectorArgs) ClientResults[GetVectorResp] {
+	// Nested return type.
+	type T = GetVectorResp
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.GetVector(args)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       cs.RemoteAddrs,
+		ttl:         cs.Timeout,
+		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
 	})
 }
 
@@ -149,13 +276,17 @@ func (cs *Clients) KNNEager(args rman.KNNArgs) ClientResults[KNNResp] {
 		addrs:       cs.RemoteAddrs,
 		ttl:         cs.Timeout,
 		requestFunc: rf,
+		failures:    cs.Failures,
+		breaker:     cs.Breaker,
+		skipFailed:  true,
 	})
 
 }
 
 // KNNEagerx is a convenience on top of Clients.KNNEager. It calls the latter
-// method, then orders KNN results into max args.K. The return is a flat slice
-// of ClientResult containing a single KNNRespItem, where lower indexes are
+// method, then orders KNN results into max args.MaxK() (i.e args.K, see the
+// docs of that method for range queries). The return is a flat slice of
+// ClientResult containing a single KNNRespItem, where lower indexes are
 // better KNN. It can look something like the following (simplified, using
 // cosine similarity where higher scores are better):
 // [
@@ -164,16 +295,38 @@ func (cs *Clients) KNNEager(args rman.KNNArgs) ClientResults[KNNResp] {
 //   addr: ":3001", score: 0.97, Vec: ...,
 // ]
 // This is to include network information in addition to actual KNN results.
+// If Clients.DedupByID is true, then items with the same ID are only included
+// once (with the best score and the network information of that node).
 func (cs *Clients) KNNEagerx(args rman.KNNArgs) []*ClientResult[KNNRespItem] {
+	r, _ := cs.KNNEagerxWithResps(args)
+	return r
+}
+
+// KNNEagerxWithResps is the same as KNNEagerx, except that it additionally
+// returns the KNNResp of each remote server, where the KNN field is left out
+// (those are merged into the first return). This gives access to per-server
+// metadata, such as KNNResp.Stats and KNNResp.RetryAfter.
+func (cs *Clients) KNNEagerxWithResps(args rman.KNNArgs) (
+	[]*ClientResult[KNNRespItem],
+	[]*ClientResult[KNNResp],
+) {
 	// Used as the 'data' field in a sortItem.
 	type U struct {
 		clientResult *ClientResult[KNNResp]
 		knnRespItem  KNNRespItem
 	}
 
-	sortItems := make([]sortItem[U], args.K)
+	// Used with Clients.DedupByID.
+	key := func(u U) string { return u.knnRespItem.ID }
+
+	sortItems := make([]sortItem[U], args.MaxK())
+	resps := make([]*ClientResult[KNNResp], 0, len(cs.RemoteAddrs))
 	// Requests -> bubble insert client results into the sortItems var above.
 	for clientResult := range cs.KNNEager(args) {
+		resp := *clientResult
+		resp.Payload.KNN = nil
+		resps = append(resps, &resp)
+
 		// Validate / check skip.
 		ok := true
 		ok = ok && clientResult.NetErr == nil
@@ -193,12 +346,16 @@ func (cs *Clients) KNNEagerx(args rman.KNNArgs) []*ClientResult[KNNRespItem] {
 					knnRespItem:  knnItem,
 				},
 			}
+			if cs.DedupByID {
+				bubbleInsertUnique(sortItems, newSortItem, args.Ascending, key)
+				continue
+			}
 			bubbleInsert(sortItems, newSortItem, args.Ascending)
 		}
 	}
 
 	// Extract from ordered slice.
-	r := make([]*ClientResult[KNNRespItem], 0, args.K)
+	r := make([]*ClientResult[KNNRespItem], 0, args.MaxK())
 	for _, sortItem := range sortItems {
 		if !sortItem.set {
 			continue
@@ -212,7 +369,7 @@ func (cs *Clients) KNNEagerx(args rman.KNNArgs) []*ClientResult[KNNRespItem] {
 		r = append(r, &newClientResult)
 	}
 
-	return r
+	return r, resps
 }
 
 // Info returns a method namespace. Similar to Client.Info()
@@ -1,6 +1,8 @@
 package ops
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -74,7 +76,7 @@ func TestCompositeAddData(t *testing.T) {
 			if len(clientResult.Payload) == 0 {
 				t.Fatal("unexpected empty result")
 			}
-			if !clientResult.Payload[0] {
+			if clientResult.Payload[0] != AddDataOk {
 				t.Fatal("one node got a not-ok result")
 			}
 			// The x.AddData method for the composite type 'Clients'
@@ -103,6 +105,113 @@ func TestCompositeAddData(t *testing.T) {
 	}
 }
 
+func TestCompositeCreateNamespace(t *testing.T) {
+	n := 2
+
+	err := withNetwork(t, n, func(tn *testNetwork) {
+		ns := "dim5"
+		args := CreateNamespaceArgs{Namespace: ns, Dim: 5}
+		ch := NewClients(tn.addrs, time.Second).CreateNamespace(args)
+
+		ch, nResps := countChan(ch)
+		if nResps != n {
+			t.Fatal("unexpected amt of responses:", nResps)
+		}
+		for clientResult := range ch {
+			if err := clientResult.NetErr; err != nil {
+				t.Fatal("one node got a network err:", err)
+			}
+			if clientResult.Payload != CreateNamespaceOk {
+				t.Fatal("one node got an unexpected status:", clientResult.Payload)
+			}
+		}
+
+		// All nodes should reject a 3-D insert, and accept a 5-D one.
+		for _, addr := range tn.addrs {
+			c := NewClient(addr, time.Second)
+			vec3, _ := randFloat64Slice(3)
+			vec5, _ := randFloat64Slice(5)
+			r := c.AddData([]AddDataArgs{
+				{Namespace: ns, Vec: vec3},
+				{Namespace: ns, Vec: vec5},
+			})
+			if r.NetErr != nil {
+				t.Fatal("one node got a network err:", r.NetErr)
+			}
+			if r.Payload[0] != AddDataDimMismatch || r.Payload[1] != AddDataOk {
+				t.Fatalf("node %v: unexpected statuses: %v", addr, r.Payload)
+			}
+
+			// Another dim is not accepted either.
+			args := CreateNamespaceArgs{Namespace: ns, Dim: 3}
+			if r := c.CreateNamespace(args); r.Payload != CreateNamespaceDimMismatch {
+				t.Fatalf("node %v: unexpected status: %v", addr, r.Payload)
+			}
+			args = CreateNamespaceArgs{Namespace: ns, Dim: 0}
+			if r := c.CreateNamespace(args); r.Payload != CreateNamespaceRejected {
+				t.Fatalf("node %v: unexpected status: %v", addr, r.Payload)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal("could not setup a test network:", err)
+	}
+}
+
+func TestCompositeDeleteOlderThan(t *testing.T) {
+	n := 2
+
+	err := withNetwork(t, n, func(tn *testNetwork) {
+		ns := "test"
+		add := func(k int) {
+			for _, addr := range tn.addrs {
+				args := make([]AddDataArgs, k)
+				for i := range args {
+					args[i].Namespace = ns
+					args[i].Vec, _ = randFloat64Slice(3)
+				}
+				if r := NewClient(addr, time.Second).AddData(args); r.NetErr != nil {
+					t.Fatal("one node got a network err:", r.NetErr)
+				}
+			}
+		}
+		add(3)
+		time.Sleep(time.Millisecond * 300)
+		add(2)
+
+		args := DeleteOlderThanArgs{Namespace: ns, OlderThan: time.Millisecond * 150}
+		ch, nResps := countChan(NewClients(tn.addrs, time.Second).DeleteOlderThan(args))
+		if nResps != n {
+			t.Fatal("unexpected amt of responses:", nResps)
+		}
+		for clientResult := range ch {
+			if err := clientResult.NetErr; err != nil {
+				t.Fatal("one node got a network err:", err)
+			}
+			if clientResult.Payload != 3 {
+				t.Fatal("one node got an unexpected delete count:", clientResult.Payload)
+			}
+		}
+
+		for _, addr := range tn.addrs {
+			r := NewClient(addr, time.Second).Info().SSpaceLen(ns)
+			if r.NetErr != nil || r.Payload.NVecs != 2 {
+				t.Fatalf("node %v: unexpected len after delete: %+v", addr, r)
+			}
+			// Nothing is deleted without an age.
+			args := DeleteOlderThanArgs{Namespace: ns}
+			if r := NewClient(addr, time.Second).DeleteOlderThan(args); r.Payload != 0 {
+				t.Fatalf("node %v: unexpected delete count: %v", addr, r.Payload)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal("could not setup a test network:", err)
+	}
+}
+
 func TestCompositeKNNEagerx(t *testing.T) {
 	err := withNetwork(t, 5, func(tn *testNetwork) {
 		for _, node := range tn.nodes {
@@ -139,3 +248,238 @@ func TestCompositeKNNEagerx(t *testing.T) {
 		t.Fatal("could not setup a test network:", err)
 	}
 }
+
+func TestCompositeKNNEagerxWithResps(t *testing.T) {
+	n := 3
+	err := withNetwork(t, n, func(tn *testNetwork) {
+		for _, node := range tn.nodes {
+			node.fill(1000)
+		}
+		node := tn.nodes[tn.addrs[0]]
+		ns := node.rManMeta.namespace
+		dim := node.rManMeta.poolVecDim
+
+		v, _ := randFloat64Slice(dim)
+		args := rman.KNNArgs{
+			Namespace: ns,
+			Priority:  1,
+			QueryVec:  v,
+			KNNMethod: rman.KNNMethodCosineSimilarity,
+			Ascending: false,
+			K:         3,
+			Extent:    0.5,
+			Accept:    2, // Never accept early; scan everything.
+			Reject:    -2,
+			TTL:       time.Minute,
+			Stats:     true,
+		}
+
+		r, resps := NewClients(tn.addrs, args.TTL).KNNEagerxWithResps(args)
+		if len(r) != args.K {
+			t.Fatal("unexpected result len:", len(r))
+		}
+		if len(resps) != n {
+			t.Fatal("unexpected resps len:", len(resps))
+		}
+		for _, resp := range resps {
+			if resp.Payload.KNN != nil {
+				t.Fatal("unexpected KNN items in resp")
+			}
+			if resp.Payload.Stats == nil {
+				t.Fatal("missing stats")
+			}
+			if resp.Payload.Stats.Candidates != 500 {
+				t.Fatal("unexpected scan count:", resp.Payload.Stats.Candidates)
+			}
+		}
+
+		// Stats should not be included unless requested.
+		args.Stats = false
+		_, resps = NewClients(tn.addrs, args.TTL).KNNEagerxWithResps(args)
+		for _, resp := range resps {
+			if resp.Payload.Stats != nil {
+				t.Fatal("got stats without requesting them")
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal("could not setup a test network:", err)
+	}
+}
+
+func TestCompositeKNNEagerxDedupByID(t *testing.T) {
+	err := withNetwork(t, 2, func(tn *testNetwork) {
+		ns := "dedup"
+		// Ordered by cosine similarity to the query vec (first is the best).
+		dup := AddDataArgs{Namespace: ns, Vec: []float64{1, 0, 0}, ID: "dup"}
+		a := AddDataArgs{Namespace: ns, Vec: []float64{1, 0.1, 0}, ID: "a"}
+		noID := AddDataArgs{Namespace: ns, Vec: []float64{1, 0.15, 0}}
+		b := AddDataArgs{Namespace: ns, Vec: []float64{1, 0.2, 0}, ID: "b"}
+
+		// 'dup' and 'noID' are replicated on both nodes.
+		payloads := [][]AddDataArgs{{dup, a, noID}, {dup, noID, b}}
+		for i, addr := range tn.addrs {
+			r := NewClient(addr, time.Second).AddData(payloads[i])
+			if r.NetErr != nil {
+				t.Fatal("one node got a network err:", r.NetErr)
+			}
+			for _, status := range r.Payload {
+				if status != AddDataOk {
+					t.Fatalf("node %v: unexpected status: %v", addr, status)
+				}
+			}
+		}
+
+		args := rman.KNNArgs{
+			Namespace: ns,
+			Priority:  1,
+			QueryVec:  []float64{1, 0, 0},
+			KNNMethod: rman.KNNMethodCosineSimilarity,
+			Ascending: false,
+			K:         4,
+			Extent:    1,
+			Accept:    2, // Never accept early; scan everything.
+			Reject:    -2,
+			TTL:       time.Minute,
+		}
+
+		check := func(cs *Clients, want []string) {
+			r := cs.KNNEagerx(args)
+			have := make([]string, len(r))
+			for i, clientResult := range r {
+				have[i] = clientResult.Payload.ID
+			}
+			if fmt.Sprint(have) != fmt.Sprint(want) {
+				t.Fatalf("dedup=%v: want ids %q, have %q", cs.DedupByID, want, have)
+			}
+		}
+
+		cs := NewClients(tn.addrs, args.TTL)
+		check(cs, []string{"dup", "dup", "a", ""})
+		// Items without an ID are not deduplicated.
+		cs.DedupByID = true
+		check(cs, []string{"dup", "a", "", ""})
+	})
+
+	if err != nil {
+		t.Fatal("could not setup a test network:", err)
+	}
+}
+
+func TestCompositeFailureCooldown(t *testing.T) {
+	addrUp := freeLocalNoFail(t)
+	addrDown := freeLocalNoFail(t)
+	cooldown := time.Millisecond * 200
+
+	err := withTestNode(addrUp, func(_ *testNode) {
+		failures, _ := NewFailureTracker(cooldown)
+		newClients := func() *Clients {
+			cs := NewClients([]string{addrUp, addrDown}, time.Second)
+			cs.Failures = failures
+			return cs
+		}
+
+		// Nothing listens on addrDown, so it fails.
+		ch := newClients().Info().SSpaceNamespaces()
+		if _, n := countChan(ch); n != 2 {
+			t.Fatal("unexpected amt of responses:", n)
+		}
+		if !failures.Cooling(addrDown) || failures.Cooling(addrUp) {
+			t.Fatal("unexpected cooldown state after failure")
+		}
+
+		// Recover, but it should still be skipped during the cooldown.
+		err := withTestNode(addrDown, func(_ *testNode) {
+			ch := newClients().Info().SSpaceNamespaces()
+			for r := range ch {
+				if r.RemoteAddr == addrDown {
+					t.Fatal("addr was not skipped during cooldown")
+				}
+			}
+
+			time.Sleep(cooldown)
+			ch = newClients().Info().SSpaceNamespaces()
+			results := ch.collectToMap()
+			if failures.Cooling(addrDown) {
+				t.Fatal("unexpected cooldown state after recovery")
+			}
+			if len(results) != 2 || results[addrDown].NetErr != nil {
+				t.Fatal("recovered addr was not re-included after cooldown")
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal("could not setup a test node:", err)
+	}
+}
+
+func TestCompositeCircuitBreaker(t *testing.T) {
+	addr := freeLocalNoFail(t)
+	openTimeout := time.Millisecond * 200
+	breaker, _ := NewCircuitBreaker(NewCircuitBreakerArgs{
+		FailThreshold: 2,
+		OpenTimeout:   openTimeout,
+	})
+	ping := func() *ClientResult[bool] {
+		ch := NewClientsWithBreaker([]string{addr}, breaker, time.Second).Ping()
+		return ch.collectToMap()[addr]
+	}
+
+	// Nothing listens on addr, so the calls fail (after dialing).
+	for i := 0; i < 2; i++ {
+		if state := breaker.State(addr); state != CircuitClosed {
+			t.Fatalf("unexpected state before failure %v: %v", i, state)
+		}
+		r := ping()
+		if r.NetErr == nil || errors.Is(r.NetErr, ErrCircuitOpen) {
+			t.Fatal("expected a dial err, have:", r.NetErr)
+		}
+	}
+	if state := breaker.State(addr); state != CircuitOpen {
+		t.Fatal("unexpected state after repeated failures:", state)
+	}
+
+	err := withTestNode(addr, func(_ *testNode) {
+		// Fail fast while open, even though the addr is up.
+		if r := ping(); !errors.Is(r.NetErr, ErrCircuitOpen) {
+			t.Fatal("expected fast fail while open, have:", r.NetErr)
+		}
+
+		time.Sleep(openTimeout)
+		if state := breaker.State(addr); state != CircuitHalfOpen {
+			t.Fatal("unexpected state after open timeout:", state)
+		}
+		// Probe.
+		if r := ping(); r.NetErr != nil || !r.Payload {
+			t.Fatal("unexpected probe result:", r.NetErr)
+		}
+		if state := breaker.State(addr); state != CircuitClosed {
+			t.Fatal("unexpected state after successful probe:", state)
+		}
+	})
+	if err != nil {
+		t.Fatal("could not setup a test node:", err)
+	}
+
+	// A failed probe re-opens the circuit.
+	for i := 0; i < 2; i++ {
+		ping()
+	}
+	time.Sleep(openTimeout)
+	if r := ping(); errors.Is(r.NetErr, ErrCircuitOpen) {
+		t.Fatal("expected a probe while half-open")
+	}
+	if state := breaker.State(addr); state != CircuitOpen {
+		t.Fatal("unexpected state after failed probe:", state)
+	}
+
+	// Invalid cfg.
+	if _, ok := NewCircuitBreaker(NewCircuitBreakerArgs{}); ok {
+		t.Fatal("expected not-ok with zero value args")
+	}
+}
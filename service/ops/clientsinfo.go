@@ -28,6 +28,9 @@ func (csi *CSInfo) SSpaceNamespaces() ClientResults[[]string] {
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
 
@@ -47,6 +50,9 @@ func (csi *CSInfo) SSpaceNamespace(key string) ClientResults[bool] {
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
 
@@ -66,6 +72,9 @@ func (csi *CSInfo) SSpaceDim(key string) ClientResults[SSpaceDimResp] {
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
 
@@ -85,6 +94,31 @@ func (csi *CSInfo) SSpaceLen(key string) ClientResults[SSpaceLenResp] {
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
+	})
+}
+
+// SSpaceVersion does a composite call to Client.Info().SSpaceVersion(),
+// using all internal addrs. See docs for that method for more details.
+func (csi *CSInfo) SSpaceVersion(key string) ClientResults[SSpaceVersionResp] {
+	// Nested return type.
+	type T = SSpaceVersionResp
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.Info().SSpaceVersion(key)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       csi.RemoteAddrs,
+		ttl:         csi.Timeout,
+		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
 
@@ -104,6 +138,9 @@ func (csi *CSInfo) SSpaceCap(key string) ClientResults[SSpaceCapResp] {
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
 
@@ -123,6 +160,9 @@ func (csi *CSInfo) KNNLatency(args KNNLatencyArgs) ClientResults[KNNLatencyResp]
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
 
@@ -142,5 +182,52 @@ func (csi *CSInfo) KNNMonitor(args KNNMonArgs) ClientResults[rman.KNNMonItemAvg]
 		addrs:       csi.RemoteAddrs,
 		ttl:         csi.Timeout,
 		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
+	})
+}
+
+// KNNMonitorSeries does a composite call to Client.Info().KNNMonitorSeries(),
+// using all internal addrs. See docs for that method for more details.
+func (csi *CSInfo) KNNMonitorSeries(args KNNMonArgs) ClientResults[[]rman.KNNMonItemAvg] {
+	// Nested return type.
+	type T = []rman.KNNMonItemAvg
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.Info().KNNMonitorSeries(args)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       csi.RemoteAddrs,
+		ttl:         csi.Timeout,
+		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
+	})
+}
+
+// NormHistogram does a composite call to Client.Info().NormHistogram(), using
+// all internal addrs. See docs for that method for more details.
+func (csi *CSInfo) NormHistogram(args NormHistogramArgs) ClientResults[NormHistogramResp] {
+	// Nested return type.
+	type T = NormHistogramResp
+
+	// Request/task func per client/address.
+	rf := func(c *Client) *ClientResult[T] {
+		return c.Info().NormHistogram(args)
+	}
+
+	// Concurrent requests.
+	return fanInRequests(fanInRequestsArgs[T]{
+		addrs:       csi.RemoteAddrs,
+		ttl:         csi.Timeout,
+		requestFunc: rf,
+		failures:    csi.Failures,
+		breaker:     csi.Breaker,
+		skipFailed:  true,
 	})
 }
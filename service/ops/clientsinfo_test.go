@@ -295,3 +295,43 @@ func TestCompositeInfoKNNMonitor(t *testing.T) {
 	}
 
 }
+
+func TestCompositeInfoNormHistogram(t *testing.T) {
+	n := 3
+	err := withNetwork(t, n, func(tn *testNetwork) {
+		// Create some data so there is a namespace.
+		for _, node := range tn.nodes {
+			node.fill(10)
+		}
+
+		// Any node to get namespace.
+		ns := tn.nodes[tn.addrs[0]].rManMeta.namespace
+
+		args := NormHistogramArgs{Key: ns, Buckets: 2}
+		ch := NewClients(tn.addrs).Info().NormHistogram(args)
+
+		// Check amt. for results.
+		ch, nResults := countChan(ch)
+		if nResults != n {
+			t.Fatal("got an unexpected amt of results:", nResults)
+		}
+
+		for clientResult := range ch {
+			if err := clientResult.NetErr; err != nil {
+				t.Fatal("one node got a network err:", err)
+			}
+
+			if !clientResult.Payload.LookupOk {
+				t.Fatal("one node got a not-ok namespace lookup")
+			}
+
+			if hist := clientResult.Payload.Histogram; hist.N != 10 {
+				t.Fatal("got unexpected histogram:", hist)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal("could not setup a test network:", err)
+	}
+}
@@ -0,0 +1,63 @@
+package ops
+
+import (
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+)
+
+/*
+File contains the codec selection of the rpc layer (Server and Client). By
+default, net/rpc uses gob, which is efficient but practically Go only. The
+jsonrpc codec (JSON-RPC 1.0, see net/rpc/jsonrpc) enables clients in other
+languages to talk to a Server directly, e.g by writing the following on a tcp
+connection (one JSON object per request):
+	{"method": "Server.Ping", "params": [{"Payload": false}], "id": 1}
+*/
+
+// Codec selects the encoding of rpc calls between a Client and a Server, which
+// must use the same one. The zero value is CodecGob. Note that AddDataStream
+// has its own protocol (see stream.go), which is gob encoded regardless.
+type Codec int
+
+const (
+	// CodecGob is the default codec of net/rpc.
+	CodecGob Codec = iota
+	// CodecJSON is the codec of net/rpc/jsonrpc, i.e JSON-RPC 1.0.
+	CodecJSON
+)
+
+// Ok returns true if the Codec is one of the constants above.
+func (c Codec) Ok() bool {
+	return c == CodecGob || c == CodecJSON
+}
+
+// String returns a human-readable name of the Codec.
+func (c Codec) String() string {
+	switch c {
+	case CodecGob:
+		return "gob"
+	case CodecJSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+// serveConn serves conn with the given handler (blocking), using the Codec.
+// Protocol versions are checked regardless of the Codec, see version.go.
+func (c Codec) serveConn(handler *rpc.Server, conn io.ReadWriteCloser) {
+	if c == CodecJSON {
+		handler.ServeCodec(versionServerCodec{jsonrpc.NewServerCodec(conn)})
+		return
+	}
+	handler.ServeCodec(versionServerCodec{newGobServerCodec(conn)})
+}
+
+// newClient returns an rpc.Client which uses the Codec on conn.
+func (c Codec) newClient(conn io.ReadWriteCloser) *rpc.Client {
+	if c == CodecJSON {
+		return jsonrpc.NewClient(conn)
+	}
+	return rpc.NewClient(conn)
+}
@@ -0,0 +1,63 @@
+package ops
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCodecJSON(t *testing.T) {
+	addr := freeLocalNoFail(t)
+	node, err := newTestNodeWithCodec(addr, CodecJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.stopFunc()
+	node.fill(100)
+
+	// Ping with plain JSON, as a client in another language would.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := map[string]any{
+		"method": "Server.Ping",
+		"params": []any{map[string]any{"Payload": false}},
+		"id":     1,
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		ID     int
+		Result SResp[bool]
+		Error  any
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 1 || resp.Error != nil || !resp.Result.Payload {
+		t.Fatalf("unexpected ping resp: %+v", resp)
+	}
+
+	// KNN with a jsonrpc client.
+	client := NewClientWithCodec(addr, CodecJSON)
+	args := node.rManMeta.randKNNArgs()
+	args.Extent = 1
+	args.Reject = -1
+	r := client.KNNEager(args)
+	if r.NetErr != nil {
+		t.Fatal(r.NetErr)
+	}
+	if !r.Payload.Ok || len(r.Payload.KNN) != args.K {
+		t.Fatalf("unexpected knn resp: %+v", r.Payload)
+	}
+
+	// Codecs must match.
+	if r := NewClient(addr, time.Second).Ping(); r.NetErr == nil {
+		t.Fatal("unexpected nil err for a gob client against a json server")
+	}
+}
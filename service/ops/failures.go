@@ -0,0 +1,93 @@
+package ops
+
+import (
+	"sync"
+	"time"
+)
+
+// FailureTracker keeps track of recent network failures per remote addr. It
+// is intended to be shared between Clients instances (see Clients.Failures),
+// such that composite read operations can skip addrs that failed recently,
+// instead of waiting for them to time out again. An addr is said to be cooling
+// down for FailureTracker.Cooldown after its last failure.
+type FailureTracker struct {
+	mx       sync.Mutex
+	failed   map[string]time.Time
+	cooldown time.Duration
+}
+
+// NewFailureTracker is a factory func for FailureTracker, where 'cooldown' is
+// how long addrs are skipped after a failure. Returns false if cooldown <= 0.
+func NewFailureTracker(cooldown time.Duration) (*FailureTracker, bool) {
+	if cooldown <= 0 {
+		return nil, false
+	}
+	ft := FailureTracker{
+		failed:   make(map[string]time.Time),
+		cooldown: cooldown,
+	}
+	return &ft, true
+}
+
+// Fail registers a failure for the given addr, which starts (or restarts) the
+// cooldown of that addr.
+func (ft *FailureTracker) Fail(addr string) {
+	ft.mx.Lock()
+	defer ft.mx.Unlock()
+	ft.failed[addr] = time.Now()
+}
+
+// Ok registers a success for the given addr, which ends its cooldown.
+func (ft *FailureTracker) Ok(addr string) {
+	ft.mx.Lock()
+	defer ft.mx.Unlock()
+	delete(ft.failed, addr)
+}
+
+// Cooling returns true if the given addr failed within the cooldown window.
+func (ft *FailureTracker) Cooling(addr string) bool {
+	ft.mx.Lock()
+	defer ft.mx.Unlock()
+	return ft.cooling(addr)
+}
+
+// cooling is the same as FailureTracker.Cooling but without mutex protection.
+// Expired failures are removed.
+func (ft *FailureTracker) cooling(addr string) bool {
+	t, ok := ft.failed[addr]
+	if !ok {
+		return false
+	}
+	if time.Since(t) >= ft.cooldown {
+		delete(ft.failed, addr)
+		return false
+	}
+	return true
+}
+
+// filter returns the addrs that are not cooling down. If all of them are, then
+// all are returned, as skipping everything would make the call pointless.
+func (ft *FailureTracker) filter(addrs []string) []string {
+	ft.mx.Lock()
+	defer ft.mx.Unlock()
+
+	r := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !ft.cooling(addr) {
+			r = append(r, addr)
+		}
+	}
+	if len(r) == 0 {
+		return addrs
+	}
+	return r
+}
+
+// register calls FailureTracker.Fail if 'err' is not nil, else FailureTracker.Ok.
+func (ft *FailureTracker) register(addr string, err error) {
+	if err != nil {
+		ft.Fail(addr)
+		return
+	}
+	ft.Ok(addr)
+}
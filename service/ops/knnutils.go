@@ -21,12 +21,24 @@ func Distancer2Vec(d mathx.Distancer) []float64 {
 	return r
 }
 
+// Distancer2ID returns the ID of a mathx.Distancer, if it has one (e.g it was
+// added with AddDataArgs.ID set, see mathx.FloatVec.ID). Returns an empty
+// string otherwise.
+func Distancer2ID(d mathx.Distancer) string {
+	if ider, ok := d.(interface{ ID() string }); ok {
+		return ider.ID()
+	}
+	return ""
+}
+
 // KNNRespItemFromScoreItem converts KNN results (pkg knnc and requestman)
 // into a KNNRespItem. See docs for Distancer2Vec for why this is needed.
 func KNNRespItemFromScoreItem(scoreItem knnc.ScoreItem) KNNRespItem {
 	return KNNRespItem{
 		Vec:   Distancer2Vec(scoreItem.Distancer),
 		Score: scoreItem.Score,
+		ID:    Distancer2ID(scoreItem.Distancer),
+		Added: scoreItem.Added,
 	}
 }
 
@@ -79,3 +91,35 @@ func bubbleInsert[T any](s []sortItem[T], insertee sortItem[T], ascending bool)
 		}
 	}
 }
+
+// bubbleInsertUnique is the same as bubbleInsert, except that the insertee is
+// treated as a duplicate of any element in the slice with the same key (as
+// returned by the given func, where an empty key is never a duplicate). Only
+// the better scoring one of duplicates is kept, i.e the insertee is ignored if
+// the existing element is equal or better, and the existing element is removed
+// otherwise (before the insert).
+func bubbleInsertUnique[T any](
+	s []sortItem[T],
+	insertee sortItem[T],
+	ascending bool,
+	key func(T) string,
+) {
+	k := key(insertee.data)
+	for i := 0; k != "" && i < len(s); i++ {
+		if !s[i].set || key(s[i].data) != k {
+			continue
+		}
+
+		better := insertee.score < s[i].score && ascending
+		better = better || insertee.score > s[i].score && !ascending
+		if !better {
+			return
+		}
+
+		// Remove, shifting the rest such that unset items stay last.
+		copy(s[i:], s[i+1:])
+		s[len(s)-1] = sortItem[T]{}
+		break
+	}
+	bubbleInsert(s, insertee, ascending)
+}
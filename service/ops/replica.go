@@ -0,0 +1,177 @@
+package ops
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	rman "github.com/crunchypi/ddrop/service/requestman"
+)
+
+/*
+File contains the read-replica mode of Server (see NewReplicaServer), where a
+Server mirrors the data of another one (the primary), such that reads can be
+scaled out. The replica pulls delta snapshots (see requestman.SnapshotArgs) from
+the primary with Client.Snapshot, at an interval, and restores them locally.
+*/
+
+// replicaDefaultInterval is the default of ReplicaArgs.Interval.
+const replicaDefaultInterval = time.Second
+
+// ReplicaArgs is intended as args for NewReplicaServer.
+type ReplicaArgs struct {
+	// SourceAddr is the addr of the Server which is mirrored (the primary).
+	SourceAddr string
+	// SourceCodec is the Codec of the primary, see NewServerWithCodec.
+	SourceCodec Codec
+	// Interval is the time between syncs with the primary.
+	// Optional, 0 defaults to 1s.
+	Interval time.Duration
+	// Timeout is used for calls to the primary, see NewClient.
+	// Optional, 0 defaults to the default of NewClient.
+	Timeout time.Duration
+}
+
+// Ok returns true if all the following conditions are true:
+// - args.SourceAddr != ""
+// - args.SourceCodec.Ok() == true
+// - args.Interval >= 0
+// - args.Timeout >= 0
+func (args *ReplicaArgs) Ok() bool {
+	ok := true
+	ok = ok && args.SourceAddr != ""
+	ok = ok && args.SourceCodec.Ok()
+	ok = ok && args.Interval >= 0
+	ok = ok && args.Timeout >= 0
+	return ok
+}
+
+// NewReplicaServer is the same as NewServer, except that the Server is a read
+// replica of the Server at args.SourceAddr (the primary). It syncs with the
+// primary once per args.Interval, where it pulls all data added to the primary
+// since the last sync (see Client.Snapshot) and adds it to its own internal
+// requestman.Handle. The first sync pulls everything, including namespaces
+// with pinned dims. Reads (KNN and info) are served as usual, while writes
+// (AddData, AddDataStream, CreateNamespace and DeleteOlderThan) are rejected,
+// with AddDataReadOnly, CreateNamespaceRejected and 0, respectively. Syncing
+// stops when the internal requestman.Handle is stopped (see Server.StartListen).
+// Returns (nil, false) if !args.Ok(), or for the same reasons as NewServer.
+//
+// Replication lag: data added to the primary becomes visible on the replica
+// after the next sync, i.e after up to args.Interval plus the time of the sync
+// itself (which grows with the amount of new data). Failed syncs (e.g if the
+// primary is unreachable) are retried at the next interval, so the lag grows
+// while the primary is unreachable. Note that only additions are mirrored, as
+// with delta snapshots: data deleted on the primary (DeleteOlderThan) is kept
+// by the replica, though expiration times are mirrored along with the data.
+// Also, the sync position is the snapshot version of the primary, which starts
+// over if the primary restarts, so the replica must be restarted as well.
+func NewReplicaServer(
+	localAddr string,
+	rManHandleArgs rman.NewHandleArgs,
+	args ReplicaArgs,
+) (*Server, bool) {
+	if !args.Ok() {
+		return nil, false
+	}
+	s, ok := NewServer(localAddr, rManHandleArgs)
+	if !ok {
+		return nil, false
+	}
+	s.readOnly = true
+
+	interval := args.Interval
+	if interval == 0 {
+		interval = replicaDefaultInterval
+	}
+	c := NewClientWithCodec(args.SourceAddr, args.SourceCodec, args.Timeout)
+	go s.replicate(c, interval)
+	return s, true
+}
+
+// replicate syncs with the primary (using c) once per interval, until s.ctx is
+// done. This method will block.
+func (s *Server) replicate(c *Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	since := uint64(0)
+	for {
+		// Failed syncs keep 'since', i.e they are simply retried.
+		since, _ = s.syncReplica(c, since)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncReplica pulls a snapshot of all data added to the primary after 'since'
+// (using c) and restores it with the internal requestman.Handle. Returns the
+// version to use as 'since' in the next sync, which is 'since' on error.
+func (s *Server) syncReplica(c *Client, since uint64) (uint64, error) {
+	r := c.Snapshot(since)
+	if r.NetErr != nil {
+		return since, r.NetErr
+	}
+	if !r.Payload.Ok {
+		return since, errors.New("ops: primary could not make a snapshot")
+	}
+	if _, err := s.rManHandle.Restore(bytes.NewReader(r.Payload.Data)); err != nil {
+		return since, err
+	}
+	return r.Payload.Version, nil
+}
+
+// SnapshotResp is intended as the response of Client.Snapshot.
+type SnapshotResp struct {
+	// Data is the snapshot, see requestman.Handle.SnapshotWithArgs.
+	Data []byte
+	// Version of the snapshot, i.e the 'since' of the next delta.
+	Version uint64
+	// Ok is false if the snapshot could not be made.
+	Ok bool
+}
+
+// Snapshot makes a (compressed) snapshot of the internal requestman.Handle with
+// the SnapshotWithArgs method, where args.Payload is SnapshotArgs.Since. Used
+// by replicas, see NewReplicaServer.
+func (s *Server) Snapshot(args SArgs[uint64], resp *SResp[SnapshotResp]) error {
+	resp.RecvTime = time.Now()
+
+	var buf bytes.Buffer
+	version, err := s.rManHandle.SnapshotWithArgs(rman.SnapshotArgs{
+		W:        &buf,
+		Compress: true,
+		Since:    args.Payload,
+	})
+	if err != nil {
+		return nil
+	}
+	resp.Payload.Data = buf.Bytes()
+	resp.Payload.Version = version
+	resp.Payload.Ok = true
+	return nil
+}
+
+// Snapshot gets a snapshot of all data on the remote server which was added
+// after the snapshot with version 'since' (0 for all data). The remote server
+// uses requestman.Handle.SnapshotWithArgs(...), see the docs for more details.
+// The snapshot can be restored with requestman.Handle.Restore.
+func (c *Client) Snapshot(since uint64) *ClientResult[SnapshotResp] {
+	// Nested return type.
+	type T = SnapshotResp
+
+	// Request.
+	send := NewSArgs(since)
+	resp := SResp[T]{}
+	nErr := c.call(callArgs{"Server.Snapshot", send, &resp})
+
+	return &ClientResult[T]{
+		RemoteAddr:     c.RemoteAddr,
+		NetErr:         nErr,
+		Payload:        resp.Payload,
+		NetworkLatency: resp.RecvTime.Sub(send.SendTime),
+	}
+}
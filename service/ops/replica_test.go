@@ -0,0 +1,119 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	rman "github.com/crunchypi/ddrop/service/requestman"
+)
+
+// waitForReplica polls SSpaceLen of the namespace on the server at 'addr' until
+// it has 'n' vecs, or fails the test after a timeout.
+func waitForReplica(t *testing.T, addr string, ns string, n int) {
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		r := NewClient(addr).Info().SSpaceLen(ns)
+		if r.NetErr == nil && r.Payload.NVecs == n {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("replica did not get %v vecs in time", n)
+}
+
+func TestReplicaServer(t *testing.T) {
+	primaryAddr := freeLocalNoFail(t)
+	replicaAddr := freeLocalNoFail(t)
+
+	err := withTestNode(primaryAddr, func(primary *testNode) {
+		ns := primary.rManMeta.namespace
+		dim := primary.rManMeta.poolVecDim
+
+		// Same setup as the primary, see newTestNodeWithCodec.
+		rManMeta := newRequestManagerMeta()
+		handleArgs := rman.NewHandleArgs{
+			NewSearchSpaceArgs:    rManMeta.newSearchSpaceArgs,
+			NewLatencyTrackerArgs: rManMeta.newLatencyTrackerArgs,
+			KNNQueueBuf:           rManMeta.knnQueueBuf,
+			KNNQueueMaxConcurrent: rManMeta.knnQueueMaxConcurrent,
+			Ctx:                   context.Background(),
+			NewKNNMonitorArgs:     rManMeta.newKNNMonitorArgs,
+		}
+		if _, ok := NewReplicaServer(replicaAddr, handleArgs, ReplicaArgs{}); ok {
+			t.Fatal("created a replica without a source addr")
+		}
+		replicaArgs := ReplicaArgs{SourceAddr: primaryAddr, Interval: time.Millisecond * 50}
+		replica, ok := NewReplicaServer(replicaAddr, handleArgs, replicaArgs)
+		if !ok {
+			t.Fatal("could not create a replica")
+		}
+		stop, err := replica.StartListen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+
+		primaryClient := NewClient(primaryAddr)
+		primaryClient.CreateNamespace(CreateNamespaceArgs{Namespace: ns, Dim: dim})
+		addData := func(from, to int) []AddDataArgs {
+			args := make([]AddDataArgs, 0, to-from)
+			for i := from; i < to; i++ {
+				vec, _ := randFloat64Slice(dim)
+				args = append(args, AddDataArgs{Namespace: ns, Vec: vec, ID: fmt.Sprint("id", i)})
+			}
+			for _, status := range primaryClient.AddData(args).Payload {
+				if status != AddDataOk {
+					t.Fatalf("unexpected status when adding to the primary: %v", status)
+				}
+			}
+			return args
+		}
+
+		added := addData(0, 50)
+		waitForReplica(t, replicaAddr, ns, 50)
+		// Later syncs only pull new data (deltas), i.e nothing is duplicated.
+		added = append(added, addData(50, 60)...)
+		waitForReplica(t, replicaAddr, ns, 60)
+
+		replicaClient := NewClient(replicaAddr)
+		if r := replicaClient.Info().SSpaceDim(ns); r.Payload.PinnedDim != dim {
+			t.Fatalf("unexpected pinned dim on the replica: %v", r.Payload.PinnedDim)
+		}
+
+		// The latest data is queryable on the replica.
+		knnArgs := rman.KNNArgs{
+			Namespace: ns,
+			Priority:  1,
+			QueryVec:  added[len(added)-1].Vec,
+			KNNMethod: rman.KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         1,
+			Extent:    1,
+			Accept:    0,
+			Reject:    100,
+			TTL:       time.Second,
+		}
+		r := replicaClient.KNNEager(knnArgs)
+		if r.NetErr != nil || !r.Payload.Ok || len(r.Payload.KNN) != 1 {
+			t.Fatalf("unexpected knn result on the replica: %+v", r)
+		}
+		if r.Payload.KNN[0].ID != added[len(added)-1].ID {
+			t.Fatalf("unexpected top result on the replica: %+v", r.Payload.KNN[0])
+		}
+
+		// Direct writes are rejected.
+		statuses := replicaClient.AddData(added[:1]).Payload
+		if len(statuses) != 1 || statuses[0] != AddDataReadOnly {
+			t.Fatalf("unexpected status when adding to the replica: %v", statuses)
+		}
+		cr := replicaClient.CreateNamespace(CreateNamespaceArgs{Namespace: "other", Dim: dim})
+		if cr.Payload != CreateNamespaceRejected {
+			t.Fatalf("unexpected status when creating a namespace on the replica: %v", cr.Payload)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,9 +12,16 @@ import (
 
 // Server is an rpc server on top of requestman.Handle.
 type Server struct {
-	LocalAddr      string
+	LocalAddr string
+	// Codec is the encoding of rpc calls, see NewServerWithCodec.
+	Codec Codec
+
 	rManHandle     *rman.Handle
 	rManHandleStop func()
+	// ctx is the ctx of rManHandle, it is done when rManHandleStop is called.
+	ctx context.Context
+	// readOnly is true for replicas, see NewReplicaServer.
+	readOnly bool
 }
 
 // NewServer is a factory function. Will return (nil, false) is a new
@@ -37,11 +44,31 @@ func NewServer(localAddr string, rManHandleArgs rman.NewHandleArgs) (*Server, bo
 		LocalAddr:      localAddr,
 		rManHandle:     rManHandle,
 		rManHandleStop: ctxStop,
+		ctx:            ctx,
 	}
 
 	return &s, true
 }
 
+// NewServerWithCodec is the same as NewServer, except that the Server uses the
+// given Codec for rpc calls (NewServer uses CodecGob), e.g CodecJSON in order
+// to serve clients which are not written in Go. Clients must use the same
+// Codec, see NewClientWithCodec. Also returns (nil, false) if !codec.Ok().
+func NewServerWithCodec(
+	localAddr string,
+	rManHandleArgs rman.NewHandleArgs,
+	codec Codec,
+) (*Server, bool) {
+	if !codec.Ok() {
+		return nil, false
+	}
+	s, ok := NewServer(localAddr, rManHandleArgs)
+	if ok {
+		s.Codec = codec
+	}
+	return s, ok
+}
+
 // StartListen spins up the server and makes it active. The returned func
 // is used for stopping (this also stops the internal requestman.Handle),
 // while the error indicates the following (These are for the setup):
@@ -50,6 +77,8 @@ func NewServer(localAddr string, rManHandleArgs rman.NewHandleArgs) (*Server, bo
 //
 // Note, while accepting requests with net.Listener.Accept(), if an err
 // is returned, then the listening event-loop simply fails.
+//
+// Note, the listener also serves AddDataStream (see Client.AddDataStream).
 func (s *Server) StartListen() (stop func(), err error) {
 	handler := rpc.NewServer()
 	if err := handler.Register(s); err != nil {
@@ -85,7 +114,7 @@ func (s *Server) StartListen() (stop func(), err error) {
 			if err != nil {
 				break
 			}
-			go handler.ServeConn(cxn)
+			go s.serveConn(handler, cxn)
 		}
 	}()
 	return stop, nil
@@ -94,27 +123,32 @@ func (s *Server) StartListen() (stop func(), err error) {
 // SArgs is used as a Server argument wrapper with metadata.
 // Go rpc methods are required to have the following signature format:
 //  x.Method(args any, resp *any) error
-// This is used as the 'args'.
+// This is used as the 'args'. Version is the protocol version of the
+// client, which is checked by the Server, see ProtocolVersion.
 type SArgs[T any] struct {
 	SendTime time.Time
 	Payload  T
+	Version  int
 }
 
 // SResp is used as a Server argument wrapper with metadata.
 // Go rpc methods are required to have the following signature format:
 //  x.Method(args any, resp *any) error
-// This is used as the 'resp'.
+// This is used as the 'resp'. Version is the protocol version of the
+// Server, which is checked by the Client, see ProtocolVersion.
 type SResp[T any] struct {
 	RecvTime time.Time
 	Payload  T
+	Version  int
 }
 
 // NewSArgs is a convenience func for setting up a new SArgs[T] with instance
-// with the SendTime field set to time.Now().
+// with the SendTime field set to time.Now() and Version set to ProtocolVersion.
 func NewSArgs[T any](payload T) SArgs[T] {
 	return SArgs[T]{
 		SendTime: time.Now(),
 		Payload:  payload,
+		Version:  ProtocolVersion,
 	}
 }
 
@@ -126,9 +160,12 @@ func (s *Server) Ping(args SArgs[bool], resp *SResp[bool]) error {
 }
 
 // AddData attempts to add the given data to the internal requestman.Handle with
-// the AddData() method. The returns of those AddData() calls are stored index
-// for index in the response.
-func (s *Server) AddData(args SArgs[[]AddDataArgs], resp *SResp[[]bool]) error {
+// the AddDataErr() method. The returns of those AddDataErr() calls are stored
+// (as AddDataStatus) index for index in the response. Note that vecs which do
+// not pass mathx.ValidVec (i.e empty or with NaN/Inf elements) are rejected by
+// the requestman.Handle, and that all data is rejected (with AddDataReadOnly)
+// by replicas (see NewReplicaServer).
+func (s *Server) AddData(args SArgs[[]AddDataArgs], resp *SResp[[]AddDataStatus]) error {
 	resp.RecvTime = time.Now()
 
 	if args.Payload == nil {
@@ -136,27 +173,92 @@ func (s *Server) AddData(args SArgs[[]AddDataArgs], resp *SResp[[]bool]) error {
 	}
 
 	// Make sure the resp.Payload slice is of matching length as args.Payload
-	// because of the way bools are stored (by index) in the loop below.
+	// because of the way statuses are stored (by index) in the loop below.
 	if resp.Payload == nil || len(resp.Payload) <= len(args.Payload) {
-		resp.Payload = make([]bool, len(args.Payload))
+		resp.Payload = make([]AddDataStatus, len(args.Payload))
 	}
 
-	// Try add.
 	for i, addDataArgs := range args.Payload {
-		resp.Payload[i] = s.rManHandle.AddData(
-			addDataArgs.Namespace,
-			rman.DistancerContainer{
-				D:       mathx.NewSafeVec(addDataArgs.Vec...),
-				Expires: addDataArgs.Expires,
-			},
-			addDataArgs.Data,
-		)
+		resp.Payload[i] = s.addData(addDataArgs)
 	}
 
 	return nil
 }
 
-// KNNEager attempts to do a KNN request using the KNN method of the internal
+// addData adds a single AddDataArgs with the internal requestman.Handle. The vec
+// is not copied (see mathx.FloatVec), so it must not be used elsewhere, which
+// holds as long as it is decoded per call.
+func (s *Server) addData(args AddDataArgs) AddDataStatus {
+	if s.readOnly {
+		return AddDataReadOnly
+	}
+	err := s.rManHandle.AddDataErr(
+		args.Namespace,
+		rman.DistancerContainer{
+			D:        mathx.NewFloatVecWithID(args.Vec, args.ID),
+			Expires:  args.Expires,
+			Tenant:   args.Tenant,
+			Metadata: args.Metadata,
+		},
+		args.Data,
+	)
+	return addDataStatusFromErr(err)
+}
+
+// CreateNamespace attempts to create a namespace with a pinned vec dimension,
+// using the CreateNamespaceWithArgs method of the internal requestman.Handle. The
+// outcome is stored as a CreateNamespaceStatus in the response. Replicas (see
+// NewReplicaServer) respond with CreateNamespaceRejected.
+func (s *Server) CreateNamespace(
+	args SArgs[CreateNamespaceArgs],
+	resp *SResp[CreateNamespaceStatus],
+) error {
+	resp.RecvTime = time.Now()
+	if s.readOnly {
+		resp.Payload = CreateNamespaceRejected
+		return nil
+	}
+	err := s.rManHandle.CreateNamespaceWithArgs(rman.CreateNamespaceArgs{
+		Namespace:        args.Payload.Namespace,
+		Dim:              args.Payload.Dim,
+		DefaultKNNMethod: args.Payload.DefaultKNNMethod,
+	})
+	resp.Payload = createNamespaceStatusFromErr(err)
+	return nil
+}
+
+// DeleteOlderThan deletes data which was added longer ago than
+// args.Payload.OlderThan, using the DeleteWhere method of the internal
+// requestman.Handle. The number of deleted vecs is stored in the response.
+// Replicas (see NewReplicaServer) do not delete anything.
+func (s *Server) DeleteOlderThan(args SArgs[DeleteOlderThanArgs], resp *SResp[int]) error {
+	resp.RecvTime = time.Now()
+	if args.Payload.OlderThan <= 0 || s.readOnly {
+		return nil
+	}
+
+	cutoff := resp.RecvTime.Add(-args.Payload.OlderThan)
+	resp.Payload = s.rManHandle.DeleteWhere(
+		args.Payload.Namespace,
+		func(id string, d mathx.Distancer, added time.Time) bool {
+			return added.Before(cutoff)
+		},
+	)
+	return nil
+}
+
+// GetVector gets the vec with args.Payload.ID in args.Payload.Namespace, using
+// the Info().SSpaceVecByID method of the internal requestman.Handle.
+func (s *Server) GetVector(args SArgs[GetVectorArgs], resp *SResp[GetVectorResp]) error {
+	resp.RecvTime = time.Now()
+	resp.Payload.Vec, resp.Payload.Found = s.rManHandle.Info().SSpaceVecByID(
+		args.Payload.Namespace,
+		args.Payload.ID,
+	)
+	return nil
+}
+
+// KNNEager attempts to do a KNN request using the KNNEager method of the internal
 // requestmanager.Handle. It does so eagerly, so will wait until the KNN request
 // is complete.
 //
@@ -170,19 +272,17 @@ func (s *Server) KNNEager(args SArgs[rman.KNNArgs], resp *SResp[KNNResp]) error
 		return nil
 	}
 
-	// Do request.
-	enqueueResult, ok := s.rManHandle.KNN(args.Payload)
+	// Do request, awaiting the result.
+	enqueueResult, result, ok := s.rManHandle.KNNEager(args.Payload)
 	if !ok {
+		(*resp).Payload.RetryAfter = enqueueResult.RetryAfter
 		return nil
 	}
 
-	// Await result.
-	select {
-	case <-time.After(args.Payload.TTL + time.Microsecond):
-		enqueueResult.Cancel.Cancel()
-	case result := <-enqueueResult.Pipe:
-		(*resp).Payload.KNN = KNNRespItemsFromScoreItems(result)
-		(*resp).Payload.Ok = true
+	(*resp).Payload.KNN = KNNRespItemsFromScoreItems(result)
+	(*resp).Payload.Ok = true
+	if args.Payload.Stats {
+		(*resp).Payload.Stats = enqueueResult.Stats
 	}
 
 	return nil
@@ -36,6 +36,7 @@ func (i *SInfo) SSpaceDim(args SArgs[string], resp *SResp[SSpaceDimResp]) error
 	dim, nsOk := i.rManHandle.Info().SSpaceDim(args.Payload)
 	resp.Payload.LookupOk = nsOk
 	resp.Payload.Dim = dim
+	resp.Payload.PinnedDim, _ = i.rManHandle.Info().SSpacePinnedDim(args.Payload)
 	return nil
 }
 
@@ -51,6 +52,17 @@ func (i *SInfo) SSpaceLen(args SArgs[string], resp *SResp[SSpaceLenResp]) error
 	return nil
 }
 
+// SSpaceVersion forwards the call to the method with the same name on top of
+// the internal requestman.Handle.Info(). See docs for that for more details.
+func (i *SInfo) SSpaceVersion(args SArgs[string], resp *SResp[SSpaceVersionResp]) error {
+	resp.RecvTime = time.Now()
+
+	version, nsOk := i.rManHandle.Info().SSpaceVersion(args.Payload)
+	resp.Payload.LookupOk = nsOk
+	resp.Payload.Version = version
+	return nil
+}
+
 // SSpaceCap forwards the call to the method with the same name on top of
 // the internal requestman.Handle.Info(). See docs for that for more details.
 func (i *SInfo) SSpaceCap(args SArgs[string], resp *SResp[SSpaceCapResp]) error {
@@ -91,9 +103,34 @@ func (i *SInfo) KNNLatency(args SArgs[KNNLatencyArgs], resp *SResp[KNNLatencyRes
 func (i *SInfo) KNNMonitor(args SArgs[KNNMonArgs], resp *SResp[rman.KNNMonItemAvg]) error {
 	resp.RecvTime = time.Now()
 	resp.Payload = i.rManHandle.Info().KNNMonitor(
+		args.Payload.Namespace,
+		args.Payload.Start,
+		args.Payload.End,
+	)
+
+	return nil
+}
+
+// KNNMonitorSeries forwards the call to the method with the same name on top of
+// the internal requestman.Handle.Info(). See docs for that for more details.
+func (i *SInfo) KNNMonitorSeries(args SArgs[KNNMonArgs], resp *SResp[[]rman.KNNMonItemAvg]) error {
+	resp.RecvTime = time.Now()
+	resp.Payload = i.rManHandle.Info().KNNMonitorSeries(
+		args.Payload.Namespace,
 		args.Payload.Start,
 		args.Payload.End,
 	)
 
 	return nil
 }
+
+// NormHistogram forwards the call to the method with the same name on top of
+// the internal requestman.Handle.Info(). See docs for that for more details.
+func (i *SInfo) NormHistogram(args SArgs[NormHistogramArgs], resp *SResp[NormHistogramResp]) error {
+	resp.RecvTime = time.Now()
+
+	hist, ok := i.rManHandle.Info().NormHistogram(args.Payload.Key, args.Payload.Buckets)
+	resp.Payload.LookupOk = ok
+	resp.Payload.Histogram = hist
+	return nil
+}
@@ -0,0 +1,200 @@
+package ops
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+/*
+File contains streaming ingest, i.e a way of adding data with a persistent
+connection (AddDataStream) instead of one rpc call per batch (Client.AddData).
+
+This is not a net/rpc method, as those are single call/response pairs, so it
+uses a small protocol of its own, served on the same listener as Server:
+	- The client writes addDataStreamMagic as the first bytes of a connection,
+	  which Server uses to tell the connection apart from net/rpc calls.
+	- The client writes any number of gob encoded addDataStreamFrame, where the
+	  last one has Done set to true.
+	- The server adds each AddDataArgs as it is read, and responds with one gob
+	  encoded AddDataStreamResp after the last frame. The conn is then closed.
+*/
+
+// addDataStreamMagic is written first on a conn used for AddDataStream.
+// net/rpc conns are gob encoded and never start with these bytes.
+const addDataStreamMagic = "ddrop:stream:adddata\n"
+
+// ErrStreamClosed is returned when using an AddDataStream after Close.
+var ErrStreamClosed = errors.New("stream is closed")
+
+// addDataStreamFrame is a single message sent from AddDataStream to Server.
+type addDataStreamFrame struct {
+	Args AddDataArgs
+	// Done ends the stream, Args is not used if this is true.
+	Done bool
+}
+
+// AddDataStreamResp is the summary of an entire AddDataStream, as the statuses
+// of individual items are not sent back (see AddDataStatus).
+type AddDataStreamResp struct {
+	// N is the number of AddDataArgs received by the server.
+	N int
+	// Statuses is the count of each AddDataStatus, the values sum up to N.
+	Statuses map[AddDataStatus]int
+}
+
+/*
+--------------------------------------------------------------------------------
+Server side.
+--------------------------------------------------------------------------------
+*/
+
+// peekedConn is a net.Conn where reads go through a bufio.Reader, such that
+// bytes which were peeked before the conn is served are not lost.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the internal bufio.Reader.
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveConn serves a conn either as an AddDataStream or with the given handler
+// (net/rpc, using Server.Codec), depending on whether the conn starts with
+// addDataStreamMagic.
+func (s *Server) serveConn(handler *rpc.Server, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	magic, err := r.Peek(len(addDataStreamMagic))
+	if err == nil && string(magic) == addDataStreamMagic {
+		r.Discard(len(magic))
+		s.serveAddDataStream(conn, r)
+		return
+	}
+
+	// Note, on err (e.g EOF), the handler gets to deal with it.
+	s.Codec.serveConn(handler, &peekedConn{Conn: conn, r: r})
+}
+
+// serveAddDataStream reads addDataStreamFrame from r until one is Done, and
+// adds the data with the internal requestman.Handle (same as Server.AddData).
+// The resp is only sent if the stream ends properly.
+func (s *Server) serveAddDataStream(conn net.Conn, r io.Reader) {
+	defer conn.Close()
+
+	dec := gob.NewDecoder(r)
+	resp := AddDataStreamResp{Statuses: make(map[AddDataStatus]int)}
+	for {
+		// A new frame for each iter, because gob reuses the slices of the
+		// target while the vecs are not copied when added (see Server.addData).
+		var frame addDataStreamFrame
+		if err := dec.Decode(&frame); err != nil {
+			return
+		}
+		if frame.Done {
+			break
+		}
+
+		resp.N++
+		resp.Statuses[s.addData(frame.Args)]++
+	}
+
+	gob.NewEncoder(conn).Encode(resp)
+}
+
+/*
+--------------------------------------------------------------------------------
+Client side.
+--------------------------------------------------------------------------------
+*/
+
+// AddDataStream is a persistent connection to a Server, used for adding data
+// continuously. It is created with Client.AddDataStream. Data is sent with the
+// Send method and added by the Server as it arrives. The stream must be ended
+// with the Close method, which also returns a summary of the entire stream.
+//
+// Note; an AddDataStream is not safe for concurrent use.
+type AddDataStream struct {
+	RemoteAddr string
+	// timeout is used when awaiting the resp in Close.
+	timeout time.Duration
+	conn    net.Conn
+	w       *bufio.Writer
+	enc     *gob.Encoder
+	closed  bool
+}
+
+// AddDataStream opens a new AddDataStream to the remote server. Returns an err
+// if the server could not be reached (within Client.Timeout).
+func (c *Client) AddDataStream() (*AddDataStream, error) {
+	conn, err := net.DialTimeout("tcp", c.RemoteAddr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	if _, err := w.WriteString(addDataStreamMagic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := AddDataStream{
+		RemoteAddr: c.RemoteAddr,
+		timeout:    c.Timeout,
+		conn:       conn,
+		w:          w,
+		enc:        gob.NewEncoder(w),
+	}
+	return &s, nil
+}
+
+// Send sends a single AddDataArgs to the remote server. Writes are buffered,
+// so the data might not be sent before the buffer fills up, or on Flush/Close.
+// As such, a returned err might originate from an earlier Send. The stream is
+// not usable after an err, other than calling Close (to release resources).
+func (s *AddDataStream) Send(args AddDataArgs) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	return s.enc.Encode(addDataStreamFrame{Args: args})
+}
+
+// Flush sends any buffered data to the remote server.
+func (s *AddDataStream) Flush() error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	return s.w.Flush()
+}
+
+// Close ends the stream and awaits (for at most Client.Timeout) a summary from
+// the remote server. The summary is only received if all data was sent, so
+// ClientResult.NetErr is set otherwise. Note that ClientResult.NetworkLatency
+// is not set, as it is not meaningful for an entire stream.
+func (s *AddDataStream) Close() *ClientResult[AddDataStreamResp] {
+	r := ClientResult[AddDataStreamResp]{RemoteAddr: s.RemoteAddr}
+	if s.closed {
+		r.NetErr = ErrStreamClosed
+		return &r
+	}
+	s.closed = true
+	defer s.conn.Close()
+
+	if r.NetErr = s.enc.Encode(addDataStreamFrame{Done: true}); r.NetErr != nil {
+		return &r
+	}
+	if r.NetErr = s.w.Flush(); r.NetErr != nil {
+		return &r
+	}
+
+	if s.timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	}
+	r.NetErr = gob.NewDecoder(s.conn).Decode(&r.Payload)
+	return &r
+}
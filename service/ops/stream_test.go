@@ -0,0 +1,79 @@
+package ops
+
+import (
+	"testing"
+)
+
+func TestAddDataStream(t *testing.T) {
+	addr := freeLocalNoFail(t)
+
+	err := withTestNode(addr, func(testNode *testNode) {
+		namespace := testNode.rManMeta.namespace
+		dim := testNode.rManMeta.poolVecDim
+		rm := testNode.server.rManHandle
+
+		stream, err := NewClient(addr).AddDataStream()
+		if err != nil {
+			t.Fatal("could not open stream:", err)
+		}
+
+		n := 10_000 - 1 // Cap of the test node, minus one for the ping below.
+		for i := 0; i < n; i++ {
+			vec, _ := randFloat64Slice(dim)
+			args := AddDataArgs{Namespace: namespace, Vec: vec, Data: []byte{}}
+			if err := stream.Send(args); err != nil {
+				t.Fatal("could not send:", err)
+			}
+
+			// Regular rpc calls should work while a stream is open.
+			if i == n/2 {
+				if err := stream.Flush(); err != nil {
+					t.Fatal("could not flush:", err)
+				}
+				r := NewClient(addr).AddData([]AddDataArgs{{Namespace: namespace, Vec: vec}})
+				if r.NetErr != nil || len(r.Payload) != 1 || r.Payload[0] != AddDataOk {
+					t.Fatal("unexpected AddData result while streaming:", r)
+				}
+			}
+		}
+		// One with a dim mismatch, which is not added.
+		if err := stream.Send(AddDataArgs{Namespace: namespace, Vec: []float64{1}}); err != nil {
+			t.Fatal("could not send:", err)
+		}
+
+		r := stream.Close()
+		if r.NetErr != nil {
+			t.Fatal("unexpected err on close:", r.NetErr)
+		}
+		if r.Payload.N != n+1 {
+			t.Fatalf("want %v received, have %v", n+1, r.Payload.N)
+		}
+		if have := r.Payload.Statuses[AddDataOk]; have != n {
+			t.Fatalf("want %v ok statuses, have %v", n, have)
+		}
+		if have := r.Payload.Statuses[AddDataDimMismatch]; have != 1 {
+			t.Fatalf("want 1 dim mismatch status, have %v", have)
+		}
+		if _, l, _ := rm.Info().SSpaceLen(namespace); l != n+1 {
+			t.Fatalf("want search space len %v, have %v", n+1, l)
+		}
+
+		// Closed streams are not usable.
+		if err := stream.Send(AddDataArgs{}); err != ErrStreamClosed {
+			t.Fatal("unexpected err on send after close:", err)
+		}
+		if r := stream.Close(); r.NetErr != ErrStreamClosed {
+			t.Fatal("unexpected err on second close:", r.NetErr)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddDataStreamNoServer(t *testing.T) {
+	if _, err := NewClient(freeLocalNoFail(t)).AddDataStream(); err == nil {
+		t.Fatal("want err when opening a stream without a server")
+	}
+}
@@ -222,6 +222,12 @@ type testNode struct {
 // newTestNode is a factory func for T testNode. Its internal requestman.Handle
 // is set up using newRequestManagerMeta(), see docs for that for more info.
 func newTestNode(addr string) (*testNode, error) {
+	return newTestNodeWithCodec(addr, CodecGob)
+}
+
+// newTestNodeWithCodec is the same as newTestNode, except that the Server uses
+// the given Codec.
+func newTestNodeWithCodec(addr string, codec Codec) (*testNode, error) {
 	rManMeta := newRequestManagerMeta()
 	handleArgs := rman.NewHandleArgs{
 		NewSearchSpaceArgs:    rManMeta.newSearchSpaceArgs,
@@ -232,7 +238,7 @@ func newTestNode(addr string) (*testNode, error) {
 		NewKNNMonitorArgs:     rManMeta.newKNNMonitorArgs,
 	}
 
-	s, ok := NewServer(addr, handleArgs)
+	s, ok := NewServerWithCodec(addr, handleArgs, codec)
 	if !ok {
 		s := "testNode setup failed, invalid requestman.Handle cfg"
 		return nil, errors.New(s)
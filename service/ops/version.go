@@ -0,0 +1,180 @@
+package ops
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+)
+
+/*
+File contains versioning of the rpc protocol, i.e of SArgs and SResp, such that
+a Server (or Client) of one version can tell that the other side is not
+compatible, instead of misbehaving silently (gob, for instance, ignores fields
+that are unknown to either side), e.g during rolling upgrades of a cluster.
+Versions are checked by a wrapper around the rpc.ServerCodec of the Server (see
+versionServerCodec) and by Client.call, so rpc methods do not deal with them.
+Note that AddDataStream has its own protocol (see stream.go), which is not
+versioned.
+*/
+
+// ProtocolVersion is the version of the rpc protocol which is used by this pkg,
+// i.e the SArgs.Version and SResp.Version set by Client and Server. It must be
+// incremented on incompatible changes of the rpc args or responses.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest version of the rpc protocol which is
+// supported, by both Server and Client. Versions between this and
+// ProtocolVersion (inclusive) are supported, along with 0, which means that
+// the version is not set (e.g by jsonrpc clients in other languages).
+const MinProtocolVersion = 1
+
+// ErrProtocolVersion is returned by Client methods (see ClientResult.NetErr)
+// if the Server does not support the protocol version of the Client, or vice
+// versa. Use errors.Is to check for it, as it is wrapped with the details.
+var ErrProtocolVersion = errors.New("ops: unsupported rpc protocol version")
+
+// checkProtocolVersion returns nil if 'v' is supported (see MinProtocolVersion),
+// else ErrProtocolVersion, wrapped with the details.
+func checkProtocolVersion(v int) error {
+	if v == 0 || v >= MinProtocolVersion && v <= ProtocolVersion {
+		return nil
+	}
+	return fmt.Errorf(
+		"%w: %d, supported are %d to %d",
+		ErrProtocolVersion,
+		v,
+		MinProtocolVersion,
+		ProtocolVersion,
+	)
+}
+
+// versioned is implemented by SArgs and SResp.
+type versioned interface {
+	protocolVersion() int
+}
+
+// protocolVersion implements the versioned interface.
+func (a SArgs[T]) protocolVersion() int {
+	return a.Version
+}
+
+// protocolVersion implements the versioned interface.
+func (r SResp[T]) protocolVersion() int {
+	return r.Version
+}
+
+// setProtocolVersion sets r.Version to ProtocolVersion, see versionServerCodec.
+func (r *SResp[T]) setProtocolVersion() {
+	r.Version = ProtocolVersion
+}
+
+// versionServerCodec wraps an rpc.ServerCodec such that the versions of all
+// requests are checked (see checkProtocolVersion) before they reach the rpc
+// methods of the Server, and such that the versions of all responses are set.
+// A request with an unsupported version gets ErrProtocolVersion (as a string,
+// see rpc.ServerError) as the response, which is handled by Client.call.
+type versionServerCodec struct {
+	rpc.ServerCodec
+}
+
+// ReadRequestBody implements rpc.ServerCodec.
+func (c versionServerCodec) ReadRequestBody(body any) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil {
+		return err
+	}
+	if v, ok := body.(versioned); ok {
+		return checkProtocolVersion(v.protocolVersion())
+	}
+	return nil
+}
+
+// WriteResponse implements rpc.ServerCodec.
+func (c versionServerCodec) WriteResponse(r *rpc.Response, body any) error {
+	if v, ok := body.(interface{ setProtocolVersion() }); ok {
+		v.setProtocolVersion()
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// protocolVersionErr is used by Client.call with the returns of an rpc call. It
+// converts version errors of the Server (see versionServerCodec) back into
+// ErrProtocolVersion, such that errors.Is can be used, and checks the version
+// of 'resp' if the call succeeded. Other errors are returned as they are.
+func protocolVersionErr(err error, resp any) error {
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		msg := string(serverErr)
+		if strings.HasPrefix(msg, ErrProtocolVersion.Error()) {
+			return fmt.Errorf("%w%s", ErrProtocolVersion, msg[len(ErrProtocolVersion.Error()):])
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if v, ok := resp.(versioned); ok {
+		return checkProtocolVersion(v.protocolVersion())
+	}
+	return nil
+}
+
+// gobServerCodec is the same as the (unexported) gob codec which is used by
+// rpc.Server.ServeConn, such that it can be wrapped (see versionServerCodec).
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+// newGobServerCodec is a factory func, see gobServerCodec.
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+// ReadRequestHeader implements rpc.ServerCodec.
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+// ReadRequestBody implements rpc.ServerCodec.
+func (c *gobServerCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+// WriteResponse implements rpc.ServerCodec. The conn is closed if encoding
+// fails, as the stream is broken after that.
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body any) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// Close implements rpc.ServerCodec.
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
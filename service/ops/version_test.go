@@ -0,0 +1,61 @@
+package ops
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	for _, codec := range []Codec{CodecGob, CodecJSON} {
+		addr := freeLocalNoFail(t)
+		node, err := newTestNodeWithCodec(addr, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClientWithCodec(addr, codec)
+
+		// ping does a Ping with the given client version.
+		ping := func(version int) (SResp[bool], error) {
+			send := SArgs[bool]{SendTime: time.Now(), Version: version}
+			resp := SResp[bool]{}
+			err := client.call(callArgs{"Server.Ping", send, &resp})
+			return resp, err
+		}
+
+		for _, version := range []int{0, ProtocolVersion} {
+			resp, err := ping(version)
+			if err != nil || !resp.Payload {
+				t.Fatalf("%v: unexpected ping with version %v: %+v, %v", codec, version, resp, err)
+			}
+			if resp.Version != ProtocolVersion {
+				t.Fatalf("%v: unexpected resp version: %v", codec, resp.Version)
+			}
+		}
+
+		// The method is not called, i.e the payload is unset.
+		resp, err := ping(ProtocolVersion + 1)
+		if !errors.Is(err, ErrProtocolVersion) || resp.Payload {
+			t.Fatalf("%v: unexpected ping with unsupported version: %+v, %v", codec, resp, err)
+		}
+		// The connection still works after a rejected request.
+		if r := client.Ping(); r.NetErr != nil || !r.Payload {
+			t.Fatalf("%v: unexpected ping after rejection: %+v", codec, r)
+		}
+
+		node.stopFunc()
+	}
+}
+
+func TestProtocolVersionErr(t *testing.T) {
+	if err := protocolVersionErr(nil, &SResp[bool]{Version: ProtocolVersion + 1}); !errors.Is(err, ErrProtocolVersion) {
+		t.Fatalf("unsupported resp version was not detected: %v", err)
+	}
+	if err := protocolVersionErr(nil, &SResp[bool]{}); err != nil {
+		t.Fatalf("unexpected err for an unversioned resp: %v", err)
+	}
+	other := errors.New("other")
+	if err := protocolVersionErr(other, &SResp[bool]{}); err != other {
+		t.Fatalf("unexpected err for a non-version err: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package requestman
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+File contains namespace aliases, i.e names which point to a namespace, such that
+the data behind a name can be swapped without changing the queries, e.g for
+blue/green dataset swaps. See Handle.CreateAlias.
+*/
+
+// Errors returned by Handle.CreateAlias and Handle.SwapAlias. These may also
+// return ErrUnknownNamespace (see backend.go) if the target does not exist.
+var (
+	ErrAliasExists    = errors.New("requestman: alias already exists")
+	ErrUnknownAlias   = errors.New("requestman: alias does not exist")
+	ErrAliasNamespace = errors.New("requestman: alias is the name of a namespace")
+)
+
+// namespaceAliases maps aliases to namespaces.
+//
+// Note; thread safe.
+type namespaceAliases struct {
+	mx      sync.RWMutex
+	targets map[string]string
+}
+
+// resolve returns the namespace of 'ns' if it is an alias, else 'ns' itself.
+func (a *namespaceAliases) resolve(ns string) string {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	if target, ok := a.targets[ns]; ok {
+		return target
+	}
+	return ns
+}
+
+// CreateAlias creates an alias which points to the 'target' namespace, such that
+// KNN requests (Handle.KNN, Handle.KNNBatch, and the ones built on those) with
+// the alias as KNNArgs.Namespace are done in the target namespace instead. The
+// alias can be pointed to another namespace with Handle.SwapAlias. Other methods
+// (e.g Handle.AddData and Handle.Info) use namespace names only, i.e aliases are
+// not resolved there. Aliases are not kept in snapshots or the write-ahead log.
+// Errors are:
+// - ErrHandleClosed if the ctx used when creating the Handle signalled done.
+// - ErrAliasExists if the alias already exists.
+// - ErrAliasNamespace if the alias is the name of a namespace, as it would
+//   shadow it, or if the target is an alias (aliases do not chain).
+// - ErrUnknownNamespace if the target namespace does not exist.
+func (h *Handle) CreateAlias(alias string, target string) error {
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return ErrHandleClosed
+	default:
+	}
+
+	h.aliases.mx.Lock()
+	defer h.aliases.mx.Unlock()
+	if _, ok := h.aliases.targets[alias]; ok {
+		return ErrAliasExists
+	}
+	if err := h.checkAliasTarget(alias, target); err != nil {
+		return err
+	}
+	h.aliases.targets[alias] = target
+	return nil
+}
+
+// SwapAlias points an existing alias (see Handle.CreateAlias) to the 'target'
+// namespace, and returns the namespace it pointed to before. The swap is atomic,
+// i.e each KNN request is done in either the old or the new target, where
+// requests that are already enqueued are done in the old one. Errors are the
+// same as with Handle.CreateAlias, except that ErrUnknownAlias is returned if
+// the alias does not exist (instead of ErrAliasExists if it does).
+func (h *Handle) SwapAlias(alias string, target string) (string, error) {
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return "", ErrHandleClosed
+	default:
+	}
+
+	h.aliases.mx.Lock()
+	defer h.aliases.mx.Unlock()
+	old, ok := h.aliases.targets[alias]
+	if !ok {
+		return "", ErrUnknownAlias
+	}
+	if err := h.checkAliasTarget(alias, target); err != nil {
+		return "", err
+	}
+	h.aliases.targets[alias] = target
+	return old, nil
+}
+
+// DeleteAlias deletes an alias (see Handle.CreateAlias). Returns false if it
+// does not exist.
+func (h *Handle) DeleteAlias(alias string) bool {
+	h.aliases.mx.Lock()
+	defer h.aliases.mx.Unlock()
+	_, ok := h.aliases.targets[alias]
+	delete(h.aliases.targets, alias)
+	return ok
+}
+
+// checkAliasTarget checks the conditions of Handle.CreateAlias and
+// Handle.SwapAlias, the caller must hold the lock of Handle.aliases.
+func (h *Handle) checkAliasTarget(alias string, target string) error {
+	if _, ok := h.knnNamespaces.get(alias); ok {
+		return ErrAliasNamespace
+	}
+	if _, ok := h.aliases.targets[target]; ok {
+		return ErrAliasNamespace
+	}
+	if _, ok := h.knnNamespaces.get(target); !ok {
+		return ErrUnknownNamespace
+	}
+	return nil
+}
+
+// Aliases returns a copy of all aliases (see Handle.CreateAlias), where the keys
+// are the aliases and the values are the namespaces they point to.
+func (i *info) Aliases() map[string]string {
+	i.h.aliases.mx.RLock()
+	defer i.h.aliases.mx.RUnlock()
+
+	r := make(map[string]string, len(i.h.aliases.targets))
+	for alias, target := range i.h.aliases.targets {
+		r[alias] = target
+	}
+	return r
+}
@@ -0,0 +1,89 @@
+package requestman
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestHandleAlias(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newTestHandle(100, 100, ctx)
+	for _, ns := range []string{"blue", "green"} {
+		dc := DistancerContainer{D: mathx.NewFloatVecWithID([]float64{1}, ns)}
+		if !h.AddData(ns, dc, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	// queryID does a KNN request with the alias and returns the ID of the result.
+	queryID := func() string {
+		r, ok := h.KNN(KNNArgs{
+			Namespace: "live",
+			Priority:  1,
+			QueryVec:  []float64{1},
+			KNNMethod: KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         1,
+			Extent:    1,
+			Accept:    0,
+			Reject:    100,
+			TTL:       time.Minute,
+		})
+		if !ok {
+			t.Fatal("got not-ok for a KNN request with an alias")
+		}
+		id := ""
+		for items := range r.Pipe {
+			for _, item := range items {
+				id = item.Distancer.(*mathx.FloatVec).ID()
+			}
+		}
+		return id
+	}
+
+	if _, err := h.SwapAlias("live", "blue"); err != ErrUnknownAlias {
+		t.Fatalf("unexpected err when swapping a missing alias: %v", err)
+	}
+	if err := h.CreateAlias("live", "missing"); err != ErrUnknownNamespace {
+		t.Fatalf("unexpected err when creating an alias to a missing namespace: %v", err)
+	}
+	if err := h.CreateAlias("green", "blue"); err != ErrAliasNamespace {
+		t.Fatalf("unexpected err when creating an alias which shadows a namespace: %v", err)
+	}
+
+	if err := h.CreateAlias("live", "blue"); err != nil {
+		t.Fatalf("could not create alias: %v", err)
+	}
+	if err := h.CreateAlias("live", "green"); err != ErrAliasExists {
+		t.Fatalf("unexpected err when creating an existing alias: %v", err)
+	}
+	if err := h.CreateAlias("other", "live"); err != ErrAliasNamespace {
+		t.Fatalf("unexpected err when creating an alias to an alias: %v", err)
+	}
+	if id := queryID(); id != "blue" {
+		t.Fatalf("unexpected result before swap: %q", id)
+	}
+
+	old, err := h.SwapAlias("live", "green")
+	if err != nil || old != "blue" {
+		t.Fatalf("unexpected swap result: %q, %v", old, err)
+	}
+	if id := queryID(); id != "green" {
+		t.Fatalf("unexpected result after swap: %q", id)
+	}
+	if aliases := h.Info().Aliases(); len(aliases) != 1 || aliases["live"] != "green" {
+		t.Fatalf("unexpected aliases: %v", aliases)
+	}
+
+	if !h.DeleteAlias("live") || h.DeleteAlias("live") {
+		t.Fatal("unexpected result when deleting the alias")
+	}
+	if _, ok := h.KNN(newTestKNNArgs(1, "live")); ok {
+		t.Fatal("got ok for a KNN request with a deleted alias")
+	}
+}
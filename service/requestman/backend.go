@@ -0,0 +1,140 @@
+package requestman
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+)
+
+/*
+File contains the selectable KNN backend of namespaces, see Handle.SetBackend.
+*/
+
+// Errors returned by Handle.SetBackend.
+var (
+	ErrUnknownNamespace = errors.New("requestman: namespace does not exist")
+	ErrInvalidBackend   = errors.New("requestman: invalid backend args")
+	ErrBackendTraining  = errors.New("requestman: backend training failed")
+)
+
+// Backend is the KNN backend of a namespace, i.e what is scanned by Handle.KNN.
+type Backend int
+
+const (
+	// BackendExact scans the raw vecs, i.e KNN results are exact (with Extent=1).
+	BackendExact Backend = iota
+	// BackendPQ scans product quantized codes of the vecs (see knnc.PQIndex),
+	// which uses less memory bandwidth but gives approximate distances. It is
+	// only used for KNNMethodEuclideanDistance requests without KNNArgs.Metric
+	// (others fall back to BackendExact), and not by Handle.KNNBatch. Scores of
+	// the results are the approximate distances, unless KNNArgs.OverFetch is
+	// used for re-ranking.
+	BackendPQ
+)
+
+// String returns a human-readable name of the Backend.
+func (b Backend) String() string {
+	switch b {
+	case BackendExact:
+		return "exact"
+	case BackendPQ:
+		return "pq"
+	}
+	return "unknown"
+}
+
+// pqBackendDefaultSampleSize is the default of BackendArgs.SampleSize.
+const pqBackendDefaultSampleSize = 10000
+
+// BackendArgs is intended for Handle.SetBackend.
+type BackendArgs struct {
+	Backend Backend
+	// SampleSize is the max number of (randomly selected) vecs in the namespace
+	// which are used for training with BackendPQ.
+	// Optional, 0 defaults to 10000.
+	SampleSize int
+	// PQ is the training args for BackendPQ, see knnc.TrainPQArgs. PQ.Seed is
+	// also used for selecting the sample.
+	PQ knnc.TrainPQArgs
+}
+
+// Ok validates BackendArgs. Returns true iff:
+//	(1) Backend is BackendExact or BackendPQ
+//	(2) SampleSize >= 0
+//	(3) PQ.Ok() if Backend is BackendPQ
+func (args *BackendArgs) Ok() bool {
+	switch args.Backend {
+	case BackendExact:
+		return args.SampleSize >= 0
+	case BackendPQ:
+		return args.SampleSize >= 0 && args.PQ.Ok()
+	}
+	return false
+}
+
+// SetBackend selects the KNN backend of a namespace, see Backend. For BackendPQ,
+// a codebook is trained on a sample of the (non-expired) data in the namespace,
+// after which all data in it is encoded. New data is encoded when it is added,
+// with the same codebook, so the namespace should have representative data
+// when this is called. Calling this again re-trains the codebook. Errors are:
+// - ErrHandleClosed if the ctx used when creating the Handle signalled done.
+// - ErrInvalidBackend if args.Ok() == false.
+// - ErrUnknownNamespace if the namespace does not exist.
+// - ErrBackendTraining if the namespace has no (non-expired) data, or if
+//   knnc.TrainPQ fails, e.g if the dimension is not divisible by args.PQ.M.
+func (h *Handle) SetBackend(ns string, args BackendArgs) error {
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return ErrHandleClosed
+	default:
+	}
+
+	if !args.Ok() {
+		return ErrInvalidBackend
+	}
+	nsItem, ok := h.knnNamespaces.get(ns)
+	if !ok {
+		return ErrUnknownNamespace
+	}
+	if args.Backend == BackendExact {
+		return h.knnNamespaces.setPQ(ns, nil)
+	}
+
+	// Training is done without holding the namespace lock, as it is slow.
+	if args.SampleSize == 0 {
+		args.SampleSize = pqBackendDefaultSampleSize
+	}
+	containers := nsItem.searchSpaces.Snapshot()
+	rng := rand.New(rand.NewSource(args.PQ.Seed))
+	sample := make([]knnc.Distancer, 0, args.SampleSize)
+	for _, i := range rng.Perm(len(containers)) {
+		if len(sample) == args.SampleSize {
+			break
+		}
+		if d := containers[i].Distancer(); d != nil {
+			sample = append(sample, d)
+		}
+	}
+	cb, ok := knnc.TrainPQ(sample, args.PQ)
+	if !ok {
+		return ErrBackendTraining
+	}
+
+	pq, _ := knnc.NewPQIndex(cb)
+	return h.knnNamespaces.setPQ(ns, pq)
+}
+
+// Backend returns the KNN backend of a namespace, see Handle.SetBackend.
+// Returns false if the namespace does not exist.
+func (i *info) Backend(key string) (Backend, bool) {
+	nsItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return BackendExact, false
+	}
+	if nsItem.pq != nil {
+		return BackendPQ, true
+	}
+	return BackendExact, true
+}
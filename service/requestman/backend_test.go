@@ -0,0 +1,167 @@
+package requestman
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestHandleSetBackend(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 1000, 10)
+	pqArgs := BackendArgs{Backend: BackendPQ, PQ: knnc.TrainPQArgs{M: 4, KSub: 16}}
+
+	if err := h.SetBackend(ns, pqArgs); !errors.Is(err, ErrUnknownNamespace) {
+		t.Fatalf("unexpected err for a namespace that does not exist: %v", err)
+	}
+
+	vecs := make([]*mathx.SafeVec, 500)
+	for i := range vecs {
+		vecs[i], _ = mathx.NewSafeVecRand(8)
+		h.AddData(ns, DistancerContainer{D: vecs[i]}, nil)
+	}
+
+	if err := h.SetBackend(ns, BackendArgs{Backend: BackendPQ}); !errors.Is(err, ErrInvalidBackend) {
+		t.Fatalf("unexpected err for invalid args: %v", err)
+	}
+	badM := pqArgs
+	badM.PQ.M = 3
+	if err := h.SetBackend(ns, badM); !errors.Is(err, ErrBackendTraining) {
+		t.Fatalf("unexpected err for a dim that is not divisible by M: %v", err)
+	}
+	if err := h.SetBackend(ns, pqArgs); err != nil {
+		t.Fatalf("could not set the pq backend: %v", err)
+	}
+	if b, _ := h.Info().Backend(ns); b != BackendPQ {
+		t.Fatalf("unexpected backend: %v", b)
+	}
+
+	// Data added after the backend is set is encoded too.
+	v, _ := mathx.NewSafeVecRand(8)
+	h.AddData(ns, DistancerContainer{D: v}, nil)
+	nsItem, _ := h.knnNamespaces.get(ns)
+	if nsItem.pq.Len() != len(vecs)+1 {
+		t.Fatalf("unexpected pq index len: %v", nsItem.pq.Len())
+	}
+
+	// The query is stored, so it should be among the (approximate) top results,
+	// which must be the original vecs.
+	query := make([]float64, 8)
+	for i := range query {
+		query[i], _ = vecs[0].Peek(i)
+	}
+	args := KNNArgs{
+		Namespace: ns,
+		Priority:  1,
+		QueryVec:  query,
+		KNNMethod: KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         10,
+		Extent:    1,
+		Reject:    100,
+		TTL:       time.Second * 5,
+	}
+	enqRes, ok := h.KNN(args)
+	if !ok {
+		t.Fatal("could not enqueue a KNN request")
+	}
+	found := false
+	for _, item := range <-enqRes.Pipe {
+		if _, isPQ := item.Distancer.(*knnc.PQVec); isPQ || !item.Set {
+			t.Fatalf("unexpected result item: %+v", item)
+		}
+		found = found || item.Distancer == mathx.Distancer(vecs[0])
+	}
+	if !found {
+		t.Fatal("the stored query vec is not among the top results")
+	}
+
+	n := h.DeleteWhere(ns, func(_ string, d mathx.Distancer, _ time.Time) bool {
+		return d == mathx.Distancer(vecs[0])
+	})
+	if n != 1 || nsItem.pq.Len() != len(vecs) {
+		t.Fatalf("unexpected delete result: n=%v, pq len=%v", n, nsItem.pq.Len())
+	}
+
+	if err := h.SetBackend(ns, BackendArgs{Backend: BackendExact}); err != nil {
+		t.Fatalf("could not set the exact backend: %v", err)
+	}
+	if b, _ := h.Info().Backend(ns); b != BackendExact {
+		t.Fatalf("unexpected backend: %v", b)
+	}
+}
+
+func TestHandleKNNOverFetch(t *testing.T) {
+	ns := "test"
+	dim := 16
+	h := newTestHandleCleanup(t, 2000, 10)
+
+	vecs := make([]*mathx.SafeVec, 2000)
+	for i := range vecs {
+		vecs[i], _ = mathx.NewSafeVecRand(dim)
+		h.AddData(ns, DistancerContainer{D: vecs[i]}, nil)
+	}
+	// Coarse codebook, such that recall without over-fetch is low.
+	pqArgs := BackendArgs{Backend: BackendPQ, PQ: knnc.TrainPQArgs{M: 2, KSub: 16, Seed: 1}}
+	if err := h.SetBackend(ns, pqArgs); err != nil {
+		t.Fatalf("could not set the pq backend: %v", err)
+	}
+
+	k := 10
+	queries := make([][]float64, 20)
+	want := make([]map[mathx.Distancer]bool, len(queries))
+	for i := range queries {
+		queries[i], _ = randFloat64Slice(dim)
+		exact := make(knnc.ScoreItems, k)
+		for _, v := range vecs {
+			score, _ := v.EuclideanDistance(mathx.NewSafeVec(queries[i]...))
+			exact.BubbleInsert(knnc.ScoreItem{Distancer: v, Score: score, Set: true}, true)
+		}
+		want[i] = map[mathx.Distancer]bool{}
+		for _, item := range exact {
+			want[i][item.Distancer] = true
+		}
+	}
+
+	prev := -1.
+	for _, overFetch := range []int{0, 1, 4, 16, 32} {
+		hits := 0
+		for i, query := range queries {
+			enqRes, ok := h.KNN(KNNArgs{
+				Namespace: ns,
+				Priority:  1,
+				QueryVec:  query,
+				KNNMethod: KNNMethodEuclideanDistance,
+				Ascending: true,
+				K:         k,
+				Extent:    1,
+				Accept:    -1,
+				Reject:    math.MaxFloat64,
+				TTL:       time.Second * 5,
+				OverFetch: overFetch,
+			})
+			if !ok {
+				t.Fatal("could not enqueue a KNN request")
+			}
+			for _, item := range <-enqRes.Pipe {
+				if want[i][item.Distancer] {
+					hits++
+				}
+			}
+		}
+
+		recall := float64(hits) / float64(k*len(queries))
+		t.Logf("over-fetch %v, recall@%v: %.3f", overFetch, k, recall)
+		if recall < prev {
+			t.Fatalf("recall decreased with over-fetch %v: %v < %v", overFetch, recall, prev)
+		}
+		prev = recall
+	}
+	if prev < 0.6 {
+		t.Fatalf("unexpectedly low recall with the max over-fetch: %v", prev)
+	}
+}
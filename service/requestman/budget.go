@@ -0,0 +1,81 @@
+package requestman
+
+import (
+	"time"
+)
+
+/*
+File contains the budget of KNN requests, i.e how KNNArgs.TTL is split between
+the phases of a request (see KNNPhase), such that a long wait in one phase does
+not silently leave no time for the others. The phase that exhausted the budget
+of a request is reported with KNNStats.Exhausted.
+*/
+
+// KNNPhase is a phase of a KNN request, see KNNBudget and KNNStats.Exhausted.
+type KNNPhase string
+
+const (
+	// KNNPhaseQueue is the time a request waits in the queue of a Handle
+	// before it is processed.
+	KNNPhaseQueue KNNPhase = "queue"
+	// KNNPhaseScan is the time spent scanning (and scoring) candidates.
+	KNNPhaseScan KNNPhase = "scan"
+	// KNNPhaseMerge is the time spent merging scored candidates into the
+	// result, which continues after the scan is done.
+	KNNPhaseMerge KNNPhase = "merge"
+)
+
+// KNNBudget splits KNNArgs.TTL between the phases of KNN requests, see
+// NewHandleArgs.KNNBudget. Each phase ends at a fraction of the TTL after the
+// request was created, such that time which is not used by a phase carries
+// over to the next one, while the merge phase gets the rest of the TTL. The
+// zero value of a field means that the phase can use all of the TTL (minus the
+// previous phases), which is the default.
+type KNNBudget struct {
+	// Queue is the fraction of the TTL that a request can wait in the queue.
+	// Requests that wait longer are dropped without being processed, which
+	// leaves the rest of the TTL for requests that have a chance to finish.
+	Queue float64
+	// Scan is the fraction of the TTL for scanning, counting from the end of
+	// the queue budget, i.e scanning stops at (Queue+Scan)*TTL after the
+	// request was created, such that there is time left for merging.
+	Scan float64
+}
+
+// Ok returns true if the configuration of KNNBudget is acceptable, i.e:
+// - KNNBudget.Queue >= 0
+// - KNNBudget.Scan >= 0
+// - KNNBudget.Queue + KNNBudget.Scan <= 1
+func (b *KNNBudget) Ok() bool {
+	ok := true
+	ok = ok && b.Queue >= 0
+	ok = ok && b.Scan >= 0
+	ok = ok && b.Queue+b.Scan <= 1
+	return ok
+}
+
+// queueDeadline returns when the queue budget of a request, created at
+// 'created' with the given TTL, is exhausted.
+func (b *KNNBudget) queueDeadline(created time.Time, ttl time.Duration) time.Time {
+	if b.Queue == 0 {
+		return created.Add(ttl)
+	}
+	return created.Add(time.Duration(float64(ttl) * b.Queue))
+}
+
+// scanDeadline returns when the scan budget of a request, created at 'created'
+// with the given TTL, is exhausted.
+func (b *KNNBudget) scanDeadline(created time.Time, ttl time.Duration) time.Time {
+	if b.Scan == 0 {
+		return created.Add(ttl)
+	}
+	return created.Add(time.Duration(float64(ttl) * (b.Queue + b.Scan)))
+}
+
+// exhaust sets KNNStats.Exhausted of the request to 'phase', unless it is set
+// already, i.e the first exhausted phase is kept.
+func (r *knnRequest) exhaust(phase KNNPhase) {
+	if r.enqueueResult.Stats != nil && r.enqueueResult.Stats.Exhausted == "" {
+		r.enqueueResult.Stats.Exhausted = phase
+	}
+}
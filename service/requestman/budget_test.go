@@ -0,0 +1,79 @@
+package requestman
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestHandleKNNBudgetQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A single request is processed at a time, and the first one is held in
+	// the post processor, such that the second one waits in the queue.
+	h := newTestHandle(100, 1, ctx)
+	h.knnQueue.budget = KNNBudget{Queue: 0.25}
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	h.knnQueue.postProcessor = func(args KNNArgs, items knnc.ScoreItems) knnc.ScoreItems {
+		if args.Namespace == "held" {
+			entered <- struct{}{}
+			<-release
+		}
+		return items
+	}
+
+	dim := 3
+	for _, ns := range []string{"held", "test"} {
+		for i := 0; i < 10; i++ {
+			v, _ := randFloat64Slice(dim)
+			if !h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+				t.Fatal("got not-ok when adding data")
+			}
+		}
+	}
+
+	held, ok := h.KNN(newTestKNNArgs(dim, "held"))
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+	<-entered
+
+	args := newTestKNNArgs(dim, "test")
+	args.Extent = 1
+	args.Reject = -2
+	args.TTL = time.Millisecond * 400
+	r, ok := h.KNN(args)
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+
+	// Longer than the queue budget (100ms), but shorter than the TTL.
+	time.Sleep(time.Millisecond * 200)
+	close(release)
+	<-held.Pipe
+
+	if items, open := <-r.Pipe; open || len(items) != 0 {
+		t.Fatalf("unexpected result of a request that exhausted the queue budget: %v", items)
+	}
+	if r.Stats.Exhausted != KNNPhaseQueue {
+		t.Fatalf("unexpected exhausted phase: %q", r.Stats.Exhausted)
+	}
+	if s := r.Stats.String(); !strings.Contains(s, "queue exhausted budget") {
+		t.Fatalf("unexpected stats summary: %q", s)
+	}
+
+	// Without a long queue, the budget is not exhausted.
+	r, ok = h.KNN(args)
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+	if items := <-r.Pipe; len(items) == 0 || r.Stats.Exhausted != "" {
+		t.Fatalf("unexpected result without a long queue: %v, %+v", items, *r.Stats)
+	}
+}
@@ -22,11 +22,22 @@ and feeding the results to knnRequest.enqueueResult
 type knnQueueItem struct {
 	nsItem  knnNamespacesItem
 	request knnRequest
+	// batch is used instead of 'request' if set, for requests that share a
+	// scan, see Handle.KNNBatch and consumeBatch.
+	batch []knnRequest
+}
+
+// created gives the time when the request (or batch) was created.
+func (qi *knnQueueItem) created() time.Time {
+	if qi.batch != nil {
+		return qi.batch[0].created
+	}
+	return qi.request.created
 }
 
 // process uses the internal knn searchspace as data in order to consume the
 // internal knnRequest. Specifically:
-//  knnQueueItem.request.consume(knnQueueItem.nsItem.searchSpaces).
+//  knnQueueItem.request.consumeBackend(nsItem.searchSpaces, nsItem.pq, nsItem.metaIndex).
 //
 // This method also registers the time spent on a KNN search into
 // nsItem.latency.
@@ -38,35 +49,77 @@ type knnQueueItem struct {
 //    This is calculated based on delta time since knnQueueItem.request
 //    was created (.created field) _and_ the average latency of
 //    knnQueueItem.nsItem.latency.AverageSTD().
+// 3) The queue budget of the request is exhausted, see KNNBudget.Queue.
+// In the last two cases, KNNStats.Exhausted is set to KNNPhaseQueue.
+//
+// If knnQueueItem.batch is set, then it is processed with processBatch instead.
 func (qi *knnQueueItem) process() {
 	// Note, not doing 'defer close(qi.request.enqueueResult.Pipe)' because
 	// that is done in qi.request.consume. Doing it again might lead to a
 	// double close and panic.
 
-	// This shouldn't really happend but adding for safety.
-	if qi.nsItem.searchSpaces == nil || qi.nsItem.latency == nil {
-		close(qi.request.enqueueResult.Pipe)
+	if qi.batch != nil {
+		qi.processBatch()
 		return
 	}
 
-	// Might have been cancelled while in queue.
-	if qi.request.enqueueResult.Cancel.Cancelled() {
+	if !qi.admit(&qi.request) {
 		close(qi.request.enqueueResult.Pipe)
 		return
 	}
 
-	// Check that time waited in queue + estimated query time does not exceed
-	// the acceptable latency / deadline.
-	queueWait := time.Now().Sub(qi.request.created)
-	queryWaitEstimation, _ := qi.nsItem.latency.AverageSTD()
-	if queueWait+queryWaitEstimation > qi.request.args.TTL {
-		close(qi.request.enqueueResult.Pipe)
+	defer qi.nsItem.latency.RegisterCallback()()
+	// This closes the qi.request.enqueueResult.Pipe channel.
+	qi.request.consumeBackend(qi.nsItem.searchSpaces, qi.nsItem.pq, qi.nsItem.metaIndex) /* TODO: handle fail? */
+}
+
+// processBatch is the equivalent of knnQueueItem.process for qi.batch, where
+// the requests that pass knnQueueItem.admit are consumed with consumeBatch,
+// i.e they share a scan. The pipes of the other requests are closed.
+func (qi *knnQueueItem) processBatch() {
+	admitted := make([]*knnRequest, 0, len(qi.batch))
+	for i := range qi.batch {
+		if !qi.admit(&qi.batch[i]) {
+			close(qi.batch[i].enqueueResult.Pipe)
+			continue
+		}
+		admitted = append(admitted, &qi.batch[i])
+	}
+	if len(admitted) == 0 {
 		return
 	}
 
 	defer qi.nsItem.latency.RegisterCallback()()
-	// This closes the qi.request.enqueueResult.Pipe channel.
-	qi.request.consume(qi.nsItem.searchSpaces) /* TODO: handle fail? */
+	// This closes the enqueueResult.Pipe chans of all admitted requests.
+	consumeBatch(qi.nsItem.searchSpaces, admitted)
+}
+
+// admit returns false if a request should be dropped, on the conditions listed
+// in the doc of knnQueueItem.process.
+func (qi *knnQueueItem) admit(r *knnRequest) bool {
+	// This shouldn't really happend but adding for safety.
+	if qi.nsItem.searchSpaces == nil || qi.nsItem.latency == nil {
+		return false
+	}
+
+	// Might have been cancelled while in queue.
+	if r.enqueueResult.Cancel.Cancelled() {
+		return false
+	}
+
+	// Check that the queue budget is not exhausted, and that time waited in
+	// queue + estimated query time does not exceed the acceptable latency /
+	// deadline. Either way, the time in queue left too little for the query.
+	now := time.Now()
+	queueWait := now.Sub(r.created)
+	queryWaitEstimation, _ := qi.nsItem.latency.AverageSTD()
+	ok := true
+	ok = ok && !now.After(r.budget.queueDeadline(r.created, r.args.TTL))
+	ok = ok && queueWait+queryWaitEstimation <= r.args.TTL
+	if !ok {
+		r.exhaust(KNNPhaseQueue)
+	}
+	return ok
 }
 
 // knnQueue does controlled processing of knn requests with a defined max amount
@@ -80,12 +133,28 @@ type knnQueue struct {
 	// maxConcurrent specifies the highest amount of _parent_ goroutines that can
 	// be used for a knn request (which in itself can use multiple goroutines).
 	maxConcurrent int
+	// scanMaxWorkers is set as knnRequest.scanMaxWorkers for all requests,
+	// see NewHandleArgs.ScanMaxWorkers.
+	scanMaxWorkers int
+	// postProcessor is set as knnRequest.postProcessor for all requests,
+	// see NewHandleArgs.PostProcessor.
+	postProcessor PostProcessor
+	// budget is set as knnRequest.budget for all requests, see
+	// NewHandleArgs.KNNBudget.
+	budget KNNBudget
 
 	// ctx is used for stopping the processing loop in startProcessing.
 	// Will wait until all requests are done before quitting.
 	ctx context.Context
 }
 
+// configure sets the handle-level options of knnQueue on a knnRequest.
+func (q *knnQueue) configure(r *knnRequest) {
+	r.scanMaxWorkers = q.scanMaxWorkers
+	r.postProcessor = q.postProcessor
+	r.budget = q.budget
+}
+
 // startProcessing starts the queue processing / event loop. It iterates over the
 // internal queued knnQueueItems, of which the .process() method is called. The
 // loop blocks if the number of concurrent knnQueueItems.process() routines exceeds
@@ -100,12 +169,15 @@ func (q *knnQueue) startProcessing() {
 			done := ticker.AddAwait()
 			defer done()
 
-			queueWait := time.Now().Sub(qItem.request.created)
+			queueWait := time.Now().Sub(qItem.created())
 			q.latency.Register(queueWait)
-			if queueWait > qItem.request.args.TTL {
-				return
-			}
 
+			// Requests which waited too long are dropped (with their pipes
+			// closed) by knnQueueItem.admit, see knnQueueItem.process.
+			q.configure(&qItem.request)
+			for i := range qItem.batch {
+				q.configure(&qItem.batch[i])
+			}
 			qItem.process()
 		}(qItem)
 
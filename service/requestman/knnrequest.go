@@ -1,6 +1,12 @@
 package requestman
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crunchypi/ddrop/pkg/knnc"
@@ -14,6 +20,11 @@ File for primary types:
     KNNEnqueueResult: Where knn request results go.
 */
 
+// ErrZeroQueryVec is set as KNNEnqueueResult.Err by Handle.KNN when a query vec
+// is a zero vector while the similarity is undefined for it, see
+// KNNArgs.zeroQuery.
+var ErrZeroQueryVec = errors.New("requestman: query vec is a zero vector")
+
 // KNNMethod specifies the distance function used for a request.
 type KNNMethod int
 
@@ -22,6 +33,13 @@ const (
 	KNNMethodCosineSimilarity
 )
 
+// KNNMethodNamespaceDefault is a KNNArgs.KNNMethod which is replaced by the
+// default KNNMethod of the namespace (see CreateNamespaceArgs.DefaultKNNMethod)
+// when the request is enqueued. KNNArgs.Ascending is then set for the default
+// KNNMethod, such that results are ordered from nearest to furthest. Note that
+// KNNMethod.Ok() returns false for this, as it is not a distance function.
+const KNNMethodNamespaceDefault KNNMethod = -1
+
 // Ok returns true if it the KNNMethod is defined in this pkg.
 func (m *KNNMethod) Ok() bool {
 	ok := false
@@ -30,23 +48,41 @@ func (m *KNNMethod) Ok() bool {
 	return ok
 }
 
+// Ascending returns the KNNArgs.Ascending value which orders the results from
+// nearest to furthest for this KNNMethod, i.e for a KNN query. If furthest is
+// true, then the opposite is returned, i.e for a K-furthest-neighbours query.
+// For example, lower is better for Euclidean distance, so this returns true
+// for (KNNMethodEuclideanDistance, false), but false for cosine similarity.
+func (m *KNNMethod) Ascending(furthest bool) bool {
+	return ((*m) == KNNMethodEuclideanDistance) != furthest
+}
+
 // KNNArgs are used as arguments for making KNN requests. Check if all the
 // requirements are met with calling KNNArgs.Ok().
 type KNNArgs struct {
 	// Namespace is used to group search spaces together, based on logical
 	// meaning, but also for having uniform vector dimensions.
 	Namespace string
+	// Tenant is optional, it is the tenant making the request, which is used
+	// for quotas (see NewHandleArgs.TenantQuotas).
+	Tenant string
 	// Priority specifies how important a KNN query is -- higher is better.
 	// It influences the number of goroutines used, though not necessarily
 	// a one-to-one mapping. Must be > 0.
 	Priority int
-	// QueryVec is used for similarity searching. Must not be nil, with a
-	// length of > 0. Also, make sure the dimension is appropriate for the
-	// KNNArgs.namespace field.
+	// QueryVec is used for similarity searching. Must pass mathx.ValidVec,
+	// i.e not nil, a length of > 0 and no NaN/Inf elements. Also, make sure
+	// the dimension is appropriate for the KNNArgs.namespace field.
 	QueryVec []float64
 	// KNNMethod specifies the distance function used for the query.
-	// KNNMethod.Ok() must return true.
+	// KNNMethod.Ok() must return true, unless KNNArgs.Metric is set or
+	// this is KNNMethodNamespaceDefault.
 	KNNMethod KNNMethod
+	// Metric (optional) is the name of a distance function registered with
+	// RegisterMetric, which is then used instead of KNNArgs.KNNMethod. Note
+	// that the Ascending field should match it, see MetricAscending. Must
+	// be registered if set.
+	Metric string
 	// Ascending plays a role with ordering _and_ the meaning is dependent
 	// somewhat on the KNNArgs.KNNMethod field.
 	//
@@ -65,6 +101,15 @@ type KNNArgs struct {
 	// example, 0.5 will search half the search space. This is used to
 	// trade accuracy for speed.
 	Extent float64
+	// RandomSeed selects which items are searched with an Extent < 1, see
+	// knnc.SearchSpacesScanArgs.Seed. The same seed gives the same candidates
+	// for the same data (e.g the same namespace version, see
+	// info.SSpaceVersion), which makes approximate queries reproducible, e.g
+	// for benchmarking. Different seeds search different (but equally many)
+	// items. Use 0 (default) to always search from the first item of each
+	// search space. Note that Accept ends a search early, which depends on
+	// timing, so reproducible results need an Accept that is never reached.
+	RandomSeed int64
 	// Accept is another optimization trick; the search will be aborted
 	// when there are KNNArgs.K results with better than KNNArgs.Accept
 	// accuracy.
@@ -80,39 +125,264 @@ type KNNArgs struct {
 	// is a good idea to cancel it manually. After this duration, the
 	// best-found results are given. Must be > 0.
 	TTL time.Duration
+	// BlockDeadline is optional. If > 0, it is the max time a scanner waits
+	// for the pipeline to accept a single candidate (as opposed to TTL, which
+	// is for the whole request), e.g when the pipeline falls behind under
+	// load. Then, OnBlockDeadline specifies whether the scanner is aborted or
+	// skips the candidate, either way the missing candidates are counted as
+	// KNNStats.Unscanned. See knnc.SearchSpaceScanArgs.BlockDeadline. Must be
+	// >= 0. Ignored by Handle.KNNBatch.
+	BlockDeadline time.Duration
+	// OnBlockDeadline is used with BlockDeadline, the default aborts the
+	// scanner (knnc.BlockDeadlineAbort). Must be Ok().
+	OnBlockDeadline knnc.BlockDeadlinePolicy
+	// ZeroVecMode specifies how cosine similarity is scored when either the
+	// query vector or a candidate vector has a norm of zero, in which case
+	// the similarity is undefined. The default (mathx.ZeroVecModeSkip)
+	// drops such candidates. Only used with KNNMethodCosineSimilarity, but
+	// ZeroVecMode.Ok() must return true regardless. Note that a zero query
+	// vector would drop all candidates with the default, so such requests
+	// are rejected by Handle.KNN (with ErrZeroQueryVec) instead. With other
+	// modes, all candidates get the same score, i.e the result is arbitrary.
+	ZeroVecMode mathx.ZeroVecMode
+	// ScoreRoundDecimals rounds every score (with mathx.RoundF64) to the
+	// specified amount of decimals before it reaches the filter and merge
+	// stages. Tiny float differences can otherwise reorder equally good
+	// results between runs, so this makes ranking stable at the chosen
+	// precision. Disabled with 0 (default), must be >= 0.
+	ScoreRoundDecimals int
+	// MergeSendInterval specifies how often the merge stage of the pipeline
+	// emits its (partial) results, i.e knnc.MergeStagePartialArgs.SendInterval.
+	// 1 emits after every insert (useful for streaming), larger values emit
+	// less often, which is cheaper. Use 0 (default) for max(K, 2); else
+	// it must be >= 1.
+	MergeSendInterval int
+	// OverFetch is used with approximate backends (see BackendPQ), where the
+	// scores found while scanning are approximate. K*OverFetch candidates are
+	// then kept (instead of K), which are re-ranked with the exact distance,
+	// such that the result is the K best of them, with exact scores. Higher
+	// values improve recall at the cost of K*OverFetch exact distance
+	// computations. Use 0 (default) to disable re-ranking, in which case the
+	// scores of the result are approximate; else it must be >= 1. Ignored
+	// when the exact backend is used.
+	OverFetch int
+	// DimMismatchFallback true keeps candidates with a dimension different to
+	// the query vector, which are otherwise dropped (and counted as
+	// KNNStats.Failed), such that they are scored with DimMismatchScore
+	// instead. This makes them visible in the result, e.g for finding corrupt
+	// data. Either way, they are counted as KNNStats.DimMismatch. Ignored with
+	// approximate backends (see BackendPQ), where candidates are encoded.
+	DimMismatchFallback bool
+	// DimMismatchScore is the score of candidates with a mismatched dimension,
+	// only used with DimMismatchFallback.
+	DimMismatchScore float64
+	// Filter is optional. If set, only candidates with all of its key=value
+	// pairs in their DistancerContainer.Metadata are scored, others are
+	// dropped before their distance is computed (and counted as
+	// KNNStats.Unmatched). Note that Extent applies before filtering, i.e it
+	// limits the scanned candidates, not the matching ones. With an index on
+	// any of the fields, only the candidates of the index are scanned, see
+	// Handle.SetMetadataIndex.
+	Filter map[string]string
 
 	// Monitor true will register the KNN request (and results).
 	Monitor bool
+	// monitorSync is set by Handle.KNNEager, which registers the result with
+	// the monitor itself (knnMonitor.observe), such that Handle.KNN does not
+	// have to put a listener on the result pipe (knnMonitor.register).
+	monitorSync bool
+	// Stats true will collect additional resource accounting stats for the
+	// request (see KNNStats), at a small performance penalty. They are
+	// accessible through KNNEnqueueResult.Stats.
+	Stats bool
+
+	// RangeQuery true turns the request into a range query, where all items
+	// with a score within KNNArgs.Radius are returned (regardless of count),
+	// instead of the K best ones. K is then an optional cap for the number
+	// of results (to bound memory), where 0 means DefaultRangeQueryMaxK, see
+	// KNNArgs.MaxK. Accept and Reject are ignored for range queries.
+	RangeQuery bool
+	// Radius is the threshold of a range query (see KNNArgs.RangeQuery). The
+	// meaning of 'within' depends on KNNArgs.Ascending, similar to Reject,
+	// but inclusive: scores <= Radius are kept with Ascending=true (e.g for
+	// Euclidean distance) and scores >= Radius with Ascending=false.
+	Radius float64
+}
+
+// DefaultRangeQueryMaxK is the max number of results of a range query if the
+// KNNArgs.K field is 0, see KNNArgs.RangeQuery.
+const DefaultRangeQueryMaxK = 1000
+
+// MaxK returns the max number of results for the request, which is KNNArgs.K,
+// except for range queries (KNNArgs.RangeQuery) with K=0, in which case it
+// is DefaultRangeQueryMaxK.
+func (r *KNNArgs) MaxK() int {
+	if r.RangeQuery && r.K == 0 {
+		return DefaultRangeQueryMaxK
+	}
+	return r.K
 }
 
 // Ok checks if KNNArgs meets the minimum configuration requirement.
 // Returns true if:
 //  r.Priority > 0,
-//  r.QueryVec != nil,
-//  len(r.QueryVec) > 0,
-//  r.KNNMethod.Ok(),
-//  r.K > 0,
+//  mathx.ValidVec(r.QueryVec) == nil,
+//  r.KNNMethod.Ok() (or r.Metric is registered, if set, or r.KNNMethod is
+//    KNNMethodNamespaceDefault)
+//  r.K > 0 (or >= 0 with r.RangeQuery)
 //  r.Extent > 0 && r.Extent <= 1
 //  r.TTL > 0
+//  r.BlockDeadline >= 0 (0 is default, see field doc)
+//  r.OnBlockDeadline.Ok()
+//  r.ZeroVecMode.Ok()
+//  r.ScoreRoundDecimals >= 0
+//  r.MergeSendInterval >= 0 (0 is default, see field doc)
+//  r.OverFetch >= 0 (0 is default, see field doc)
 func (r *KNNArgs) Ok() bool {
 	ok := true
 	ok = ok && r.Priority > 0
-	ok = ok && r.QueryVec != nil && len(r.QueryVec) > 0
-	ok = ok && r.KNNMethod.Ok()
-	ok = ok && r.K > 0
+	ok = ok && mathx.ValidVec(r.QueryVec) == nil
+	if r.Metric != "" {
+		_, registered := lookupMetric(r.Metric)
+		ok = ok && registered
+	} else {
+		ok = ok && (r.KNNMethod.Ok() || r.KNNMethod == KNNMethodNamespaceDefault)
+	}
+	ok = ok && (r.K > 0 || r.RangeQuery && r.K == 0)
 	ok = ok && r.Extent > 0 && r.Extent <= 1
 	ok = ok && r.TTL > 0
+	ok = ok && r.BlockDeadline >= 0
+	ok = ok && r.OnBlockDeadline.Ok()
+	ok = ok && r.ZeroVecMode.Ok()
+	ok = ok && r.ScoreRoundDecimals >= 0
+	ok = ok && r.MergeSendInterval >= 0
+	ok = ok && r.OverFetch >= 0
+	return ok
+}
+
+// resolveMethod replaces KNNMethodNamespaceDefault (if used) with the default
+// KNNMethod of the namespace, and sets r.Ascending for it. r.Metric takes
+// precedence, as with KNNArgs.KNNMethod.
+func (r *KNNArgs) resolveMethod(nsItem knnNamespacesItem) {
+	if r.KNNMethod != KNNMethodNamespaceDefault || r.Metric != "" {
+		return
+	}
+	r.KNNMethod = nsItem.defaultMethod
+	r.Ascending = r.KNNMethod.Ascending(false)
+}
+
+// zeroQuery returns true if r.QueryVec is a zero vector while the request uses
+// KNNMethodCosineSimilarity (without r.Metric) with mathx.ZeroVecModeSkip, in
+// which case every candidate would be dropped, i.e the result would always be
+// empty. See ErrZeroQueryVec.
+func (r *KNNArgs) zeroQuery() bool {
+	ok := true
+	ok = ok && r.Metric == ""
+	ok = ok && r.KNNMethod == KNNMethodCosineSimilarity
+	ok = ok && r.ZeroVecMode == mathx.ZeroVecModeSkip
+	for _, v := range r.QueryVec {
+		ok = ok && v == 0
+	}
 	return ok
 }
 
+// KNNStats contains statistics about how the candidates of a KNN request were
+// processed, which is useful for debugging (e.g dimension issues) and for
+// benchmarking. Fields marked as optional are only set with KNNArgs.Stats.
+type KNNStats struct {
+	// Candidates is the number of vectors that were scanned, i.e reached the
+	// KNN pipeline.
+	Candidates int
+	// Expired is the number of candidates that were dropped because they
+	// expired (became nil) before their distance could be computed.
+	Expired int
+	// Failed is the number of candidates that were dropped because the
+	// distance computation failed, typically because of vectors with a
+	// dimension different to the query vector.
+	Failed int
+	// DimMismatch is the number of candidates with a dimension different to
+	// the query vector. They are either counted as Failed as well, or scored
+	// with KNNArgs.DimMismatchScore (see KNNArgs.DimMismatchFallback). If it
+	// equals Candidates, then the query vector likely has the wrong dimension,
+	// else a non-zero value typically means that the namespace has corrupt data.
+	DimMismatch int
+	// Unmatched is the number of candidates that were dropped (without being
+	// scored) because their metadata did not match KNNArgs.Filter.
+	Unmatched int
+	// Filtered (optional) is the number of candidates that were not rejected
+	// by the filter stage (see KNNArgs.Reject), i.e that reached merging.
+	Filtered int
+	// MergeInserts (optional) is the number of candidates that were inserted
+	// into the final result, after they were merged by the merge stage.
+	MergeInserts int
+	// WallTime (optional) is the time spent from the start of the pipeline
+	// until the result was ready.
+	WallTime time.Duration
+	// Truncated is true if scanning was aborted because KNNArgs.TTL was
+	// exceeded (or KNNArgs.BlockDeadline was hit), i.e the result might be
+	// partial. Note that it is false if the request was cancelled or aborted
+	// early (see KNNArgs.Accept).
+	Truncated bool
+	// Unscanned is the number of candidates that were not scanned because
+	// KNNArgs.TTL was exceeded or KNNArgs.BlockDeadline was hit, i.e how much
+	// the recall might be degraded. Candidates of search spaces that were not
+	// scanned at all are counted with KNNArgs.Extent, including expired ones.
+	// Not counted by Handle.KNNBatch.
+	Unscanned int
+	// Exhausted is the phase that exhausted the budget of the request (see
+	// KNNBudget), empty if none did. The result is incomplete if it is set,
+	// e.g KNNPhaseQueue means that the request was dropped after waiting in
+	// the queue, such that nothing was searched.
+	Exhausted KNNPhase
+}
+
+// String gives a short summary, e.g:
+//  "120 of 1000 candidates failed distance computation, 0 expired, 120 with
+//  mismatched dimension"
+// The number of unscanned candidates and the phase that exhausted the budget
+// are appended if set, e.g:
+//  "..., 300 unscanned, scan exhausted budget"
+func (s KNNStats) String() string {
+	r := fmt.Sprintf(
+		"%d of %d candidates failed distance computation, %d expired, %d with mismatched dimension",
+		s.Failed,
+		s.Candidates,
+		s.Expired,
+		s.DimMismatch,
+	)
+	if s.Unscanned != 0 {
+		r += fmt.Sprintf(", %d unscanned", s.Unscanned)
+	}
+	if s.Exhausted != "" {
+		r += fmt.Sprintf(", %s exhausted budget", s.Exhausted)
+	}
+	return r
+}
+
 // KNNEnqueueResult is used to receive the results of a KNN request/query.
 type KNNEnqueueResult struct {
-	// Pipe is the destination of a KNN request/query.
+	// Pipe is the destination of a KNN request/query. Results only contain
+	// set items, i.e they have fewer than K items if there are fewer than K
+	// candidates.
 	Pipe chan knnc.ScoreItems
 	// Cancel can be used to cancel a request. Should be called when
 	// the deadline for a request (e.g KNNArgs.TTL is exceeded after
 	// a request is made).
 	Cancel *knnc.CancelSignal
+	// Stats is updated right before a result is sent through Pipe (or before
+	// Pipe is closed without a result, see KNNStats.Exhausted), so it should
+	// only be read after receiving from Pipe. Counts might be partial
+	// if the request was cancelled or aborted early (see KNNArgs.Accept).
+	Stats *KNNStats
+	// RetryAfter is only set when Handle.KNN rejects a request because the
+	// estimated queue+query latency exceeds KNNArgs.TTL. It is that estimate,
+	// which can be used as a hint for when to retry. It is also set when a
+	// tenant exceeds its QPS quota, see KNNEnqueueResult.Err.
+	RetryAfter time.Duration
+	// Err is only set when Handle.KNN rejects a request for a reason that has
+	// an error, i.e ErrQuotaExceeded (RetryAfter is then set too) and
+	// ErrZeroQueryVec.
+	Err error
 }
 
 // knnRequest is a wrapper around KNNArgs and its primary purpose is to
@@ -133,11 +403,63 @@ type knnRequest struct {
 	created time.Time
 	// Destination of the request.
 	enqueueResult KNNEnqueueResult
+	// Failures reported by the map stage, set up with knnRequest.toMapStage.
+	// Used to update enqueueResult.Stats.
+	mapFailures chan knnc.MapStageFailures
+	// Number of ScoreItems kept by knnRequest.toFilterFunc. Only counted if
+	// args.Stats is true. Use with sync/atomic.
+	filtered int64
+	// Number of candidates with a mismatched dimension, see
+	// knnRequest.onDimMismatch. Use with sync/atomic.
+	dimMismatch int64
+	// Number of candidates that were not scanned, see KNNStats.Unscanned.
+	// Use with sync/atomic.
+	unscanned int64
+	// Number of workers per pipeline stage, derived from args.Priority, see
+	// knnWorkers. Refined with the pool size in knnRequest.consume.
+	nWorkers int
+	// scanMaxWorkers caps the number of scan workers (as opposed to nWorkers,
+	// which is per stage), 0 means no cap. See NewHandleArgs.ScanMaxWorkers.
+	scanMaxWorkers int
+	// postProcessor is optional, see NewHandleArgs.PostProcessor.
+	postProcessor PostProcessor
+	// budget splits args.TTL between phases, see NewHandleArgs.KNNBudget.
+	budget KNNBudget
+	// pqTable is set when BackendPQ is used, in which case the map stage scores
+	// *knnc.PQVec instead of raw vecs. See knnRequest.consumeBackend.
+	pqTable *knnc.PQDistanceTable
+}
+
+// knnMinVecsPerWorker is the minimum number of vecs per worker, see knnWorkers.
+const knnMinVecsPerWorker = 1_000
+
+// knnWorkers gives the effective number of workers per pipeline stage for a
+// request with the given priority (KNNArgs.Priority), on a pool of 'poolLen'
+// vecs. The priority is capped by runtime.GOMAXPROCS, as more workers than
+// cpus only adds contention, and by ceil(poolLen / knnMinVecsPerWorker), as
+// small pools are not worth splitting. The result is at least 1, such that a
+// higher priority never increases latency (by oversubscription).
+func knnWorkers(priority, poolLen int) int {
+	n := priority
+	if procs := runtime.GOMAXPROCS(0); n > procs {
+		n = procs
+	}
+	perPool := poolLen / knnMinVecsPerWorker
+	if poolLen%knnMinVecsPerWorker != 0 {
+		perPool++
+	}
+	if n > perPool {
+		n = perPool
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
 }
 
 // newKNNRequest is a convenience func for creating a knnRequest instance.
-// It sets up the internal KNNEnqueueResult instance safely and sets the
-// 'created' field to now.
+// It sets up the internal KNNEnqueueResult instance safely, sets the 'created'
+// field to now and the 'nWorkers' field with knnWorkers (without a pool size).
 //
 // Note that this does not check the args. For safety, use knnRequest.Ok(),
 // if that is needed.
@@ -148,8 +470,10 @@ func newKNNRequest(args *KNNArgs) knnRequest {
 		enqueueResult: KNNEnqueueResult{
 			Pipe:   make(chan knnc.ScoreItems),
 			Cancel: knnc.NewCancelSignal(),
+			Stats:  &KNNStats{},
 		},
-		created: time.Now(),
+		created:  time.Now(),
+		nWorkers: knnWorkers(args.Priority, math.MaxInt),
 	}
 }
 
@@ -212,19 +536,41 @@ func (r *knnRequest) toScanChans(
 		return nil, false
 	}
 
-	return ss.Scan(knnc.SearchSpacesScanArgs{
-		Extent:        r.args.Extent,
-		BaseStageArgs: r.toBaseStageArgs(),
-	})
+	return ss.Scan(r.toScanArgs(nil))
+}
+
+// toScanArgs converts a knnRequest into knnc.SearchSpacesScanArgs, using the
+// Extent, RandomSeed, BlockDeadline and OnBlockDeadline of knnRequest.args,
+// the given status chan (may be nil), knnRequest.unscanned and
+// knnRequest.toBaseStageArgs(), where NWorkers is capped with
+// knnRequest.scanMaxWorkers (if > 0), and TTL ends at the scan deadline of
+// knnRequest.budget (if set, see KNNBudget.Scan).
+func (r *knnRequest) toScanArgs(status chan<- knnc.ScanStatus) knnc.SearchSpacesScanArgs {
+	args := knnc.SearchSpacesScanArgs{
+		Extent:          r.args.Extent,
+		BaseStageArgs:   r.toBaseStageArgs(),
+		Status:          status,
+		Seed:            r.args.RandomSeed,
+		BlockDeadline:   r.args.BlockDeadline,
+		OnBlockDeadline: r.args.OnBlockDeadline,
+		Unscanned:       &r.unscanned,
+	}
+	if r.scanMaxWorkers > 0 && args.NWorkers > r.scanMaxWorkers {
+		args.NWorkers = r.scanMaxWorkers
+	}
+	if r.budget.Scan > 0 {
+		args.TTL = time.Until(r.budget.scanDeadline(r.created, r.args.TTL))
+	}
+	return args
 }
 
 // toBaseStageArgs simply converts a knnRequest to knnc.BaseStageArgs, using
 // some state from the internal knnRequest.args. Specifically:
-//  NWorkers:       knnRequest.args.Priority
+//  NWorkers:       knnRequest.nWorkers (derived from args.Priority)
 //  BaseWorkerArgs: knnRequest.toBaseWorkerArgs()
 func (r *knnRequest) toBaseStageArgs() knnc.BaseStageArgs {
 	return knnc.BaseStageArgs{
-		NWorkers:       r.args.Priority,
+		NWorkers:       r.nWorkers,
 		BaseWorkerArgs: r.toBaseWorkerArgs(),
 	}
 }
@@ -232,44 +578,151 @@ func (r *knnRequest) toBaseStageArgs() knnc.BaseStageArgs {
 // toMapFunc simply converts a knnRequest into a func that can be used with
 // knnc.MapStagePartialArgs.MapFunc. It is a func where 'other' is compared
 // against the internal knnRequest.queryVec to produce a distance score, using
-// distance method specifies with knnRequest.KNNMethod. That distance score is
-// returned in the form of knnc.ScoreItem. The bool is whether the distance
-// function succeeded or not.
+// distance method specifies with knnRequest.KNNMethod (or the registered metric
+// specified with knnRequest.args.Metric, if set). That distance score is
+// returned in the form of knnc.ScoreItem, rounded if knnRequest.args has a
+// ScoreRoundDecimals > 0. The bool is whether the distance function succeeded
+// or not, where candidates with a dimension different to the query vector are
+// handled with knnRequest.onDimMismatch. If knnRequest.pqTable is set, then 'other' must be a *knnc.PQVec and
+// the score is the approximate distance given by the table.
 func (r *knnRequest) toMapFunc() func(other mathx.Distancer) (knnc.ScoreItem, bool) {
+	return r.mapFunc(r.pqTable)
+}
+
+// mapFunc is the impl of knnRequest.toMapFunc, where pqTable is used instead
+// of knnRequest.pqTable, i.e a nil pqTable gives exact distances.
+func (r *knnRequest) mapFunc(
+	pqTable *knnc.PQDistanceTable,
+) func(other mathx.Distancer) (knnc.ScoreItem, bool) {
+	// Looked up once, as opposed to per score.
+	m, registered := lookupMetric(r.args.Metric)
+
 	return func(other mathx.Distancer) (knnc.ScoreItem, bool) {
 		score := 0.
 		ok := true
 
-		switch r.args.KNNMethod {
-		case KNNMethodEuclideanDistance:
+		switch {
+		case pqTable != nil:
+			v, isPQ := other.(*knnc.PQVec)
+			if !isPQ {
+				return knnc.ScoreItem{}, false
+			}
+			score, ok = pqTable.Distance(v)
+		case r.args.Metric != "":
+			if !registered {
+				return knnc.ScoreItem{}, false
+			}
+			score, ok = m.f(r.queryVec, other)
+		case r.args.KNNMethod == KNNMethodEuclideanDistance:
 			score, ok = r.queryVec.EuclideanDistance(other)
-		case KNNMethodCosineSimilarity:
-			score, ok = r.queryVec.CosineSimilarity(other)
+		case r.args.KNNMethod == KNNMethodCosineSimilarity:
+			score, ok = mathx.CosineSimilarityZeroVecDist(r.queryVec, other, r.args.ZeroVecMode)
 		default:
 			return knnc.ScoreItem{}, false
 		}
 
-		return knnc.ScoreItem{Score: score}, ok
+		if !ok && pqTable == nil && other.Dim() != r.queryVec.Dim() {
+			score, ok = r.onDimMismatch()
+		}
+		if r.args.ScoreRoundDecimals > 0 {
+			score = mathx.RoundF64(score, r.args.ScoreRoundDecimals)
+		}
+
+		return knnc.ScoreItem{Score: score, Source: r.args.Namespace}, ok
 	}
 }
 
+// onDimMismatch is used by knnRequest.mapFunc for candidates with a dimension
+// different to the query vector. It counts them for KNNStats.DimMismatch, then
+// gives args.DimMismatchScore and args.DimMismatchFallback, i.e whether the
+// candidate should be kept.
+func (r *knnRequest) onDimMismatch() (float64, bool) {
+	atomic.AddInt64(&r.dimMismatch, 1)
+	return r.args.DimMismatchScore, r.args.DimMismatchFallback
+}
+
 // toMapStage simply converts a knnRequest into a func that is compatible with
 // knnc.NewPipelineArgs.MapStage. It uses knnc.MapStage and constructs its args
 // with the following:
 //  - MapStagePartialArgs.MapFunc = knnRequest.toMapFunc()
+//  - MapStagePartialArgs.Predicate = knnRequest.toPredicate()
+//  - MapStagePartialArgs.Failures = knnRequest.mapFailures (new chan)
 //  - MapStagePartialArgs.BaseStageArgs = knnRequest.toMapFunc()
 func (r *knnRequest) toMapStage() mapStageF {
 	return func(in knnc.ScanChan) (<-chan knnc.ScoreItem, bool) {
+		baseStageArgs := r.toBaseStageArgs()
+		if baseStageArgs.NWorkers < 1 {
+			return nil, false
+		}
+		// Buffered such that workers never block when reporting.
+		r.mapFailures = make(chan knnc.MapStageFailures, baseStageArgs.NWorkers)
 		return knnc.MapStage(knnc.MapStageArgs{
 			In: in,
 			MapStagePartialArgs: knnc.MapStagePartialArgs{
 				MapFunc:       r.toMapFunc(),
-				BaseStageArgs: r.toBaseStageArgs(),
+				Predicate:     r.toPredicate(),
+				Failures:      r.mapFailures,
+				BaseStageArgs: baseStageArgs,
 			},
 		})
 	}
 }
 
+// toPredicate converts knnRequest.args.Filter into a func that can be used with
+// knnc.MapStagePartialArgs.Predicate, see matchMetadata. Returns nil if there
+// is no filter, such that candidates are not checked at all. Candidates which
+// do not come from a *DistancerContainer (see knnc.ScanItem.Container) never
+// match.
+func (r *knnRequest) toPredicate() func(knnc.ScanItem) bool {
+	if len(r.args.Filter) == 0 {
+		return nil
+	}
+	return func(item knnc.ScanItem) bool {
+		dc, ok := item.Container.(*DistancerContainer)
+		return ok && matchMetadata(r.args.Filter, dc.Metadata)
+	}
+}
+
+// matchMetadata returns true if 'metadata' has all key=value pairs of 'filter'.
+func matchMetadata(filter, metadata map[string]string) bool {
+	for k, v := range filter {
+		if other, ok := metadata[k]; !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
+
+// updateStats collects the failures reported by the map stage (see
+// knnRequest.toMapStage) without blocking, and puts them into the internal
+// knnRequest.enqueueResult.Stats, along with optional stats if args.Stats is
+// true. Does nothing if either the failure chan or Stats is nil.
+func (r *knnRequest) updateStats() {
+	if r.mapFailures == nil || r.enqueueResult.Stats == nil {
+		return
+	}
+
+	failures := knnc.MapStageFailures{}
+	for done := false; !done; {
+		select {
+		case f, ok := <-r.mapFailures:
+			failures.Merge(f) // Zero value if !ok.
+			done = !ok
+		default:
+			done = true
+		}
+	}
+
+	r.enqueueResult.Stats.Candidates += failures.Received
+	r.enqueueResult.Stats.Expired += failures.NilDistancer
+	r.enqueueResult.Stats.Failed += failures.MapFunc
+	r.enqueueResult.Stats.Unmatched += failures.Predicate
+	r.enqueueResult.Stats.DimMismatch += int(atomic.LoadInt64(&r.dimMismatch))
+	if r.args.Stats {
+		r.enqueueResult.Stats.Filtered += int(atomic.LoadInt64(&r.filtered))
+	}
+}
+
 // toFilterFunc simply converts a knnRequest into a func that can be used with
 // knnc.FilterStagePartialArgs.FilterFunc. The returned func uses the internal
 // knnRequest.args.Reject to filter out scores 'worse' than score.Score. The
@@ -278,12 +731,23 @@ func (r *knnRequest) toMapStage() mapStageF {
 //  If Reject=1 and score.Score=2 and Ascending=true  -> return false
 //  If Reject=2 and score.Score=1 and Ascending=true  -> return true
 //
-// ... and flipping the Ascending flag gives the opposite results.
+// ... and flipping the Ascending flag gives the opposite results. For range
+// queries (knnRequest.args.RangeQuery), knnRequest.args.Radius is used as an
+// inclusive threshold instead. Kept scores are counted (for KNNStats.Filtered)
+// if knnRequest.args.Stats is true.
 func (r *knnRequest) toFilterFunc() func(score knnc.ScoreItem) bool {
 	return func(score knnc.ScoreItem) bool {
 		keep := false
-		keep = keep || score.Score < r.args.Reject && r.args.Ascending
-		keep = keep || score.Score > r.args.Reject && !r.args.Ascending
+		if r.args.RangeQuery {
+			keep = keep || score.Score <= r.args.Radius && r.args.Ascending
+			keep = keep || score.Score >= r.args.Radius && !r.args.Ascending
+		} else {
+			keep = keep || score.Score < r.args.Reject && r.args.Ascending
+			keep = keep || score.Score > r.args.Reject && !r.args.Ascending
+		}
+		if keep && r.args.Stats {
+			atomic.AddInt64(&r.filtered, 1)
+		}
 		return keep
 	}
 }
@@ -308,23 +772,47 @@ func (r *knnRequest) toFilterStage() filterStageF {
 // toMergeStage simply converts a knnRequest into a func that is compatible with
 // knnc.NewPipelineArgs.MergeStage. It uses knnc.MergeStage and constructs its
 // arguments with the following:
-//  - knnc.MergeStagePartialArgs.K = knnRequest.args.K
+//  - knnc.MergeStagePartialArgs.K = knnRequest.candidateK()
 //  - knnc.MergeStagePartialArgs.Ascending = knnRequest.args.Ascending
+//  - knnc.MergeStagePartialArgs.SendInterval = knnRequest.mergeSendInterval()
 //  - knnc.MergeStagePartialArgs.BaseStageArgs = knnRequest.toBaseStageArgs()
 func (r *knnRequest) toMergeStage() mergeStageF {
 	return func(in <-chan knnc.ScoreItem) (<-chan knnc.ScoreItems, bool) {
 		return knnc.MergeStage(knnc.MergeStageArgs{
 			In: in,
 			MergeStagePartialArgs: knnc.MergeStagePartialArgs{
-				K:             r.args.K,
+				K:             r.candidateK(),
 				Ascending:     r.args.Ascending,
-				SendInterval:  2, // TODO, arbitrary.
+				SendInterval:  r.mergeSendInterval(),
 				BaseStageArgs: r.toBaseStageArgs(),
 			},
 		})
 	}
 }
 
+// candidateK returns the number of candidates kept by the merge stage, which is
+// knnRequest.args.MaxK(), multiplied with args.OverFetch for pq scans (i.e
+// if knnRequest.pqTable is set), if it is set. See knnRequest.rerankPQ.
+func (r *knnRequest) candidateK() int {
+	if r.pqTable != nil && r.args.OverFetch > 1 {
+		return r.args.MaxK() * r.args.OverFetch
+	}
+	return r.args.MaxK()
+}
+
+// mergeSendInterval returns knnRequest.args.MergeSendInterval, or max(K, 2)
+// if that is unset (where K is knnRequest.args.MaxK()). The lower bound of 2 for the default is there because an
+// interval of 1 copies the merged results on every insert, which is costly.
+func (r *knnRequest) mergeSendInterval() int {
+	if r.args.MergeSendInterval > 0 {
+		return r.args.MergeSendInterval
+	}
+	if k := r.args.MaxK(); k > 2 {
+		return k
+	}
+	return 2
+}
+
 // toPipeline simply converts a knnRequest into a knnc.NewPipelineArgs that is
 // fed into knnc.Pipeline, from which both the returns are returned here. The
 // args are constructed as follows:
@@ -354,8 +842,40 @@ func (r *knnRequest) toPipeline() (*knnc.Pipeline, bool) {
 // r.enqueueResult.Cancel will be cancelled.
 //
 // Additionally, this method also uses the r.args.Accept field to abort a search
-// when enough (r.args.K) elements of sufficient quality are found.
+// when enough (r.args.K) elements of sufficient quality are found, except for
+// range queries (r.args.RangeQuery), which are never aborted early. Stats about
+// the processed candidates are put into r.enqueueResult.Stats before the result
+// is sent, including whether the scan was truncated due to r.args.TTL (i.e the
+// result might be partial). The result is also registered as accessed with
+// ss.Touch, which matters if ss has a hot tier. The number of workers per stage
+// is derived from r.args.Priority and the pool size of ss, see knnWorkers.
 func (r *knnRequest) consume(ss *knnc.SearchSpaces) bool {
+	return r.consumeBackend(ss, nil, nil)
+}
+
+// usesPQ returns true if the request should be consumed with the given pq index
+// (see knnRequest.consumeBackend), i.e if pq is not nil, the request is for
+// KNNMethodEuclideanDistance without a registered metric, and the query has
+// the dimension of the codebook of pq. See BackendPQ.
+func (r *knnRequest) usesPQ(pq *knnc.PQIndex) bool {
+	ok := pq != nil
+	ok = ok && r.args.Metric == ""
+	ok = ok && r.args.KNNMethod == KNNMethodEuclideanDistance
+	ok = ok && len(r.args.QueryVec) == pq.Codebook().Dim()
+	return ok
+}
+
+// consumeBackend is the impl of knnRequest.consume, where 'pq' (see BackendPQ)
+// is scanned instead of ss if r.usesPQ(pq) is true. It is otherwise the same,
+// except that ss.Touch is skipped for pq scans. Note that the scores of the
+// results are approximate in that case. If 'mi' (may be nil) has candidates for
+// r.args.Filter (see metadataIndex.candidates), then only those are scanned,
+// with the raw vecs of ss (i.e 'pq' is not used).
+func (r *knnRequest) consumeBackend(
+	ss *knnc.SearchSpaces,
+	pq *knnc.PQIndex,
+	mi *metadataIndex,
+) bool {
 	defer close(r.enqueueResult.Pipe)
 
 	// Check args.
@@ -368,16 +888,49 @@ func (r *knnRequest) consume(ss *knnc.SearchSpaces) bool {
 		return false
 	}
 
+	// Don't oversubscribe for small pools.
+	_, poolLen := ss.Len()
+	subset, indexed := mi.candidates(r.args.Filter)
+	if indexed {
+		poolLen = len(subset)
+	}
+	r.nWorkers = knnWorkers(r.args.Priority, poolLen)
+
 	// Try start scan(ners).
-	scanChans, ok := ss.Scan(knnc.SearchSpacesScanArgs{
-		Extent:        r.args.Extent,
-		BaseStageArgs: r.toBaseStageArgs(),
-	})
+	scanStatus := make(chan knnc.ScanStatus, 1)
+	var scanChans <-chan knnc.ScanChan
+	var ok bool
+	switch {
+	case indexed:
+		scanArgs := r.toScanArgs(scanStatus)
+		scanArgs.Subset = subset
+		scanChans, ok = ss.Scan(scanArgs)
+	case r.usesPQ(pq):
+		r.pqTable, _ = pq.Codebook().DistanceTable(r.queryVec)
+		scanChans, ok = pq.Scan(r.toScanArgs(scanStatus))
+	default:
+		scanChans, ok = ss.Scan(r.toScanArgs(scanStatus))
+	}
 	if !ok {
 		return false
 	}
 
+	return r.consumeScan(ss, scanChans, func() knnc.ScanStatus { return <-scanStatus })
+}
+
+// consumeScan is the part of knnRequest.consume (see docs) which comes after
+// the scan has started; it feeds 'scanChans' through a new pipeline and sends
+// the result to r.enqueueResult.Pipe, without closing it. The 'scanStatus' func
+// gives the status of the scan and is only called once the pipeline is done.
+// Returns false if r.toPipeline() fails, in which case r.enqueueResult.Cancel
+// is cancelled.
+func (r *knnRequest) consumeScan(
+	ss *knnc.SearchSpaces,
+	scanChans <-chan knnc.ScanChan,
+	scanStatus func() knnc.ScanStatus,
+) bool {
 	// Try start pipeline.
+	start := time.Now()
 	pipeline, ok := r.toPipeline()
 	if !ok {
 		// Setup of at least one stage (in toPipeline) failed, kill all of them,
@@ -396,8 +949,12 @@ func (r *knnRequest) consume(ss *knnc.SearchSpaces) bool {
 		}
 	}()
 
-	result := make(knnc.ScoreItems, r.args.K)
+	// Owned by the receiver of r.enqueueResult.Pipe, so it is not given back.
+	result := knnc.GetScoreItems(r.candidateK())
+	mergeInserts := 0
 	pipeline.ConsumeIter(func(scoreItems knnc.ScoreItems) bool {
+		// Items are copied into 'result', so this can be reused.
+		defer knnc.PutScoreItems(scoreItems)
 		for _, scoreItem := range scoreItems {
 			// Mechanism for stopping the query when r.K amoung of scores
 			// are found with better than r.Accept scores.
@@ -408,15 +965,208 @@ func (r *knnRequest) consume(ss *knnc.SearchSpaces) bool {
 
 			// done && worst.Set = true if there are k results and all of them
 			// satisfy the qi.request.Accept scores. !(true) = stop.
-			if done && worst.Set {
+			if done && worst.Set && !r.args.RangeQuery {
 				r.enqueueResult.Cancel.Cancel()
 				return false
 			}
 			result.BubbleInsert(scoreItem, r.args.Ascending)
+			mergeInserts++
 		}
 		return true
 	})
 
-	r.enqueueResult.Pipe <- result
+	r.updateStats()
+	if r.enqueueResult.Stats != nil {
+		// The pipeline is drained or cancelled at this point, so all scanners
+		// are done or about to be, i.e this does not block for long.
+		status := scanStatus()
+		r.enqueueResult.Stats.Truncated = status == knnc.ScanTruncated
+		r.enqueueResult.Stats.Unscanned = int(atomic.LoadInt64(&r.unscanned))
+		// Not exhausted if aborted by KNNArgs.BlockDeadline before the TTL.
+		scanDeadline := r.budget.scanDeadline(r.created, r.args.TTL)
+		if r.enqueueResult.Stats.Truncated && !time.Now().Before(scanDeadline) {
+			r.exhaust(KNNPhaseScan)
+		}
+		// Stages stop at the TTL as well, i.e merging might be incomplete.
+		if time.Since(r.created) >= r.args.TTL {
+			r.exhaust(KNNPhaseMerge)
+		}
+	}
+	if r.args.Stats && r.enqueueResult.Stats != nil {
+		r.enqueueResult.Stats.MergeInserts = mergeInserts
+		r.enqueueResult.Stats.WallTime = time.Since(start)
+	}
+	if r.pqTable != nil {
+		result = r.rerankPQ(result)
+	}
+	result = r.postProcess(result)
+	// Access tracking for the hot tier (see knnc.NewSearchSpacesArgs.HotTierSize),
+	// which is not used by pq scans.
+	if r.pqTable == nil {
+		touched := make([]knnc.Distancer, 0, len(result))
+		for _, scoreItem := range result {
+			if scoreItem.Set {
+				touched = append(touched, scoreItem.Distancer)
+			}
+		}
+		ss.Touch(touched...)
+	}
+
+	r.enqueueResult.Pipe <- trimUnset(result)
 	return true
 }
+
+// trimUnset removes unset items from 'items' (e.g when there are fewer than K
+// candidates), in place, while the order of the rest is kept. The cap is kept
+// as well, such that the result can still be given to knnc.PutScoreItems.
+func trimUnset(items knnc.ScoreItems) knnc.ScoreItems {
+	n := 0
+	for _, item := range items {
+		if item.Set {
+			items[n] = item
+			n++
+		}
+	}
+	return items[:n]
+}
+
+// rerankPQ replaces the *knnc.PQVec instances in the result of a pq scan with
+// their original vecs (see knnc.ScoreItems.UnwrapPQ). If args.OverFetch is set,
+// then the candidates (see knnRequest.candidateK) are scored again with the
+// exact distance, and the best args.MaxK() of them are returned, with their
+// exact scores. Candidates that fail the exact distance are dropped.
+func (r *knnRequest) rerankPQ(candidates knnc.ScoreItems) knnc.ScoreItems {
+	candidates.UnwrapPQ()
+	if r.args.OverFetch == 0 {
+		return candidates
+	}
+
+	exact := r.mapFunc(nil)
+	result := knnc.GetScoreItems(r.args.MaxK())
+	for _, candidate := range candidates {
+		if !candidate.Set {
+			continue
+		}
+		scoreItem, ok := exact(candidate.Distancer)
+		if !ok {
+			continue
+		}
+		scoreItem.Distancer = candidate.Distancer
+		scoreItem.ID = candidate.ID
+		scoreItem.Added = candidate.Added
+		scoreItem.Set = true
+		result.BubbleInsert(scoreItem, r.args.Ascending)
+	}
+	knnc.PutScoreItems(candidates)
+	return result
+}
+
+// consumeBatch is the equivalent of knnRequest.consume for multiple requests
+// on the same data (ss), where a single scan is shared by all of them with
+// knnc.MultiplexScan, i.e the scan cost is amortized. The scan uses the
+// Extent of the first request (it is assumed to be the same for all, see
+// Handle.KNNBatch), while the number of workers, buffer and TTL is the max
+// of all requests. Each request still has its own pipeline, cancel signal
+// and TTL, so cancelling one does not affect the others.
+//
+// The r.enqueueResult.Pipe chan of all requests will be closed. Requests
+// that are not ok (knnRequest.Ok) are skipped. Returns false if no request is
+// ok, or if the scan could not be started. This method blocks until all
+// results are sent.
+func consumeBatch(ss *knnc.SearchSpaces, rs []*knnRequest) bool {
+	valid := make([]*knnRequest, 0, len(rs))
+	for _, r := range rs {
+		if !r.Ok() {
+			close(r.enqueueResult.Pipe)
+			continue
+		}
+		valid = append(valid, r)
+	}
+	if len(valid) == 0 {
+		return false
+	}
+
+	// Shared scan, as wide as the most demanding request.
+	scanStatus := make(chan knnc.ScanStatus, 1)
+	scanArgs := knnc.SearchSpacesScanArgs{
+		Extent: valid[0].args.Extent,
+		Status: scanStatus,
+		Seed:   valid[0].args.RandomSeed,
+	}
+	scanArgs.Cancel = knnc.NewCancelSignal()
+	defer scanArgs.Cancel.Cancel()
+
+	// Don't oversubscribe for small pools.
+	_, poolLen := ss.Len()
+	outs := make([]knnc.BaseWorkerArgs, len(valid))
+	for i, r := range valid {
+		r.nWorkers = knnWorkers(r.args.Priority, poolLen)
+		outs[i] = r.toBaseWorkerArgs()
+		if r.nWorkers > scanArgs.NWorkers {
+			scanArgs.NWorkers = r.nWorkers
+		}
+		if outs[i].Buf > scanArgs.Buf {
+			scanArgs.Buf = outs[i].Buf
+		}
+		if outs[i].TTL > scanArgs.TTL {
+			scanArgs.TTL = outs[i].TTL
+		}
+	}
+	// Same for all requests, see NewHandleArgs.ScanMaxWorkers.
+	if max := valid[0].scanMaxWorkers; max > 0 && scanArgs.NWorkers > max {
+		scanArgs.NWorkers = max
+	}
+
+	scanChans, ok := ss.Scan(scanArgs)
+	if ok {
+		var muxed []<-chan knnc.ScanChan
+		if muxed, ok = knnc.MultiplexScan(scanChans, outs); ok {
+			consumeMuxed(ss, valid, muxed, scanStatus)
+			return true
+		}
+	}
+
+	for _, r := range valid {
+		close(r.enqueueResult.Pipe)
+	}
+	return false
+}
+
+// consumeMuxed is a part of consumeBatch. It consumes each of 'muxed' with
+// the request of the same index (knnRequest.consumeScan), concurrently. The
+// shared 'scanStatus' is used for each request, except for requests that are
+// cancelled or past their TTL, which get knnc.ScanCancelled or
+// knnc.ScanTruncated, respectively (as they might be done before the scan).
+func consumeMuxed(
+	ss *knnc.SearchSpaces,
+	rs []*knnRequest,
+	muxed []<-chan knnc.ScanChan,
+	scanStatus <-chan knnc.ScanStatus,
+) {
+	var status knnc.ScanStatus
+	statusDone := make(chan struct{})
+	go func() {
+		defer close(statusDone)
+		status = <-scanStatus
+	}()
+
+	wg := sync.WaitGroup{}
+	for i, r := range rs {
+		wg.Add(1)
+		go func(r *knnRequest, scanChans <-chan knnc.ScanChan) {
+			defer wg.Done()
+			defer close(r.enqueueResult.Pipe)
+			r.consumeScan(ss, scanChans, func() knnc.ScanStatus {
+				switch {
+				case r.enqueueResult.Cancel.Cancelled():
+					return knnc.ScanCancelled
+				case time.Since(r.created) >= r.args.TTL:
+					return knnc.ScanTruncated
+				}
+				<-statusDone
+				return status
+			})
+		}(r, muxed[i])
+	}
+	wg.Wait()
+}
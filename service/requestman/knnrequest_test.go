@@ -2,7 +2,11 @@ package requestman
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,6 +39,69 @@ func TestKNNRequestToMapFunc(t *testing.T) {
 	}
 }
 
+func TestKNNRequestToMapFuncZeroVec(t *testing.T) {
+	r := newKNNRequest(&KNNArgs{
+		QueryVec:  []float64{1, 1},
+		KNNMethod: KNNMethodCosineSimilarity,
+	})
+
+	if _, ok := r.toMapFunc()(mathx.NewSafeVec(0, 0)); ok {
+		t.Fatal("expected not-ok with default ZeroVecMode")
+	}
+
+	r.args.ZeroVecMode = mathx.ZeroVecModeNegOne
+	score, ok := r.toMapFunc()(mathx.NewSafeVec(0, 0))
+	if !ok || score.Score != -1 {
+		t.Fatalf("unexpected score with ZeroVecModeNegOne: %v, ok=%v", score, ok)
+	}
+}
+
+func TestKNNRequestToMapFuncScoreRoundDecimals(t *testing.T) {
+	r := newKNNRequest(&KNNArgs{
+		QueryVec:           []float64{0, 0},
+		KNNMethod:          KNNMethodEuclideanDistance,
+		ScoreRoundDecimals: 2,
+	})
+
+	// Distances differ below the rounding threshold (1.00001 vs 1.00002),
+	// while the last one differs above it.
+	vecs := []mathx.Distancer{
+		mathx.NewSafeVec(1.00002, 0),
+		mathx.NewSafeVec(1.00001, 0),
+		mathx.NewSafeVec(2, 0),
+		mathx.NewSafeVec(1.00003, 0),
+	}
+
+	// Top-K scores should be the same regardless of insertion order.
+	topK := func(order []int) []float64 {
+		items := make(knnc.ScoreItems, 3)
+		for _, i := range order {
+			item, ok := r.toMapFunc()(vecs[i])
+			if !ok {
+				t.Fatal("unexpected not-ok from map func")
+			}
+			item.Set = true
+			items.BubbleInsert(item, true)
+		}
+
+		scores := make([]float64, len(items))
+		for i, item := range items {
+			scores[i] = item.Score
+		}
+		return scores
+	}
+
+	want := []float64{1, 1, 1}
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		have := topK(order)
+		for i := range want {
+			if have[i] != want[i] {
+				t.Fatalf("unexpected top-k with order %v: %v", order, have)
+			}
+		}
+	}
+}
+
 func TestKNNRequestToMapStage(t *testing.T) {
 
 	r := newKNNRequest(&KNNArgs{
@@ -175,6 +242,58 @@ func TestKNNRequestToMergeStage(t *testing.T) {
 	}
 }
 
+func TestKNNRequestToMergeStageSendInterval(t *testing.T) {
+	nInserts := 12
+
+	// Counts the number of emissions from the merge stage.
+	emissions := func(interval int) int {
+		r := newKNNRequest(&KNNArgs{
+			TTL:               time.Second,
+			Priority:          1,
+			K:                 3,
+			MergeSendInterval: interval,
+		})
+
+		chI := make(chan knnc.ScoreItem)
+		chO, ok := r.toMergeStage()(chI)
+		if !ok {
+			t.Fatal("failed starting merge stage")
+		}
+
+		go func() {
+			defer close(chI)
+			for i := 0; i < nInserts; i++ {
+				chI <- knnc.ScoreItem{Score: float64(i), Set: true}
+			}
+		}()
+
+		n := 0
+		for range chO {
+			n++
+		}
+		return n
+	}
+
+	// nInserts is divisible by all intervals below, so there is no remainder
+	// (empty results are not sent by the merge stage).
+	if n := emissions(1); n != nInserts {
+		t.Fatalf("interval 1: want %v emissions, have %v", nInserts, n)
+	}
+	if n := emissions(4); n != nInserts/4 {
+		t.Fatalf("interval 4: want %v emissions, have %v", nInserts/4, n)
+	}
+	// Default is K=3.
+	if n := emissions(0); n != nInserts/3 {
+		t.Fatalf("default interval: want %v emissions, have %v", nInserts/3, n)
+	}
+
+	args := newTestKNNArgs(3, "test")
+	args.MergeSendInterval = -1
+	if args.Ok() {
+		t.Fatal("expected not-ok KNNArgs with a negative MergeSendInterval")
+	}
+}
+
 func TestKNNRequestToPipeline(t *testing.T) {
 	r := newKNNRequest(&KNNArgs{
 		//Namespace:,
@@ -273,6 +392,575 @@ func TestKNNRequestConsume(t *testing.T) {
 	}
 }
 
+func TestKNNRequestConsumeStats(t *testing.T) {
+	n := 1000
+	dim := 3
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      n,
+		SearchSpacesMaxN:        n,
+		MaintenanceTaskInterval: 1,
+	})
+
+	for i := 0; i < n; i++ {
+		v, _ := mathx.NewSafeVecRand(dim)
+		ss.AddSearchable(&DistancerContainer{D: v})
+	}
+
+	// Query vec has a dimension that doesn't match the search space, so all
+	// distance computations should fail.
+	r := newKNNRequest(&KNNArgs{
+		Namespace: "",
+		Priority:  3,
+		QueryVec:  []float64{1, 1, 1, 1},
+		KNNMethod: KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         1,
+		Extent:    1,
+		Accept:    0,
+		Reject:    5,
+		TTL:       time.Second * 10,
+	})
+
+	go r.consume(ss)
+	for range r.enqueueResult.Pipe {
+	}
+
+	want := KNNStats{Candidates: n, Failed: n, DimMismatch: n}
+	if *r.enqueueResult.Stats != want {
+		t.Fatalf("unexpected stats. want %v, have %v", want, r.enqueueResult.Stats)
+	}
+}
+
+func TestKNNRequestConsumeDimMismatch(t *testing.T) {
+	n := 100
+	dim := 3
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      n + 1,
+		SearchSpacesMaxN:        1,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	for i := 0; i < n; i++ {
+		v, _ := randFloat64Slice(dim)
+		ss.AddSearchable(&DistancerContainer{D: mathx.NewFloatVecWithID(v, "")})
+	}
+	// Search spaces reject vecs with a mismatched dim, so corruption of a vec
+	// which is already added is simulated instead.
+	corrupt := &DistancerContainer{D: mathx.NewFloatVecWithID([]float64{1, 1, 1}, "")}
+	ss.AddSearchable(corrupt)
+	corrupt.D = mathx.NewFloatVecWithID([]float64{1, 1, 1, 1}, "bad")
+
+	for _, fallback := range []bool{false, true} {
+		r := newKNNRequest(&KNNArgs{
+			Namespace:           "",
+			Priority:            3,
+			QueryVec:            []float64{1, 1, 1},
+			KNNMethod:           KNNMethodEuclideanDistance,
+			Ascending:           true,
+			K:                   1,
+			Extent:              1,
+			Accept:              -1,
+			Reject:              5, // Max dist for rand vecs is sqrt(3).
+			TTL:                 time.Second * 10,
+			DimMismatchFallback: fallback,
+			DimMismatchScore:    -1,
+		})
+
+		go r.consume(ss)
+		id := ""
+		for items := range r.enqueueResult.Pipe {
+			for _, item := range items {
+				if item.Set {
+					id = item.Distancer.(*mathx.FloatVec).ID()
+				}
+			}
+		}
+
+		stats := r.enqueueResult.Stats
+		if stats.Candidates != n+1 || stats.DimMismatch != 1 {
+			t.Fatalf("unexpected stats with fallback=%v: %v", fallback, stats)
+		}
+		// The corrupt vec is only kept with the fallback, where its score (-1)
+		// is better than any other.
+		if fallback && (stats.Failed != 0 || id != "bad") {
+			t.Fatalf("fallback did not keep the corrupt vec: %v, %q", stats, id)
+		}
+		if !fallback && (stats.Failed != 1 || id == "bad") {
+			t.Fatalf("corrupt vec was not dropped: %v, %q", stats, id)
+		}
+	}
+}
+
+func TestKNNRequestConsumeTruncated(t *testing.T) {
+	n := 100_000
+	dim := 50
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      1000,
+		SearchSpacesMaxN:        n,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	for i := 0; i < n; i++ {
+		v, _ := mathx.NewSafeVecRand(dim)
+		ss.AddSearchable(&DistancerContainer{D: v})
+	}
+
+	// Scanning everything takes much longer than the TTL.
+	queryVec, _ := randFloat64Slice(dim)
+	r := newKNNRequest(&KNNArgs{
+		Namespace: "",
+		Priority:  1,
+		QueryVec:  queryVec,
+		KNNMethod: KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         5,
+		Extent:    1,
+		Accept:    0,
+		Reject:    math.MaxFloat64,
+		TTL:       time.Millisecond * 5,
+	})
+
+	go r.consume(ss)
+	for range r.enqueueResult.Pipe {
+	}
+
+	stats := r.enqueueResult.Stats
+	if !stats.Truncated {
+		t.Fatal("truncated scan was not reported")
+	}
+	if stats.Candidates >= n {
+		t.Fatal("unexpected candidate count for a truncated scan:", stats.Candidates)
+	}
+}
+
+func TestKNNRequestConsumeBlockDeadline(t *testing.T) {
+	n := 200
+	dim := 3
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      1000,
+		SearchSpacesMaxN:        n,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	for i := 0; i < n; i++ {
+		v, _ := mathx.NewSafeVecRand(dim)
+		ss.AddSearchable(&DistancerContainer{D: v})
+	}
+
+	// Scoring is much slower than the block deadline, i.e the scanner blocks.
+	name := "test-slow"
+	RegisterMetric(name, func(a, b mathx.Distancer) (float64, bool) {
+		time.Sleep(time.Millisecond * 5)
+		return a.EuclideanDistance(b)
+	}, false)
+
+	for _, policy := range []knnc.BlockDeadlinePolicy{knnc.BlockDeadlineAbort, knnc.BlockDeadlineSkip} {
+		queryVec, _ := randFloat64Slice(dim)
+		r := newKNNRequest(&KNNArgs{
+			Namespace:       "",
+			Priority:        1,
+			QueryVec:        queryVec,
+			Metric:          name,
+			Ascending:       true,
+			K:               5,
+			Extent:          1,
+			Accept:          0,
+			Reject:          math.MaxFloat64,
+			TTL:             time.Second * 10,
+			BlockDeadline:   time.Millisecond,
+			OnBlockDeadline: policy,
+		})
+
+		go r.consume(ss)
+		for range r.enqueueResult.Pipe {
+		}
+
+		stats := r.enqueueResult.Stats
+		if stats.Truncated != (policy == knnc.BlockDeadlineAbort) {
+			t.Fatalf("policy %v: unexpected truncation: %+v", policy, *stats)
+		}
+		if stats.Unscanned == 0 || stats.Candidates+stats.Unscanned != n {
+			t.Fatalf("policy %v: unexpected counts: %+v", policy, *stats)
+		}
+		// Aborted before the TTL, i.e the budget is not exhausted.
+		if stats.Exhausted != "" {
+			t.Fatalf("policy %v: unexpected exhausted phase: %q", policy, stats.Exhausted)
+		}
+	}
+}
+
+func TestKNNRequestConsumeStatsExtent(t *testing.T) {
+	n := 1000
+	dim := 3
+
+	// All vecs fit in a single SearchSpace, such that Extent maps exactly.
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      n,
+		SearchSpacesMaxN:        1,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	for i := 0; i < n; i++ {
+		v, _ := mathx.NewSafeVecRand(dim)
+		ss.AddSearchable(&DistancerContainer{D: v})
+	}
+
+	for _, extent := range []float64{1, 0.5, 0.1} {
+		r := newKNNRequest(&KNNArgs{
+			Namespace: "",
+			Priority:  3,
+			QueryVec:  []float64{1, 1, 1},
+			KNNMethod: KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         5,
+			Extent:    extent,
+			Accept:    0,
+			Reject:    5, // Max dist for rand vecs is sqrt(3).
+			TTL:       time.Second * 10,
+			Stats:     true,
+		})
+
+		go r.consume(ss)
+		for range r.enqueueResult.Pipe {
+		}
+
+		stats := r.enqueueResult.Stats
+		if want := int(float64(n) * extent); stats.Candidates != want {
+			t.Fatalf("want %v scanned with extent %v, have %v", want, extent, stats.Candidates)
+		}
+		// Nothing is rejected, so everything should reach merging.
+		if stats.Filtered != stats.Candidates {
+			t.Fatalf("unexpected filtered count with extent %v: %v", extent, stats.Filtered)
+		}
+		if stats.MergeInserts == 0 || stats.MergeInserts > stats.Filtered {
+			t.Fatalf("unexpected merge inserts with extent %v: %v", extent, stats.MergeInserts)
+		}
+		if stats.WallTime <= 0 {
+			t.Fatalf("unexpected wall time with extent %v: %v", extent, stats.WallTime)
+		}
+	}
+}
+
+func TestKNNWorkers(t *testing.T) {
+	// Raise the cpu cap (if needed) such that scaling is visible on any host.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	for _, tc := range []struct {
+		priority int
+		poolLen  int
+		want     int
+	}{
+		{priority: 8, poolLen: 3, want: 1},
+		{priority: 8, poolLen: 0, want: 1},
+		{priority: 0, poolLen: 100_000, want: 1},
+		{priority: 8, poolLen: knnMinVecsPerWorker, want: 1},
+		{priority: 8, poolLen: knnMinVecsPerWorker + 1, want: 2},
+		{priority: 8, poolLen: knnMinVecsPerWorker * 3, want: 3},
+		{priority: 4, poolLen: 100_000, want: 4},
+		{priority: 100, poolLen: 100_000, want: 8},
+	} {
+		if have := knnWorkers(tc.priority, tc.poolLen); have != tc.want {
+			t.Fatalf("want %v workers for priority %v and pool len %v, have %v",
+				tc.want, tc.priority, tc.poolLen, have)
+		}
+	}
+}
+
+func TestKNNRequestConsumeWorkers(t *testing.T) {
+	// Raise the cpu cap (if needed) such that scaling is visible on any host.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	for _, tc := range []struct {
+		poolLen int
+		want    int
+	}{
+		{poolLen: 3, want: 1},
+		{poolLen: knnMinVecsPerWorker * 8, want: 8},
+	} {
+		ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+			SearchSpacesMaxCap:      tc.poolLen,
+			SearchSpacesMaxN:        1,
+			MaintenanceTaskInterval: time.Minute,
+		})
+		for i := 0; i < tc.poolLen; i++ {
+			v, _ := mathx.NewSafeVecRand(3)
+			ss.AddSearchable(&DistancerContainer{D: v})
+		}
+
+		// Pipeline stages wind down after the pipe is closed, wait for that
+		// such that other tests are not affected (e.g goroutine leak checks).
+		nGoroutines := runtime.NumGoroutine()
+
+		r := newKNNRequest(&KNNArgs{
+			Namespace: "",
+			Priority:  100,
+			QueryVec:  []float64{1, 1, 1},
+			KNNMethod: KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         1,
+			Extent:    1,
+			Accept:    0,
+			Reject:    5,
+			TTL:       time.Second * 10,
+		})
+
+		go r.consume(ss)
+		for range r.enqueueResult.Pipe {
+		}
+
+		// Set before the pipe is closed by consume.
+		if r.nWorkers != tc.want {
+			t.Fatalf("want %v workers for pool len %v, have %v",
+				tc.want, tc.poolLen, r.nWorkers)
+		}
+
+		deadline := time.Now().Add(time.Second * 10)
+		for runtime.NumGoroutine() > nGoroutines && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+// testConcurrencyContainer tracks the max number of concurrent calls to
+// Distancer, i.e how many scanners are active at a time.
+type testConcurrencyContainer struct {
+	DistancerContainer
+	active *int64
+	max    *int64
+}
+
+func (c *testConcurrencyContainer) Distancer() mathx.Distancer {
+	n := atomic.AddInt64(c.active, 1)
+	defer atomic.AddInt64(c.active, -1)
+	for {
+		max := atomic.LoadInt64(c.max)
+		if n <= max || atomic.CompareAndSwapInt64(c.max, max, n) {
+			break
+		}
+	}
+	// Give other scanners a chance to overlap, even with a single cpu.
+	runtime.Gosched()
+	return c.DistancerContainer.Distancer()
+}
+
+func TestKNNRequestScanMaxWorkers(t *testing.T) {
+	// Raise the cpu cap (if needed) such that Priority gives many workers.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	poolLen := knnMinVecsPerWorker * 8
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      poolLen,
+		SearchSpacesMaxN:        poolLen / 32,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	var active, max int64
+	for i := 0; i < poolLen; i++ {
+		v, _ := mathx.NewSafeVecRand(3)
+		ss.AddSearchable(&testConcurrencyContainer{DistancerContainer{D: v}, &active, &max})
+	}
+	atomic.StoreInt64(&max, 0) // Adding might peek too.
+
+	scanMaxWorkers := 2
+	r := newKNNRequest(&KNNArgs{
+		Namespace: "",
+		Priority:  100,
+		QueryVec:  []float64{1, 1, 1},
+		KNNMethod: KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         1,
+		Extent:    1,
+		Accept:    0,
+		Reject:    5,
+		TTL:       time.Second * 10,
+	})
+	r.scanMaxWorkers = scanMaxWorkers
+
+	go r.consume(ss)
+	n := 0
+	for range r.enqueueResult.Pipe {
+		n++
+	}
+	if n != 1 {
+		t.Fatal("unexpected result count:", n)
+	}
+
+	// Priority still applies to the other stages.
+	if r.nWorkers != 8 {
+		t.Fatal("unexpected number of workers:", r.nWorkers)
+	}
+	if scanArgs := r.toScanArgs(nil); scanArgs.NWorkers != scanMaxWorkers {
+		t.Fatal("unexpected number of scan workers:", scanArgs.NWorkers)
+	}
+	if max := atomic.LoadInt64(&max); max == 0 || max > int64(scanMaxWorkers) {
+		t.Fatalf("want at most %v concurrent scanners, have %v", scanMaxWorkers, max)
+	}
+}
+
+// testCountingContainer counts calls to Distancer, i.e how many times it is scanned.
+type testCountingContainer struct {
+	DistancerContainer
+	n *int64
+}
+
+func (c *testCountingContainer) Distancer() mathx.Distancer {
+	atomic.AddInt64(c.n, 1)
+	return c.DistancerContainer.Distancer()
+}
+
+func TestConsumeBatch(t *testing.T) {
+	n := 1000
+	dim := 3
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      100,
+		SearchSpacesMaxN:        n,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	var scanned int64
+	vecs := make([]*mathx.SafeVec, n)
+	for i := range vecs {
+		vecs[i], _ = mathx.NewSafeVecRand(dim)
+		ss.AddSearchable(&testCountingContainer{DistancerContainer{D: vecs[i]}, &scanned})
+	}
+	atomic.StoreInt64(&scanned, 0) // Adding might peek too.
+
+	queryVecs := [][]float64{{0, 0, 0}, {1, 1, 1}, {0.5, 0.5, 0.5}}
+	rs := make([]*knnRequest, len(queryVecs))
+	for i, queryVec := range queryVecs {
+		r := newKNNRequest(&KNNArgs{
+			Namespace: "",
+			Priority:  2,
+			QueryVec:  queryVec,
+			KNNMethod: KNNMethodEuclideanDistance,
+			Ascending: true,
+			K:         3,
+			Extent:    1,
+			Accept:    0,
+			Reject:    5, // Max dist for rand vecs is sqrt(3).
+			TTL:       time.Second * 10,
+		})
+		rs[i] = &r
+	}
+
+	results := make([]knnc.ScoreItems, len(rs))
+	wg := sync.WaitGroup{}
+	for i, r := range rs {
+		wg.Add(1)
+		go func(i int, r *knnRequest) {
+			defer wg.Done()
+			for scoreItems := range r.enqueueResult.Pipe {
+				results[i] = scoreItems
+			}
+		}(i, r)
+	}
+	if !consumeBatch(ss, rs) {
+		t.Fatal("unexpected not-ok consumeBatch")
+	}
+	wg.Wait()
+
+	if have := atomic.LoadInt64(&scanned); have != int64(n) {
+		t.Fatalf("want %v vecs scanned once, have %v scans", n, have)
+	}
+
+	// Compare with brute force.
+	for i, queryVec := range queryVecs {
+		want := make(knnc.ScoreItems, 3)
+		for _, v := range vecs {
+			score, _ := mathx.NewSafeVec(queryVec...).EuclideanDistance(v)
+			want.BubbleInsert(knnc.ScoreItem{Distancer: v, Score: score, Set: true}, true)
+		}
+		have := results[i].Trim()
+		if len(have) != len(want) {
+			t.Fatalf("query %v: want %v results, have %v", i, len(want), len(have))
+		}
+		for j := range want {
+			if have[j].Score != want[j].Score {
+				t.Fatalf("query %v: want score %v at %v, have %v", i, want[j].Score, j, have[j].Score)
+			}
+		}
+	}
+}
+
+// Checks that results are correct when many requests run concurrently, as the
+// ScoreItems of the merge path are pooled (see knnc.GetScoreItems) and so are
+// reused across requests.
+func TestKNNRequestConsumeConcurrentPooled(t *testing.T) {
+	n := 1000
+	dim := 3
+	k := 5
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      100,
+		SearchSpacesMaxN:        n,
+		MaintenanceTaskInterval: time.Minute,
+	})
+
+	vecs := make([]*mathx.SafeVec, n)
+	for i := range vecs {
+		vecs[i], _ = mathx.NewSafeVecRand(dim)
+		ss.AddSearchable(&DistancerContainer{D: vecs[i]})
+	}
+
+	queryVecs := make([][]float64, 20)
+	for i := range queryVecs {
+		queryVecs[i], _ = randFloat64Slice(dim)
+	}
+
+	results := make([]knnc.ScoreItems, len(queryVecs))
+	wg := sync.WaitGroup{}
+	for i, queryVec := range queryVecs {
+		r := newKNNRequest(&KNNArgs{
+			Namespace:         "",
+			Priority:          2,
+			QueryVec:          queryVec,
+			KNNMethod:         KNNMethodEuclideanDistance,
+			Ascending:         true,
+			K:                 k,
+			Extent:            1,
+			Accept:            0,
+			Reject:            5, // Max dist for rand vecs is sqrt(3).
+			TTL:               time.Second * 10,
+			MergeSendInterval: 1, // Many sends, i.e many pooled slices.
+		})
+		// Captured before consume starts, as it writes to r.
+		pipe := r.enqueueResult.Pipe
+		go r.consume(ss)
+
+		wg.Add(1)
+		go func(i int, pipe <-chan knnc.ScoreItems) {
+			defer wg.Done()
+			for scoreItems := range pipe {
+				results[i] = scoreItems
+			}
+		}(i, pipe)
+	}
+	wg.Wait()
+
+	// Compare with brute force.
+	for i, queryVec := range queryVecs {
+		want := make(knnc.ScoreItems, k)
+		for _, v := range vecs {
+			score, _ := mathx.NewSafeVec(queryVec...).EuclideanDistance(v)
+			want.BubbleInsert(knnc.ScoreItem{Distancer: v, Score: score, Set: true}, true)
+		}
+		have := results[i].Trim()
+		if len(have) != len(want) {
+			t.Fatalf("query %v: want %v results, have %v", i, len(want), len(have))
+		}
+		for j := range want {
+			if have[j].Score != want[j].Score {
+				t.Fatalf("query %v: want score %v at %v, have %v", i, want[j].Score, j, have[j].Score)
+			}
+		}
+	}
+}
+
 /*
 --------------------------------------------------------------------------------
 Testing parameter tweaking. Some parameters/configs of KNNArgs are related to
@@ -300,10 +988,20 @@ var scoreDump float64 // Just so the compiler won't do unwanted optimization.
 // Helper func intended for timeing queries while tweaking paramaters.
 // The purpose if to validate that some (query) param changes do indeed speed
 // up / slow down query times (accuracy is not checked). This is timed here and
-// the slope is returned.
-func testTimeSlope(args testTimeSlopeArgs) (time.Duration, bool) {
+// the slope is returned, along with the average duration of all steps.
+func testTimeSlope(args testTimeSlopeArgs) (time.Duration, time.Duration, bool) {
 	durations := make([]time.Duration, 0, args.n)
 
+	// Cancelled requests wind down in the background, wait for that such that
+	// other tests are not affected (e.g goroutine leak checks).
+	nGoroutines := runtime.NumGoroutine()
+	defer func() {
+		deadline := time.Now().Add(time.Second * 10)
+		for runtime.NumGoroutine() > nGoroutines && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+
 	// Create data.
 	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
 		SearchSpacesMaxCap:      args.poolSize,
@@ -326,7 +1024,7 @@ func testTimeSlope(args testTimeSlopeArgs) (time.Duration, bool) {
 			//request := args.f(i)
 			request := newKNNRequest(args.f(i))
 			if !request.Ok() {
-				return 0, false
+				return 0, 0, false
 			}
 
 			stamp := time.Now()
@@ -337,10 +1035,12 @@ func testTimeSlope(args testTimeSlopeArgs) (time.Duration, bool) {
 			// this as it is, at least it validates that the request went through.
 			go request.consume(ss)
 			if len((<-request.enqueueResult.Pipe).Trim()) == 0 {
-				return 0, false
+				return 0, 0, false
 			}
 
 			delta := time.Now().Sub(stamp)
+			// Stop lingering workers, as done when a request is used normally.
+			request.enqueueResult.Cancel.Cancel()
 			totalDuration += delta
 		}
 
@@ -361,7 +1061,12 @@ func testTimeSlope(args testTimeSlopeArgs) (time.Duration, bool) {
 	// -1 because it is relative deltas. 0 div potential but keeping it for
 	// simplicity, it's for testing anyway.
 	relativeDeltaAverage := relativeDeltaSum / (time.Duration(len(durations)) - 1)
-	return relativeDeltaAverage, true
+
+	totalDuration := time.Duration(0)
+	for _, d := range durations {
+		totalDuration += d
+	}
+	return relativeDeltaAverage, totalDuration / time.Duration(len(durations)), true
 }
 
 func randFloat64Slice(dim int) ([]float64, bool) {
@@ -378,7 +1083,9 @@ func randFloat64Slice(dim int) ([]float64, bool) {
 }
 
 // Increases KNNRequest (search) 'priority' for each step, which should make
-// query faster because 'priority'=num of goroutines per stage.
+// query faster because 'priority'=num of goroutines per stage. Priority is
+// capped (see knnWorkers), so the time can also be flat (e.g with one cpu),
+// which is why small positive slopes (noise) are tolerated.
 func TestTimeSlopePriority(t *testing.T) {
 	poolSize := 100_000
 	poolDim := 3
@@ -386,7 +1093,7 @@ func TestTimeSlopePriority(t *testing.T) {
 	n := 5
 	m := 10
 
-	slope, ok := testTimeSlope(testTimeSlopeArgs{
+	slope, mean, ok := testTimeSlope(testTimeSlopeArgs{
 		poolSize: poolSize,
 		poolDim:  poolDim,
 		n:        n,
@@ -412,8 +1119,87 @@ func TestTimeSlopePriority(t *testing.T) {
 	if !ok {
 		t.Fatal("timeSlope func returned false, test is broken")
 	}
-	if slope > 0 {
-		t.Fatal("positive slope, implying increase in time per step.")
+	if slope > mean/10 {
+		t.Fatalf("positive slope (%v, mean %v), implying increase in time per step.", slope, mean)
+	}
+}
+
+// BenchmarkKNNRequestPriority runs KNN requests with increasing priorities on
+// the same data. Priority is capped by the number of cpus (see knnWorkers), so
+// the time per op should decrease or stay flat as priority increases.
+func BenchmarkKNNRequestPriority(b *testing.B) {
+	poolSize := 100_000
+	poolDim := 3
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      poolSize / 10,
+		SearchSpacesMaxN:        poolSize,
+		MaintenanceTaskInterval: time.Minute,
+	})
+	for i := 0; i < poolSize; i++ {
+		v, _ := mathx.NewSafeVecRand(poolDim)
+		ss.AddSearchable(&DistancerContainer{D: v})
+	}
+
+	for _, priority := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("priority=%d", priority), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				v, _ := randFloat64Slice(poolDim)
+				request := newKNNRequest(&KNNArgs{
+					Priority:  priority,
+					QueryVec:  v,
+					KNNMethod: KNNMethodCosineSimilarity,
+					K:         3,
+					Extent:    1,
+					Accept:    1,
+					Reject:    0,
+					TTL:       time.Minute,
+				})
+				go request.consume(ss)
+				if len((<-request.enqueueResult.Pipe).Trim()) == 0 {
+					b.Fatal("got 0 results")
+				}
+				request.enqueueResult.Cancel.Cancel()
+			}
+		})
+	}
+}
+
+// BenchmarkKNNRequestAllocs runs KNN requests which stream many (partial) results
+// through the merge stage (MergeSendInterval=1), for allocation reporting, as
+// the ScoreItems slices of the merge path are pooled (see knnc.GetScoreItems).
+func BenchmarkKNNRequestAllocs(b *testing.B) {
+	poolSize := 10_000
+	poolDim := 3
+
+	ss, _ := knnc.NewSearchSpaces(knnc.NewSearchSpacesArgs{
+		SearchSpacesMaxCap:      poolSize / 10,
+		SearchSpacesMaxN:        poolSize,
+		MaintenanceTaskInterval: time.Minute,
+	})
+	for i := 0; i < poolSize; i++ {
+		v, _ := mathx.NewSafeVecRand(poolDim)
+		ss.AddSearchable(&DistancerContainer{D: v})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, _ := randFloat64Slice(poolDim)
+		request := newKNNRequest(&KNNArgs{
+			Priority:          2,
+			QueryVec:          v,
+			KNNMethod:         KNNMethodEuclideanDistance,
+			Ascending:         true,
+			K:                 10,
+			Extent:            1,
+			Reject:            5, // Max dist for rand vecs is sqrt(3).
+			TTL:               time.Minute,
+			MergeSendInterval: 1,
+		})
+		go request.consume(ss)
+		for range request.enqueueResult.Pipe {
+		}
 	}
 }
 
@@ -426,7 +1212,7 @@ func TestTimeSlopeExtent(t *testing.T) {
 	n := 100
 	m := 10
 
-	slope, ok := testTimeSlope(testTimeSlopeArgs{
+	slope, _, ok := testTimeSlope(testTimeSlopeArgs{
 		poolSize: poolSize,
 		poolDim:  poolDim,
 		n:        n,
@@ -472,7 +1258,7 @@ func TestTimeSlopeAccept(t *testing.T) {
 	n := 100
 	m := 10
 
-	slope, ok := testTimeSlope(testTimeSlopeArgs{
+	slope, _, ok := testTimeSlope(testTimeSlopeArgs{
 		poolSize: poolSize,
 		poolDim:  poolDim,
 		n:        n,
@@ -519,7 +1305,7 @@ func TestTimeSlopeReject(t *testing.T) {
 	n := 100
 	m := 10
 
-	slope, ok := testTimeSlope(testTimeSlopeArgs{
+	slope, _, ok := testTimeSlope(testTimeSlopeArgs{
 		poolSize: poolSize,
 		poolDim:  poolDim,
 		n:        n,
@@ -562,7 +1348,7 @@ func TestTimeSlopeCombined(t *testing.T) {
 	n := 100
 	m := 10
 
-	slope, ok := testTimeSlope(testTimeSlopeArgs{
+	slope, _, ok := testTimeSlope(testTimeSlopeArgs{
 		poolSize: poolSize,
 		poolDim:  poolDim,
 		n:        n,
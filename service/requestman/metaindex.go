@@ -0,0 +1,225 @@
+package requestman
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+)
+
+/*
+File contains secondary indexes on DistancerContainer.Metadata, which restrict
+the scan of KNN requests with a KNNArgs.Filter to the matching candidates, as
+opposed to scanning (and filtering) the whole namespace. See
+Handle.SetMetadataIndex.
+*/
+
+// ErrInvalidIndexField is returned by Handle.SetMetadataIndex if a field is
+// empty.
+var ErrInvalidIndexField = errors.New("requestman: invalid metadata index field")
+
+// metadataIndexMinClean is the min number of entries in a metadataIndex before
+// expired containers are removed from it, see metadataIndex.add.
+const metadataIndexMinClean = 1024
+
+// metadataIndex is an inverted index from the values of some metadata fields
+// (see DistancerContainer.Metadata) to the containers which have them. It is
+// kept in sync with the namespace by knnNamespaces.put and Handle.removeWhere,
+// while expired containers are removed lazily (see metadataIndex.add). Note
+// that DistancerContainer.Metadata must not change after a container is added.
+type metadataIndex struct {
+	mx sync.RWMutex
+	// values maps each indexed field to its values, and each value to the set
+	// of containers with that value.
+	values map[string]map[string]map[*DistancerContainer]struct{}
+	// n is the number of entries (field/value/container) in values.
+	n int
+	// cleanAt is the n at which expired containers are removed.
+	cleanAt int
+}
+
+// newMetadataIndex is a factory func for metadataIndex, where each of 'fields'
+// is indexed. Fields are expected to be validated by the caller.
+func newMetadataIndex(fields []string) *metadataIndex {
+	mi := metadataIndex{
+		values:  make(map[string]map[string]map[*DistancerContainer]struct{}, len(fields)),
+		cleanAt: metadataIndexMinClean,
+	}
+	for _, field := range fields {
+		mi.values[field] = make(map[string]map[*DistancerContainer]struct{})
+	}
+	return &mi
+}
+
+// fields returns the indexed fields, sorted.
+func (mi *metadataIndex) fields() []string {
+	r := make([]string, 0, len(mi.values))
+	for field := range mi.values {
+		r = append(r, field)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// add indexes 'dc' by the values of its metadata for all indexed fields, fields
+// which it does not have are skipped. Expired containers are removed once the
+// number of entries has doubled since the last removal, such that the cost of
+// that is amortized over the adds.
+func (mi *metadataIndex) add(dc *DistancerContainer) {
+	mi.mx.Lock()
+	defer mi.mx.Unlock()
+
+	for field, values := range mi.values {
+		v, ok := dc.Metadata[field]
+		if !ok {
+			continue
+		}
+		if values[v] == nil {
+			values[v] = make(map[*DistancerContainer]struct{})
+		}
+		values[v][dc] = struct{}{}
+		mi.n++
+	}
+
+	if mi.n >= mi.cleanAt {
+		mi.remove(func(dc *DistancerContainer) bool { return dc.Distancer() == nil })
+		mi.cleanAt = 2 * mi.n
+		if mi.cleanAt < metadataIndexMinClean {
+			mi.cleanAt = metadataIndexMinClean
+		}
+	}
+}
+
+// removeSet removes all containers in 'removed' from the index, see
+// Handle.removeWhere. Containers which are not *DistancerContainer are skipped.
+func (mi *metadataIndex) removeSet(removed map[knnc.DistancerContainer]struct{}) {
+	mi.mx.Lock()
+	defer mi.mx.Unlock()
+
+	for container := range removed {
+		dc, ok := container.(*DistancerContainer)
+		if !ok {
+			continue
+		}
+		for field, values := range mi.values {
+			v, ok := dc.Metadata[field]
+			if _, indexed := values[v][dc]; !ok || !indexed {
+				continue
+			}
+			delete(values[v], dc)
+			if len(values[v]) == 0 {
+				delete(values, v)
+			}
+			mi.n--
+		}
+	}
+}
+
+// remove removes all containers where 'pred' returns true, the caller must
+// hold the lock.
+func (mi *metadataIndex) remove(pred func(dc *DistancerContainer) bool) {
+	for _, values := range mi.values {
+		for v, set := range values {
+			for dc := range set {
+				if pred(dc) {
+					delete(set, dc)
+					mi.n--
+				}
+			}
+			if len(set) == 0 {
+				delete(values, v)
+			}
+		}
+	}
+}
+
+// candidates returns the (non-expired) containers which have the value of
+// 'filter' for one of its indexed fields, where the field with the fewest
+// containers is used. These are the only containers which can match 'filter'
+// (see matchMetadata), though not all of them necessarily do, as other fields
+// of the filter are not checked. The bool is false if none of the fields of
+// 'filter' are indexed (or if the instance is nil), in which case the whole
+// namespace must be scanned.
+func (mi *metadataIndex) candidates(filter map[string]string) ([]knnc.DistancerContainer, bool) {
+	if mi == nil {
+		return nil, false
+	}
+	mi.mx.RLock()
+	defer mi.mx.RUnlock()
+
+	var best map[*DistancerContainer]struct{}
+	indexed := false
+	for field, v := range filter {
+		values, ok := mi.values[field]
+		if !ok {
+			continue
+		}
+		if set := values[v]; !indexed || len(set) < len(best) {
+			best = set
+			indexed = true
+		}
+	}
+	if !indexed {
+		return nil, false
+	}
+
+	// Not nil, as that scans the whole namespace (see knnc.SearchSpacesScanArgs).
+	r := make([]knnc.DistancerContainer, 0, len(best))
+	for dc := range best {
+		if dc.Distancer() != nil {
+			r = append(r, dc)
+		}
+	}
+	// Sorted by insertion order, such that scans are reproducible, e.g with
+	// KNNArgs.RandomSeed.
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].(*DistancerContainer).seq < r[j].(*DistancerContainer).seq
+	})
+	return r, true
+}
+
+// SetMetadataIndex sets the metadata fields (see DistancerContainer.Metadata)
+// which are indexed in a namespace, replacing any previous ones, after which
+// all (non-expired) data in the namespace is indexed. KNN requests with a
+// KNNArgs.Filter on any of the fields then only scan the containers with the
+// matching value of the most selective of them (see knnc.SearchSpacesScanArgs.Subset),
+// instead of the whole namespace, which makes selective filters much cheaper.
+// Such requests always scan the raw vecs, i.e BackendPQ is not used, and
+// KNNArgs.Extent applies to the candidates of the index. Note that
+// Handle.KNNBatch does not use the index. No fields (or nil) removes the
+// index. The index is not kept in snapshots. Errors are:
+// - ErrHandleClosed if the ctx used when creating the Handle signalled done.
+// - ErrInvalidIndexField if any of the fields are empty.
+// - ErrUnknownNamespace if the namespace does not exist.
+func (h *Handle) SetMetadataIndex(ns string, fields []string) error {
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return ErrHandleClosed
+	default:
+	}
+
+	for _, field := range fields {
+		if field == "" {
+			return ErrInvalidIndexField
+		}
+	}
+	if len(fields) == 0 {
+		return h.knnNamespaces.setMetadataIndex(ns, nil)
+	}
+	return h.knnNamespaces.setMetadataIndex(ns, newMetadataIndex(fields))
+}
+
+// MetadataIndex returns the indexed metadata fields of a namespace (sorted),
+// see Handle.SetMetadataIndex. Returns false if the namespace does not exist.
+func (i *info) MetadataIndex(key string) ([]string, bool) {
+	nsItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return nil, false
+	}
+	if nsItem.metaIndex == nil {
+		return []string{}, true
+	}
+	return nsItem.metaIndex.fields(), true
+}
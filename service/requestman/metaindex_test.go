@@ -0,0 +1,122 @@
+package requestman
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestHandleMetadataIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newTestHandle(100, 100, ctx)
+	dim := 3
+	n := 1000
+	nRare := 10
+	for i := 0; i < n; i++ {
+		category := "common"
+		if i%(n/nRare) == 0 {
+			category = "rare"
+		}
+		v, _ := randFloat64Slice(dim)
+		dc := DistancerContainer{
+			D:        mathx.NewFloatVecWithID(v, fmt.Sprintf("%s-%d", category, i)),
+			Metadata: map[string]string{"category": category},
+		}
+		if !h.AddData("test", dc, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	args := newTestKNNArgs(dim, "test")
+	args.K = 5
+	args.Extent = 1
+	args.Accept = 2 // Never reached with cosine similarity.
+	args.Reject = -2
+	args.Stats = true
+
+	// query does a KNN request with the filter, returns the sorted IDs of the
+	// result and the number of scanned candidates.
+	query := func(filter map[string]string) ([]string, int) {
+		args.Filter = filter
+		enqueueResult, items, ok := h.KNNEager(args)
+		if !ok {
+			t.Fatal("got not-ok for a KNN request")
+		}
+		ids := make([]string, 0, len(items))
+		for _, item := range items.Trim() {
+			ids = append(ids, item.Distancer.(*mathx.FloatVec).ID())
+		}
+		sort.Strings(ids)
+		return ids, enqueueResult.Stats.Candidates
+	}
+
+	filter := map[string]string{"category": "rare"}
+	want, scanned := query(filter)
+	if scanned != n {
+		t.Fatalf("unexpected number of candidates without an index: %v", scanned)
+	}
+
+	if err := h.SetMetadataIndex("missing", []string{"category"}); err != ErrUnknownNamespace {
+		t.Fatalf("unexpected err for a missing namespace: %v", err)
+	}
+	if err := h.SetMetadataIndex("test", []string{""}); err != ErrInvalidIndexField {
+		t.Fatalf("unexpected err for an empty field: %v", err)
+	}
+	if err := h.SetMetadataIndex("test", []string{"category", "other"}); err != nil {
+		t.Fatalf("could not set index: %v", err)
+	}
+	if fields, _ := h.Info().MetadataIndex("test"); strings.Join(fields, ",") != "category,other" {
+		t.Fatalf("unexpected indexed fields: %v", fields)
+	}
+
+	// Same result, while only the matching vecs are scanned.
+	have, scanned := query(filter)
+	if scanned != nRare {
+		t.Fatalf("unexpected number of candidates with an index: %v", scanned)
+	}
+	if strings.Join(have, ",") != strings.Join(want, ",") || len(have) != args.K {
+		t.Fatalf("unexpected result with an index. want %v, have %v", want, have)
+	}
+	for _, id := range have {
+		if !strings.HasPrefix(id, "rare-") {
+			t.Fatalf("got a result with a non-matching category: %q", id)
+		}
+	}
+
+	// Unindexed fields scan everything.
+	if _, scanned := query(map[string]string{"unindexed": "x"}); scanned != n {
+		t.Fatalf("unexpected number of candidates for an unindexed field: %v", scanned)
+	}
+
+	// Data that is added later is indexed, deleted data is removed.
+	dc := DistancerContainer{
+		D:        mathx.NewFloatVecWithID([]float64{1, 2, 3}, "rare-new"),
+		Metadata: map[string]string{"category": "rare"},
+	}
+	if !h.AddData("test", dc, nil) {
+		t.Fatal("got not-ok when adding data")
+	}
+	if _, scanned := query(filter); scanned != nRare+1 {
+		t.Fatalf("unexpected number of candidates after add: %v", scanned)
+	}
+	h.DeleteWhere("test", func(id string, d mathx.Distancer, added time.Time) bool {
+		return id == "rare-new" || id == "rare-0"
+	})
+	if _, scanned := query(filter); scanned != nRare-1 {
+		t.Fatalf("unexpected number of candidates after delete: %v", scanned)
+	}
+
+	if err := h.SetMetadataIndex("test", nil); err != nil {
+		t.Fatalf("could not remove index: %v", err)
+	}
+	if _, scanned := query(filter); scanned != n-1 {
+		t.Fatalf("unexpected number of candidates after removing the index: %v", scanned)
+	}
+}
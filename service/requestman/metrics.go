@@ -0,0 +1,70 @@
+package requestman
+
+import (
+	"sync"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+/*
+File contains a package-level registry of custom distance functions (metrics),
+which can be used in KNN requests by name (see KNNArgs.Metric), as opposed to
+the built-in ones of the closed KNNMethod enum.
+*/
+
+// MetricFunc is a distance function which scores 'b' relative to 'a', where
+// 'a' is the query vec. The bool is whether the computation succeeded or not,
+// e.g false for vectors with mismatched dimensions.
+type MetricFunc func(a, b mathx.Distancer) (float64, bool)
+
+// metric is a registered MetricFunc, see RegisterMetric.
+type metric struct {
+	f              MetricFunc
+	higherIsBetter bool
+}
+
+// metrics is the registry used by RegisterMetric.
+var metrics = struct {
+	sync.RWMutex
+	items map[string]metric
+}{items: make(map[string]metric)}
+
+// RegisterMetric registers a distance func by name, such that it can be used
+// with KNNArgs.Metric. The higherIsBetter arg is a hint for the ordering of the
+// metric, e.g false for distances and true for similarities, which is used by
+// MetricAscending. Note that the registry is local to the process, so metrics
+// must be registered on all rpc nodes (pkg ops) that are expected to use them.
+// Returns false if the name is empty, f is nil or the name is already taken.
+func RegisterMetric(name string, f MetricFunc, higherIsBetter bool) bool {
+	if name == "" || f == nil {
+		return false
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if _, ok := metrics.items[name]; ok {
+		return false
+	}
+	metrics.items[name] = metric{f: f, higherIsBetter: higherIsBetter}
+	return true
+}
+
+// MetricAscending returns the KNNArgs.Ascending value which orders the results
+// from nearest to furthest for the registered metric with the given name, or
+// the opposite if furthest is true (same as KNNMethod.Ascending). The second
+// return is false if no metric is registered with the name.
+func MetricAscending(name string, furthest bool) (bool, bool) {
+	m, ok := lookupMetric(name)
+	if !ok {
+		return false, false
+	}
+	return !m.higherIsBetter != furthest, true
+}
+
+// lookupMetric returns a registered metric, see RegisterMetric.
+func lookupMetric(name string) (metric, bool) {
+	metrics.RLock()
+	defer metrics.RUnlock()
+	m, ok := metrics.items[name]
+	return m, ok
+}
@@ -0,0 +1,62 @@
+package requestman
+
+import "github.com/crunchypi/ddrop/pkg/knnc"
+
+/*
+File contains KNN middleware, i.e an extension point for observing or changing
+KNN requests (e.g for auth, quotas or metrics) without changing Handle.KNN. It
+also contains PostProcessor, which is the same for the results of KNN requests.
+*/
+
+// KNNFunc has the signature of Handle.KNN, see KNNMiddleware.
+type KNNFunc func(args KNNArgs) (KNNEnqueueResult, bool)
+
+// KNNMiddleware wraps a KNNFunc, such that it can act before and/or after the
+// next KNNFunc in the chain (see NewHandleArgs.KNNMiddleware). It can change the
+// args, the results, or not call next at all, e.g to reject a request. For
+// example, a middleware that rejects requests for a namespace:
+//
+//	func(next KNNFunc) KNNFunc {
+//		return func(args KNNArgs) (KNNEnqueueResult, bool) {
+//			if args.Namespace == "blocked" {
+//				return KNNEnqueueResult{}, false
+//			}
+//			return next(args)
+//		}
+//	}
+type KNNMiddleware func(next KNNFunc) KNNFunc
+
+// chainKNNMiddleware wraps the given KNNFunc with all middleware, such that the
+// first middleware is the outermost, i.e it is called first.
+func chainKNNMiddleware(f KNNFunc, middleware []KNNMiddleware) KNNFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		f = middleware[i](f)
+	}
+	return f
+}
+
+// PostProcessor changes the final result of a KNN request, e.g for business
+// rules that can't be expressed as a distance metric (such as excluding some
+// items, or boosting others), see NewHandleArgs.PostProcessor. It is called
+// after the result is merged, right before it is sent through
+// KNNEnqueueResult.Pipe.
+//
+// 'items' contains only set items, ordered by score (see KNNArgs.Ascending).
+// The IDs of items are available through ScoreItem.Distancer, if it has an
+// ID() string method (e.g mathx.FloatVec). The returned ScoreItems are sent
+// as-is, so they can be re-ordered, shorter or longer than 'items'. It is
+// called concurrently, so it must be safe for that.
+type PostProcessor func(args KNNArgs, items knnc.ScoreItems) knnc.ScoreItems
+
+// postProcess applies the PostProcessor of knnRequest to 'result', if it is
+// set. Unset items (at the end of 'result') are not passed on.
+func (r *knnRequest) postProcess(result knnc.ScoreItems) knnc.ScoreItems {
+	if r.postProcessor == nil {
+		return result
+	}
+	n := 0
+	for n < len(result) && result[n].Set {
+		n++
+	}
+	return r.postProcessor(*r.args, result[:n])
+}
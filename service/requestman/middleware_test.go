@@ -0,0 +1,116 @@
+package requestman
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestHandleKNNMiddleware(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Counts invocations, and records the order of middleware calls.
+	var calls []string
+	counter := func(next KNNFunc) KNNFunc {
+		return func(args KNNArgs) (KNNEnqueueResult, bool) {
+			calls = append(calls, "counter")
+			return next(args)
+		}
+	}
+	blocker := func(next KNNFunc) KNNFunc {
+		return func(args KNNArgs) (KNNEnqueueResult, bool) {
+			calls = append(calls, "blocker")
+			if args.Namespace == "blocked" {
+				return KNNEnqueueResult{}, false
+			}
+			return next(args)
+		}
+	}
+
+	h := newTestHandle(100, 100, ctx)
+	h.knn = chainKNNMiddleware(h.knnCore, []KNNMiddleware{counter, blocker})
+
+	dim := 3
+	for _, ns := range []string{"open", "blocked"} {
+		v, _ := randFloat64Slice(dim)
+		if !h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	r, ok := h.KNN(newTestKNNArgs(dim, "open"))
+	if !ok {
+		t.Fatal("got not-ok for a namespace which is not blocked")
+	}
+	for range r.Pipe {
+	}
+	if _, ok := h.KNN(newTestKNNArgs(dim, "blocked")); ok {
+		t.Fatal("got ok for a blocked namespace")
+	}
+
+	want := "[counter blocker counter blocker]"
+	if fmt.Sprint(calls) != want {
+		t.Fatalf("want calls %v, have %v", want, calls)
+	}
+}
+
+func TestHandlePostProcessor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Removes 'id2' and reverses the order.
+	postProcessor := func(args KNNArgs, items knnc.ScoreItems) knnc.ScoreItems {
+		r := make(knnc.ScoreItems, 0, len(items))
+		for i := len(items) - 1; i >= 0; i-- {
+			if !items[i].Set {
+				t.Error("post processor got an unset item")
+			}
+			if items[i].Distancer.(*mathx.FloatVec).ID() != "id2" {
+				r = append(r, items[i])
+			}
+		}
+		return r
+	}
+
+	h := newTestHandle(100, 100, ctx)
+	h.knnQueue.postProcessor = postProcessor
+
+	for i := 0; i < 10; i++ {
+		dc := DistancerContainer{D: mathx.NewFloatVecWithID([]float64{float64(i)}, fmt.Sprint("id", i))}
+		if !h.AddData("test", dc, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	r, ok := h.KNN(KNNArgs{
+		Namespace: "test",
+		Priority:  1,
+		QueryVec:  []float64{0},
+		KNNMethod: KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         5,
+		Extent:    1,
+		Accept:    0,
+		Reject:    100,
+		TTL:       time.Minute,
+	})
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+
+	var ids []string
+	for items := range r.Pipe {
+		for _, item := range items {
+			ids = append(ids, item.Distancer.(*mathx.FloatVec).ID())
+		}
+	}
+	want := "[id4 id3 id1 id0]"
+	if fmt.Sprint(ids) != want {
+		t.Fatalf("want ids %v, have %v", want, ids)
+	}
+}
@@ -3,10 +3,12 @@ package requestman
 import (
 	"context"
 	"math"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/crunchypi/ddrop/pkg/knnc"
+	"github.com/crunchypi/ddrop/pkg/timex"
 )
 
 /*
@@ -125,7 +127,20 @@ type timedLinkedList[T any] struct {
 	// MinChainLinkSize represents the min time delta between any link.
 	// This linked list impl operates on the principle that each link
 	// represents a discrete timeframe, this field specifies that window.
+	// Links start at multiples of it (see time.Time.Truncate), such that
+	// the boundaries only depend on the clock.
 	minChainLinkSize time.Duration
+	// clock is used for the creation time of new links, nil means the real
+	// time. See timex.NewLatencyTrackerArgs.Clock.
+	clock timex.Clock
+}
+
+// now returns the current time of tll.clock, or time.Now() if it is nil.
+func (tll *timedLinkedList[T]) now() time.Time {
+	if tll.clock == nil {
+		return time.Now()
+	}
+	return tll.clock.Now()
 }
 
 // Inner exposes the inner linked list.
@@ -136,21 +151,21 @@ func (tll *timedLinkedList[T]) Inner() *linkedList[timed[T]] {
 // maintain does maintenance in order to make the instance state true to the
 // configurations. Specifically, it
 // - Adds a new head if current head is nil.
-// - Adds a new head (moving the old one) if delta time between now and
-//   creation time of old head is greater than tll.minChainLinkSize.
+// - Adds a new head (moving the old one) if now is past the timeframe of
+//   the old head, i.e [created, created+tll.minChainLinkSize).
 // - Trims the tail such that n links does not exceed tll.maxChainLinkN
 func (tll *timedLinkedList[T]) maintain() {
-	now := time.Now()
+	// Start of the timeframe which covers now.
+	start := tll.now().Truncate(tll.minChainLinkSize)
 	// Handle nil head.
 	if tll.inner.head == nil {
-		tll.inner.add(timed[T]{created: now})
+		tll.inner.add(timed[T]{created: start})
 	}
 
 	// Handle expired head.
-	headDelta := now.Sub(tll.inner.head.payload.created)
-	if headDelta > tll.minChainLinkSize {
+	if start.After(tll.inner.head.payload.created) {
 		newHead := linkedListItem[timed[T]]{}
-		newHead.payload.created = now
+		newHead.payload.created = start
 		newHead.next = tll.inner.head
 		tll.inner.head = &newHead
 	}
@@ -196,6 +211,14 @@ func (tll *timedLinkedList[T]) timeRange(start, end time.Time) []timed[T] {
 	return result
 }
 
+// withinBounds returns true if the period between 'start' and 'end' (same as
+// for tll.timeRange) fits within the window retained by this instance, i.e
+// tll.maxChainLinkN * tll.minChainLinkSize.
+func (tll *timedLinkedList[T]) withinBounds(start, end time.Time) bool {
+	maxDuration := tll.minChainLinkSize * time.Duration(tll.maxChainLinkN)
+	return start.Sub(end) <= maxDuration
+}
+
 /*
 --------------------------------------------------------------------------------
 Monitor impl starts here.
@@ -209,6 +232,36 @@ type knnMonItem struct {
 	Satisfaction float64
 }
 
+// KNNMonSatisfactionHist is a histogram of satisfaction ratios (got n / want n)
+// for a group of KNN requests, i.e the distribution behind an average such as
+// KNNMonItemAvg.AvgSatisfaction. The buckets are:
+//  [0]: [0.00, 0.25)
+//  [1]: [0.25, 0.50)
+//  [2]: [0.50, 0.75)
+//  [3]: [0.75, 1.00)
+//  [4]: 1.00 (or more), i.e fully satisfied.
+type KNNMonSatisfactionHist [5]int
+
+// knnMonSatisfactionBucket returns the KNNMonSatisfactionHist index for the
+// given satisfaction ratio. Ratios outside of [0, 1] go into the first/last.
+func knnMonSatisfactionBucket(satisfaction float64) int {
+	last := len(KNNMonSatisfactionHist{}) - 1
+	if satisfaction >= 1 {
+		return last
+	}
+	if satisfaction <= 0 || math.IsNaN(satisfaction) {
+		return 0
+	}
+	return int(satisfaction * float64(last))
+}
+
+// add merges 'other' into this instance, i.e adds the counts of each bucket.
+func (h *KNNMonSatisfactionHist) add(other KNNMonSatisfactionHist) {
+	for i := range h {
+		h[i] += other[i]
+	}
+}
+
 // KNNMonItemAvg captures stats for a group of KNN requests over a period.
 type KNNMonItemAvg struct {
 	isSet   bool
@@ -221,6 +274,15 @@ type KNNMonItemAvg struct {
 	AvgScore        float64       // Average score for all requests.
 	AvgScoreNoFails float64       // Same as AvgScore but without fails.
 	AvgSatisfaction float64       // Success ratio (got n / want n).
+
+	// SatisfactionHist is the distribution of success ratios, which shows
+	// e.g whether most requests got exactly K results or many got far fewer.
+	SatisfactionHist KNNMonSatisfactionHist
+
+	// BoundsOk is false if the requested period exceeds what is retained,
+	// i.e the result might cover a shorter period than requested. Only set
+	// by the monitor when reading averages.
+	BoundsOk bool
 }
 
 // mergeKNNMonItem merges a knnMonItem in such a way that averages are maintained.
@@ -249,12 +311,14 @@ func (ia *KNNMonItemAvg) mergeKNNMonItem(i knnMonItem) {
 	ia.AvgScore = (totalScore + i.AvgScore) / n
 	ia.AvgScoreNoFails = (totalScore + i.AvgScore) / (n - float64(ia.NFailed) + c)
 	ia.AvgSatisfaction = (totalSatisfaction + i.Satisfaction) / n
+	ia.SatisfactionHist[knnMonSatisfactionBucket(i.Satisfaction)]++
 }
 
 // mergeKNNMonItemAvg merges another KNNMonItemAvg instance with this instance,
 // only 'this' is changed. The merging is done as follows:
 // - this.Created is set to be the oldest.
 // - other.N is added to this.N.
+// - other.SatisfactionHist is added to this.SatisfactionHist (per bucket).
 // - All other field pairs are simply added, divided by 2, then set to this.
 func (ia *KNNMonItemAvg) mergeKNNMonItemAvg(other *KNNMonItemAvg) {
 	if !ia.isSet {
@@ -277,6 +341,18 @@ func (ia *KNNMonItemAvg) mergeKNNMonItemAvg(other *KNNMonItemAvg) {
 	ia.AvgScore = (ia.AvgScore + other.AvgScore) / 2
 	ia.AvgScoreNoFails = (ia.AvgScoreNoFails + other.AvgScoreNoFails) / 2
 	ia.AvgSatisfaction = (ia.AvgSatisfaction + other.AvgSatisfaction) / 2
+	ia.SatisfactionHist.add(other.SatisfactionHist)
+}
+
+// scale multiplies the count fields (N, NFailed and SatisfactionHist) with f,
+// such that a sample of requests gives an estimate of the total. Averages are
+// left as is, as they are representative of the total with uniform sampling.
+func (ia *KNNMonItemAvg) scale(f float64) {
+	ia.N = int(math.Round(float64(ia.N) * f))
+	ia.NFailed = int(math.Round(float64(ia.NFailed) * f))
+	for i := range ia.SatisfactionHist {
+		ia.SatisfactionHist[i] = int(math.Round(float64(ia.SatisfactionHist[i]) * f))
+	}
 }
 
 // knnMonitor is intended for monitoring KNN requests in this pkg. It operates
@@ -299,29 +375,69 @@ func (ia *KNNMonItemAvg) mergeKNNMonItemAvg(other *KNNMonItemAvg) {
 // - Internal request processing gets A, requester gets B.
 // - Read with knnMonitor.average(...)
 //
+// Entries are tracked both in aggregate (all namespaces) and per namespace,
+// since namespaces can have very different score distributions.
+//
 // Note; thread safe.
 type knnMonitor struct {
-	mx       sync.Mutex
+	mx sync.Mutex
+	// averages tracks all namespaces, and is also used as the template for
+	// the linked lists in 'namespaces' (i.e their maxChainLinkN etc).
 	averages *timedLinkedList[KNNMonItemAvg]
+	// namespaces tracks each namespace separately. Lazily set up.
+	namespaces map[string]*timedLinkedList[KNNMonItemAvg]
+	// sampleRate is the fraction of requests that are actually monitored by
+	// knnMonitor.register, see NewHandleArgs.MonitorSampleRate. Counts are
+	// scaled up by the inverse when read. Values <= 0 are treated as 1.
+	sampleRate float64
 }
 
-// registerMonItem merges a knnMonItem into the head of the internal linked list.
-func (m *knnMonitor) registerMonItem(item knnMonItem) {
-	m.mx.Lock()
-	defer m.mx.Unlock()
+// KNNMonitorAllNamespaces can be used as the namespace when reading monitoring
+// data (e.g Handle.Info().KNNMonitor) in order to get the aggregate for all
+// namespaces.
+const KNNMonitorAllNamespaces = ""
 
+// registerMonItemInto merges a knnMonItem into the head of the given linked list.
+func registerMonItemInto(tll *timedLinkedList[KNNMonItemAvg], item knnMonItem) {
 	// Garantee head.
-	m.averages.maintain()
-	monItem := &m.averages.inner.head.payload.inner
+	tll.maintain()
+	monItem := &tll.inner.head.payload.inner
 	if !monItem.isSet {
 		monItem.isSet = true
-		monItem.Created = m.averages.inner.head.payload.created
-		monItem.Span = m.averages.minChainLinkSize
+		monItem.Created = tll.inner.head.payload.created
+		monItem.Span = tll.minChainLinkSize
 	}
 
 	monItem.mergeKNNMonItem(item)
 }
 
+// registerMonItem merges a knnMonItem into the head of the internal linked list
+// for all namespaces, as well as the one for the given namespace. The latter
+// is skipped for KNNMonitorAllNamespaces, as that is only the aggregate.
+func (m *knnMonitor) registerMonItem(ns string, item knnMonItem) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	registerMonItemInto(m.averages, item)
+	if ns == KNNMonitorAllNamespaces {
+		return
+	}
+
+	if m.namespaces == nil {
+		m.namespaces = make(map[string]*timedLinkedList[KNNMonItemAvg])
+	}
+	tll, ok := m.namespaces[ns]
+	if !ok {
+		tll = &timedLinkedList[KNNMonItemAvg]{
+			maxChainLinkN:    m.averages.maxChainLinkN,
+			minChainLinkSize: m.averages.minChainLinkSize,
+			clock:            m.averages.clock,
+		}
+		m.namespaces[ns] = tll
+	}
+	registerMonItemInto(tll, item)
+}
+
 // average merges together all internal KNNMonItemAvg in the given period,
 // then returns the result. Note that 'start' should be _after_ 'end', this
 // might be counter-intuitive. The reason being that the underlying linked
@@ -332,14 +448,29 @@ func (m *knnMonitor) registerMonItem(item knnMonItem) {
 //  now := time.Now()
 //  x.timeRange(now, now.Add(-time.Minute))
 //
+// The BoundsOk field of the returned value is false if the given period is
+// longer than the retained window (maxChainLinkN * minChainLinkSize).
+//
+// The average is for the given namespace 'ns', or for all namespaces if it is
+// KNNMonitorAllNamespaces. An unknown namespace gives an unset (zero) result.
+//
 // Note; thread safe.
-func (m *knnMonitor) average(start, end time.Time) KNNMonItemAvg {
+func (m *knnMonitor) average(ns string, start, end time.Time) KNNMonItemAvg {
 	m.mx.Lock()
 	defer m.mx.Unlock()
 
-	items := m.averages.timeRange(start, end)
+	tll := m.averages
+	if ns != KNNMonitorAllNamespaces {
+		nsTLL, ok := m.namespaces[ns]
+		if !ok {
+			return KNNMonItemAvg{BoundsOk: m.averages.withinBounds(start, end)}
+		}
+		tll = nsTLL
+	}
+
+	items := tll.timeRange(start, end)
 	if len(items) == 0 {
-		return KNNMonItemAvg{}
+		return KNNMonItemAvg{BoundsOk: tll.withinBounds(start, end)}
 	}
 
 	result := items[0].inner
@@ -351,13 +482,64 @@ func (m *knnMonitor) average(start, end time.Time) KNNMonItemAvg {
 		result.mergeKNNMonItemAvg(&itemAvg.inner)
 	}
 
-	m.averages.maintain()
+	tll.maintain()
+	result.BoundsOk = tll.withinBounds(start, end)
+	m.scale(&result)
+	return result
+}
+
+// scale does KNNMonItemAvg.scale with the inverse of knnMonitor.sampleRate, if
+// sampling is used. Note that this is not mutex protected.
+func (m *knnMonitor) scale(item *KNNMonItemAvg) {
+	if m.sampleRate > 0 && m.sampleRate < 1 {
+		item.scale(1 / m.sampleRate)
+	}
+}
+
+// sampled returns true if a request should be monitored, according to
+// knnMonitor.sampleRate.
+func (m *knnMonitor) sampled() bool {
+	return m.sampleRate <= 0 || m.sampleRate >= 1 || rand.Float64() < m.sampleRate
+}
+
+// series is the same as knnMonitor.average, except that the KNNMonItemAvg of
+// each link (i.e time bucket, see timedLinkedList) in the given period is
+// returned separately, in chronological order (oldest first). Buckets without
+// any requests are left out. The BoundsOk field is set for all of them.
+//
+// Note; thread safe.
+func (m *knnMonitor) series(ns string, start, end time.Time) []KNNMonItemAvg {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	tll := m.averages
+	if ns != KNNMonitorAllNamespaces {
+		nsTLL, ok := m.namespaces[ns]
+		if !ok {
+			return []KNNMonItemAvg{}
+		}
+		tll = nsTLL
+	}
+
+	items := tll.timeRange(start, end)
+	boundsOk := tll.withinBounds(start, end)
+	result := make([]KNNMonItemAvg, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		if !items[i].inner.isSet {
+			continue
+		}
+		item := items[i].inner
+		item.BoundsOk = boundsOk
+		m.scale(&item)
+		result = append(result, item)
+	}
 	return result
 }
 
 // knnMonitorRegisterArgs is intended as args for knnMonitor.register(...).
 type knnMonitorRegisterArgs struct {
 	knnEnqueueResult KNNEnqueueResult // What to listen for.
+	namespace        string           // Namespace of the KNN request.
 	k                int              // Number of excepted KNN request results.
 	ttl              time.Duration    // Listen deadline (mitigate leaks).
 }
@@ -372,11 +554,19 @@ type knnMonitorRegisterArgs struct {
 // - Put that KNNEnqueueResult (A) here, another (B) is returned.
 // - Internal request processing gets A, requester gets B.
 //
+// A is returned as is (i.e not monitored) if the request is not sampled, see
+// knnMonitor.sampleRate.
+//
 // Note; thread safe.
 func (m *knnMonitor) register(args knnMonitorRegisterArgs) KNNEnqueueResult {
+	if !m.sampled() {
+		return args.knnEnqueueResult
+	}
+
 	out := KNNEnqueueResult{
 		Pipe:   make(chan knnc.ScoreItems, cap(args.knnEnqueueResult.Pipe)),
 		Cancel: args.knnEnqueueResult.Cancel,
+		Stats:  args.knnEnqueueResult.Stats,
 	}
 
 	// Leak prevention.
@@ -389,7 +579,7 @@ func (m *knnMonitor) register(args knnMonitorRegisterArgs) KNNEnqueueResult {
 		defer close(out.Pipe)
 		defer ctxCancel()
 
-		stamp := time.Now()
+		stamp := m.averages.now()
 		// Rcv safely with timeout.
 		safeChanIter(safeChanIterArgs[knnc.ScoreItems]{
 			ch:  args.knnEnqueueResult.Pipe,
@@ -403,30 +593,10 @@ func (m *knnMonitor) register(args knnMonitorRegisterArgs) KNNEnqueueResult {
 				})
 				// Update stamp on all exit paths.
 				defer func() {
-					stamp = time.Now()
+					stamp = m.averages.now()
 				}()
 
-				delta := time.Now().Sub(stamp)
-				scoreItems = scoreItems.Trim()
-
-				// Guard zero div.
-				if len(scoreItems) == 0 {
-					m.registerMonItem(knnMonItem{Latency: delta})
-					return true
-				}
-
-				// Total -> average.
-				totalScore := 0.
-				for _, scoreItem := range scoreItems {
-					totalScore += scoreItem.Score
-				}
-
-				m.registerMonItem(knnMonItem{
-					Latency:      delta,
-					AvgScore:     totalScore / float64(len(scoreItems)),
-					Satisfaction: float64(len(scoreItems)) / float64(args.k),
-				})
-
+				m.record(args.namespace, scoreItems, args.k, m.averages.now().Sub(stamp))
 				return true
 			},
 		})
@@ -434,3 +604,42 @@ func (m *knnMonitor) register(args knnMonitorRegisterArgs) KNNEnqueueResult {
 
 	return out
 }
+
+// observe registers the result of a KNN request directly, as opposed to
+// knnMonitor.register which puts a listener (i.e a goroutine) on the result
+// pipe. This is intended for callers that consume the result synchronously,
+// e.g Handle.KNNEager. The request is skipped if it is not sampled, see
+// knnMonitor.sampleRate.
+//
+// Note; thread safe.
+func (m *knnMonitor) observe(ns string, scoreItems knnc.ScoreItems, k int, latency time.Duration) {
+	if m.sampled() {
+		m.record(ns, scoreItems, k, latency)
+	}
+}
+
+// record converts the result of a KNN request (wanting k items) into a
+// knnMonItem, then registers it with knnMonitor.registerMonItem.
+//
+// Note; thread safe.
+func (m *knnMonitor) record(ns string, scoreItems knnc.ScoreItems, k int, latency time.Duration) {
+	scoreItems = scoreItems.Trim()
+
+	// Guard zero div.
+	if len(scoreItems) == 0 {
+		m.registerMonItem(ns, knnMonItem{Latency: latency})
+		return
+	}
+
+	// Total -> average.
+	totalScore := 0.
+	for _, scoreItem := range scoreItems {
+		totalScore += scoreItem.Score
+	}
+
+	m.registerMonItem(ns, knnMonItem{
+		Latency:      latency,
+		AvgScore:     totalScore / float64(len(scoreItems)),
+		Satisfaction: float64(len(scoreItems)) / float64(k),
+	})
+}
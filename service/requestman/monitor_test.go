@@ -1,6 +1,7 @@
 package requestman
 
 import (
+	"math"
 	"math/rand"
 	"runtime"
 	"sync"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/crunchypi/ddrop/pkg/knnc"
 	"github.com/crunchypi/ddrop/pkg/mathx"
+	"github.com/crunchypi/ddrop/pkg/timex"
 )
 
 func init() {
@@ -136,10 +138,13 @@ func TestTLLMaintain(t *testing.T) {
 	maxN := 10
 	minD := time.Millisecond * 10
 
+	// Starts at a link boundary, see timedLinkedList.minChainLinkSize.
+	clock := timex.NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
 	tll := timedLinkedList[int]{
 		inner:            linkedList[timed[int]]{},
 		maxChainLinkN:    maxN,
 		minChainLinkSize: minD,
+		clock:            clock,
 	}
 
 	// Setting head.
@@ -148,8 +153,15 @@ func TestTLLMaintain(t *testing.T) {
 		t.Fatal("didn't set head")
 	}
 
+	// Not a new head, as the link size is not exceeded.
+	clock.Advance(minD - time.Nanosecond)
+	tll.maintain()
+	if tll.Inner().len() != 1 {
+		t.Fatal("added to head too early")
+	}
+
 	// New head, so len must be 2.
-	time.Sleep(minD)
+	clock.Advance(time.Nanosecond)
 	tll.maintain()
 	if tll.Inner().len() != 2 {
 		t.Fatal("could not add to head")
@@ -158,7 +170,7 @@ func TestTLLMaintain(t *testing.T) {
 	// Add many, but excess should be trimmed.
 	for i := 0; i < maxN*2; i++ {
 		tll.maintain()
-		time.Sleep(minD)
+		clock.Advance(minD * 2)
 	}
 
 	if tll.Inner().len() != maxN {
@@ -296,6 +308,62 @@ func TestMonItemAvgMergeKNNMonItemAvg(t *testing.T) {
 		s := "unexpected AvgSatisfaction field val; want %v, got %v\n"
 		t.Fatalf(s, kmiaExpect.AvgSatisfaction, kmiaCombo.AvgSatisfaction)
 	}
+
+	if kmiaCombo.SatisfactionHist != kmiaExpect.SatisfactionHist {
+		s := "unexpected SatisfactionHist field val; want %v, got %v\n"
+		t.Fatalf(s, kmiaExpect.SatisfactionHist, kmiaCombo.SatisfactionHist)
+	}
+}
+
+func TestMonitorSatisfactionHist(t *testing.T) {
+	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    10,
+		minChainLinkSize: time.Second,
+	}}
+
+	// Got n results per request, all with want n (k) = 4. Buckets are in
+	// quarters (and the last is for exactly k), see want below.
+	k := 4
+	for _, got := range []int{0, 1, 2, 2, 3, 3, 4} {
+		enqR := KNNEnqueueResult{
+			Pipe:   make(chan knnc.ScoreItems, 1),
+			Cancel: knnc.NewCancelSignal(),
+		}
+		monEnqR := monitor.register(knnMonitorRegisterArgs{
+			knnEnqueueResult: enqR,
+			k:                k,
+			ttl:              time.Second,
+		})
+		scoreItems := make(knnc.ScoreItems, k)
+		for i := 0; i < got; i++ {
+			scoreItems[i] = knnc.ScoreItem{Set: true, Score: 1}
+		}
+		enqR.Pipe <- scoreItems
+		close(enqR.Pipe)
+		for range monEnqR.Pipe {
+		}
+	}
+
+	now := time.Now()
+	r := monitor.average(KNNMonitorAllNamespaces, now, now.Add(-time.Second*5))
+	want := KNNMonSatisfactionHist{1, 1, 2, 2, 1}
+	if r.SatisfactionHist != want {
+		t.Fatalf("unexpected histogram; want %v, have %v", want, r.SatisfactionHist)
+	}
+
+	// Edge cases of the bucket func.
+	for satisfaction, want := range map[float64]int{
+		-1:     0,
+		0.2499: 0,
+		0.25:   1,
+		0.9999: 3,
+		1:      4,
+		2:      4,
+	} {
+		if have := knnMonSatisfactionBucket(satisfaction); have != want {
+			t.Fatalf("satisfaction %v: want bucket %v, have %v", satisfaction, want, have)
+		}
+	}
 }
 
 func TestMonitorAveragePrecice(t *testing.T) {
@@ -311,15 +379,15 @@ func TestMonitorAveragePrecice(t *testing.T) {
 	}}
 
 	// ll layout, starting with head:  [kmi2]-[kmi1]-[kmi1x2]
-	monitor.registerMonItem(kmi1)
-	monitor.registerMonItem(kmi1)
+	monitor.registerMonItem(KNNMonitorAllNamespaces, kmi1)
+	monitor.registerMonItem(KNNMonitorAllNamespaces, kmi1)
 	time.Sleep(d)
-	monitor.registerMonItem(kmi1)
+	monitor.registerMonItem(KNNMonitorAllNamespaces, kmi1)
 	time.Sleep(d)
-	monitor.registerMonItem(kmi2)
+	monitor.registerMonItem(KNNMonitorAllNamespaces, kmi2)
 
 	// All nodes.
-	r := monitor.average(testStarted, testStarted.Add(-time.Hour))
+	r := monitor.average(KNNMonitorAllNamespaces, testStarted, testStarted.Add(-time.Hour))
 	// Note, not checking all stats, that is done in one of the tests above,
 	// related to KNNMonItemAvg.
 	if r.N != 4 {
@@ -330,7 +398,7 @@ func TestMonitorAveragePrecice(t *testing.T) {
 	}
 
 	// 2/3 nodes in the linked list (so kmi1+kmi2) and take their average.
-	r = monitor.average(testStarted, testStarted.Add(-d*2))
+	r = monitor.average(KNNMonitorAllNamespaces, testStarted, testStarted.Add(-d*2))
 	if r.N != 2 {
 		t.Fatal("unexpected N field val:", r.N)
 	}
@@ -339,6 +407,267 @@ func TestMonitorAveragePrecice(t *testing.T) {
 	}
 }
 
+func TestMonitorSeries(t *testing.T) {
+	d := time.Millisecond * 100
+	testStarted := time.Now()
+	clock := timex.NewManualClock(testStarted)
+
+	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    10,
+		minChainLinkSize: d,
+		clock:            clock,
+	}}
+
+	// ll layout, starting with head:  [kmi2]-[kmi1x2]
+	kmi1 := knnMonItem{Latency: 1, AvgScore: 0.0, Satisfaction: 1}
+	kmi2 := knnMonItem{Latency: 1, AvgScore: 0.5, Satisfaction: 1}
+	monitor.registerMonItem("ns", kmi1)
+	monitor.registerMonItem("ns", kmi1)
+	clock.Advance(d * 2)
+	monitor.registerMonItem("ns", kmi2)
+
+	for _, ns := range []string{KNNMonitorAllNamespaces, "ns"} {
+		r := monitor.series(ns, clock.Now(), testStarted.Add(-time.Hour))
+		if len(r) != 2 {
+			t.Fatalf("namespace %q: unexpected series len: %v", ns, len(r))
+		}
+		// Oldest first.
+		if r[0].N != 2 || r[0].AvgScore != 0 || r[1].N != 1 || r[1].AvgScore != 0.5 {
+			t.Fatalf("namespace %q: unexpected series: %+v", ns, r)
+		}
+		if !r[0].Created.Before(r[1].Created) {
+			t.Fatalf("namespace %q: series not in chronological order", ns)
+		}
+		if r[0].BoundsOk {
+			t.Fatalf("namespace %q: unexpected BoundsOk=true", ns)
+		}
+	}
+
+	if r := monitor.series("unknown", clock.Now(), testStarted); len(r) != 0 {
+		t.Fatalf("unexpected series for unknown namespace: %+v", r)
+	}
+}
+
+// Tests time bucket rollover and averages with a manual clock, i.e without
+// any sleeping.
+func TestMonitorManualClock(t *testing.T) {
+	d := time.Second
+	clock := timex.NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    5,
+		minChainLinkSize: d,
+		clock:            clock,
+	}}
+	ns := KNNMonitorAllNamespaces
+
+	// ll layout, starting with head:  [kmi2x2]-[kmi1]
+	kmi1 := knnMonItem{Latency: time.Millisecond, AvgScore: 0, Satisfaction: 1}
+	kmi2 := knnMonItem{Latency: time.Millisecond * 4, AvgScore: 1, Satisfaction: 1}
+	monitor.registerMonItem(ns, kmi1)
+	clock.Advance(d / 2)
+	if n := monitor.averages.Inner().len(); n != 1 {
+		t.Fatalf("unexpected rollover before the bucket size: %v buckets", n)
+	}
+	clock.Advance(d)
+	monitor.registerMonItem(ns, kmi2)
+	monitor.registerMonItem(ns, kmi2)
+	if n := monitor.averages.Inner().len(); n != 2 {
+		t.Fatalf("unexpected number of buckets after rollover: %v", n)
+	}
+
+	now := clock.Now()
+	r := monitor.average(ns, now, now.Add(-d))
+	if r.N != 2 || r.AvgScore != 1 || r.AvgLatency != time.Millisecond*4 {
+		t.Fatalf("unexpected average of the last bucket: %+v", r)
+	}
+	r = monitor.average(ns, now, now.Add(-d*3))
+	if r.N != 3 || r.AvgScore != 0.5 || !r.BoundsOk {
+		t.Fatalf("unexpected average of all buckets: %+v", r)
+	}
+	if !r.Created.Equal(now.Add(-d * 3 / 2)) {
+		t.Fatalf("unexpected creation time of the oldest bucket: %v", r.Created)
+	}
+
+	// Much later, only the new bucket is within the period.
+	clock.Advance(d * 10)
+	monitor.registerMonItem(ns, kmi1)
+	now = clock.Now()
+	if r := monitor.average(ns, now, now.Add(-d*2)); r.N != 1 || r.AvgScore != 0 {
+		t.Fatalf("unexpected average after a long pause: %+v", r)
+	}
+	if r := monitor.average(ns, now, now.Add(-d*20)); r.N != 4 || r.BoundsOk {
+		t.Fatalf("unexpected average for a period beyond the window: %+v", r)
+	}
+}
+
+// Tests that buckets start at multiples of the bucket size, such that a fixed
+// sequence of requests under a manual clock always gives the same buckets.
+func TestMonitorBucketBoundaries(t *testing.T) {
+	d := time.Millisecond * 100
+	epoch := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := timex.NewManualClock(epoch)
+	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    10,
+		minChainLinkSize: d,
+		clock:            clock,
+	}}
+	ns := KNNMonitorAllNamespaces
+
+	// Offsets (in ms) from epoch of each request.
+	kmi := knnMonItem{Latency: time.Millisecond, AvgScore: 1, Satisfaction: 1}
+	for _, offset := range []int{50, 99, 100, 150, 199, 420, 430} {
+		clock.Set(epoch.Add(time.Millisecond * time.Duration(offset)))
+		monitor.registerMonItem(ns, kmi)
+	}
+
+	// Oldest first.
+	wantCreated := []time.Time{epoch, epoch.Add(d), epoch.Add(d * 4)}
+	wantN := []int{2, 3, 2}
+	r := monitor.series(ns, clock.Now(), epoch.Add(-d))
+	if len(r) != len(wantN) {
+		t.Fatalf("unexpected number of buckets; want %v, have %v", len(wantN), len(r))
+	}
+	for i := range wantN {
+		if !r[i].Created.Equal(wantCreated[i]) || r[i].N != wantN[i] {
+			s := "bucket %v: want created %v with N %v, have %v with N %v"
+			t.Fatalf(s, i, wantCreated[i], wantN[i], r[i].Created, r[i].N)
+		}
+	}
+}
+
+func TestMonitorAverageBoundsOk(t *testing.T) {
+	d := time.Millisecond * 100
+	maxN := 10
+
+	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    maxN,
+		minChainLinkSize: d,
+	}}
+	item := knnMonItem{Latency: 1, AvgScore: 1, Satisfaction: 1}
+	monitor.registerMonItem(KNNMonitorAllNamespaces, item)
+
+	ns := KNNMonitorAllNamespaces
+	now := time.Now()
+	// Exactly the retained window.
+	if r := monitor.average(ns, now, now.Add(-d*time.Duration(maxN))); !r.BoundsOk {
+		t.Fatal("unexpected BoundsOk=false for a period within the retained window")
+	}
+	// Longer than MaxN*MinStep.
+	if r := monitor.average(ns, now, now.Add(-d*time.Duration(maxN+1))); r.BoundsOk {
+		t.Fatal("unexpected BoundsOk=true for a period longer than the retained window")
+	}
+
+	// Same for the empty case.
+	monitor = knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    maxN,
+		minChainLinkSize: d,
+	}}
+	if r := monitor.average(ns, now, now.Add(-time.Hour)); r.BoundsOk {
+		t.Fatal("unexpected BoundsOk=true for an empty monitor and a long period")
+	}
+}
+
+func TestMonitorNamespaces(t *testing.T) {
+	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
+		maxChainLinkN:    10,
+		minChainLinkSize: time.Second,
+	}}
+
+	// Namespace -> score of each result.
+	scores := map[string]float64{"a": 0.1, "b": 0.9}
+	for ns, score := range scores {
+		for i := 0; i < 3; i++ {
+			enqR := KNNEnqueueResult{
+				Pipe:   make(chan knnc.ScoreItems, 1),
+				Cancel: knnc.NewCancelSignal(),
+			}
+			monEnqR := monitor.register(knnMonitorRegisterArgs{
+				knnEnqueueResult: enqR,
+				namespace:        ns,
+				k:                1,
+				ttl:              time.Second,
+			})
+			enqR.Pipe <- knnc.ScoreItems{{Set: true, Score: score}}
+			close(enqR.Pipe)
+			for range monEnqR.Pipe {
+			}
+		}
+	}
+
+	now := time.Now()
+	end := now.Add(-time.Second * 5)
+	for ns, score := range scores {
+		r := monitor.average(ns, now, end)
+		if r.N != 3 || math.Abs(r.AvgScore-score) > 1e-9 {
+			t.Fatalf("namespace %v: unexpected N/AvgScore: %v/%v", ns, r.N, r.AvgScore)
+		}
+	}
+
+	r := monitor.average(KNNMonitorAllNamespaces, now, end)
+	if r.N != 6 || math.Abs(r.AvgScore-0.5) > 1e-9 {
+		t.Fatalf("aggregate: unexpected N/AvgScore: %v/%v", r.N, r.AvgScore)
+	}
+
+	r = monitor.average("unknown", now, end)
+	if r.N != 0 || !r.BoundsOk {
+		t.Fatalf("unexpected result for unknown namespace: %+v", r)
+	}
+}
+
+func TestMonitorSampleRate(t *testing.T) {
+	monitor := knnMonitor{
+		averages: &timedLinkedList[KNNMonItemAvg]{
+			maxChainLinkN:    10,
+			minChainLinkSize: time.Second,
+		},
+		sampleRate: 0.1,
+	}
+
+	// Half of the requests get a score of 0, the other half 1. Same with
+	// satisfaction, i.e the averages should be ~0.5 regardless of sampling.
+	n := 2000
+	nMonitored := 0
+	for i := 0; i < n; i++ {
+		enqR := KNNEnqueueResult{
+			Pipe:   make(chan knnc.ScoreItems, 1),
+			Cancel: knnc.NewCancelSignal(),
+		}
+		monEnqR := monitor.register(knnMonitorRegisterArgs{
+			knnEnqueueResult: enqR,
+			k:                2,
+			ttl:              time.Second,
+		})
+		// A new pipe means that a monitor goroutine was started.
+		if monEnqR.Pipe != enqR.Pipe {
+			nMonitored++
+		}
+		scoreItems := knnc.ScoreItems{{Set: true, Score: float64(i % 2)}, {}}
+		if i%2 == 1 {
+			scoreItems[1] = knnc.ScoreItem{Set: true, Score: 1}
+		}
+		enqR.Pipe <- scoreItems
+		close(enqR.Pipe)
+		for range monEnqR.Pipe {
+		}
+	}
+
+	if nMonitored < n/20 || nMonitored > n*3/20 {
+		t.Fatalf("want ~%v monitored requests, have %v", n/10, nMonitored)
+	}
+
+	now := time.Now()
+	r := monitor.average(KNNMonitorAllNamespaces, now, now.Add(-time.Second*5))
+	if math.Abs(float64(r.N-n)) > float64(n)*0.5 {
+		t.Fatalf("want N ~%v (scaled), have %v", n, r.N)
+	}
+	if math.Abs(r.AvgScore-0.5) > 0.15 {
+		t.Fatalf("want AvgScore ~0.5, have %v", r.AvgScore)
+	}
+	if math.Abs(r.AvgSatisfaction-0.75) > 0.1 {
+		t.Fatalf("want AvgSatisfaction ~0.75, have %v", r.AvgSatisfaction)
+	}
+}
+
 func TestMonitorRegister(t *testing.T) {
 	type enqResultDuo struct {
 		raw KNNEnqueueResult // Normal
@@ -366,8 +695,10 @@ func TestMonitorRegister(t *testing.T) {
 
 	startedNGoroutines := runtime.NumGoroutine()
 
+	// +1 since links start at multiples of d, so the test runtime can touch
+	// one more link than it fills.
 	monitor := knnMonitor{averages: &timedLinkedList[KNNMonItemAvg]{
-		maxChainLinkN:    int(testRuntime / d),
+		maxChainLinkN:    int(testRuntime/d) + 1,
 		minChainLinkSize: d,
 	}}
 	// Note; using channels here becase of their lazy nature.
@@ -417,12 +748,12 @@ func TestMonitorRegister(t *testing.T) {
 
 	wg.Wait()
 	// Make sure the whole linked list is filled.
-	if monitor.averages.inner.len() != int(testRuntime/d) {
+	if monitor.averages.inner.len() != int(testRuntime/d)+1 {
 		t.Log("unexpected ll len:", monitor.averages.inner.len())
 	}
 
 	// Simple check; make sure that all entries are accounted for.
-	r := monitor.average(testStarted, testStarted.Add(-testRuntime))
+	r := monitor.average(KNNMonitorAllNamespaces, testStarted, testStarted.Add(-testRuntime-d))
 	if r.N != n {
 		s := "some entries were unaccounted for. want %v, have %v"
 		t.Fatalf(s, n, r.N)
@@ -432,7 +763,7 @@ func TestMonitorRegister(t *testing.T) {
 	// It is a bit non-deterministic, so using ranges for these checks.
 	sampleSize := 0.5
 	durationSpan := time.Duration(float64(testRuntime) * sampleSize)
-	r = monitor.average(testStarted, testStarted.Add(-durationSpan))
+	r = monitor.average(KNNMonitorAllNamespaces, testStarted, testStarted.Add(-durationSpan))
 
 	// Check number of entries for period.
 	margin := 0.2
@@ -1,7 +1,9 @@
 package requestman
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/crunchypi/ddrop/pkg/knnc"
 	"github.com/crunchypi/ddrop/pkg/timex"
@@ -17,6 +19,21 @@ File contains a hashmap wrapper for knnc.SearchSpaces, as a way of namespacing.
 type knnNamespacesItem struct {
 	latency      *timex.LatencyTracker
 	searchSpaces *knnc.SearchSpaces
+	// dim is the pinned vec dimension of the namespace, 0 means not pinned.
+	// See knnNamespaces.pinDim.
+	dim int
+	// pq is the index used with BackendPQ, nil means BackendExact. All data
+	// added with put is also added here. See Handle.SetBackend.
+	pq *knnc.PQIndex
+	// metaIndex is the index of metadata fields, nil means none. All data
+	// added with put is also added here. See Handle.SetMetadataIndex.
+	metaIndex *metadataIndex
+	// defaultMethod is used for KNNMethodNamespaceDefault, see
+	// CreateNamespaceArgs.DefaultKNNMethod.
+	defaultMethod KNNMethod
+	// version is changed whenever the namespace is mutated, see
+	// knnNamespaces.touch and info.SSpaceVersion.
+	version *uint64
 }
 
 // knnNamespaces is a namespacing mutex-protected wrapper around knnc.SearchSpaces.
@@ -24,6 +41,13 @@ type knnNamespacesItem struct {
 type knnNamespaces struct {
 	sync.RWMutex
 	items map[string]knnNamespacesItem
+	// seq is incremented for each DistancerContainer added with put, and the
+	// new value is kept in DistancerContainer.seq. This gives a logical order
+	// of inserts, used for delta snapshots (see SnapshotArgs.Since).
+	seq uint64
+	// mutations is incremented (atomically) for each knnNamespaces.touch,
+	// the new value is the version of the touched namespace.
+	mutations uint64
 
 	// newSearchSpaceArgs keeps instructions for how to create new search spaces
 	// that go into new namedSSPaceItem (for knnNamespaces.items).
@@ -64,12 +88,49 @@ func (ns *knnNamespaces) get(key string) (knnNamespacesItem, bool) {
 	return ss, ok
 }
 
+// create retrieves a knnNamespaceItem using a key/namespace, a new one is created
+// if it does not exist. Returns false if an attempt to create a new namespace
+// failed, i.e knnc.NewSearchSpaces(knnNamespaces.newSearchSpaceArgs) returns
+// false. Note; the caller must hold the lock.
+func (ns *knnNamespaces) create(key string) (knnNamespacesItem, bool) {
+	nsItem, ok := ns.items[key]
+	if ok {
+		return nsItem, true
+	}
+
+	newSearchSpaces, ok := knnc.NewSearchSpaces(ns.newSearchSpaceArgs)
+	if !ok {
+		return nsItem, false
+	}
+	newSearchSpaces.StartMaintenance()
+
+	lt, _ := timex.NewLatencyTracker(ns.newLatencyTrackerArgs)
+	nsItem.latency = lt
+	nsItem.searchSpaces = newSearchSpaces
+	nsItem.version = new(uint64)
+	ns.touch(nsItem)
+	ns.items[key] = nsItem
+	return nsItem, true
+}
+
+// touch sets a new version of the namespace, which is unique across all
+// namespaces (including deleted ones), see info.SSpaceVersion. This is used
+// whenever a namespace is mutated. Note; thread safe.
+func (ns *knnNamespaces) touch(nsItem knnNamespacesItem) {
+	atomic.StoreUint64(nsItem.version, atomic.AddUint64(&ns.mutations, 1))
+}
+
 // put adds a DistancerContainer to a namespace. If the namespace does not exist
 // then a new one will be automatically created. Returns false if
 // - DistancerContainer.D == nil.
 // - An attempt to create a new namespace failed. This happens if a new
 //   knnc.NewSearchSpaces(knnNamespaces.newSearchSpaceArgs) returns false.
+// - The namespace has a pinned dim (see knnNamespaces.pinDim) which does not
+//   match the dim of DistancerContainer.D.
 // - knnc.SearchSpaces.AddSearchable(DistancerContainer) returns false.
+//
+// The DistancerContainer is also added to knnNamespacesItem.pq and
+// knnNamespacesItem.metaIndex, if they are set.
 func (ns *knnNamespaces) put(key string, d DistancerContainer) bool {
 	if d.D == nil {
 		return false
@@ -78,21 +139,155 @@ func (ns *knnNamespaces) put(key string, d DistancerContainer) bool {
 	ns.Lock()
 	defer ns.Unlock()
 
+	nsItem, ok := ns.create(key)
+	if !ok {
+		return false
+	}
+	if nsItem.dim != 0 && nsItem.dim != d.D.Dim() {
+		return false
+	}
+
+	ns.seq++
+	d.seq = ns.seq
+	if !nsItem.searchSpaces.AddSearchable(&d) {
+		return false
+	}
+	if nsItem.pq != nil {
+		nsItem.pq.Add(&d)
+	}
+	if nsItem.metaIndex != nil {
+		nsItem.metaIndex.add(&d)
+	}
+	ns.touch(nsItem)
+	return true
+}
+
+// knnNamespacesSnapshot is a point-in-time copy of a single namespace, see
+// knnNamespaces.snapshot.
+type knnNamespacesSnapshot struct {
+	key        string
+	dim        int
+	containers []knnc.DistancerContainer
+}
+
+// snapshot copies the DistancerContainer references of all namespaces (sorted
+// by key), see knnc.SearchSpaces.Snapshot. The returned uint64 is the seq at the
+// time of the copy (see knnNamespaces.seq), i.e all data added with a seq less
+// than or equal to it is included, while data added later is not.
+func (ns *knnNamespaces) snapshot() ([]knnNamespacesSnapshot, uint64) {
+	// Read lock for the entire copy, as put uses a write lock.
+	ns.RLock()
+	defer ns.RUnlock()
+
+	r := make([]knnNamespacesSnapshot, 0, len(ns.items))
+	for k, nsItem := range ns.items {
+		r = append(r, knnNamespacesSnapshot{
+			key:        k,
+			dim:        nsItem.dim,
+			containers: nsItem.searchSpaces.Snapshot(),
+		})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].key < r[j].key })
+	return r, ns.seq
+}
+
+// pinDim pins the vec dimension of a namespace, such that knnNamespaces.put
+// only accepts data with that dimension. If the namespace does not exist then
+// a new (empty) one will be automatically created. Pinning the same dim again
+// is a no-op. Errors are:
+// - ErrDimMismatch if the namespace is pinned to another dim, or if it has
+//   data with another dim.
+// - ErrDataRejected if an attempt to create a new namespace failed (see
+//   knnNamespaces.create).
+func (ns *knnNamespaces) pinDim(key string, dim int) error {
+	ns.Lock()
+	defer ns.Unlock()
+
+	nsItem, ok := ns.create(key)
+	if !ok {
+		return ErrDataRejected
+	}
+	if nsItem.dim == dim {
+		return nil
+	}
+	if nsItem.dim != 0 {
+		return ErrDimMismatch
+	}
+	if _, nVecs := nsItem.searchSpaces.Len(); nVecs != 0 && nsItem.searchSpaces.Dim() != dim {
+		return ErrDimMismatch
+	}
+
+	nsItem.dim = dim
+	ns.items[key] = nsItem
+	return nil
+}
+
+// setDefaultMethod sets the knnNamespacesItem.defaultMethod of an existing
+// namespace. Returns ErrUnknownNamespace if the namespace does not exist.
+func (ns *knnNamespaces) setDefaultMethod(key string, method KNNMethod) error {
+	ns.Lock()
+	defer ns.Unlock()
+
+	nsItem, ok := ns.items[key]
+	if !ok {
+		return ErrUnknownNamespace
+	}
+	nsItem.defaultMethod = method
+	ns.items[key] = nsItem
+	ns.touch(nsItem)
+	return nil
+}
+
+// setPQ sets the knnNamespacesItem.pq of an existing namespace, after adding
+// all (non-expired) data of the namespace to it. A nil pq is allowed, which
+// selects BackendExact. Returns ErrUnknownNamespace if the namespace does not
+// exist.
+func (ns *knnNamespaces) setPQ(key string, pq *knnc.PQIndex) error {
+	// Write lock, such that no data is added while pq is filled.
+	ns.Lock()
+	defer ns.Unlock()
+
 	nsItem, ok := ns.items[key]
 	if !ok {
-		newSearchSpaces, ok := knnc.NewSearchSpaces(ns.newSearchSpaceArgs)
-		if !ok {
-			return false
+		return ErrUnknownNamespace
+	}
+	if pq != nil {
+		for _, container := range nsItem.searchSpaces.Snapshot() {
+			pq.Add(container)
 		}
-		newSearchSpaces.StartMaintenance()
+	}
+
+	nsItem.pq = pq
+	ns.items[key] = nsItem
+	ns.touch(nsItem)
+	return nil
+}
 
-		lt, _ := timex.NewLatencyTracker(ns.newLatencyTrackerArgs)
-		nsItem.latency = lt
-		nsItem.searchSpaces = newSearchSpaces
-		ns.items[key] = nsItem
+// setMetadataIndex sets the knnNamespacesItem.metaIndex of an existing
+// namespace, after adding all (non-expired) data of the namespace to it. A nil
+// index is allowed, which removes it. Returns ErrUnknownNamespace if the
+// namespace does not exist.
+func (ns *knnNamespaces) setMetadataIndex(key string, mi *metadataIndex) error {
+	// Write lock, such that no data is added while the index is filled.
+	ns.Lock()
+	defer ns.Unlock()
+
+	nsItem, ok := ns.items[key]
+	if !ok {
+		return ErrUnknownNamespace
+	}
+	if mi != nil {
+		for _, container := range nsItem.searchSpaces.Snapshot() {
+			if dc, ok := container.(*DistancerContainer); ok && dc.Distancer() != nil {
+				mi.add(dc)
+			}
+		}
 	}
 
-	return nsItem.searchSpaces.AddSearchable(&d)
+	nsItem.metaIndex = mi
+	ns.items[key] = nsItem
+	ns.touch(nsItem)
+	return nil
 }
 
 // del deletes all namespaces with the specified keys. If no keys are used, then
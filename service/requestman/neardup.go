@@ -0,0 +1,88 @@
+package requestman
+
+import (
+	"errors"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+/*
+File contains near-duplicate detection at ingest, i.e rejecting new data which
+is (almost) the same as data that is already stored, see NewHandleArgs.NearDup.
+*/
+
+// ErrNearDuplicate is returned by Handle.AddDataErr when the data is a near-
+// duplicate of existing data in the namespace, see NearDupArgs.
+var ErrNearDuplicate = errors.New("requestman: data is a near-duplicate")
+
+// NearDupArgs configures near-duplicate detection for Handle.AddData, see
+// NewHandleArgs.NearDup. When enabled, each new vec is compared with all the
+// (non-expired) vecs in the namespace, and rejected if any of them is within
+// the threshold. This costs a pass over the namespace per insert, i.e it trades
+// ingest latency for an index without near-duplicates. Concurrent inserts of
+// near-duplicates are not compared with each other, so a few might slip by.
+type NearDupArgs struct {
+	// Enabled turns on near-duplicate detection, the other fields are only
+	// used if this is true.
+	Enabled bool
+	// KNNMethod is the method used for comparing vecs.
+	KNNMethod KNNMethod
+	// Threshold is the distance (KNNMethodEuclideanDistance) at or below
+	// which, or the similarity (KNNMethodCosineSimilarity) at or above which,
+	// two vecs are considered near-duplicates. Must be >= 0 for Euclidean
+	// distance, and within [-1, 1] for cosine similarity.
+	Threshold float64
+}
+
+// Ok returns true if the configuration of NearDupArgs is acceptable, which is
+// always the case if NearDupArgs.Enabled is false. Otherwise:
+// - NearDupArgs.KNNMethod.Ok() == true
+// - NearDupArgs.Threshold >= 0 for KNNMethodEuclideanDistance.
+// - NearDupArgs.Threshold is within [-1, 1] for KNNMethodCosineSimilarity.
+func (args *NearDupArgs) Ok() bool {
+	if !args.Enabled {
+		return true
+	}
+	switch args.KNNMethod {
+	case KNNMethodEuclideanDistance:
+		return args.Threshold >= 0
+	case KNNMethodCosineSimilarity:
+		return args.Threshold >= -1 && args.Threshold <= 1
+	default:
+		return false
+	}
+}
+
+// isNearDup returns true if 'd' and 'other' are near-duplicates. Vecs that
+// can not be compared (e.g with different dims) are not near-duplicates.
+func (args *NearDupArgs) isNearDup(d, other mathx.Distancer) bool {
+	switch args.KNNMethod {
+	case KNNMethodEuclideanDistance:
+		dist, ok := d.EuclideanDistance(other)
+		return ok && dist <= args.Threshold
+	case KNNMethodCosineSimilarity:
+		sim, ok := d.CosineSimilarity(other)
+		return ok && sim >= args.Threshold
+	default:
+		return false
+	}
+}
+
+// hasNearDup returns true if the namespace has a near-duplicate of 'd', see
+// NearDupArgs. Returns false if near-duplicate detection is disabled, or if
+// the namespace does not exist.
+func (h *Handle) hasNearDup(ns string, d mathx.Distancer) bool {
+	if !h.nearDup.Enabled {
+		return false
+	}
+	nsItem, ok := h.knnNamespaces.get(ns)
+	if !ok {
+		return false
+	}
+	for _, container := range nsItem.searchSpaces.Snapshot() {
+		if other := container.Distancer(); other != nil && h.nearDup.isNearDup(d, other) {
+			return true
+		}
+	}
+	return false
+}
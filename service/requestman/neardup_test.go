@@ -0,0 +1,76 @@
+package requestman
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestNearDupArgsOk(t *testing.T) {
+	for _, tc := range []struct {
+		args NearDupArgs
+		want bool
+	}{
+		{args: NearDupArgs{}, want: true},
+		{args: NearDupArgs{Threshold: -1}, want: true},
+		{args: NearDupArgs{Enabled: true, Threshold: 0.1}, want: true},
+		{args: NearDupArgs{Enabled: true, Threshold: -0.1}, want: false},
+		{args: NearDupArgs{Enabled: true, KNNMethod: KNNMethodCosineSimilarity, Threshold: 0.99}, want: true},
+		{args: NearDupArgs{Enabled: true, KNNMethod: KNNMethodCosineSimilarity, Threshold: 1.1}, want: false},
+		{args: NearDupArgs{Enabled: true, KNNMethod: 99}, want: false},
+	} {
+		if have := tc.args.Ok(); have != tc.want {
+			t.Fatalf("want %v for %+v, have %v", tc.want, tc.args, have)
+		}
+	}
+}
+
+func TestHandleAddDataNearDup(t *testing.T) {
+	for _, nearDup := range []NearDupArgs{
+		{Enabled: true, KNNMethod: KNNMethodEuclideanDistance, Threshold: 0.01},
+		{Enabled: true, KNNMethod: KNNMethodCosineSimilarity, Threshold: 0.9999},
+	} {
+		h := newTestHandleCleanup(t, 100, 100)
+		h.nearDup = nearDup
+
+		ns := "test"
+		add := func(v ...float64) error {
+			return h.AddDataErr(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil)
+		}
+		if err := add(1, 2, 3); err != nil {
+			t.Fatal("unexpected err when adding data:", err)
+		}
+		if err := add(1, 2, 3.001); !errors.Is(err, ErrNearDuplicate) {
+			t.Fatalf("method %v: want err %v, have %v", nearDup.KNNMethod, ErrNearDuplicate, err)
+		}
+		if err := add(3, 2, 1); err != nil {
+			t.Fatalf("method %v: unexpected err for dissimilar data: %v", nearDup.KNNMethod, err)
+		}
+		// Other namespaces are not compared.
+		if err := h.AddDataErr("other", DistancerContainer{D: mathx.NewSafeVec(1, 2, 3)}, nil); err != nil {
+			t.Fatal("unexpected err when adding data to another namespace:", err)
+		}
+		if _, nVecs, _ := h.Info().SSpaceLen(ns); nVecs != 2 {
+			t.Fatal("unexpected number of vecs:", nVecs)
+		}
+	}
+
+	// Near-duplicates in a snapshot are skipped when restoring.
+	h := newTestHandleCleanup(t, 100, 100)
+	for _, v := range [][]float64{{1, 2, 3}, {1, 2, 3.001}, {3, 2, 1}} {
+		if err := h.AddDataErr("test", DistancerContainer{D: mathx.NewSafeVec(v...)}, nil); err != nil {
+			t.Fatal("unexpected err when adding data:", err)
+		}
+	}
+	buf := bytes.Buffer{}
+	if _, err := h.Snapshot(&buf); err != nil {
+		t.Fatal("unexpected snapshot err:", err)
+	}
+	restored := newTestHandleCleanup(t, 100, 100)
+	restored.nearDup = NearDupArgs{Enabled: true, Threshold: 0.01}
+	if n, err := restored.Restore(&buf); n != 2 || err != nil {
+		t.Fatalf("unexpected restore with near-duplicates: %v/%v", n, err)
+	}
+}
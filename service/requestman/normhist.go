@@ -0,0 +1,81 @@
+package requestman
+
+import (
+	"math"
+)
+
+/*
+File contains a histogram of the norms of the vecs stored in a namespace, which
+is intended for data quality checks, e.g to detect zero vecs (which can't be
+used with cosine similarity), or vecs that are not normalized while the rest
+are. See info.NormHistogram.
+*/
+
+// NormHistogram is the distribution of the norms of the (non-expired) vecs in
+// a namespace, see info.NormHistogram. Bucket i of Counts covers the norms in
+// [Min+i*Width, Min+(i+1)*Width), except for the last one, which includes Max.
+type NormHistogram struct {
+	// N is the number of vecs in the histogram, i.e the sum of Counts.
+	N int
+	// Zero is the number of zero vecs, which are also included in Counts.
+	Zero int
+	// Min and Max are the smallest and largest norms, both are 0 if N is 0.
+	Min float64
+	Max float64
+	// Width is the width of each bucket, it is 0 if all norms are equal, in
+	// which case they are all in the first bucket.
+	Width float64
+	// Counts is the number of vecs per bucket.
+	Counts []int
+}
+
+// NormHistogram computes the distribution of the norms (see mathx.Distancer)
+// of all (non-expired) vecs in a namespace, divided into 'buckets' buckets of
+// equal width between the smallest and largest norm. This does a pass over all
+// data of the namespace, so it is not intended to be called frequently.
+// Returns false if the namespace does not exist or if buckets < 1.
+func (i *info) NormHistogram(key string, buckets int) (NormHistogram, bool) {
+	if buckets < 1 {
+		return NormHistogram{}, false
+	}
+	nsItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return NormHistogram{}, false
+	}
+
+	norms := make([]float64, 0)
+	for _, container := range nsItem.searchSpaces.Snapshot() {
+		if d := container.Distancer(); d != nil {
+			norms = append(norms, d.Norm())
+		}
+	}
+
+	r := NormHistogram{N: len(norms), Counts: make([]int, buckets)}
+	if len(norms) == 0 {
+		return r, true
+	}
+
+	r.Min, r.Max = math.Inf(1), math.Inf(-1)
+	for _, norm := range norms {
+		r.Min = math.Min(r.Min, norm)
+		r.Max = math.Max(r.Max, norm)
+		if norm == 0 {
+			r.Zero++
+		}
+	}
+
+	r.Width = (r.Max - r.Min) / float64(buckets)
+	for _, norm := range norms {
+		bucket := 0
+		if r.Width > 0 {
+			bucket = int((norm - r.Min) / r.Width)
+		}
+		// Max (and rounding errors close to it) go in the last bucket.
+		if bucket >= buckets {
+			bucket = buckets - 1
+		}
+		r.Counts[bucket]++
+	}
+
+	return r, true
+}
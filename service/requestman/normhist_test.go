@@ -0,0 +1,46 @@
+package requestman
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+func TestInfoNormHistogram(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newTestHandle(100, 100, ctx)
+	if _, ok := h.Info().NormHistogram("test", 2); ok {
+		t.Fatal("got ok for a missing namespace")
+	}
+
+	// Norms: 0, 1, 1, 1, 5, 10.
+	vecs := [][]float64{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {0, 0, -1}, {3, 4, 0}, {0, 6, 8}}
+	for _, v := range vecs {
+		if !h.AddData("test", DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+			t.Fatalf("got not-ok when adding %v", v)
+		}
+	}
+
+	if _, ok := h.Info().NormHistogram("test", 0); ok {
+		t.Fatal("got ok for 0 buckets")
+	}
+
+	hist, ok := h.Info().NormHistogram("test", 2)
+	if !ok {
+		t.Fatal("got not-ok for an existing namespace")
+	}
+	want := NormHistogram{N: 6, Zero: 1, Min: 0, Max: 10, Width: 5, Counts: []int{4, 2}}
+	if fmt.Sprint(hist) != fmt.Sprint(want) {
+		t.Fatalf("unexpected histogram. want %+v, have %+v", want, hist)
+	}
+
+	// The max norm is in the last bucket, not past it.
+	hist, _ = h.Info().NormHistogram("test", 4)
+	if fmt.Sprint(hist.Counts) != fmt.Sprint([]int{4, 0, 1, 1}) {
+		t.Fatalf("unexpected counts with 4 buckets: %v", hist.Counts)
+	}
+}
@@ -0,0 +1,335 @@
+package requestman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+)
+
+/*
+File contains an optional query log for T Handle, which records a sample of KNN
+requests (args and result stats) for debugging and for offline replay. Replay
+is done with ReplayQueryLog.
+*/
+
+// DefaultQueryLogBuf is used for QueryLogArgs.Buf if it is 0.
+const DefaultQueryLogBuf = 1024
+
+// QueryLogArgs configures the query log of a Handle, see NewHandleArgs.QueryLog.
+type QueryLogArgs struct {
+	// W is where sampled KNN requests are written, as JSON lines, i.e one
+	// QueryLogEntry per line. Nil (default) disables the query log. Writes
+	// are done by a single goroutine, so W does not have to be thread safe,
+	// but it should not block for long (entries are dropped if it does).
+	W io.Writer
+	// SampleRate is the fraction of KNN requests that are logged, where 1
+	// logs all of them. Must be in the range [0, 1].
+	SampleRate float64
+	// Buf is the max number of entries that can wait to be written to W.
+	// New entries are dropped while it is full, such that a slow W does not
+	// affect KNN requests. Use 0 for DefaultQueryLogBuf; else it must be > 0.
+	Buf int
+}
+
+// Ok returns true if all the following conditions are true:
+// - args.SampleRate >= 0 && args.SampleRate <= 1
+// - args.Buf >= 0
+func (args *QueryLogArgs) Ok() bool {
+	ok := true
+	ok = ok && args.SampleRate >= 0 && args.SampleRate <= 1
+	ok = ok && args.Buf >= 0
+	return ok
+}
+
+// QueryLogEntry is a single line in a query log, see QueryLogArgs.
+type QueryLogEntry struct {
+	// Time is when the KNN request was made.
+	Time time.Time
+	// Args of the KNN request.
+	Args KNNArgs
+	// Latency is the time from the request was made until the last result
+	// was received.
+	Latency time.Duration
+	// NResults is the number of (set) items in the last result.
+	NResults int
+	// AvgScore is the average score of the items in the last result.
+	AvgScore float64
+	// Stats are only set if Args.Stats is true, see KNNEnqueueResult.Stats.
+	Stats *KNNStats `json:",omitempty"`
+}
+
+// queryLog implements the query log of a Handle. Set it up with newQueryLog.
+//
+// Note; thread safe.
+type queryLog struct {
+	sampleRate float64
+	entries    chan QueryLogEntry
+	// done is closed when the writer is done, i.e after ctx (see newQueryLog)
+	// is done and the pending entries are written. See Handle.waitThenQuit.
+	done chan struct{}
+}
+
+// newQueryLog sets up a queryLog which writes to args.W until ctx is done. It
+// returns nil if args.W is nil, i.e the query log is disabled. The args are
+// expected to be ok (QueryLogArgs.Ok).
+func newQueryLog(ctx context.Context, args QueryLogArgs) *queryLog {
+	if args.W == nil {
+		return nil
+	}
+	if args.Buf == 0 {
+		args.Buf = DefaultQueryLogBuf
+	}
+
+	l := queryLog{
+		sampleRate: args.SampleRate,
+		entries:    make(chan QueryLogEntry, args.Buf),
+		done:       make(chan struct{}),
+	}
+	go l.write(ctx, json.NewEncoder(args.W))
+	return &l
+}
+
+// write encodes entries until ctx is done, then writes the ones that are
+// already pending and closes queryLog.done. Errors are ignored, i.e the entry
+// is lost. This blocks.
+func (l *queryLog) write(ctx context.Context, enc *json.Encoder) {
+	defer close(l.done)
+	for {
+		select {
+		case entry := <-l.entries:
+			enc.Encode(entry)
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-l.entries:
+					enc.Encode(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// register puts a listener on items sent through knnEnqueueResult.Pipe, the
+// same way as knnMonitor.register, if the request is sampled (else the given
+// KNNEnqueueResult is returned as is). An entry is queued for writing when
+// the pipe is closed, or dropped if the queue is full.
+//
+// Note; thread safe.
+func (l *queryLog) register(args KNNArgs, knnEnqueueResult KNNEnqueueResult) KNNEnqueueResult {
+	if l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return knnEnqueueResult
+	}
+
+	out := KNNEnqueueResult{
+		Pipe:   make(chan knnc.ScoreItems, cap(knnEnqueueResult.Pipe)),
+		Cancel: knnEnqueueResult.Cancel,
+		Stats:  knnEnqueueResult.Stats,
+	}
+
+	// Leak prevention.
+	ctx, ctxCancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(args.TTL*10),
+	)
+
+	entry := QueryLogEntry{Time: time.Now(), Args: args}
+	go func() {
+		defer close(out.Pipe)
+		defer ctxCancel()
+
+		safeChanIter(safeChanIterArgs[knnc.ScoreItems]{
+			ch:  knnEnqueueResult.Pipe,
+			ctx: ctx,
+			rcv: func(scoreItems knnc.ScoreItems) bool {
+				entry.Latency = time.Since(entry.Time)
+				entry.NResults = 0
+				entry.AvgScore = 0
+
+				for _, scoreItem := range scoreItems {
+					if scoreItem.Set {
+						entry.NResults++
+						entry.AvgScore += scoreItem.Score
+					}
+				}
+				// Guard zero div.
+				if entry.NResults > 0 {
+					entry.AvgScore /= float64(entry.NResults)
+				}
+
+				safeChanSend(safeChanSendArgs[knnc.ScoreItems]{
+					ch:  out.Pipe,
+					ctx: ctx,
+					elm: scoreItems,
+				})
+				return true
+			},
+		})
+
+		// Stats are only updated before sending, so they are done here.
+		if args.Stats && knnEnqueueResult.Stats != nil {
+			stats := *knnEnqueueResult.Stats
+			entry.Stats = &stats
+		}
+		select {
+		case l.entries <- entry:
+		default:
+		}
+	}()
+
+	return out
+}
+
+// ReplayStats summarises a replay of a query log, see ReplayQueryLog. Fields
+// prefixed with Recorded are from the log itself, such that a replay can be
+// compared with the original run (e.g for regression benchmarking).
+type ReplayStats struct {
+	// N is the number of replayed queries, including rejected ones.
+	N int
+	// NRejected is the number of queries that were rejected by Handle.KNN.
+	NRejected int
+	// AvgLatency is the average time from a query was made until its last
+	// result was received. Rejected queries are not included.
+	AvgLatency time.Duration
+	// MaxLatency is the highest latency of a query.
+	MaxLatency time.Duration
+	// AvgNResults is the average number of (set) items in the last result of
+	// a query. Rejected queries are not included.
+	AvgNResults float64
+	// RecordedAvgLatency is the average QueryLogEntry.Latency.
+	RecordedAvgLatency time.Duration
+	// RecordedAvgNResults is the average QueryLogEntry.NResults.
+	RecordedAvgNResults float64
+	// Duration is the time spent on the whole replay.
+	Duration time.Duration
+}
+
+// ReplayQueryLogArgs is intended as args for ReplayQueryLogWithArgs.
+type ReplayQueryLogArgs struct {
+	// Handle is where queries are replayed. Must not be nil.
+	Handle *Handle
+	// R is the query log, i.e JSON lines of QueryLogEntry (see QueryLogArgs).
+	// Must not be nil.
+	R io.Reader
+	// Speed is a multiplier for the recorded time between queries, where
+	// 2 replays twice as fast and 0.5 half as fast. Use 0 to not wait at
+	// all between queries; else it must be > 0.
+	Speed float64
+}
+
+// Ok returns true if all the following conditions are true:
+// - args.Handle != nil
+// - args.R != nil
+// - args.Speed >= 0
+func (args *ReplayQueryLogArgs) Ok() bool {
+	ok := true
+	ok = ok && args.Handle != nil
+	ok = ok && args.R != nil
+	ok = ok && args.Speed >= 0
+	return ok
+}
+
+// ReplayQueryLog is ReplayQueryLogWithArgs with the recorded speed, i.e
+// ReplayQueryLogArgs.Speed = 1.
+func ReplayQueryLog(h *Handle, r io.Reader) (ReplayStats, bool) {
+	return ReplayQueryLogWithArgs(ReplayQueryLogArgs{Handle: h, R: r, Speed: 1})
+}
+
+// ReplayQueryLogWithArgs reads queries from a query log (see QueryLogArgs) and
+// issues them with Handle.KNN, in the logged order and with the logged time
+// between queries (scaled by args.Speed). Queries can overlap, as they do not
+// wait for each other. Blocks until all queries are done, then returns stats
+// about latency and result counts. Note that replayed queries are logged
+// again if the Handle has a query log.
+//
+// Returns (ReplayStats{}, false) if args.Ok() == false, or if the query log
+// contains a line which can not be decoded into a QueryLogEntry, in which case
+// queries before that line are still replayed.
+func ReplayQueryLogWithArgs(args ReplayQueryLogArgs) (ReplayStats, bool) {
+	if !args.Ok() {
+		return ReplayStats{}, false
+	}
+
+	stats := ReplayStats{}
+	mx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	var totalLatency, totalRecordedLatency time.Duration
+	var totalNResults, totalRecordedNResults int
+
+	started := time.Now()
+	var firstRecorded time.Time
+	dec := json.NewDecoder(args.R)
+	ok := true
+	for {
+		var entry QueryLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			ok = errors.Is(err, io.EOF)
+			break
+		}
+		if stats.N == 0 {
+			firstRecorded = entry.Time
+		}
+		stats.N++
+		totalRecordedLatency += entry.Latency
+		totalRecordedNResults += entry.NResults
+
+		// Keep the recorded (scaled) offset relative to the first query.
+		if args.Speed > 0 {
+			offset := time.Duration(float64(entry.Time.Sub(firstRecorded)) / args.Speed)
+			time.Sleep(time.Until(started.Add(offset)))
+		}
+
+		stamp := time.Now()
+		enqueueResult, enqueued := args.Handle.KNN(entry.Args)
+		if !enqueued {
+			stats.NRejected++
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nResults := 0
+			for scoreItems := range enqueueResult.Pipe {
+				nResults = 0
+				for _, scoreItem := range scoreItems {
+					if scoreItem.Set {
+						nResults++
+					}
+				}
+			}
+			latency := time.Since(stamp)
+
+			mx.Lock()
+			defer mx.Unlock()
+			totalLatency += latency
+			totalNResults += nResults
+			if latency > stats.MaxLatency {
+				stats.MaxLatency = latency
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats.Duration = time.Since(started)
+	if n := stats.N - stats.NRejected; n > 0 {
+		stats.AvgLatency = totalLatency / time.Duration(n)
+		stats.AvgNResults = float64(totalNResults) / float64(n)
+	}
+	if stats.N > 0 {
+		stats.RecordedAvgLatency = totalRecordedLatency / time.Duration(stats.N)
+		stats.RecordedAvgNResults = float64(totalRecordedNResults) / float64(stats.N)
+	}
+	if !ok {
+		return ReplayStats{}, false
+	}
+	return stats, true
+}
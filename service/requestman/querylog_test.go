@@ -0,0 +1,228 @@
+package requestman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+// testQueryLogBuffer is a bytes.Buffer which can be written to and read from
+// concurrently.
+type testQueryLogBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *testQueryLogBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries decodes the lines written so far. Fails the test on invalid lines.
+func (b *testQueryLogBuffer) entries(t *testing.T) []QueryLogEntry {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	var r []QueryLogEntry
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry QueryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", scanner.Text(), err)
+		}
+		r = append(r, entry)
+	}
+	return r
+}
+
+func TestHandleQueryLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := testQueryLogBuffer{}
+	h := newTestHandle(100, 100, ctx)
+	h.queryLog = newQueryLog(ctx, QueryLogArgs{W: &buf, SampleRate: 1})
+
+	ns := "test"
+	dim := 3
+	for i := 0; i < 100; i++ {
+		v, _ := randFloat64Slice(dim)
+		if !h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	n := 10
+	for i := 0; i < n; i++ {
+		args := newTestKNNArgs(dim, ns)
+		args.Stats = i%2 == 0
+		// Such that all requests get results.
+		args.Extent = 1
+		args.Reject = -1
+		r, ok := h.KNN(args)
+		if !ok {
+			t.Fatal("got not-ok when making a KNN request")
+		}
+		for range r.Pipe {
+		}
+	}
+
+	// Entries are queued before the pipe is closed, but written async.
+	var entries []QueryLogEntry
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); {
+		if entries = buf.entries(t); len(entries) >= n {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(entries) != n {
+		t.Fatalf("want %v log lines, have %v", n, len(entries))
+	}
+
+	for i, entry := range entries {
+		if entry.Time.IsZero() || entry.Latency <= 0 {
+			t.Fatalf("entry %v: unexpected time/latency: %v/%v", i, entry.Time, entry.Latency)
+		}
+		if entry.Args.Namespace != ns || len(entry.Args.QueryVec) != dim {
+			t.Fatalf("entry %v: unexpected args: %+v", i, entry.Args)
+		}
+		if entry.NResults <= 0 || entry.NResults > entry.Args.K {
+			t.Fatalf("entry %v: unexpected NResults: %v", i, entry.NResults)
+		}
+		if (entry.Stats != nil) != entry.Args.Stats {
+			t.Fatalf("entry %v: stats set=%v, want %v", i, entry.Stats != nil, entry.Args.Stats)
+		}
+	}
+}
+
+func TestQueryLogShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := testQueryLogBuffer{}
+	l := newQueryLog(ctx, QueryLogArgs{W: &buf, SampleRate: 1, Buf: 10})
+
+	// The writer might not get to these before the cancel, but they are
+	// pending, so they should be written before it is done.
+	n := 5
+	for i := 0; i < n; i++ {
+		l.entries <- QueryLogEntry{Time: time.Now(), NResults: i}
+	}
+	cancel()
+
+	select {
+	case <-l.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the writer did not finish after the ctx was done")
+	}
+	if entries := buf.entries(t); len(entries) != n {
+		t.Fatalf("want %v log lines, have %v", n, len(entries))
+	}
+}
+
+func TestHandleQueryLogSampleRate(t *testing.T) {
+	// Not set up with newQueryLog, as the writer is not needed.
+	l := queryLog{sampleRate: 0}
+	enqueueResult := KNNEnqueueResult{}
+	if r := l.register(newTestKNNArgs(3, "test"), enqueueResult); r.Pipe != nil {
+		t.Fatal("unexpected listener on a request which should not be sampled")
+	}
+
+	if newQueryLog(context.Background(), QueryLogArgs{}) != nil {
+		t.Fatal("want nil query log without a writer")
+	}
+	for _, args := range []QueryLogArgs{{SampleRate: -0.1}, {SampleRate: 1.1}, {Buf: -1}} {
+		if args.Ok() {
+			t.Fatalf("unexpected ok args: %+v", args)
+		}
+	}
+}
+
+func TestReplayQueryLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := testQueryLogBuffer{}
+	h := newTestHandle(100, 100, ctx)
+	h.queryLog = newQueryLog(ctx, QueryLogArgs{W: &buf, SampleRate: 1})
+
+	ns := "test"
+	dim := 3
+	for i := 0; i < 100; i++ {
+		v, _ := randFloat64Slice(dim)
+		if !h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	// Record, with some time between queries.
+	n := 5
+	gap := time.Millisecond * 20
+	for i := 0; i < n; i++ {
+		args := newTestKNNArgs(dim, ns)
+		args.Extent = 1
+		args.Reject = -1
+		r, ok := h.KNN(args)
+		if !ok {
+			t.Fatal("got not-ok when making a KNN request")
+		}
+		for range r.Pipe {
+		}
+		time.Sleep(gap)
+	}
+	var entries []QueryLogEntry
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); {
+		if entries = buf.entries(t); len(entries) >= n {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(entries) != n {
+		t.Fatalf("want %v log lines, have %v", n, len(entries))
+	}
+	recorded := entries[n-1].Time.Sub(entries[0].Time)
+
+	// Replay on a handle without a query log, such that the log is unchanged.
+	h.queryLog = nil
+	for _, speed := range []float64{0, 0.5, 1, 4} {
+		buf.mx.Lock()
+		r := bytes.NewReader(buf.buf.Bytes())
+		buf.mx.Unlock()
+
+		stats, ok := ReplayQueryLogWithArgs(ReplayQueryLogArgs{Handle: h, R: r, Speed: speed})
+		if !ok {
+			t.Fatalf("speed %v: unexpected not-ok replay", speed)
+		}
+		if stats.N != n || stats.NRejected != 0 {
+			t.Fatalf("speed %v: unexpected N/NRejected: %v/%v", speed, stats.N, stats.NRejected)
+		}
+		if stats.AvgNResults <= 0 || stats.RecordedAvgNResults <= 0 {
+			t.Fatalf("speed %v: unexpected result counts: %+v", speed, stats)
+		}
+		if stats.AvgLatency <= 0 || stats.MaxLatency < stats.AvgLatency {
+			t.Fatalf("speed %v: unexpected latencies: %+v", speed, stats)
+		}
+		// The last query is issued after the (scaled) recorded span.
+		if speed > 0 && stats.Duration < time.Duration(float64(recorded)/speed) {
+			t.Fatalf("speed %v: replay took %v, recorded %v", speed, stats.Duration, recorded)
+		}
+	}
+
+	// Invalid log / args.
+	if _, ok := ReplayQueryLog(h, bytes.NewReader([]byte("not json\n"))); ok {
+		t.Fatal("unexpected ok replay of an invalid log")
+	}
+	if _, ok := ReplayQueryLog(nil, bytes.NewReader(nil)); ok {
+		t.Fatal("unexpected ok replay without a handle")
+	}
+	args := ReplayQueryLogArgs{Handle: h, R: bytes.NewReader(nil), Speed: -1}
+	if _, ok := ReplayQueryLogWithArgs(args); ok {
+		t.Fatal("unexpected ok replay with a negative speed")
+	}
+}
@@ -0,0 +1,174 @@
+package requestman
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+File contains per-tenant quotas, i.e bounds on how many KNN requests a tenant
+can make per second and how much data it can store. Tenants are identified by
+KNNArgs.Tenant and DistancerContainer.Tenant, see NewHandleArgs.TenantQuotas.
+*/
+
+// ErrQuotaExceeded is returned by Handle.AddDataErr, and set as
+// KNNEnqueueResult.Err by Handle.KNN, when a tenant exceeds its TenantQuota.
+var ErrQuotaExceeded = errors.New("requestman: tenant quota exceeded")
+
+// TenantQuota bounds the resource usage of a single tenant, see
+// NewHandleArgs.TenantQuotas. Zero values mean unlimited.
+type TenantQuota struct {
+	// QPS is the max (sustained) number of KNN requests per second. Must be
+	// >= 0, where 0 means unlimited.
+	QPS float64
+	// Burst is the max number of KNN requests that can be made at once, i.e
+	// requests are allowed to exceed QPS briefly (token bucket). Must be >= 0,
+	// where 0 means max(1, QPS). Not used if QPS is 0.
+	Burst int
+	// MaxVecs is the max number of (non-expired) vecs stored by the tenant,
+	// across all namespaces. Must be >= 0, where 0 means unlimited.
+	MaxVecs int
+}
+
+// Ok returns true if the configuration of TenantQuota is acceptable.
+// Specifically:
+// - TenantQuota.QPS >= 0
+// - TenantQuota.Burst >= 0
+// - TenantQuota.MaxVecs >= 0
+func (q *TenantQuota) Ok() bool {
+	return q.QPS >= 0 && q.Burst >= 0 && q.MaxVecs >= 0
+}
+
+// burst returns TenantQuota.Burst, with the default applied.
+func (q *TenantQuota) burst() float64 {
+	if q.Burst > 0 {
+		return float64(q.Burst)
+	}
+	return math.Max(1, q.QPS)
+}
+
+// tenantQuotas enforces TenantQuota instances for a Handle.
+type tenantQuotas struct {
+	sync.Mutex
+	quotas map[string]TenantQuota
+	// tokens and refilled make up a token bucket per tenant (with a QPS quota),
+	// where refilled is the last time tokens were added.
+	tokens   map[string]float64
+	refilled map[string]time.Time
+	// vecs is the (approximate) number of vecs stored per tenant (with a
+	// MaxVecs quota), see tenantQuotas.reserveVec.
+	vecs map[string]int
+	// countVecs counts the non-expired vecs stored by a tenant.
+	countVecs func(tenant string) int
+}
+
+// newTenantQuotas is a factory func for tenantQuotas. Returns nil if there are
+// no quotas. countVecs is described in tenantQuotas.countVecs.
+func newTenantQuotas(
+	quotas map[string]TenantQuota,
+	countVecs func(tenant string) int,
+) *tenantQuotas {
+	if len(quotas) == 0 {
+		return nil
+	}
+	q := tenantQuotas{
+		quotas:    make(map[string]TenantQuota, len(quotas)),
+		tokens:    make(map[string]float64),
+		refilled:  make(map[string]time.Time),
+		vecs:      make(map[string]int),
+		countVecs: countVecs,
+	}
+	for tenant, quota := range quotas {
+		q.quotas[tenant] = quota
+	}
+	return &q
+}
+
+// allowKNN takes a token from the bucket of the tenant. Returns 0 if it was
+// allowed (or the tenant has no QPS quota), else the time until a token is
+// available.
+func (q *tenantQuotas) allowKNN(tenant string, now time.Time) time.Duration {
+	q.Lock()
+	defer q.Unlock()
+
+	quota, ok := q.quotas[tenant]
+	if !ok || quota.QPS == 0 {
+		return 0
+	}
+
+	tokens, ok := q.tokens[tenant]
+	if !ok {
+		tokens = quota.burst()
+	}
+	if last, ok := q.refilled[tenant]; ok {
+		tokens += now.Sub(last).Seconds() * quota.QPS
+	}
+	tokens = math.Min(tokens, quota.burst())
+	q.refilled[tenant] = now
+
+	if tokens < 1 {
+		q.tokens[tenant] = tokens
+		return time.Duration((1 - tokens) / quota.QPS * float64(time.Second))
+	}
+	q.tokens[tenant] = tokens - 1
+	return 0
+}
+
+// middleware returns a KNNMiddleware which rejects KNN requests with
+// ErrQuotaExceeded when the tenant exceeds its QPS quota.
+func (q *tenantQuotas) middleware() KNNMiddleware {
+	return func(next KNNFunc) KNNFunc {
+		return func(args KNNArgs) (KNNEnqueueResult, bool) {
+			if wait := q.allowKNN(args.Tenant, time.Now()); wait > 0 {
+				return KNNEnqueueResult{RetryAfter: wait, Err: ErrQuotaExceeded}, false
+			}
+			return next(args)
+		}
+	}
+}
+
+// reserveVec reserves space for a single vec for the tenant. Returns false if
+// the tenant is at its MaxVecs quota. The reservation should be given back with
+// tenantQuotas.releaseVec if the vec is not stored after all.
+//
+// Vecs are not tracked when they expire, so the count is refreshed with
+// tenantQuotas.countVecs when a tenant is at its quota. This costs a pass over
+// all data, but only happens for tenants at their quota. The count can be off
+// briefly with concurrent inserts, i.e the quota is approximate.
+func (q *tenantQuotas) reserveVec(tenant string) bool {
+	q.Lock()
+	quota, ok := q.quotas[tenant]
+	if !ok || quota.MaxVecs == 0 {
+		q.Unlock()
+		return true
+	}
+	if q.vecs[tenant] < quota.MaxVecs {
+		q.vecs[tenant]++
+		q.Unlock()
+		return true
+	}
+	q.Unlock()
+
+	// Not counted while holding the lock, as it is slow.
+	n := q.countVecs(tenant)
+
+	q.Lock()
+	defer q.Unlock()
+	q.vecs[tenant] = n
+	if n < quota.MaxVecs {
+		q.vecs[tenant]++
+		return true
+	}
+	return false
+}
+
+// releaseVec gives back a reservation made with tenantQuotas.reserveVec.
+func (q *tenantQuotas) releaseVec(tenant string) {
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.quotas[tenant]; ok && q.vecs[tenant] > 0 {
+		q.vecs[tenant]--
+	}
+}
@@ -0,0 +1,109 @@
+package requestman
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+// newTestQuotaHandle is newTestHandle with the given quotas, set up the same way
+// as NewHandle does with NewHandleArgs.TenantQuotas.
+func newTestQuotaHandle(ctx context.Context, quotas map[string]TenantQuota) *Handle {
+	h := newTestHandle(100, 100, ctx)
+	h.quotas = newTenantQuotas(quotas, h.countTenantVecs)
+	h.knn = chainKNNMiddleware(h.knnCore, []KNNMiddleware{h.quotas.middleware()})
+	return h
+}
+
+func TestHandleTenantQuotaQPS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newTestQuotaHandle(ctx, map[string]TenantQuota{"limited": {QPS: 2, Burst: 2}})
+	ns := "test"
+	dim := 3
+	v, _ := randFloat64Slice(dim)
+	if !h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+		t.Fatal("got not-ok when adding data")
+	}
+
+	knn := func(tenant string) (KNNEnqueueResult, bool) {
+		args := newTestKNNArgs(dim, ns)
+		args.Tenant = tenant
+		r, ok := h.KNN(args)
+		if ok {
+			r.Cancel.Cancel()
+		}
+		return r, ok
+	}
+
+	// The burst is allowed, then the tenant is throttled.
+	for i := 0; i < 2; i++ {
+		if _, ok := knn("limited"); !ok {
+			t.Fatalf("request %v: got not-ok within the burst", i)
+		}
+	}
+	r, ok := knn("limited")
+	if ok || !errors.Is(r.Err, ErrQuotaExceeded) {
+		t.Fatalf("want ErrQuotaExceeded, have ok=%v, err=%v", ok, r.Err)
+	}
+	if r.RetryAfter <= 0 || r.RetryAfter > time.Millisecond*500 {
+		t.Fatal("unexpected RetryAfter:", r.RetryAfter)
+	}
+
+	// Other tenants are not affected.
+	for _, tenant := range []string{"other", ""} {
+		for i := 0; i < 10; i++ {
+			if _, ok := knn(tenant); !ok {
+				t.Fatalf("tenant '%v': got not-ok without a quota", tenant)
+			}
+		}
+	}
+
+	// Allowed again after waiting.
+	time.Sleep(r.RetryAfter)
+	if _, ok := knn("limited"); !ok {
+		t.Fatal("got not-ok after waiting for RetryAfter")
+	}
+}
+
+func TestHandleTenantQuotaMaxVecs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newTestQuotaHandle(ctx, map[string]TenantQuota{"limited": {MaxVecs: 3}})
+	add := func(ns, tenant string, expires time.Time) error {
+		v, _ := randFloat64Slice(3)
+		dc := DistancerContainer{D: mathx.NewSafeVec(v...), Tenant: tenant, Expires: expires}
+		return h.AddDataErr(ns, dc, nil)
+	}
+
+	// Quota is across namespaces.
+	ttl := time.Millisecond * 20
+	for i, ns := range []string{"a", "b", "a"} {
+		if err := add(ns, "limited", time.Now().Add(ttl)); err != nil {
+			t.Fatalf("add %v: unexpected err: %v", i, err)
+		}
+	}
+	if err := add("a", "limited", time.Time{}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatal("want ErrQuotaExceeded, have", err)
+	}
+	if err := add("a", "other", time.Time{}); err != nil {
+		t.Fatal("unexpected err for a tenant without a quota:", err)
+	}
+
+	// Expired data does not count.
+	time.Sleep(ttl)
+	if err := add("a", "limited", time.Time{}); err != nil {
+		t.Fatal("unexpected err after expiration:", err)
+	}
+
+	for _, quota := range []TenantQuota{{QPS: -1}, {Burst: -1}, {MaxVecs: -1}} {
+		if quota.Ok() {
+			t.Fatalf("unexpected ok quota: %+v", quota)
+		}
+	}
+}
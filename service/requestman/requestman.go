@@ -2,6 +2,10 @@ package requestman
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/crunchypi/ddrop/pkg/knnc"
@@ -9,6 +13,16 @@ import (
 	"github.com/crunchypi/ddrop/pkg/timex"
 )
 
+// Errors returned by Handle.AddDataErr and Handle.CreateNamespace. Invalid vecs are reported with an
+// error wrapping one of the mathx.ErrVecX errors (see mathx.ValidVec).
+var (
+	ErrHandleClosed     = errors.New("requestman: handle is shut down")
+	ErrDataRejected     = errors.New("requestman: data rejected by search spaces")
+	ErrDimMismatch      = errors.New("requestman: vec dim does not match namespace")
+	ErrInvalidDim       = errors.New("requestman: dim must be positive")
+	ErrInvalidKNNMethod = errors.New("requestman: invalid knn method")
+)
+
 // DistancerContainer implements knnc.DistancerContainer.
 type DistancerContainer struct {
 	D mathx.Distancer
@@ -17,6 +31,24 @@ type DistancerContainer struct {
 	// is cheaper. But that would also require a sync.RWMutes due to how this
 	// will be used concurrently in the knnc pkg.
 	Expires time.Time
+	// Tenant is optional, it is the tenant that stores this data, which is
+	// used for quotas (see NewHandleArgs.TenantQuotas). Not kept in snapshots.
+	Tenant string
+	// Added is when the container was added to a Handle. It is set (once) by
+	// Handle.AddData if it is zero, such that it can be kept when data is moved
+	// between Handle instances, e.g with Handle.Restore. See Handle.DeleteWhere.
+	Added time.Time
+	// Data is the payload of the container, it is set by Handle.AddData. Kept
+	// in memory only, i.e not in snapshots or the write-ahead log (as of now).
+	// See info.SSpaceVecByID.
+	Data []byte
+	// Metadata is optional, it is small structured data (e.g a category) that
+	// KNN requests can filter on, see KNNArgs.Filter. It must not be modified
+	// after the container is added. Kept in memory only, as with Data.
+	Metadata map[string]string
+	// seq is the logical insertion order of this container, it is set when the
+	// container is added. See knnNamespaces.seq.
+	seq uint64
 }
 
 // Distancer returns the internal mathx.Distancer if the Expiration field is set
@@ -28,6 +60,23 @@ func (d *DistancerContainer) Distancer() mathx.Distancer {
 	return d.D
 }
 
+// AddedTime returns the Added field, such that it is available in KNN results
+// (see knnc.ScanItem.Added).
+func (d *DistancerContainer) AddedTime() time.Time {
+	return d.Added
+}
+
+// ID returns the ID of the internal mathx.Distancer if it has an 'ID() string'
+// method (see mathx.FloatVec), empty otherwise. Unlike Distancer, this works
+// after expiration, such that expired data can be recognised, e.g with
+// knnc.NewSearchSpacesArgs.OnEvict.
+func (d *DistancerContainer) ID() string {
+	if ider, ok := d.D.(interface{ ID() string }); ok {
+		return ider.ID()
+	}
+	return ""
+}
+
 // Symbolic.
 var _ knnc.DistancerContainer = &DistancerContainer{}
 
@@ -47,6 +96,33 @@ type Handle struct {
 	// monitor keeps metadata about processed KNN requests, such as average
 	// accuracy, latency, satisfaction, etc.
 	monitor *knnMonitor
+
+	// latencyHalfLife is used for latency estimates in Handle.KNN if > 0.
+	// See NewHandleArgs.LatencyHalfLife.
+	latencyHalfLife time.Duration
+	// admissionFactor scales KNNArgs.TTL in the latency check of Handle.KNN.
+	// See NewHandleArgs.AdmissionFactor.
+	admissionFactor float64
+
+	// queryLog records a sample of KNN requests, nil if disabled. See
+	// NewHandleArgs.QueryLog.
+	queryLog *queryLog
+
+	// knn is Handle.knnCore wrapped with NewHandleArgs.KNNMiddleware, it is
+	// what Handle.KNN calls.
+	knn KNNFunc
+	// quotas enforces NewHandleArgs.TenantQuotas, nil if there are none.
+	quotas *tenantQuotas
+	// nearDup is NewHandleArgs.NearDup.
+	nearDup NearDupArgs
+	// wal logs writes before they are applied, nil if disabled. See
+	// NewHandleArgs.WAL.
+	wal *wal
+	// aliases are resolved by KNN requests, see Handle.CreateAlias.
+	aliases *namespaceAliases
+	// done is closed when the handle has wound down after ctx is done, see
+	// Handle.waitThenQuit.
+	done chan struct{}
 }
 
 // NewHandleArgs is intended as args for func NewHandle.
@@ -67,6 +143,12 @@ type NewHandleArgs struct {
 	// specifies how many KNN requests can be processed concurrently -- though
 	// each KNN request can use multiple goroutines individually.
 	KNNQueueMaxConcurrent int
+	// ScanMaxWorkers is optional, it caps the number of concurrent scan
+	// goroutines (see knnc.SearchSpaces.Scan) per KNN request. The number is
+	// otherwise derived from KNNArgs.Priority (capped by GOMAXPROCS), so this
+	// decouples scan parallelism from Priority, which still applies to the
+	// other pipeline stages. Must be >= 0, where 0 means no cap.
+	ScanMaxWorkers int
 
 	// Ctx is used to stop the KNN request queue. It will also be used to stop
 	// the maintanence loop for each namespaced (KNN) search space (for more
@@ -75,8 +157,64 @@ type NewHandleArgs struct {
 
 	// NewKNNMonitorArgs keeps instructions for how to make a new monitor.
 	// This includes same args as timex.NewLatencyArgs, as the internal
-	// data structure works the same way.
+	// data structure works the same way. The Clock field is used for the
+	// time buckets of the monitor, as well as for the latency of monitored
+	// requests.
 	NewKNNMonitorArgs timex.NewLatencyTrackerArgs
+	// MonitorSampleRate is the fraction of KNN requests with KNNArgs.Monitor
+	// that are actually monitored, which reduces the overhead of monitoring
+	// (a goroutine per request) under high load. The counts in KNNMonItemAvg
+	// (N, NFailed, SatisfactionHist) are scaled up accordingly, such that
+	// they are estimates of the total, while averages are kept as is.
+	// Optional, 0 defaults to 1 (i.e all). Must be in the range [0, 1].
+	MonitorSampleRate float64
+
+	// LatencyHalfLife is optional. If it is > 0, then Handle.KNN will estimate
+	// queue and query latency using timex.LatencyTracker.AverageDecayed with
+	// this half-life, instead of AverageSTD. This makes the TTL check more
+	// responsive to recent latency changes. Must be >= 0.
+	LatencyHalfLife time.Duration
+	// AdmissionFactor tunes how aggressively Handle.KNN admits requests, as
+	// a request is rejected if the estimated queue+query latency exceeds
+	// KNNArgs.TTL * AdmissionFactor. So values > 1 are more lenient (admits
+	// requests that might not finish in time), while values < 1 are more
+	// strict. Optional, 0 defaults to 1. Must be >= 0.
+	AdmissionFactor float64
+	// KNNBudget is optional, it splits KNNArgs.TTL between the phases of KNN
+	// requests (see KNNBudget), where the zero value lets each phase use all
+	// of the TTL that is left. KNNBudget.Ok() must return true.
+	KNNBudget KNNBudget
+
+	// QueryLog is optional, it configures a log of sampled KNN requests (from
+	// Handle.KNN and Handle.KNNBatch), which is useful for debugging and for
+	// replaying queries later on. Disabled if QueryLog.W is nil (default).
+	QueryLog QueryLogArgs
+
+	// KNNMiddleware is optional. It wraps Handle.KNN (see KNNMiddleware), where
+	// the first one is the outermost, i.e it is called first. This applies to
+	// Handle.KNNMulti as well (once per namespace), as it is built on top of
+	// Handle.KNN, but not to Handle.KNNBatch.
+	KNNMiddleware []KNNMiddleware
+
+	// TenantQuotas is optional, it maps tenant IDs (KNNArgs.Tenant and
+	// DistancerContainer.Tenant) to their TenantQuota. Tenants that are not
+	// in the map (including the empty one) are not limited. The QPS quota is
+	// enforced with a KNNMiddleware, applied after NewHandleArgs.KNNMiddleware.
+	TenantQuotas map[string]TenantQuota
+
+	// PostProcessor is optional, it changes the final result of all KNN
+	// requests (Handle.KNN, Handle.KNNBatch and Handle.KNNMulti, where it is
+	// applied per namespace), see PostProcessor.
+	PostProcessor PostProcessor
+
+	// NearDup is optional (disabled by default), it makes Handle.AddData
+	// reject data which is a near-duplicate of existing data, see NearDupArgs.
+	NearDup NearDupArgs
+
+	// WAL is optional, it configures a write-ahead log of all writes, which is
+	// replayed by NewHandle, such that data survives a crash. Disabled if
+	// WAL.Path is empty (default). See WALArgs and Handle.RotateWAL.
+	WAL WALArgs
 }
 
 // Ok returns true if the configuration kn NewHandleArgs is acceptable.
@@ -85,27 +223,58 @@ type NewHandleArgs struct {
 // - NewHandleArgs.NewLatencyTrackerArgs.Ok() == true
 // - NewHandleArgs.KNNQueueBuf >= 0
 // - NewHandleArgs.KNNQueueMaxConcurrent > 0
+// - NewHandleArgs.ScanMaxWorkers >= 0
 // - NewHandleArgs.Ctx != nil
 // - NewKNNMonitorArgs.Ok == true
+// - NewHandleArgs.MonitorSampleRate >= 0 && <= 1
+// - NewHandleArgs.LatencyHalfLife >= 0
+// - NewHandleArgs.AdmissionFactor >= 0
+// - NewHandleArgs.KNNBudget.Ok() == true
+// - NewHandleArgs.QueryLog.Ok() == true
+// - NewHandleArgs.KNNMiddleware does not contain nil
+// - TenantQuota.Ok() == true for all of NewHandleArgs.TenantQuotas
+// - NewHandleArgs.NearDup.Ok() == true
+// - NewHandleArgs.WAL.Ok() == true
 func (args *NewHandleArgs) Ok() bool {
 	ok := true
 	ok = ok && args.NewSearchSpaceArgs.Ok()
 	ok = ok && args.NewLatencyTrackerArgs.Ok()
 	ok = ok && args.KNNQueueBuf >= 0
 	ok = ok && args.KNNQueueMaxConcurrent > 0
+	ok = ok && args.ScanMaxWorkers >= 0
 	ok = ok && args.Ctx != nil
 	ok = ok && args.NewKNNMonitorArgs.Ok()
+	ok = ok && args.MonitorSampleRate >= 0 && args.MonitorSampleRate <= 1
+	ok = ok && args.LatencyHalfLife >= 0
+	ok = ok && args.AdmissionFactor >= 0
+	ok = ok && args.KNNBudget.Ok()
+	ok = ok && args.QueryLog.Ok()
+	for _, middleware := range args.KNNMiddleware {
+		ok = ok && middleware != nil
+	}
+	for _, quota := range args.TenantQuotas {
+		ok = ok && quota.Ok()
+	}
+	ok = ok && args.NearDup.Ok()
+	ok = ok && args.WAL.Ok()
 	return ok
 }
 
 // NewHandleArgs attempts to set up a new Handle. Returns (nil, false) if args.Ok
-// returns false. For more details, see doc for T Handle and T NewHandleArgs.
+// returns false, or if the write-ahead log (see NewHandleArgs.WAL) is enabled
+// but can not be opened or replayed. For more details, see doc for T Handle
+// and T NewHandleArgs.
 func NewHandle(args NewHandleArgs) (*Handle, bool) {
 	if !args.Ok() {
 		return nil, false
 	}
 
 	lt, _ := timex.NewLatencyTracker(args.NewLatencyTrackerArgs)
+	admissionFactor := args.AdmissionFactor
+	if admissionFactor == 0 {
+		admissionFactor = 1
+	}
+
 	h := Handle{
 		knnNamespaces: &knnNamespaces{
 			items:                 make(map[string]knnNamespacesItem),
@@ -113,19 +282,43 @@ func NewHandle(args NewHandleArgs) (*Handle, bool) {
 			newLatencyTrackerArgs: args.NewLatencyTrackerArgs,
 		},
 		knnQueue: knnQueue{
-			latency:       lt,
-			queue:         make(chan knnQueueItem, args.KNNQueueBuf),
-			maxConcurrent: args.KNNQueueMaxConcurrent,
-			ctx:           args.Ctx,
+			latency:        lt,
+			queue:          make(chan knnQueueItem, args.KNNQueueBuf),
+			maxConcurrent:  args.KNNQueueMaxConcurrent,
+			scanMaxWorkers: args.ScanMaxWorkers,
+			postProcessor:  args.PostProcessor,
+			budget:         args.KNNBudget,
+			ctx:            args.Ctx,
 		},
 		ctx: args.Ctx,
 		monitor: &knnMonitor{
 			averages: &timedLinkedList[KNNMonItemAvg]{
 				maxChainLinkN:    args.NewKNNMonitorArgs.MaxChainLinkN,
 				minChainLinkSize: args.NewKNNMonitorArgs.MinChainLinkSize,
+				clock:            args.NewKNNMonitorArgs.Clock,
 			},
+			sampleRate: args.MonitorSampleRate,
 		},
+		latencyHalfLife: args.LatencyHalfLife,
+		admissionFactor: admissionFactor,
+		queryLog:        newQueryLog(args.Ctx, args.QueryLog),
+		nearDup:         args.NearDup,
+		aliases:         &namespaceAliases{targets: make(map[string]string)},
+		done:            make(chan struct{}),
+	}
+	h.quotas = newTenantQuotas(args.TenantQuotas, h.countTenantVecs)
+	middleware := args.KNNMiddleware
+	if h.quotas != nil {
+		middleware = append(append([]KNNMiddleware{}, middleware...), h.quotas.middleware())
+	}
+	h.knn = chainKNNMiddleware(h.knnCore, middleware)
+
+	// Set after the replay, such that it is not logged again.
+	wal, err := openWAL(&h, args.WAL)
+	if err != nil {
+		return nil, false
 	}
+	h.wal = wal
 
 	go h.knnQueue.startProcessing()
 	go h.waitThenQuit()
@@ -133,8 +326,11 @@ func NewHandle(args NewHandleArgs) (*Handle, bool) {
 }
 
 // waitThenQuit waits for Handle.ctx to be done, then stops the maintenance of
-// all namespaced KNN search spaces. This method will block.
+// all namespaced KNN search spaces, closes the write-ahead log and waits for
+// the query log to write its pending entries (if they are enabled). Handle.done
+// is closed when this is finished. This method will block.
 func (h *Handle) waitThenQuit() {
+	defer close(h.done)
 	select {
 	case <-h.ctx.Done():
 		for _, v := range h.knnNamespaces.items {
@@ -144,6 +340,12 @@ func (h *Handle) waitThenQuit() {
 
 			v.searchSpaces.StopMaintenance()
 		}
+		if h.wal != nil {
+			h.wal.close()
+		}
+		if h.queryLog != nil {
+			<-h.queryLog.done
+		}
 	}
 }
 
@@ -152,20 +354,272 @@ func (h *Handle) waitThenQuit() {
 // Returns false on either of the following conditions:
 // - ctx used when creating the Handle (NewHandle(...)) signalled done.
 // - DistancerContainer.D == nil.
+// - the elements of DistancerContainer.D do not pass mathx.ValidDistancer, i.e
+//   the vec is empty or contains NaN/Inf elements.
 // - the knnc.SearchSpaces instance used for this namespace returns false
 //   on the method AddSearchable(d).
 //
-// TODO: currently, only the Distancer is stored, as any other means
-// of persisting data is not yet implemented.
+// See Handle.AddDataErr for a variant which reports the reason for failure.
+//
+// TODO: currently, 'data' is only stored in memory (see
+// DistancerContainer.Data), as any other means of persisting data is not yet
+// implemented.
 func (h *Handle) AddData(ns string, d DistancerContainer, data []byte) bool {
+	return h.AddDataErr(ns, d, data) == nil
+}
+
+// AddDataErr is the same as Handle.AddData, except that it returns a non-nil
+// error describing the reason on failure, instead of false. Errors are:
+// - ErrHandleClosed if the ctx used when creating the Handle signalled done.
+// - An error wrapping mathx.ErrVecNil if DistancerContainer.D == nil.
+// - An error wrapping one of the mathx.ErrVecX errors if the elements of
+//   DistancerContainer.D do not pass mathx.ValidDistancer.
+// - ErrDimMismatch if the namespace has data with a different dimension.
+// - ErrNearDuplicate if the namespace has a near-duplicate of the data (only
+//   if enabled with NewHandleArgs.NearDup).
+// - ErrQuotaExceeded if DistancerContainer.Tenant is at its TenantQuota.MaxVecs.
+// - ErrDataRejected if the data was not accepted by the namespace for other
+//   reasons, for instance due to capacity.
+// - An error wrapping ErrWAL if the write-ahead log is enabled (see
+//   NewHandleArgs.WAL) and the data could not be logged.
+func (h *Handle) AddDataErr(ns string, d DistancerContainer, data []byte) error {
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return ErrHandleClosed
+	default:
+	}
+
+	// == nil does not work as expected.
+	if d.D == nil || reflect.ValueOf(d.D).IsNil() {
+		return fmt.Errorf("requestman: invalid vec: %w", mathx.ErrVecNil)
+	}
+	if err := mathx.ValidDistancer(d.D); err != nil {
+		return fmt.Errorf("requestman: invalid vec: %w", err)
+	}
+	if h.hasNearDup(ns, d.D) {
+		return ErrNearDuplicate
+	}
+	if h.quotas != nil && !h.quotas.reserveVec(d.Tenant) {
+		return ErrQuotaExceeded
+	}
+	if d.Added.IsZero() {
+		d.Added = time.Now()
+	}
+	d.Data = data
+	if h.wal != nil {
+		h.wal.mx.Lock()
+		defer h.wal.mx.Unlock()
+		if err := h.wal.appendAdd(ns, &d); err != nil {
+			if h.quotas != nil {
+				h.quotas.releaseVec(d.Tenant)
+			}
+			return err
+		}
+	}
+
+	if !h.knnNamespaces.put(ns, d) {
+		if h.quotas != nil {
+			h.quotas.releaseVec(d.Tenant)
+		}
+		// Only classifies the failure, so it does not matter if this races.
+		if pinned, _ := h.Info().SSpacePinnedDim(ns); pinned != 0 && pinned != d.D.Dim() {
+			return ErrDimMismatch
+		}
+		dim, _ := h.Info().SSpaceDim(ns)
+		_, nVecs, _ := h.Info().SSpaceLen(ns)
+		if nVecs != 0 && dim != d.D.Dim() {
+			return ErrDimMismatch
+		}
+		return ErrDataRejected
+	}
+	return nil
+}
+
+// CreateNamespace creates a namespace with a pinned vec dimension, such that
+// Handle.AddData only accepts data with that dimension in the namespace (it
+// otherwise accepts any dimension if the namespace is empty). This is useful
+// for making sure that multiple Handle instances (e.g on different nodes) agree
+// on the dimension of a namespace. An existing namespace is pinned instead of
+// re-created, and pinning the same dim again is a no-op. Errors are:
+// - ErrHandleClosed if the ctx used when creating the Handle signalled done.
+// - ErrInvalidDim if dim <= 0.
+// - ErrDimMismatch if the namespace is already pinned to another dim, or if
+//   it has data with another dim.
+// - ErrDataRejected if the namespace could not be created.
+// - An error wrapping ErrWAL if the write-ahead log is enabled (see
+//   NewHandleArgs.WAL) and the namespace could not be logged.
+//
+// See Handle.CreateNamespaceWithArgs for more options.
+func (h *Handle) CreateNamespace(ns string, dim int) error {
+	return h.CreateNamespaceWithArgs(CreateNamespaceArgs{Namespace: ns, Dim: dim})
+}
+
+// CreateNamespaceArgs is intended as args for Handle.CreateNamespaceWithArgs.
+type CreateNamespaceArgs struct {
+	// Namespace is the name of the namespace.
+	Namespace string
+	// Dim is the vec dimension which the namespace is pinned to, see
+	// Handle.CreateNamespace. Must be > 0.
+	Dim int
+	// DefaultKNNMethod is used for KNN requests in the namespace which use
+	// KNNMethodNamespaceDefault, such that they do not have to specify the
+	// KNNMethod. Other requests are not affected, i.e the KNNMethod can still
+	// be set per request. Must be ok (see KNNMethod.Ok), the zero value is
+	// KNNMethodEuclideanDistance. It is set again if the namespace exists,
+	// but it is not kept in snapshots or the write-ahead log.
+	DefaultKNNMethod KNNMethod
+}
+
+// CreateNamespaceWithArgs is the same as Handle.CreateNamespace, except that it
+// takes more options, see CreateNamespaceArgs. It additionally returns
+// ErrInvalidKNNMethod if !args.DefaultKNNMethod.Ok().
+func (h *Handle) CreateNamespaceWithArgs(args CreateNamespaceArgs) error {
 	// Check if handle is shut down.
 	select {
 	case <-h.ctx.Done():
-		return false
+		return ErrHandleClosed
 	default:
 	}
 
-	return h.knnNamespaces.put(ns, d)
+	if args.Dim <= 0 {
+		return ErrInvalidDim
+	}
+	if !args.DefaultKNNMethod.Ok() {
+		return ErrInvalidKNNMethod
+	}
+	if h.wal != nil {
+		h.wal.mx.Lock()
+		defer h.wal.mx.Unlock()
+		if err := h.wal.appendNamespace(args.Namespace, args.Dim); err != nil {
+			return err
+		}
+	}
+	if err := h.knnNamespaces.pinDim(args.Namespace, args.Dim); err != nil {
+		return err
+	}
+	return h.knnNamespaces.setDefaultMethod(args.Namespace, args.DefaultKNNMethod)
+}
+
+// DeleteWhere deletes all data in a namespace where 'pred' returns true, and
+// returns how many were deleted. 'pred' gets the ID (see DistancerContainer.ID),
+// the vec and DistancerContainer.Added of each item, including expired ones. For
+// example, deleting all data added before a time 't':
+//
+//	h.DeleteWhere(ns, func(id string, d mathx.Distancer, added time.Time) bool {
+//		return added.Before(t)
+//	})
+//
+// Returns 0 if the namespace does not exist, or if the ctx used when creating
+// the Handle signalled done. Note that 'pred' is called while holding a lock
+// (see knnc.SearchSpaces.Remove), so it must not use this Handle.
+//
+// If the write-ahead log is enabled (see NewHandleArgs.WAL), then 'pred' is
+// called on a snapshot of the namespace (see knnc.SearchSpaces.Snapshot), and
+// the matches are logged before they are deleted. Nothing is deleted if they
+// can not be logged.
+func (h *Handle) DeleteWhere(
+	ns string,
+	pred func(id string, d mathx.Distancer, added time.Time) bool,
+) int {
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return 0
+	default:
+	}
+
+	nsItem, ok := h.knnNamespaces.get(ns)
+	if !ok || pred == nil {
+		return 0
+	}
+	if h.wal == nil {
+		return h.removeWhere(nsItem, func(dc *DistancerContainer) bool {
+			return pred(dc.ID(), dc.D, dc.Added)
+		})
+	}
+
+	h.wal.mx.Lock()
+	defer h.wal.mx.Unlock()
+	var matches []*DistancerContainer
+	matched := make(map[*DistancerContainer]struct{})
+	for _, container := range nsItem.searchSpaces.Snapshot() {
+		dc, ok := container.(*DistancerContainer)
+		if ok && pred(dc.ID(), dc.D, dc.Added) {
+			matches = append(matches, dc)
+			matched[dc] = struct{}{}
+		}
+	}
+	if len(matches) == 0 || h.wal.appendDelete(ns, matches) != nil {
+		return 0
+	}
+	return h.removeWhere(nsItem, func(dc *DistancerContainer) bool {
+		_, ok := matched[dc]
+		return ok
+	})
+}
+
+// removeWhere is the core of Handle.DeleteWhere, it removes all containers in
+// the namespace where 'pred' returns true (also from the pq and metadata
+// indexes, if any) and releases their tenant quotas. Returns how many were
+// removed.
+func (h *Handle) removeWhere(nsItem knnNamespacesItem, pred func(dc *DistancerContainer) bool) int {
+	var tenants []string
+	// Kept for removing the same containers from the indexes (if any), such
+	// that 'pred' is called once per container.
+	removed := make(map[knnc.DistancerContainer]struct{})
+	n := nsItem.searchSpaces.Remove(func(container knnc.DistancerContainer) bool {
+		dc, ok := container.(*DistancerContainer)
+		if !ok || !pred(dc) {
+			return false
+		}
+		tenants = append(tenants, dc.Tenant)
+		removed[container] = struct{}{}
+		return true
+	})
+	if nsItem.pq != nil && n != 0 {
+		nsItem.pq.Remove(func(container knnc.DistancerContainer) bool {
+			_, ok := removed[container]
+			return ok
+		})
+	}
+	if nsItem.metaIndex != nil && n != 0 {
+		nsItem.metaIndex.removeSet(removed)
+	}
+	if n != 0 {
+		h.knnNamespaces.touch(nsItem)
+	}
+	if h.quotas != nil {
+		for _, tenant := range tenants {
+			h.quotas.releaseVec(tenant)
+		}
+	}
+	return n
+}
+
+// countTenantVecs counts the non-expired data stored with the given
+// DistancerContainer.Tenant, across all namespaces.
+func (h *Handle) countTenantVecs(tenant string) int {
+	n := 0
+	namespaces, _ := h.knnNamespaces.snapshot()
+	for _, ns := range namespaces {
+		for _, container := range ns.containers {
+			dc, ok := container.(*DistancerContainer)
+			if ok && dc.Tenant == tenant && dc.Distancer() != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// distancerElements copies the elements of a mathx.Distancer into a slice.
+func distancerElements(d mathx.Distancer) []float64 {
+	s := make([]float64, d.Dim())
+	for i := range s {
+		s[i], _ = d.Peek(i)
+	}
+	return s
 }
 
 // KNN attempts to enqueue a KNN request, see docs for KNNEnqueueResult for more
@@ -173,8 +627,50 @@ func (h *Handle) AddData(ns string, d DistancerContainer, data []byte) bool {
 // - args.Ok() == false
 // - ctx used when creating the Handle (NewHandle(...)) signalled done.
 // - args.Namespace is unknown / not yet created with Handle.AddData(...).
-// - args.TTL is lower than the estimated queue+query time.
+// - args.TTL (scaled by NewHandleArgs.AdmissionFactor) is lower than the
+//   estimated queue+query time. The returned KNNEnqueueResult.RetryAfter
+//   is set to that estimate in this case.
+// - a KNNMiddleware (see NewHandleArgs.KNNMiddleware) returns false.
+// - args.Tenant exceeds its TenantQuota.QPS. The returned KNNEnqueueResult
+//   has Err set to ErrQuotaExceeded and RetryAfter to the time until the
+//   tenant is allowed another request.
+// - args.QueryVec is a zero vector with KNNMethodCosineSimilarity, where the
+//   similarity is undefined (see KNNArgs.ZeroVecMode for the alternatives).
+//   The returned KNNEnqueueResult has Err set to ErrZeroQueryVec.
 func (h *Handle) KNN(args KNNArgs) (KNNEnqueueResult, bool) {
+	return h.knn(args)
+}
+
+// KNNEager is the same as Handle.KNN, except that it waits (at most args.TTL)
+// for the first result of the request, which is returned along with the
+// KNNEnqueueResult (e.g for Stats). This is cheaper than receiving from the
+// pipe of Handle.KNN when args.Monitor is set, as the result is registered
+// with the monitor directly instead of through a listener goroutine. Returns
+// a false bool on the conditions listed in the doc of Handle.KNN, or if the
+// TTL is exceeded, in which case the request is cancelled.
+func (h *Handle) KNNEager(args KNNArgs) (KNNEnqueueResult, knnc.ScoreItems, bool) {
+	stamp := h.monitor.averages.now()
+	args.monitorSync = true
+	enqueueResult, ok := h.knn(args)
+	if !ok {
+		return enqueueResult, nil, false
+	}
+
+	select {
+	case <-time.After(args.TTL + time.Microsecond):
+		enqueueResult.Cancel.Cancel()
+		return enqueueResult, nil, false
+	case result, open := <-enqueueResult.Pipe:
+		if args.Monitor && open {
+			latency := h.monitor.averages.now().Sub(stamp)
+			h.monitor.observe(args.Namespace, result, args.MaxK(), latency)
+		}
+		return enqueueResult, result, true
+	}
+}
+
+// knnCore is the impl of Handle.KNN, without KNNMiddleware.
+func (h *Handle) knnCore(args KNNArgs) (KNNEnqueueResult, bool) {
 	if !args.Ok() {
 		return KNNEnqueueResult{}, false
 	}
@@ -186,31 +682,216 @@ func (h *Handle) KNN(args KNNArgs) (KNNEnqueueResult, bool) {
 	default:
 	}
 
-	// Namespace check.
-	nsItem, ok := h.knnNamespaces.get(args.Namespace)
+	// Namespace check, see Handle.CreateAlias for aliases.
+	nsItem, ok := h.knnNamespaces.get(h.aliases.resolve(args.Namespace))
 	if !ok {
 		return KNNEnqueueResult{}, false
 	}
+	args.resolveMethod(nsItem)
+	if args.zeroQuery() {
+		return KNNEnqueueResult{Err: ErrZeroQueryVec}, false
+	}
 
 	// Latency check.
-	avgQueueWait, _ := h.knnQueue.latency.AverageSTD()
-	avgQueryWait, _ := nsItem.latency.AverageSTD()
-	if avgQueueWait+avgQueryWait > args.TTL {
-		return KNNEnqueueResult{}, false
+	avgQueueWait := h.estimateLatency(h.knnQueue.latency)
+	avgQueryWait := h.estimateLatency(nsItem.latency)
+	if float64(avgQueueWait+avgQueryWait) > float64(args.TTL)*h.admissionFactor {
+		return KNNEnqueueResult{RetryAfter: avgQueueWait + avgQueryWait}, false
 	}
 
 	request := newKNNRequest(&args)
 	h.knnQueue.queue <- knnQueueItem{nsItem: nsItem, request: request}
 	// Optional listen to result.
-	if args.Monitor {
-		enqueueResult := h.monitor.register(knnMonitorRegisterArgs{
-			knnEnqueueResult: request.enqueueResult,
-			k:                args.K,
+	enqueueResult := request.enqueueResult
+	if args.Monitor && !args.monitorSync {
+		enqueueResult = h.monitor.register(knnMonitorRegisterArgs{
+			knnEnqueueResult: enqueueResult,
+			namespace:        args.Namespace,
+			k:                args.MaxK(),
 			ttl:              args.TTL,
 		})
-		return enqueueResult, true
 	}
-	return request.enqueueResult, true
+	if h.queryLog != nil {
+		enqueueResult = h.queryLog.register(args, enqueueResult)
+	}
+	return enqueueResult, true
+}
+
+// KNNBatch is the equivalent of Handle.KNN for multiple requests on the same
+// namespace, where the requests share a single scan of the data (instead of
+// one scan each), i.e the scan cost is amortized. The requests are otherwise
+// independent, e.g they can be cancelled individually. The returned results
+// are in the same order as 'args'. Returns a false bool on the conditions
+// listed in the doc of Handle.KNN (applied to each of 'args'), in addition to:
+// - len(args) == 0
+// - the args have different Namespace, Extent or RandomSeed values.
+// In the TTL case, RetryAfter is set for all returned results, as is Err in the
+// ErrZeroQueryVec case, while the returned slice is nil in other fail cases.
+func (h *Handle) KNNBatch(args []KNNArgs) ([]KNNEnqueueResult, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	// Requests keep a ref to their args.
+	args = append([]KNNArgs(nil), args...)
+	for i := range args {
+		if !args[i].Ok() {
+			return nil, false
+		}
+		ok := true
+		ok = ok && args[i].Namespace == args[0].Namespace
+		ok = ok && args[i].Extent == args[0].Extent
+		ok = ok && args[i].RandomSeed == args[0].RandomSeed
+		if !ok {
+			return nil, false
+		}
+	}
+
+	// Check if handle is shut down.
+	select {
+	case <-h.ctx.Done():
+		return nil, false
+	default:
+	}
+
+	// Namespace check, see Handle.CreateAlias for aliases.
+	nsItem, ok := h.knnNamespaces.get(h.aliases.resolve(args[0].Namespace))
+	if !ok {
+		return nil, false
+	}
+	for i := range args {
+		args[i].resolveMethod(nsItem)
+		if !args[i].zeroQuery() {
+			continue
+		}
+		results := make([]KNNEnqueueResult, len(args))
+		for j := range results {
+			results[j] = KNNEnqueueResult{Err: ErrZeroQueryVec}
+		}
+		return results, false
+	}
+
+	// Latency check, against the shortest TTL.
+	avgQueueWait := h.estimateLatency(h.knnQueue.latency)
+	avgQueryWait := h.estimateLatency(nsItem.latency)
+	results := make([]KNNEnqueueResult, len(args))
+	for i := range args {
+		if float64(avgQueueWait+avgQueryWait) <= float64(args[i].TTL)*h.admissionFactor {
+			continue
+		}
+		for j := range results {
+			results[j] = KNNEnqueueResult{RetryAfter: avgQueueWait + avgQueryWait}
+		}
+		return results, false
+	}
+
+	batch := make([]knnRequest, len(args))
+	for i := range args {
+		batch[i] = newKNNRequest(&args[i])
+		results[i] = batch[i].enqueueResult
+	}
+	h.knnQueue.queue <- knnQueueItem{nsItem: nsItem, batch: batch}
+	// Optional listen to results.
+	for i := range args {
+		if args[i].Monitor {
+			results[i] = h.monitor.register(knnMonitorRegisterArgs{
+				knnEnqueueResult: results[i],
+				namespace:        args[i].Namespace,
+				k:                args[i].MaxK(),
+				ttl:              args[i].TTL,
+			})
+		}
+		if h.queryLog != nil {
+			results[i] = h.queryLog.register(args[i], results[i])
+		}
+	}
+	return results, true
+}
+
+// KNNMulti is the equivalent of Handle.KNN for a query over multiple namespaces,
+// where the results of all of them are merged into a single result (of at most
+// args.MaxK() items, ordered with args.Ascending). The namespace that each item
+// came from is kept as knnc.ScoreItem.Source. args.Namespace is ignored, as each
+// namespace is queried with a separate Handle.KNN call (so monitoring and the
+// query log apply per namespace). The returned KNNEnqueueResult.Cancel cancels
+// all of them, while Stats is not set. Returns a false bool if:
+// - len(namespaces) == 0
+// - Handle.KNN returns false for any of the namespaces, see the docs of that
+//   method. Requests for other namespaces are cancelled in this case, while
+//   RetryAfter is set if it was set by Handle.KNN.
+func (h *Handle) KNNMulti(args KNNArgs, namespaces []string) (KNNEnqueueResult, bool) {
+	if len(namespaces) == 0 {
+		return KNNEnqueueResult{}, false
+	}
+
+	results := make([]KNNEnqueueResult, 0, len(namespaces))
+	for _, ns := range namespaces {
+		nsArgs := args
+		nsArgs.Namespace = ns
+		result, ok := h.KNN(nsArgs)
+		if !ok {
+			for _, result := range results {
+				result.Cancel.Cancel()
+			}
+			return KNNEnqueueResult{RetryAfter: result.RetryAfter, Err: result.Err}, false
+		}
+		results = append(results, result)
+	}
+
+	out := KNNEnqueueResult{
+		Pipe:   make(chan knnc.ScoreItems),
+		Cancel: knnc.NewCancelSignal(),
+	}
+
+	// Leak prevention.
+	ctx, ctxCancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(args.TTL*10),
+	)
+
+	// Forward cancellation until the merge is done.
+	go func() {
+		select {
+		case <-out.Cancel.Done():
+			for _, result := range results {
+				result.Cancel.Cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		defer close(out.Pipe)
+		defer ctxCancel()
+
+		merged := make(knnc.ScoreItems, args.MaxK())
+		for _, result := range results {
+			safeChanIter(safeChanIterArgs[knnc.ScoreItems]{
+				ch:  result.Pipe,
+				ctx: ctx,
+				rcv: func(scoreItems knnc.ScoreItems) bool {
+					for _, scoreItem := range scoreItems {
+						merged.BubbleInsert(scoreItem, args.Ascending)
+					}
+					return true
+				},
+			})
+		}
+		safeChanSend(safeChanSendArgs[knnc.ScoreItems]{ch: out.Pipe, ctx: ctx, elm: merged})
+	}()
+
+	return out, true
+}
+
+// estimateLatency gives the average latency of the given tracker, used for the
+// TTL check in Handle.KNN. Uses timex.LatencyTracker.AverageDecayed if
+// Handle.latencyHalfLife > 0, otherwise timex.LatencyTracker.AverageSTD.
+func (h *Handle) estimateLatency(lt *timex.LatencyTracker) time.Duration {
+	if h.latencyHalfLife > 0 {
+		d, _ := lt.AverageDecayed(h.latencyHalfLife)
+		return d
+	}
+	d, _ := lt.AverageSTD()
+	return d
 }
 
 /*
@@ -256,6 +937,18 @@ func (i *info) SSpaceDim(key string) (int, bool) {
 	return ssItem.searchSpaces.Dim(), true
 }
 
+// SSpacePinnedDim returns the vec dimension pinned with Handle.CreateNamespace
+// for a namespace, which is 0 if it is not pinned. Returns false if the
+// namespace does not exist.
+func (i *info) SSpacePinnedDim(key string) (int, bool) {
+	ssItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return 0, false
+	}
+
+	return ssItem.dim, true
+}
+
 // SSpaceLen forwards the call to- and return from knnc.SearchSpaces.Len for a
 // search space associated with a namespace. Returns false if the namespace
 // does not exist.
@@ -269,6 +962,20 @@ func (i *info) SSpaceLen(key string) (int, int, bool) {
 	return nSearchSpaces, nData, true
 }
 
+// SSpaceVersion returns the version of a namespace, which changes whenever the
+// namespace is mutated, i.e when data is added or deleted, or when its backend
+// or default KNN method is changed. Versions are unique across namespaces, also
+// if a namespace is deleted and created again, so an unchanged version means
+// unchanged KNN results (for the same query). Note that expiration of data is
+// not a mutation. Returns false if the namespace does not exist.
+func (i *info) SSpaceVersion(key string) (uint64, bool) {
+	nsItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return 0, false
+	}
+	return atomic.LoadUint64(nsItem.version), true
+}
+
 // SSpaceCap forwards the call to- and return from knnc.SearchSpaces.Cap for a
 // search space associated with a namespace. Returns false if the namespace
 // does not exist.
@@ -281,6 +988,82 @@ func (i *info) SSpaceCap(key string) (int, bool) {
 	return ssItem.searchSpaces.Cap(), true
 }
 
+// NamespaceVec is a vec in a namespace along with its ID (see
+// DistancerContainer.ID), see info.SSpaceVecs.
+type NamespaceVec struct {
+	ID  string
+	Vec []float64
+}
+
+// SSpaceVecs returns a copy of all (non-expired) vecs in a namespace, e.g for
+// using them as query vecs. Returns false if the namespace does not exist.
+func (i *info) SSpaceVecs(key string) ([]NamespaceVec, bool) {
+	ssItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return nil, false
+	}
+
+	snapshot := ssItem.searchSpaces.Snapshot()
+	r := make([]NamespaceVec, 0, len(snapshot))
+	for _, container := range snapshot {
+		d := container.Distancer()
+		if d == nil {
+			continue
+		}
+		id := ""
+		if dc, ok := container.(*DistancerContainer); ok {
+			id = dc.ID()
+		}
+		r = append(r, NamespaceVec{ID: id, Vec: distancerElements(d)})
+	}
+	return r, true
+}
+
+// StoredVec is a vec stored in a namespace along with its metadata, see
+// info.SSpaceVecByID.
+type StoredVec struct {
+	ID      string
+	Vec     []float64
+	Data    []byte
+	Added   time.Time
+	Expires time.Time
+}
+
+// SSpaceVecByID returns a copy of the (non-expired) vec with the given ID in a
+// namespace, along with its payload (see DistancerContainer.Data). If there
+// are multiple vecs with the ID (they are not required to be unique), then the
+// most recently added one is returned. Returns false if the namespace does not
+// exist or if it has no such vec. Note that this scans the namespace, as IDs
+// are not indexed, so it is not intended for the hot path.
+func (i *info) SSpaceVecByID(key string, id string) (StoredVec, bool) {
+	ssItem, ok := i.h.knnNamespaces.get(key)
+	if !ok {
+		return StoredVec{}, false
+	}
+
+	var found *DistancerContainer
+	for _, container := range ssItem.searchSpaces.Snapshot() {
+		dc, ok := container.(*DistancerContainer)
+		if !ok || dc.ID() != id || dc.Distancer() == nil {
+			continue
+		}
+		if found == nil || dc.seq > found.seq {
+			found = dc
+		}
+	}
+	if found == nil {
+		return StoredVec{}, false
+	}
+
+	return StoredVec{
+		ID:      id,
+		Vec:     distancerElements(found.D),
+		Data:    append([]byte(nil), found.Data...),
+		Added:   found.Added,
+		Expires: found.Expires,
+	}, true
+}
+
 // KNNQueueLatency forwards the call to- and return from the "Average" method
 // of the timex.LatencyTracker instance associated with the KNN queue.
 // In other words, it returns the average KNN queue latency for a given period.
@@ -300,15 +1083,26 @@ func (i *info) KNNQueryLatency(k string, d time.Duration) (time.Duration, bool)
 	return ns.latency.Average(d)
 }
 
-// KNNMonitor returns knn monitoring data for the given period. Note that
-// 'start' should be _after_ 'end', which might be counter-intuitive.
+// KNNMonitor returns knn monitoring data for the given namespace and period.
+// Use KNNMonitorAllNamespaces as 'ns' to get the aggregate for all namespaces.
+// Note that 'start' should be _after_ 'end', which might be counter-intuitive.
 // So to get data created the last minute:
 //
 //  now := time.Now()
-//  x.KNNMonitor(now, now.Add(-time.Minute))
+//  x.KNNMonitor("ns", now, now.Add(-time.Minute))
 //
 // The reason for this is that 'start' and 'end' is relative to the internal
-// linked list where 'head' and 'tail' is in reverse chronological order.
-func (i *info) KNNMonitor(start, end time.Time) KNNMonItemAvg {
-    return i.h.monitor.average(start, end)
+// linked list where 'head' and 'tail' is in reverse chronological order. The
+// BoundsOk field of the result is false if the period is longer than what is
+// retained (see NewHandleArgs.NewKNNMonitorArgs).
+func (i *info) KNNMonitor(ns string, start, end time.Time) KNNMonItemAvg {
+    return i.h.monitor.average(ns, start, end)
+}
+
+// KNNMonitorSeries is the same as info.KNNMonitor, except that the result is a
+// time series, i.e the KNNMonItemAvg of each time bucket in the period (where
+// a bucket is NewHandleArgs.NewKNNMonitorArgs.MinChainLinkSize long), oldest
+// first. Buckets without any KNN requests are left out.
+func (i *info) KNNMonitorSeries(ns string, start, end time.Time) []KNNMonItemAvg {
+	return i.h.monitor.series(ns, start, end)
 }
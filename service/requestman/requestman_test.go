@@ -2,8 +2,14 @@ package requestman
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,11 +26,8 @@ func init() {
 // args:
 // - sSpaceMaxN is used for SearchSpacesMaxCap and SearchSpaceMaxN.
 // - knnQueueN is used for knnQueue.queue buf and MaxConcurrent.
-// - ctx is used as context for the handle. Accepts nil.
+// - ctx is used as context for the handle, see also newTestHandleCleanup.
 func newTestHandle(sSpaceMaxN, knnQueueN int, ctx context.Context) *Handle {
-	if ctx == nil {
-		ctx = context.Background()
-	}
 	h, ok := NewHandle(NewHandleArgs{
 		NewSearchSpaceArgs: knnc.NewSearchSpacesArgs{
 			SearchSpacesMaxCap:      sSpaceMaxN,
@@ -52,6 +55,20 @@ func newTestHandle(sSpaceMaxN, knnQueueN int, ctx context.Context) *Handle {
 	return h
 }
 
+// Convenience, same as newTestHandle but with a ctx which is cancelled when the
+// test (and its subtests) finish, after which it waits for the handle to wind
+// down (see Handle.waitThenQuit). This way, no goroutines of the handle are
+// left running, which would otherwise disturb leak checks of later tests.
+func newTestHandleCleanup(t testing.TB, sSpaceMaxN, knnQueueN int) *Handle {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	h := newTestHandle(sSpaceMaxN, knnQueueN, ctx)
+	t.Cleanup(func() {
+		ctxCancel()
+		<-h.done
+	})
+	return h
+}
+
 // Convenience, makes a random (valid) KNNRequest with TTL=time.Minute.
 // Panics if vec creation fails or returned KNNargs.OK() == false.
 func newTestKNNArgs(dim int, ns string) KNNArgs {
@@ -83,7 +100,7 @@ func newTestKNNArgs(dim int, ns string) KNNArgs {
 func TestHandleAddData(t *testing.T) {
 	ns := "test"
 	dc := DistancerContainer{D: mathx.NewSafeVec(9)}
-	h := newTestHandle(100, 100, nil)
+	h := newTestHandleCleanup(t, 100, 100)
 
 	if ok := h.AddData(ns, dc, []byte{}); !ok {
 		t.Fatal("got not-ok when adding data")
@@ -104,6 +121,569 @@ func TestHandleAddData(t *testing.T) {
 	}
 }
 
+func TestHandleOnEvict(t *testing.T) {
+	ids := make(chan string, 1)
+	h := newTestHandleCleanup(t, 100, 100)
+	h.knnNamespaces.newSearchSpaceArgs.OnEvict = func(id string, reason knnc.EvictReason) {
+		if reason == knnc.EvictExpired {
+			ids <- id
+		}
+	}
+
+	dc := DistancerContainer{
+		D:       mathx.NewFloatVecWithID([]float64{1, 2}, "x"),
+		Expires: time.Now().Add(time.Millisecond * 10),
+	}
+	if ok := h.AddData("test", dc, nil); !ok {
+		t.Fatal("got not-ok when adding data")
+	}
+
+	// Cleaned by the maintenance loop (see newTestHandle for the interval).
+	select {
+	case id := <-ids:
+		if id != "x" {
+			t.Fatal("unexpected evicted id:", id)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("expired data was not evicted")
+	}
+}
+
+func TestHandleAddDataInvalidVec(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	for _, tc := range []struct {
+		d   mathx.Distancer
+		err error
+	}{
+		{d: nil, err: mathx.ErrVecNil},
+		{d: (*mathx.SafeVec)(nil), err: mathx.ErrVecNil},
+		{d: mathx.NewSafeVec(), err: mathx.ErrVecEmpty},
+		{d: mathx.NewSafeVec(1, math.NaN()), err: mathx.ErrVecNaN},
+		{d: mathx.NewSafeVec(math.Inf(-1), 1), err: mathx.ErrVecInf},
+	} {
+		err := h.AddDataErr(ns, DistancerContainer{D: tc.d}, []byte{})
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("want err %v, have %v", tc.err, err)
+		}
+		if h.AddData(ns, DistancerContainer{D: tc.d}, []byte{}) {
+			t.Fatal("expected not-ok when adding invalid data")
+		}
+	}
+
+	// Valid data after the rejected ones; scores should not be corrupt.
+	for i := 0; i < 10; i++ {
+		v, _ := mathx.NewSafeVecRand(2)
+		if err := h.AddDataErr(ns, DistancerContainer{D: v}, []byte{}); err != nil {
+			t.Fatal("unexpected err when adding valid data:", err)
+		}
+	}
+	_, n, _ := h.Info().SSpaceLen(ns)
+	if n != 10 {
+		t.Fatal("unexpected search space len:", n)
+	}
+
+	// Valid vec, but not the dim of the namespace.
+	err := h.AddDataErr(ns, DistancerContainer{D: mathx.NewSafeVec(1, 2, 3)}, []byte{})
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("want err %v, have %v", ErrDimMismatch, err)
+	}
+
+	args := newTestKNNArgs(2, ns)
+	args.KNNMethod = KNNMethodEuclideanDistance
+	args.Extent = 1
+	r, ok := h.KNN(args)
+	if !ok {
+		t.Fatal("unexpected not-ok KNN request")
+	}
+	for _, item := range (<-r.Pipe).Trim() {
+		if math.IsNaN(item.Score) {
+			t.Fatal("got NaN score")
+		}
+	}
+}
+
+func TestHandleCreateNamespace(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	if err := h.CreateNamespace(ns, 0); !errors.Is(err, ErrInvalidDim) {
+		t.Fatalf("want err %v, have %v", ErrInvalidDim, err)
+	}
+	if err := h.CreateNamespace(ns, 5); err != nil {
+		t.Fatal("unexpected err when creating namespace:", err)
+	}
+	if dim, ok := h.Info().SSpacePinnedDim(ns); !ok || dim != 5 {
+		t.Fatalf("unexpected pinned dim: %v (ok=%v)", dim, ok)
+	}
+	// Same dim is a no-op, another one is not.
+	if err := h.CreateNamespace(ns, 5); err != nil {
+		t.Fatal("unexpected err when re-creating namespace:", err)
+	}
+	if err := h.CreateNamespace(ns, 3); !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("want err %v, have %v", ErrDimMismatch, err)
+	}
+
+	// Rejected even though the namespace is empty.
+	err := h.AddDataErr(ns, DistancerContainer{D: mathx.NewSafeVec(1, 2, 3)}, nil)
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("want err %v, have %v", ErrDimMismatch, err)
+	}
+	v, _ := mathx.NewSafeVecRand(5)
+	if err := h.AddDataErr(ns, DistancerContainer{D: v}, nil); err != nil {
+		t.Fatal("unexpected err when adding data:", err)
+	}
+
+	// Pinning an existing namespace checks its data.
+	if !h.AddData("other", DistancerContainer{D: mathx.NewSafeVec(1, 2)}, nil) {
+		t.Fatal("got not-ok when adding data")
+	}
+	if err := h.CreateNamespace("other", 3); !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("want err %v, have %v", ErrDimMismatch, err)
+	}
+	if err := h.CreateNamespace("other", 2); err != nil {
+		t.Fatal("unexpected err when pinning existing namespace:", err)
+	}
+}
+
+func TestHandleCreateNamespaceDefaultKNNMethod(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	err := h.CreateNamespaceWithArgs(CreateNamespaceArgs{
+		Namespace:        ns,
+		Dim:              2,
+		DefaultKNNMethod: KNNMethodNamespaceDefault,
+	})
+	if !errors.Is(err, ErrInvalidKNNMethod) {
+		t.Fatalf("want err %v, have %v", ErrInvalidKNNMethod, err)
+	}
+	err = h.CreateNamespaceWithArgs(CreateNamespaceArgs{
+		Namespace:        ns,
+		Dim:              2,
+		DefaultKNNMethod: KNNMethodCosineSimilarity,
+	})
+	if err != nil {
+		t.Fatal("unexpected err when creating namespace:", err)
+	}
+
+	// 'cosine' is nearest with cosine similarity, 'euclidean' with Euclidean distance.
+	for id, v := range map[string][]float64{"cosine": {10, 0}, "euclidean": {1, 0.5}} {
+		if !h.AddData(ns, DistancerContainer{D: mathx.NewFloatVecWithID(v, id)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+	// 'ascending' sets Accept and Reject, such that neither is hit.
+	nearest := func(method KNNMethod, ascending bool) string {
+		accept, reject := 1e9, -1e9
+		if ascending {
+			accept, reject = reject, accept
+		}
+		r, ok := h.KNN(KNNArgs{
+			Namespace: ns,
+			Priority:  1,
+			QueryVec:  []float64{1, 0},
+			KNNMethod: method,
+			Ascending: ascending,
+			K:         1,
+			Extent:    1,
+			Accept:    accept,
+			Reject:    reject,
+			TTL:       time.Minute,
+		})
+		if !ok {
+			t.Fatalf("got not-ok for a KNN request with method %v", method)
+		}
+		id := ""
+		for items := range r.Pipe {
+			for _, item := range items {
+				id = item.ID
+			}
+		}
+		return id
+	}
+
+	// Ascending is set for the default method, i.e it is false here.
+	if id := nearest(KNNMethodNamespaceDefault, false); id != "cosine" {
+		t.Fatalf("unexpected nearest with the default method: %q", id)
+	}
+	// The method can still be set per request.
+	if id := nearest(KNNMethodEuclideanDistance, true); id != "euclidean" {
+		t.Fatalf("unexpected nearest with Euclidean distance: %q", id)
+	}
+}
+
+func TestHandleDeleteWhere(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	// Old and new data, with a cutoff in between.
+	add := func(prefix string) {
+		for i := 0; i < 5; i++ {
+			v := mathx.NewFloatVecWithID([]float64{float64(i), 1}, fmt.Sprint(prefix, i))
+			if err := h.AddDataErr(ns, DistancerContainer{D: v}, nil); err != nil {
+				t.Fatal("unexpected err when adding data:", err)
+			}
+		}
+	}
+	add("old")
+	time.Sleep(time.Millisecond * 10)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond * 10)
+	add("new")
+
+	olderThanCutoff := func(id string, d mathx.Distancer, added time.Time) bool {
+		if added.IsZero() {
+			t.Error("unexpected zero added time for id:", id)
+		}
+		return added.Before(cutoff)
+	}
+	if n := h.DeleteWhere(ns, olderThanCutoff); n != 5 {
+		t.Fatal("unexpected delete count:", n)
+	}
+	if n := h.DeleteWhere(ns, olderThanCutoff); n != 0 {
+		t.Fatal("unexpected delete count on second call:", n)
+	}
+	if n := h.DeleteWhere("unknown", olderThanCutoff); n != 0 {
+		t.Fatal("unexpected delete count for unknown namespace:", n)
+	}
+
+	var ids []string
+	nsItem, _ := h.knnNamespaces.get(ns)
+	for _, container := range nsItem.searchSpaces.Snapshot() {
+		ids = append(ids, container.(*DistancerContainer).ID())
+	}
+	sort.Strings(ids)
+	want := "[new0 new1 new2 new3 new4]"
+	if fmt.Sprint(ids) != want {
+		t.Fatalf("want remaining ids %v, have %v", want, ids)
+	}
+}
+
+func TestHandleSSpaceVecByID(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+	if _, ok := h.Info().SSpaceVecByID("test", "a"); ok {
+		t.Fatal("got a vec from a namespace which does not exist")
+	}
+
+	add := func(vec []float64, id string, data string, expires time.Time) {
+		dc := DistancerContainer{D: mathx.NewFloatVecWithID(vec, id), Expires: expires}
+		if err := h.AddDataErr("test", dc, []byte(data)); err != nil {
+			t.Fatal("unexpected err when adding data:", err)
+		}
+	}
+	add([]float64{1, 2}, "a", "old", time.Time{})
+	add([]float64{3, 4}, "a", "new", time.Time{})
+	add([]float64{5, 6}, "b", "expired", time.Now().Add(time.Millisecond*10))
+	time.Sleep(time.Millisecond * 20)
+
+	// Most recently added.
+	r, ok := h.Info().SSpaceVecByID("test", "a")
+	if !ok || r.ID != "a" || string(r.Data) != "new" || r.Added.IsZero() {
+		t.Fatalf("unexpected vec: %+v", r)
+	}
+	if len(r.Vec) != 2 || r.Vec[0] != 3 || r.Vec[1] != 4 {
+		t.Fatalf("unexpected elements: %v", r.Vec)
+	}
+	if _, ok := h.Info().SSpaceVecByID("test", "b"); ok {
+		t.Fatal("got an expired vec")
+	}
+	if _, ok := h.Info().SSpaceVecByID("test", "c"); ok {
+		t.Fatal("got a vec which does not exist")
+	}
+}
+
+func TestHandleSSpaceVersion(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+	if _, ok := h.Info().SSpaceVersion("test"); ok {
+		t.Fatal("got a version for a namespace which does not exist")
+	}
+
+	versions := make(map[uint64]bool)
+	// mutated fails if the version is unchanged (or used before), after 'f'.
+	mutated := func(desc string, f func()) {
+		f()
+		version, ok := h.Info().SSpaceVersion("test")
+		if !ok || versions[version] {
+			t.Fatalf("version unchanged after %v: %v", desc, version)
+		}
+		versions[version] = true
+	}
+	add := func() {
+		v, _ := randFloat64Slice(2)
+		if err := h.AddDataErr("test", DistancerContainer{D: mathx.NewSafeVec(v...)}, nil); err != nil {
+			t.Fatal("unexpected err when adding data:", err)
+		}
+	}
+	mutated("create", func() { h.CreateNamespace("test", 2) })
+	mutated("add", add)
+	mutated("add", add)
+
+	// Not mutations.
+	version, _ := h.Info().SSpaceVersion("test")
+	h.DeleteWhere("test", func(string, mathx.Distancer, time.Time) bool { return false })
+	h.KNNEager(newTestKNNArgs(2, "test"))
+	if v, _ := h.Info().SSpaceVersion("test"); v != version {
+		t.Fatal("version changed without a mutation")
+	}
+
+	mutated("delete", func() {
+		h.DeleteWhere("test", func(string, mathx.Distancer, time.Time) bool { return true })
+	})
+	mutated("recreate", func() {
+		h.knnNamespaces.Lock()
+		h.knnNamespaces.del("test")
+		h.knnNamespaces.Unlock()
+		h.CreateNamespace("test", 2)
+	})
+}
+
+func TestHandleKNNMulti(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+
+	// Vecs on a line, where "a" has the integer distances to the origin and
+	// "b" has the ones in between.
+	n := 5
+	for i := 0; i < n; i++ {
+		if !h.AddData("a", DistancerContainer{D: mathx.NewSafeVec(float64(i), 0)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+		if !h.AddData("b", DistancerContainer{D: mathx.NewSafeVec(float64(i)+0.5, 0)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	args := KNNArgs{
+		Priority:  1,
+		QueryVec:  []float64{0, 0},
+		KNNMethod: KNNMethodEuclideanDistance,
+		Ascending: true,
+		K:         n * 2,
+		Extent:    1,
+		Accept:    -1,
+		Reject:    100,
+		TTL:       time.Minute,
+	}
+	r, ok := h.KNNMulti(args, []string{"a", "b"})
+	if !ok {
+		t.Fatal("unexpected not-ok KNNMulti request")
+	}
+	result := (<-r.Pipe).Trim()
+	if len(result) != n*2 {
+		t.Fatalf("want %v results, have %v", n*2, len(result))
+	}
+	for i, item := range result {
+		want := "a"
+		if i%2 == 1 {
+			want = "b"
+		}
+		if item.Score != float64(i)/2 || item.Source != want {
+			t.Fatalf("item %v: unexpected score/source: %v/%q", i, item.Score, item.Source)
+		}
+	}
+
+	// Any unknown namespace fails the request.
+	if _, ok := h.KNNMulti(args, []string{"a", "missing"}); ok {
+		t.Fatal("unexpected ok KNNMulti request with an unknown namespace")
+	}
+	if _, ok := h.KNNMulti(args, nil); ok {
+		t.Fatal("unexpected ok KNNMulti request without namespaces")
+	}
+
+	// Cancelled requests still close the pipe.
+	r, ok = h.KNNMulti(args, []string{"a", "b"})
+	if !ok {
+		t.Fatal("unexpected not-ok KNNMulti request")
+	}
+	r.Cancel.Cancel()
+	for range r.Pipe {
+	}
+}
+
+func TestHandleKNNRangeQuery(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	// Vecs on a line, i.e the Euclidean distance to the origin is i.
+	for i := 0; i < 10; i++ {
+		v := mathx.NewSafeVec(float64(i), 0)
+		if ok := h.AddData(ns, DistancerContainer{D: v}, []byte{}); !ok {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	for _, tc := range []struct {
+		k      int
+		radius float64
+		want   []float64
+	}{
+		{k: 0, radius: 3.5, want: []float64{0, 1, 2, 3}},
+		{k: 0, radius: 3, want: []float64{0, 1, 2, 3}}, // Inclusive.
+		{k: 0, radius: 100, want: []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{k: 0, radius: -1, want: []float64{}},
+		{k: 2, radius: 3.5, want: []float64{0, 1}}, // Capped.
+	} {
+		args := newTestKNNArgs(2, ns)
+		args.QueryVec = []float64{0, 0}
+		args.KNNMethod = KNNMethodEuclideanDistance
+		args.Ascending = true
+		args.Extent = 1
+		args.K = tc.k
+		args.Accept = 100 // Would abort early if it was not ignored.
+		args.RangeQuery = true
+		args.Radius = tc.radius
+
+		r, ok := h.KNN(args)
+		if !ok {
+			t.Fatal("unexpected not-ok KNN request")
+		}
+		result := (<-r.Pipe).Trim()
+		if len(result) != len(tc.want) {
+			s := "radius %v, k %v: unexpected result len: want %v, have %v"
+			t.Fatalf(s, tc.radius, tc.k, len(tc.want), len(result))
+		}
+		for i, item := range result {
+			if item.Score != tc.want[i] {
+				s := "radius %v, k %v: unexpected score no. %v: want %v, have %v"
+				t.Fatalf(s, tc.radius, tc.k, i, tc.want[i], item.Score)
+			}
+		}
+	}
+
+	// K=0 is only valid for range queries.
+	args := newTestKNNArgs(2, ns)
+	args.K = 0
+	if args.Ok() {
+		t.Fatal("expected not-ok KNNArgs with K=0")
+	}
+	args.RangeQuery = true
+	if !args.Ok() || args.MaxK() != DefaultRangeQueryMaxK {
+		t.Fatal("unexpected args for a range query with K=0")
+	}
+}
+
+func TestHandleKNNBatch(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	// Vecs on a line, i.e the Euclidean distance to the origin is i.
+	for i := 0; i < 10; i++ {
+		v := mathx.NewSafeVec(float64(i), 0)
+		if ok := h.AddData(ns, DistancerContainer{D: v}, []byte{}); !ok {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	wants := []float64{2, 7, 9}
+	args := make([]KNNArgs, len(wants))
+	for i, want := range wants {
+		args[i] = newTestKNNArgs(2, ns)
+		args[i].QueryVec = []float64{want, 0.1}
+		args[i].KNNMethod = KNNMethodEuclideanDistance
+		args[i].Ascending = true
+		args[i].Extent = 1
+		args[i].K = 1
+		args[i].Accept = 0
+		args[i].Reject = 100
+	}
+
+	rs, ok := h.KNNBatch(args)
+	if !ok || len(rs) != len(wants) {
+		t.Fatal("unexpected not-ok KNN batch")
+	}
+	for i, r := range rs {
+		result := (<-r.Pipe).Trim()
+		if len(result) != 1 {
+			t.Fatalf("request %v: unexpected result len %v", i, len(result))
+		}
+		if have, _ := result[0].Distancer.Peek(0); have != wants[i] {
+			t.Fatalf("request %v: want nearest %v, have %v", i, wants[i], have)
+		}
+	}
+
+	// Args must share namespace and extent.
+	args[1].Extent = 0.5
+	if _, ok := h.KNNBatch(args); ok {
+		t.Fatal("unexpected ok KNN batch with different extents")
+	}
+	args[1].Extent = 1
+	args[1].Namespace = "other"
+	if _, ok := h.KNNBatch(args); ok {
+		t.Fatal("unexpected ok KNN batch with different namespaces")
+	}
+	if _, ok := h.KNNBatch(nil); ok {
+		t.Fatal("unexpected ok empty KNN batch")
+	}
+}
+
+func TestHandleKNNRegisteredMetric(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+
+	// Vecs on a line, i.e the Manhattan distance to (0, 0) is 2i.
+	for i := 0; i < 10; i++ {
+		v := mathx.NewSafeVec(float64(i), float64(-i))
+		if ok := h.AddData(ns, DistancerContainer{D: v}, []byte{}); !ok {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	name := "test-manhattan"
+	manhattan := func(a, b mathx.Distancer) (float64, bool) {
+		if a.Dim() != b.Dim() {
+			return 0, false
+		}
+		score := 0.
+		for i := 0; i < a.Dim(); i++ {
+			x, _ := a.Peek(i)
+			y, _ := b.Peek(i)
+			score += math.Abs(x - y)
+		}
+		return score, true
+	}
+	// Might already be registered with go test -count > 1.
+	RegisterMetric(name, manhattan, false)
+	if RegisterMetric(name, manhattan, false) {
+		t.Fatal("registered the same name twice")
+	}
+	if RegisterMetric("", manhattan, false) || RegisterMetric("x", nil, false) {
+		t.Fatal("registered an invalid metric")
+	}
+
+	args := newTestKNNArgs(2, ns)
+	args.QueryVec = []float64{0, 0}
+	args.Metric = name
+	args.Ascending, _ = MetricAscending(name, false)
+	args.K = 3
+	args.Extent = 1
+	args.Accept = -1 // Never accept early.
+	args.Reject = math.MaxFloat64
+
+	r, ok := h.KNN(args)
+	if !ok {
+		t.Fatal("unexpected not-ok KNN request")
+	}
+	result := (<-r.Pipe).Trim()
+	if len(result) != args.K {
+		t.Fatal("unexpected result len:", len(result))
+	}
+	for i, item := range result {
+		if item.Score != float64(i*2) {
+			t.Fatalf("unexpected score no. %v: %v", i, item.Score)
+		}
+	}
+
+	// Unregistered.
+	args.Metric = "unregistered"
+	if args.Ok() {
+		t.Fatal("expected not-ok KNNArgs with an unregistered metric")
+	}
+	if _, ok := MetricAscending(args.Metric, false); ok {
+		t.Fatal("expected not-ok MetricAscending with an unregistered metric")
+	}
+}
+
 // NOTE: Weak test, it only checks that multiple concurrent KNN requests
 // go through (KNNArgs.TTL=Hour so everything passes), and don't return empty.
 func TestHandleKNN(t *testing.T) {
@@ -160,11 +740,460 @@ func TestHandleKNN(t *testing.T) {
 	}
 
 	ctxCancel()
-	// Check leaks.
+	<-h.done
+	// Check leaks. The maintenance of the namespace stops in the background,
+	// so give it time.
 	runtime.GC()
-	if nGoroutines != runtime.NumGoroutine() {
-		s := "number of goroutines at the end of this test is not the"
-		s += " same as at the start; possible leak. Want %v, have %v."
+	deadline := time.Now().Add(time.Second * 5)
+	for runtime.NumGoroutine() > nGoroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if runtime.NumGoroutine() > nGoroutines {
+		s := "number of goroutines at the end of this test is higher"
+		s += " than at the start; possible leak. Want %v, have %v."
 		t.Fatalf(s, nGoroutines, runtime.NumGoroutine())
 	}
 }
+
+func TestHandleKNNInvalidQueryVec(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+	if ok := h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(1, 2)}, []byte{}); !ok {
+		t.Fatal("got not-ok when adding data")
+	}
+
+	for _, v := range [][]float64{nil, {}, {1, math.NaN()}, {math.Inf(1), 1}} {
+		args := newTestKNNArgs(2, ns)
+		args.QueryVec = v
+		if args.Ok() {
+			t.Fatalf("expected not-ok KNNArgs with query vec %v", v)
+		}
+		if _, ok := h.KNN(args); ok {
+			t.Fatalf("expected rejected request with query vec %v", v)
+		}
+	}
+}
+
+func TestHandleKNNZeroQueryVec(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+	if ok := h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(1, 2)}, []byte{}); !ok {
+		t.Fatal("got not-ok when adding data")
+	}
+
+	args := newTestKNNArgs(2, ns)
+	args.QueryVec = []float64{0, 0}
+	if !args.Ok() {
+		t.Fatal("expected ok KNNArgs with a zero query vec")
+	}
+	if r, ok := h.KNN(args); ok || r.Err != ErrZeroQueryVec {
+		t.Fatalf("unexpected result with a zero query vec: ok=%v, err=%v", ok, r.Err)
+	}
+	if r, ok := h.KNNBatch([]KNNArgs{args}); ok || len(r) != 1 || r[0].Err != ErrZeroQueryVec {
+		t.Fatalf("unexpected batch result with a zero query vec: %v, ok=%v", r, ok)
+	}
+
+	// The zero vec is fine with Euclidean distance and with other modes.
+	for _, setup := range []func(*KNNArgs){
+		func(args *KNNArgs) {
+			args.KNNMethod = KNNMethodEuclideanDistance
+			args.Ascending = true
+			args.Accept, args.Reject = 0, 100
+		},
+		func(args *KNNArgs) {
+			args.ZeroVecMode = mathx.ZeroVecModeZero
+			args.Accept, args.Reject = 1, -1
+		},
+	} {
+		args := args
+		setup(&args)
+		r, ok := h.KNN(args)
+		if !ok || r.Err != nil {
+			t.Fatalf("unexpected rejection with args %+v: %v", args, r.Err)
+		}
+		n := 0
+		for items := range r.Pipe {
+			for _, item := range items {
+				if item.Set {
+					n++
+				}
+			}
+		}
+		if n != 1 {
+			t.Fatalf("unexpected amt of results with args %+v: %v", args, n)
+		}
+	}
+}
+
+func TestHandleKNNResultIDs(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+	for i := 0; i < 20; i++ {
+		v, _ := randFloat64Slice(3)
+		dc := DistancerContainer{D: mathx.NewFloatVecWithID(v, fmt.Sprint("id", i))}
+		if !h.AddData(ns, dc, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	args := newTestKNNArgs(3, ns)
+	args.Extent = 1
+	args.Accept = 1
+	args.Reject = -1
+	r, ok := h.KNN(args)
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+	n := 0
+	for items := range r.Pipe {
+		for _, item := range items {
+			if !item.Set {
+				continue
+			}
+			n++
+			if want := item.Distancer.(*mathx.FloatVec).ID(); item.ID != want {
+				t.Fatalf("unexpected id of a result: want %q, have %q", want, item.ID)
+			}
+		}
+	}
+	if n == 0 {
+		t.Fatal("got no results")
+	}
+}
+
+func TestHandleKNNRandomSeed(t *testing.T) {
+	ns := "test"
+	n := 200
+	h := newTestHandleCleanup(t, 20, 100)
+	for i := 0; i < n; i++ {
+		v, _ := randFloat64Slice(3)
+		dc := DistancerContainer{D: mathx.NewFloatVecWithID(v, fmt.Sprint("id", i))}
+		if !h.AddData(ns, dc, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	args := newTestKNNArgs(3, ns)
+	args.KNNMethod = KNNMethodEuclideanDistance
+	args.Ascending = true
+	args.K = n
+	args.Extent = 0.2
+	// Never reached, i.e the whole extent is always searched.
+	args.Accept = -1
+	args.Reject = math.MaxFloat64
+
+	// candidates returns the IDs of all results (i.e all searched items, as
+	// K is the size of the namespace), sorted.
+	candidates := func(seed int64) string {
+		args.RandomSeed = seed
+		_, items, ok := h.KNNEager(args)
+		if !ok {
+			t.Fatal("got not-ok for a KNN request")
+		}
+		ids := make([]string, 0, len(items))
+		for i, item := range items {
+			if i > 0 && item.Score < items[i-1].Score {
+				t.Fatalf("unordered results with seed %v", seed)
+			}
+			ids = append(ids, item.ID)
+		}
+		if len(ids) == 0 || len(ids) == n {
+			t.Fatalf("unexpected amt of candidates with seed %v: %v", seed, len(ids))
+		}
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+
+	samples := make(map[string]bool)
+	for seed := int64(1); seed <= 5; seed++ {
+		sample := candidates(seed)
+		if candidates(seed) != sample {
+			t.Fatalf("different candidates with the same seed: %v", seed)
+		}
+		samples[sample] = true
+	}
+	if len(samples) < 2 {
+		t.Fatal("all seeds gave the same candidates")
+	}
+}
+
+func TestHandleKNNFewerThanK(t *testing.T) {
+	ns := "test"
+	poolSize := 3
+	h := newTestHandleCleanup(t, 100, 100)
+	for i := 0; i < poolSize; i++ {
+		v, _ := randFloat64Slice(3)
+		if !h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	args := newTestKNNArgs(3, ns)
+	args.K = poolSize * 3
+	args.Extent = 1
+	args.Accept = 1
+	args.Reject = -1
+	r, ok := h.KNN(args)
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+	for items := range r.Pipe {
+		if len(items) != poolSize {
+			t.Fatalf("unexpected amt of results: want %v, have %v", poolSize, len(items))
+		}
+		for i, item := range items {
+			if !item.Set || item.Distancer == nil {
+				t.Fatalf("result no. %v is unset", i)
+			}
+		}
+	}
+}
+
+func TestHandleKNNLatencyHalfLife(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+	h.latencyHalfLife = time.Second
+
+	ns := "test"
+	if ok := h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(1, 2)}, []byte{}); !ok {
+		t.Fatal("got not-ok when adding data")
+	}
+
+	// Simulate a recent latency spike in the queue.
+	h.knnQueue.latency.Register(time.Hour)
+
+	args := newTestKNNArgs(2, ns)
+	if _, ok := h.KNN(args); ok {
+		t.Fatal("expected request to be rejected due to estimated latency > TTL")
+	}
+
+	// Invalid cfg.
+	handleArgs := NewHandleArgs{LatencyHalfLife: -1}
+	if handleArgs.Ok() {
+		t.Fatal("expected not-ok NewHandleArgs with a negative LatencyHalfLife")
+	}
+}
+
+func TestHandleKNNAdmissionFactor(t *testing.T) {
+	ns := "test"
+	latency := time.Millisecond * 100
+
+	for _, tc := range []struct {
+		factor float64
+		admit  bool
+	}{
+		{factor: 1.5, admit: true},
+		{factor: 0.5, admit: false},
+	} {
+		h := newTestHandleCleanup(t, 100, 100)
+		h.admissionFactor = tc.factor
+
+		v := mathx.NewSafeVec(1, 2)
+		if ok := h.AddData(ns, DistancerContainer{D: v}, []byte{}); !ok {
+			t.Fatal("got not-ok when adding data")
+		}
+		h.knnQueue.latency.Register(latency)
+
+		// Just below the estimated latency.
+		args := newTestKNNArgs(2, ns)
+		args.TTL = latency - time.Millisecond*5
+
+		r, ok := h.KNN(args)
+		if ok != tc.admit {
+			t.Fatalf("factor %v: want admitted=%v, have %v", tc.factor, tc.admit, ok)
+		}
+		if ok {
+			r.Cancel.Cancel()
+		}
+	}
+
+	// Invalid cfg.
+	handleArgs := NewHandleArgs{AdmissionFactor: -1}
+	if handleArgs.Ok() {
+		t.Fatal("expected not-ok NewHandleArgs with a negative AdmissionFactor")
+	}
+}
+
+func TestHandleKNNRetryAfter(t *testing.T) {
+	ns := "test"
+	h := newTestHandleCleanup(t, 100, 100)
+	if ok := h.AddData(ns, DistancerContainer{D: mathx.NewSafeVec(1, 2)}, []byte{}); !ok {
+		t.Fatal("got not-ok when adding data")
+	}
+
+	// Simulate an over-subscribed queue.
+	h.knnQueue.latency.Register(time.Second)
+
+	args := newTestKNNArgs(2, ns)
+	args.TTL = time.Millisecond * 100
+	r, ok := h.KNN(args)
+	if ok {
+		t.Fatal("expected request to be rejected")
+	}
+	// Estimate is the average latency of the queue (and an empty query tracker).
+	if r.RetryAfter != time.Second {
+		t.Fatal("unexpected retry hint:", r.RetryAfter)
+	}
+
+	// Not rejected due to latency, so no hint.
+	args.Namespace = "unknown"
+	if r, _ := h.KNN(args); r.RetryAfter != 0 {
+		t.Fatal("unexpected retry hint for unknown namespace:", r.RetryAfter)
+	}
+}
+
+func TestHandleKNNEager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Requests are held in the post processor, such that goroutines can be
+	// counted while all of them are in flight.
+	n := 20
+	entered := make(chan struct{}, n)
+	release := make(chan struct{})
+	h := newTestHandle(100, n, ctx)
+	h.knnQueue.postProcessor = func(args KNNArgs, items knnc.ScoreItems) knnc.ScoreItems {
+		entered <- struct{}{}
+		<-release
+		return items
+	}
+
+	dim := 3
+	for i := 0; i < 10; i++ {
+		v, _ := randFloat64Slice(dim)
+		if !h.AddData("test", DistancerContainer{D: mathx.NewSafeVec(v...)}, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+	args := newTestKNNArgs(dim, "test")
+	args.Extent = 1
+	args.Reject = -1
+	args.K = 5
+	args.Monitor = true
+
+	// Number of goroutines with all n requests in flight, for the given func.
+	inFlight := func(f func()) int {
+		wg := sync.WaitGroup{}
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func() { defer wg.Done(); f() }()
+		}
+		for i := 0; i < n; i++ {
+			<-entered
+		}
+		r := runtime.NumGoroutine()
+		for i := 0; i < n; i++ {
+			release <- struct{}{}
+		}
+		wg.Wait()
+		return r
+	}
+
+	nEager := inFlight(func() {
+		if _, result, ok := h.KNNEager(args); !ok || len(result.Trim()) != args.K {
+			t.Error("unexpected eager result")
+		}
+	})
+	now := time.Now()
+	r := h.Info().KNNMonitor("test", now, now.Add(-time.Second))
+	if r.N != n || r.AvgSatisfaction != 1 {
+		t.Fatalf("unexpected monitor stats of eager requests: %+v", r)
+	}
+
+	// Same, but each request has a listener goroutine (knnMonitor.register).
+	nAsync := inFlight(func() {
+		enqueueResult, ok := h.KNN(args)
+		if !ok {
+			t.Error("got not-ok for a KNN request")
+			return
+		}
+		<-enqueueResult.Pipe
+	})
+	if nAsync-nEager < n/2 {
+		t.Fatalf("want ~%v fewer goroutines with eager requests, have %v", n, nAsync-nEager)
+	}
+}
+
+func TestHandleKNNFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newTestHandle(100, 100, ctx)
+	dim := 3
+	n := 40
+	for i := 0; i < n; i++ {
+		category := []string{"a", "b"}[i%2]
+		v, _ := randFloat64Slice(dim)
+		dc := DistancerContainer{
+			D:        mathx.NewFloatVecWithID(v, fmt.Sprintf("%s-%d", category, i)),
+			Metadata: map[string]string{"category": category},
+		}
+		if !h.AddData("test", dc, nil) {
+			t.Fatal("got not-ok when adding data")
+		}
+	}
+
+	args := newTestKNNArgs(dim, "test")
+	args.K = 10
+	args.Extent = 1
+	args.Accept = 2 // Never reached with cosine similarity.
+	args.Reject = -2
+	args.Filter = map[string]string{"category": "a"}
+
+	enqueueResult, items, ok := h.KNNEager(args)
+	if !ok {
+		t.Fatal("got not-ok for a KNN request")
+	}
+	items = items.Trim()
+	if len(items) != args.K {
+		t.Fatalf("unexpected number of results: %v", len(items))
+	}
+	for _, item := range items {
+		if id := item.Distancer.(*mathx.FloatVec).ID(); !strings.HasPrefix(id, "a-") {
+			t.Fatalf("got a result with a non-matching category: %q", id)
+		}
+	}
+	// Non-matching candidates are not scored.
+	if stats := enqueueResult.Stats; stats.Unmatched != n/2 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats: %+v", *stats)
+	}
+}
+
+// benchmarkAddData simulates bulk ingest through Handle.AddDataErr, where vecs
+// are decoded from a request and then wrapped as a mathx.Distancer (see
+// ops.Server.AddData), such that the allocations of the whole add path are
+// reported, not just the ones of the wrapper.
+func benchmarkAddData(b *testing.B, wrap func([]float64) mathx.Distancer) {
+	dim := 128
+	vecs := make([][]float64, 1000)
+	for i := range vecs {
+		vecs[i], _ = randFloat64Slice(dim)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A new Handle per round, so the namespace does not fill up.
+		b.StopTimer()
+		ctx, cancel := context.WithCancel(context.Background())
+		h := newTestHandle(len(vecs), 1, ctx)
+		b.StartTimer()
+
+		for _, vec := range vecs {
+			if err := h.AddDataErr("bench", DistancerContainer{D: wrap(vec)}, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.StopTimer()
+		cancel()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkAddDataSafeVec(b *testing.B) {
+	benchmarkAddData(b, func(vec []float64) mathx.Distancer { return mathx.NewSafeVec(vec...) })
+}
+
+func BenchmarkAddDataFloatVec(b *testing.B) {
+	benchmarkAddData(b, func(vec []float64) mathx.Distancer { return mathx.NewFloatVec(vec) })
+}
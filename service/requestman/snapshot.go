@@ -0,0 +1,470 @@
+package requestman
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+/*
+File contains snapshots, i.e a binary format for writing all data of a Handle to
+an io.Writer (Handle.Snapshot), such that it can be restored later, possibly by
+another Handle (Handle.Restore). Snapshots can also be deltas, i.e only contain
+data added since an earlier snapshot (see SnapshotArgs.Since).
+
+The format starts with snapshotMagic, followed by records. Each record starts
+with a single byte (snapshotRecordX) which tells what follows:
+	- snapshotRecordVersion: two uint64, the first is SnapshotArgs.Since (0
+	  if this is not a delta) and the second is the version of the snapshot.
+	- snapshotRecordNamespace: a string (namespace) and uint32 (pinned dim, 0
+	  if not pinned). The following item records belong to this namespace.
+	- snapshotRecordItem: a uint32 (dim), dim * float64 (vec), int64 (expires,
+	  as unix nanoseconds, 0 if not set), a string (ID, see mathx.FloatVec)
+	  and int64 (DistancerContainer.Added, as unix nanoseconds).
+	- snapshotRecordEnd: ends the snapshot.
+Strings are written as a uint32 (length) followed by the bytes. Everything is
+little endian. The entire snapshot may be gzip compressed, see SnapshotArgs.
+
+Snapshots with snapshotMagicV1 are the same, except that item records do not
+have the last int64 (added). They can still be restored.
+
+Snapshots can be concatenated, e.g a delta can be appended to the file of the
+snapshot it is based on (see Handle.AppendSnapshotFile), such that the file is
+a simple log. Each appended snapshot starts with its own magic. Restore reads
+all of them, where items with an ID replace earlier items with the same ID (in
+the same namespace). Compressed snapshots can only be concatenated with other
+compressed snapshots, as the gzip streams are then read as one (multistream).
+*/
+
+// snapshotMagic is written first in every (uncompressed) snapshot.
+const snapshotMagic = "ddrop:snapshot:v2\n"
+
+// snapshotMagicV1 is the magic of snapshots without added times in items.
+const snapshotMagicV1 = "ddrop:snapshot:v1\n"
+
+// gzipMagic is the first bytes of a gzip stream, used to detect compression.
+const gzipMagic = "\x1f\x8b"
+
+// Record types of a snapshot, see the doc at the top of this file.
+const (
+	snapshotRecordEnd byte = iota
+	snapshotRecordNamespace
+	snapshotRecordItem
+	snapshotRecordVersion
+)
+
+// Limits used when reading a snapshot, such that a corrupt snapshot does not
+// cause huge allocations.
+const (
+	snapshotMaxStrLen = 1 << 16
+	snapshotMaxDim    = 1 << 24
+)
+
+// ErrInvalidSnapshot is returned by Handle.Restore if the snapshot can not be
+// read, e.g if it is corrupt or not a snapshot at all.
+var ErrInvalidSnapshot = errors.New("requestman: invalid snapshot")
+
+// SnapshotArgs is intended as args for Handle.SnapshotWithArgs.
+type SnapshotArgs struct {
+	// W is where the snapshot is written.
+	W io.Writer
+	// Compress wraps W with gzip if true. This makes the snapshot (a lot)
+	// smaller for high-dimensional data, at the cost of some cpu. Handle.Restore
+	// detects compression, so this does not have to be specified when restoring.
+	Compress bool
+	// Since is optional. If > 0, then the snapshot is a delta, i.e it only
+	// contains data added after the snapshot with this version was made (the
+	// version is returned by Handle.SnapshotWithArgs). A delta is restored by
+	// restoring the snapshot it is based on first, followed by the delta(s), in
+	// order. Namespaces (and pinned dims) are always included.
+	//
+	// Note that removals are not recorded in deltas. This is fine for
+	// expiration, as the expiration time is kept with the data itself
+	// (including in the base snapshot). Data deleted with Handle.DeleteWhere,
+	// on the other hand, is restored from the base snapshot, so a new base
+	// snapshot should be made after deleting.
+	Since uint64
+}
+
+// Ok returns true if the configuration of SnapshotArgs is acceptable.
+// Specifically:
+// - SnapshotArgs.W != nil
+func (args *SnapshotArgs) Ok() bool {
+	return args.W != nil
+}
+
+// Snapshot calls Handle.SnapshotWithArgs with SnapshotArgs.W = w, without
+// compression and not as a delta. See the docs of that method for more details.
+func (h *Handle) Snapshot(w io.Writer) (uint64, error) {
+	return h.SnapshotWithArgs(SnapshotArgs{W: w})
+}
+
+// SnapshotWithArgs writes all namespaces (including pinned dims) and the data
+// in them to args.W, such that it can be restored with Handle.Restore. Data is
+// written as vecs (i.e the elements of each mathx.Distancer), along with the
+// expiration time, the ID (if the Distancer has an 'ID() string' method, see
+// mathx.FloatVec) and DistancerContainer.Added. Expired data is left out.
+//
+// Data is copied from all namespaces (see knnc.SearchSpaces.Snapshot) before it
+// is written, so concurrent writes are only blocked during the copy, though they
+// might not be included. The returned uint64 is the version of the snapshot,
+// which can be used as SnapshotArgs.Since for a later delta snapshot, such that
+// the delta includes exactly the data that this snapshot does not. Returns an
+// err if args.Ok() == false, or on a write err.
+func (h *Handle) SnapshotWithArgs(args SnapshotArgs) (uint64, error) {
+	if !args.Ok() {
+		return 0, errors.New("requestman: invalid snapshot args")
+	}
+	namespaces, version := h.knnNamespaces.snapshot()
+
+	var w io.Writer = args.W
+	var zw *gzip.Writer
+	if args.Compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+
+	bw := bufio.NewWriter(w)
+	sw := snapshotWriter{w: bw}
+	sw.writeBytes([]byte(snapshotMagic))
+	sw.writeByte(snapshotRecordVersion)
+	sw.writeUint64(args.Since)
+	sw.writeUint64(version)
+
+	for _, ns := range namespaces {
+		sw.writeByte(snapshotRecordNamespace)
+		sw.writeStr(ns.key)
+		sw.writeUint32(uint32(ns.dim))
+		for _, container := range ns.containers {
+			d := container.Distancer()
+			if d == nil {
+				continue
+			}
+
+			expires, added := int64(0), int64(0)
+			if dc, ok := container.(*DistancerContainer); ok {
+				if dc.seq <= args.Since {
+					continue
+				}
+				if !dc.Expires.IsZero() {
+					expires = dc.Expires.UnixNano()
+				}
+				if !dc.Added.IsZero() {
+					added = dc.Added.UnixNano()
+				}
+			}
+			id := ""
+			if ider, ok := d.(interface{ ID() string }); ok {
+				id = ider.ID()
+			}
+
+			sw.writeByte(snapshotRecordItem)
+			sw.writeUint32(uint32(d.Dim()))
+			for i := 0; i < d.Dim(); i++ {
+				elm, _ := d.Peek(i)
+				sw.writeUint64(math.Float64bits(elm))
+			}
+			sw.writeUint64(uint64(expires))
+			sw.writeStr(id)
+			sw.writeUint64(uint64(added))
+		}
+	}
+	sw.writeByte(snapshotRecordEnd)
+
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// AppendSnapshotFile appends a snapshot (see Handle.SnapshotWithArgs, args.W is
+// not used) to the file at 'path', which is created if it does not exist. With
+// args.Since set to the version of the previous snapshot in the file, the file
+// is a log of deltas, which is restored in one go with Handle.Restore. The file
+// is synced before it is closed. Returns the version of the snapshot, along with
+// errors from Handle.SnapshotWithArgs or from opening/writing/syncing the file.
+func (h *Handle) AppendSnapshotFile(path string, args SnapshotArgs) (uint64, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	args.W = f
+	version, err := h.SnapshotWithArgs(args)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return version, f.Close()
+}
+
+// restoreItem is an item read by Handle.Restore, which is added after all of
+// the snapshots in the reader are read.
+type restoreItem struct {
+	ns string
+	dc DistancerContainer
+}
+
+// Restore reads a snapshot (see Handle.Snapshot) from r, and adds all of it to
+// this Handle, i.e it creates namespaces (pinning dims with
+// Handle.CreateNamespace if they were pinned) and adds data with
+// Handle.AddDataErr. Vecs are added as mathx.FloatVec (with IDs, if set) and
+// keep their DistancerContainer.Added, while data that expired since the
+// snapshot was made is skipped (same for near-duplicates, see NearDupArgs). Compressed
+// snapshots (see SnapshotArgs.Compress) are detected and decompressed. Delta
+// snapshots (see SnapshotArgs.Since) are restored the same way, so the snapshot
+// they are based on must be restored first.
+//
+// r may contain multiple snapshots after each other (see
+// Handle.AppendSnapshotFile), which are read cumulatively: an item with an ID
+// replaces any earlier item with the same ID in the same namespace, i.e only
+// the latest version of each ID is added. Items are therefore added after all
+// of r is read.
+//
+// The returned int is the number of vecs that were added. Errors are:
+// - An error wrapping ErrInvalidSnapshot if the snapshot can not be read, in
+//   which case no vecs are added (though namespaces might be created).
+// - Errors returned by Handle.CreateNamespace or Handle.AddDataErr, wrapped
+//   with the namespace.
+// Note that everything added before an error is kept, i.e a restore might be
+// partial.
+func (h *Handle) Restore(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && string(magic) == gzipMagic {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	var items []restoreItem
+	// Key: namespace + "\x00" + ID, val: index in items.
+	ids := make(map[string]int)
+	sr := snapshotReader{r: br}
+	for {
+		if err := h.restoreNext(&sr, &items, ids); err != nil {
+			return 0, err
+		}
+		// Done unless another snapshot follows.
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		}
+	}
+
+	n := 0
+	now := time.Now()
+	for _, item := range items {
+		if !item.dc.Expires.IsZero() && now.After(item.dc.Expires) {
+			continue
+		}
+		err := h.AddDataErr(item.ns, item.dc, nil)
+		if errors.Is(err, ErrNearDuplicate) {
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("requestman: namespace '%v': %w", item.ns, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// restoreNext is a part of Handle.Restore, which reads a single snapshot from
+// sr (up to and including snapshotRecordEnd). Namespaces are created as they are
+// read, while items are put into 'items', where 'ids' is used for replacing
+// items with the same ID (see Handle.Restore).
+func (h *Handle) restoreNext(sr *snapshotReader, items *[]restoreItem, ids map[string]int) error {
+	magic := string(sr.readBytes(len(snapshotMagic)))
+	if sr.err != nil || (magic != snapshotMagic && magic != snapshotMagicV1) {
+		return fmt.Errorf("%w: missing header", ErrInvalidSnapshot)
+	}
+	hasAdded := magic == snapshotMagic
+
+	ns := ""
+	hasNamespace := false
+	for {
+		record := sr.readByte()
+		if sr.err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, sr.err)
+		}
+
+		switch record {
+		case snapshotRecordEnd:
+			return nil
+		case snapshotRecordVersion:
+			// Not needed for restoring, deltas are applied as-is.
+			sr.readUint64()
+			sr.readUint64()
+		case snapshotRecordNamespace:
+			ns = sr.readStr()
+			dim := sr.readUint32()
+			if sr.err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSnapshot, sr.err)
+			}
+			hasNamespace = true
+			if dim == 0 {
+				continue
+			}
+			if err := h.CreateNamespace(ns, int(dim)); err != nil {
+				return fmt.Errorf("requestman: namespace '%v': %w", ns, err)
+			}
+		case snapshotRecordItem:
+			dim := sr.readUint32()
+			if sr.err == nil && (dim > snapshotMaxDim || !hasNamespace) {
+				sr.err = errors.New("unexpected item")
+			}
+			vec := make([]float64, 0, dim)
+			for i := uint32(0); i < dim && sr.err == nil; i++ {
+				vec = append(vec, math.Float64frombits(sr.readUint64()))
+			}
+			expiresNano := int64(sr.readUint64())
+			id := sr.readStr()
+			addedNano := int64(0)
+			if hasAdded {
+				addedNano = int64(sr.readUint64())
+			}
+			if sr.err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSnapshot, sr.err)
+			}
+
+			item := restoreItem{
+				ns: ns,
+				dc: DistancerContainer{D: mathx.NewFloatVecWithID(vec, id)},
+			}
+			if addedNano != 0 {
+				item.dc.Added = time.Unix(0, addedNano)
+			}
+			if expiresNano != 0 {
+				item.dc.Expires = time.Unix(0, expiresNano)
+			}
+
+			if id == "" {
+				*items = append(*items, item)
+				continue
+			}
+			// Later versions replace earlier ones.
+			key := ns + "\x00" + id
+			if i, ok := ids[key]; ok {
+				(*items)[i] = item
+				continue
+			}
+			ids[key] = len(*items)
+			*items = append(*items, item)
+		default:
+			return fmt.Errorf("%w: unknown record type %v", ErrInvalidSnapshot, record)
+		}
+	}
+}
+
+// snapshotWriter writes the primitives of the snapshot format. The first err is
+// kept, after which all writes are no-ops.
+type snapshotWriter struct {
+	w   io.Writer
+	buf [8]byte
+	err error
+}
+
+func (sw *snapshotWriter) writeBytes(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) writeByte(b byte) {
+	sw.buf[0] = b
+	sw.writeBytes(sw.buf[:1])
+}
+
+func (sw *snapshotWriter) writeUint32(v uint32) {
+	binary.LittleEndian.PutUint32(sw.buf[:4], v)
+	sw.writeBytes(sw.buf[:4])
+}
+
+func (sw *snapshotWriter) writeUint64(v uint64) {
+	binary.LittleEndian.PutUint64(sw.buf[:8], v)
+	sw.writeBytes(sw.buf[:8])
+}
+
+func (sw *snapshotWriter) writeStr(s string) {
+	sw.writeUint32(uint32(len(s)))
+	sw.writeBytes([]byte(s))
+}
+
+// snapshotReader reads the primitives of the snapshot format. The first err is
+// kept, after which all reads return zero values.
+type snapshotReader struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+func (sr *snapshotReader) readBytes(n int) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		sr.err = err
+		return nil
+	}
+	return b
+}
+
+func (sr *snapshotReader) readByte() byte {
+	if sr.err == nil {
+		_, sr.err = io.ReadFull(sr.r, sr.buf[:1])
+	}
+	if sr.err != nil {
+		return 0
+	}
+	return sr.buf[0]
+}
+
+func (sr *snapshotReader) readUint32() uint32 {
+	if sr.err == nil {
+		_, sr.err = io.ReadFull(sr.r, sr.buf[:4])
+	}
+	if sr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(sr.buf[:4])
+}
+
+func (sr *snapshotReader) readUint64() uint64 {
+	if sr.err == nil {
+		_, sr.err = io.ReadFull(sr.r, sr.buf[:8])
+	}
+	if sr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(sr.buf[:8])
+}
+
+func (sr *snapshotReader) readStr() string {
+	n := sr.readUint32()
+	if sr.err == nil && n > snapshotMaxStrLen {
+		sr.err = errors.New("string too long")
+	}
+	return string(sr.readBytes(int(n)))
+}
@@ -0,0 +1,317 @@
+package requestman
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+// testSnapshotContent returns a sorted, printable representation of all data
+// in a Handle (namespace, pinned dim, vec, expiration, ID and added time), used
+// to compare a Handle with a restored one. Expired data is left out.
+func testSnapshotContent(h *Handle) []string {
+	var r []string
+	for _, ns := range h.knnNamespaces.keys() {
+		nsItem, _ := h.knnNamespaces.get(ns)
+		r = append(r, fmt.Sprintf("ns=%v pinned=%v", ns, nsItem.dim))
+		for _, container := range nsItem.searchSpaces.Snapshot() {
+			if container.Distancer() == nil {
+				continue
+			}
+			dc := container.(*DistancerContainer)
+			id := ""
+			if v, ok := dc.D.(*mathx.FloatVec); ok {
+				id = v.ID()
+			}
+			r = append(r, fmt.Sprintf(
+				"ns=%v vec=%v expires=%v id=%v added=%v",
+				ns,
+				distancerElements(dc.D),
+				dc.Expires.UnixNano(),
+				id,
+				dc.Added.UnixNano(),
+			))
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+func TestHandleSnapshotRestore(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+
+	// High-dimensional data, with a few decimals as is common for embeddings.
+	dim := 256
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 200; i++ {
+		v, _ := randFloat64Slice(dim)
+		for j := range v {
+			v[j] = mathx.RoundF64(v[j], 3)
+		}
+		dc := DistancerContainer{D: mathx.NewFloatVecWithID(v, fmt.Sprint("id", i))}
+		if i%2 == 0 {
+			dc = DistancerContainer{D: mathx.NewSafeVec(v...), Expires: expires}
+		}
+		if err := h.AddDataErr("a", dc, nil); err != nil {
+			t.Fatal("unexpected err when adding data:", err)
+		}
+	}
+	if err := h.CreateNamespace("b", 3); err != nil {
+		t.Fatal("unexpected err when creating a namespace:", err)
+	}
+	// Expired data is not included.
+	dc := DistancerContainer{
+		D:       mathx.NewSafeVec(1, 2, 3),
+		Expires: time.Now().Add(time.Millisecond * 10),
+	}
+	if err := h.AddDataErr("b", dc, nil); err != nil {
+		t.Fatal("unexpected err when adding data:", err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	raw, compressed := bytes.Buffer{}, bytes.Buffer{}
+	if _, err := h.Snapshot(&raw); err != nil {
+		t.Fatal("unexpected snapshot err:", err)
+	}
+	if _, err := h.SnapshotWithArgs(SnapshotArgs{W: &compressed, Compress: true}); err != nil {
+		t.Fatal("unexpected compressed snapshot err:", err)
+	}
+	if compressed.Len() >= raw.Len() {
+		t.Fatalf("compressed snapshot is not smaller: %v >= %v", compressed.Len(), raw.Len())
+	}
+
+	want := testSnapshotContent(h)
+	for _, buf := range []*bytes.Buffer{&raw, &compressed} {
+		restored := newTestHandleCleanup(t, 100, 100)
+		n, err := restored.Restore(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal("unexpected restore err:", err)
+		}
+		if n != 200 {
+			t.Fatal("unexpected restore count:", n)
+		}
+
+		// IDs are kept, but all vecs are restored as mathx.FloatVec, so SafeVec
+		// instances (without IDs) show up the same way.
+		have := testSnapshotContent(restored)
+		if fmt.Sprint(have) != fmt.Sprint(want) {
+			t.Fatalf("restored content differs:\nwant %v\nhave %v", want, have)
+		}
+		if dim, _ := restored.Info().SSpacePinnedDim("b"); dim != 3 {
+			t.Fatal("unexpected pinned dim:", dim)
+		}
+	}
+
+	// Invalid snapshots.
+	for _, b := range [][]byte{nil, []byte("not a snapshot"), raw.Bytes()[:raw.Len()/2]} {
+		_, err := newTestHandleCleanup(t, 100, 100).Restore(bytes.NewReader(b))
+		if !errors.Is(err, ErrInvalidSnapshot) {
+			t.Fatalf("want ErrInvalidSnapshot, have %v", err)
+		}
+	}
+	if _, err := h.SnapshotWithArgs(SnapshotArgs{}); err == nil {
+		t.Fatal("unexpected nil err without a writer")
+	}
+}
+
+func TestHandleSnapshotDelta(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+
+	dim := 8
+	add := func(ns string, n int, expires time.Time) {
+		for i := 0; i < n; i++ {
+			v, _ := randFloat64Slice(dim)
+			dc := DistancerContainer{D: mathx.NewSafeVec(v...), Expires: expires}
+			if err := h.AddDataErr(ns, dc, nil); err != nil {
+				t.Fatal("unexpected err when adding data:", err)
+			}
+		}
+	}
+
+	// Some of the base data is removed (expires) before the delta.
+	add("a", 100, time.Time{})
+	add("a", 10, time.Now().Add(time.Millisecond*10))
+	base := bytes.Buffer{}
+	version, err := h.Snapshot(&base)
+	if err != nil {
+		t.Fatal("unexpected snapshot err:", err)
+	}
+	if version != 110 {
+		t.Fatal("unexpected snapshot version:", version)
+	}
+
+	add("a", 20, time.Time{})
+	add("b", 5, time.Now().Add(time.Hour))
+	time.Sleep(time.Millisecond * 20)
+
+	delta := bytes.Buffer{}
+	deltaVersion, err := h.SnapshotWithArgs(SnapshotArgs{W: &delta, Since: version})
+	if err != nil {
+		t.Fatal("unexpected delta snapshot err:", err)
+	}
+	if deltaVersion != 135 {
+		t.Fatal("unexpected delta snapshot version:", deltaVersion)
+	}
+
+	restored := newTestHandleCleanup(t, 100, 100)
+	for i, buf := range []*bytes.Buffer{&base, &delta} {
+		if _, err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("unexpected restore err for snapshot %v: %v", i, err)
+		}
+	}
+	// The expired base data is skipped by Restore, and left out of the content.
+	want, have := testSnapshotContent(h), testSnapshotContent(restored)
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("restored content differs:\nwant %v\nhave %v", want, have)
+	}
+	if len(want) != 127 { // 2 namespace lines.
+		t.Fatal("unexpected content len:", len(want))
+	}
+
+	// A delta without changes has no data.
+	empty := bytes.Buffer{}
+	if _, err := h.SnapshotWithArgs(SnapshotArgs{W: &empty, Since: deltaVersion}); err != nil {
+		t.Fatal("unexpected delta snapshot err:", err)
+	}
+	if n, err := newTestHandleCleanup(t, 100, 100).Restore(&empty); n != 0 || err != nil {
+		t.Fatalf("unexpected restore of an empty delta: %v/%v", n, err)
+	}
+}
+
+func TestHandleSnapshotAdded(t *testing.T) {
+	h := newTestHandleCleanup(t, 100, 100)
+
+	before := time.Now()
+	if err := h.AddDataErr("a", DistancerContainer{D: mathx.NewSafeVec(1, 2)}, nil); err != nil {
+		t.Fatal("unexpected err when adding data:", err)
+	}
+	// Given times are kept.
+	given := before.Add(-time.Hour)
+	dc := DistancerContainer{D: mathx.NewSafeVec(3, 4), Added: given}
+	if err := h.AddDataErr("a", dc, nil); err != nil {
+		t.Fatal("unexpected err when adding data:", err)
+	}
+
+	nsItem, _ := h.knnNamespaces.get("a")
+	for _, container := range nsItem.searchSpaces.Snapshot() {
+		dc := container.(*DistancerContainer)
+		if dc.Added.Equal(given) {
+			continue
+		}
+		if dc.Added.Before(before) || dc.Added.After(time.Now()) {
+			t.Fatalf("unexpected added time: %v (added after %v)", dc.Added, before)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if _, err := h.Snapshot(&buf); err != nil {
+		t.Fatal("unexpected snapshot err:", err)
+	}
+	// Restored later, but the added times are from the snapshot.
+	time.Sleep(time.Millisecond * 10)
+	restored := newTestHandleCleanup(t, 100, 100)
+	if _, err := restored.Restore(&buf); err != nil {
+		t.Fatal("unexpected restore err:", err)
+	}
+	want, have := testSnapshotContent(h), testSnapshotContent(restored)
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("restored content differs:\nwant %v\nhave %v", want, have)
+	}
+
+	// Snapshots without added times (v1) are still accepted.
+	v1 := bytes.Buffer{}
+	sw := snapshotWriter{w: &v1}
+	sw.writeBytes([]byte(snapshotMagicV1))
+	sw.writeByte(snapshotRecordNamespace)
+	sw.writeStr("a")
+	sw.writeUint32(0)
+	sw.writeByte(snapshotRecordItem)
+	sw.writeUint32(1)
+	sw.writeUint64(math.Float64bits(1))
+	sw.writeUint64(0)
+	sw.writeStr("id")
+	sw.writeByte(snapshotRecordEnd)
+
+	before = time.Now()
+	restoredV1 := newTestHandleCleanup(t, 100, 100)
+	if n, err := restoredV1.Restore(&v1); n != 1 || err != nil {
+		t.Fatalf("unexpected restore of a v1 snapshot: %v/%v", n, err)
+	}
+	nsItem, _ = restoredV1.knnNamespaces.get("a")
+	for _, container := range nsItem.searchSpaces.Snapshot() {
+		if added := container.(*DistancerContainer).Added; added.Before(before) {
+			t.Fatal("unexpected added time for a v1 snapshot:", added)
+		}
+	}
+}
+
+func TestHandleAppendSnapshotFile(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		h := newTestHandleCleanup(t, 100, 100)
+		path := filepath.Join(t.TempDir(), "snapshot")
+
+		// Key: ID, val: latest vec.
+		latest := make(map[string][]float64)
+		put := func(id string) {
+			h.DeleteWhere("a", func(other string, _ mathx.Distancer, _ time.Time) bool {
+				return other == id
+			})
+			v, _ := randFloat64Slice(4)
+			if err := h.AddDataErr("a", DistancerContainer{D: mathx.NewFloatVecWithID(v, id)}, nil); err != nil {
+				t.Fatal("unexpected err when adding data:", err)
+			}
+			latest[id] = v
+		}
+
+		// Base, then two deltas where some of the IDs are updated each time.
+		version := uint64(0)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 10; i++ {
+				if round == 0 || i%(round+1) == 0 {
+					put(fmt.Sprint("id", i))
+				}
+			}
+			var err error
+			version, err = h.AppendSnapshotFile(path, SnapshotArgs{Since: version, Compress: compress})
+			if err != nil {
+				t.Fatal("unexpected snapshot err:", err)
+			}
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("could not open the snapshot file:", err)
+		}
+		defer f.Close()
+		restored := newTestHandleCleanup(t, 100, 100)
+		n, err := restored.Restore(f)
+		if err != nil {
+			t.Fatal("unexpected restore err:", err)
+		}
+		if n != len(latest) {
+			t.Fatalf("want %v restored vecs, have %v (compress=%v)", len(latest), n, compress)
+		}
+
+		// The restored content is the latest version of each ID, which is the
+		// same as the content of the original handle.
+		want, have := testSnapshotContent(h), testSnapshotContent(restored)
+		if fmt.Sprint(have) != fmt.Sprint(want) {
+			t.Fatalf("restored content differs:\nwant %v\nhave %v", want, have)
+		}
+		nsItem, _ := restored.knnNamespaces.get("a")
+		for _, container := range nsItem.searchSpaces.Snapshot() {
+			v := container.Distancer().(*mathx.FloatVec)
+			if fmt.Sprint(distancerElements(v)) != fmt.Sprint(latest[v.ID()]) {
+				t.Fatalf("restored vec of %v is not the latest version", v.ID())
+			}
+		}
+	}
+}
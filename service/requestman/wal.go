@@ -0,0 +1,565 @@
+package requestman
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/mathx"
+)
+
+/*
+File contains an optional write-ahead log (WAL) for T Handle, see WALArgs. All
+writes (Handle.AddData, Handle.DeleteWhere and Handle.CreateNamespace) are
+appended to the log before they are applied, and the log is replayed by
+NewHandle, such that data survives a crash. Handle.RotateWAL writes a snapshot
+(see snapshot.go) and truncates the log, such that it does not grow forever.
+
+The log starts with walMagic, followed by records. Each record starts with a
+single byte (walRecordX) which tells what follows:
+	- walRecordNamespace: a string (namespace) and uint32 (pinned dim).
+	- walRecordAdd: a string (namespace), an item and a string
+	  (DistancerContainer.Tenant).
+	- walRecordDelete: a string (namespace) and uint32 (n), followed by n
+	  items, which are the deleted ones.
+	- walRecordCheckpoint: a uint64, the hash of the snapshot written by
+	  Handle.RotateWAL. Records before it are in that snapshot.
+Items have the same fields as snapshotRecordItem in snapshots, and the
+primitives are written the same way (see snapshotWriter).
+*/
+
+// walMagic is written first in every log.
+const walMagic = "ddrop:wal:v1\n"
+
+// Record types of a log, see the doc at the top of this file.
+const (
+	walRecordNamespace byte = iota + 1
+	walRecordAdd
+	walRecordDelete
+	walRecordCheckpoint
+)
+
+// Errors related to the WAL, see WALArgs.
+var (
+	ErrWAL         = errors.New("requestman: write-ahead log failed")
+	ErrWALDisabled = errors.New("requestman: write-ahead log is not enabled")
+)
+
+// WALSyncPolicy decides when the write-ahead log is synced to disk (fsync), which
+// is a trade-off between durability and write throughput. See WALArgs.
+type WALSyncPolicy int
+
+const (
+	// WALSyncEveryWrite syncs after every write, i.e a write is on disk when
+	// Handle.AddData (etc) returns. This is the safest and slowest policy.
+	WALSyncEveryWrite WALSyncPolicy = iota
+	// WALSyncInterval syncs (at most) once per WALArgs.SyncInterval, if there
+	// were writes since the last sync. Writes within the last interval might
+	// be lost on a crash of the machine (not of the process).
+	WALSyncInterval
+	// WALSyncNone never syncs, i.e it is left to the OS. This is the fastest
+	// policy, though the OS might keep writes in memory for a while.
+	WALSyncNone
+)
+
+// walDefaultSyncInterval is the default of WALArgs.SyncInterval.
+const walDefaultSyncInterval = time.Millisecond * 100
+
+// WALArgs configures the write-ahead log of a Handle, see NewHandleArgs.WAL.
+type WALArgs struct {
+	// Path is the file of the log, which is created if it does not exist, and
+	// replayed by NewHandle if it does. Empty (default) disables the log.
+	Path string
+	// SnapshotPath is the file of the snapshot written by Handle.RotateWAL,
+	// which is restored by NewHandle before the log is replayed.
+	// Optional, empty defaults to Path + ".snapshot".
+	SnapshotPath string
+	// Compress is used as SnapshotArgs.Compress by Handle.RotateWAL.
+	Compress bool
+	// SyncPolicy decides when the log is synced, see WALSyncPolicy.
+	// Optional, defaults to WALSyncEveryWrite.
+	SyncPolicy WALSyncPolicy
+	// SyncInterval is used with WALSyncInterval.
+	// Optional, 0 defaults to 100ms.
+	SyncInterval time.Duration
+}
+
+// Ok returns true if all the following conditions are true:
+// - args.SyncPolicy is one of the WALSyncX consts
+// - args.SyncInterval >= 0
+func (args *WALArgs) Ok() bool {
+	ok := true
+	ok = ok && args.SyncPolicy >= WALSyncEveryWrite && args.SyncPolicy <= WALSyncNone
+	ok = ok && args.SyncInterval >= 0
+	return ok
+}
+
+// walSyncer syncs the write-ahead log to disk, it is an *os.File except in tests.
+type walSyncer interface {
+	Sync() error
+}
+
+// wal implements the write-ahead log of a Handle. Set it up with openWAL.
+//
+// Note; thread safe, though mx must be held by the caller of the append
+// methods (such that the append and the write it logs happen together).
+type wal struct {
+	mx           sync.Mutex
+	f            *os.File
+	syncer       walSyncer
+	syncPolicy   WALSyncPolicy
+	snapshotPath string
+	compress     bool
+	closed       bool
+	// dirty is true if there were writes since the last sync.
+	dirty bool
+	// done is closed by wal.close, it stops the loop of WALSyncInterval.
+	done chan struct{}
+}
+
+// walEntry is a record read from a log by openWAL.
+type walEntry struct {
+	record byte
+	ns     string
+	dim    int
+	items  []DistancerContainer
+	hash   uint64
+}
+
+// openWAL restores the snapshot at args.SnapshotPath (if any) into h, replays the
+// log at args.Path (if any) and opens the log for appending. A log that ends
+// with a partial record (e.g due to a crash during a write) is truncated after
+// the last complete one. Returns nil if args.Path is empty, i.e the log is
+// disabled. The log must be set as Handle.wal after this, such that the replay
+// is not logged again.
+func openWAL(h *Handle, args WALArgs) (*wal, error) {
+	if args.Path == "" {
+		return nil, nil
+	}
+	if args.SnapshotPath == "" {
+		args.SnapshotPath = args.Path + ".snapshot"
+	}
+
+	snapshotHash, err := restoreWALSnapshot(h, args.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(args.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	entries, size, err := readWAL(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Records before the last checkpoint are already in the snapshot, unless
+	// the snapshot was not written (i.e the hash is from an earlier one).
+	start := 0
+	for i, entry := range entries {
+		if entry.record == walRecordCheckpoint && entry.hash == snapshotHash {
+			start = i + 1
+		}
+	}
+	for _, entry := range entries[start:] {
+		h.replayWALEntry(entry)
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := &wal{
+		f:            f,
+		syncer:       f,
+		syncPolicy:   args.SyncPolicy,
+		snapshotPath: args.SnapshotPath,
+		compress:     args.Compress,
+		done:         make(chan struct{}),
+	}
+	if size == 0 {
+		err := w.write(func(sw *snapshotWriter) { sw.writeBytes([]byte(walMagic)) })
+		if err == nil {
+			err = w.sync()
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if w.syncPolicy == WALSyncInterval {
+		interval := args.SyncInterval
+		if interval == 0 {
+			interval = walDefaultSyncInterval
+		}
+		go w.syncLoop(interval)
+	}
+	return w, nil
+}
+
+// restoreWALSnapshot restores the snapshot at 'path' into h, and returns its
+// hash (see walRecordCheckpoint). Returns 0 if the file does not exist.
+func restoreWALSnapshot(h *Handle, path string) (uint64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hash := fnv.New64a()
+	r := io.TeeReader(f, hash)
+	if _, err := h.Restore(r); err != nil {
+		return 0, err
+	}
+	// Restore might not read all of it, the hash should include everything.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return 0, err
+	}
+	return hash.Sum64(), nil
+}
+
+// readWAL reads all complete records of the log in f. The returned int64 is the
+// size of the log up to and including the last complete record, which is 0 if
+// the log is empty (or does not even have a complete magic).
+func readWAL(f *os.File) ([]walEntry, int64, error) {
+	cr := &countingReader{r: bufio.NewReader(f)}
+	sr := snapshotReader{r: cr}
+
+	magic := string(sr.readBytes(len(walMagic)))
+	if isPartialRead(sr.err) {
+		return nil, 0, nil
+	}
+	if sr.err != nil || magic != walMagic {
+		return nil, 0, fmt.Errorf("%w: missing header", ErrWAL)
+	}
+
+	var entries []walEntry
+	for {
+		size := cr.n
+		entry := walEntry{record: sr.readByte()}
+		switch entry.record {
+		case walRecordNamespace:
+			entry.ns = sr.readStr()
+			entry.dim = int(sr.readUint32())
+		case walRecordAdd:
+			entry.ns = sr.readStr()
+			dc := readWALItem(&sr)
+			dc.Tenant = sr.readStr()
+			entry.items = []DistancerContainer{dc}
+		case walRecordDelete:
+			entry.ns = sr.readStr()
+			n := sr.readUint32()
+			for i := uint32(0); i < n && sr.err == nil; i++ {
+				entry.items = append(entry.items, readWALItem(&sr))
+			}
+		case walRecordCheckpoint:
+			entry.hash = sr.readUint64()
+		default:
+			if sr.err == nil {
+				sr.err = fmt.Errorf("unknown record type %v", entry.record)
+			}
+		}
+
+		if isPartialRead(sr.err) {
+			return entries, size, nil
+		}
+		if sr.err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrWAL, sr.err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// isPartialRead returns true if err is due to reaching the end of the log,
+// possibly in the middle of a record.
+func isPartialRead(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// replayWALEntry applies a single record of the log to h. Errors are ignored,
+// as records are logged before they are applied, i.e the original write might
+// have failed as well.
+func (h *Handle) replayWALEntry(entry walEntry) {
+	switch entry.record {
+	case walRecordNamespace:
+		h.CreateNamespace(entry.ns, entry.dim)
+	case walRecordAdd:
+		dc := entry.items[0]
+		if !dc.Expires.IsZero() && time.Now().After(dc.Expires) {
+			return
+		}
+		h.AddDataErr(entry.ns, dc, nil)
+	case walRecordDelete:
+		nsItem, ok := h.knnNamespaces.get(entry.ns)
+		if !ok {
+			return
+		}
+		keys := make(map[string]struct{}, len(entry.items))
+		for i := range entry.items {
+			keys[walItemKey(&entry.items[i])] = struct{}{}
+		}
+		h.removeWhere(nsItem, func(dc *DistancerContainer) bool {
+			_, ok := keys[walItemKey(dc)]
+			return ok
+		})
+	}
+}
+
+// walItemKey identifies an item in walRecordDelete, i.e it is the same for
+// the logged item and the item in the Handle (see Handle.replayWALEntry).
+func walItemKey(dc *DistancerContainer) string {
+	var sb strings.Builder
+	sb.WriteString(dc.ID())
+	sb.WriteByte(0)
+	sb.WriteString(strconv.FormatInt(dc.Added.UnixNano(), 36))
+	for i := 0; i < dc.D.Dim(); i++ {
+		elm, _ := dc.D.Peek(i)
+		sb.WriteByte(0)
+		sb.WriteString(strconv.FormatUint(math.Float64bits(elm), 36))
+	}
+	return sb.String()
+}
+
+// write calls fn with a snapshotWriter (where the record should be written),
+// then writes the record to the log, which is synced if the policy is
+// WALSyncEveryWrite. The caller must hold w.mx.
+func (w *wal) write(fn func(sw *snapshotWriter)) error {
+	if w.closed {
+		return fmt.Errorf("%w: closed", ErrWAL)
+	}
+	bw := bufio.NewWriter(w.f)
+	sw := snapshotWriter{w: bw}
+	fn(&sw)
+
+	err := sw.err
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWAL, err)
+	}
+	w.dirty = true
+	if w.syncPolicy == WALSyncEveryWrite {
+		return w.sync()
+	}
+	return nil
+}
+
+// sync syncs the log to disk, regardless of the policy. The caller must hold
+// w.mx.
+func (w *wal) sync() error {
+	if err := w.syncer.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrWAL, err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// syncLoop implements WALSyncInterval, it syncs the log every interval if it
+// is dirty, until wal.close is called. This method will block.
+func (w *wal) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mx.Lock()
+			if w.dirty && !w.closed {
+				w.sync()
+			}
+			w.mx.Unlock()
+		}
+	}
+}
+
+// appendNamespace logs Handle.CreateNamespace. The caller must hold w.mx.
+func (w *wal) appendNamespace(ns string, dim int) error {
+	return w.write(func(sw *snapshotWriter) {
+		sw.writeByte(walRecordNamespace)
+		sw.writeStr(ns)
+		sw.writeUint32(uint32(dim))
+	})
+}
+
+// appendAdd logs Handle.AddData. The caller must hold w.mx.
+func (w *wal) appendAdd(ns string, dc *DistancerContainer) error {
+	return w.write(func(sw *snapshotWriter) {
+		sw.writeByte(walRecordAdd)
+		sw.writeStr(ns)
+		writeWALItem(sw, dc)
+		sw.writeStr(dc.Tenant)
+	})
+}
+
+// appendDelete logs Handle.DeleteWhere. The caller must hold w.mx.
+func (w *wal) appendDelete(ns string, dcs []*DistancerContainer) error {
+	return w.write(func(sw *snapshotWriter) {
+		sw.writeByte(walRecordDelete)
+		sw.writeStr(ns)
+		sw.writeUint32(uint32(len(dcs)))
+		for _, dc := range dcs {
+			writeWALItem(sw, dc)
+		}
+	})
+}
+
+// close closes the log, after which all appends fail. Pending writes are
+// synced first, unless the policy is WALSyncNone.
+func (w *wal) close() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	if w.dirty && w.syncPolicy != WALSyncNone {
+		w.sync()
+	}
+	return w.f.Close()
+}
+
+// writeWALItem writes the same fields as snapshotRecordItem in snapshots.
+func writeWALItem(sw *snapshotWriter, dc *DistancerContainer) {
+	expires, added := int64(0), int64(0)
+	if !dc.Expires.IsZero() {
+		expires = dc.Expires.UnixNano()
+	}
+	if !dc.Added.IsZero() {
+		added = dc.Added.UnixNano()
+	}
+
+	sw.writeUint32(uint32(dc.D.Dim()))
+	for i := 0; i < dc.D.Dim(); i++ {
+		elm, _ := dc.D.Peek(i)
+		sw.writeUint64(math.Float64bits(elm))
+	}
+	sw.writeUint64(uint64(expires))
+	sw.writeStr(dc.ID())
+	sw.writeUint64(uint64(added))
+}
+
+// readWALItem reads an item written by writeWALItem.
+func readWALItem(sr *snapshotReader) DistancerContainer {
+	dim := sr.readUint32()
+	if sr.err == nil && dim > snapshotMaxDim {
+		sr.err = errors.New("unexpected item")
+	}
+	vec := make([]float64, 0, dim)
+	for i := uint32(0); i < dim && sr.err == nil; i++ {
+		vec = append(vec, math.Float64frombits(sr.readUint64()))
+	}
+	expiresNano := int64(sr.readUint64())
+	id := sr.readStr()
+	addedNano := int64(sr.readUint64())
+
+	dc := DistancerContainer{D: mathx.NewFloatVecWithID(vec, id)}
+	if expiresNano != 0 {
+		dc.Expires = time.Unix(0, expiresNano)
+	}
+	if addedNano != 0 {
+		dc.Added = time.Unix(0, addedNano)
+	}
+	return dc
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// RotateWAL writes a snapshot of all data (see Handle.SnapshotWithArgs) to
+// WALArgs.SnapshotPath, after which the log is truncated, as everything in it
+// is then in the snapshot. The snapshot is written to a temporary file which
+// replaces the previous one when it is complete, and a checkpoint is logged
+// (and synced, regardless of WALArgs.SyncPolicy) before that, such that a crash
+// at any point is recovered by NewHandle. Writes
+// to this Handle are blocked while this runs. Returns the version of the
+// snapshot, or an err if the log is not enabled (ErrWALDisabled), or if any of
+// the file operations fail (in which case the log is kept as is).
+func (h *Handle) RotateWAL() (uint64, error) {
+	if h.wal == nil {
+		return 0, ErrWALDisabled
+	}
+	w := h.wal
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.closed {
+		return 0, fmt.Errorf("%w: closed", ErrWAL)
+	}
+
+	tmpPath := w.snapshotPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	hash := fnv.New64a()
+	args := SnapshotArgs{W: io.MultiWriter(f, hash), Compress: w.compress}
+	version, err := h.SnapshotWithArgs(args)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	err = w.write(func(sw *snapshotWriter) {
+		sw.writeByte(walRecordCheckpoint)
+		sw.writeUint64(hash.Sum64())
+	})
+	if err == nil {
+		err = w.sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, w.snapshotPath); err != nil {
+		return 0, err
+	}
+
+	// Start over with an empty log.
+	if err := w.f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	err = w.write(func(sw *snapshotWriter) { sw.writeBytes([]byte(walMagic)) })
+	if err == nil {
+		err = w.sync()
+	}
+	return version, err
+}
@@ -0,0 +1,196 @@
+package requestman
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crunchypi/ddrop/pkg/knnc"
+	"github.com/crunchypi/ddrop/pkg/mathx"
+	"github.com/crunchypi/ddrop/pkg/timex"
+)
+
+// newTestWALHandle is the same as newTestHandle, except that it uses 'args' as
+// NewHandleArgs.WAL. Returns false if NewHandle does.
+func newTestWALHandle(ctx context.Context, args WALArgs) (*Handle, bool) {
+	return NewHandle(NewHandleArgs{
+		NewSearchSpaceArgs: knnc.NewSearchSpacesArgs{
+			SearchSpacesMaxCap:      100,
+			SearchSpacesMaxN:        100,
+			MaintenanceTaskInterval: time.Millisecond * 100,
+		},
+		NewLatencyTrackerArgs: timex.NewLatencyTrackerArgs{
+			MaxChainLinkN:    10,
+			MinChainLinkSize: time.Millisecond * 100,
+			StandardPeriod:   time.Second,
+		},
+		KNNQueueBuf:           10,
+		KNNQueueMaxConcurrent: 10,
+		Ctx:                   ctx,
+		NewKNNMonitorArgs: timex.NewLatencyTrackerArgs{
+			MaxChainLinkN:    1,
+			MinChainLinkSize: time.Second,
+		},
+		WAL: args,
+	})
+}
+
+func TestHandleWAL(t *testing.T) {
+	args := WALArgs{Path: filepath.Join(t.TempDir(), "wal")}
+	// A crash is simulated by never closing the Handle instances, i.e the next
+	// one replays the log as-is.
+	h, ok := newTestWALHandle(context.Background(), args)
+	if !ok {
+		t.Fatal("could not create a handle with a wal")
+	}
+	if err := h.CreateNamespace("pinned", 4); err != nil {
+		t.Fatalf("could not create namespace: %v", err)
+	}
+	addTestData := func(h *Handle, from, to int) {
+		for i := from; i < to; i++ {
+			v, _ := randFloat64Slice(4)
+			dc := DistancerContainer{D: mathx.NewFloatVecWithID(v, fmt.Sprint("id", i))}
+			if i%3 == 0 {
+				dc.Expires = time.Now().Add(time.Hour)
+			}
+			if err := h.AddDataErr([]string{"a", "pinned"}[i%2], dc, nil); err != nil {
+				t.Fatalf("could not add data: %v", err)
+			}
+		}
+	}
+	addTestData(h, 0, 100)
+	n := h.DeleteWhere("a", func(id string, _ mathx.Distancer, _ time.Time) bool {
+		return id < "id3"
+	})
+	if n == 0 {
+		t.Fatal("deleted nothing")
+	}
+
+	want := testSnapshotContent(h)
+	h, ok = newTestWALHandle(context.Background(), args)
+	if !ok {
+		t.Fatal("could not replay the wal")
+	}
+	if have := testSnapshotContent(h); !reflect.DeepEqual(have, want) {
+		t.Fatalf("unexpected content after replay:\nhave: %v\nwant: %v", have, want)
+	}
+
+	// Rotation truncates the log, the data is then in the snapshot.
+	if _, err := h.RotateWAL(); err != nil {
+		t.Fatalf("could not rotate the wal: %v", err)
+	}
+	if stat, _ := os.Stat(args.Path); stat.Size() != int64(len(walMagic)) {
+		t.Fatalf("unexpected wal size after rotation: %v", stat.Size())
+	}
+	addTestData(h, 100, 150)
+	h.DeleteWhere("pinned", func(id string, _ mathx.Distancer, _ time.Time) bool {
+		return id < "id2"
+	})
+
+	// A partial record at the end (e.g a crash during a write) is dropped.
+	f, _ := os.OpenFile(args.Path, os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write([]byte{walRecordAdd, 1, 0})
+	f.Close()
+
+	want = testSnapshotContent(h)
+	h, ok = newTestWALHandle(context.Background(), args)
+	if !ok {
+		t.Fatal("could not replay the wal after rotation")
+	}
+	if have := testSnapshotContent(h); !reflect.DeepEqual(have, want) {
+		t.Fatalf("unexpected content after rotation and replay:\nhave: %v\nwant: %v", have, want)
+	}
+	if pinned, _ := h.Info().SSpacePinnedDim("pinned"); pinned != 4 {
+		t.Fatalf("unexpected pinned dim after replay: %v", pinned)
+	}
+
+	// A checkpoint without the snapshot (i.e a crash during rotation) is ignored.
+	addTestData(h, 150, 160)
+	want = testSnapshotContent(h)
+	h.wal.mx.Lock()
+	h.wal.write(func(sw *snapshotWriter) {
+		sw.writeByte(walRecordCheckpoint)
+		sw.writeUint64(1)
+	})
+	h.wal.mx.Unlock()
+	h, ok = newTestWALHandle(context.Background(), args)
+	if !ok {
+		t.Fatal("could not replay the wal with a checkpoint")
+	}
+	if have := testSnapshotContent(h); !reflect.DeepEqual(have, want) {
+		t.Fatalf("unexpected content after a failed rotation:\nhave: %v\nwant: %v", have, want)
+	}
+
+	if _, err := newTestHandleCleanup(t, 10, 10).RotateWAL(); err != ErrWALDisabled {
+		t.Fatalf("unexpected err when rotating without a wal: %v", err)
+	}
+}
+
+// testSyncer is a walSyncer which counts the syncs.
+type testSyncer struct {
+	n int64
+}
+
+func (s *testSyncer) Sync() error {
+	atomic.AddInt64(&s.n, 1)
+	return nil
+}
+
+func TestHandleWALSyncPolicy(t *testing.T) {
+	nWrites := 100
+	interval := time.Millisecond * 50
+	for _, policy := range []WALSyncPolicy{WALSyncEveryWrite, WALSyncInterval, WALSyncNone} {
+		args := WALArgs{
+			Path:         filepath.Join(t.TempDir(), "wal"),
+			SyncPolicy:   policy,
+			SyncInterval: interval,
+		}
+		h, ok := newTestWALHandle(context.Background(), args)
+		if !ok {
+			t.Fatalf("could not create a handle with sync policy %v", policy)
+		}
+		syncer := &testSyncer{}
+		h.wal.mx.Lock()
+		h.wal.syncer = syncer
+		h.wal.mx.Unlock()
+
+		start := time.Now()
+		for i := 0; i < nWrites; i++ {
+			v, _ := randFloat64Slice(4)
+			if err := h.AddDataErr("test", DistancerContainer{D: mathx.NewSafeVec(v...)}, nil); err != nil {
+				t.Fatalf("could not add data with sync policy %v: %v", policy, err)
+			}
+		}
+		elapsed := time.Since(start)
+		// Time for the interval loop to catch up.
+		time.Sleep(interval * 3)
+
+		n := int(atomic.LoadInt64(&syncer.n))
+		switch policy {
+		case WALSyncEveryWrite:
+			if n != nWrites {
+				t.Fatalf("unexpected syncs with every-write: %v", n)
+			}
+		case WALSyncInterval:
+			// At most one per interval while writing, and one for the rest.
+			maxN := int(elapsed/interval) + 2
+			if n < 1 || n > maxN {
+				t.Fatalf("unexpected syncs with interval: %v, want [1, %v]", n, maxN)
+			}
+		case WALSyncNone:
+			if n != 0 {
+				t.Fatalf("unexpected syncs with none: %v", n)
+			}
+		}
+	}
+
+	args := WALArgs{Path: "wal", SyncPolicy: WALSyncNone + 1}
+	if args.Ok() {
+		t.Fatal("args with an invalid sync policy are ok")
+	}
+}